@@ -24,9 +24,11 @@ import (
 	"fmt"
 
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -37,77 +39,86 @@ import (
 )
 
 func (c *Controller) initAzureKeyVaultSecret() {
-	_, err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			akvs, err := convertToAzureKeyVaultSecret(obj)
-			if err != nil {
-				klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
-				syncFailures.WithLabelValues("add", "AzureKeyVaultSecret").Inc()
-				return
-			}
-
-			if c.akvsHasOutputDefined(akvs) {
-				klog.V(4).InfoS("adding to queue", "azurekeyvaultsecret", klog.KObj(akvs))
-				syncCounter.WithLabelValues("add", "AzureKeyVaultSecret").Inc()
-				queue.Enqueue(c.akvsCrdQueue.GetQueue(), obj)
-			}
-		},
-		UpdateFunc: func(old, new interface{}) {
-			newAkvs, err := convertToAzureKeyVaultSecret(new)
-			if err != nil {
-				klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
-				syncFailures.WithLabelValues("update", "AzureKeyVault").Inc()
-				return
-			}
-
-			oldAkvs, err := convertToAzureKeyVaultSecret(old)
-			if err != nil {
-				klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
-				syncFailures.WithLabelValues("update", "AzureKeyVault").Inc()
-				return
-			}
-
-			// If akvs has not changed and has secret output, add to akv queue to check if secret has changed in akv
-			if newAkvs.ResourceVersion == oldAkvs.ResourceVersion && c.akvsHasOutputDefined(newAkvs) {
-				klog.V(4).InfoS("adding to azure key vault queue to check if secret has changed in azure key vault", "azurekeyvaultsecret", klog.KObj(newAkvs))
-				syncCounter.WithLabelValues("update", "AzureKeyVault").Inc()
-				queue.Enqueue(c.azureKeyVaultQueue.GetQueue(), new)
-				return
-			}
+	// AzureKeyVaultSecrets in namespaces that are not watched are ignored entirely
+	_, err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: c.isObjectWatched,
+		Handler: cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				akvs, err := convertToAzureKeyVaultSecret(obj)
+				if err != nil {
+					klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
+					syncFailures.WithLabelValues("add", "AzureKeyVaultSecret").Inc()
+					return
+				}
 
-			if c.akvsHasOutputDefined(newAkvs) || c.akvsHasOutputDefined(oldAkvs) {
-				klog.V(4).InfoS("azurekeyvaultsecret changed - adding to queue", "azurekeyvaultsecret", klog.KObj(newAkvs))
-				syncCounter.WithLabelValues("update", "AzureKeyVaultSecret").Inc()
-				queue.Enqueue(c.akvsCrdQueue.GetQueue(), new)
-			}
-		},
-		DeleteFunc: func(obj interface{}) {
-			akvs, err := convertToAzureKeyVaultSecret(obj)
-			if err != nil {
-				klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
-				syncFailures.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
-				return
-			}
+				if !c.isSelected(akvs) {
+					klog.V(5).InfoS("azurekeyvaultsecret does not match label selector - skipping", "azurekeyvaultsecret", klog.KObj(akvs))
+					return
+				}
 
-			if c.akvsHasOutputDefined(akvs) {
-				klog.V(4).InfoS("azurekeyvaultsecret deleted - adding to queue", "azurekeyvaultsecret", klog.KObj(akvs))
-				syncCounter.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
-				queue.Enqueue(c.akvsCrdQueue.GetQueue(), obj)
+				if c.akvsHasOutputDefined(akvs) {
+					// on startup, keep the poll schedule from before the restart
+					if isInInitialList && c.scheduleStoredAzurePoll(akvs) {
+						return
+					}
 
-				err = c.deleteKubernetesValues(akvs)
+					klog.V(4).InfoS("adding to queue", "azurekeyvaultsecret", klog.KObj(akvs))
+					syncCounter.WithLabelValues("add", "AzureKeyVaultSecret").Inc()
+					queue.Enqueue(c.akvsCrdQueue.GetQueue(), obj)
+				}
+			},
+			UpdateFunc: func(old, new interface{}) {
+				newAkvs, err := convertToAzureKeyVaultSecret(new)
 				if err != nil {
-					klog.ErrorS(err, "failed to delete secret data from azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs))
-					syncFailures.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
+					klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
+					syncFailures.WithLabelValues("update", "AzureKeyVault").Inc()
+					return
 				}
 
-				// Getting default key to remove from Azure work queue
-				key, err := cache.MetaNamespaceKeyFunc(obj)
+				oldAkvs, err := convertToAzureKeyVaultSecret(old)
 				if err != nil {
-					utilruntime.HandleError(err)
+					klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
+					syncFailures.WithLabelValues("update", "AzureKeyVault").Inc()
 					return
 				}
-				c.azureKeyVaultQueue.GetQueue().Forget(key)
-			}
+
+				if !c.isSelected(newAkvs) {
+					klog.V(5).InfoS("azurekeyvaultsecret does not match label selector - skipping", "azurekeyvaultsecret", klog.KObj(newAkvs))
+					return
+				}
+				// labels changed, so the resource version differs and it is queued below
+				if !c.isSelected(oldAkvs) {
+					klog.V(4).InfoS("azurekeyvaultsecret now matches label selector", "azurekeyvaultsecret", klog.KObj(newAkvs))
+				}
+
+				// If akvs has not changed and has secret output, add to akv queue to check if secret has changed in akv
+				if newAkvs.ResourceVersion == oldAkvs.ResourceVersion && c.akvsHasOutputDefined(newAkvs) {
+					if c.options.DisableAzurePolling {
+						klog.V(5).InfoS("polling azure key vault is disabled - skipping", "azurekeyvaultsecret", klog.KObj(newAkvs))
+						return
+					}
+
+					klog.V(4).InfoS("adding to azure key vault queue to check if secret has changed in azure key vault", "azurekeyvaultsecret", klog.KObj(newAkvs))
+					syncCounter.WithLabelValues("update", "AzureKeyVault").Inc()
+					queue.Enqueue(c.azureKeyVaultQueue.GetQueue(), new)
+					return
+				}
+
+				if c.akvsHasOutputDefined(newAkvs) || c.akvsHasOutputDefined(oldAkvs) {
+					// Any change gets values from Azure Key Vault, so the force sync annotation works even if polling is disabled
+					if newAkvs.Annotations[AnnotationForceSync] != oldAkvs.Annotations[AnnotationForceSync] {
+						klog.InfoS("force sync requested", "azurekeyvaultsecret", klog.KObj(newAkvs), "value", newAkvs.Annotations[AnnotationForceSync])
+						if key, err := cache.MetaNamespaceKeyFunc(new); err == nil {
+							c.requestForceSync(key)
+						}
+					}
+
+					klog.V(4).InfoS("azurekeyvaultsecret changed - adding to queue", "azurekeyvaultsecret", klog.KObj(newAkvs))
+					syncCounter.WithLabelValues("update", "AzureKeyVaultSecret").Inc()
+					queue.Enqueue(c.akvsCrdQueue.GetQueue(), new)
+				}
+			},
+			DeleteFunc: c.handleDeletedAzureKeyVaultSecret,
 		},
 	})
 	if err != nil {
@@ -115,6 +126,55 @@ func (c *Controller) initAzureKeyVaultSecret() {
 	}
 }
 
+// handleDeletedAzureKeyVaultSecret removes the values of the deleted AzureKeyVaultSecret from its outputs,
+// or releases outputs with reclaimPolicy Retain, where obj may be a tombstone
+func (c *Controller) handleDeletedAzureKeyVaultSecret(obj interface{}) {
+	akvs, err := convertToAzureKeyVaultSecret(obj)
+	if err != nil {
+		klog.ErrorS(err, "failed to convert to azurekeyvaultsecret")
+		syncFailures.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
+		return
+	}
+
+	if !c.isSelected(akvs) {
+		return
+	}
+
+	if c.akvsHasOutputDefined(akvs) {
+		klog.V(4).InfoS("azurekeyvaultsecret deleted - adding to queue", "azurekeyvaultsecret", klog.KObj(akvs))
+		syncCounter.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), obj)
+
+		if c.isClaimedByOther(akvs) {
+			klog.V(4).InfoS("azurekeyvaultsecret claimed by other controller instance - not deleting secret data", "azurekeyvaultsecret", klog.KObj(akvs), "instance", akvs.Status.Claim.Instance)
+		} else {
+			if err = c.deleteKubernetesValues(akvs); err != nil {
+				klog.ErrorS(err, "failed to delete secret data from azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs))
+				syncFailures.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
+			}
+			// normally done by the finalizer, unless it gave up or reclaimPolicy was set too late for it
+			if err = c.releaseRetainedOutputs(akvs); err != nil {
+				klog.ErrorS(err, "failed to release retained outputs of azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs))
+				syncFailures.WithLabelValues("delete", "AzureKeyVaultSecret").Inc()
+			}
+		}
+
+		// Getting default key to remove from Azure work queue, obj may be a tombstone
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		c.azureKeyVaultQueue.GetQueue().Forget(key)
+		c.forceSyncs.Delete(key)
+		c.sanitizedKeys.Delete(key)
+		c.certificateAnnotations.Delete(key)
+		c.servedBy.Delete(key)
+		c.vaultObjectMetadata.Delete(key)
+		c.objectStatus.Delete(key)
+	}
+}
+
 func (c *Controller) syncDeletedAzureKeyVaultSecret(key string) error {
 	var akvs *akv.AzureKeyVaultSecret
 	var err error
@@ -127,34 +187,66 @@ func (c *Controller) syncDeletedAzureKeyVaultSecret(key string) error {
 		return err
 	}
 
-	var outputObject metav1.Object
+	// labels may have changed since it was queued
+	if !c.isSelected(akvs) {
+		klog.V(4).InfoS("azurekeyvaultsecret does not match label selector - skipping", "azurekeyvaultsecret", klog.KObj(akvs))
+		return nil
+	}
+
+	var claimed bool
+	if akvs, claimed, err = c.claim(akvs); err != nil || !claimed {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectName(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectVersion(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveTemplate(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.setPollingCondition(akvs); err != nil {
+		return err
+	}
+
+	var outputObjects []metav1.Object
+	var pending []pendingRotation
 	if c.akvsHasOutputSecret(akvs) {
-		secret, err := c.getOrCreateKubernetesSecret(akvs)
+		secret, rotation, err := c.getOrCreateKubernetesSecret(akvs, false)
 		if err != nil {
 			return err
 		}
+		if rotation != nil {
+			pending = append(pending, *rotation)
+		}
 
 		klog.V(4).InfoS("sync successful", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
-		outputObject = secret
+		outputObjects = append(outputObjects, secret)
 	}
 
 	if c.akvsHasOutputConfigMap(akvs) {
-		cm, err := c.getOrCreateKubernetesConfigMap(akvs)
+		cm, rotation, err := c.getOrCreateKubernetesConfigMap(akvs, false)
 		if err != nil {
 			return err
 		}
+		if rotation != nil {
+			pending = append(pending, *rotation)
+		}
 
 		klog.V(4).InfoS("sync successful", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
-		outputObject = cm
+		outputObjects = append(outputObjects, cm)
 	}
 
-	if !isOwnedBy(outputObject, akvs) { // checks if the object has a controllerRef set to the given owner
-		msg := fmt.Sprintf(MessageResourceExists, outputObject.GetName())
-		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrResourceExists, msg)
-		return fmt.Errorf(msg)
+	if akvs, err = c.setRotationPending(akvs, pending); err != nil {
+		return err
 	}
 
-	return nil
+	return c.checkOutputOwnership(akvs, outputObjects...)
 }
 
 func (c *Controller) syncAzureKeyVaultSecret(key string) error {
@@ -169,43 +261,119 @@ func (c *Controller) syncAzureKeyVaultSecret(key string) error {
 		return err
 	}
 
-	var outputObject metav1.Object
-	if c.akvsHasOutputSecret(akvs) {
-		secret, err := c.getOrCreateKubernetesSecret(akvs)
+	// labels may have changed since it was queued
+	if !c.isSelected(akvs) {
+		klog.V(4).InfoS("azurekeyvaultsecret does not match label selector - skipping", "azurekeyvaultsecret", klog.KObj(akvs))
+		return nil
+	}
+
+	var claimed bool
+	if akvs, claimed, err = c.claim(akvs); err != nil || !claimed {
+		return err
+	}
+
+	if deleting, err := c.finalizeAzureKeyVaultSecret(akvs); deleting || err != nil {
+		return err
+	}
+
+	var valid bool
+	if akvs, valid, err = c.checkSpec(akvs); err != nil || !valid {
+		return err
+	}
+
+	if akvs, err = c.ensureRetainFinalizer(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectName(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectVersion(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveTemplate(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.setPollingCondition(akvs); err != nil {
+		return err
+	}
+
+	if akvsHasOutputs(akvs) {
+		return c.syncOutputs(akvs, false)
+	}
+
+	forceSync := c.takeForceSync(key)
+	syncSecret := c.akvsHasOutputSecret(akvs)
+	if syncSecret {
+		if akvs, syncSecret, err = c.resolveSecretConflict(akvs); err != nil {
+			return err
+		}
+	}
+	if syncSecret {
+		if akvs, syncSecret, err = c.applySecretRecreatePolicy(akvs, forceSync); err != nil {
+			return err
+		}
+	}
+
+	// status is rewritten for the new names when outputs are renamed
+	previous := akvs.Status
+	var outputObjects []metav1.Object
+	var pending []pendingRotation
+	if syncSecret {
+		secret, rotation, err := c.getOrCreateKubernetesSecret(akvs, forceSync)
 		if err != nil {
 			return err
 		}
+		if rotation != nil {
+			pending = append(pending, *rotation)
+		}
 
 		klog.V(4).InfoS("sync successful", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
-		outputObject = secret
+		outputObjects = append(outputObjects, secret)
+
+		if err = c.pruneRenamedSecret(akvs, previous); err != nil {
+			return err
+		}
 	}
 
 	if c.akvsHasOutputConfigMap(akvs) {
-		cm, err := c.getOrCreateKubernetesConfigMap(akvs)
+		cm, rotation, err := c.getOrCreateKubernetesConfigMap(akvs, forceSync)
 		if err != nil {
 			return err
 		}
+		if rotation != nil {
+			pending = append(pending, *rotation)
+		}
 
 		klog.V(4).InfoS("sync successful", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
-		outputObject = cm
+		outputObjects = append(outputObjects, cm)
+
+		if err = c.pruneRenamedConfigMap(akvs, previous); err != nil {
+			return err
+		}
 	}
 
-	if !isOwnedBy(outputObject, akvs) { // checks if the object has a controllerRef set to the given owner
-		msg := fmt.Sprintf(MessageResourceExists, outputObject.GetName())
-		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrResourceExists, msg)
-		return fmt.Errorf(msg)
+	if akvs, err = c.setRotationPending(akvs, pending); err != nil {
+		return err
 	}
 
-	return nil
+	if err = c.syncChecksumAnnotations(akvs); err != nil {
+		return err
+	}
+
+	return c.checkOutputOwnership(akvs, outputObjects...)
 }
 
 func (c *Controller) syncAzureKeyVault(key string) error {
 	var akvs *akv.AzureKeyVaultSecret
 	var err error
-	var secretName string
-	var cmName string
-	var cmHash string
-	var secretHash string
+	var written writtenOutputs
+	var pending []pendingRotation
+	var rotationChanges string
+	var generation int64
 
 	klog.V(4).InfoS("checking state of azurekeyvaultsecret in azure key vault", "key", key)
 	if akvs, err = c.getAzureKeyVaultSecret(key); err != nil {
@@ -215,107 +383,257 @@ func (c *Controller) syncAzureKeyVault(key string) error {
 		return err
 	}
 
-	if c.akvsHasOutputSecret(akvs) {
+	// labels may have changed since it was queued
+	if !c.isSelected(akvs) {
+		klog.V(4).InfoS("azurekeyvaultsecret does not match label selector - skipping", "azurekeyvaultsecret", klog.KObj(akvs))
+		return nil
+	}
+
+	var claimed bool
+	if akvs, claimed, err = c.claim(akvs); err != nil || !claimed {
+		return err
+	}
+
+	// retries releasing retained outputs on resync, after the AzureKeyVaultSecret queue gave up
+	if deleting, err := c.finalizeAzureKeyVaultSecret(akvs); deleting || err != nil {
+		return err
+	}
+
+	var valid bool
+	if akvs, valid, err = c.checkSpec(akvs); err != nil || !valid {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectName(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveObjectVersion(akvs); err != nil {
+		return err
+	}
+
+	if akvs, err = c.resolveTemplate(akvs); err != nil {
+		return err
+	}
+
+	if isPinnedVersionSynced(akvs) {
+		klog.V(4).InfoS("skipping poll of azure key vault for pinned object version", "azurekeyvaultsecret", klog.KObj(akvs), "version", akvs.Spec.Vault.Object.Version)
+		return nil
+	}
+
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		klog.V(4).InfoS("skipping poll of azure key vault until next poll time", "azurekeyvaultsecret", klog.KObj(akvs), "nextPoll", akvs.Status.NextAzurePollTime, "predictedRenewal", akvs.Status.PredictedRenewalTime)
+		return nil
+	}
+
+	if c.isVaultObjectUnchanged(akvs) {
+		klog.V(4).InfoS("object version unchanged in azure key vault - skipping download", "azurekeyvaultsecret", klog.KObj(akvs), "version", akvs.Status.VaultObjectVersion)
+		c.scheduleAzurePoll(key, akvs)
+		return nil
+	}
+
+	if akvsHasOutputs(akvs) {
+		if err = c.syncOutputs(akvs, true); err != nil {
+			return err
+		}
+		c.scheduleAzurePoll(key, akvs)
+		return nil
+	}
+
+	debounce := c.newRotationDebounce(akvs)
+	syncSecret := c.akvsHasOutputSecret(akvs)
+	if syncSecret {
+		if akvs, syncSecret, err = c.resolveSecretConflict(akvs); err != nil {
+			return err
+		}
+	}
+
+	if syncSecret {
 		klog.V(4).InfoS("getting secret value from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs))
 		secretValue, err := c.getSecretFromKeyVault(akvs)
+		akvs, err = c.checkKeyCollision(akvs, err)
+		akvs, err = c.checkKeyMismatch(akvs, err)
 		if err != nil {
-			msg := fmt.Sprintf(FailedAzureKeyVault, akvs.Name, akvs.Spec.Vault.Name, err.Error())
-			c.recorder.Event(akvs, corev1.EventTypeWarning, ErrAzureVault, msg)
+			err = newAzureKeyVaultError(akvs, err)
+			c.recordAzureFailure(akvs, err)
 			syncFailures.WithLabelValues("sync", "AzureKeyVault").Inc()
-			return fmt.Errorf(msg)
+			return err
 		}
 
-		secretHash = getMD5HashOfByteValues(secretValue)
+		written.secretHash = getHashOfByteValues(secretValue)
+		written.secretKeys = sortByteValueKeys(secretValue)
+		var migrated bool
+		if akvs, migrated = migrateSecretHash(akvs, secretValue); migrated {
+			// values unchanged since written with an MD5 hash, only the status is rewritten
+			written.secretName = akvs.Status.SecretName
+		}
 
 		klog.V(4).InfoS("checking if secret value has changed in azure", "azurekeyvaultsecret", klog.KObj(akvs))
-		if akvs.Status.SecretHash != secretHash {
-			klog.V(4).InfoS("value has changed in azure key vault", "before", akvs.Status.SecretHash, "now", secretHash, "azurekeyvaultsecret", klog.KObj(akvs))
+		if akvs.Status.SecretHash != written.secretHash {
+			klog.V(4).InfoS("value has changed in azure key vault", "before", akvs.Status.SecretHash, "now", written.secretHash, "azurekeyvaultsecret", klog.KObj(akvs))
 
 			klog.InfoS("updating with recent changes from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, akvs.Spec.Output.Secret.Name))
 			existingSecret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), akvs.Spec.Output.Secret.Name, metav1.GetOptions{})
-			if err != nil {
+			if err != nil && hasSecretRecreatePolicy(akvs) {
+				klog.InfoS("secret deleted - syncing azurekeyvaultsecret to apply recreate policy", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, akvs.Spec.Output.Secret.Name))
+				queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+			} else if err != nil {
 				klog.Infof("existing secret %s not found, creating new secret", akvs.Spec.Output.Secret.Name)
-				newSecret := createNewSecret(akvs, secretValue)
-				secret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Create(context.TODO(), newSecret, metav1.CreateOptions{})
+				newSecret := c.createNewSecret(akvs, secretValue)
+				setRotationGeneration(newSecret, akvs.Status.RotationGeneration)
+				secret, err := c.writer().CreateSecret(context.TODO(), newSecret)
 				if err != nil {
 					return fmt.Errorf("failed to create the secret %s, error: %+v", akvs.Spec.Output.Secret.Name, err)
 				}
 
-				secretName = secret.Name
+				written.secretName = secret.Name
 				klog.InfoS("secret created", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+			} else if isReportOnly(akvs, false) && hasAzureKeyVaultSecretChangedForSecret(akvs, secretValue, existingSecret) {
+				pending = append(pending, pendingRotation{kind: outputKindSecret, name: existingSecret.Name, hash: written.secretHash})
+			} else if akvs.Status.SecretHash != "" && hasAzureKeyVaultSecretChangedForSecret(akvs, secretValue, existingSecret) && debounce.hold() {
+				klog.InfoS("holding back changes from azure key vault until rotation debounce ends", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(existingSecret), "applyTime", debounce.pending.ApplyTime)
 			} else {
-				updatedSecret, err := createNewSecretFromExisting(akvs, secretValue, existingSecret)
+				updatedSecret, err := c.createNewSecretFromExisting(akvs, secretValue, existingSecret)
 				if err != nil {
 					return fmt.Errorf("failed to update existing secret %s, error: %+v", akvs.Spec.Output.Secret.Name, err)
 				}
-				secret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Update(context.TODO(), updatedSecret, metav1.UpdateOptions{})
+				if !equality.Semantic.DeepEqual(existingSecret.Data, updatedSecret.Data) {
+					bumpRotationGeneration(updatedSecret, existingSecret)
+				}
+				secret, err := c.writer().PatchSecret(context.TODO(), existingSecret, updatedSecret)
 				if err != nil {
 					return fmt.Errorf("failed to update secret, error: %+v", err)
 				}
 
-				secretName = secret.Name
-				c.recorder.Event(akvs, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSyncedWithAzureKeyVault)
-				klog.InfoS("secret changed - any resources (like pods) using this secret must be restarted to pick up the new value - details: https://github.com/kubernetes/kubernetes/issues/22368", "azurekeyvaultsecret", klog.KObj(secret), "secret", klog.KObj(akvs))
+				written.secretName = secret.Name
+				generation = max(generation, rotationGeneration(secret))
+				diff := diffSecretKeys(akvs.Status.SecretKeys, existingSecret.Data, updatedSecret.Data)
+				rotationChanges = diff.String()
+				c.reportSecretRotated(akvs, secret, diff)
 			}
 		}
 	}
 
-	if c.akvsHasOutputConfigMap(akvs) {
+	if c.akvsHasOutputConfigMap(akvs) && isImmutableConfigMap(akvs) {
+		var rotation *pendingRotation
+		if akvs, _, rotation, err = c.syncImmutableConfigMap(akvs, false); err != nil {
+			err = newAzureKeyVaultError(akvs, err)
+			c.recordAzureFailure(akvs, err)
+			return err
+		}
+		if rotation != nil {
+			pending = append(pending, *rotation)
+		}
+	} else if c.akvsHasOutputConfigMap(akvs) {
 		klog.V(4).InfoS("getting secret value from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs))
 		cmValue, err := c.getConfigMapFromKeyVault(akvs)
+		akvs, err = c.checkKeyCollision(akvs, err)
 		if err != nil {
-			msg := fmt.Sprintf(FailedAzureKeyVault, akvs.Name, akvs.Spec.Vault.Name, err.Error())
-			c.recorder.Event(akvs, corev1.EventTypeWarning, ErrAzureVault, msg)
-			return fmt.Errorf(msg)
+			err = newAzureKeyVaultError(akvs, err)
+			c.recordAzureFailure(akvs, err)
+			return err
 		}
 
-		cmHash = getMD5HashOfStringValues(cmValue)
+		written.configMapHash = getHashOfStringValues(cmValue)
+		written.configMapKeys = sortStringValueKeys(cmValue)
+		var migrated bool
+		if akvs, migrated = migrateConfigMapHash(akvs, cmValue); migrated {
+			// values unchanged since written with an MD5 hash, only the status is rewritten
+			written.configMapName = akvs.Status.ConfigMapName
+		}
 
 		klog.V(4).InfoS("checking if secret value has changed in azure key vault", "azurekeyvaultsecret", klog.KObj(akvs))
-		if akvs.Status.ConfigMapHash != cmHash {
-			klog.V(4).InfoS("value has changed in azure key vault", "before", akvs.Status.SecretHash, "now", secretHash, "azurekeyvaultsecret", klog.KObj(akvs))
+		if akvs.Status.ConfigMapHash != written.configMapHash {
+			klog.V(4).InfoS("value has changed in azure key vault", "before", akvs.Status.ConfigMapHash, "now", written.configMapHash, "azurekeyvaultsecret", klog.KObj(akvs))
 
 			klog.InfoS("updating with recent changes from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KRef(akvs.Namespace, akvs.Spec.Output.ConfigMap.Name))
 			existingCm, err := c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Get(context.TODO(), akvs.Spec.Output.ConfigMap.Name, metav1.GetOptions{})
 			if err != nil {
 				klog.Infof("existing configmap %s not found, creating new configmap", akvs.Spec.Output.ConfigMap.Name)
-				newCm := createNewConfigMap(akvs, cmValue)
-				cm, err := c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Create(context.TODO(), newCm, metav1.CreateOptions{})
+				newCm := c.createNewConfigMap(akvs, cmValue)
+				setRotationGeneration(newCm, akvs.Status.RotationGeneration)
+				cm, err := c.writer().CreateConfigMap(context.TODO(), newCm)
 				if err != nil {
 					return fmt.Errorf("failed to create the configmap %s, error: %+v", akvs.Spec.Output.ConfigMap.Name, err)
 				}
-				cmName = cm.Name
+				written.configMapName = cm.Name
 				klog.InfoS("configmap created", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+			} else if isReportOnly(akvs, false) && hasAzureKeyVaultSecretChangedForConfigMap(akvs, cmValue, existingCm) {
+				pending = append(pending, pendingRotation{kind: outputKindConfigMap, name: existingCm.Name, hash: written.configMapHash})
+			} else if akvs.Status.ConfigMapHash != "" && hasAzureKeyVaultSecretChangedForConfigMap(akvs, cmValue, existingCm) && debounce.hold() {
+				klog.InfoS("holding back changes from azure key vault until rotation debounce ends", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(existingCm), "applyTime", debounce.pending.ApplyTime)
 			} else {
-				updatedCm, err := createNewConfigMapFromExisting(akvs, cmValue, existingCm)
+				updatedCm, err := c.createNewConfigMapFromExisting(akvs, cmValue, existingCm)
 				if err != nil {
 					return fmt.Errorf("failed to update existing configmap %s, error: %+v", akvs.Spec.Output.ConfigMap.Name, err)
 				}
-				cm, err := c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Update(context.TODO(), updatedCm, metav1.UpdateOptions{})
+				if !equality.Semantic.DeepEqual(existingCm.Data, updatedCm.Data) {
+					bumpRotationGeneration(updatedCm, existingCm)
+				}
+				cm, err := c.writer().PatchConfigMap(context.TODO(), existingCm, updatedCm)
 				if err != nil {
 					return fmt.Errorf("failed to update configmap, error: %+v", err)
 				}
-				cmName = cm.Name
-				c.recorder.Event(akvs, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSyncedWithAzureKeyVault)
-				klog.InfoS("configmap changed - any resources (like pods) using this configmap must be restarted to pick up the new value - details: https://github.com/kubernetes/kubernetes/issues/22368", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+				written.configMapName = cm.Name
+				generation = max(generation, rotationGeneration(cm))
+				if diff := diffConfigMapKeys(akvs.Status.ConfigMapKeys, configMapValues(existingCm), configMapValues(updatedCm)); !diff.isEmpty() {
+					if rotationChanges == "" {
+						rotationChanges = diff.String()
+					}
+					c.reportConfigMapRotated(akvs, cm, diff)
+				}
 			}
 		}
 	}
 
+	// changes held back by syncPolicy ReportOnly are not recorded in the status, so they are
+	// reported again on the next poll until applied
+	if akvs, err = c.setRotationPending(akvs, pending); err != nil {
+		return err
+	}
+
+	akvs = akvs.DeepCopy()
+	akvs.Status.PredictedRenewalTime = c.predictCertificateRenewal(akvs)
+	akvs.Status.NextAzurePollTime = debounce.nextPoll(c.nextAzurePollTime(akvs))
+	akvs.Status.DebouncedRotation = debounce.status()
+	c.scheduleDebouncedRotation(key, akvs, debounce)
+	if generation > 0 {
+		akvs.Status.RotationGeneration = generation
+	}
+	if rotationChanges != "" {
+		akvs.Status.LastRotationChanges = rotationChanges
+	}
+	if c.isReferencedByRefreshDue(akvs, written.secretName != "" || written.configMapName != "") {
+		c.refreshReferencedBy(akvs)
+	}
+
 	klog.V(4).InfoS("updating status", "azurekeyvaultsecret", klog.KObj(akvs))
-	if err = c.updateAzureKeyVaultSecretStatus(akvs, secretName, cmName, secretHash, cmHash); err != nil {
+	if err = c.updateAzureKeyVaultSecretStatus(akvs, written); err != nil {
 		return err
 	}
 
+	if err = c.syncChecksumAnnotations(akvs); err != nil {
+		return err
+	}
+
+	c.scheduleAzurePoll(key, akvs)
 	klog.V(4).InfoS("sync successful", "azurekeyvaultsecret", klog.KObj(akvs))
 	return nil
 }
 
+// deleteKubernetesValues removes the values written by akvs from its outputs, except from
+// outputs with deletePolicy Retain
 func (c *Controller) deleteKubernetesValues(akvs *akv.AzureKeyVaultSecret) error {
+	if akvsHasOutputs(akvs) {
+		return c.deleteOutputsValues(akvs)
+	}
 	if c.akvsHasOutputSecret(akvs) {
+		if isSecretRetained(akvs.Spec.Output) {
+			return nil
+		}
 		return c.deleteKubernetesSecretValues(akvs)
 	}
-	if c.akvsHasOutputConfigMap(akvs) {
+	if c.akvsHasOutputConfigMap(akvs) && !isConfigMapRetained(akvs.Spec.Output) {
 		return c.deleteKubernetesConfigMapValues(akvs)
 	}
 	return nil
@@ -337,7 +655,7 @@ func convertToAzureKeyVaultSecret(obj interface{}) (*akv.AzureKeyVaultSecret, er
 }
 
 func (c *Controller) akvsHasOutputDefined(secret *akv.AzureKeyVaultSecret) bool {
-	return c.akvsHasOutputSecret(secret) || c.akvsHasOutputConfigMap(secret)
+	return c.akvsHasOutputSecret(secret) || c.akvsHasOutputConfigMap(secret) || akvsHasOutputs(secret)
 }
 
 func (c *Controller) akvsHasOutputSecret(secret *akv.AzureKeyVaultSecret) bool {
@@ -348,48 +666,146 @@ func (c *Controller) akvsHasOutputConfigMap(secret *akv.AzureKeyVaultSecret) boo
 	return secret.Spec.Output.ConfigMap.Name != ""
 }
 
+// createTransformator creates a transformator running the controller default transforms
+// for the object type, unless disabled, before the transforms in the AzureKeyVaultSecret
+func (c *Controller) createTransformator(akvs *akv.AzureKeyVaultSecret) (*transformers.Transformator, error) {
+	var defaults []string
+	if c.options != nil && !akvs.Spec.Output.Secret.DisableDefaultTransforms {
+		defaults = c.options.DefaultTransforms[akvs.Spec.Vault.Object.Type]
+	}
+
+	transformator, err := transformers.CreateTransformatorWithDefaults(defaults, &akvs.Spec.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(4).InfoS("using transforms", "azurekeyvaultsecret", klog.KObj(akvs), "transforms", transformator.Transforms())
+	return transformator, nil
+}
+
 func (c *Controller) getSecretFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (map[string][]byte, error) {
+	if len(azureKeyVaultSecret.Spec.Vault.Objects) > 0 {
+		return c.getObjectsFromKeyVault(azureKeyVaultSecret)
+	}
+	service, err := c.vaultServiceFor(azureKeyVaultSecret)
+	if err != nil {
+		return nil, err
+	}
+	return c.getSecretFromVaultService(azureKeyVaultSecret, service)
+}
+
+func (c *Controller) getSecretFromVaultService(azureKeyVaultSecret *akv.AzureKeyVaultSecret, service vault.Service) (map[string][]byte, error) {
 	var secretHandler KubernetesHandler
+	vaultService := newFallbackVaultService(newEnabledVersionVaultService(service))
 
 	switch azureKeyVaultSecret.Spec.Vault.Object.Type {
 	case akv.AzureKeyVaultObjectTypeSecret:
-		transformator, err := transformers.CreateTransformator(&azureKeyVaultSecret.Spec.Output)
+		transformator, err := c.createTransformator(azureKeyVaultSecret)
 		if err != nil {
 			return nil, err
 		}
-		secretHandler = NewAzureSecretHandler(azureKeyVaultSecret, c.vaultService, *transformator)
+		secretHandler = NewAzureSecretHandler(azureKeyVaultSecret, vaultService, *transformator)
 	case akv.AzureKeyVaultObjectTypeCertificate:
-		secretHandler = NewAzureCertificateHandler(azureKeyVaultSecret, c.vaultService)
+		// read on every sync, so a changed password gives a new keystore
+		password, err := c.keystorePassword(azureKeyVaultSecret)
+		if err != nil {
+			return nil, err
+		}
+		certHandler := NewAzureCertificateHandler(azureKeyVaultSecret, vaultService)
+		certHandler.keystorePassword = password
+		secretHandler = certHandler
 	case akv.AzureKeyVaultObjectTypeKey:
-		secretHandler = NewAzureKeyHandler(azureKeyVaultSecret, c.vaultService)
+		secretHandler = NewAzureKeyHandler(azureKeyVaultSecret, vaultService)
 	case akv.AzureKeyVaultObjectTypeMultiKeyValueSecret:
-		secretHandler = NewAzureMultiKeySecretHandler(azureKeyVaultSecret, c.vaultService)
+		secretHandler = NewAzureMultiKeySecretHandler(azureKeyVaultSecret, vaultService)
 	default:
 		return nil, fmt.Errorf("azure key vault object type '%s' not currently supported", azureKeyVaultSecret.Spec.Vault.Object.Type)
 	}
-	return secretHandler.HandleSecret()
+
+	values, err := secretHandler.HandleSecret()
+	c.storeAzureReachable(azureKeyVaultSecret, vaultService)
+	if isCertificateNotExportable(err) {
+		c.recorder.Eventf(azureKeyVaultSecret, corev1.EventTypeWarning, ReasonCertificateNotExportable,
+			"Certificate '%s' in Azure Key Vault '%s' is not exportable, so its private key cannot be written to a %s secret. Mark the key as exportable in the certificate policy, or use a secret type without the private key",
+			azureKeyVaultSecret.Spec.Vault.Object.Name, azureKeyVaultSecret.Spec.Vault.Identifier(), azureKeyVaultSecret.Spec.Output.Secret.Type)
+	}
+	c.reportTransformFailed(azureKeyVaultSecret, err)
+	if isInvalidDockerConfig(err) {
+		c.recorder.Event(azureKeyVaultSecret, corev1.EventTypeWarning, ReasonInvalidDockerConfig,
+			fmt.Sprintf(FailedAzureKeyVault, azureKeyVaultSecret.Name, azureKeyVaultSecret.Spec.Vault.Identifier(), err.Error()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = c.checkNotBefore(azureKeyVaultSecret, secretHandler); err != nil {
+		return nil, err
+	}
+	c.storeSanitizedKeys(azureKeyVaultSecret, secretHandler)
+	c.reportUnmatchedKeyFilters(azureKeyVaultSecret, secretHandler, outputKindSecret, determineSecretName(azureKeyVaultSecret))
+	c.storeVaultObjectMetadata(azureKeyVaultSecret, secretHandler)
+	c.storeCertificateAnnotations(azureKeyVaultSecret, secretHandler)
+	c.reportInvalidSSHPrivateKey(azureKeyVaultSecret, secretHandler)
+	c.storeServedBy(azureKeyVaultSecret, vaultService)
+	if values, err = normalizeDataKeys(values, akv.DataKeyCaseOf(azureKeyVaultSecret.Spec.Output.Secret)); err != nil {
+		return nil, err
+	}
+	if values, err = affixDataKeys(values, azureKeyVaultSecret.Spec.Output.Secret.KeyPrefix, azureKeyVaultSecret.Spec.Output.Secret.KeySuffix); err != nil {
+		return nil, err
+	}
+	if values, err = selectByteValueKeys(values, azureKeyVaultSecret.Spec.Output.Secret.Keys); err != nil {
+		return nil, err
+	}
+	return c.renderTemplate(azureKeyVaultSecret, values)
 }
 
 func (c *Controller) getConfigMapFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret) (map[string]string, error) {
+	if len(azureKeyVaultSecret.Spec.Vault.Objects) > 0 {
+		return c.getConfigMapObjectsFromKeyVault(azureKeyVaultSecret)
+	}
+	service, err := c.vaultServiceFor(azureKeyVaultSecret)
+	if err != nil {
+		return nil, err
+	}
+	return c.getConfigMapFromVaultService(azureKeyVaultSecret, service)
+}
+
+func (c *Controller) getConfigMapFromVaultService(azureKeyVaultSecret *akv.AzureKeyVaultSecret, service vault.Service) (map[string]string, error) {
 	var cmHandler KubernetesHandler
+	vaultService := newFallbackVaultService(newEnabledVersionVaultService(service))
 
 	switch azureKeyVaultSecret.Spec.Vault.Object.Type {
 	case akv.AzureKeyVaultObjectTypeSecret:
-		transformator, err := transformers.CreateTransformator(&azureKeyVaultSecret.Spec.Output)
+		transformator, err := c.createTransformator(azureKeyVaultSecret)
 		if err != nil {
 			return nil, err
 		}
-		cmHandler = NewAzureSecretHandler(azureKeyVaultSecret, c.vaultService, *transformator)
+		cmHandler = NewAzureSecretHandler(azureKeyVaultSecret, vaultService, *transformator)
 	case akv.AzureKeyVaultObjectTypeCertificate:
-		cmHandler = NewAzureCertificateHandler(azureKeyVaultSecret, c.vaultService)
+		cmHandler = NewAzureCertificateHandler(azureKeyVaultSecret, vaultService)
 	case akv.AzureKeyVaultObjectTypeKey:
-		cmHandler = NewAzureKeyHandler(azureKeyVaultSecret, c.vaultService)
+		cmHandler = NewAzureKeyHandler(azureKeyVaultSecret, vaultService)
 	case akv.AzureKeyVaultObjectTypeMultiKeyValueSecret:
-		cmHandler = NewAzureMultiKeySecretHandler(azureKeyVaultSecret, c.vaultService)
+		cmHandler = NewAzureMultiKeySecretHandler(azureKeyVaultSecret, vaultService)
 	default:
 		return nil, fmt.Errorf("azure key vault object type '%s' not currently supported", azureKeyVaultSecret.Spec.Vault.Object.Type)
 	}
-	return cmHandler.HandleConfigMap()
+	values, err := cmHandler.HandleConfigMap()
+	c.storeAzureReachable(azureKeyVaultSecret, vaultService)
+	c.reportTransformFailed(azureKeyVaultSecret, err)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.checkNotBefore(azureKeyVaultSecret, cmHandler); err != nil {
+		return nil, err
+	}
+	c.storeSanitizedKeys(azureKeyVaultSecret, cmHandler)
+	c.reportUnmatchedKeyFilters(azureKeyVaultSecret, cmHandler, outputKindConfigMap, azureKeyVaultSecret.Spec.Output.ConfigMap.Name)
+	c.storeVaultObjectMetadata(azureKeyVaultSecret, cmHandler)
+	c.storeServedBy(azureKeyVaultSecret, vaultService)
+	if values, err = selectStringValueKeys(values, azureKeyVaultSecret.Spec.Output.ConfigMap.Keys); err != nil {
+		return nil, err
+	}
+	return c.renderConfigMapTemplate(azureKeyVaultSecret, values)
 }
 
 func (c *Controller) getAzureKeyVaultSecret(key string) (*akv.AzureKeyVaultSecret, error) {
@@ -414,14 +830,28 @@ func hasAzureKeyVaultSecretChangedForSecret(akvs *akv.AzureKeyVaultSecret, akvsV
 	}
 
 	// Check if dataKey has changed by trying to lookup key
-	if akvs.Spec.Output.Secret.DataKey != "" {
-		if _, ok := secret.Data[akvs.Spec.Output.Secret.DataKey]; !ok {
+	if dataKey := determineSecretDataKey(akvs); dataKey != "" {
+		if _, ok := secret.Data[dataKey]; !ok {
 			return true
 		}
 	}
 
 	// Check if data content has changed
-	if akvs.Status.SecretHash != getMD5HashOfSecret(akvsValues, secret) {
+	if akvs.Status.SecretHash != getHashOfSecret(akvsValues, secret) {
+		return true
+	}
+
+	// Check if output spec has changed how values are rendered (like key encoding),
+	// even though the object in Azure Key Vault is the same
+	if akvs.Status.SecretHash != getHashOfByteValues(akvsValues) {
+		return true
+	}
+	// Check if keys previously written are no longer produced (like when dataKeyCase has changed)
+	if len(getStaleSecretKeys(akvs, akvsValues, secret)) > 0 {
+		return true
+	}
+	// Check if keys not written by akvs must be removed
+	if replacesAllSecretKeys(akvs) && len(getUnmanagedSecretKeys(akvsValues, secret)) > 0 {
 		return true
 	}
 	return false
@@ -430,56 +860,97 @@ func hasAzureKeyVaultSecretChangedForSecret(akvs *akv.AzureKeyVaultSecret, akvsV
 func hasAzureKeyVaultSecretChangedForConfigMap(akvs *akv.AzureKeyVaultSecret, akvsValues map[string]string, cm *corev1.ConfigMap) bool {
 	// Check if dataKey has changed by trying to lookup key
 	if akvs.Spec.Output.ConfigMap.DataKey != "" {
-		if _, ok := cm.Data[akvs.Spec.Output.ConfigMap.DataKey]; !ok {
+		if _, ok := configMapValues(cm)[akvs.Spec.Output.ConfigMap.DataKey]; !ok {
 			return true
 		}
 	}
 
 	// Check if data content has changed
-	if akvs.Status.ConfigMapHash != getMD5HashOfConfigMap(akvsValues, cm) {
+	if akvs.Status.ConfigMapHash != getHashOfConfigMap(akvsValues, cm) {
 		return true
 	}
-	return false
-}
 
-func (c *Controller) updateAzureKeyVaultSecretStatus(akvs *akv.AzureKeyVaultSecret, secretName, cmName, secretHash, cmHash string) error {
-	akvsCopy := akvs.DeepCopy()
-	if secretName != "" {
-		akvsCopy.Status.SecretName = secretName
-		akvsCopy.Status.SecretHash = secretHash
+	// Check if output spec has changed how values are rendered (like key encoding),
+	// even though the object in Azure Key Vault is the same
+	if akvs.Status.ConfigMapHash != getHashOfStringValues(akvsValues) {
+		return true
 	}
-	if cmName != "" {
-		akvsCopy.Status.ConfigMapName = cmName
-		akvsCopy.Status.ConfigMapHash = cmHash
+	// Check if keys previously written are no longer produced (like trailing array elements)
+	if len(getStaleConfigMapKeys(akvs, akvsValues, cm)) > 0 {
+		return true
 	}
-	akvsCopy.Status.LastAzureUpdate = c.clock.Now()
-
-	_, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), akvsCopy, metav1.UpdateOptions{})
-	return err
+	// Check if values must move between data and binaryData (like when forceBinary has changed)
+	if hasConfigMapBinaryDataChanged(akvs, akvsValues, cm) {
+		return true
+	}
+	return false
 }
 
-func (c *Controller) updateAzureKeyVaultSecretStatusForSecret(akvs *akv.AzureKeyVaultSecret, secretHash string) error {
-	secretName := determineSecretName(akvs)
-	now := c.clock.Now()
-
-	akvsCopy := akvs.DeepCopy()
-	akvsCopy.Status.SecretName = secretName
-	akvsCopy.Status.SecretHash = secretHash
-	akvsCopy.Status.LastAzureUpdate = now
-
-	_, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), akvsCopy, metav1.UpdateOptions{})
-	return err
+// writtenOutputs is what was written to the output Secret and ConfigMap of an
+// AzureKeyVaultSecret, to be recorded in its status. Outputs without a name were not
+// written and keep their status.
+type writtenOutputs struct {
+	secretName    string
+	secretHash    string
+	secretKeys    []string
+	configMapName string
+	configMapHash string
+	configMapKeys []string
+
+	// appliesRotation clears a change held back by spec.output.rotationDebounce, as the
+	// latest values were written
+	appliesRotation bool
 }
 
-func (c *Controller) updateAzureKeyVaultSecretStatusForConfigMap(akvs *akv.AzureKeyVaultSecret, cmHash string) error {
-	cmName := determineConfigMapName(akvs)
+// writtenSecret returns the status of the output Secret of akvs after writing values
+func writtenSecret(akvs *akv.AzureKeyVaultSecret, values map[string][]byte) writtenOutputs {
+	return writtenOutputs{
+		secretName:      determineSecretName(akvs),
+		secretHash:      getHashOfByteValues(values),
+		secretKeys:      sortByteValueKeys(values),
+		appliesRotation: true,
+	}
+}
 
-	akvsCopy := akvs.DeepCopy()
-	akvsCopy.Status.ConfigMapName = cmName
-	akvsCopy.Status.ConfigMapHash = cmHash
-	akvsCopy.Status.LastAzureUpdate = c.clock.Now()
+// writtenConfigMap returns the status of the output ConfigMap of akvs after writing values
+func writtenConfigMap(akvs *akv.AzureKeyVaultSecret, values map[string]string) writtenOutputs {
+	return writtenOutputs{
+		configMapName:   determineConfigMapName(akvs),
+		configMapHash:   getHashOfStringValues(values),
+		configMapKeys:   sortStringValueKeys(values),
+		appliesRotation: true,
+	}
+}
 
-	_, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), akvsCopy, metav1.UpdateOptions{})
+// updateAzureKeyVaultSecretStatus records the outputs written from Azure Key Vault in the
+// status of akvs, along with where and when the values were read. The status is left as is
+// if only the time of the poll or the renewal of the claim would change, see isStatusUnchanged.
+func (c *Controller) updateAzureKeyVaultSecretStatus(akvs *akv.AzureKeyVaultSecret, written writtenOutputs) error {
+	_, err := c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		existing := akvsCopy.Status.DeepCopy()
+		if written.secretName != "" {
+			akvsCopy.Status.SecretName = written.secretName
+			akvsCopy.Status.SecretHash = written.secretHash
+			akvsCopy.Status.SecretKeys = written.secretKeys
+		}
+		if written.configMapName != "" {
+			akvsCopy.Status.ConfigMapName = written.configMapName
+			akvsCopy.Status.ConfigMapHash = written.configMapHash
+			akvsCopy.Status.ConfigMapKeys = written.configMapKeys
+		}
+		if written.appliesRotation {
+			akvsCopy.Status.DebouncedRotation = nil
+		}
+		akvsCopy.Status.SanitizedKeys = c.loadSanitizedKeys(akvsCopy)
+		c.setServedBy(akvsCopy)
+		c.setVaultObjectVersion(akvsCopy)
+		c.renewClaim(akvsCopy)
+		akvsCopy.Status.LastAzureUpdate = c.clock.Now()
+
+		if c.isStatusUnchanged(*existing, akvsCopy.Status) {
+			akvsCopy.Status = *existing
+		}
+	})
 	return err
 }
 
@@ -188,3 +188,57 @@ func TestSyncAzureKeyVaultMultiKeyVauleDoesNotAllowOutputSecretType(t *testing.T
 		t.Error("expected value of key 'someOtherKey' to be 'someOtherValue'")
 	}
 }
+
+func TestChangedKeyEncodingRequiresSecretUpdate(t *testing.T) {
+	akvs := &akv.AzureKeyVaultSecret{
+		Spec: akv.AzureKeyVaultSecretSpec{
+			Output: akv.AzureKeyVaultOutput{
+				Secret: akv.AzureKeyVaultOutputSecret{
+					DataKey: "key",
+				},
+			},
+		},
+	}
+
+	existing := &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"key": []byte("pem encoded key")},
+	}
+	akvs.Status.SecretHash = getHashOfByteValues(existing.Data)
+
+	if hasAzureKeyVaultSecretChangedForSecret(akvs, map[string][]byte{"key": []byte("pem encoded key")}, existing) {
+		t.Error("secret should not need update when values are unchanged")
+	}
+
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, map[string][]byte{"key": []byte("der encoded key")}, existing) {
+		t.Error("secret should need update when values are rendered differently")
+	}
+}
+
+func TestSyncAzureKeyVaultInMemoryVersions(t *testing.T) {
+	service := fakeVault.NewInMemoryService()
+	first := service.SetSecret("my-vault", "my-secret", "first value")
+	service.SetSecret("my-vault", "my-secret", "second value")
+	c := &Controller{vaultService: service}
+
+	akvs := secret()
+	akvs.Spec.Vault.Name = "my-vault"
+	akvs.Spec.Vault.Object.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "value"
+
+	res, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := string(res["value"]); value != "second value" {
+		t.Errorf("expected latest value 'second value', but got '%s'", value)
+	}
+
+	akvs.Spec.Vault.Object.Version = first
+	if res, err = c.getSecretFromKeyVault(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if value := string(res["value"]); value != "first value" {
+		t.Errorf("expected pinned value 'first value', but got '%s'", value)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// recordAzureFailure records a warning event for err from reading akvs from Azure Key Vault.
+// As failing syncs are retried and polled again, the event is recorded at most once per
+// AzureFailureEventInterval for each AzureKeyVaultSecret, until a sync succeeds. Failures
+// are still visible in the Synced condition and the akv2k8s_syncs_failed_total metric.
+func (c *Controller) recordAzureFailure(akvs *akv.AzureKeyVaultSecret, err error) {
+	key := fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name)
+	now := c.clock.Now().Time
+
+	if c.options != nil && c.options.AzureFailureEventInterval > 0 {
+		if last, ok := c.azureFailureEvents.Load(key); ok && now.Sub(last.(time.Time)) < c.options.AzureFailureEventInterval {
+			klog.V(4).InfoS("failure event recorded recently - not recording again", "azurekeyvaultsecret", klog.KObj(akvs), "lastEvent", last, "err", err)
+			return
+		}
+	}
+
+	c.azureFailureEvents.Store(key, now)
+	reason := ErrAzureVault
+	if isCredentialsError(err) {
+		reason = ReasonInvalidCredentials
+	}
+	c.recorder.Event(akvs, corev1.EventTypeWarning, reason, err.Error())
+}
@@ -0,0 +1,72 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAzureFailureEventsAreRateLimited(t *testing.T) {
+	akvs := secret()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder, clock: clock, options: &Options{AzureFailureEventInterval: 10 * time.Minute}}
+	err := errors.New("vault unreachable")
+
+	c.recordAzureFailure(akvs, err)
+	clock.now = clock.now.Add(5 * time.Minute)
+	c.recordAzureFailure(akvs, err)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected one event within the interval, but got %d", len(recorder.Events))
+	}
+	expectEvent(t, recorder, ErrAzureVault)
+
+	clock.now = clock.now.Add(5 * time.Minute)
+	c.recordAzureFailure(akvs, err)
+	expectEvent(t, recorder, ErrAzureVault)
+}
+
+func TestRecoveredSyncRecordsEventOnce(t *testing.T) {
+	akvs := secret()
+	akvs.Status.Conditions = []metav1.Condition{{Type: ConditionTypeSynced, Status: metav1.ConditionFalse, Reason: "SyncFailed", Message: "vault unreachable"}}
+	c := syncConditionsController(t, akvs)
+	recorder := c.recorder.(*record.FakeRecorder)
+	key := akvs.Namespace + "/" + akvs.Name
+	c.azureFailureEvents.Store(key, syncConditionsNow)
+
+	sync := c.withSyncConditions(func(key string) error { return nil })
+	if err := sync(key); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, recorder, MessageAzureKeyVaultSecretRecovered)
+	if _, ok := c.azureFailureEvents.Load(key); ok {
+		t.Error("expected a successful sync to reset the failure event interval")
+	}
+
+	// the lister still has the failed condition, but the latest status does not
+	if err := sync(key); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event for a steady state sync, but got %d", len(recorder.Events))
+	}
+}
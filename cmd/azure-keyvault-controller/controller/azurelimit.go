@@ -0,0 +1,125 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var (
+	azureRequestWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "akv2k8s_azure_keyvault_request_wait_duration_seconds",
+		Help:    "How long requests to Azure Key Vault wait for the concurrency and rate limits before being sent, by operation",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"operation"})
+
+	azureRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "akv2k8s_azure_keyvault_requests_in_flight",
+		Help: "The number of requests to Azure Key Vault currently being sent",
+	})
+)
+
+// limitedVaultService limits how many requests to Azure Key Vault are sent at once and
+// how many are sent per second, across all workers
+type limitedVaultService struct {
+	service vault.Service
+
+	// slots has a buffer of the max number of concurrent requests, nil if unlimited
+	slots chan struct{}
+	// limiter is nil if the rate is unlimited
+	limiter flowcontrol.RateLimiter
+}
+
+// newLimitedVaultService returns a service sending at most maxConcurrent requests at once and
+// qps requests per second to service. Zero means no limit.
+func newLimitedVaultService(service vault.Service, maxConcurrent int, qps float64) *limitedVaultService {
+	s := &limitedVaultService{service: service}
+	if maxConcurrent > 0 {
+		s.slots = make(chan struct{}, maxConcurrent)
+	}
+	if qps > 0 {
+		s.limiter = flowcontrol.NewTokenBucketRateLimiter(float32(qps), 1)
+	}
+	return s
+}
+
+// withService returns a service sending requests to service within the same limits as s,
+// so requests made with other credentials count towards the limits too
+func (s *limitedVaultService) withService(service vault.Service) *limitedVaultService {
+	return &limitedVaultService{service: service, slots: s.slots, limiter: s.limiter}
+}
+
+// acquire waits until a request for operation is allowed, returning a func to release it
+func (s *limitedVaultService) acquire(operation string) func() {
+	start := time.Now()
+	if s.slots != nil {
+		s.slots <- struct{}{}
+	}
+	if s.limiter != nil {
+		s.limiter.Accept()
+	}
+	azureRequestWaitDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	azureRequestsInFlight.Inc()
+
+	return func() {
+		azureRequestsInFlight.Dec()
+		if s.slots != nil {
+			<-s.slots
+		}
+	}
+}
+
+func (s *limitedVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
+	defer s.acquire("GetSecret")()
+	return s.service.GetSecret(secret)
+}
+
+func (s *limitedVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	defer s.acquire("GetSecret")()
+	return s.service.GetSecretWithMetadata(secret)
+}
+
+func (s *limitedVaultService) GetKey(secret *akv.AzureKeyVault) (string, error) {
+	defer s.acquire("GetKey")()
+	return s.service.GetKey(secret)
+}
+
+func (s *limitedVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	defer s.acquire("GetKeyMaterial")()
+	return s.service.GetKeyMaterial(secret)
+}
+
+func (s *limitedVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (*vault.Certificate, error) {
+	defer s.acquire("GetCertificate")()
+	return s.service.GetCertificate(secret, options)
+}
+
+func (s *limitedVaultService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (*time.Time, error) {
+	defer s.acquire("GetCertificateRenewalTime")()
+	return s.service.GetCertificateRenewalTime(secret)
+}
+
+func (s *limitedVaultService) GetObjectVersions(secret *akv.AzureKeyVault) ([]vault.ObjectVersion, error) {
+	defer s.acquire("GetObjectVersions")()
+	return s.service.GetObjectVersions(secret)
+}
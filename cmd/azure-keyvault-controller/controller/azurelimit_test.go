@@ -0,0 +1,89 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+// concurrencyVaultService records the max number of concurrent reads
+type concurrencyVaultService struct {
+	fakeVaultService
+	current int32
+	max     int32
+}
+
+func (f *concurrencyVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	current := atomic.AddInt32(&f.current, 1)
+	defer atomic.AddInt32(&f.current, -1)
+	for {
+		max := atomic.LoadInt32(&f.max)
+		if current <= max || atomic.CompareAndSwapInt32(&f.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return "some-value", nil, nil
+}
+
+func TestLimitedVaultServiceLimitsConcurrency(t *testing.T) {
+	inner := &concurrencyVaultService{}
+	service := newLimitedVaultService(inner, 2, 0)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, _, err := service.GetSecretWithMetadata(&akv.AzureKeyVault{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if inner.max > 2 {
+		t.Errorf("expected at most 2 concurrent requests, but got %d", inner.max)
+	}
+	if len(service.slots) != 0 {
+		t.Errorf("expected all slots to be released, but %d are taken", len(service.slots))
+	}
+}
+
+func TestLimitedVaultServiceLimitsRate(t *testing.T) {
+	service := newLimitedVaultService(&fakeVaultService{fakeSecretValue: "some-value"}, 0, 20)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := service.GetSecret(&akv.AzureKeyVault{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first request is sent at once, the following ones 50ms apart
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected requests to be spread out by the rate limit, but took %v", elapsed)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationCertificateSubject holds the subject of the certificate in the Secret
+	AnnotationCertificateSubject = "akv2k8s.io/certificate-subject"
+
+	// AnnotationCertificateSANs holds the subject alternative names of the certificate in the Secret
+	AnnotationCertificateSANs = "akv2k8s.io/certificate-sans"
+
+	// AnnotationCertificateIssuer holds the issuer of the certificate in the Secret
+	AnnotationCertificateIssuer = "akv2k8s.io/certificate-issuer"
+
+	// AnnotationCertificateSerial holds the serial number of the certificate in the Secret, in hex
+	AnnotationCertificateSerial = "akv2k8s.io/certificate-serial"
+
+	// AnnotationCertificateNotBefore holds when the certificate in the Secret becomes valid
+	AnnotationCertificateNotBefore = "akv2k8s.io/certificate-not-before"
+
+	// AnnotationCertificateNotAfter holds when the certificate in the Secret expires
+	AnnotationCertificateNotAfter = "akv2k8s.io/certificate-not-after"
+
+	// AnnotationCertificateKeyAlgorithm holds the public key algorithm and size of the certificate in the Secret
+	AnnotationCertificateKeyAlgorithm = "akv2k8s.io/certificate-key-algorithm"
+
+	// certificates can have thousands of SANs, so the annotation is cut at a whole name
+	maxCertificateSANsLength = 1024
+)
+
+// certificateAnnotations returns the annotations describing cert
+func certificateAnnotations(cert *x509.Certificate) map[string]string {
+	return map[string]string{
+		AnnotationCertificateSubject:      cert.Subject.String(),
+		AnnotationCertificateSANs:         joinNames(certificateSANs(cert), maxCertificateSANsLength),
+		AnnotationCertificateIssuer:       cert.Issuer.String(),
+		AnnotationCertificateSerial:       cert.SerialNumber.Text(16),
+		AnnotationCertificateNotBefore:    cert.NotBefore.UTC().Format(time.RFC3339),
+		AnnotationCertificateNotAfter:     cert.NotAfter.UTC().Format(time.RFC3339),
+		AnnotationCertificateKeyAlgorithm: certificateKeyAlgorithm(cert),
+	}
+}
+
+// certificateSANs returns the subject alternative names of cert, prefixed by their type
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
+
+// joinNames joins names with commas in at most max bytes. Names that do not fit are
+// left out as a whole and counted in a trailing "+<n> more".
+func joinNames(names []string, max int) string {
+	kept, length := 0, 0
+	for i, name := range names {
+		next := length + len(name)
+		if i > 0 {
+			next++
+		}
+		var tail int
+		if remaining := len(names) - i - 1; remaining > 0 {
+			tail = len(fmt.Sprintf(",+%d more", remaining))
+		}
+		if next+tail > max {
+			break
+		}
+		kept, length = i+1, next
+	}
+
+	joined := strings.Join(names[:kept], ",")
+	if kept == len(names) {
+		return joined
+	}
+	if kept == 0 {
+		return fmt.Sprintf("+%d more", len(names))
+	}
+	return fmt.Sprintf("%s,+%d more", joined, len(names)-kept)
+}
+
+// certificateKeyAlgorithm returns the public key algorithm of cert with its key size or curve
+func certificateKeyAlgorithm(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA-%s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+func certificateAnnotationsEnabled(akvs *akv.AzureKeyVaultSecret) bool {
+	return akvs.Spec.Vault.Object.Type == akv.AzureKeyVaultObjectTypeCertificate && akvs.Spec.Output.Secret.Certificate.MetadataAnnotations
+}
+
+// storeCertificateAnnotations remembers the certificate annotations for the Secret of akvs
+// from the certificate last handled by handler
+func (c *Controller) storeCertificateAnnotations(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler) {
+	key := fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name)
+	h, ok := handler.(*azureCertificateHandler)
+	if !ok || h.certificate == nil || !certificateAnnotationsEnabled(akvs) {
+		c.certificateAnnotations.Delete(key)
+		return
+	}
+	c.certificateAnnotations.Store(key, certificateAnnotations(h.certificate))
+}
+
+// loadCertificateAnnotations returns the certificate annotations for the Secret of akvs,
+// or nil if disabled or the certificate has not been read
+func (c *Controller) loadCertificateAnnotations(akvs *akv.AzureKeyVaultSecret) map[string]string {
+	if !certificateAnnotationsEnabled(akvs) {
+		return nil
+	}
+	annotations, ok := c.certificateAnnotations.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return nil
+	}
+	return annotations.(map[string]string)
+}
+
+// secretAnnotations returns the annotations to set on a Secret written for akvs
+func (c *Controller) secretAnnotations(akvs *akv.AzureKeyVaultSecret) map[string]string {
+	certAnnotations := c.loadCertificateAnnotations(akvs)
+	if len(certAnnotations) == 0 {
+		return c.outputAnnotations(akvs)
+	}
+
+	annotations := make(map[string]string)
+	for k, v := range c.outputAnnotations(akvs) {
+		annotations[k] = v
+	}
+	for k, v := range certAnnotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// hasCertificateAnnotationsChanged checks if any certificate annotation on obj
+// is missing or outdated, so it can be restored
+func (c *Controller) hasCertificateAnnotationsChanged(akvs *akv.AzureKeyVaultSecret, obj metav1.Object) bool {
+	current := obj.GetAnnotations()
+	for k, v := range c.loadCertificateAnnotations(akvs) {
+		if current[k] != v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+func TestJoinNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		sans     []string
+		max      int
+		expected string
+	}{
+		{name: "none", sans: nil, max: 20, expected: ""},
+		{name: "fits", sans: []string{"DNS:a.com", "DNS:b.com"}, max: 20, expected: "DNS:a.com,DNS:b.com"},
+		{name: "cut at whole name", sans: []string{"DNS:a.com", "DNS:b.com", "DNS:c.com"}, max: 20, expected: "DNS:a.com,+2 more"},
+		{name: "nothing fits", sans: []string{"DNS:very-long-name.example.com"}, max: 10, expected: "+1 more"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			joined := joinNames(tt.sans, tt.max)
+			if joined != tt.expected {
+				t.Errorf("expected '%s', but got '%s'", tt.expected, joined)
+			}
+			if len(joined) > tt.max {
+				t.Errorf("expected at most %d bytes, but got %d", tt.max, len(joined))
+			}
+		})
+	}
+}
+
+func TestCertificateAnnotationsOnSecret(t *testing.T) {
+	chain, certs := fakeCertificateChain(t)
+	c := &Controller{vaultService: &fakeVaultService{fakeCertValue: chain}, options: &Options{}}
+
+	akvs := secret()
+	akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeCertificate
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "cert"
+
+	values, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.createNewSecret(akvs, values).Annotations[AnnotationCertificateSubject]; ok {
+		t.Error("certificate annotations should not be set unless enabled")
+	}
+
+	akvs.Spec.Output.Secret.Certificate.MetadataAnnotations = true
+	if values, err = c.getSecretFromKeyVault(akvs); err != nil {
+		t.Fatal(err)
+	}
+	newSecret := c.createNewSecret(akvs, values)
+
+	expected := map[string]string{
+		AnnotationCertificateSubject:      "CN=www.example.com",
+		AnnotationCertificateIssuer:       "CN=ca.example.com",
+		AnnotationCertificateSerial:       "2",
+		AnnotationCertificateNotAfter:     certs[0].NotAfter.UTC().Format("2006-01-02T15:04:05Z07:00"),
+		AnnotationCertificateKeyAlgorithm: "ECDSA-P-256",
+		AnnotationSourceObjectType:        "certificate",
+	}
+	for k, v := range expected {
+		if newSecret.Annotations[k] != v {
+			t.Errorf("expected annotation %s to be '%s', but was '%s'", k, v, newSecret.Annotations[k])
+		}
+	}
+
+	if c.hasCertificateAnnotationsChanged(akvs, newSecret) {
+		t.Error("expected no change for secret with current annotations")
+	}
+	delete(newSecret.Annotations, AnnotationCertificateNotAfter)
+	if !c.hasCertificateAnnotationsChanged(akvs, newSecret) {
+		t.Error("expected change when a certificate annotation is removed")
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/klog/v2"
+)
+
+// changeDetection returns how polls detect changes in Azure Key Vault for akvs, being
+// spec.vault.object.changeDetection or else the controller default
+func (c *Controller) changeDetection(akvs *akv.AzureKeyVaultSecret) akv.AzureKeyVaultChangeDetection {
+	if mode := akvs.Spec.Vault.Object.ChangeDetection; mode != "" {
+		return mode
+	}
+	if c.options != nil && c.options.ChangeDetection != "" {
+		return c.options.ChangeDetection
+	}
+	return akv.AzureKeyVaultChangeDetectionHash
+}
+
+// isVaultObjectUnchanged tells if akvs uses version change detection and the current version
+// of its object in Azure Key Vault, and when it was updated, match status. Listing versions
+// only reads metadata, so downloading and rendering large objects is skipped when nothing
+// changed. Objects without a version in status, like keys read without key material, and
+// failures to list versions are always treated as changed, falling back to comparing hashes.
+func (c *Controller) isVaultObjectUnchanged(akvs *akv.AzureKeyVaultSecret) bool {
+	if c.changeDetection(akvs) != akv.AzureKeyVaultChangeDetectionVersion || akvs.Status.VaultObjectVersion == "" {
+		return false
+	}
+	// pinned versions are not polled at all, see isPinnedVersionSynced
+	if akvs.Spec.Vault.Object.Version != "" {
+		return false
+	}
+
+	service, err := c.vaultServiceFor(akvs)
+	if err != nil {
+		return false
+	}
+	versions, err := service.GetObjectVersions(&akvs.Spec.Vault)
+	if err != nil {
+		klog.ErrorS(err, "failed to list object versions for change detection - reading object instead", "azurekeyvaultsecret", klog.KObj(akvs))
+		return false
+	}
+	current, err := vault.CurrentVersion(versions)
+	if err != nil {
+		return false
+	}
+
+	if current.Version != akvs.Status.VaultObjectVersion {
+		return false
+	}
+	// status is written with second precision
+	synced := akvs.Status.VaultObjectUpdated
+	if synced == nil || current.Updated.IsZero() {
+		return synced == nil && current.Updated.IsZero()
+	}
+	return current.Updated.Unix() == synced.Unix()
+}
@@ -0,0 +1,73 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsVaultObjectUnchanged(t *testing.T) {
+	created := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	updated := metav1.NewTime(created.Add(time.Hour))
+	versions := []vault.ObjectVersion{
+		{Version: "v1", Enabled: true, Created: created, Updated: created},
+		{Version: "v2", Enabled: true, Created: created.Add(time.Minute), Updated: updated.Time},
+	}
+
+	tests := []struct {
+		name            string
+		specMode        akv.AzureKeyVaultChangeDetection
+		defaultMode     akv.AzureKeyVaultChangeDetection
+		pinned          string
+		syncedVersion   string
+		syncedUpdated   *metav1.Time
+		expectUnchanged bool
+	}{
+		{"hash by default", "", "", "", "v2", &updated, false},
+		{"version in spec", akv.AzureKeyVaultChangeDetectionVersion, "", "", "v2", &updated, true},
+		{"version by controller default", "", akv.AzureKeyVaultChangeDetectionVersion, "", "v2", &updated, true},
+		{"hash in spec overrides controller default", akv.AzureKeyVaultChangeDetectionHash, akv.AzureKeyVaultChangeDetectionVersion, "", "v2", &updated, false},
+		{"new version", akv.AzureKeyVaultChangeDetectionVersion, "", "", "v1", &updated, false},
+		{"updated since synced", akv.AzureKeyVaultChangeDetectionVersion, "", "", "v2", &metav1.Time{Time: created}, false},
+		{"updated not in status", akv.AzureKeyVaultChangeDetectionVersion, "", "", "v2", nil, false},
+		{"not synced yet", akv.AzureKeyVaultChangeDetectionVersion, "", "", "", nil, false},
+		{"pinned version", akv.AzureKeyVaultChangeDetectionVersion, "", "v2", "v2", &updated, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{
+				vaultService: &fakeVaultService{fakeVersions: versions},
+				options:      &Options{ChangeDetection: tt.defaultMode},
+			}
+			akvs := secret()
+			akvs.Spec.Vault.Object.ChangeDetection = tt.specMode
+			akvs.Spec.Vault.Object.Version = tt.pinned
+			akvs.Status.VaultObjectVersion = tt.syncedVersion
+			akvs.Status.VaultObjectUpdated = tt.syncedUpdated
+
+			if unchanged := c.isVaultObjectUnchanged(akvs); unchanged != tt.expectUnchanged {
+				t.Errorf("expected unchanged %t, but got %t", tt.expectUnchanged, unchanged)
+			}
+		})
+	}
+}
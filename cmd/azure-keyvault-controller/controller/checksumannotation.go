@@ -0,0 +1,259 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// checksumAnnotationPrefix is prefixed to the name of the AzureKeyVaultSecret to get the
+// pod template annotation holding the checksum of its Secret values
+const checksumAnnotationPrefix = "akv2k8s.io/secret-checksum-"
+
+// checksumAnnotationKinds are the workload kinds that can be checksum annotation targets
+var checksumAnnotationKinds = []string{"Deployment", "StatefulSet", "DaemonSet"}
+
+func checksumAnnotation(akvs *akv.AzureKeyVaultSecret) string {
+	return checksumAnnotationPrefix + akvs.Name
+}
+
+// validateChecksumAnnotationTargets returns a problem for each target that is not a
+// supported workload kind
+func validateChecksumAnnotationTargets(field string, targets []akv.AzureKeyVaultWorkloadReference) []string {
+	var problems []string
+	for i, target := range targets {
+		if !isChecksumAnnotationKind(target.Kind) {
+			problems = append(problems, fmt.Sprintf("%s[%d].kind '%s' is invalid: must be one of %s", field, i, target.Kind, strings.Join(checksumAnnotationKinds, ", ")))
+		}
+	}
+	return problems
+}
+
+func isChecksumAnnotationKind(kind string) bool {
+	for _, k := range checksumAnnotationKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func containsWorkload(workloads []akv.AzureKeyVaultWorkloadReference, workload akv.AzureKeyVaultWorkloadReference) bool {
+	for _, w := range workloads {
+		if w == workload {
+			return true
+		}
+	}
+	return false
+}
+
+// syncChecksumAnnotations sets the checksum of the values last written to the output Secret in
+// the pod template of each workload in spec.output.secret.checksumAnnotationTargets, so they roll
+// out when the values change, and removes it from workloads no longer listed. Workloads not found
+// are skipped until the next sync. The annotated workloads are recorded in status.checksumAnnotationTargets.
+func (c *Controller) syncChecksumAnnotations(akvs *akv.AzureKeyVaultSecret) error {
+	if len(akvs.Spec.Output.Secret.ChecksumAnnotationTargets) == 0 && len(akvs.Status.ChecksumAnnotationTargets) == 0 {
+		return nil
+	}
+	if c.options != nil && c.options.ExportDir != "" {
+		klog.V(4).InfoS("not writing checksum annotations when exporting outputs", "azurekeyvaultsecret", klog.KObj(akvs))
+		return nil
+	}
+
+	// the status has the hash of the values just written
+	latest, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Get(context.TODO(), akvs.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	annotation := checksumAnnotation(latest)
+	targets := latest.Spec.Output.Secret.ChecksumAnnotationTargets
+	unchanged := c.legacyChecksumMatcher(latest)
+	var annotated []akv.AzureKeyVaultWorkloadReference
+	for _, target := range targets {
+		if latest.Status.SecretHash == "" {
+			break
+		}
+		checksum := latest.Status.SecretHash
+		if err := c.patchChecksumAnnotation(latest.Namespace, target, annotation, &checksum, unchanged); err != nil {
+			if errors.IsNotFound(err) {
+				klog.V(4).InfoS("checksum annotation target not found", "azurekeyvaultsecret", klog.KObj(latest), "kind", target.Kind, "name", target.Name)
+				continue
+			}
+			return fmt.Errorf("failed to annotate %s %s/%s with checksum, error: %+v", target.Kind, latest.Namespace, target.Name, err)
+		}
+		annotated = append(annotated, target)
+	}
+
+	for _, target := range latest.Status.ChecksumAnnotationTargets {
+		if containsWorkload(targets, target) {
+			continue
+		}
+		if err := c.patchChecksumAnnotation(latest.Namespace, target, annotation, nil, nil); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to remove checksum annotation from %s %s/%s, error: %+v", target.Kind, latest.Namespace, target.Name, err)
+		}
+	}
+
+	_, err = c.updateStatus(latest, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.ChecksumAnnotationTargets = annotated
+	})
+	return err
+}
+
+// legacyChecksumMatcher returns a func telling if a checksum annotation is the MD5 hash of the
+// values akvs last wrote to its output Secret, which workloads were annotated with before values
+// were hashed with SHA-256. Such workloads are left alone, so upgrading does not roll them out.
+// The Secret is only read for checksums of MD5 length, and at most once.
+func (c *Controller) legacyChecksumMatcher(akvs *akv.AzureKeyVaultSecret) func(current string) bool {
+	var legacy *string
+	return func(current string) bool {
+		if len(current) != legacyHashLength {
+			return false
+		}
+		if legacy == nil {
+			checksum := c.legacyChecksum(akvs)
+			legacy = &checksum
+		}
+		return *legacy != "" && current == *legacy
+	}
+}
+
+// legacyChecksum returns the MD5 hash of the values akvs last wrote to its output Secret, or
+// empty if the Secret does not hold the values hashed in status.secretHash
+func (c *Controller) legacyChecksum(akvs *akv.AzureKeyVaultSecret) string {
+	secret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), akvs.Spec.Output.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).InfoS("failed to get secret to compare legacy checksum", "azurekeyvaultsecret", klog.KObj(akvs), "error", err)
+		return ""
+	}
+
+	values := make(map[string][]byte, len(akvs.Status.SecretKeys))
+	for _, key := range akvs.Status.SecretKeys {
+		value, ok := secret.Data[key]
+		if !ok {
+			return ""
+		}
+		values[key] = value
+	}
+	if getHashOfByteValues(values) != akvs.Status.SecretHash {
+		return ""
+	}
+	return hashByteValues(md5.New(), values)
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// patchChecksumAnnotation sets the annotation in the pod template of target to checksum, or
+// removes it if checksum is nil, using a JSON patch touching only the annotation. Nothing is
+// patched if the annotation is already as wanted, or unchanged tells it is a checksum of the
+// same values.
+func (c *Controller) patchChecksumAnnotation(namespace string, target akv.AzureKeyVaultWorkloadReference, annotation string, checksum *string, unchanged func(current string) bool) error {
+	template, err := c.getPodTemplate(namespace, target)
+	if err != nil {
+		return err
+	}
+
+	const annotationsPath = "/spec/template/metadata/annotations"
+	path := annotationsPath + "/" + escapeJSONPointer(annotation)
+	current, found := template.Annotations[annotation]
+
+	var patch []jsonPatchOperation
+	switch {
+	case checksum == nil && !found:
+		return nil
+	case checksum == nil:
+		// fail instead of removing an annotation changed since read
+		patch = []jsonPatchOperation{{Op: "test", Path: path, Value: current}, {Op: "remove", Path: path}}
+	case found && current == *checksum:
+		return nil
+	case found && unchanged != nil && unchanged(current):
+		klog.V(4).InfoS("checksum annotation has legacy hash of unchanged values - not patching", "kind", target.Kind, "workload", klog.KRef(namespace, target.Name), "annotation", annotation)
+		return nil
+	case template.Annotations == nil:
+		patch = []jsonPatchOperation{{Op: "add", Path: annotationsPath, Value: map[string]string{annotation: *checksum}}}
+	default:
+		patch = []jsonPatchOperation{{Op: "add", Path: path, Value: *checksum}}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	klog.InfoS("patching checksum annotation", "kind", target.Kind, "workload", klog.KRef(namespace, target.Name), "annotation", annotation, "remove", checksum == nil)
+	return c.patchWorkload(namespace, target, data)
+}
+
+func (c *Controller) getPodTemplate(namespace string, target akv.AzureKeyVaultWorkloadReference) (*corev1.PodTemplateSpec, error) {
+	apps := c.kubeclientset.AppsV1()
+	switch target.Kind {
+	case "Deployment":
+		deployment, err := apps.Deployments(namespace).Get(context.TODO(), target.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &deployment.Spec.Template, nil
+	case "StatefulSet":
+		statefulSet, err := apps.StatefulSets(namespace).Get(context.TODO(), target.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &statefulSet.Spec.Template, nil
+	case "DaemonSet":
+		daemonSet, err := apps.DaemonSets(namespace).Get(context.TODO(), target.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &daemonSet.Spec.Template, nil
+	}
+	return nil, fmt.Errorf("unsupported checksum annotation target kind '%s'", target.Kind)
+}
+
+func (c *Controller) patchWorkload(namespace string, target akv.AzureKeyVaultWorkloadReference, patch []byte) error {
+	apps := c.kubeclientset.AppsV1()
+	var err error
+	switch target.Kind {
+	case "Deployment":
+		_, err = apps.Deployments(namespace).Patch(context.TODO(), target.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = apps.StatefulSets(namespace).Patch(context.TODO(), target.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	case "DaemonSet":
+		_, err = apps.DaemonSets(namespace).Patch(context.TODO(), target.Name, types.JSONPatchType, patch, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("unsupported checksum annotation target kind '%s'", target.Kind)
+	}
+	return err
+}
+
+// escapeJSONPointer escapes a key for use in a JSON pointer, as in RFC 6901
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,201 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func checksumSecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "output"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	akvs.Spec.Output.Secret.ChecksumAnnotationTargets = []akv.AzureKeyVaultWorkloadReference{{Kind: "Deployment", Name: "app"}}
+	akvs.Status.SecretHash = "first-hash"
+	return akvs
+}
+
+func createDeployment(t *testing.T, kubeclient *k8sfake.Clientset, annotations map[string]string) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: metav1.NamespaceDefault},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+			},
+		},
+	}
+	if _, err := kubeclient.AppsV1().Deployments(deployment.Namespace).Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTemplateAnnotations(t *testing.T, kubeclient *k8sfake.Clientset) map[string]string {
+	deployment, err := kubeclient.AppsV1().Deployments(metav1.NamespaceDefault).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployment.Spec.Template.Annotations
+}
+
+func countPatches(kubeclient *k8sfake.Clientset) int {
+	count := 0
+	for _, action := range kubeclient.Actions() {
+		if action.GetVerb() == "patch" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestChecksumAnnotationIsWrittenToPodTemplate(t *testing.T) {
+	akvs := checksumSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{})
+	createDeployment(t, kubeclient, map[string]string{"other": "value"})
+
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations := getTemplateAnnotations(t, kubeclient)
+	if annotations["akv2k8s.io/secret-checksum-test-name"] != "first-hash" {
+		t.Errorf("expected checksum annotation 'first-hash', but got annotations %v", annotations)
+	}
+	if annotations["other"] != "value" {
+		t.Errorf("expected other annotations to be kept, but got %v", annotations)
+	}
+
+	updated := getStatus(t, c, akvs)
+	if len(updated.Status.ChecksumAnnotationTargets) != 1 || updated.Status.ChecksumAnnotationTargets[0].Name != "app" {
+		t.Errorf("expected annotated workload in status, but got %v", updated.Status.ChecksumAnnotationTargets)
+	}
+
+	// unchanged values do not patch the workload again
+	if err := c.syncChecksumAnnotations(updated); err != nil {
+		t.Fatal(err)
+	}
+	if countPatches(kubeclient) != 1 {
+		t.Errorf("expected workload to be patched once, but was patched %d times", countPatches(kubeclient))
+	}
+
+	updated.Status.SecretHash = "second-hash"
+	if _, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncChecksumAnnotations(updated); err != nil {
+		t.Fatal(err)
+	}
+	if annotations := getTemplateAnnotations(t, kubeclient); annotations["akv2k8s.io/secret-checksum-test-name"] != "second-hash" {
+		t.Errorf("expected checksum annotation 'second-hash', but got annotations %v", annotations)
+	}
+}
+
+func TestChecksumAnnotationWithoutTemplateAnnotations(t *testing.T) {
+	akvs := checksumSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{})
+	createDeployment(t, kubeclient, nil)
+
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if annotations := getTemplateAnnotations(t, kubeclient); annotations["akv2k8s.io/secret-checksum-test-name"] != "first-hash" {
+		t.Errorf("expected checksum annotation 'first-hash', but got annotations %v", annotations)
+	}
+}
+
+func TestChecksumAnnotationIsRemovedWithTarget(t *testing.T) {
+	akvs := checksumSecret()
+	akvs.Spec.Output.Secret.ChecksumAnnotationTargets = nil
+	akvs.Status.ChecksumAnnotationTargets = []akv.AzureKeyVaultWorkloadReference{{Kind: "Deployment", Name: "app"}, {Kind: "StatefulSet", Name: "gone"}}
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{})
+	createDeployment(t, kubeclient, map[string]string{"other": "value", "akv2k8s.io/secret-checksum-test-name": "first-hash"})
+
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+
+	annotations := getTemplateAnnotations(t, kubeclient)
+	if _, found := annotations["akv2k8s.io/secret-checksum-test-name"]; found {
+		t.Errorf("expected checksum annotation to be removed, but got annotations %v", annotations)
+	}
+	if annotations["other"] != "value" {
+		t.Errorf("expected other annotations to be kept, but got %v", annotations)
+	}
+	if updated := getStatus(t, c, akvs); len(updated.Status.ChecksumAnnotationTargets) != 0 {
+		t.Errorf("expected no annotated workloads in status, but got %v", updated.Status.ChecksumAnnotationTargets)
+	}
+}
+
+func TestChecksumAnnotationTargetNotFound(t *testing.T) {
+	akvs := checksumSecret()
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if updated := getStatus(t, c, akvs); len(updated.Status.ChecksumAnnotationTargets) != 0 {
+		t.Errorf("expected missing workload not to be recorded as annotated, but got %v", updated.Status.ChecksumAnnotationTargets)
+	}
+}
+
+func TestValidateSpecChecksumAnnotationTargets(t *testing.T) {
+	akvs := checksumSecret()
+	akvs.Spec.Output.Secret.ChecksumAnnotationTargets = append(akvs.Spec.Output.Secret.ChecksumAnnotationTargets, akv.AzureKeyVaultWorkloadReference{Kind: "Pod", Name: "app"})
+
+	err := validateSpec(akvs)
+	if err == nil || err.Error() != "spec.output.secret.checksumAnnotationTargets[1].kind 'Pod' is invalid: must be one of Deployment, StatefulSet, DaemonSet" {
+		t.Errorf("expected invalid kind to be reported, but got %v", err)
+	}
+}
+
+func TestChecksumAnnotationWithLegacyHashOfUnchangedValues(t *testing.T) {
+	akvs, existing := legacySecret("value")
+	legacy := akvs.Status.SecretHash
+	akvs.Spec.Output.Secret.ChecksumAnnotationTargets = []akv.AzureKeyVaultWorkloadReference{{Kind: "Deployment", Name: "app"}}
+	akvs, _ = migrateSecretHash(akvs, existing.Data)
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, existing)
+	createDeployment(t, kubeclient, map[string]string{"akv2k8s.io/secret-checksum-test-name": legacy})
+
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if countPatches(kubeclient) != 0 {
+		t.Errorf("expected workload annotated with md5 hash of unchanged values not to be patched, but was patched %d times", countPatches(kubeclient))
+	}
+	if updated := getStatus(t, c, akvs); len(updated.Status.ChecksumAnnotationTargets) != 1 {
+		t.Errorf("expected workload to be recorded as annotated, but got %v", updated.Status.ChecksumAnnotationTargets)
+	}
+
+	// the values have changed since the workload was annotated
+	akvs.Status.SecretHash = getHashOfByteValues(map[string][]byte{"password": []byte("new-value")})
+	if _, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), akvs, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncChecksumAnnotations(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if annotations := getTemplateAnnotations(t, kubeclient); annotations["akv2k8s.io/secret-checksum-test-name"] != akvs.Status.SecretHash {
+		t.Errorf("expected checksum annotation '%s', but got annotations %v", akvs.Status.SecretHash, annotations)
+	}
+}
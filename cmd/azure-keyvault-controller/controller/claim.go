@@ -0,0 +1,112 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// claim claims akvs for this controller instance, returning false if akvs is claimed by a
+// different instance whose claim has not expired. The claim is renewed once half the TTL
+// has passed, unless a status write renewed it earlier.
+func (c *Controller) claim(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, bool, error) {
+	if c.options == nil || c.options.InstanceID == "" {
+		return akvs, true, nil
+	}
+
+	now := c.clock.Now().Time
+	claim := akvs.Status.Claim
+	if c.isClaimedByOther(akvs) {
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeManagedByOther) {
+			klog.InfoS("azurekeyvaultsecret claimed by other controller instance - not syncing until the claim expires", "azurekeyvaultsecret", klog.KObj(akvs), "instance", claim.Instance)
+			c.recorder.Event(akvs, corev1.EventTypeNormal, ConditionTypeManagedByOther, fmt.Sprintf("Managed by controller instance '%s'", claim.Instance))
+		}
+
+		// check again when the claim expires, in case the other instance is gone
+		if key, err := cache.MetaNamespaceKeyFunc(akvs); err == nil {
+			c.akvsCrdQueue.GetQueue().AddAfter(key, claim.RenewTime.Add(c.options.ClaimTTL).Sub(now))
+		}
+
+		updated, err := c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeManagedByOther,
+			Status:  metav1.ConditionTrue,
+			Reason:  "ClaimedByOtherInstance",
+			Message: fmt.Sprintf("Managed by controller instance '%s'", claim.Instance),
+		})
+		return updated, false, err
+	}
+
+	if claim != nil && claim.Instance == c.options.InstanceID && now.Sub(claim.RenewTime.Time) < c.options.ClaimTTL/2 &&
+		!meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeManagedByOther) {
+		return akvs, true, nil
+	}
+
+	if claim != nil && claim.Instance != c.options.InstanceID {
+		klog.InfoS("taking over azurekeyvaultsecret from controller instance with expired claim", "azurekeyvaultsecret", klog.KObj(akvs), "instance", claim.Instance)
+		c.recorder.Event(akvs, corev1.EventTypeNormal, "ClaimTakenOver", fmt.Sprintf("Took over from controller instance '%s' after its claim expired", claim.Instance))
+	}
+
+	updated, err := c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		c.renewClaim(akvsCopy)
+		if meta.FindStatusCondition(akvsCopy.Status.Conditions, ConditionTypeManagedByOther) != nil {
+			meta.SetStatusCondition(&akvsCopy.Status.Conditions, metav1.Condition{
+				Type:               ConditionTypeManagedByOther,
+				Status:             metav1.ConditionFalse,
+				Reason:             "ClaimedByThisInstance",
+				Message:            fmt.Sprintf("Managed by controller instance '%s'", c.options.InstanceID),
+				ObservedGeneration: akvsCopy.Generation,
+			})
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
+// isClaimedByOther tells if akvs is claimed by a different controller instance
+// whose claim has not expired
+func (c *Controller) isClaimedByOther(akvs *akv.AzureKeyVaultSecret) bool {
+	if c.options == nil || c.options.InstanceID == "" {
+		return false
+	}
+
+	claim := akvs.Status.Claim
+	if claim == nil || claim.Instance == c.options.InstanceID {
+		return false
+	}
+	return c.clock.Now().Time.Before(claim.RenewTime.Add(c.options.ClaimTTL))
+}
+
+// renewClaim sets the claim of this controller instance in the status of akvs, so
+// status written for other reasons renews the claim as well
+func (c *Controller) renewClaim(akvs *akv.AzureKeyVaultSecret) {
+	if c.options == nil || c.options.InstanceID == "" {
+		return
+	}
+	akvs.Status.Claim = &akv.AzureKeyVaultSecretClaim{
+		Instance:  c.options.InstanceID,
+		RenewTime: c.clock.Now(),
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var claimNow = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func claimController(t *testing.T, akvs *akv.AzureKeyVaultSecret) *Controller {
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+	c.options = &Options{InstanceID: "new", ClaimTTL: time.Minute}
+	c.clock = &fakeClock{now: claimNow}
+	c.akvsCrdQueue = newPriorityQueue("AzureKeyVaultSecrets", priorityHigh, 1, 1, nil, false, nil)
+	return c
+}
+
+func claimedSecret(instance string, renewed time.Time) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Status.Claim = &akv.AzureKeyVaultSecretClaim{Instance: instance, RenewTime: metav1.NewTime(renewed)}
+	return akvs
+}
+
+func TestClaimDisabled(t *testing.T) {
+	akvs := claimedSecret("old", claimNow)
+	c := claimController(t, akvs)
+	c.options.InstanceID = ""
+
+	if _, claimed, err := c.claim(akvs); err != nil || !claimed {
+		t.Errorf("expected claims to be ignored without instance id, but got claimed=%t, err=%v", claimed, err)
+	}
+}
+
+func TestClaimUnclaimed(t *testing.T) {
+	akvs := secret()
+	c := claimController(t, akvs)
+
+	if _, claimed, err := c.claim(akvs); err != nil || !claimed {
+		t.Fatalf("expected to claim azurekeyvaultsecret, but got claimed=%t, err=%v", claimed, err)
+	}
+
+	claim := getStatus(t, c, akvs).Status.Claim
+	if claim == nil || claim.Instance != "new" || !claim.RenewTime.Time.Equal(claimNow) {
+		t.Errorf("expected claim by 'new' at %s, but got %+v", claimNow, claim)
+	}
+}
+
+func TestClaimByOtherInstance(t *testing.T) {
+	akvs := claimedSecret("old", claimNow.Add(-30*time.Second))
+	c := claimController(t, akvs)
+
+	if _, claimed, err := c.claim(akvs); err != nil || claimed {
+		t.Fatalf("expected azurekeyvaultsecret claimed by other instance to be left alone, but got claimed=%t, err=%v", claimed, err)
+	}
+
+	status := getStatus(t, c, akvs).Status
+	if !meta.IsStatusConditionTrue(status.Conditions, ConditionTypeManagedByOther) {
+		t.Errorf("expected condition %s to be true, but got %+v", ConditionTypeManagedByOther, status.Conditions)
+	}
+	if status.Claim.Instance != "old" {
+		t.Errorf("expected claim by 'old' to be kept, but got %+v", status.Claim)
+	}
+}
+
+func TestClaimTakeOverExpired(t *testing.T) {
+	akvs := claimedSecret("old", claimNow.Add(-2*time.Minute))
+	meta.SetStatusCondition(&akvs.Status.Conditions, metav1.Condition{Type: ConditionTypeManagedByOther, Status: metav1.ConditionTrue, Reason: "ClaimedByOtherInstance"})
+	c := claimController(t, akvs)
+
+	if _, claimed, err := c.claim(akvs); err != nil || !claimed {
+		t.Fatalf("expected expired claim to be taken over, but got claimed=%t, err=%v", claimed, err)
+	}
+
+	status := getStatus(t, c, akvs).Status
+	if status.Claim == nil || status.Claim.Instance != "new" {
+		t.Errorf("expected claim by 'new', but got %+v", status.Claim)
+	}
+	if meta.IsStatusConditionTrue(status.Conditions, ConditionTypeManagedByOther) {
+		t.Errorf("expected condition %s to be false after take over", ConditionTypeManagedByOther)
+	}
+}
+
+func TestClaimRenewedAfterHalfTTL(t *testing.T) {
+	fresh := claimedSecret("new", claimNow.Add(-10*time.Second))
+	c := claimController(t, fresh)
+
+	updated, claimed, err := c.claim(fresh)
+	if err != nil || !claimed {
+		t.Fatalf("expected own claim, but got claimed=%t, err=%v", claimed, err)
+	}
+	if updated != fresh {
+		t.Error("expected fresh claim not to be renewed")
+	}
+
+	stale := claimedSecret("new", claimNow.Add(-40*time.Second))
+	c = claimController(t, stale)
+	if _, _, err := c.claim(stale); err != nil {
+		t.Fatal(err)
+	}
+	if claim := getStatus(t, c, stale).Status.Claim; !claim.RenewTime.Time.Equal(claimNow) {
+		t.Errorf("expected claim to be renewed at %s, but got %s", claimNow, claim.RenewTime)
+	}
+}
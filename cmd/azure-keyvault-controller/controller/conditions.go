@@ -0,0 +1,224 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ConditionTypeVersionResolved tells if the object version in spec.vault.object.versionFrom could be resolved
+	ConditionTypeVersionResolved = "VersionResolved"
+
+	// ConditionTypeNameResolved tells if the object name in spec.vault.object.nameFrom could be resolved
+	ConditionTypeNameResolved = "NameResolved"
+
+	// ConditionTypePollingDisabled tells if periodic polling of Azure Key Vault is disabled for the controller
+	ConditionTypePollingDisabled = "PollingDisabled"
+
+	// ConditionTypeOutputDeleted tells if the output Secret has been deleted and is kept deleted
+	// according to spec.output.secret.recreatePolicy
+	ConditionTypeOutputDeleted = "OutputDeleted"
+
+	// ConditionTypeOutputSynced tells if an output in spec.outputs was synced, and is set in
+	// the status of each output
+	ConditionTypeOutputSynced = "Synced"
+
+	// ConditionTypeConflicted tells if the output Secret is owned by a different AzureKeyVaultSecret,
+	// and how spec.output.secret.conflictPolicy was applied
+	ConditionTypeConflicted = "Conflicted"
+
+	// ConditionTypeKeyCollision tells if two sources write the same data key in the output
+	ConditionTypeKeyCollision = "KeyCollision"
+
+	// ConditionTypeInvalidSpec tells if the AzureKeyVaultSecret spec is invalid in a way retrying cannot fix
+	ConditionTypeInvalidSpec = "InvalidSpec"
+
+	// ConditionTypeKeyMismatch tells if the private key read from Azure Key Vault does not match its certificate
+	ConditionTypeKeyMismatch = "KeyMismatch"
+
+	// ConditionTypeServedFromFallback tells if values were read from the fallback Azure Key Vault
+	ConditionTypeServedFromFallback = "ServedFromFallback"
+
+	// ConditionTypeRotationPending tells if a change in Azure Key Vault is not applied to an
+	// output because spec.syncPolicy is ReportOnly
+	ConditionTypeRotationPending = "RotationPending"
+
+	// ConditionTypeTemplateResolved tells if the template in spec.output.secret.template or
+	// spec.output.secret.templateFrom could be resolved and parsed
+	ConditionTypeTemplateResolved = "TemplateResolved"
+
+	// ConditionTypeManagedByOther tells if the AzureKeyVaultSecret is claimed by a different
+	// controller instance, and left alone by this instance until the claim expires
+	ConditionTypeManagedByOther = "ManagedByOther"
+
+	// ConditionTypeSynced tells if the last sync of the AzureKeyVaultSecret succeeded and its
+	// outputs have the values in Azure Key Vault
+	ConditionTypeSynced = "Synced"
+
+	// ConditionTypeAzureReachable tells if Azure Key Vault could be reached when last read
+	ConditionTypeAzureReachable = "AzureReachable"
+
+	// ConditionTypeOutputExists tells if the output Secrets and ConfigMaps of the AzureKeyVaultSecret exist
+	ConditionTypeOutputExists = "OutputExists"
+
+	// ConditionTypeExpired tells if the version synced from Azure Key Vault is past its expiry
+	ConditionTypeExpired = "Expired"
+)
+
+// setCondition sets condition in the status of akvs and returns the updated akvs.
+// The status is only updated if the condition has changed.
+func (c *Controller) setCondition(akvs *akv.AzureKeyVaultSecret, condition metav1.Condition) (*akv.AzureKeyVaultSecret, error) {
+	return c.setConditions(akvs, condition)
+}
+
+// setConditions sets conditions in the status of akvs with a single update, and returns the
+// updated akvs. The status is only updated if any of the conditions has changed.
+func (c *Controller) setConditions(akvs *akv.AzureKeyVaultSecret, conditions ...metav1.Condition) (*akv.AzureKeyVaultSecret, error) {
+	if !isAnyConditionChanged(akvs, conditions) {
+		return akvs, nil
+	}
+
+	return c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		c.applyConditions(akvsCopy, conditions)
+	})
+}
+
+// applyConditions sets conditions in the status of akvs, as observed at its generation
+func (c *Controller) applyConditions(akvs *akv.AzureKeyVaultSecret, conditions []metav1.Condition) {
+	for _, condition := range conditions {
+		condition.ObservedGeneration = akvs.Generation
+		if condition.LastTransitionTime.IsZero() && c.clock != nil {
+			condition.LastTransitionTime = c.clock.Now()
+		}
+		meta.SetStatusCondition(&akvs.Status.Conditions, condition)
+	}
+}
+
+// isAnyConditionChanged tells if any of conditions differs from the conditions in the status of akvs
+func isAnyConditionChanged(akvs *akv.AzureKeyVaultSecret, conditions []metav1.Condition) bool {
+	for _, condition := range conditions {
+		existing := meta.FindStatusCondition(akvs.Status.Conditions, condition.Type)
+		if existing == nil ||
+			existing.Status != condition.Status ||
+			existing.Reason != condition.Reason ||
+			existing.Message != condition.Message ||
+			existing.ObservedGeneration != akvs.Generation {
+			return true
+		}
+	}
+	return false
+}
+
+// setPollingCondition sets the PollingDisabled condition if polling of Azure Key Vault
+// is disabled, or clears it if polling has been enabled again
+func (c *Controller) setPollingCondition(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	if c.options != nil && c.options.DisableAzurePolling {
+		return c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypePollingDisabled,
+			Status:  metav1.ConditionTrue,
+			Reason:  "DisabledByController",
+			Message: fmt.Sprintf("Azure Key Vault is not polled for changes, set or change annotation %s to sync", AnnotationForceSync),
+		})
+	}
+
+	if meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypePollingDisabled) == nil {
+		return akvs, nil
+	}
+	return c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypePollingDisabled,
+		Status:  metav1.ConditionFalse,
+		Reason:  "EnabledByController",
+		Message: "Azure Key Vault is polled for changes",
+	})
+}
+
+// checkKeyCollision sets the KeyCollision condition if getting values for akvs failed with err
+// because two sources write the same data key, or clears it once values are read without
+// collisions. Err is returned unchanged, while the status error is only logged.
+func (c *Controller) checkKeyCollision(akvs *akv.AzureKeyVaultSecret, err error) (*akv.AzureKeyVaultSecret, error) {
+	var condition metav1.Condition
+	switch {
+	case isKeyCollision(err):
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeKeyCollision) {
+			c.recorder.Event(akvs, corev1.EventTypeWarning, ConditionTypeKeyCollision, err.Error())
+		}
+		condition = metav1.Condition{
+			Type:    ConditionTypeKeyCollision,
+			Status:  metav1.ConditionTrue,
+			Reason:  "DuplicateDataKey",
+			Message: err.Error(),
+		}
+	case err == nil && meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeKeyCollision):
+		condition = metav1.Condition{
+			Type:    ConditionTypeKeyCollision,
+			Status:  metav1.ConditionFalse,
+			Reason:  "UniqueDataKeys",
+			Message: "All data keys are written by a single source",
+		}
+	default:
+		return akvs, err
+	}
+
+	updated, statusErr := c.setCondition(akvs, condition)
+	if statusErr != nil {
+		klog.ErrorS(statusErr, "failed to update key collision condition", "azurekeyvaultsecret", klog.KObj(akvs))
+		return akvs, err
+	}
+	return updated, err
+}
+
+// checkKeyMismatch sets the KeyMismatch condition if getting values for akvs failed with err
+// because the private key does not match the certificate, or clears it once values are read
+// with a matching key. Err is returned unchanged, so the previous output is kept.
+func (c *Controller) checkKeyMismatch(akvs *akv.AzureKeyVaultSecret, err error) (*akv.AzureKeyVaultSecret, error) {
+	var condition metav1.Condition
+	switch {
+	case isKeyMismatch(err):
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeKeyMismatch) {
+			c.recorder.Event(akvs, corev1.EventTypeWarning, ConditionTypeKeyMismatch, err.Error())
+		}
+		condition = metav1.Condition{
+			Type:    ConditionTypeKeyMismatch,
+			Status:  metav1.ConditionTrue,
+			Reason:  "PrivateKeyMismatch",
+			Message: err.Error(),
+		}
+	case err == nil && meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeKeyMismatch):
+		condition = metav1.Condition{
+			Type:    ConditionTypeKeyMismatch,
+			Status:  metav1.ConditionFalse,
+			Reason:  "PrivateKeyMatches",
+			Message: "The private key matches the certificate",
+		}
+	default:
+		return akvs, err
+	}
+
+	updated, statusErr := c.setCondition(akvs, condition)
+	if statusErr != nil {
+		klog.ErrorS(statusErr, "failed to update key mismatch condition", "azurekeyvaultsecret", klog.KObj(akvs))
+		return akvs, err
+	}
+	return updated, err
+}
@@ -0,0 +1,93 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPollingCondition(t *testing.T) {
+	akvs := secret()
+	client := akvfake.NewSimpleClientset(akvs)
+	c := &Controller{akvsClient: client, options: &Options{}}
+
+	updated, err := c.setPollingCondition(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.FindStatusCondition(updated.Status.Conditions, ConditionTypePollingDisabled) != nil {
+		t.Error("condition should not be added when polling is enabled")
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("expected no status update, but got %v", client.Actions())
+	}
+
+	c.options.DisableAzurePolling = true
+	updated, err = c.setPollingCondition(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(updated.Status.Conditions, ConditionTypePollingDisabled) {
+		t.Error("expected condition to be true when polling is disabled")
+	}
+
+	c.options.DisableAzurePolling = false
+	updated, err = c.setPollingCondition(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypePollingDisabled)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Errorf("expected condition to be false when polling is enabled again, but got %v", condition)
+	}
+}
+
+func TestKeyCollisionCondition(t *testing.T) {
+	akvs := secret()
+	client := akvfake.NewSimpleClientset(akvs)
+	c := &Controller{akvsClient: client, recorder: record.NewFakeRecorder(10), options: &Options{}}
+
+	// other errors do not change the condition
+	updated, err := c.checkKeyCollision(akvs, errors.New("vault not found"))
+	if err == nil || meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeKeyCollision) != nil {
+		t.Errorf("expected error to be returned without condition, but got %v", updated.Status.Conditions)
+	}
+
+	collision := &keyCollisionError{key: "tls.key", source: "the certificate", source2: "the private key"}
+	updated, err = c.checkKeyCollision(updated, collision)
+	if err != collision {
+		t.Errorf("expected key collision error to be returned, but got %v", err)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeKeyCollision)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Message != collision.Error() {
+		t.Errorf("expected condition naming the colliding key, but got %v", condition)
+	}
+
+	updated, err = c.checkKeyCollision(updated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionFalse(updated.Status.Conditions, ConditionTypeKeyCollision) {
+		t.Error("expected condition to be cleared once keys are unique")
+	}
+}
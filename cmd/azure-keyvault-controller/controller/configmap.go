@@ -22,9 +22,10 @@ package controller
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"sort"
 
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
@@ -47,12 +48,17 @@ func (c *Controller) getConfigMap(ns, name string) (*corev1.ConfigMap, error) {
 }
 
 func (c *Controller) deleteKubernetesConfigMapValues(akvs *akv.AzureKeyVaultSecret) error {
+	if isImmutableConfigMap(akvs) {
+		// immutable configmaps are not shared, and are garbage collected with the AzureKeyVaultSecret
+		return nil
+	}
+
 	cm, err := c.getConfigMap(akvs.Namespace, akvs.Spec.Output.ConfigMap.Name)
 	if errors.IsNotFound(err) {
 		return nil
 	}
 
-	cmData := cm.Data
+	cmData := configMapValues(cm)
 
 	data, err := c.getConfigMapFromKeyVault(akvs)
 	if err != nil {
@@ -63,26 +69,43 @@ func (c *Controller) deleteKubernetesConfigMapValues(akvs *akv.AzureKeyVaultSecr
 		delete(cmData, key)
 	}
 
-	newCM, err := createNewConfigMapFromExistingWithUpdatedValues(akvs, cmData, cm)
+	// keys written by akvs during the last sync and no longer produced are kept, and stay
+	// where akvs would write them
+	written := make(map[string]string)
+	for _, key := range akvs.Status.ConfigMapKeys {
+		if value, ok := cmData[key]; ok {
+			written[key] = value
+		}
+	}
+
+	newCM, err := createNewConfigMapFromExistingWithUpdatedValues(akvs, cmData, written, cm)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Update(context.TODO(), newCM, metav1.UpdateOptions{})
+	_, err = c.writer().PatchConfigMap(context.TODO(), cm, newCM)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Controller) getOrCreateKubernetesConfigMap(akvs *akv.AzureKeyVaultSecret) (*corev1.ConfigMap, error) {
+// getOrCreateKubernetesConfigMap creates or updates the output ConfigMap of akvs. With syncPolicy
+// ReportOnly an existing ConfigMap is only updated when forceSync is set, otherwise the change is
+// returned as pending.
+func (c *Controller) getOrCreateKubernetesConfigMap(akvs *akv.AzureKeyVaultSecret, forceSync bool) (*corev1.ConfigMap, *pendingRotation, error) {
 	var cm *corev1.ConfigMap
 	var cmValues map[string]string
 	var err error
 
 	cmName := akvs.Spec.Output.ConfigMap.Name
 	if cmName == "" {
-		return nil, fmt.Errorf("output configmap name must be specified using spec.output.configMap.name")
+		return nil, nil, fmt.Errorf("output configmap name must be specified using spec.output.configMap.name")
+	}
+
+	if isImmutableConfigMap(akvs) {
+		_, cm, rotation, err := c.syncImmutableConfigMap(akvs, forceSync)
+		return cm, rotation, err
 	}
 
 	klog.V(4).InfoS("get or create configmap", "configmap", klog.KRef(akvs.Namespace, cmName))
@@ -92,28 +115,34 @@ func (c *Controller) getOrCreateKubernetesConfigMap(akvs *akv.AzureKeyVaultSecre
 			klog.V(4).InfoS("configmap was not found", "configmap", klog.KRef(akvs.Namespace, cmName))
 			klog.V(4).InfoS("getting configmap value from azure key vault", "configmap", klog.KRef(akvs.Namespace, cmName))
 			cmValues, err = c.getConfigMapFromKeyVault(akvs)
+			akvs, err = c.checkKeyCollision(akvs, err)
 			if err != nil {
-				return nil, fmt.Errorf("failed to get configmap from azure key vault for configmap '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
+				return nil, nil, fmt.Errorf("failed to get configmap from azure key vault for configmap '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
 			}
 
-			if cm, err = c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Create(context.TODO(), createNewConfigMap(akvs, cmValues), metav1.CreateOptions{}); err != nil {
-				return nil, fmt.Errorf("failed to create new configmap, err: %+v", err)
+			failedWrite := c.hasFailedWrite(outputKindConfigMap, akvs.Namespace, cmName)
+			if cm, err = c.writer().CreateConfigMap(context.TODO(), c.createNewConfigMap(akvs, cmValues)); err != nil {
+				return nil, nil, fmt.Errorf("failed to create new configmap, err: %+v", err)
+			}
+			if akvs.Status.ConfigMapName == cmName {
+				c.reportDriftRepaired(akvs, outputKindConfigMap, cmName, sortStringValueKeys(configMapValues(cm)), failedWrite)
 			}
 
 			klog.InfoS("updating status for azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs))
-			if err = c.updateAzureKeyVaultSecretStatusForConfigMap(akvs, getMD5HashOfStringValues(cmValues)); err != nil {
-				return nil, fmt.Errorf("failed to update status for azurekeyvaultsecret %s, error: %+v", akvs.Name, err)
+			if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenConfigMap(akvs, cmValues)); err != nil {
+				return nil, nil, fmt.Errorf("failed to update status for azurekeyvaultsecret %s, error: %+v", akvs.Name, err)
 			}
 			c.recorder.Event(cm, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
-			return cm, nil
+			return cm, nil, nil
 		}
 	}
 
 	// get updated secret values from azure key vault
 	klog.V(4).InfoS("getting secret from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs))
 	cmValues, err = c.getConfigMapFromKeyVault(akvs)
+	akvs, err = c.checkKeyCollision(akvs, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
+		return nil, nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
 	}
 
 	if cmName != cm.Name {
@@ -123,48 +152,78 @@ func (c *Controller) getOrCreateKubernetesConfigMap(akvs *akv.AzureKeyVaultSecre
 		// Only delete if this akvs is the only owner
 		if !hasMultipleOwners(cm.GetOwnerReferences()) {
 			// Delete configmap
-			if err = c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}); err != nil {
-				return nil, err
+			if err = c.writer().DeleteConfigMap(context.TODO(), akvs.Namespace, cm.Name); err != nil {
+				return nil, nil, err
 			}
 		}
 		// Recreate configmap under new Name
-		if cm, err = c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Create(context.TODO(), createNewConfigMap(akvs, cmValues), metav1.CreateOptions{}); err != nil {
-			return nil, err
+		if cm, err = c.writer().CreateConfigMap(context.TODO(), c.createNewConfigMap(akvs, cmValues)); err != nil {
+			return nil, nil, err
 		}
 		c.recorder.Event(cm, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
-		return cm, nil
+		return cm, nil, nil
 	}
 
-	if hasAzureKeyVaultSecretChangedForConfigMap(akvs, cmValues, cm) {
+	hash := getHashOfStringValues(cmValues)
+	akvs, migrated := migrateConfigMapHash(akvs, cmValues)
+	valuesChanged := hasAzureKeyVaultSecretChangedForConfigMap(akvs, cmValues, cm)
+	if valuesChanged && isReportOnly(akvs, forceSync) {
+		klog.V(4).InfoS("values have changed, not updating configmap with sync policy ReportOnly", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+		return cm, &pendingRotation{kind: outputKindConfigMap, name: cm.Name, hash: hash}, nil
+	}
+	if valuesChanged && akvs.Status.ConfigMapHash != hash && c.isRotationDebounced(akvs, forceSync) {
+		klog.V(4).InfoS("values have changed, not updating configmap until rotation debounce ends", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm), "applyTime", akvs.Status.DebouncedRotation.ApplyTime)
+		return cm, nil, nil
+	}
+
+	if valuesChanged || c.hasProvenanceAnnotationsChanged(akvs, cm) {
 		klog.InfoS("values have changed requiring update to configmap", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
 
-		updatedCM, err := createNewConfigMapFromExisting(akvs, cmValues, cm)
+		updatedCM, err := c.createNewConfigMapFromExisting(akvs, cmValues, cm)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		cm, err = c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Update(context.TODO(), updatedCM, metav1.UpdateOptions{})
-		if err == nil {
-			klog.InfoS("configmap updated", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
-			c.recorder.Event(cm, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
+		// the values in Azure Key Vault are unchanged since last written, so the configmap has drifted
+		drift := valuesChanged && akvs.Status.ConfigMapHash == hash
+		keys := changedConfigMapKeys(configMapValues(cm), configMapValues(updatedCM))
+		failedWrite := c.hasFailedWrite(outputKindConfigMap, cm.Namespace, cm.Name)
+		cm, err = c.writer().PatchConfigMap(context.TODO(), cm, updatedCM)
+		if err != nil {
+			return nil, nil, err
+		}
+		klog.InfoS("configmap updated", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+		if drift {
+			c.reportDriftRepaired(akvs, outputKindConfigMap, cm.Name, keys, failedWrite)
+		}
+		c.recorder.Event(cm, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
+
+		if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenConfigMap(akvs, cmValues)); err != nil {
+			return nil, nil, err
+		}
+	} else if migrated {
+		klog.V(4).InfoS("values unchanged, recording sha-256 hash in status", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+		if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenConfigMap(akvs, cmValues)); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return cm, err
+	return cm, nil, err
 }
 
 // createNewConfigMap creates a new ConfigMap for a AzureKeyVaultSecret resource. It also sets
 // the appropriate OwnerReferences on the resource so handleObject can discover
 // the AzureKeyVaultSecret resource that 'owns' it.
-func createNewConfigMap(azureKeyVaultSecret *akv.AzureKeyVaultSecret, azureSecretValue map[string]string) *corev1.ConfigMap {
+func (c *Controller) createNewConfigMap(azureKeyVaultSecret *akv.AzureKeyVaultSecret, azureSecretValue map[string]string) *corev1.ConfigMap {
 	cmName := determineConfigMapName(azureKeyVaultSecret)
+	data, binaryData := splitConfigMapValues(azureKeyVaultSecret, azureSecretValue, azureSecretValue, nil)
 
 	return &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        cmName,
 			Namespace:   azureKeyVaultSecret.Namespace,
 			Labels:      azureKeyVaultSecret.Labels,
-			Annotations: azureKeyVaultSecret.Annotations,
+			Annotations: c.outputAnnotations(azureKeyVaultSecret),
 			OwnerReferences: []metav1.OwnerReference{
 				*newOwnerRef(azureKeyVaultSecret, schema.GroupVersionKind{
 					Group:   akv.SchemeGroupVersion.Group,
@@ -173,7 +232,8 @@ func createNewConfigMap(azureKeyVaultSecret *akv.AzureKeyVaultSecret, azureSecre
 				}),
 			},
 		},
-		Data: azureSecretValue,
+		Data:       data,
+		BinaryData: binaryData,
 	}
 }
 
@@ -193,7 +253,7 @@ func newOwnerRef(owner metav1.Object, gvk schema.GroupVersionKind) *metav1.Owner
 // updateExistingSecret creates a new Secret for a AzureKeyVaultSecret resource. It also sets
 // the appropriate OwnerReferences on the resource so handleObject can discover
 // the AzureKeyVaultSecret resource that 'owns' it.
-func createNewConfigMapFromExisting(akvs *akv.AzureKeyVaultSecret, values map[string]string, existingCM *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+func (c *Controller) createNewConfigMapFromExisting(akvs *akv.AzureKeyVaultSecret, values map[string]string, existingCM *corev1.ConfigMap) (*corev1.ConfigMap, error) {
 	cmName := determineConfigMapName(akvs)
 	cmClone := existingCM.DeepCopy()
 	ownerRefs := cmClone.GetOwnerReferences()
@@ -206,29 +266,34 @@ func createNewConfigMapFromExisting(akvs *akv.AzureKeyVaultSecret, values map[st
 		}))
 	}
 
-	mergedValues := mergeValuesWithExistingConfigMap(values, existingCM)
+	mergedValues := mergeValuesWithExistingConfigMap(values, existingCM, getStaleConfigMapKeys(akvs, values, existingCM))
+	data, binaryData := splitConfigMapValues(akvs, mergedValues, values, existingCM)
 
-	return &corev1.ConfigMap{
+	updated := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            cmName,
 			Namespace:       akvs.Namespace,
 			Labels:          akvs.Labels,
-			Annotations:     akvs.Annotations,
+			Annotations:     c.outputAnnotations(akvs),
 			OwnerReferences: ownerRefs,
 		},
-		Data: mergedValues,
-	}, nil
+		Data:       data,
+		BinaryData: binaryData,
+	}
+	keepRotationGeneration(updated, existingCM)
+	return updated, nil
 }
 
-// updateExistingSecret creates a new Secret for a AzureKeyVaultSecret resource. It also sets
-// the appropriate OwnerReferences on the resource so handleObject can discover
-// the AzureKeyVaultSecret resource that 'owns' it.
-func createNewConfigMapFromExistingWithUpdatedValues(akvs *akv.AzureKeyVaultSecret, values map[string]string, existingCM *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+// createNewConfigMapFromExistingWithUpdatedValues returns existingCM with values as its data.
+// Values in written were written by akvs and are split into data and binaryData as akvs
+// writes them, while other values stay where they are in existingCM.
+func createNewConfigMapFromExistingWithUpdatedValues(akvs *akv.AzureKeyVaultSecret, values, written map[string]string, existingCM *corev1.ConfigMap) (*corev1.ConfigMap, error) {
 	cmName := determineConfigMapName(akvs)
 	cmClone := existingCM.DeepCopy()
 	ownerRefs := cmClone.GetOwnerReferences()
+	data, binaryData := splitConfigMapValues(akvs, values, written, existingCM)
 
-	return &corev1.ConfigMap{
+	updated := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            cmName,
 			Namespace:       akvs.Namespace,
@@ -236,11 +301,14 @@ func createNewConfigMapFromExistingWithUpdatedValues(akvs *akv.AzureKeyVaultSecr
 			Annotations:     akvs.Annotations,
 			OwnerReferences: ownerRefs,
 		},
-		Data: values,
-	}, nil
+		Data:       data,
+		BinaryData: binaryData,
+	}
+	keepRotationGeneration(updated, existingCM)
+	return updated, nil
 }
 
-func mergeValuesWithExistingConfigMap(values map[string]string, cm *corev1.ConfigMap) map[string]string {
+func mergeValuesWithExistingConfigMap(values map[string]string, cm *corev1.ConfigMap, staleKeys []string) map[string]string {
 	newValues := make(map[string]string)
 
 	// copy existing values into new map
@@ -248,15 +316,36 @@ func mergeValuesWithExistingConfigMap(values map[string]string, cm *corev1.Confi
 		newValues[k] = v
 	}
 
-	// copy any values from existing secret that does not exist in akvs values
-	for key, val := range cm.Data {
+	// copy any values from existing configmap that does not exist in akvs values
+	for key, val := range configMapValues(cm) {
 		if _, ok := values[key]; !ok {
 			newValues[key] = val
 		}
 	}
+
+	// remove keys previously written by this akvs, but no longer produced
+	for _, key := range staleKeys {
+		delete(newValues, key)
+	}
 	return newValues
 }
 
+// getStaleConfigMapKeys returns keys in cm that was written by akvs during the last
+// sync, but is no longer part of the akvs values
+func getStaleConfigMapKeys(akvs *akv.AzureKeyVaultSecret, akvsValues map[string]string, cm *corev1.ConfigMap) []string {
+	var stale []string
+	cmValues := configMapValues(cm)
+	for _, key := range akvs.Status.ConfigMapKeys {
+		if _, ok := akvsValues[key]; ok {
+			continue
+		}
+		if _, ok := cmValues[key]; ok {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
+
 func determineConfigMapName(azureKeyVaultSecret *akv.AzureKeyVaultSecret) string {
 	name := azureKeyVaultSecret.Spec.Output.ConfigMap.Name
 	if name == "" {
@@ -265,7 +354,11 @@ func determineConfigMapName(azureKeyVaultSecret *akv.AzureKeyVaultSecret) string
 	return name
 }
 
-func getMD5HashOfStringValues(values map[string]string) string {
+func getHashOfStringValues(values map[string]string) string {
+	return hashStringValues(sha256.New(), values)
+}
+
+func hashStringValues(hasher hash.Hash, values map[string]string) string {
 	var mergedValues bytes.Buffer
 
 	// sort keys to make sure hash is consistent
@@ -275,16 +368,15 @@ func getMD5HashOfStringValues(values map[string]string) string {
 		mergedValues.WriteString(k + values[k])
 	}
 
-	hasher := md5.New()
 	hasher.Write(mergedValues.Bytes())
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-func getMD5HashOfConfigMap(akvsValues map[string]string, cm *corev1.ConfigMap) string {
+func getHashOfConfigMap(akvsValues map[string]string, cm *corev1.ConfigMap) string {
 	// filter out only values related to this akvs,
 	// as multiple akvs can write to a single secret
-	values := filterStringValueKeys(akvsValues, cm.Data)
-	return getMD5HashOfStringValues(values)
+	values := filterStringValueKeys(akvsValues, configMapValues(cm))
+	return getHashOfStringValues(values)
 }
 
 func filterStringValueKeys(akvsValues, cmValues map[string]string) map[string]string {
@@ -0,0 +1,83 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"unicode/utf8"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// isBinaryConfigMapValue tells if value is written to binaryData of the output ConfigMap of akvs,
+// as ConfigMap data only holds UTF-8 text
+func isBinaryConfigMapValue(akvs *akv.AzureKeyVaultSecret, value string) bool {
+	return akvs.Spec.Output.ConfigMap.ForceBinary || !utf8.ValidString(value)
+}
+
+// configMapValues returns the data and binaryData of cm as one map, keys being unique across both
+func configMapValues(cm *corev1.ConfigMap) map[string]string {
+	values := make(map[string]string, len(cm.Data)+len(cm.BinaryData))
+	for key, value := range cm.Data {
+		values[key] = value
+	}
+	for key, value := range cm.BinaryData {
+		values[key] = string(value)
+	}
+	return values
+}
+
+// splitConfigMapValues splits values into the data and binaryData of the output ConfigMap of akvs.
+// Values written by akvs go to binaryData when isBinaryConfigMapValue, while other keys of existing
+// stay where they are, so binaryData written by others is kept as binaryData.
+func splitConfigMapValues(akvs *akv.AzureKeyVaultSecret, values, written map[string]string, existing *corev1.ConfigMap) (map[string]string, map[string][]byte) {
+	data := make(map[string]string, len(values))
+	var binaryData map[string][]byte
+	for key, value := range values {
+		binary := !utf8.ValidString(value)
+		if _, ok := written[key]; ok {
+			binary = isBinaryConfigMapValue(akvs, value)
+		} else if existing != nil {
+			if _, ok := existing.BinaryData[key]; ok {
+				binary = true
+			}
+		}
+
+		if !binary {
+			data[key] = value
+			continue
+		}
+		if binaryData == nil {
+			binaryData = make(map[string][]byte)
+		}
+		binaryData[key] = []byte(value)
+	}
+	return data, binaryData
+}
+
+// hasConfigMapBinaryDataChanged tells if any value written by akvs to cm is in data while it
+// should be in binaryData or the other way around, like when forceBinary has changed
+func hasConfigMapBinaryDataChanged(akvs *akv.AzureKeyVaultSecret, akvsValues map[string]string, cm *corev1.ConfigMap) bool {
+	for key, value := range akvsValues {
+		_, inData := cm.Data[key]
+		_, inBinaryData := cm.BinaryData[key]
+		if (inData || inBinaryData) && inBinaryData != isBinaryConfigMapValue(akvs, value) {
+			return true
+		}
+	}
+	return false
+}
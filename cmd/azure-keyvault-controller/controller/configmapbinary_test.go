@@ -0,0 +1,125 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// derValue is not valid UTF-8, like a der encoded certificate
+const derValue = "\x30\x82\x02\xff\x00"
+
+func TestCreateNewConfigMapWritesBinaryData(t *testing.T) {
+	c := &Controller{options: &Options{}}
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+
+	cm := c.createNewConfigMap(akvs, map[string]string{"ca.der": derValue, "host": "db.local"})
+	if !reflect.DeepEqual(cm.Data, map[string]string{"host": "db.local"}) {
+		t.Errorf("expected only text in data, but got %v", cm.Data)
+	}
+	if !reflect.DeepEqual(cm.BinaryData, map[string][]byte{"ca.der": []byte(derValue)}) {
+		t.Errorf("expected der in binaryData, but got %v", cm.BinaryData)
+	}
+
+	akvs.Spec.Output.ConfigMap.ForceBinary = true
+	cm = c.createNewConfigMap(akvs, map[string]string{"ca.der": derValue, "host": "db.local"})
+	if len(cm.Data) != 0 || len(cm.BinaryData) != 2 || string(cm.BinaryData["host"]) != "db.local" {
+		t.Errorf("expected all values in binaryData with forceBinary, but got data %v and binaryData %v", cm.Data, cm.BinaryData)
+	}
+}
+
+func TestUpdateConfigMapKeepsBinaryData(t *testing.T) {
+	c := &Controller{options: &Options{}}
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+	akvs.Status.ConfigMapKeys = []string{"ca.der", "host"}
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: akvs.Namespace},
+		Data:       map[string]string{"host": "db.local", "other": "text"},
+		BinaryData: map[string][]byte{"ca.der": []byte(derValue), "other.bin": []byte("written as binary by someone else")},
+	}
+
+	values := map[string]string{"ca.der": derValue, "host": "db.other"}
+	akvs.Status.ConfigMapHash = getHashOfStringValues(map[string]string{"ca.der": derValue, "host": "db.local"})
+	if !hasAzureKeyVaultSecretChangedForConfigMap(akvs, values, existing) {
+		t.Error("configmap should need update when a text value has changed")
+	}
+
+	updated, err := c.createNewConfigMapFromExisting(akvs, values, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(updated.Data, map[string]string{"host": "db.other", "other": "text"}) {
+		t.Errorf("unexpected data %v", updated.Data)
+	}
+	expected := map[string][]byte{"ca.der": []byte(derValue), "other.bin": []byte("written as binary by someone else")}
+	if !reflect.DeepEqual(updated.BinaryData, expected) {
+		t.Errorf("expected binaryData %v to be kept, but got %v", expected, updated.BinaryData)
+	}
+}
+
+func TestBinaryDataChangeDetection(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+	values := map[string]string{"ca.der": derValue, "host": "db.local"}
+	akvs.Status.ConfigMapHash = getHashOfStringValues(values)
+
+	cm := (&Controller{options: &Options{}}).createNewConfigMap(akvs, values)
+	if hasAzureKeyVaultSecretChangedForConfigMap(akvs, values, cm) {
+		t.Error("configmap with unchanged binaryData should not need update")
+	}
+
+	cm.BinaryData["ca.der"] = []byte("\x30\x82\x00")
+	if !hasAzureKeyVaultSecretChangedForConfigMap(akvs, values, cm) {
+		t.Error("configmap should need update when binaryData has changed")
+	}
+
+	cm = (&Controller{options: &Options{}}).createNewConfigMap(akvs, values)
+	akvs.Spec.Output.ConfigMap.ForceBinary = true
+	if !hasAzureKeyVaultSecretChangedForConfigMap(akvs, values, cm) {
+		t.Error("configmap should need update when forceBinary moves text values to binaryData")
+	}
+}
+
+func TestDeleteConfigMapValuesHonoursForceBinary(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+	akvs.Spec.Output.ConfigMap.ForceBinary = true
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: akvs.Namespace},
+		Data:       map[string]string{"host": "db.local", "other": "text"},
+	}
+	values := map[string]string{"host": "db.local", "other": "text"}
+
+	updated, err := createNewConfigMapFromExistingWithUpdatedValues(akvs, values, map[string]string{"host": "db.local"}, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(updated.Data, map[string]string{"other": "text"}) {
+		t.Errorf("expected values of others to stay in data, but got %v", updated.Data)
+	}
+	if !reflect.DeepEqual(updated.BinaryData, map[string][]byte{"host": []byte("db.local")}) {
+		t.Errorf("expected values written by akvs in binaryData with forceBinary, but got %v", updated.BinaryData)
+	}
+}
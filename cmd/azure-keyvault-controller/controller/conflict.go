@@ -0,0 +1,182 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationAllowTakeover can be set on an AzureKeyVaultSecret to the name of another
+// AzureKeyVaultSecret in the same namespace, allowing it to take over the output Secret
+// with conflictPolicy TakeOver
+const AnnotationAllowTakeover = "akv2k8s.io/allow-takeover"
+
+// otherSecretOwner returns the name of the AzureKeyVaultSecret other than akvs owning secret, if any
+func otherSecretOwner(secret *corev1.Secret, akvs *akv.AzureKeyVaultSecret) string {
+	for _, ref := range secret.GetOwnerReferences() {
+		if ref.Kind == "AzureKeyVaultSecret" && ref.UID != akvs.UID {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+// isTakeoverAllowed tells if the outputs of owner can be taken over by akvs
+func (c *Controller) isTakeoverAllowed(owner, akvs *akv.AzureKeyVaultSecret) bool {
+	if c.options != nil && c.options.AllowTakeover {
+		return true
+	}
+	return owner != nil && owner.Annotations[AnnotationAllowTakeover] == akvs.Name
+}
+
+// resolveSecretConflict checks if the output Secret of akvs is owned by a different
+// AzureKeyVaultSecret, and applies spec.output.secret.conflictPolicy. It returns false if
+// the Secret should not be synced. Opaque Secrets can have several owners, each writing
+// its own keys, so they are never in conflict.
+func (c *Controller) resolveSecretConflict(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, bool, error) {
+	name := akvs.Spec.Output.Secret.Name
+	secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return akvs, false, err
+	}
+
+	ownerName := ""
+	if err == nil && secret.Type != corev1.SecretTypeOpaque && !isOwnedBy(secret, akvs) {
+		ownerName = otherSecretOwner(secret, akvs)
+	}
+	if ownerName == "" {
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeConflicted) {
+			return akvs, true, nil
+		}
+		akvs, err = c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeConflicted,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NoConflict",
+			Message: fmt.Sprintf("Secret '%s' is not owned by another AzureKeyVaultSecret", name),
+		})
+		return akvs, true, err
+	}
+
+	owner, err := c.azureKeyVaultSecretLister.AzureKeyVaultSecrets(akvs.Namespace).Get(ownerName)
+	if err != nil && !errors.IsNotFound(err) {
+		return akvs, false, err
+	}
+	if errors.IsNotFound(err) {
+		owner = nil
+	}
+
+	// the owner took over the secret, which akvs acknowledged or the controller allows
+	if owner != nil && owner.Spec.Output.Secret.ConflictPolicy == akv.AzureKeyVaultConflictPolicyTakeOver && c.isTakeoverAllowed(akvs, owner) {
+		akvs, err = c.setConflictCondition(akvs, owner, "TakenOver", fmt.Sprintf("Secret '%s' was taken over by AzureKeyVaultSecret '%s' and is no longer synced", name, ownerName))
+		return akvs, false, err
+	}
+
+	switch akvs.Spec.Output.Secret.ConflictPolicy {
+	case akv.AzureKeyVaultConflictPolicySkip:
+		akvs, err = c.setConflictCondition(akvs, owner, "Skipped", fmt.Sprintf("Secret '%s' is owned by AzureKeyVaultSecret '%s' and is not synced according to conflictPolicy Skip", name, ownerName))
+		return akvs, false, err
+	case akv.AzureKeyVaultConflictPolicyTakeOver:
+		if owner != nil && !c.isTakeoverAllowed(owner, akvs) {
+			msg := fmt.Sprintf("Secret '%s' is owned by AzureKeyVaultSecret '%s', set annotation %s: %s on it to allow the takeover", name, ownerName, AnnotationAllowTakeover, akvs.Name)
+			if akvs, err = c.setConflictCondition(akvs, owner, "TakeOverNotAllowed", msg); err != nil {
+				return akvs, false, err
+			}
+			return akvs, false, fmt.Errorf(msg)
+		}
+		akvs, err = c.takeOverSecret(akvs, owner, secret)
+		return akvs, false, err
+	default:
+		msg := fmt.Sprintf("Secret '%s' is owned by AzureKeyVaultSecret '%s'", name, ownerName)
+		if akvs, err = c.setConflictCondition(akvs, owner, "OwnedByOtherAzureKeyVaultSecret", msg); err != nil {
+			return akvs, false, err
+		}
+		return akvs, false, fmt.Errorf(msg)
+	}
+}
+
+// setConflictCondition sets the Conflicted condition of akvs, and tells both akvs and the
+// owner of the Secret about the conflict when the condition changes
+func (c *Controller) setConflictCondition(akvs, owner *akv.AzureKeyVaultSecret, reason, message string) (*akv.AzureKeyVaultSecret, error) {
+	existing := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeConflicted)
+	if existing == nil || existing.Status != metav1.ConditionTrue || existing.Reason != reason || existing.Message != message {
+		klog.InfoS("output secret owned by another azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, akvs.Spec.Output.Secret.Name), "reason", reason)
+		c.recorder.Event(akvs, corev1.EventTypeWarning, reason, message)
+		if owner != nil {
+			c.recorder.Event(owner, corev1.EventTypeNormal, reason, fmt.Sprintf("AzureKeyVaultSecret '%s' also outputs to Secret '%s': %s", akvs.Name, akvs.Spec.Output.Secret.Name, message))
+		}
+	}
+
+	return c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeConflicted,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// takeOverSecret transfers ownership of secret from owner to akvs, replacing its values
+// with the values of akvs
+func (c *Controller) takeOverSecret(akvs, owner *akv.AzureKeyVaultSecret, secret *corev1.Secret) (*akv.AzureKeyVaultSecret, error) {
+	values, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		return akvs, newAzureKeyVaultError(akvs, err)
+	}
+
+	newSecret := c.createNewSecret(akvs, values)
+	newSecret.ResourceVersion = secret.ResourceVersion
+	for _, ref := range secret.GetOwnerReferences() {
+		if ref.Kind != "AzureKeyVaultSecret" {
+			newSecret.OwnerReferences = append(newSecret.OwnerReferences, ref)
+		}
+	}
+	if _, err = c.writer().PatchSecret(context.TODO(), secret, newSecret); err != nil {
+		return akvs, err
+	}
+
+	ownerName := otherSecretOwner(secret, akvs)
+	msg := fmt.Sprintf("Secret '%s' was taken over from AzureKeyVaultSecret '%s'", secret.Name, ownerName)
+	klog.InfoS("secret taken over", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret), "previousOwner", ownerName)
+	c.recorder.Event(akvs, corev1.EventTypeNormal, "TookOver", msg)
+	if owner != nil {
+		c.recorder.Event(owner, corev1.EventTypeWarning, "TakenOver", fmt.Sprintf("Secret '%s' was taken over by AzureKeyVaultSecret '%s' and is no longer synced", secret.Name, akvs.Name))
+	}
+
+	return c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.SecretName = secret.Name
+		akvsCopy.Status.SecretHash = getHashOfByteValues(values)
+		akvsCopy.Status.SecretKeys = sortByteValueKeys(values)
+		akvsCopy.Status.SanitizedKeys = c.loadSanitizedKeys(akvsCopy)
+		c.setServedBy(akvsCopy)
+		c.setVaultObjectVersion(akvsCopy)
+		akvsCopy.Status.LastAzureUpdate = c.clock.Now()
+		meta.SetStatusCondition(&akvsCopy.Status.Conditions, metav1.Condition{
+			Type:               ConditionTypeConflicted,
+			Status:             metav1.ConditionFalse,
+			Reason:             "TookOver",
+			Message:            msg,
+			ObservedGeneration: akvsCopy.Generation,
+		})
+	})
+}
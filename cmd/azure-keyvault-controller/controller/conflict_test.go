@@ -0,0 +1,198 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// conflictController returns a controller where the TLS secret 'my-secret' is owned by
+// the AzureKeyVaultSecret owner, and akvs outputs to the same secret with policy. Both
+// can be modified by setup before being added to the controller.
+func conflictController(t *testing.T, policy akv.AzureKeyVaultConflictPolicy, setup func(akvs, owner *akv.AzureKeyVaultSecret)) (*Controller, *akv.AzureKeyVaultSecret, *akv.AzureKeyVaultSecret) {
+	owner := secret()
+	owner.Name = "owner"
+	owner.UID = types.UID("owner-uid")
+	owner.Spec.Output.Secret.Name = "my-secret"
+
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	akvs.Spec.Output.Secret.ConflictPolicy = policy
+
+	if setup != nil {
+		setup(akvs, owner)
+	}
+
+	existing := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my-secret",
+			Namespace:       akvs.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*newOwnerRef(owner, akv.SchemeGroupVersion.WithKind("AzureKeyVaultSecret"))},
+		},
+		Type: corev1.SecretTypeTLS,
+	}
+
+	secretIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := secretIndexer.Add(existing); err != nil {
+		t.Fatal(err)
+	}
+	akvsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, obj := range []*akv.AzureKeyVaultSecret{owner, akvs} {
+		if err := akvsIndexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Controller{
+		kubeclientset:             k8sfake.NewSimpleClientset(existing),
+		akvsClient:                akvfake.NewSimpleClientset(owner, akvs),
+		recorder:                  record.NewFakeRecorder(10),
+		secretsLister:             corelisters.NewSecretLister(secretIndexer),
+		azureKeyVaultSecretLister: listers.NewAzureKeyVaultSecretLister(akvsIndexer),
+		vaultService:              &fakeVaultService{fakeSecretValue: "some-value"},
+		clock:                     &fakeClock{},
+		options:                   &Options{},
+	}
+	return c, akvs, owner
+}
+
+func assertConflicted(t *testing.T, akvs *akv.AzureKeyVaultSecret, status metav1.ConditionStatus, reason string) {
+	t.Helper()
+	condition := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeConflicted)
+	if condition == nil || condition.Status != status || condition.Reason != reason {
+		t.Errorf("expected Conflicted condition to be %s with reason %s, but got %v", status, reason, condition)
+	}
+}
+
+func TestConflictPolicyFail(t *testing.T) {
+	c, akvs, _ := conflictController(t, "", nil)
+
+	updated, sync, err := c.resolveSecretConflict(akvs)
+	if err == nil {
+		t.Error("expected error for secret owned by another azurekeyvaultsecret")
+	}
+	if sync {
+		t.Error("secret owned by another azurekeyvaultsecret should not be synced")
+	}
+	assertConflicted(t, updated, metav1.ConditionTrue, "OwnedByOtherAzureKeyVaultSecret")
+
+	// both azurekeyvaultsecrets are told about the conflict
+	if events := len(c.recorder.(*record.FakeRecorder).Events); events != 2 {
+		t.Errorf("expected 2 events, but got %d", events)
+	}
+}
+
+func TestConflictPolicySkip(t *testing.T) {
+	c, akvs, _ := conflictController(t, akv.AzureKeyVaultConflictPolicySkip, nil)
+
+	updated, sync, err := c.resolveSecretConflict(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		t.Error("secret should be skipped")
+	}
+	assertConflicted(t, updated, metav1.ConditionTrue, "Skipped")
+}
+
+func TestConflictPolicyTakeOverNotAllowed(t *testing.T) {
+	c, akvs, _ := conflictController(t, akv.AzureKeyVaultConflictPolicyTakeOver, nil)
+
+	updated, sync, err := c.resolveSecretConflict(akvs)
+	if err == nil {
+		t.Error("expected error when the owner has not allowed the takeover")
+	}
+	if sync {
+		t.Error("secret should not be synced")
+	}
+	assertConflicted(t, updated, metav1.ConditionTrue, "TakeOverNotAllowed")
+}
+
+func TestConflictPolicyTakeOver(t *testing.T) {
+	c, akvs, owner := conflictController(t, akv.AzureKeyVaultConflictPolicyTakeOver, func(akvs, owner *akv.AzureKeyVaultSecret) {
+		owner.Annotations = map[string]string{AnnotationAllowTakeover: akvs.Name}
+	})
+
+	updated, sync, err := c.resolveSecretConflict(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		t.Error("secret is synced by the takeover and should not be synced again")
+	}
+	assertConflicted(t, updated, metav1.ConditionFalse, "TookOver")
+	if updated.Status.SecretName != "my-secret" || updated.Status.SecretHash == "" {
+		t.Errorf("expected status of synced secret, but got %v", updated.Status)
+	}
+
+	secret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "my-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isOwnedBy(secret, akvs) || isOwnedBy(secret, owner) {
+		t.Errorf("expected ownership to be transferred, but got %v", secret.OwnerReferences)
+	}
+	if string(secret.Data["password"]) != "some-value" {
+		t.Errorf("expected values of akvs in secret, but got %v", secret.Data)
+	}
+}
+
+func TestConflictTakenOverSecretIsYielded(t *testing.T) {
+	// owner took over the secret, as acknowledged by akvs
+	c, akvs, _ := conflictController(t, "", func(akvs, owner *akv.AzureKeyVaultSecret) {
+		owner.Spec.Output.Secret.ConflictPolicy = akv.AzureKeyVaultConflictPolicyTakeOver
+		akvs.Annotations = map[string]string{AnnotationAllowTakeover: owner.Name}
+	})
+
+	updated, sync, err := c.resolveSecretConflict(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		t.Error("secret taken over should not be synced")
+	}
+	assertConflicted(t, updated, metav1.ConditionTrue, "TakenOver")
+}
+
+func TestNoConflictForOpaqueSecrets(t *testing.T) {
+	c, akvs, _ := conflictController(t, "", nil)
+	existing, _ := c.secretsLister.Secrets(akvs.Namespace).Get("my-secret")
+	existing.Type = corev1.SecretTypeOpaque
+
+	_, sync, err := c.resolveSecretConflict(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sync {
+		t.Error("opaque secret shared with another azurekeyvaultsecret should be synced")
+	}
+}
@@ -20,6 +20,7 @@ limitations under the License.
 package controller
 
 import (
+	"sync"
 	"time"
 
 	"github.com/appscode/go/runtime"
@@ -27,10 +28,12 @@ import (
 	"k8s.io/klog/v2"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	appslisters "k8s.io/client-go/listers/apps/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/record"
 	"kmodules.xyz/client-go/tools/queue"
@@ -38,7 +41,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 	akvcs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned"
 	keyvaultScheme "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/scheme"
 	akvInformers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/informers/externalversions"
@@ -60,6 +66,22 @@ const (
 	// ErrConfigMap is used as part of the Event 'reason' when a Secret sync fails
 	ErrConfigMap = "ErrConfigMap"
 
+	// ErrVersionFrom is used as part of the Event 'reason' when the object version
+	// in spec.vault.object.versionFrom cannot be resolved
+	ErrVersionFrom = "ErrVersionFrom"
+
+	// ErrTemplate is used as part of the Event 'reason' when the template in
+	// spec.output.secret.template or spec.output.secret.templateFrom cannot be resolved
+	ErrTemplate = "ErrTemplate"
+
+	// ErrNameFrom is used as part of the Event 'reason' when the object name
+	// in spec.vault.object.nameFrom cannot be resolved
+	ErrNameFrom = "ErrNameFrom"
+
+	// ErrOutputs is used as part of the Event 'reason' when spec.output and spec.outputs
+	// are both set in a AzureKeyVaultSecret
+	ErrOutputs = "ErrOutputs"
+
 	// FailedAzureKeyVault is the message used for Events when a resource
 	// fails to get secret from Azure Key Vault
 	FailedAzureKeyVault = "Failed to get secret for '%s' from Azure Key Vault '%s': %s"
@@ -72,10 +94,22 @@ const (
 	// is synced successfully
 	MessageAzureKeyVaultSecretSynced = "AzureKeyVaultSecret synced to Kubernetes Secret successfully"
 
+	// SecretRotated is used as part of the Event 'reason' when a Secret is updated
+	// with a change from Azure Key Vault
+	SecretRotated = "Rotated"
+
+	// RotationDebounced is used as part of the Event 'reason' when a change from Azure Key Vault
+	// is held back until spec.output.rotationDebounce ends
+	RotationDebounced = "RotationDebounced"
+
 	// MessageAzureKeyVaultSecretSyncedWithAzureKeyVault is the message used for an Event fired when a AzureKeyVaultSecret
 	// is synced successfully after getting updated secret from Azure Key Vault
 	MessageAzureKeyVaultSecretSyncedWithAzureKeyVault = "AzureKeyVaultSecret synced to Kubernetes Secret successfully with change from Azure Key Vault"
 
+	// MessageAzureKeyVaultSecretRecovered is the message used for an Event fired when a AzureKeyVaultSecret
+	// is synced successfully after its last sync failed
+	MessageAzureKeyVaultSecretRecovered = "AzureKeyVaultSecret synced with Azure Key Vault successfully after failing"
+
 	ControllerName = "Akv2k8s controller"
 )
 
@@ -116,12 +150,54 @@ type Controller struct {
 	// ConfigMap
 	configMapsLister corelisters.ConfigMapLister
 
+	// Pod, only set when reporting pods using rotated secrets or referencing workloads
+	podsLister corelisters.PodLister
+
+	// ReplicaSet, only set when reporting referencing workloads
+	replicaSetsLister appslisters.ReplicaSetLister
+
 	// AzureKeyVaultSecret
 	azureKeyVaultSecretLister listers.AzureKeyVaultSecretLister
 	akvsInformerFactory       akvInformers.SharedInformerFactory
-	akvsCrdQueue              *queue.Worker
+	akvsCrdQueue              *priorityQueue
 	akvsCrdDeletionQueue      *queue.Worker
-	azureKeyVaultQueue        *queue.Worker
+	azureKeyVaultQueue        *priorityQueue
+	syncWorker                *priorityWorker
+
+	// keys of AzureKeyVaultSecrets where the force sync annotation has been set or changed
+	forceSyncs sync.Map
+
+	// keys renamed by sanitizeDataKey when each AzureKeyVaultSecret was last read from Azure Key Vault
+	sanitizedKeys sync.Map
+
+	// certificate metadata annotations for the Secret of each AzureKeyVaultSecret when last read from Azure Key Vault
+	certificateAnnotations sync.Map
+
+	// name of the Azure Key Vault each AzureKeyVaultSecret was last read from
+	servedBy sync.Map
+
+	// version of the object each AzureKeyVaultSecret was last read from in Azure Key Vault
+	vaultObjectMetadata sync.Map
+
+	// result of the last read of each object in spec.vault.objects of each AzureKeyVaultSecret,
+	// see storeObjectStatus
+	objectStatus sync.Map
+
+	// error message of the last read of each AzureKeyVaultSecret from Azure Key Vault, empty
+	// if the vault could be reached, see storeAzureReachable
+	azureReachable sync.Map
+
+	// outputs the last write failed for, see failureTrackingWriter
+	failedWrites sync.Map
+
+	// time of the last failure event from Azure Key Vault of each AzureKeyVaultSecret, see recordAzureFailure
+	azureFailureEvents sync.Map
+
+	// services for credentials in spec.vault.credentialsFrom by hash of the credentials, see vaultServiceFor
+	credentialVaultServices sync.Map
+
+	// writes outputs, see writer
+	outputWriter outputWriter
 
 	options *Options
 	clock   Timer
@@ -129,10 +205,129 @@ type Controller struct {
 
 // Options contains options for the controller
 type Options struct {
-	NumThreads     int
 	MaxNumRequeues int
 	ResyncPeriod   time.Duration
 	AkvsRef        corev1.ObjectReference
+
+	// CRDWorkers is the max number of changed or deleted AzureKeyVaultSecrets synced at once
+	CRDWorkers int
+
+	// AzureWorkers is the max number of periodic polls of Azure Key Vault run at once
+	AzureWorkers int
+
+	// WatchNamespaces are the namespaces AzureKeyVaultSecrets are synced in, empty for all
+	WatchNamespaces []string
+
+	// ExcludeNamespaces are namespaces AzureKeyVaultSecrets are never synced in, even if
+	// listed in WatchNamespaces
+	ExcludeNamespaces []string
+
+	// AkvsLabelSelector selects the AzureKeyVaultSecrets handled by this controller, so several
+	// controllers can share a cluster. Nil to handle all AzureKeyVaultSecrets.
+	AkvsLabelSelector labels.Selector
+
+	// RequeueBaseDelay is how long to wait before retrying a failed key the first time,
+	// doubled for each following failure up to RequeueMaxDelay. Zero to use the defaults
+	// of workqueue.DefaultControllerRateLimiter.
+	RequeueBaseDelay time.Duration
+	RequeueMaxDelay  time.Duration
+
+	// DisableProvenanceAnnotations stops the controller from annotating outputs with
+	// the Azure Key Vault object and AzureKeyVaultSecret they were synced from
+	DisableProvenanceAnnotations bool
+
+	// DefaultTransforms are run for each object type before any transforms in the
+	// AzureKeyVaultSecret, unless disabled using spec.output.secret.disableDefaultTransforms
+	DefaultTransforms transformers.DefaultTransforms
+
+	// CertificateRelaxedPollInterval is how often certificates with a predicted renewal time
+	// are polled before CertificateRenewalWindow, zero to poll on every resync
+	CertificateRelaxedPollInterval time.Duration
+
+	// CertificateRenewalWindow is how long before a predicted certificate renewal to start
+	// polling on every resync
+	CertificateRenewalWindow time.Duration
+
+	// MaxReportedPods is the max number of pods named in events and logs when a secret
+	// used by the pods is rotated, zero to not look up pods at all
+	MaxReportedPods int
+
+	// ReferencedByRefreshInterval is how often to refresh status.referencedBy with the
+	// workloads consuming the output, zero to disable
+	ReferencedByRefreshInterval time.Duration
+
+	// MaxReferencedBy is the max number of workloads listed in status.referencedBy
+	MaxReferencedBy int
+
+	// PollFairness is the max number of changed AzureKeyVaultSecrets processed in a row
+	// while a periodic poll of Azure Key Vault is waiting
+	PollFairness int
+
+	// FairQueuing processes AzureKeyVaultSecrets round-robin across namespaces, instead
+	// of in the order they were queued
+	FairQueuing bool
+
+	// PollBatchWindow groups periodic polls of Azure Key Vault by vault, polling all
+	// AzureKeyVaultSecrets of a vault together for up to this long before moving on to
+	// the next vault. Zero to poll in the order they were queued.
+	PollBatchWindow time.Duration
+
+	// DisableAzurePolling stops periodic polling of Azure Key Vault, so outputs only
+	// change when the AzureKeyVaultSecret changes
+	DisableAzurePolling bool
+
+	// AzurePollInterval is how often Azure Key Vault is polled, used to record when each
+	// AzureKeyVaultSecret is next polled so the schedule survives restarts. Zero to not record it.
+	AzurePollInterval time.Duration
+
+	// AllowTakeover lets AzureKeyVaultSecrets with conflictPolicy TakeOver take over outputs
+	// owned by other AzureKeyVaultSecrets, without the owner acknowledging it
+	AllowTakeover bool
+
+	// ImmutableRevisionGracePeriod is how long an immutable ConfigMap replaced by a newer
+	// revision is kept, so workloads can move to the new one before it is deleted
+	ImmutableRevisionGracePeriod time.Duration
+
+	// ExportDir is where outputs are written as manifests instead of applied using the
+	// Kubernetes API, to be committed to Git by another process. Empty to apply outputs.
+	ExportDir string
+
+	// ExportDigestsOnly writes the SHA-256 digest of each value in exported manifests,
+	// instead of the value itself
+	ExportDigestsOnly bool
+
+	// InstanceID identifies this controller installation in status.claim of the
+	// AzureKeyVaultSecrets it manages. Empty to not claim AzureKeyVaultSecrets.
+	InstanceID string
+
+	// ClaimTTL is how long a claim is valid without being renewed, before another
+	// instance can take over the AzureKeyVaultSecret
+	ClaimTTL time.Duration
+
+	// ChangeDetection is how polls detect changes in Azure Key Vault for AzureKeyVaultSecrets
+	// not setting spec.vault.object.changeDetection. Empty to compare the hash of the values.
+	ChangeDetection akv.AzureKeyVaultChangeDetection
+
+	// MaxConcurrentAzureRequests is the max number of requests to Azure Key Vault sent at
+	// once across all workers, zero for no limit
+	MaxConcurrentAzureRequests int
+
+	// AzureRequestQPS is the max number of requests per second to Azure Key Vault across
+	// all workers, zero for no limit
+	AzureRequestQPS float64
+
+	// AzureFailureEventInterval is the min time between warning events for repeated failures
+	// to read an AzureKeyVaultSecret from Azure Key Vault, zero for an event on every failure
+	AzureFailureEventInterval time.Duration
+
+	// NewVaultService returns a service reading Azure Key Vault with credential, used for
+	// AzureKeyVaultSecrets with credentials in spec.vault.credentialsFrom. Nil to not
+	// support spec.vault.credentialsFrom.
+	NewVaultService func(credential azure.LegacyTokenCredential) vault.Service
+
+	// AzureEnvironment is the Azure cloud of vaults not setting spec.vault.azureEnvironment,
+	// used for the AAD authority of spec.vault.credentialsFrom. Empty for AzurePublicCloud.
+	AzureEnvironment string
 }
 
 // NewController returns a new AzureKeyVaultSecret controller
@@ -146,7 +341,7 @@ func NewController(client kubernetes.Interface, akvsClient akvcs.Interface, akvI
 		kubeclientset: client,
 		akvsClient:    akvsClient,
 		recorder:      recorder,
-		vaultService:  vaultService,
+		vaultService:  newLimitedVaultService(newInstrumentedVaultService(vaultService), options.MaxConcurrentAzureRequests, options.AzureRequestQPS),
 
 		akvsInformerFactory: akvInformerFactory,
 		kubeInformerFactory: kubeInformerFactory,
@@ -159,12 +354,39 @@ func NewController(client kubernetes.Interface, akvsClient akvcs.Interface, akvI
 		clock:   &Clock{},
 	}
 
-	controller.akvsCrdQueue = queue.New("AzureKeyVaultSecrets", options.MaxNumRequeues, options.NumThreads, controller.syncAzureKeyVaultSecret)
-	controller.akvsCrdDeletionQueue = queue.New("DeletedAzureKeyVaultSecrets", options.MaxNumRequeues, options.NumThreads, controller.syncDeletedAzureKeyVaultSecret)
-	controller.azureKeyVaultQueue = queue.New("AzureKeyVault", options.MaxNumRequeues, options.NumThreads, controller.syncAzureKeyVault)
+	if options.ExportDir != "" {
+		controller.outputWriter = newGitExportWriter(options.ExportDir, options.ExportDigestsOnly)
+	}
+
+	if options.MaxReportedPods > 0 || options.ReferencedByRefreshInterval > 0 {
+		controller.podsLister = kubeInformerFactory.Core().V1().Pods().Lister()
+	}
+	if options.ReferencedByRefreshInterval > 0 {
+		controller.replicaSetsLister = kubeInformerFactory.Apps().V1().ReplicaSets().Lister()
+	}
+
+	// AzureKeyVaultSecrets and AzureKeyVault share CRDWorkers + AzureWorkers workers, with changes
+	// to AzureKeyVaultSecrets processed before periodic polls. Each queue is processed by at most
+	// its own number of workers at once. Failed syncs in namespaces being deleted are dropped
+	// instead of retried, and keys in namespaces that are not watched are skipped.
+	controller.akvsCrdQueue = newPriorityQueue("AzureKeyVaultSecrets", priorityHigh, options.MaxNumRequeues, options.CRDWorkers, options.requeueRateLimiter(), options.FairQueuing, controller.skipUnwatchedNamespace("AzureKeyVaultSecrets", controller.dropInTerminatingNamespace("AzureKeyVaultSecrets", countSyncs("AzureKeyVaultSecrets", controller.withSyncConditions(controller.syncAzureKeyVaultSecret)))))
+	controller.akvsCrdDeletionQueue = queue.New("DeletedAzureKeyVaultSecrets", options.MaxNumRequeues, options.CRDWorkers, controller.skipUnwatchedNamespace("DeletedAzureKeyVaultSecrets", controller.dropInTerminatingNamespace("DeletedAzureKeyVaultSecrets", controller.syncDeletedAzureKeyVaultSecret)))
+	if options.PollBatchWindow > 0 {
+		controller.azureKeyVaultQueue = newPriorityQueueWithOrder("AzureKeyVault", priorityLow, options.MaxNumRequeues, options.AzureWorkers, options.requeueRateLimiter(), newVaultBatchQueue("AzureKeyVault", options.PollBatchWindow, controller.vaultOfKey), controller.skipUnwatchedNamespace("AzureKeyVault", controller.dropInTerminatingNamespace("AzureKeyVault", countSyncs("AzureKeyVault", controller.withSyncConditions(controller.syncAzureKeyVault)))))
+	} else {
+		controller.azureKeyVaultQueue = newPriorityQueue("AzureKeyVault", priorityLow, options.MaxNumRequeues, options.AzureWorkers, options.requeueRateLimiter(), options.FairQueuing, controller.skipUnwatchedNamespace("AzureKeyVault", controller.dropInTerminatingNamespace("AzureKeyVault", countSyncs("AzureKeyVault", controller.withSyncConditions(controller.syncAzureKeyVault)))))
+	}
+	controller.syncWorker = newPriorityWorker(controller.akvsCrdQueue, controller.azureKeyVaultQueue, options.CRDWorkers+options.AzureWorkers, options.PollFairness)
 
 	klog.InfoS("setting up event handlers")
 	controller.initAzureKeyVaultSecret()
+	controller.initVersionFromConfigMaps()
+	controller.initNameFrom()
+	controller.initTemplateFrom()
+	controller.initKeystorePasswords()
+	controller.initOutputDeletion()
+	controller.initCredentialsFrom()
+	controller.initSecretDrift()
 
 	return controller
 }
@@ -192,16 +414,17 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 		}
 	}
 
-	klog.InfoS("starting azure key vault secret queue")
-	c.akvsCrdQueue.Run(stopCh)
+	klog.InfoS("starting azure key vault secret and azure key vault queues")
+	c.syncWorker.Run(stopCh)
 
 	klog.InfoS("starting azure key vault deleted secret queue")
 	c.akvsCrdDeletionQueue.Run(stopCh)
 
-	klog.InfoS("starting azure key vault queue")
-	c.azureKeyVaultQueue.Run(stopCh)
+	go c.reportQueueDepth(stopCh)
 
-	klog.InfoS("started workers")
+	klog.InfoS("started workers", "crdWorkers", c.options.CRDWorkers, "azureWorkers", c.options.AzureWorkers)
 	<-stopCh
 	klog.InfoS("Shutting down workers")
+	c.syncWorker.Wait()
+	klog.InfoS("workers stopped")
 }
@@ -0,0 +1,213 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+const (
+	// credentialsFromSecretIndex indexes azurekeyvaultsecrets by the namespace/name of the
+	// secret referenced in spec.vault.credentialsFrom
+	credentialsFromSecretIndex = "credentialsFromSecret"
+
+	// ReasonInvalidCredentials is the reason of the warning event when the secret referenced
+	// in spec.vault.credentialsFrom is missing or malformed
+	ReasonInvalidCredentials = "InvalidCredentials"
+)
+
+// credentialKeys are the keys the secret referenced in spec.vault.credentialsFrom must have
+var credentialKeys = []string{"clientId", "clientSecret", "tenantId"}
+
+// credentialsError tells that the credentials referenced in spec.vault.credentialsFrom
+// cannot be used, which retrying will not fix until the secret is changed
+type credentialsError struct {
+	msg string
+}
+
+func (e *credentialsError) Error() string {
+	return e.msg
+}
+
+// isCredentialsError tells if err is caused by unusable credentials in spec.vault.credentialsFrom
+func isCredentialsError(err error) bool {
+	var credentials *credentialsError
+	return errors.As(err, &credentials)
+}
+
+func (c *Controller) initCredentialsFrom() {
+	err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddIndexers(cache.Indexers{
+		credentialsFromSecretIndex: credentialsFromSecretIndexFunc,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add indexers", "indexes", []string{credentialsFromSecretIndex})
+	}
+
+	_, err = c.kubeInformerFactory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueAzureKeyVaultSecretsForCredentials,
+		UpdateFunc: func(old, new interface{}) {
+			oldObj, ok := old.(metav1.Object)
+			if !ok {
+				return
+			}
+			newObj, ok := new.(metav1.Object)
+			if !ok || newObj.GetResourceVersion() == oldObj.GetResourceVersion() {
+				return
+			}
+			c.enqueueAzureKeyVaultSecretsForCredentials(new)
+		},
+		DeleteFunc: c.enqueueAzureKeyVaultSecretsForCredentials,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add event handler")
+	}
+}
+
+// credentialsFromSecretIndexFunc indexes an azurekeyvaultsecret by the secrets referenced in
+// spec.vault.credentialsFrom and in the credentialsFrom of each entry in spec.vault.objects
+func credentialsFromSecretIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+	credentials := []*akv.AzureKeyVaultCredentialsFrom{akvs.Spec.Vault.CredentialsFrom}
+	for _, object := range akvs.Spec.Vault.Objects {
+		credentials = append(credentials, object.CredentialsFrom)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, credentialsFrom := range credentials {
+		if credentialsFrom == nil || credentialsFrom.SecretRef.Name == "" {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", akvs.Namespace, credentialsFrom.SecretRef.Name)
+		if !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	return keys, nil
+}
+
+// enqueueAzureKeyVaultSecretsForCredentials adds all azurekeyvaultsecrets authenticating
+// with the credentials in the secret obj to the queue
+func (c *Controller) enqueueAzureKeyVaultSecretsForCredentials(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	indexer := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().GetIndexer()
+	referencing, err := indexer.ByIndex(credentialsFromSecretIndex, key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, akvs := range referencing {
+		klog.V(4).InfoS("credentials changed - adding to queue", "secret", key, "azurekeyvaultsecret", klog.KObj(akvs.(*akv.AzureKeyVaultSecret)))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// vaultServiceFor returns the service to read akvs from Azure Key Vault with, which is the
+// service of the controller unless spec.vault.credentialsFrom is set. Services for the
+// credentials in a secret are cached per set of credentials and Azure cloud, so akvs
+// sharing credentials share tokens, and send requests within the limits of the controller.
+func (c *Controller) vaultServiceFor(akvs *akv.AzureKeyVaultSecret) (vault.Service, error) {
+	credentialsFrom := akvs.Spec.Vault.CredentialsFrom
+	if credentialsFrom == nil {
+		return c.vaultService, nil
+	}
+	if c.options.NewVaultService == nil {
+		return nil, &credentialsError{msg: "spec.vault.credentialsFrom is not supported by this controller"}
+	}
+
+	name := credentialsFrom.SecretRef.Name
+	secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, &credentialsError{msg: fmt.Sprintf("secret '%s' referenced in spec.vault.credentialsFrom not found", name)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(credentialKeys))
+	var missing []string
+	for _, key := range credentialKeys {
+		values[key] = strings.TrimSpace(string(secret.Data[key]))
+		if values[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &credentialsError{msg: fmt.Sprintf("secret '%s' referenced in spec.vault.credentialsFrom is missing %s", name, strings.Join(missing, ", "))}
+	}
+
+	// the credentials authenticate with the AAD authority of the cloud of the vault
+	options := &azidentity.ClientSecretCredentialOptions{}
+	environment := string(akvs.Spec.Vault.AzureEnvironment)
+	if environment == "" {
+		environment = c.options.AzureEnvironment
+	}
+	if environment != "" {
+		env, err := azure.EnvironmentFromName(environment)
+		if err != nil {
+			return nil, err
+		}
+		environment = env.Name
+		options.ClientOptions = azcore.ClientOptions{Cloud: cloud.Configuration{ActiveDirectoryAuthorityHost: env.ActiveDirectoryAuthorityHost}}
+	}
+
+	hash := sha256.Sum256([]byte(environment + "\x00" + values["tenantId"] + "\x00" + values["clientId"] + "\x00" + values["clientSecret"]))
+	cacheKey := hex.EncodeToString(hash[:])
+	if service, ok := c.credentialVaultServices.Load(cacheKey); ok {
+		return service.(vault.Service), nil
+	}
+
+	credential, err := azidentity.NewClientSecretCredential(values["tenantId"], values["clientId"], values["clientSecret"], options)
+	if err != nil {
+		return nil, &credentialsError{msg: fmt.Sprintf("secret '%s' referenced in spec.vault.credentialsFrom has invalid credentials: %s", name, err.Error())}
+	}
+
+	var service vault.Service = newInstrumentedVaultService(c.options.NewVaultService(credential))
+	if limited, ok := c.vaultService.(*limitedVaultService); ok {
+		service = limited.withService(service)
+	}
+	klog.InfoS("created azure key vault client for credentials", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, name), "clientId", values["clientId"])
+	actual, _ := c.credentialVaultServices.LoadOrStore(cacheKey, service)
+	return actual.(vault.Service), nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func credentialsSecret(name, clientSecret string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Data: map[string][]byte{
+			"clientId":     []byte("client-id"),
+			"clientSecret": []byte(clientSecret),
+			"tenantId":     []byte("tenant-id"),
+		},
+	}
+}
+
+func credentialsController(t *testing.T, akvs *akv.AzureKeyVaultSecret, created *int, secrets ...*corev1.Secret) *Controller {
+	c, _ := outputsController(t, akvs, &countingVaultService{}, secrets...)
+	c.options.NewVaultService = func(credential azure.LegacyTokenCredential) vault.Service {
+		*created++
+		return &fakeVaultService{fakeSecretValue: "scoped-value"}
+	}
+	return c
+}
+
+func withCredentialsFrom(akvs *akv.AzureKeyVaultSecret, name string) *akv.AzureKeyVaultSecret {
+	akvs.Spec.Vault.CredentialsFrom = &akv.AzureKeyVaultCredentialsFrom{SecretRef: corev1.LocalObjectReference{Name: name}}
+	return akvs
+}
+
+func TestVaultServiceForWithoutCredentialsFrom(t *testing.T) {
+	var created int
+	c := credentialsController(t, secret(), &created)
+
+	service, err := c.vaultServiceFor(secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service != c.vaultService || created != 0 {
+		t.Errorf("expected the service of the controller, but got %v with %d services created", service, created)
+	}
+}
+
+func TestVaultServiceForCachesPerCredentials(t *testing.T) {
+	var created int
+	first := withCredentialsFrom(secret(), "team-a")
+	c := credentialsController(t, first, &created, credentialsSecret("team-a", "secret-a"), credentialsSecret("team-a-copy", "secret-a"), credentialsSecret("team-b", "secret-b"))
+
+	service, err := c.vaultServiceFor(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := service.GetSecret(&first.Spec.Vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "scoped-value" {
+		t.Errorf("expected value read with scoped service, but got '%s'", value)
+	}
+
+	if _, err := c.vaultServiceFor(withCredentialsFrom(secret(), "team-a-copy")); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Errorf("expected service to be reused for the same credentials, but %d were created", created)
+	}
+
+	if _, err := c.vaultServiceFor(withCredentialsFrom(secret(), "team-b")); err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Errorf("expected a new service for other credentials, but %d were created", created)
+	}
+}
+
+func TestVaultServiceForInvalidCredentials(t *testing.T) {
+	malformed := credentialsSecret("malformed", "")
+	delete(malformed.Data, "tenantId")
+
+	tests := []struct {
+		name       string
+		secretName string
+		expected   string
+	}{
+		{name: "missing secret", secretName: "missing", expected: "secret 'missing' referenced in spec.vault.credentialsFrom not found"},
+		{name: "malformed secret", secretName: "malformed", expected: "is missing clientSecret, tenantId"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created int
+			akvs := withCredentialsFrom(secret(), tt.secretName)
+			c := credentialsController(t, akvs, &created, malformed)
+
+			_, err := c.getSecretFromKeyVault(akvs)
+			if err == nil || !isCredentialsError(err) || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("expected credentials error containing '%s', but got %v", tt.expected, err)
+			}
+			if created != 0 {
+				t.Errorf("expected no service to be created, but %d were", created)
+			}
+
+			c.recordAzureFailure(akvs, newAzureKeyVaultError(akvs, err))
+			event := expectEvent(t, c.recorder.(*record.FakeRecorder), ReasonInvalidCredentials)
+			if !strings.Contains(event, tt.expected) {
+				t.Errorf("expected event to explain '%s', but got '%s'", tt.expected, event)
+			}
+		})
+	}
+}
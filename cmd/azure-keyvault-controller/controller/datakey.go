@@ -0,0 +1,335 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// keyCollisionError tells that two sources write the same data key in an output, where one
+// value would silently overwrite the other
+type keyCollisionError struct {
+	key     string
+	source  string
+	source2 string
+}
+
+func (e *keyCollisionError) Error() string {
+	return fmt.Sprintf("data key '%s' is written by both %s and %s", e.key, e.source, e.source2)
+}
+
+// isKeyCollision tells if err is caused by two sources writing the same data key
+func isKeyCollision(err error) bool {
+	var collision *keyCollisionError
+	return errors.As(err, &collision)
+}
+
+// maxDataKeyLength is the max length of a Kubernetes Secret or ConfigMap data key
+const maxDataKeyLength = validation.DNS1123SubdomainMaxLength
+
+// sanitizeDataKey returns key as a valid Kubernetes data key, for keys derived from names
+// or content in Azure Key Vault. Keys that are already valid are never changed. Otherwise:
+//
+//   - every character other than ASCII letters, digits, '-', '_' and '.' is replaced with '_'
+//   - leading dots are replaced with '_', as Kubernetes reserves keys like '..data'
+//   - keys longer than 253 characters are cut to 244 characters, followed by '-' and the first
+//     8 hex characters of the sha256 hash of the original key, to keep long keys unique
+//
+// It fails if the key is empty.
+func sanitizeDataKey(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("data key is empty")
+	}
+	if len(validation.IsConfigMapKey(key)) == 0 {
+		return key, nil
+	}
+
+	var sanitized strings.Builder
+	leading := true
+	for _, r := range key {
+		switch {
+		case r == '.' && leading:
+			sanitized.WriteRune('_')
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.'):
+			sanitized.WriteRune(r)
+			leading = false
+		default:
+			sanitized.WriteRune('_')
+			leading = false
+		}
+	}
+
+	result := sanitized.String()
+	if len(result) > maxDataKeyLength {
+		hash := sha256.Sum256([]byte(key))
+		result = result[:maxDataKeyLength-9] + "-" + hex.EncodeToString(hash[:])[:8]
+	}
+	return result, nil
+}
+
+// sanitizeDataKeys returns values with all keys sanitized using sanitizeDataKey, and the
+// keys that were renamed, from original to sanitized key. It fails if a key is empty, or
+// two keys are sanitized to the same key.
+func sanitizeDataKeys(values map[string]string) (map[string]string, map[string]string, error) {
+	sanitized := make(map[string]string, len(values))
+	sources := make(map[string]string, len(values))
+	var renamed map[string]string
+
+	// iterate in sorted order to get the same error every time
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		newKey, err := sanitizeDataKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if source, ok := sources[newKey]; ok {
+			return nil, nil, &keyCollisionError{
+				key:     newKey,
+				source:  fmt.Sprintf("key '%s'", source),
+				source2: fmt.Sprintf("key '%s' sanitized to a valid data key", key),
+			}
+		}
+		sources[newKey] = key
+		sanitized[newKey] = values[key]
+		if newKey != key {
+			if renamed == nil {
+				renamed = make(map[string]string)
+			}
+			renamed[key] = newKey
+		}
+	}
+	return sanitized, renamed, nil
+}
+
+// storeSanitizedKeys remembers the keys renamed by handler when reading akvs, to be recorded
+// in the status of akvs
+func (c *Controller) storeSanitizedKeys(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler) {
+	var renamed map[string]string
+	if h, ok := handler.(*azureMultiValueSecretHandler); ok {
+		renamed = h.sanitizedKeys
+	}
+	c.sanitizedKeys.Store(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name), renamed)
+}
+
+// loadSanitizedKeys returns the keys renamed when akvs was last read, or the keys in its
+// status if not read since the controller started
+func (c *Controller) loadSanitizedKeys(akvs *akv.AzureKeyVaultSecret) map[string]string {
+	renamed, ok := c.sanitizedKeys.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return akvs.Status.SanitizedKeys
+	}
+	return renamed.(map[string]string)
+}
+
+// normalizeDataKeys returns values with all keys converted to keyCase. It fails
+// if two different keys are normalized to the same key, as one value would
+// silently overwrite the other.
+func normalizeDataKeys(values map[string][]byte, keyCase akv.AzureKeyVaultDataKeyCase) (map[string][]byte, error) {
+	if keyCase == "" || keyCase == akv.AzureKeyVaultDataKeyCaseAsIs {
+		return values, nil
+	}
+
+	normalized := make(map[string][]byte, len(values))
+	sources := make(map[string]string, len(values))
+
+	// iterate in sorted order to get the same error every time
+	for _, key := range sortByteValueKeys(values) {
+		newKey, err := normalizeDataKey(key, keyCase)
+		if err != nil {
+			return nil, err
+		}
+		if source, ok := sources[newKey]; ok {
+			return nil, &keyCollisionError{
+				key:     newKey,
+				source:  fmt.Sprintf("key '%s'", source),
+				source2: fmt.Sprintf("key '%s' normalized using dataKeyCase '%s'", key, keyCase),
+			}
+		}
+		sources[newKey] = key
+		normalized[newKey] = values[key]
+	}
+	return normalized, nil
+}
+
+// affixDataKeys returns values with prefix and suffix added to every key. It fails naming the
+// first key, in sorted order, that is not a valid Kubernetes data key with the prefix and suffix.
+func affixDataKeys(values map[string][]byte, prefix, suffix string) (map[string][]byte, error) {
+	if prefix == "" && suffix == "" {
+		return values, nil
+	}
+
+	affixed := make(map[string][]byte, len(values))
+	for _, key := range sortByteValueKeys(values) {
+		newKey, err := affixDataKey(key, prefix, suffix)
+		if err != nil {
+			return nil, err
+		}
+		affixed[newKey] = values[key]
+	}
+	return affixed, nil
+}
+
+func affixDataKey(key, prefix, suffix string) (string, error) {
+	newKey := prefix + key + suffix
+	if errs := validation.IsConfigMapKey(newKey); len(errs) > 0 {
+		return "", fmt.Errorf("data key '%s' with keyPrefix '%s' and keySuffix '%s' is '%s', which is not a valid key: %s", key, prefix, suffix, newKey, strings.Join(errs, ", "))
+	}
+	return newKey, nil
+}
+
+// selectByteValueKeys returns only the keys of values in keys, all of values if keys is
+// empty. It fails if a key is not in values, rather than writing an output without it.
+func selectByteValueKeys(values map[string][]byte, keys []string) (map[string][]byte, error) {
+	if len(keys) == 0 {
+		return values, nil
+	}
+	selected := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			return nil, fmt.Errorf("key '%s' in keys is not in the values read from azure key vault, which has keys %v", key, sortByteValueKeys(values))
+		}
+		selected[key] = value
+	}
+	return selected, nil
+}
+
+// selectStringValueKeys is selectByteValueKeys for ConfigMap values
+func selectStringValueKeys(values map[string]string, keys []string) (map[string]string, error) {
+	if len(keys) == 0 {
+		return values, nil
+	}
+	selected := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			return nil, fmt.Errorf("key '%s' in keys is not in the values read from azure key vault, which has keys %v", key, sortStringValueKeys(values))
+		}
+		selected[key] = value
+	}
+	return selected, nil
+}
+
+// normalizeDataKey converts key to keyCase. The key is split into words on
+// any character that is not a letter or digit (consecutive separators count
+// as one), on a lower case letter or digit followed by an upper case letter
+// (someKey, v2Key) and before the last upper case letter in a sequence
+// followed by a lower case letter (HTTPServer). Digits never start a new
+// word. Letters are case mapped using unicode rules, but the result must
+// still be a valid Kubernetes data key.
+func normalizeDataKey(key string, keyCase akv.AzureKeyVaultDataKeyCase) (string, error) {
+	var normalized string
+	words := splitDataKeyWords(key)
+
+	switch keyCase {
+	case "", akv.AzureKeyVaultDataKeyCaseAsIs:
+		return key, nil
+	case akv.AzureKeyVaultDataKeyCaseUpper:
+		normalized = strings.ToUpper(key)
+	case akv.AzureKeyVaultDataKeyCaseLower:
+		normalized = strings.ToLower(key)
+	case akv.AzureKeyVaultDataKeyCaseUpperSnake:
+		normalized = strings.ToUpper(strings.Join(words, "_"))
+	case akv.AzureKeyVaultDataKeyCaseLowerSnake:
+		normalized = strings.ToLower(strings.Join(words, "_"))
+	case akv.AzureKeyVaultDataKeyCaseCamel:
+		for i, word := range words {
+			word = strings.ToLower(word)
+			if i > 0 {
+				runes := []rune(word)
+				runes[0] = unicode.ToUpper(runes[0])
+				word = string(runes)
+			}
+			normalized += word
+		}
+	default:
+		return "", fmt.Errorf("dataKeyCase '%s' not supported", keyCase)
+	}
+
+	if normalized == "" {
+		return "", fmt.Errorf("data key '%s' is empty after normalizing using dataKeyCase '%s'", key, keyCase)
+	}
+	if errs := validation.IsConfigMapKey(normalized); len(errs) > 0 {
+		return "", fmt.Errorf("data key '%s' normalized to '%s' using dataKeyCase '%s' is not a valid key: %s", key, normalized, keyCase, strings.Join(errs, ", "))
+	}
+	return normalized, nil
+}
+
+func splitDataKeyWords(key string) []string {
+	var words []string
+	var current []rune
+
+	runes := []rune(key)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(current) > 0 {
+				words = append(words, string(current))
+				current = nil
+			}
+			continue
+		}
+
+		if len(current) > 0 && unicode.IsUpper(r) {
+			prev := current[len(current)-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				words = append(words, string(current))
+				current = nil
+			}
+		}
+		current = append(current, r)
+	}
+
+	if len(current) > 0 {
+		words = append(words, string(current))
+	}
+	return words
+}
+
+// determineSecretDataKey returns the data key used in the Kubernetes secret,
+// after applying dataKeyCase, keyPrefix and keySuffix. Secret types with keys of
+// their own ignore dataKey.
+func determineSecretDataKey(akvs *akv.AzureKeyVaultSecret) string {
+	output := akvs.Spec.Output.Secret
+	switch output.Type {
+	case corev1.SecretTypeSSHAuth, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeDockercfg, corev1.SecretTypeBasicAuth:
+		return ""
+	}
+	dataKey, err := normalizeDataKey(output.DataKey, akv.DataKeyCaseOf(output))
+	if err != nil {
+		return output.DataKey
+	}
+	if affixed, err := affixDataKey(dataKey, output.KeyPrefix, output.KeySuffix); err == nil {
+		return affixed
+	}
+	return dataKey
+}
@@ -0,0 +1,285 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestNormalizeDataKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		keyCase  akv.AzureKeyVaultDataKeyCase
+		expected string
+	}{
+		{"my-secret-key", akv.AzureKeyVaultDataKeyCaseUpperSnake, "MY_SECRET_KEY"},
+		{"someOtherKey", akv.AzureKeyVaultDataKeyCaseUpperSnake, "SOME_OTHER_KEY"},
+		{"HTTPServerURL", akv.AzureKeyVaultDataKeyCaseUpperSnake, "HTTP_SERVER_URL"},
+		{"db--password__", akv.AzureKeyVaultDataKeyCaseUpperSnake, "DB_PASSWORD"},
+		{"api-v2-key", akv.AzureKeyVaultDataKeyCaseUpperSnake, "API_V2_KEY"},
+		{"v2Key", akv.AzureKeyVaultDataKeyCaseLowerSnake, "v2_key"},
+		{"2fa-secret", akv.AzureKeyVaultDataKeyCaseLowerSnake, "2fa_secret"},
+		{"MY_SECRET_KEY", akv.AzureKeyVaultDataKeyCaseCamel, "mySecretKey"},
+		{"my-secret.key", akv.AzureKeyVaultDataKeyCaseCamel, "mySecretKey"},
+		{"db-host", akv.AzureKeyVaultDataKeyCaseUpper, "DB-HOST"},
+		{"DB_Host", akv.AzureKeyVaultDataKeyCaseLower, "db_host"},
+		{"my-secret-key", akv.AzureKeyVaultDataKeyCaseAsIs, "my-secret-key"},
+		{"my-secret-key", "", "my-secret-key"},
+	}
+
+	for _, test := range tests {
+		normalized, err := normalizeDataKey(test.key, test.keyCase)
+		if err != nil {
+			t.Errorf("failed to normalize '%s' using '%s': %+v", test.key, test.keyCase, err)
+			continue
+		}
+		if normalized != test.expected {
+			t.Errorf("expected '%s' using '%s' to be '%s', but got '%s'", test.key, test.keyCase, test.expected, normalized)
+		}
+	}
+}
+
+func TestNormalizeDataKeyInvalidResult(t *testing.T) {
+	if _, err := normalizeDataKey("--", akv.AzureKeyVaultDataKeyCaseUpperSnake); err == nil {
+		t.Error("expected error when key is empty after normalizing")
+	}
+
+	if _, err := normalizeDataKey("blåbær", akv.AzureKeyVaultDataKeyCaseUpperSnake); err == nil {
+		t.Error("expected error when normalized key contains non ascii letters")
+	}
+}
+
+func TestNormalizeDataKeysCollision(t *testing.T) {
+	values := map[string][]byte{
+		"some-key": []byte("first"),
+		"someKey":  []byte("second"),
+	}
+
+	if _, err := normalizeDataKeys(values, akv.AzureKeyVaultDataKeyCaseUpperSnake); !isKeyCollision(err) {
+		t.Errorf("expected key collision when two keys are normalized to the same key, but got %v", err)
+	}
+
+	normalized, err := normalizeDataKeys(values, akv.AzureKeyVaultDataKeyCaseAsIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(normalized) != 2 {
+		t.Errorf("expected two keys, but got %d", len(normalized))
+	}
+}
+
+func TestAffixDataKeys(t *testing.T) {
+	values := map[string][]byte{"HOST": []byte("db.local"), "PORT": []byte("5432")}
+
+	affixed, err := affixDataKeys(values, "APP_DB_", "_FILE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := sortByteValueKeys(affixed); strings.Join(keys, ",") != "APP_DB_HOST_FILE,APP_DB_PORT_FILE" {
+		t.Errorf("expected prefixed and suffixed keys, but got %v", keys)
+	}
+
+	_, err = affixDataKeys(values, "APP DB ", "")
+	if err == nil || !strings.Contains(err.Error(), "'APP DB HOST'") {
+		t.Errorf("expected error naming the invalid key, but got %v", err)
+	}
+}
+
+func TestKeyPrefixChangeUpdatesSecret(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.DataKey = "host"
+	akvs.Spec.Output.Secret.DataKeyCase = akv.AzureKeyVaultDataKeyCaseUpper
+	akvs.Spec.Output.Secret.KeyPrefix = "APP_DB_"
+	akvs.Status.SecretKeys = []string{"DB_HOST"}
+
+	existing := &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"DB_HOST": []byte("db.local")},
+	}
+	values := map[string][]byte{"APP_DB_HOST": []byte("db.local")}
+	akvs.Status.SecretHash = getHashOfByteValues(values)
+
+	if determineSecretDataKey(akvs) != "APP_DB_HOST" {
+		t.Errorf("expected data key with prefix, but got '%s'", determineSecretDataKey(akvs))
+	}
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+		t.Error("secret should need update when the key prefix is changed")
+	}
+}
+
+func TestKeyTransformIsDataKeyCaseAlias(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.DataKey = "db-host"
+	akvs.Spec.Output.Secret.KeyTransform = akv.AzureKeyVaultKeyTransformSnakeUpper
+	akvs.Spec.Output.Secret.KeyPrefix = "APP_"
+
+	if key := determineSecretDataKey(akvs); key != "APP_DB_HOST" {
+		t.Errorf("expected keyTransform snake-upper to give 'APP_DB_HOST', but got '%s'", key)
+	}
+}
+
+func TestStaleSecretKeysAreRemoved(t *testing.T) {
+	akvs := secret()
+	akvs.Status.SecretKeys = []string{"someKey", "someOtherKey"}
+
+	existing := &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"someKey":      []byte("someValue"),
+			"someOtherKey": []byte("someOtherValue"),
+			"notOwnedKey":  []byte("notOwnedValue"),
+		},
+	}
+
+	values := map[string][]byte{
+		"SOME_KEY":       []byte("someValue"),
+		"SOME_OTHER_KEY": []byte("someOtherValue"),
+	}
+
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+		t.Error("secret should need update when keys are renamed")
+	}
+
+	merged := mergeValuesWithExistingSecret(values, existing, getStaleSecretKeys(akvs, values, existing))
+	if len(merged) != 3 {
+		t.Errorf("expected three keys, but got %v", merged)
+	}
+	for _, key := range []string{"SOME_KEY", "SOME_OTHER_KEY", "notOwnedKey"} {
+		if _, ok := merged[key]; !ok {
+			t.Errorf("expected key '%s'", key)
+		}
+	}
+}
+
+func TestStaleConfigMapKeysAreRemoved(t *testing.T) {
+	akvs := secret()
+	akvs.Status.ConfigMapKeys = []string{"keys_0", "keys_1", "keys_2"}
+
+	existing := &corev1.ConfigMap{
+		Data: map[string]string{
+			"keys_0":      "a",
+			"keys_1":      "b",
+			"keys_2":      "c",
+			"notOwnedKey": "notOwnedValue",
+		},
+	}
+
+	// the last element was removed from the array in Azure Key Vault
+	values := map[string]string{
+		"keys_0": "a",
+		"keys_1": "b",
+	}
+	akvs.Status.ConfigMapHash = getHashOfStringValues(values)
+
+	if !hasAzureKeyVaultSecretChangedForConfigMap(akvs, values, existing) {
+		t.Error("configmap should need update when keys are no longer produced")
+	}
+
+	merged := mergeValuesWithExistingConfigMap(values, existing, getStaleConfigMapKeys(akvs, values, existing))
+	expected := map[string]string{"keys_0": "a", "keys_1": "b", "notOwnedKey": "notOwnedValue"}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %v, but got %v", expected, merged)
+	}
+}
+
+func TestSanitizeDataKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"valid-key_1.txt", "valid-key_1.txt"},
+		{".env", ".env"},
+		{"-leading-dash", "-leading-dash"},
+		{"my secret", "my_secret"},
+		{"db/password", "db_password"},
+		{"nøkkel", "n_kkel"},
+		{".", "_"},
+		{"..data", "__data"},
+		{"..my key", "__my_key"},
+		{strings.Repeat("a", 300), strings.Repeat("a", 244) + "-9835fa6b"},
+	}
+
+	for _, test := range tests {
+		sanitized, err := sanitizeDataKey(test.key)
+		if err != nil {
+			t.Errorf("sanitizing '%s' failed: %v", test.key, err)
+			continue
+		}
+		if sanitized != test.expected {
+			t.Errorf("expected '%s' to be sanitized to '%s', but got '%s'", test.key, test.expected, sanitized)
+		}
+	}
+
+	if _, err := sanitizeDataKey(""); err == nil {
+		t.Error("expected error for empty key")
+	}
+}
+
+func TestSanitizeDataKeyIsAlwaysValid(t *testing.T) {
+	valid := func(key string) bool {
+		sanitized, err := sanitizeDataKey(key)
+		if key == "" {
+			return err != nil
+		}
+		return err == nil && len(validation.IsConfigMapKey(sanitized)) == 0
+	}
+	if err := quick.Check(valid, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+
+	// keys made of characters with special meaning
+	special := func(runes []byte) bool {
+		alphabet := []byte("./-_ a..")
+		key := make([]byte, len(runes))
+		for i, r := range runes {
+			key[i] = alphabet[int(r)%len(alphabet)]
+		}
+		return valid(string(key))
+	}
+	if err := quick.Check(special, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSanitizeDataKeysCollision(t *testing.T) {
+	values := map[string]string{
+		"db password": "first",
+		"db_password": "second",
+	}
+
+	if _, _, err := sanitizeDataKeys(values); !isKeyCollision(err) {
+		t.Errorf("expected key collision when two keys are sanitized to the same key, but got %v", err)
+	}
+
+	sanitized, renamed, err := sanitizeDataKeys(map[string]string{"db password": "value", "user": "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sanitized["db_password"] != "value" || sanitized["user"] != "name" {
+		t.Errorf("unexpected sanitized values %v", sanitized)
+	}
+	if len(renamed) != 1 || renamed["db password"] != "db_password" {
+		t.Errorf("expected only renamed key to be recorded, but got %v", renamed)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// rotationDebounce holds back changes in Azure Key Vault for spec.output.rotationDebounce,
+// starting from when the first change was detected
+type rotationDebounce struct {
+	window  time.Duration
+	now     metav1.Time
+	pending *akv.AzureKeyVaultDebouncedRotation
+	started bool
+	held    bool
+}
+
+func (c *Controller) newRotationDebounce(akvs *akv.AzureKeyVaultSecret) *rotationDebounce {
+	d := &rotationDebounce{now: c.clock.Now()}
+	if akvs.Spec.Output.RotationDebounce != nil {
+		d.window = akvs.Spec.Output.RotationDebounce.Duration
+	}
+	if akvs.Status.DebouncedRotation != nil {
+		d.pending = akvs.Status.DebouncedRotation.DeepCopy()
+	}
+	return d
+}
+
+// hold tells if a detected change should be held back, starting the debounce window
+// if no change is already waiting
+func (d *rotationDebounce) hold() bool {
+	if d.window <= 0 {
+		return false
+	}
+	if d.pending == nil {
+		d.pending = &akv.AzureKeyVaultDebouncedRotation{
+			DetectedTime: d.now,
+			ApplyTime:    metav1.NewTime(d.now.Add(d.window)),
+		}
+		d.started = true
+	}
+	if d.now.Before(&d.pending.ApplyTime) {
+		d.held = true
+		return true
+	}
+	return false
+}
+
+// status returns the change to record as waiting in status, or nil if no change was held back
+func (d *rotationDebounce) status() *akv.AzureKeyVaultDebouncedRotation {
+	if !d.held {
+		return nil
+	}
+	return d.pending
+}
+
+// nextPoll returns next, or the end of the debounce window if a change is held back
+// and the window ends first
+func (d *rotationDebounce) nextPoll(next *metav1.Time) *metav1.Time {
+	if !d.held || (next != nil && next.Before(&d.pending.ApplyTime)) {
+		return next
+	}
+	applyTime := d.pending.ApplyTime
+	return &applyTime
+}
+
+// isRotationDebounced tells if changes to the outputs of akvs are held back because
+// a change detected in Azure Key Vault is waiting for spec.output.rotationDebounce
+func (c *Controller) isRotationDebounced(akvs *akv.AzureKeyVaultSecret, forceSync bool) bool {
+	if forceSync || akvs.Spec.Output.RotationDebounce == nil || akvs.Status.DebouncedRotation == nil {
+		return false
+	}
+	now := c.clock.Now()
+	return now.Before(&akvs.Status.DebouncedRotation.ApplyTime)
+}
+
+// scheduleDebouncedRotation polls Azure Key Vault again for akvs when the debounce window
+// of a change held back by d ends
+func (c *Controller) scheduleDebouncedRotation(key string, akvs *akv.AzureKeyVaultSecret, d *rotationDebounce) {
+	if !d.held {
+		return
+	}
+	if d.started {
+		c.recorder.Event(akvs, corev1.EventTypeNormal, RotationDebounced, fmt.Sprintf("Change from Azure Key Vault held back until %s", d.pending.ApplyTime.UTC().Format(time.RFC3339)))
+	}
+	c.azureKeyVaultQueue.GetQueue().AddAfter(key, d.pending.ApplyTime.Sub(d.now.Time))
+}
+
+// validateRotationDebounce returns the problems with spec.output.rotationDebounce in output
+func validateRotationDebounce(output akv.AzureKeyVaultOutput) []string {
+	if output.RotationDebounce == nil {
+		return nil
+	}
+	var problems []string
+	if output.RotationDebounce.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("spec.output.rotationDebounce '%s' must not be negative", output.RotationDebounce.Duration))
+	}
+	if output.ConfigMap.Immutable {
+		problems = append(problems, "spec.output.rotationDebounce is not supported with spec.output.configMap.immutable")
+	}
+	return problems
+}
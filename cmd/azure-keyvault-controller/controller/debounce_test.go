@@ -0,0 +1,155 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var debounceNow = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// debouncedSecret returns an AzureKeyVaultSecret with spec.output.rotationDebounce, and its
+// output Secret written with value before
+func debouncedSecret(value string) (*akv.AzureKeyVaultSecret, *corev1.Secret) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	akvs.Spec.Output.RotationDebounce = &metav1.Duration{Duration: 2 * time.Minute}
+
+	values := map[string][]byte{"password": []byte(value)}
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, values)
+	akvs.Status.SecretName = "my-secret"
+	akvs.Status.SecretHash = getHashOfByteValues(values)
+	return akvs, existing
+}
+
+func debounceController(t *testing.T, akvs *akv.AzureKeyVaultSecret, value string, existing *corev1.Secret) (*Controller, *fakeClock, func()) {
+	c, poll := pollController(t, akvs, value, existing)
+	clock := &fakeClock{now: debounceNow}
+	c.clock = clock
+	c.options = &Options{AzurePollInterval: 10 * time.Minute}
+	c.azureKeyVaultQueue = newPriorityQueue("AzureKeyVault", priorityHigh, 1, 1, nil, false, nil)
+	return c, clock, poll
+}
+
+// getOutputPassword returns the password written to the output Secret of akvs
+func getOutputPassword(t *testing.T, c *Controller, akvs *akv.AzureKeyVaultSecret) string {
+	secret, err := c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), akvs.Spec.Output.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data["password"])
+}
+
+func TestRotationDebounceAppliesFinalValue(t *testing.T) {
+	akvs, existing := debouncedSecret("v1")
+	c, clock, poll := debounceController(t, akvs, "v2", existing)
+
+	poll()
+	if value := getOutputPassword(t, c, akvs); value != "v1" {
+		t.Errorf("expected secret to keep 'v1' during rotation debounce, but got '%s'", value)
+	}
+	status := getStatus(t, c, akvs).Status
+	applyTime := debounceNow.Add(2 * time.Minute)
+	if status.DebouncedRotation == nil || !status.DebouncedRotation.ApplyTime.Time.Equal(applyTime) {
+		t.Fatalf("expected debounced rotation applied at %s, but got %+v", applyTime, status.DebouncedRotation)
+	}
+	if status.NextAzurePollTime == nil || !status.NextAzurePollTime.Time.Equal(applyTime) {
+		t.Errorf("expected next poll at end of rotation debounce %s, but got %v", applyTime, status.NextAzurePollTime)
+	}
+	if c.azureKeyVaultQueue.GetQueue().Len() != 0 {
+		t.Error("expected poll to be scheduled after rotation debounce, not right away")
+	}
+
+	// another rotation within the window does not extend it
+	c.vaultService.(*countingVaultService).fakeSecretValue = "v3"
+	clock.now = debounceNow.Add(time.Minute)
+	poll()
+	if value := getOutputPassword(t, c, akvs); value != "v1" {
+		t.Errorf("expected secret to keep 'v1' during rotation debounce, but got '%s'", value)
+	}
+	if status := getStatus(t, c, akvs).Status; status.DebouncedRotation == nil || !status.DebouncedRotation.DetectedTime.Time.Equal(debounceNow) {
+		t.Errorf("expected debounced rotation detected at %s, but got %+v", debounceNow, status.DebouncedRotation)
+	}
+
+	clock.now = applyTime
+	poll()
+	if value := getOutputPassword(t, c, akvs); value != "v3" {
+		t.Errorf("expected secret to get final value 'v3' after rotation debounce, but got '%s'", value)
+	}
+	if status := getStatus(t, c, akvs).Status; status.DebouncedRotation != nil {
+		t.Errorf("expected debounced rotation to be cleared, but got %+v", status.DebouncedRotation)
+	}
+}
+
+func TestRotationDebounceDisabled(t *testing.T) {
+	akvs, existing := debouncedSecret("v1")
+	akvs.Spec.Output.RotationDebounce = nil
+	c, _, poll := debounceController(t, akvs, "v2", existing)
+
+	poll()
+	if value := getOutputPassword(t, c, akvs); value != "v2" {
+		t.Errorf("expected secret to be updated to 'v2' right away, but got '%s'", value)
+	}
+	if status := getStatus(t, c, akvs).Status; status.DebouncedRotation != nil {
+		t.Errorf("expected no debounced rotation, but got %+v", status.DebouncedRotation)
+	}
+}
+
+func TestIsRotationDebounced(t *testing.T) {
+	akvs, _ := debouncedSecret("v1")
+	akvs.Status.DebouncedRotation = &akv.AzureKeyVaultDebouncedRotation{
+		DetectedTime: metav1.NewTime(debounceNow),
+		ApplyTime:    metav1.NewTime(debounceNow.Add(2 * time.Minute)),
+	}
+	c := &Controller{clock: &fakeClock{now: debounceNow.Add(time.Minute)}}
+
+	if !c.isRotationDebounced(akvs, false) {
+		t.Error("expected rotation to be debounced within the window")
+	}
+	if c.isRotationDebounced(akvs, true) {
+		t.Error("expected force sync to bypass rotation debounce")
+	}
+
+	c.clock = &fakeClock{now: debounceNow.Add(2 * time.Minute)}
+	if c.isRotationDebounced(akvs, false) {
+		t.Error("expected rotation not to be debounced after the window")
+	}
+}
+
+func TestValidateRotationDebounce(t *testing.T) {
+	output := akv.AzureKeyVaultOutput{RotationDebounce: &metav1.Duration{Duration: -time.Minute}}
+	output.ConfigMap.Immutable = true
+
+	problems := validateRotationDebounce(output)
+	if len(problems) != 2 || !strings.Contains(problems[0], "negative") || !strings.Contains(problems[1], "immutable") {
+		t.Errorf("expected negative and immutable rotationDebounce to be rejected, but got %v", problems)
+	}
+
+	akvs := outputsSecret()
+	akvs.Spec.Outputs[0].RotationDebounce = &metav1.Duration{Duration: time.Minute}
+	if err := validateSpec(akvs); err == nil || !strings.Contains(err.Error(), "spec.outputs[0].rotationDebounce") {
+		t.Errorf("expected rotationDebounce in spec.outputs to be rejected, but got %v", err)
+	}
+}
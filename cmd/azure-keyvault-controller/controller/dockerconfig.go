@@ -0,0 +1,67 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReasonInvalidDockerConfig is the reason of events telling that the value read for a
+// kubernetes.io/dockerconfigjson Secret is not a docker config
+const ReasonInvalidDockerConfig = "InvalidDockerConfigJson"
+
+// invalidDockerConfigError tells that a value cannot be used as the docker config of a
+// kubernetes.io/dockerconfigjson Secret
+type invalidDockerConfigError struct {
+	reason string
+}
+
+func (e *invalidDockerConfigError) Error() string {
+	return fmt.Sprintf("value is not a valid docker config for secret type %s - %s", corev1.SecretTypeDockerConfigJson, e.reason)
+}
+
+// isInvalidDockerConfig tells if err is caused by a value not being a docker config
+func isInvalidDockerConfig(err error) bool {
+	var invalid *invalidDockerConfigError
+	return errors.As(err, &invalid)
+}
+
+// validateDockerConfigJSON checks that value is a docker config as written by docker login,
+// being a json object with registry credentials under auths. The kubelet silently ignores
+// image pull secrets it cannot parse, so an invalid value must not reach the Secret.
+func validateDockerConfigJSON(value string) error {
+	var config struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		return &invalidDockerConfigError{reason: err.Error()}
+	}
+	if config.Auths == nil {
+		return &invalidDockerConfigError{reason: "missing auths"}
+	}
+	for registry, auth := range config.Auths {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(auth, &entry); err != nil || entry == nil {
+			return &invalidDockerConfigError{reason: fmt.Sprintf("auth for registry '%s' is not an object", registry)}
+		}
+	}
+	return nil
+}
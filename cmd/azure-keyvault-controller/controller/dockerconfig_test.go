@@ -0,0 +1,76 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestValidateDockerConfigJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"auths", `{"auths":{"myregistry.azurecr.io":{"username":"user","password":"password"}}}`, true},
+		{"no registries", `{"auths":{}}`, true},
+		{"not json", "lkajslfjalsdj", false},
+		{"legacy dockercfg", `{"myregistry.azurecr.io":{"auth":"dXNlcjpwYXNzd29yZA=="}}`, false},
+		{"auths not an object", `{"auths":"myregistry.azurecr.io"}`, false},
+		{"auth not an object", `{"auths":{"myregistry.azurecr.io":"dXNlcjpwYXNzd29yZA=="}}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDockerConfigJSON(tt.value)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid docker config, but got %v", err)
+			}
+			if !tt.valid && !isInvalidDockerConfig(err) {
+				t.Errorf("expected invalid docker config, but got %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidDockerConfigJSONFailsSync(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		vaultService: &fakeVaultService{fakeSecretValue: "lkajslfjalsdj"},
+		recorder:     recorder,
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-registry"
+	akvs.Spec.Output.Secret.Type = corev1.SecretTypeDockerConfigJson
+	if _, err := c.getSecretFromKeyVault(akvs); !isInvalidDockerConfig(err) {
+		t.Fatalf("expected invalid docker config, but got %v", err)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ReasonInvalidDockerConfig) {
+			t.Errorf("expected %s event, but got '%s'", ReasonInvalidDockerConfig, event)
+		}
+	default:
+		t.Errorf("expected %s event", ReasonInvalidDockerConfig)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+const (
+	// ReasonDriftRepaired is the reason of the event when an output changed or deleted
+	// outside of the controller is repaired
+	ReasonDriftRepaired = "DriftRepaired"
+
+	// ReasonIncompleteWriteRepaired is the reason of the event when an output is repaired
+	// after a write by the controller itself failed
+	ReasonIncompleteWriteRepaired = "IncompleteWriteRepaired"
+)
+
+var driftRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "akv2k8s_drift_repairs_total",
+	Help: "The total number of outputs changed or deleted outside of the controller and repaired",
+}, []string{"namespace"})
+
+func outputKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// failureTrackingWriter remembers the outputs the last write failed for, so a repair of the
+// output can be told apart from drift
+type failureTrackingWriter struct {
+	outputWriter
+	failed *sync.Map
+}
+
+func (w *failureTrackingWriter) track(kind, namespace, name string, err error) {
+	if err != nil {
+		w.failed.Store(outputKey(kind, namespace, name), struct{}{})
+	} else {
+		w.failed.Delete(outputKey(kind, namespace, name))
+	}
+}
+
+func (w *failureTrackingWriter) CreateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	created, err := w.outputWriter.CreateSecret(ctx, secret)
+	w.track(outputKindSecret, secret.Namespace, secret.Name, err)
+	return created, err
+}
+
+func (w *failureTrackingWriter) PatchSecret(ctx context.Context, existing, secret *corev1.Secret) (*corev1.Secret, error) {
+	updated, err := w.outputWriter.PatchSecret(ctx, existing, secret)
+	w.track(outputKindSecret, secret.Namespace, secret.Name, err)
+	return updated, err
+}
+
+func (w *failureTrackingWriter) CreateConfigMap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	created, err := w.outputWriter.CreateConfigMap(ctx, cm)
+	w.track(outputKindConfigMap, cm.Namespace, cm.Name, err)
+	return created, err
+}
+
+func (w *failureTrackingWriter) PatchConfigMap(ctx context.Context, existing, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	updated, err := w.outputWriter.PatchConfigMap(ctx, existing, cm)
+	w.track(outputKindConfigMap, cm.Namespace, cm.Name, err)
+	return updated, err
+}
+
+// hasFailedWrite tells if the last write of the output failed, and must be checked
+// before the output is written again
+func (c *Controller) hasFailedWrite(kind, namespace, name string) bool {
+	_, ok := c.failedWrites.Load(outputKey(kind, namespace, name))
+	return ok
+}
+
+// driftedKeys returns the names of the keys in diff, between the data in an output and
+// the data written to repair it
+func driftedKeys(diff keyDiff) []string {
+	keys := append(append(append([]string{}, diff.added...), diff.modified...), diff.removed...)
+	sort.Strings(keys)
+	return keys
+}
+
+// reportDriftRepaired records a warning event naming the keys of the output repaired, and
+// counts the repair unless it followed a failed write by the controller
+func (c *Controller) reportDriftRepaired(akvs *akv.AzureKeyVaultSecret, kind, name string, keys []string, failedWrite bool) {
+	reason := ReasonDriftRepaired
+	cause := "changed or deleted outside of akv2k8s"
+	if failedWrite {
+		reason = ReasonIncompleteWriteRepaired
+		cause = "left incomplete by a failed write"
+	} else {
+		driftRepairs.WithLabelValues(akvs.Namespace).Inc()
+	}
+
+	klog.InfoS("output repaired", "azurekeyvaultsecret", klog.KObj(akvs), "kind", kind, "name", name, "reason", reason, "keys", keys)
+	c.recorder.Eventf(akvs, corev1.EventTypeWarning, reason, "%s '%s' was %s and has been repaired, keys: %s", kind, name, cause, joinNames(keys, maxKeyDiffLength))
+}
+
+// changedConfigMapKeys returns the names of the keys in values added or changed from old
+func changedConfigMapKeys(old, values map[string]string) []string {
+	var keys []string
+	for key, value := range values {
+		if existing, ok := old[key]; !ok || existing != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// initSecretDrift queues the owners of Secrets changed outside of the controller, so the
+// Secret is repaired at once instead of when Azure Key Vault next changes
+func (c *Controller) initSecretDrift() {
+	_, err := c.kubeInformerFactory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: c.handleUpdatedSecret,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add event handler", "kind", outputKindSecret)
+	}
+}
+
+// handleUpdatedSecret queues the AzureKeyVaultSecrets owning the Secret if its data no
+// longer matches what they last wrote to it
+func (c *Controller) handleUpdatedSecret(old, new interface{}) {
+	oldSecret, ok := old.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	secret, ok := new.(*corev1.Secret)
+	if !ok || secret.ResourceVersion == oldSecret.ResourceVersion || !isOwnedByAzureKeyVaultSecret(secret) {
+		return
+	}
+
+	for _, akvs := range c.getAzureKeyVaultSecretsFromOwners(secret) {
+		if akvs.DeletionTimestamp != nil || !c.isObjectWatched(akvs) || !c.isSelected(akvs) || !hasSecretDrifted(akvs, secret) {
+			continue
+		}
+		klog.InfoS("secret changed outside of akv2k8s - repairing", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// hasSecretDrifted tells if the data of secret differs from the keys and hash akvs last wrote
+// to it, in spec.output or spec.outputs. Keys not written by akvs are only drift if they are
+// removed when syncing, according to spec.output.secret.mergeStrategy.
+func hasSecretDrifted(akvs *akv.AzureKeyVaultSecret, secret *corev1.Secret) bool {
+	view := akvs
+	if akvs.Status.SecretName != secret.Name {
+		view = nil
+		for _, output := range akvs.Spec.Outputs {
+			if output.Secret.Name == secret.Name {
+				view = outputView(akvs, output)
+				break
+			}
+		}
+	}
+	if view == nil || view.Status.SecretHash == "" {
+		return false
+	}
+
+	managed := make(map[string][]byte, len(view.Status.SecretKeys))
+	for _, key := range view.Status.SecretKeys {
+		value, ok := secret.Data[key]
+		if !ok {
+			return true
+		}
+		managed[key] = value
+	}
+	if replacesAllSecretKeys(view) && len(secret.Data) > len(managed) {
+		return true
+	}
+	return getHashOfByteValues(managed) != view.Status.SecretHash
+}
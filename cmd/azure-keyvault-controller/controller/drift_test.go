@@ -0,0 +1,187 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// driftedController returns a controller for akvs, where the output secret 'my-secret' was
+// synced with 'password' set to 'value', and then had its data replaced by existing
+func driftedController(t *testing.T, existing map[string][]byte) (*Controller, *akv.AzureKeyVaultSecret, *record.FakeRecorder) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	synced := map[string][]byte{"password": []byte("value")}
+	akvs.Status.SecretName = "my-secret"
+	akvs.Status.SecretHash = getHashOfByteValues(synced)
+	akvs.Status.SecretKeys = sortByteValueKeys(synced)
+
+	var objects []*corev1.Secret
+	if existing != nil {
+		objects = append(objects, (&Controller{options: &Options{}}).createNewSecret(akvs, existing))
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "value"}}
+	c, _ := outputsController(t, akvs, service, objects...)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	return c, akvs, recorder
+}
+
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, reason string) string {
+	t.Helper()
+	for {
+		select {
+		case event := <-recorder.Events:
+			if strings.Contains(event, reason) {
+				return event
+			}
+		default:
+			t.Fatalf("expected %s event", reason)
+			return ""
+		}
+	}
+}
+
+func TestDriftRepairedOnSecret(t *testing.T) {
+	c, akvs, recorder := driftedController(t, map[string][]byte{"password": []byte("tampered")})
+	before := testutil.ToFloat64(driftRepairs.WithLabelValues(akvs.Namespace))
+
+	if _, _, err := c.getOrCreateKubernetesSecret(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "my-secret", "password"); value != "value" {
+		t.Errorf("expected secret to be repaired to 'value', but got '%s'", value)
+	}
+
+	event := expectEvent(t, recorder, ReasonDriftRepaired)
+	if !strings.Contains(event, "keys: password") || strings.Contains(event, "tampered") {
+		t.Errorf("expected event naming the repaired key only, but got '%s'", event)
+	}
+	if after := testutil.ToFloat64(driftRepairs.WithLabelValues(akvs.Namespace)); after != before+1 {
+		t.Errorf("expected drift repairs to be counted, but got %v after %v", after, before)
+	}
+}
+
+func TestDriftRepairedOnDeletedSecret(t *testing.T) {
+	c, akvs, recorder := driftedController(t, nil)
+
+	if _, _, err := c.getOrCreateKubernetesSecret(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, recorder, ReasonDriftRepaired)
+}
+
+func TestIncompleteWriteRepaired(t *testing.T) {
+	c, akvs, recorder := driftedController(t, map[string][]byte{"password": []byte("partial")})
+	c.failedWrites.Store(outputKey(outputKindSecret, akvs.Namespace, "my-secret"), struct{}{})
+	before := testutil.ToFloat64(driftRepairs.WithLabelValues(akvs.Namespace))
+
+	if _, _, err := c.getOrCreateKubernetesSecret(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, recorder, ReasonIncompleteWriteRepaired)
+	if after := testutil.ToFloat64(driftRepairs.WithLabelValues(akvs.Namespace)); after != before {
+		t.Errorf("expected repair of a failed write not to be counted as drift, but got %v after %v", after, before)
+	}
+	if c.hasFailedWrite(outputKindSecret, akvs.Namespace, "my-secret") {
+		t.Error("expected failed write to be cleared by the repair")
+	}
+}
+
+func TestNoDriftWhenValuesChangeInAzure(t *testing.T) {
+	c, akvs, recorder := driftedController(t, map[string][]byte{"password": []byte("value")})
+	akvs.Status.SecretHash = "hash-before-rotation"
+
+	c.vaultService = &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "rotated"}}
+	if _, _, err := c.getOrCreateKubernetesSecret(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, ReasonDriftRepaired) {
+			t.Errorf("expected no drift event for a change in azure, but got '%s'", event)
+		}
+	}
+}
+
+func TestFailureTrackingWriter(t *testing.T) {
+	c, akvs, _ := driftedController(t, nil)
+	existing := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: akvs.Namespace}}
+	secret := existing.DeepCopy()
+	secret.Data = map[string][]byte{"password": []byte("value")}
+
+	if _, err := c.writer().PatchSecret(context.TODO(), existing, secret); err == nil {
+		t.Fatal("expected update of a missing secret to fail")
+	}
+	if !c.hasFailedWrite(outputKindSecret, akvs.Namespace, "my-secret") {
+		t.Error("expected failed write to be tracked")
+	}
+
+	if _, err := c.writer().CreateSecret(context.TODO(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if c.hasFailedWrite(outputKindSecret, akvs.Namespace, "my-secret") {
+		t.Error("expected failed write to be cleared by a successful write")
+	}
+}
+
+func TestHasSecretDrifted(t *testing.T) {
+	synced := map[string][]byte{"password": []byte("value")}
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		replace  bool
+		preserve bool
+		expected bool
+	}{
+		{name: "unchanged", data: synced, expected: false},
+		{name: "managed key modified", data: map[string][]byte{"password": []byte("changed")}, expected: true},
+		{name: "managed key removed", data: map[string][]byte{"other": []byte("value")}, expected: true},
+		{name: "unmanaged key added", data: map[string][]byte{"password": []byte("value"), "other": []byte("value")}, expected: false},
+		{name: "unmanaged key added with replaceAll", data: map[string][]byte{"password": []byte("value"), "other": []byte("value")}, replace: true, expected: true},
+		{name: "unmanaged key preserved", data: map[string][]byte{"password": []byte("value"), "other": []byte("value")}, preserve: true, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := secret()
+			akvs.Spec.Output.Secret.Name = "my-secret"
+			if tt.replace {
+				akvs.Spec.Output.Secret.MergeStrategy = akv.AzureKeyVaultMergeStrategyReplaceAll
+			}
+			akvs.Spec.Output.Secret.PreserveUnmanagedKeys = tt.preserve
+			akvs.Status.SecretName = "my-secret"
+			akvs.Status.SecretHash = getHashOfByteValues(synced)
+			akvs.Status.SecretKeys = sortByteValueKeys(synced)
+
+			s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: akvs.Namespace}, Data: tt.data}
+			if drifted := hasSecretDrifted(akvs, s); drifted != tt.expected {
+				t.Errorf("expected secret to have drifted: %t, but got %t", tt.expected, drifted)
+			}
+		})
+	}
+}
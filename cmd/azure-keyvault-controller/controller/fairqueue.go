@@ -0,0 +1,192 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var pendingItems = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "akv2k8s_queue_pending_items",
+	Help: "Number of items waiting in queue, by namespace. Only reported when fair queuing is enabled.",
+}, []string{"queue", "namespace"})
+
+// fairQueue is a workqueue.Interface handing out items round-robin across namespaces
+// with pending items, so one namespace with many AzureKeyVaultSecrets does not delay
+// syncs in other namespaces. Like workqueue.Type, an item is never pending more than
+// once, and an item added while processing is pending again when done.
+type fairQueue struct {
+	name string
+	cond *sync.Cond
+
+	// namespaces with pending items, in the order they get their next turn
+	namespaces []string
+	pending    map[string][]interface{}
+
+	dirty      map[interface{}]bool
+	processing map[interface{}]bool
+
+	shuttingDown bool
+	drain        bool
+}
+
+var _ workqueue.Interface = &fairQueue{}
+
+func newFairQueue(name string) *fairQueue {
+	return &fairQueue{
+		name:       name,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		pending:    make(map[string][]interface{}),
+		dirty:      make(map[interface{}]bool),
+		processing: make(map[interface{}]bool),
+	}
+}
+
+func itemNamespace(item interface{}) string {
+	key, ok := item.(string)
+	if !ok {
+		return ""
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return ""
+	}
+	return namespace
+}
+
+// Add marks item as needing processing
+func (q *fairQueue) Add(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.shuttingDown || q.dirty[item] {
+		return
+	}
+
+	q.dirty[item] = true
+	if q.processing[item] {
+		return
+	}
+
+	q.push(item)
+	q.cond.Signal()
+}
+
+func (q *fairQueue) push(item interface{}) {
+	namespace := itemNamespace(item)
+	if len(q.pending[namespace]) == 0 {
+		q.namespaces = append(q.namespaces, namespace)
+	}
+	q.pending[namespace] = append(q.pending[namespace], item)
+	pendingItems.WithLabelValues(q.name, namespace).Set(float64(len(q.pending[namespace])))
+}
+
+// Len returns the number of pending items
+func (q *fairQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	count := 0
+	for _, items := range q.pending {
+		count += len(items)
+	}
+	return count
+}
+
+// Get blocks until an item is pending, and returns the first item of the namespace
+// whose turn it is
+func (q *fairQueue) Get() (item interface{}, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for len(q.namespaces) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.namespaces) == 0 {
+		return nil, true
+	}
+
+	namespace := q.namespaces[0]
+	q.namespaces = q.namespaces[1:]
+
+	items := q.pending[namespace]
+	item = items[0]
+	if len(items) > 1 {
+		q.pending[namespace] = items[1:]
+		q.namespaces = append(q.namespaces, namespace)
+		pendingItems.WithLabelValues(q.name, namespace).Set(float64(len(items) - 1))
+	} else {
+		delete(q.pending, namespace)
+		pendingItems.DeleteLabelValues(q.name, namespace)
+	}
+
+	q.processing[item] = true
+	delete(q.dirty, item)
+	return item, false
+}
+
+// Done marks item as done processing, making it pending again if it was added
+// while being processed
+func (q *fairQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	delete(q.processing, item)
+	if q.dirty[item] {
+		q.push(item)
+		q.cond.Signal()
+	} else if len(q.processing) == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// ShutDown ignores new items and instructs workers to exit
+func (q *fairQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.drain = false
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain ignores new items, and waits until all items being processed
+// are done before instructing workers to exit
+func (q *fairQueue) ShutDownWithDrain() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.drain = true
+	q.shuttingDown = true
+	q.cond.Broadcast()
+
+	for len(q.processing) > 0 && q.drain {
+		q.cond.Wait()
+	}
+}
+
+func (q *fairQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	return q.shuttingDown
+}
@@ -0,0 +1,73 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+)
+
+func TestFairQueueRoundRobinAcrossNamespaces(t *testing.T) {
+	q := newFairQueue("test")
+	for _, key := range []string{"big/a", "big/b", "big/c", "big/d", "small/a", "other/a", "small/b"} {
+		q.Add(key)
+	}
+	q.Add("big/a")
+
+	if q.Len() != 7 {
+		t.Errorf("expected 7 pending items, but got %d", q.Len())
+	}
+
+	expected := []string{"big/a", "small/a", "other/a", "big/b", "small/b", "big/c", "big/d"}
+	for i, key := range expected {
+		item, shutdown := q.Get()
+		if shutdown {
+			t.Fatal("queue should not be shut down")
+		}
+		if item != key {
+			t.Errorf("expected item %d to be '%s', but got '%s'", i, key, item)
+		}
+		q.Done(item)
+	}
+
+	if q.Len() != 0 {
+		t.Errorf("expected no pending items, but got %d", q.Len())
+	}
+}
+
+func TestFairQueueAddWhileProcessing(t *testing.T) {
+	q := newFairQueue("test")
+	q.Add("ns/a")
+
+	item, _ := q.Get()
+	q.Add("ns/a")
+	if q.Len() != 0 {
+		t.Error("item being processed should not be pending until done")
+	}
+
+	q.Done(item)
+	if q.Len() != 1 {
+		t.Error("item added while processing should be pending when done")
+	}
+
+	q.ShutDown()
+	if _, shutdown := q.Get(); shutdown {
+		t.Error("pending items should still be returned after shut down")
+	}
+	if _, shutdown := q.Get(); !shutdown {
+		t.Error("expected queue to be shut down")
+	}
+}
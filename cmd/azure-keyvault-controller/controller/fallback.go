@@ -0,0 +1,217 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// fallbackVaultService reads objects from the fallback vault in spec.vault.fallback when
+// the vault cannot be reached, and remembers which vault the last object was read from.
+// The vault is always tried first, so reads return to it as soon as it recovers.
+type fallbackVaultService struct {
+	vault.Service
+
+	mu       sync.Mutex
+	servedBy string
+	// attempted is set once the vault has been read, and unreachable is the error of the
+	// last read if the vault could not be reached
+	attempted   bool
+	unreachable error
+}
+
+func newFallbackVaultService(service vault.Service) *fallbackVaultService {
+	return &fallbackVaultService{Service: service}
+}
+
+// isVaultUnreachable tells if err means the vault could not serve the request at all,
+// as opposed to the object being missing or access being denied
+func isVaultUnreachable(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s *fallbackVaultService) read(secret *akv.AzureKeyVault, fn func(*akv.AzureKeyVault) error) error {
+	err := s.readWithFallback(secret, fn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempted = true
+	s.unreachable = nil
+	if isVaultUnreachable(err) {
+		s.unreachable = err
+	}
+	return err
+}
+
+func (s *fallbackVaultService) readWithFallback(secret *akv.AzureKeyVault, fn func(*akv.AzureKeyVault) error) error {
+	err := fn(secret)
+	if err != nil && secret.Fallback != nil && secret.Fallback.Name != "" && isVaultUnreachable(err) {
+		klog.InfoS("azure key vault unreachable - reading from fallback vault", "vault", secret.Identifier(), "fallback", secret.Fallback.Name, "object", secret.Object.Name, "error", err.Error())
+
+		fallback := secret.DeepCopy()
+		fallback.Name = secret.Fallback.Name
+		fallback.URI = ""
+		fallback.Fallback = nil
+		if fallbackErr := fn(fallback); fallbackErr != nil {
+			return fmt.Errorf("%w, and reading from fallback vault '%s' failed: %v", err, fallback.Name, fallbackErr)
+		}
+		secret = fallback
+	} else if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servedBy = secret.Identifier()
+	return nil
+}
+
+func (s *fallbackVaultService) GetSecret(secret *akv.AzureKeyVault) (value string, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, err = s.Service.GetSecret(v)
+		return err
+	})
+	return value, err
+}
+
+func (s *fallbackVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (value string, metadata *vault.ObjectMetadata, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, metadata, err = s.Service.GetSecretWithMetadata(v)
+		return err
+	})
+	return value, metadata, err
+}
+
+func (s *fallbackVaultService) GetKey(secret *akv.AzureKeyVault) (value string, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, err = s.Service.GetKey(v)
+		return err
+	})
+	return value, err
+}
+
+func (s *fallbackVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (key *vault.Key, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		key, err = s.Service.GetKeyMaterial(v)
+		return err
+	})
+	return key, err
+}
+
+func (s *fallbackVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (cert *vault.Certificate, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		cert, err = s.Service.GetCertificate(v, options)
+		return err
+	})
+	return cert, err
+}
+
+func (s *fallbackVaultService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (renewal *time.Time, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		renewal, err = s.Service.GetCertificateRenewalTime(v)
+		return err
+	})
+	return renewal, err
+}
+
+func (s *fallbackVaultService) GetObjectVersions(secret *akv.AzureKeyVault) (versions []vault.ObjectVersion, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		versions, err = s.Service.GetObjectVersions(v)
+		return err
+	})
+	return versions, err
+}
+
+func (s *fallbackVaultService) lastServedBy() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servedBy
+}
+
+// lastReachability returns if the vault has been read, and the error of the last read if the
+// vault could not be reached
+func (s *fallbackVaultService) lastReachability() (attempted bool, unreachable error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempted, s.unreachable
+}
+
+// storeServedBy remembers which vault service last read akvs from, to be recorded in its status
+func (c *Controller) storeServedBy(akvs *akv.AzureKeyVaultSecret, service *fallbackVaultService) {
+	if servedBy := service.lastServedBy(); servedBy != "" {
+		c.servedBy.Store(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name), servedBy)
+	}
+}
+
+// setServedBy records the vault akvs was last read from in its status, and sets the
+// ServedFromFallback condition when it was the fallback vault. Akvs must be a copy
+// about to be written.
+func (c *Controller) setServedBy(akvs *akv.AzureKeyVaultSecret) {
+	value, ok := c.servedBy.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return
+	}
+	servedBy := value.(string)
+	akvs.Status.ServedBy = servedBy
+
+	fallback := akvs.Spec.Vault.Fallback
+	if fallback != nil && servedBy == fallback.Name && servedBy != akvs.Spec.Vault.Identifier() {
+		msg := fmt.Sprintf("Values were read from fallback Azure Key Vault '%s', as '%s' could not be reached", fallback.Name, akvs.Spec.Vault.Identifier())
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeServedFromFallback) {
+			c.recorder.Event(akvs, corev1.EventTypeWarning, ConditionTypeServedFromFallback, msg)
+		}
+		meta.SetStatusCondition(&akvs.Status.Conditions, metav1.Condition{
+			Type:               ConditionTypeServedFromFallback,
+			Status:             metav1.ConditionTrue,
+			Reason:             "VaultUnreachable",
+			Message:            msg,
+			ObservedGeneration: akvs.Generation,
+		})
+		return
+	}
+
+	if meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeServedFromFallback) != nil {
+		meta.SetStatusCondition(&akvs.Status.Conditions, metav1.Condition{
+			Type:               ConditionTypeServedFromFallback,
+			Status:             metav1.ConditionFalse,
+			Reason:             "VaultReachable",
+			Message:            fmt.Sprintf("Values were read from Azure Key Vault '%s'", servedBy),
+			ObservedGeneration: akvs.Generation,
+		})
+	}
+}
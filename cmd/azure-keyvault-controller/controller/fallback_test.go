@@ -0,0 +1,160 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// regionalVaultService returns the name of the vault as the secret value, or the error
+// configured for the vault
+type regionalVaultService struct {
+	fakeVaultService
+	errors map[string]error
+	reads  []string
+}
+
+func (f *regionalVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
+	value, _, err := f.GetSecretWithMetadata(secret)
+	return value, err
+}
+
+func (f *regionalVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	f.reads = append(f.reads, secret.Name)
+	if err := f.errors[secret.Name]; err != nil {
+		return "", nil, err
+	}
+	return "value from " + secret.Name, nil, nil
+}
+
+// responseError returns the error the azure sdk returns for a response with statusCode
+func responseError(statusCode int) error {
+	req, _ := http.NewRequest(http.MethodGet, "https://primary.vault.azure.net/secrets/some-secret", nil)
+	return runtime.NewResponseError(&http.Response{
+		Status:     http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	})
+}
+
+func TestFallbackVaultService(t *testing.T) {
+	vaultSpec := &akv.AzureKeyVault{
+		Name:     "primary",
+		Object:   akv.AzureKeyVaultObject{Name: "some-secret", Type: akv.AzureKeyVaultObjectTypeSecret},
+		Fallback: &akv.AzureKeyVaultFallback{Name: "secondary"},
+	}
+
+	tests := []struct {
+		name             string
+		errors           map[string]error
+		expectedValue    string
+		expectedServedBy string
+		expectErr        bool
+	}{
+		{name: "primary reachable", expectedValue: "value from primary", expectedServedBy: "primary"},
+		{name: "primary unavailable", errors: map[string]error{"primary": responseError(http.StatusServiceUnavailable)}, expectedValue: "value from secondary", expectedServedBy: "secondary"},
+		{name: "primary not found", errors: map[string]error{"primary": responseError(http.StatusNotFound)}, expectErr: true},
+		{name: "both unavailable", errors: map[string]error{"primary": responseError(http.StatusBadGateway), "secondary": errors.New("denied")}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := newFallbackVaultService(&regionalVaultService{errors: tt.errors})
+			value, err := service.GetSecret(vaultSpec)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected error, but got value '%s'", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.expectedValue {
+				t.Errorf("expected '%s', but got '%s'", tt.expectedValue, value)
+			}
+			if service.lastServedBy() != tt.expectedServedBy {
+				t.Errorf("expected to be served by '%s', but got '%s'", tt.expectedServedBy, service.lastServedBy())
+			}
+		})
+	}
+}
+
+func TestFallbackVaultServiceReturnsToPrimary(t *testing.T) {
+	vaultSpec := &akv.AzureKeyVault{
+		Name:     "primary",
+		Object:   akv.AzureKeyVaultObject{Name: "some-secret", Type: akv.AzureKeyVaultObjectTypeSecret},
+		Fallback: &akv.AzureKeyVaultFallback{Name: "secondary"},
+	}
+	regional := &regionalVaultService{errors: map[string]error{"primary": responseError(http.StatusInternalServerError)}}
+	service := newFallbackVaultService(regional)
+
+	if _, err := service.GetSecret(vaultSpec); err != nil {
+		t.Fatal(err)
+	}
+	delete(regional.errors, "primary")
+	value, err := service.GetSecret(vaultSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value from primary" || service.lastServedBy() != "primary" {
+		t.Errorf("expected primary to be used once recovered, but got '%s' from '%s'", value, service.lastServedBy())
+	}
+}
+
+func TestServedFromFallbackCondition(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder}
+
+	akvs := secret()
+	akvs.Spec.Vault.Fallback = &akv.AzureKeyVaultFallback{Name: "secondary"}
+
+	c.storeServedBy(akvs, &fallbackVaultService{servedBy: "secondary"})
+	c.setServedBy(akvs)
+	if akvs.Status.ServedBy != "secondary" {
+		t.Errorf("expected status to record fallback vault, but got '%s'", akvs.Status.ServedBy)
+	}
+	if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeServedFromFallback) {
+		t.Errorf("expected ServedFromFallback condition to be true, but got %v", akvs.Status.Conditions)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event, but got %d", len(recorder.Events))
+	}
+
+	c.storeServedBy(akvs, &fallbackVaultService{servedBy: akvs.Spec.Vault.Name})
+	c.setServedBy(akvs)
+	if akvs.Status.ServedBy != akvs.Spec.Vault.Name {
+		t.Errorf("expected status to record primary vault, but got '%s'", akvs.Status.ServedBy)
+	}
+	condition := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeServedFromFallback)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Errorf("expected ServedFromFallback condition to be false, but got %v", condition)
+	}
+}
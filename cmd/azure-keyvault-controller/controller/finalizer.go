@@ -0,0 +1,211 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// FinalizerRetainOutputs is set on AzureKeyVaultSecrets with outputs with reclaimPolicy Retain,
+	// so the owner reference can be removed from the outputs before garbage collection deletes them
+	FinalizerRetainOutputs = "akv2k8s.io/retain-outputs"
+
+	// ReasonRetainOutputsFailed is the reason of the event when outputs with reclaimPolicy Retain
+	// could not be released before the AzureKeyVaultSecret was deleted
+	ReasonRetainOutputsFailed = "RetainOutputsFailed"
+
+	// ReasonOutputRetained is the reason of the event when an output with reclaimPolicy Retain
+	// is released, so it is kept after the AzureKeyVaultSecret is deleted
+	ReasonOutputRetained = "OutputRetained"
+
+	// retainOutputsTimeout is how long releasing retained outputs is retried, before the
+	// finalizer is removed anyway so deletion of the AzureKeyVaultSecret is never blocked
+	retainOutputsTimeout = 5 * time.Minute
+)
+
+// akvsOutputList returns spec.outputs, or spec.output when spec.outputs is not used
+func akvsOutputList(akvs *akv.AzureKeyVaultSecret) []akv.AzureKeyVaultOutput {
+	if akvsHasOutputs(akvs) {
+		return akvs.Spec.Outputs
+	}
+	return []akv.AzureKeyVaultOutput{akvs.Spec.Output}
+}
+
+// reclaimPolicyOf returns the deletePolicy of output, or policy, the deprecated reclaimPolicy
+// of its Secret or ConfigMap, when deletePolicy is not set
+func reclaimPolicyOf(policy akv.AzureKeyVaultDeletePolicy, output akv.AzureKeyVaultOutput) akv.AzureKeyVaultDeletePolicy {
+	if output.DeletePolicy != "" {
+		return output.DeletePolicy
+	}
+	return policy
+}
+
+func isSecretRetained(output akv.AzureKeyVaultOutput) bool {
+	return output.Secret.Name != "" && reclaimPolicyOf(output.Secret.ReclaimPolicy, output) == akv.AzureKeyVaultDeletePolicyRetain
+}
+
+func isConfigMapRetained(output akv.AzureKeyVaultOutput) bool {
+	return output.ConfigMap.Name != "" && reclaimPolicyOf(output.ConfigMap.ReclaimPolicy, output) == akv.AzureKeyVaultDeletePolicyRetain
+}
+
+func isRetained(output akv.AzureKeyVaultOutput) bool {
+	return isSecretRetained(output) || isConfigMapRetained(output)
+}
+
+func hasRetainedOutputs(akvs *akv.AzureKeyVaultSecret) bool {
+	for _, output := range akvsOutputList(akvs) {
+		if isRetained(output) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRetainFinalizer(akvs *akv.AzureKeyVaultSecret) bool {
+	for _, finalizer := range akvs.Finalizers {
+		if finalizer == FinalizerRetainOutputs {
+			return true
+		}
+	}
+	return false
+}
+
+// setRetainFinalizer adds or removes the finalizer on akvs, and returns the updated akvs
+func (c *Controller) setRetainFinalizer(akvs *akv.AzureKeyVaultSecret, set bool) (*akv.AzureKeyVaultSecret, error) {
+	akvsCopy := akvs.DeepCopy()
+	akvsCopy.Finalizers = nil
+	for _, finalizer := range akvs.Finalizers {
+		if finalizer != FinalizerRetainOutputs {
+			akvsCopy.Finalizers = append(akvsCopy.Finalizers, finalizer)
+		}
+	}
+	if set {
+		akvsCopy.Finalizers = append(akvsCopy.Finalizers, FinalizerRetainOutputs)
+	}
+
+	klog.V(4).InfoS("updating finalizer", "azurekeyvaultsecret", klog.KObj(akvs), "finalizer", FinalizerRetainOutputs, "set", set)
+	return c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Update(context.TODO(), akvsCopy, metav1.UpdateOptions{})
+}
+
+// ensureRetainFinalizer sets the finalizer on akvs only while it has outputs with
+// deletePolicy Retain, and returns the updated akvs
+func (c *Controller) ensureRetainFinalizer(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	retain := hasRetainedOutputs(akvs)
+	if retain == hasRetainFinalizer(akvs) {
+		return akvs, nil
+	}
+	return c.setRetainFinalizer(akvs, retain)
+}
+
+// finalizeAzureKeyVaultSecret releases the outputs with deletePolicy Retain when akvs is
+// being deleted, and returns true if it is. The finalizer is removed when done, or when
+// retainOutputsTimeout has passed since deletion, so deletion is never blocked for good.
+func (c *Controller) finalizeAzureKeyVaultSecret(akvs *akv.AzureKeyVaultSecret) (bool, error) {
+	if akvs.DeletionTimestamp == nil {
+		return false, nil
+	}
+	if !hasRetainFinalizer(akvs) {
+		return true, nil
+	}
+
+	if err := c.releaseRetainedOutputs(akvs); err != nil {
+		if c.clock.Now().Sub(akvs.DeletionTimestamp.Time) < retainOutputsTimeout {
+			return true, err
+		}
+		klog.ErrorS(err, "failed to release retained outputs - giving up", "azurekeyvaultsecret", klog.KObj(akvs))
+		c.recorder.Eventf(akvs, corev1.EventTypeWarning, ReasonRetainOutputsFailed, "Outputs with deletePolicy Retain could not be released within %s and may be deleted: %s", retainOutputsTimeout, err.Error())
+	}
+
+	if _, err := c.setRetainFinalizer(akvs, false); err != nil && !errors.IsNotFound(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// releaseRetainedOutputs removes akvs as owner of each output with reclaimPolicy Retain, so
+// the output is not garbage collected with akvs. Outputs already gone are skipped.
+func (c *Controller) releaseRetainedOutputs(akvs *akv.AzureKeyVaultSecret) error {
+	for _, output := range akvsOutputList(akvs) {
+		if isSecretRetained(output) {
+			if err := c.releaseSecret(akvs, output.Secret.Name); err != nil {
+				return err
+			}
+		}
+		if isConfigMapRetained(output) {
+			name := output.ConfigMap.Name
+			if output.ConfigMap.Immutable && akvs.Status.ConfigMapName != "" {
+				name = akvs.Status.ConfigMapName
+			}
+			if err := c.releaseConfigMap(akvs, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Controller) releaseSecret(akvs *akv.AzureKeyVaultSecret, name string) error {
+	secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isOwnedBy(secret, akvs) {
+		return nil
+	}
+
+	released := secret.DeepCopy()
+	released.OwnerReferences = removeOwnerRef(released.OwnerReferences, akvs)
+	if _, err = c.writer().PatchSecret(context.TODO(), secret, released); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	klog.InfoS("secret retained", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+	c.recorder.Eventf(akvs, corev1.EventTypeNormal, ReasonOutputRetained, "Secret %s orphaned intentionally with reclaimPolicy Retain, it is kept after the AzureKeyVaultSecret is deleted", secret.Name)
+	return nil
+}
+
+func (c *Controller) releaseConfigMap(akvs *akv.AzureKeyVaultSecret, name string) error {
+	cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isOwnedBy(cm, akvs) {
+		return nil
+	}
+
+	released := cm.DeepCopy()
+	released.OwnerReferences = removeOwnerRef(released.OwnerReferences, akvs)
+	if _, err = c.writer().PatchConfigMap(context.TODO(), cm, released); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	klog.InfoS("configmap retained", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+	c.recorder.Eventf(akvs, corev1.EventTypeNormal, ReasonOutputRetained, "ConfigMap %s orphaned intentionally with reclaimPolicy Retain, it is kept after the AzureKeyVaultSecret is deleted", cm.Name)
+	return nil
+}
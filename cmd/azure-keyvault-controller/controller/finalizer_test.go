@@ -0,0 +1,199 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// retainedController returns a controller for akvs being deleted, with the retained output
+// secret 'my-secret' owned by akvs when owned is set
+func retainedController(t *testing.T, owned bool) (*Controller, *akv.AzureKeyVaultSecret, *k8sfake.Clientset) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.DeletePolicy = akv.AzureKeyVaultDeletePolicyRetain
+	akvs.Finalizers = []string{FinalizerRetainOutputs}
+	deleted := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	akvs.DeletionTimestamp = &deleted
+
+	var objects []*corev1.Secret
+	if owned {
+		objects = append(objects, (&Controller{options: &Options{}}).createNewSecret(akvs, map[string][]byte{"password": []byte("value")}))
+	}
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, objects...)
+	c.clock = &fakeClock{now: deleted.Add(time.Minute)}
+	return c, akvs, kubeclient
+}
+
+func TestEnsureRetainFinalizer(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.DeletePolicy = akv.AzureKeyVaultDeletePolicyRetain
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+
+	updated, err := c.ensureRetainFinalizer(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasRetainFinalizer(updated) {
+		t.Fatal("expected finalizer to be added for deletePolicy Retain")
+	}
+
+	updated.Spec.Output.DeletePolicy = akv.AzureKeyVaultDeletePolicyDelete
+	updated, err = c.ensureRetainFinalizer(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasRetainFinalizer(updated) {
+		t.Error("expected finalizer to be removed for deletePolicy Delete")
+	}
+}
+
+func TestFinalizeReleasesRetainedSecret(t *testing.T) {
+	c, akvs, kubeclient := retainedController(t, true)
+
+	deleting, err := c.finalizeAzureKeyVaultSecret(akvs)
+	if err != nil || !deleting {
+		t.Fatalf("expected deletion to be handled, got %t, %v", deleting, err)
+	}
+
+	secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "my-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isOwnedBy(secret, akvs) {
+		t.Error("expected owner reference to be removed from retained secret")
+	}
+	if string(secret.Data["password"]) != "value" {
+		t.Errorf("expected retained secret to keep its values, but got %v", secret.Data)
+	}
+	if hasRetainFinalizer(getStatus(t, c, akvs)) {
+		t.Error("expected finalizer to be removed")
+	}
+}
+
+func TestFinalizeWithRetainedSecretGone(t *testing.T) {
+	c, akvs, _ := retainedController(t, false)
+
+	if _, err := c.finalizeAzureKeyVaultSecret(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if hasRetainFinalizer(getStatus(t, c, akvs)) {
+		t.Error("expected finalizer to be removed when the output is gone")
+	}
+}
+
+func TestFinalizeNeverBlocksDeletion(t *testing.T) {
+	c, akvs, kubeclient := retainedController(t, true)
+	kubeclient.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("api unavailable")
+	})
+
+	if _, err := c.finalizeAzureKeyVaultSecret(akvs); err == nil {
+		t.Fatal("expected failure to be retried")
+	}
+	if !hasRetainFinalizer(getStatus(t, c, akvs)) {
+		t.Fatal("expected finalizer to be kept while retrying")
+	}
+
+	c.clock = &fakeClock{now: akvs.DeletionTimestamp.Add(retainOutputsTimeout + time.Second)}
+	if _, err := c.finalizeAzureKeyVaultSecret(akvs); err != nil {
+		t.Fatal(err)
+	}
+	if hasRetainFinalizer(getStatus(t, c, akvs)) {
+		t.Error("expected finalizer to be removed after the timeout")
+	}
+}
+
+func TestDeleteKubernetesValuesSkipsRetainedOutputs(t *testing.T) {
+	c, akvs, kubeclient := retainedController(t, true)
+	c.vaultService = &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "value"}}
+	akvs.Spec.Output.Secret.DataKey = "password"
+
+	if err := c.deleteKubernetesValues(akvs); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "my-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["password"]) != "value" {
+		t.Errorf("expected values of retained secret to be kept, but got %v", secret.Data)
+	}
+}
+
+func TestReclaimPolicyAppliesWithoutDeletePolicy(t *testing.T) {
+	output := akv.AzureKeyVaultOutput{
+		Secret:    akv.AzureKeyVaultOutputSecret{Name: "my-secret", ReclaimPolicy: akv.AzureKeyVaultDeletePolicyRetain},
+		ConfigMap: akv.AzureKeyVaultOutputConfigMap{Name: "my-configmap"},
+	}
+	if !isSecretRetained(output) || isConfigMapRetained(output) {
+		t.Errorf("expected only the secret to be retained, got secret %t, configmap %t", isSecretRetained(output), isConfigMapRetained(output))
+	}
+
+	output.DeletePolicy = akv.AzureKeyVaultDeletePolicyRetain
+	if !isSecretRetained(output) || !isConfigMapRetained(output) {
+		t.Errorf("expected deletePolicy to apply to both, got secret %t, configmap %t", isSecretRetained(output), isConfigMapRetained(output))
+	}
+}
+
+func TestDeletedTombstoneReleasesRetainedSecret(t *testing.T) {
+	c, akvs, kubeclient := retainedController(t, true)
+	akvs.Finalizers = nil
+	akvs.Spec.Output.DeletePolicy = ""
+	akvs.Spec.Output.Secret.ReclaimPolicy = akv.AzureKeyVaultDeletePolicyRetain
+	c.akvsCrdQueue = newPriorityQueue("AzureKeyVaultSecrets", priorityHigh, 1, 1, nil, false, nil)
+	c.azureKeyVaultQueue = newPriorityQueue("AzureKeyVault", priorityLow, 1, 1, nil, false, nil)
+	key := akvs.Namespace + "/" + akvs.Name
+
+	c.handleDeletedAzureKeyVaultSecret(cache.DeletedFinalStateUnknown{Key: key, Obj: akvs})
+
+	secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "my-secret", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isOwnedBy(secret, akvs) {
+		t.Error("expected owner reference to be removed from retained secret")
+	}
+	if string(secret.Data["password"]) != "value" {
+		t.Errorf("expected retained secret to keep its values, but got %v", secret.Data)
+	}
+
+	select {
+	case event := <-c.recorder.(*record.FakeRecorder).Events:
+		if !strings.Contains(event, ReasonOutputRetained) || !strings.Contains(event, "orphaned intentionally") {
+			t.Errorf("expected event about the retained secret, but got '%s'", event)
+		}
+	default:
+		t.Error("expected event about the retained secret")
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// gitExportWriter writes outputs as manifests into a directory tree of one directory per
+// namespace, instead of applying them. Another process, like a sidecar, commits the
+// directory to Git, and the manifests are applied from Git. As outputs are only read back
+// from the cluster once applied, an output may be written several times before that.
+type gitExportWriter struct {
+	dir         string
+	digestsOnly bool
+	lock        sync.Mutex
+}
+
+func newGitExportWriter(dir string, digestsOnly bool) *gitExportWriter {
+	klog.InfoS("writing outputs as manifests instead of applying them", "dir", dir, "digestsOnly", digestsOnly)
+	return &gitExportWriter{dir: dir, digestsOnly: digestsOnly}
+}
+
+// manifestPath returns the path of the manifest of the object of kind, like
+// <dir>/<namespace>/secret-<name>.yaml
+func (w *gitExportWriter) manifestPath(kind, namespace, name string) string {
+	return filepath.Join(w.dir, namespace, fmt.Sprintf("%s-%s.yaml", strings.ToLower(kind), name))
+}
+
+func valueDigest(value []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(value))
+}
+
+// exportMeta returns the metadata of an exported manifest, without the fields set by the
+// Kubernetes API
+func exportMeta(meta metav1.ObjectMeta) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:            meta.Name,
+		Namespace:       meta.Namespace,
+		Labels:          meta.Labels,
+		Annotations:     meta.Annotations,
+		OwnerReferences: meta.OwnerReferences,
+	}
+}
+
+func (w *gitExportWriter) secretManifest(secret *corev1.Secret) *corev1.Secret {
+	manifest := &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: exportMeta(secret.ObjectMeta),
+		Type:       secret.Type,
+		Data:       secret.Data,
+	}
+	if w.digestsOnly {
+		manifest.Data = nil
+		manifest.StringData = make(map[string]string, len(secret.Data))
+		for key, value := range secret.Data {
+			manifest.StringData[key] = valueDigest(value)
+		}
+	}
+	return manifest
+}
+
+func (w *gitExportWriter) configMapManifest(cm *corev1.ConfigMap) *corev1.ConfigMap {
+	manifest := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: exportMeta(cm.ObjectMeta),
+		Data:       cm.Data,
+		BinaryData: cm.BinaryData,
+	}
+	if w.digestsOnly {
+		manifest.Data = make(map[string]string, len(cm.Data)+len(cm.BinaryData))
+		manifest.BinaryData = nil
+		for key, value := range configMapValues(cm) {
+			manifest.Data[key] = valueDigest([]byte(value))
+		}
+	}
+	return manifest
+}
+
+// write writes manifest to path, replacing any existing file in one step so a commit
+// never sees a partially written manifest
+func (w *gitExportWriter) write(path string, manifest interface{}) error {
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	klog.V(4).InfoS("manifest written", "path", path)
+	return nil
+}
+
+func (w *gitExportWriter) remove(path string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.V(4).InfoS("manifest removed", "path", path)
+	return nil
+}
+
+func (w *gitExportWriter) CreateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	return w.PatchSecret(ctx, nil, secret)
+}
+
+func (w *gitExportWriter) PatchSecret(ctx context.Context, existing, secret *corev1.Secret) (*corev1.Secret, error) {
+	if err := w.write(w.manifestPath("Secret", secret.Namespace, secret.Name), w.secretManifest(secret)); err != nil {
+		return nil, fmt.Errorf("failed to export secret %s/%s, error: %+v", secret.Namespace, secret.Name, err)
+	}
+	return secret, nil
+}
+
+func (w *gitExportWriter) DeleteSecret(ctx context.Context, namespace, name string) error {
+	return w.remove(w.manifestPath("Secret", namespace, name))
+}
+
+func (w *gitExportWriter) CreateConfigMap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return w.PatchConfigMap(ctx, nil, cm)
+}
+
+func (w *gitExportWriter) PatchConfigMap(ctx context.Context, existing, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if err := w.write(w.manifestPath("ConfigMap", cm.Namespace, cm.Name), w.configMapManifest(cm)); err != nil {
+		return nil, fmt.Errorf("failed to export configmap %s/%s, error: %+v", cm.Namespace, cm.Name, err)
+	}
+	return cm, nil
+}
+
+func (w *gitExportWriter) DeleteConfigMap(ctx context.Context, namespace, name string) error {
+	return w.remove(w.manifestPath("ConfigMap", namespace, name))
+}
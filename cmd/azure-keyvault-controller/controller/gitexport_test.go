@@ -0,0 +1,123 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func readSecretManifest(t *testing.T, path string) *corev1.Secret {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{}
+	if err := yaml.Unmarshal(data, secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestGitExportWriterSecret(t *testing.T) {
+	dir := t.TempDir()
+	w := newGitExportWriter(dir, false)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "team-a", ResourceVersion: "42", UID: "secret-uid"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"password": []byte("some-value")},
+	}
+
+	if _, err := w.CreateSecret(context.TODO(), secret); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "team-a", "secret-my-secret.yaml")
+	manifest := readSecretManifest(t, path)
+	if manifest.Kind != "Secret" || manifest.APIVersion != "v1" {
+		t.Errorf("expected v1 Secret manifest, but got %v", manifest.TypeMeta)
+	}
+	if manifest.ResourceVersion != "" || manifest.UID != "" {
+		t.Errorf("expected fields set by the api to be left out, but got %v", manifest.ObjectMeta)
+	}
+	if string(manifest.Data["password"]) != "some-value" {
+		t.Errorf("expected value in manifest, but got %v", manifest.Data)
+	}
+
+	if err := w.DeleteSecret(context.TODO(), "team-a", "my-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected manifest to be removed, but got %v", err)
+	}
+	if err := w.DeleteSecret(context.TODO(), "team-a", "my-secret"); err != nil {
+		t.Errorf("expected removing a missing manifest to succeed, but got %v", err)
+	}
+}
+
+func TestGitExportWriterDigestsOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := newGitExportWriter(dir, true)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "team-a"},
+		Data:       map[string][]byte{"password": []byte("some-value")},
+	}
+
+	if _, err := w.PatchSecret(context.TODO(), nil, secret); err != nil {
+		t.Fatal(err)
+	}
+	manifest := readSecretManifest(t, filepath.Join(dir, "team-a", "secret-my-secret.yaml"))
+	if len(manifest.Data) != 0 || manifest.StringData["password"] != valueDigest([]byte("some-value")) {
+		t.Errorf("expected only the digest of the value, but got %v and %v", manifest.Data, manifest.StringData)
+	}
+}
+
+func TestSyncOutputsToGitExport(t *testing.T) {
+	dir := t.TempDir()
+	akvs := outputsSecret()
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	c, kubeclient := outputsController(t, akvs, service)
+	c.outputWriter = newGitExportWriter(dir, false)
+
+	if err := c.syncOutputs(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := kubeclient.CoreV1().Secrets(akvs.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Errorf("expected no secrets to be applied, but got %d", len(secrets.Items))
+	}
+	for name, key := range map[string]string{"first": "password", "second": "PASSWORD"} {
+		manifest := readSecretManifest(t, filepath.Join(dir, akvs.Namespace, "secret-"+name+".yaml"))
+		if string(manifest.Data[key]) != "some-value" || !isOwnedBy(manifest, akvs) {
+			t.Errorf("expected manifest of '%s' owned by akvs with key '%s', but got %v", name, key, manifest)
+		}
+	}
+
+	updated := getStatus(t, c, akvs)
+	if len(updated.Status.Outputs) != 2 || updated.Status.Outputs[0].Hash == "" {
+		t.Errorf("expected status to be updated as when applying outputs, but got %v", updated.Status.Outputs)
+	}
+}
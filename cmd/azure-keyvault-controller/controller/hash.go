@@ -0,0 +1,61 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/md5"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+// legacyHashLength is the length of the hex encoded MD5 hashes recorded in the status before
+// values were hashed with SHA-256
+const legacyHashLength = md5.Size * 2
+
+// isLegacyHashOfByteValues tells if recorded is the MD5 hash of values
+func isLegacyHashOfByteValues(recorded string, values map[string][]byte) bool {
+	return len(recorded) == legacyHashLength && recorded == hashByteValues(md5.New(), values)
+}
+
+// isLegacyHashOfStringValues tells if recorded is the MD5 hash of values
+func isLegacyHashOfStringValues(recorded string, values map[string]string) bool {
+	return len(recorded) == legacyHashLength && recorded == hashStringValues(md5.New(), values)
+}
+
+// migrateSecretHash replaces the MD5 hash in status.secretHash of akvs with the SHA-256 hash
+// of values, if it is the hash of the same values, so unchanged values are not taken as a
+// change after upgrading. Returns a copy of akvs and true if the status must be rewritten.
+func migrateSecretHash(akvs *akv.AzureKeyVaultSecret, values map[string][]byte) (*akv.AzureKeyVaultSecret, bool) {
+	if !isLegacyHashOfByteValues(akvs.Status.SecretHash, values) {
+		return akvs, false
+	}
+	migrated := akvs.DeepCopy()
+	migrated.Status.SecretHash = getHashOfByteValues(values)
+	return migrated, true
+}
+
+// migrateConfigMapHash replaces the MD5 hash in status.configMapHash of akvs with the SHA-256
+// hash of values, if it is the hash of the same values, so unchanged values are not taken as a
+// change after upgrading. Returns a copy of akvs and true if the status must be rewritten.
+func migrateConfigMapHash(akvs *akv.AzureKeyVaultSecret, values map[string]string) (*akv.AzureKeyVaultSecret, bool) {
+	if !isLegacyHashOfStringValues(akvs.Status.ConfigMapHash, values) {
+		return akvs, false
+	}
+	migrated := akvs.DeepCopy()
+	migrated.Status.ConfigMapHash = getHashOfStringValues(values)
+	return migrated, true
+}
@@ -0,0 +1,164 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/md5"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+// legacySecret returns an AzureKeyVaultSecret with the MD5 hash of value in its status, as
+// written before upgrading, and its output Secret with value
+func legacySecret(value string) (*akv.AzureKeyVaultSecret, *corev1.Secret) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+
+	values := map[string][]byte{"password": []byte(value)}
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, values)
+	akvs.Status.SecretName = "my-secret"
+	akvs.Status.SecretHash = hashByteValues(md5.New(), values)
+	akvs.Status.SecretKeys = sortByteValueKeys(values)
+	return akvs, existing
+}
+
+func secretUpdates(c *Controller) int {
+	updates := 0
+	for _, action := range c.kubeclientset.(*k8sfake.Clientset).Actions() {
+		if action.GetVerb() == "patch" && action.GetResource().Resource == "secrets" {
+			updates++
+		}
+	}
+	return updates
+}
+
+func TestHashIsSHA256(t *testing.T) {
+	hash := getHashOfByteValues(map[string][]byte{"password": []byte("value")})
+	if len(hash) != 64 {
+		t.Errorf("expected hex encoded sha-256 hash, but got '%s'", hash)
+	}
+	if hash != getHashOfStringValues(map[string]string{"password": "value"}) {
+		t.Error("expected the same hash for byte and string values")
+	}
+}
+
+func TestLegacyHashMigratedOnPoll(t *testing.T) {
+	akvs, existing := legacySecret("value")
+	c, poll := pollController(t, akvs, "value", existing)
+
+	poll()
+	expected := getHashOfByteValues(map[string][]byte{"password": []byte("value")})
+	if hash := getStatus(t, c, akvs).Status.SecretHash; hash != expected {
+		t.Errorf("expected status.secretHash to be rewritten as '%s', but got '%s'", expected, hash)
+	}
+	if updates := secretUpdates(c); updates != 0 {
+		t.Errorf("expected secret not to be updated when values are unchanged, but got %d updates", updates)
+	}
+
+	poll()
+	if updates := secretUpdates(c); updates != 0 {
+		t.Errorf("expected secret not to be updated after migration, but got %d updates", updates)
+	}
+}
+
+func TestLegacyHashMigratedOnSync(t *testing.T) {
+	akvs, existing := legacySecret("value")
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "value"}}
+	c, _ := outputsController(t, akvs, service, existing)
+
+	if _, _, err := c.getOrCreateKubernetesSecret(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := getHashOfByteValues(map[string][]byte{"password": []byte("value")})
+	if hash := getStatus(t, c, akvs).Status.SecretHash; hash != expected {
+		t.Errorf("expected status.secretHash to be rewritten as '%s', but got '%s'", expected, hash)
+	}
+	if updates := secretUpdates(c); updates != 0 {
+		t.Errorf("expected secret not to be updated when values are unchanged, but got %d updates", updates)
+	}
+}
+
+func TestLegacyHashOfChangedValues(t *testing.T) {
+	akvs, existing := legacySecret("old-value")
+	c, poll := pollController(t, akvs, "new-value", existing)
+
+	poll()
+	if value := getOutputPassword(t, c, akvs); value != "new-value" {
+		t.Errorf("expected secret to be updated with changed value, but got '%s'", value)
+	}
+	expected := getHashOfByteValues(map[string][]byte{"password": []byte("new-value")})
+	if hash := getStatus(t, c, akvs).Status.SecretHash; hash != expected {
+		t.Errorf("expected status.secretHash '%s', but got '%s'", expected, hash)
+	}
+}
+
+func TestMigrateConfigMapHash(t *testing.T) {
+	values := map[string]string{"ca.crt": "value"}
+	akvs := secret()
+	akvs.Status.ConfigMapHash = hashStringValues(md5.New(), values)
+
+	migrated, ok := migrateConfigMapHash(akvs, values)
+	if !ok || migrated.Status.ConfigMapHash != getHashOfStringValues(values) {
+		t.Errorf("expected md5 hash of unchanged values to be migrated, but got '%s'", migrated.Status.ConfigMapHash)
+	}
+	if akvs.Status.ConfigMapHash == migrated.Status.ConfigMapHash {
+		t.Error("expected azurekeyvaultsecret to be left unchanged")
+	}
+
+	if _, ok := migrateConfigMapHash(akvs, map[string]string{"ca.crt": "changed"}); ok {
+		t.Error("expected md5 hash of changed values not to be migrated")
+	}
+	if _, ok := migrateConfigMapHash(migrated, values); ok {
+		t.Error("expected sha-256 hash not to be migrated")
+	}
+}
+
+func TestHashOfMultipleKeysIsStable(t *testing.T) {
+	byteValues := map[string][]byte{}
+	stringValues := map[string]string{}
+	for _, key := range []string{"host", "port", "username", "password", "database"} {
+		byteValues[key] = []byte(key + "-value")
+		stringValues[key] = key + "-value"
+	}
+
+	byteHash := getHashOfByteValues(byteValues)
+	stringHash := getHashOfStringValues(stringValues)
+	for i := 0; i < 500; i++ {
+		if hash := getHashOfByteValues(byteValues); hash != byteHash {
+			t.Fatalf("expected stable hash '%s' of byte values, but got '%s'", byteHash, hash)
+		}
+		if hash := getHashOfStringValues(stringValues); hash != stringHash {
+			t.Fatalf("expected stable hash '%s' of string values, but got '%s'", stringHash, hash)
+		}
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Status.SecretHash = byteHash
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, byteValues)
+	for i := 0; i < 100; i++ {
+		if hasAzureKeyVaultSecretChangedForSecret(akvs, byteValues, existing) {
+			t.Fatal("secret should not need update when multiple keys are unchanged")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// immutableRevisionHashLength is the number of characters of the values hash used in the
+// name of an immutable ConfigMap
+const immutableRevisionHashLength = 10
+
+func isImmutableConfigMap(akvs *akv.AzureKeyVaultSecret) bool {
+	return akvs.Spec.Output.ConfigMap.Immutable
+}
+
+// immutableConfigMapName returns the name of the immutable ConfigMap holding the values with hash
+func immutableConfigMapName(akvs *akv.AzureKeyVaultSecret, hash string) string {
+	if len(hash) > immutableRevisionHashLength {
+		hash = hash[:immutableRevisionHashLength]
+	}
+	return fmt.Sprintf("%s-%s", determineConfigMapName(akvs), hash)
+}
+
+// syncImmutableConfigMap writes the values of akvs to an immutable ConfigMap named after their
+// hash, which is never updated. When the values change a new ConfigMap is created and set in
+// status.configMapName, and the replaced one is deleted once the grace period has passed. With
+// syncPolicy ReportOnly the current ConfigMap is kept unless forceSync is set, and the change
+// is returned as pending. Returns the akvs with the updated status.
+func (c *Controller) syncImmutableConfigMap(akvs *akv.AzureKeyVaultSecret, forceSync bool) (*akv.AzureKeyVaultSecret, *corev1.ConfigMap, *pendingRotation, error) {
+	values, err := c.getConfigMapFromKeyVault(akvs)
+	akvs, err = c.checkKeyCollision(akvs, err)
+	if err != nil {
+		return akvs, nil, nil, fmt.Errorf("failed to get configmap from azure key vault for configmap '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
+	}
+
+	hash := getHashOfStringValues(values)
+	name := immutableConfigMapName(akvs, hash)
+	current := akvs.Status.ConfigMapName
+	akvs, migrated := migrateConfigMapHash(akvs, values)
+	if migrated && current != "" {
+		// keeps the configmap named after the MD5 hash of the same values
+		name = current
+	}
+
+	if current != "" && current != name && isReportOnly(akvs, forceSync) {
+		if cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(current); err == nil {
+			klog.V(4).InfoS("values have changed, not replacing configmap with sync policy ReportOnly", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+			return akvs, cm, &pendingRotation{kind: outputKindConfigMap, name: cm.Name, hash: hash}, nil
+		}
+	}
+
+	cm, err := c.getOrCreateImmutableConfigMap(akvs, name, values)
+	if err != nil {
+		return akvs, nil, nil, err
+	}
+
+	retired := retireConfigMap(akvs.Status.RetiredConfigMaps, current, name, c.clock.Now())
+	if retired, err = c.deleteExpiredConfigMaps(akvs, retired); err != nil {
+		return akvs, nil, nil, err
+	}
+
+	if !migrated && current == name && akvs.Status.ConfigMapHash == hash && equality.Semantic.DeepEqual(akvs.Status.RetiredConfigMaps, retired) {
+		return akvs, cm, nil, nil
+	}
+	if current != name {
+		klog.InfoS("configmap replaced - any resources (like pods) using the previous configmap must be changed to use the new one", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm), "previous", current)
+	}
+
+	updated, err := c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.ConfigMapName = name
+		akvsCopy.Status.ConfigMapHash = hash
+		akvsCopy.Status.ConfigMapKeys = sortStringValueKeys(values)
+		akvsCopy.Status.RetiredConfigMaps = retired
+		akvsCopy.Status.SanitizedKeys = c.loadSanitizedKeys(akvsCopy)
+		c.setServedBy(akvsCopy)
+		c.setVaultObjectVersion(akvsCopy)
+		akvsCopy.Status.LastAzureUpdate = c.clock.Now()
+	})
+	if err != nil {
+		return akvs, nil, nil, fmt.Errorf("failed to update status for azurekeyvaultsecret %s, error: %+v", akvs.Name, err)
+	}
+	return updated, cm, nil, nil
+}
+
+// getOrCreateImmutableConfigMap returns the immutable ConfigMap name, creating it with values
+// if it does not exist. As the name is derived from the values, an existing ConfigMap owned by
+// akvs already has them.
+func (c *Controller) getOrCreateImmutableConfigMap(akvs *akv.AzureKeyVaultSecret, name string, values map[string]string) (*corev1.ConfigMap, error) {
+	cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(name)
+	if err == nil {
+		if !isOwnedBy(cm, akvs) {
+			return nil, fmt.Errorf(MessageResourceExists, name)
+		}
+		return cm, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	immutable := true
+	newCm := c.createNewConfigMap(akvs, values)
+	newCm.Name = name
+	newCm.Immutable = &immutable
+	cm, err = c.writer().CreateConfigMap(context.TODO(), newCm)
+	if errors.IsAlreadyExists(err) {
+		// created by an earlier sync not yet in the informer cache
+		return c.kubeclientset.CoreV1().ConfigMaps(akvs.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create immutable configmap %s, error: %+v", name, err)
+	}
+
+	klog.InfoS("immutable configmap created", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+	c.recorder.Event(cm, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
+	return cm, nil
+}
+
+// retireConfigMap adds the replaced ConfigMap current to retired, unless it is still in use.
+// A retired ConfigMap in use again, as the values changed back, is no longer retired.
+func retireConfigMap(retired []akv.AzureKeyVaultRetiredOutput, current, name string, now metav1.Time) []akv.AzureKeyVaultRetiredOutput {
+	var result []akv.AzureKeyVaultRetiredOutput
+	for _, r := range retired {
+		if r.Name != name && r.Name != current {
+			result = append(result, r)
+		}
+	}
+	for _, r := range retired {
+		if r.Name == current && current != name {
+			// retired before, keep the first time
+			return append(result, r)
+		}
+	}
+	if current != "" && current != name {
+		result = append(result, akv.AzureKeyVaultRetiredOutput{Name: current, RetiredTime: now})
+	}
+	return result
+}
+
+// deleteExpiredConfigMaps deletes the retired ConfigMaps owned by akvs once the grace period has
+// passed, and returns the ConfigMaps still waiting
+func (c *Controller) deleteExpiredConfigMaps(akvs *akv.AzureKeyVaultSecret, retired []akv.AzureKeyVaultRetiredOutput) ([]akv.AzureKeyVaultRetiredOutput, error) {
+	var waiting []akv.AzureKeyVaultRetiredOutput
+	for _, r := range retired {
+		if c.clock.Now().Sub(r.RetiredTime.Time) < c.options.ImmutableRevisionGracePeriod {
+			waiting = append(waiting, r)
+			continue
+		}
+
+		cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(r.Name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isOwnedBy(cm, akvs) {
+			continue
+		}
+		if err = c.writer().DeleteConfigMap(context.TODO(), akvs.Namespace, r.Name); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to delete retired configmap %s, error: %+v", r.Name, err)
+		}
+		klog.InfoS("retired configmap deleted", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm))
+	}
+	return waiting, nil
+}
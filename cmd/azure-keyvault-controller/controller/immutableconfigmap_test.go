@@ -0,0 +1,188 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+type immutableTest struct {
+	c          *Controller
+	kubeclient *k8sfake.Clientset
+	indexer    cache.Indexer
+	service    *countingVaultService
+	clock      *fakeClock
+	akvs       *akv.AzureKeyVaultSecret
+}
+
+func newImmutableTest(t *testing.T) *immutableTest {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "ca-bundle", DataKey: "ca.crt", Immutable: true}
+
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "first"}}
+	c, kubeclient := outputsController(t, akvs, service)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c.configMapsLister = corelisters.NewConfigMapLister(indexer)
+	clock := &fakeClock{now: time.Now()}
+	c.clock = clock
+	c.options.ImmutableRevisionGracePeriod = time.Hour
+
+	return &immutableTest{c: c, kubeclient: kubeclient, indexer: indexer, service: service, clock: clock, akvs: akvs}
+}
+
+// sync syncs the ConfigMap and refreshes the lister from the fake client
+func (test *immutableTest) sync(t *testing.T) *akv.AzureKeyVaultSecret {
+	t.Helper()
+	akvs, _, _, err := test.c.syncImmutableConfigMap(getStatus(t, test.c, test.akvs), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cms, err := test.kubeclient.CoreV1().ConfigMaps(test.akvs.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []interface{}
+	for i := range cms.Items {
+		items = append(items, &cms.Items[i])
+	}
+	if err := test.indexer.Replace(items, ""); err != nil {
+		t.Fatal(err)
+	}
+	return akvs
+}
+
+func (test *immutableTest) configMapNames(t *testing.T) []string {
+	cms, err := test.kubeclient.CoreV1().ConfigMaps(test.akvs.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cm := range cms.Items {
+		names = append(names, cm.Name)
+	}
+	return names
+}
+
+func countVerb(kubeclient *k8sfake.Clientset, verb, resource string) int {
+	count := 0
+	for _, action := range kubeclient.Actions() {
+		if action.GetVerb() == verb && action.GetResource().Resource == resource {
+			count++
+		}
+	}
+	return count
+}
+
+func TestImmutableConfigMapIsCreatedWithRevisionName(t *testing.T) {
+	test := newImmutableTest(t)
+	akvs := test.sync(t)
+
+	expected := immutableConfigMapName(test.akvs, getHashOfStringValues(map[string]string{"ca.crt": "first"}))
+	if akvs.Status.ConfigMapName != expected {
+		t.Fatalf("expected status.configMapName '%s', but got '%s'", expected, akvs.Status.ConfigMapName)
+	}
+
+	cm, err := test.kubeclient.CoreV1().ConfigMaps(akvs.Namespace).Get(context.TODO(), expected, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Immutable == nil || !*cm.Immutable {
+		t.Error("expected configmap to be immutable")
+	}
+	if cm.Data["ca.crt"] != "first" {
+		t.Errorf("expected configmap value 'first', but got %v", cm.Data)
+	}
+
+	// unchanged values neither create nor update anything
+	test.sync(t)
+	if countVerb(test.kubeclient, "create", "configmaps") != 1 || countVerb(test.kubeclient, "update", "configmaps") != 0 {
+		t.Errorf("expected one configmap create and no updates, but got actions %v", test.kubeclient.Actions())
+	}
+}
+
+func TestImmutableConfigMapIsReplacedAndRetired(t *testing.T) {
+	test := newImmutableTest(t)
+	first := test.sync(t).Status.ConfigMapName
+
+	test.service.fakeSecretValue = "second"
+	akvs := test.sync(t)
+	second := akvs.Status.ConfigMapName
+	if second == first {
+		t.Fatal("expected a new configmap when the values change")
+	}
+	if countVerb(test.kubeclient, "update", "configmaps") != 0 {
+		t.Error("immutable configmaps should never be updated")
+	}
+	if len(akvs.Status.RetiredConfigMaps) != 1 || akvs.Status.RetiredConfigMaps[0].Name != first {
+		t.Fatalf("expected '%s' to be retired, but got %v", first, akvs.Status.RetiredConfigMaps)
+	}
+
+	// kept during the grace period
+	test.clock.now = test.clock.now.Add(30 * time.Minute)
+	test.sync(t)
+	if names := test.configMapNames(t); len(names) != 2 {
+		t.Errorf("expected both configmaps during the grace period, but got %v", names)
+	}
+
+	test.clock.now = test.clock.now.Add(time.Hour)
+	akvs = test.sync(t)
+	if names := test.configMapNames(t); len(names) != 1 || names[0] != second {
+		t.Errorf("expected only '%s' after the grace period, but got %v", second, names)
+	}
+	if len(akvs.Status.RetiredConfigMaps) != 0 {
+		t.Errorf("expected no retired configmaps, but got %v", akvs.Status.RetiredConfigMaps)
+	}
+}
+
+func TestImmutableConfigMapRevertedValuesAreNoLongerRetired(t *testing.T) {
+	test := newImmutableTest(t)
+	first := test.sync(t).Status.ConfigMapName
+
+	test.service.fakeSecretValue = "second"
+	test.sync(t)
+	test.service.fakeSecretValue = "first"
+	akvs := test.sync(t)
+
+	if akvs.Status.ConfigMapName != first {
+		t.Errorf("expected '%s' to be used again, but got '%s'", first, akvs.Status.ConfigMapName)
+	}
+	if len(akvs.Status.RetiredConfigMaps) != 1 || akvs.Status.RetiredConfigMaps[0].Name == first {
+		t.Errorf("expected only the second configmap to be retired, but got %v", akvs.Status.RetiredConfigMaps)
+	}
+}
+
+func TestRetireConfigMapKeepsFirstRetiredTime(t *testing.T) {
+	before := metav1.NewTime(time.Now().Add(-time.Minute))
+	now := metav1.Now()
+	retired := []akv.AzureKeyVaultRetiredOutput{{Name: "cm-b", RetiredTime: before}}
+
+	result := retireConfigMap(retired, "cm-b", "cm-c", now)
+	if len(result) != 1 || !result[0].RetiredTime.Equal(&before) {
+		t.Errorf("expected 'cm-b' to keep its retired time, but got %v", result)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxKeyDiffLength is the max length of the key names listed as added, modified or
+// removed, keeping events and status small when many keys change
+const maxKeyDiffLength = 256
+
+// keyDiff has the names of the data keys changed when an output is rotated, never the values
+type keyDiff struct {
+	added    []string
+	modified []string
+	removed  []string
+}
+
+// diffSecretKeys compares the data keys managed in old, named in managed, to the keys in
+// values. Without managed keys, like when synced by an older controller, keys in old not
+// in values are not taken as removed, as they may not have been written by the controller.
+func diffSecretKeys(managed []string, old, values map[string][]byte) keyDiff {
+	var diff keyDiff
+	for key, value := range values {
+		existing, ok := old[key]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, key)
+		case !bytes.Equal(existing, value):
+			diff.modified = append(diff.modified, key)
+		}
+	}
+	for _, key := range managed {
+		if _, ok := values[key]; !ok {
+			if _, ok := old[key]; ok {
+				diff.removed = append(diff.removed, key)
+			}
+		}
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.modified)
+	sort.Strings(diff.removed)
+	return diff
+}
+
+// diffConfigMapKeys compares the keys managed in old to the keys in values, like
+// diffSecretKeys for the values of a ConfigMap
+func diffConfigMapKeys(managed []string, old, values map[string]string) keyDiff {
+	oldBytes := make(map[string][]byte, len(old))
+	for key, value := range old {
+		oldBytes[key] = []byte(value)
+	}
+	valueBytes := make(map[string][]byte, len(values))
+	for key, value := range values {
+		valueBytes[key] = []byte(value)
+	}
+	return diffSecretKeys(managed, oldBytes, valueBytes)
+}
+
+func (d keyDiff) isEmpty() bool {
+	return len(d.added) == 0 && len(d.modified) == 0 && len(d.removed) == 0
+}
+
+// String returns a summary of the diff, like "added: a; modified: b,c"
+func (d keyDiff) String() string {
+	var parts []string
+	for _, part := range []struct {
+		name string
+		keys []string
+	}{
+		{"added", d.added},
+		{"modified", d.modified},
+		{"removed", d.removed},
+	} {
+		if len(part.keys) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", part.name, joinNames(part.keys, maxKeyDiffLength)))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,146 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDiffSecretKeys(t *testing.T) {
+	old := map[string][]byte{"same": []byte("1"), "changed": []byte("2"), "gone": []byte("3"), "unmanaged": []byte("4")}
+	values := map[string][]byte{"same": []byte("1"), "changed": []byte("two"), "new": []byte("5"), "unmanaged": []byte("4")}
+
+	diff := diffSecretKeys([]string{"same", "changed", "gone"}, old, values)
+	expected := keyDiff{added: []string{"new"}, modified: []string{"changed"}, removed: []string{"gone"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, diff)
+	}
+	if diff.String() != "added: new; modified: changed; removed: gone" {
+		t.Errorf("unexpected summary '%s'", diff)
+	}
+
+	// without managed keys nothing is taken as removed
+	diff = diffSecretKeys(nil, old, values)
+	if len(diff.removed) != 0 {
+		t.Errorf("expected no removed keys without managed keys, but got %v", diff.removed)
+	}
+
+	if diff := diffSecretKeys([]string{"same"}, old, map[string][]byte{"same": []byte("1")}); !diff.isEmpty() || diff.String() != "" {
+		t.Errorf("expected empty diff, but got '%s'", diff)
+	}
+}
+
+func TestKeyDiffStringIsCapped(t *testing.T) {
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("some-long-key-name-%d", i))
+	}
+	summary := keyDiff{modified: keys}.String()
+	if len(summary) > maxKeyDiffLength+len("modified: ") {
+		t.Errorf("expected summary to be capped, but got %d bytes", len(summary))
+	}
+	if !strings.HasSuffix(summary, " more") {
+		t.Errorf("expected summary to count keys left out, but got '%s'", summary)
+	}
+}
+
+func TestSyncOutputsReportsChangedKeys(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.Outputs = akvs.Spec.Outputs[:1]
+	akvs.Status.Outputs = []akv.AzureKeyVaultOutputStatus{
+		{Kind: outputKindSecret, Name: "first", Hash: "old-hash", Keys: []string{"password"}},
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "new-value"}}
+	existing := (&Controller{options: &Options{}}).createNewSecret(outputView(akvs, akvs.Spec.Outputs[0]), map[string][]byte{"password": []byte("old-value")})
+	c, _ := outputsController(t, akvs, service, existing)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	if err := c.syncOutputs(akvs, true); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, SecretRotated) || !strings.Contains(event, "modified: password") || strings.Contains(event, "new-value") {
+			t.Errorf("expected rotated event naming the modified key only, but got '%s'", event)
+		}
+	default:
+		t.Error("expected a rotated event")
+	}
+
+	updated := getStatus(t, c, akvs)
+	if status := findOutputStatus(updated.Status.Outputs, outputKindSecret, "first"); status == nil || status.LastRotationChanges != "modified: password" {
+		t.Errorf("expected changed keys in output status, but got %v", status)
+	}
+}
+
+func TestPollReportsChangedConfigMapKeys(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.ConfigMap.Name = "my-configmap"
+	akvs.Spec.Output.ConfigMap.DataKey = "password"
+	oldValues := map[string]string{"password": "old-value"}
+	akvs.Status.ConfigMapName = "my-configmap"
+	akvs.Status.ConfigMapHash = getHashOfStringValues(oldValues)
+	akvs.Status.ConfigMapKeys = sortStringValueKeys(oldValues)
+
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "old-value"}}
+	c, kubeclient := outputsController(t, akvs, service)
+	if _, err := kubeclient.CoreV1().ConfigMaps(akvs.Namespace).Create(context.TODO(), c.createNewConfigMap(akvs, oldValues), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c.azureKeyVaultSecretLister = listers.NewAzureKeyVaultSecretLister(indexer)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	poll := func() {
+		t.Helper()
+		if err := indexer.Add(getStatus(t, c, akvs)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.syncAzureKeyVault(akvs.Namespace + "/" + akvs.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	poll()
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event for unchanged values, but got %d", len(recorder.Events))
+	}
+
+	service.fakeSecretValue = "new-value"
+	poll()
+	event := expectEvent(t, recorder, SecretRotated)
+	if !strings.Contains(event, "modified: password") || strings.Contains(event, "new-value") {
+		t.Errorf("expected rotated event naming the modified key only, but got '%s'", event)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected only the rotated event, but got %d more", len(recorder.Events))
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReasonKeyFilterUnmatched is the reason of events telling that a pattern in includeKeys or
+// excludeKeys matches no key of a multi-key-value secret
+const ReasonKeyFilterUnmatched = "KeyFilterUnmatched"
+
+// filterKeys returns the values with a key matching one of the glob patterns in include, all
+// if include is empty, and not matching any pattern in exclude. Patterns matching no key are
+// returned as unmatched, as a misspelled pattern would otherwise silently leave out keys.
+func filterKeys(values map[string]string, include, exclude []string) (map[string]string, []string) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return values, nil
+	}
+
+	matched := make(map[string]bool)
+	matchesAny := func(key string, patterns []string, field string) bool {
+		found := false
+		for _, pattern := range patterns {
+			// patterns are validated at admission, a malformed pattern matches nothing
+			if ok, _ := path.Match(pattern, key); ok {
+				matched[field+"/"+pattern] = true
+				found = true
+			}
+		}
+		return found
+	}
+
+	filtered := make(map[string]string, len(values))
+	for key, value := range values {
+		// match every pattern against every key, to tell which patterns match nothing
+		included := matchesAny(key, include, "includeKeys") || len(include) == 0
+		excluded := matchesAny(key, exclude, "excludeKeys")
+		if included && !excluded {
+			filtered[key] = value
+		}
+	}
+
+	var unmatched []string
+	for field, patterns := range map[string][]string{"includeKeys": include, "excludeKeys": exclude} {
+		for _, pattern := range patterns {
+			if !matched[field+"/"+pattern] {
+				unmatched = append(unmatched, fmt.Sprintf("'%s' in %s", pattern, field))
+			}
+		}
+	}
+	sort.Strings(unmatched)
+	return filtered, unmatched
+}
+
+// reportUnmatchedKeyFilters emits a warning naming the patterns in includeKeys and excludeKeys
+// of the output of kind that matched no key when handler read the multi-key-value secret of akvs
+func (c *Controller) reportUnmatchedKeyFilters(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler, kind, name string) {
+	h, ok := handler.(*azureMultiValueSecretHandler)
+	if !ok || len(h.unmatchedKeyFilters) == 0 {
+		return
+	}
+	c.recorder.Eventf(akvs, corev1.EventTypeWarning, ReasonKeyFilterUnmatched,
+		"Key filter %s of %s '%s' matches no key of multi-key-value secret '%s' in Azure Key Vault '%s'",
+		strings.Join(h.unmatchedKeyFilters, ", "), kind, name, akvs.Spec.Vault.Object.Name, akvs.Spec.Vault.Identifier())
+}
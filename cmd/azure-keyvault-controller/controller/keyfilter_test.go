@@ -0,0 +1,90 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFilterKeys(t *testing.T) {
+	values := map[string]string{"DB_HOST": "db.local", "DB_PASSWORD": "s3cret", "API_KEY": "key", "LOG_LEVEL": "debug"}
+
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		expected  []string
+		unmatched []string
+	}{
+		{name: "no filters", expected: []string{"API_KEY", "DB_HOST", "DB_PASSWORD", "LOG_LEVEL"}},
+		{name: "include glob", include: []string{"DB_*"}, expected: []string{"DB_HOST", "DB_PASSWORD"}},
+		{name: "exclude glob", exclude: []string{"*_PASSWORD", "API_?EY"}, expected: []string{"DB_HOST", "LOG_LEVEL"}},
+		{name: "include and exclude", include: []string{"DB_*", "LOG_LEVEL"}, exclude: []string{"DB_PASSWORD"}, expected: []string{"DB_HOST", "LOG_LEVEL"}},
+		{
+			name:      "unmatched patterns",
+			include:   []string{"DB_*", "REDIS_*"},
+			exclude:   []string{"*_SECRET"},
+			expected:  []string{"DB_HOST", "DB_PASSWORD"},
+			unmatched: []string{"'*_SECRET' in excludeKeys", "'REDIS_*' in includeKeys"},
+		},
+		{
+			name:      "include matching nothing",
+			include:   []string{"db_*"},
+			expected:  []string{},
+			unmatched: []string{"'db_*' in includeKeys"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, unmatched := filterKeys(values, tt.include, tt.exclude)
+			if keys := sortStringValueKeys(filtered); strings.Join(keys, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected keys %v, but got %v", tt.expected, keys)
+			}
+			if !reflect.DeepEqual(unmatched, tt.unmatched) {
+				t.Errorf("expected unmatched %v, but got %v", tt.unmatched, unmatched)
+			}
+		})
+	}
+}
+
+func TestMultiValueSecretKeyFilterWarnsWhenUnmatched(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+	akvs.Spec.Vault.Object.ContentType = akv.AzureKeyVaultObjectContentTypeJSON
+	akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", ExcludeKeys: []string{"DB_*"}, IncludeKeys: []string{"LOG_*", "REDIS_*"}}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: `{"DB_PASSWORD":"s3cret","LOG_LEVEL":"debug"}`}}
+	c, _ := outputsController(t, akvs, service)
+
+	values, err := c.getConfigMapFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["LOG_LEVEL"] != "debug" {
+		t.Errorf("expected only LOG_LEVEL, but got %v", values)
+	}
+
+	event := expectEvent(t, c.recorder.(*record.FakeRecorder), ReasonKeyFilterUnmatched)
+	if !strings.Contains(event, "Key filter 'REDIS_*' in includeKeys of ConfigMap 'settings'") {
+		t.Errorf("expected event naming the unmatched patterns, but got '%s'", event)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+)
+
+// ReasonCertificateNotExportable is the reason of events telling that a certificate output
+// needs the private key of a certificate not allowing it to be exported
+const ReasonCertificateNotExportable = "CertificateNotExportable"
+
+// keyMismatchError tells that the private key does not belong to the certificate it is
+// written with, identified by the sha256 fingerprints of their public keys
+type keyMismatchError struct {
+	certificateFingerprint string
+	keyFingerprint         string
+}
+
+func (e *keyMismatchError) Error() string {
+	return fmt.Sprintf("private key does not match certificate - certificate public key %s, private key public key %s", e.certificateFingerprint, e.keyFingerprint)
+}
+
+// isKeyMismatch tells if err is caused by a private key not matching its certificate
+func isKeyMismatch(err error) bool {
+	var mismatch *keyMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// isCertificateNotExportable tells if err is caused by requesting the private key of a
+// certificate whose key policy in Azure Key Vault does not allow exporting it
+func isCertificateNotExportable(err error) bool {
+	return errors.Is(err, vault.ErrCertificateNotExportable)
+}
+
+// verifyKeyMatchesCertificate checks that the private key of cert belongs to its leaf
+// certificate, which is the first certificate in the chain not being a ca. Certificates
+// without a private key have nothing to verify.
+func verifyKeyMatchesCertificate(cert *vault.Certificate) error {
+	if !cert.HasPrivateKey || len(cert.Certificates) == 0 {
+		return nil
+	}
+
+	var public crypto.PublicKey
+	switch {
+	case cert.PrivateKeyRsa != nil:
+		public = &cert.PrivateKeyRsa.PublicKey
+	case cert.PrivateKeyEcdsa != nil:
+		public = &cert.PrivateKeyEcdsa.PublicKey
+	default:
+		return nil
+	}
+
+	leaf := cert.Certificates[0]
+	for _, c := range cert.Certificates {
+		if !c.IsCA {
+			leaf = c
+			break
+		}
+	}
+
+	if key, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && key.Equal(public) {
+		return nil
+	}
+	return &keyMismatchError{
+		certificateFingerprint: publicKeyFingerprint(leaf.PublicKey),
+		keyFingerprint:         publicKeyFingerprint(public),
+	}
+}
+
+// publicKeyFingerprint returns the sha256 hash of the der encoded public key
+func publicKeyFingerprint(key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
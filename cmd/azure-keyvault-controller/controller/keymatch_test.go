@@ -0,0 +1,124 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// mismatchedCertificatePem returns a certificate chain along with a private key not belonging to it
+func mismatchedCertificatePem(t *testing.T) string {
+	chain, _ := fakeCertificateChain(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})) + chain
+}
+
+func TestVerifyKeyMatchesCertificate(t *testing.T) {
+	cert, err := vault.NewCertificateFromPem(pemCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyKeyMatchesCertificate(cert); err != nil {
+		t.Errorf("expected key to match certificate, but got %v", err)
+	}
+
+	cert, err = vault.NewCertificateFromPem(mismatchedCertificatePem(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyKeyMatchesCertificate(cert)
+	if !isKeyMismatch(err) {
+		t.Fatalf("expected key mismatch, but got %v", err)
+	}
+	if strings.Count(err.Error(), "SHA256:") != 2 {
+		t.Errorf("expected both fingerprints in error, but got '%s'", err.Error())
+	}
+}
+
+func TestHandleCertificateAsTLSWithMismatchedKey(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: mismatchedCertificatePem(t),
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeCertificate
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	if _, err := handler.HandleSecret(); !isKeyMismatch(err) {
+		t.Errorf("expected key mismatch, but got %v", err)
+	}
+
+	secret.Spec.Output.Secret.SkipKeyMatchCheck = true
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatalf("expected key match check to be skipped, but got %v", err)
+	}
+	if len(values[corev1.TLSPrivateKeyKey]) == 0 {
+		t.Error("expected private key to be written")
+	}
+}
+
+func TestKeyMismatchCondition(t *testing.T) {
+	akvs := secret()
+	client := akvfake.NewSimpleClientset(akvs)
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{akvsClient: client, recorder: recorder, options: &Options{}}
+
+	mismatch := &keyMismatchError{certificateFingerprint: "SHA256:aa", keyFingerprint: "SHA256:bb"}
+	updated, err := c.checkKeyMismatch(akvs, mismatch)
+	if err != mismatch {
+		t.Errorf("expected key mismatch error to be returned, but got %v", err)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeKeyMismatch)
+	if condition == nil || condition.Status != metav1.ConditionTrue || !strings.Contains(condition.Message, "SHA256:bb") {
+		t.Fatalf("expected KeyMismatch condition with fingerprints, but got %v", condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event, but got %d", len(recorder.Events))
+	}
+
+	updated, err = c.checkKeyMismatch(updated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition = meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeKeyMismatch)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Errorf("expected KeyMismatch condition to be cleared, but got %v", condition)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/keystore"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+// keystorePasswordSecretIndex indexes azurekeyvaultsecrets by the namespace/name of the secrets
+// referenced in keystore.passwordSecretRef of spec.output.secret and spec.outputs
+const keystorePasswordSecretIndex = "keystorePasswordSecret"
+
+// default keys of keystores in the Secret by format
+var keystoreDataKeys = map[akv.AzureKeyVaultKeystoreFormat]string{
+	akv.AzureKeyVaultKeystoreFormatPkcs12: "keystore.p12",
+	akv.AzureKeyVaultKeystoreFormatJKS:    "keystore.jks",
+}
+
+func (c *Controller) initKeystorePasswords() {
+	err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddIndexers(cache.Indexers{
+		keystorePasswordSecretIndex: keystorePasswordSecretIndexFunc,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add indexer", "index", keystorePasswordSecretIndex)
+	}
+
+	_, err = c.kubeInformerFactory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForKeystorePassword(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldSecret, ok := old.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			newSecret, ok := new.(*corev1.Secret)
+			if !ok || newSecret.ResourceVersion == oldSecret.ResourceVersion {
+				return
+			}
+			c.enqueueAzureKeyVaultSecretsForKeystorePassword(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForKeystorePassword(obj)
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add event handler")
+	}
+}
+
+func keystorePasswordSecretIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	outputs := append([]akv.AzureKeyVaultOutput{akvs.Spec.Output}, akvs.Spec.Outputs...)
+	seen := make(map[string]bool)
+	var keys []string
+	for _, output := range outputs {
+		ks := output.Secret.Keystore
+		if ks == nil || ks.PasswordSecretRef == nil || ks.PasswordSecretRef.Name == "" {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", akvs.Namespace, ks.PasswordSecretRef.Name)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// enqueueAzureKeyVaultSecretsForKeystorePassword adds all azurekeyvaultsecrets reading
+// a keystore password from the secret to the queue
+func (c *Controller) enqueueAzureKeyVaultSecretsForKeystorePassword(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	indexer := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().GetIndexer()
+	referencing, err := indexer.ByIndex(keystorePasswordSecretIndex, key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, akvs := range referencing {
+		klog.V(4).InfoS("secret with keystore password changed - adding to queue", "secret", key, "azurekeyvaultsecret", klog.KObj(akvs.(*akv.AzureKeyVaultSecret)))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// keystorePassword reads the password of the keystore in spec.output.secret of akvs from the
+// secret referenced by its passwordSecretRef, returning an empty password if no keystore is set
+func (c *Controller) keystorePassword(akvs *akv.AzureKeyVaultSecret) (string, error) {
+	ks := akvs.Spec.Output.Secret.Keystore
+	if ks == nil {
+		return "", nil
+	}
+	ref := ks.PasswordSecretRef
+	if ref == nil || ref.Name == "" || ref.Key == "" {
+		return "", fmt.Errorf("spec.output.secret.keystore.passwordSecretRef must have both name and key")
+	}
+
+	secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(ref.Name)
+	if errors.IsNotFound(err) {
+		return "", fmt.Errorf("secret '%s' holding keystore password not found", ref.Name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret '%s' holding keystore password, error: %+v", ref.Name, err)
+	}
+	password, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("key '%s' holding keystore password not found in secret '%s'", ref.Key, ref.Name)
+	}
+	if len(password) == 0 {
+		return "", fmt.Errorf("key '%s' holding keystore password in secret '%s' is empty", ref.Key, ref.Name)
+	}
+	return string(password), nil
+}
+
+// writeKeystore adds cert with its private key and chain to values as a keystore in the
+// format of spec, protected by password. Java expects the leaf first in the chain, so the
+// certificates of cert are reordered.
+func writeKeystore(cert *vault.Certificate, spec *akv.AzureKeyVaultOutputKeystore, alias, password string, values map[string][]byte) error {
+	if !cert.HasPrivateKey {
+		return fmt.Errorf("certificate has no private key to write to keystore")
+	}
+	cert.LeafFirst()
+
+	var privateKey interface{}
+	switch cert.PrivateKeyType {
+	case vault.CertificateKeyTypeRsa:
+		privateKey = cert.PrivateKeyRsa
+	case vault.CertificateKeyTypeEcdsa:
+		privateKey = cert.PrivateKeyEcdsa
+	default:
+		return fmt.Errorf("private key type '%s' currently not supported in keystores", cert.PrivateKeyType)
+	}
+	entry := keystore.Entry{Alias: alias, PrivateKey: privateKey, Certificates: cert.Certificates}
+
+	var data []byte
+	var err error
+	switch spec.Format {
+	case akv.AzureKeyVaultKeystoreFormatPkcs12:
+		data, err = keystore.EncodePkcs12(entry, password)
+	case akv.AzureKeyVaultKeystoreFormatJKS:
+		data, err = keystore.EncodeJKS(entry, password)
+	default:
+		return fmt.Errorf("keystore format '%s' not supported", spec.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s keystore, error: %+v", spec.Format, err)
+	}
+
+	dataKey := spec.DataKey
+	if dataKey == "" {
+		dataKey = keystoreDataKeys[spec.Format]
+	}
+	if _, ok := values[dataKey]; ok {
+		return &keyCollisionError{key: dataKey, source: "the certificate", source2: "the keystore"}
+	}
+	values[dataKey] = data
+	return nil
+}
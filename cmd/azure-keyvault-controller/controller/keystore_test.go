@@ -0,0 +1,177 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"golang.org/x/crypto/pkcs12"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func keystoreSecret(format akv.AzureKeyVaultKeystoreFormat) *akv.AzureKeyVaultSecret {
+	akvs := tlsSecret()
+	akvs.Spec.Output.Secret.Keystore = &akv.AzureKeyVaultOutputKeystore{
+		Format: format,
+		PasswordSecretRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "keystore-password"},
+			Key:                  "password",
+		},
+	}
+	return akvs
+}
+
+func keystorePasswordSecret(password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "keystore-password", Namespace: metav1.NamespaceDefault},
+		Data:       map[string][]byte{"password": []byte(password)},
+	}
+}
+
+func TestHandleCertificateWithPkcs12Keystore(t *testing.T) {
+	akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatPkcs12)
+	handler := NewAzureCertificateHandler(akvs, &fakeVaultService{fakeCertValue: pemTLSChainScrambled})
+	handler.keystorePassword = "s3cret"
+
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values[corev1.TLSCertKey]; !ok {
+		t.Errorf("expected %s to be written along with the keystore", corev1.TLSCertKey)
+	}
+
+	blocks, err := pkcs12.ToPEM(values["keystore.p12"], "s3cret")
+	if err != nil {
+		t.Fatalf("expected keystore.p12 to be read with the password, but got %v", err)
+	}
+	var certs []string
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, string(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})))
+		}
+	}
+	if !reflect.DeepEqual(certs, []string{pemTLSLeaf, pemTLSIntermediate, pemTLSRoot}) {
+		t.Errorf("expected the leaf, intermediate and root in order, but got %v", certs)
+	}
+	if len(blocks) != 4 || !strings.Contains(blocks[3].Type, "PRIVATE KEY") {
+		t.Errorf("expected the private key in the keystore, but got %d blocks", len(blocks))
+	}
+}
+
+func TestHandleCertificateWithJKSKeystore(t *testing.T) {
+	akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatJKS)
+	akvs.Spec.Output.Secret.Type = corev1.SecretTypeOpaque
+	akvs.Spec.Output.Secret.DataKey = "cert.pem"
+	akvs.Spec.Output.Secret.Keystore.DataKey = "truststore.jks"
+	handler := NewAzureCertificateHandler(akvs, &fakeVaultService{fakeCertValue: pemTLSChainCAFirst})
+	handler.keystorePassword = "s3cret"
+
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jks := values["truststore.jks"]; len(jks) < 4 || string(jks[:4]) != "\xfe\xed\xfe\xed" {
+		t.Errorf("expected a JKS keystore in truststore.jks, but got %v", values)
+	}
+	if _, ok := values["keystore.jks"]; ok {
+		t.Error("expected the keystore only under its own data key")
+	}
+}
+
+func TestKeystoreRequiresPrivateKey(t *testing.T) {
+	akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatPkcs12)
+	akvs.Spec.Output.Secret.Type = corev1.SecretTypeDockercfg
+	akvs.Spec.Output.Secret.DataKey = "cert"
+
+	_, err := NewAzureCertificateHandler(akvs, &fakeVaultService{fakeCertValue: pemTLSChainCAFirst}).HandleSecret()
+	if err == nil || !strings.Contains(err.Error(), "keystore is only supported for secret types") {
+		t.Errorf("expected error telling keystores need the private key, but got %v", err)
+	}
+}
+
+func TestKeystoreChangesWithPassword(t *testing.T) {
+	hashFor := func(password string) string {
+		akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatPkcs12)
+		c, _ := outputsController(t, akvs, &countingVaultService{fakeVaultService: fakeVaultService{fakeCertValue: pemTLSChainCAFirst}}, keystorePasswordSecret(password))
+		values, err := c.getSecretFromKeyVault(akvs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return getHashOfByteValues(values)
+	}
+
+	first := hashFor("s3cret")
+	if again := hashFor("s3cret"); again != first {
+		t.Error("expected the same keystore when the certificate and password are unchanged")
+	}
+	if changed := hashFor("n3w-s3cret"); changed == first {
+		t.Error("expected a new keystore when the password changes")
+	}
+}
+
+func TestKeystorePasswordErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		err    string
+	}{
+		{name: "missing secret", err: "secret 'keystore-password' holding keystore password not found"},
+		{name: "missing key", secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "keystore-password", Namespace: metav1.NamespaceDefault}}, err: "key 'password' holding keystore password not found"},
+		{name: "empty password", secret: keystorePasswordSecret(""), err: "is empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatPkcs12)
+			var objects []*corev1.Secret
+			if tt.secret != nil {
+				objects = append(objects, tt.secret)
+			}
+			c, _ := outputsController(t, akvs, &countingVaultService{fakeVaultService: fakeVaultService{fakeCertValue: pemTLSChainCAFirst}}, objects...)
+
+			if _, err := c.getSecretFromKeyVault(akvs); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing '%s', but got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestKeystorePasswordSecretIndexFunc(t *testing.T) {
+	akvs := keystoreSecret(akv.AzureKeyVaultKeystoreFormatPkcs12)
+	other := akvs.Spec.Output.Secret.Keystore.DeepCopy()
+	other.PasswordSecretRef.Name = "other-password"
+	akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "first", Keystore: akvs.Spec.Output.Secret.Keystore}},
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "second", Keystore: other}},
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "third"}},
+	}
+
+	keys, err := keystorePasswordSecretIndexFunc(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"default/keystore-password", "default/other-password"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, but got %v", expected, keys)
+	}
+}
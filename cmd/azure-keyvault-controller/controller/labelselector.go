@@ -0,0 +1,27 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// isSelected tells if akvs is handled by this controller, according to AkvsLabelSelector
+func (c *Controller) isSelected(akvs *akv.AzureKeyVaultSecret) bool {
+	return c.options.AkvsLabelSelector == nil || c.options.AkvsLabelSelector.Matches(labels.Set(akvs.Labels))
+}
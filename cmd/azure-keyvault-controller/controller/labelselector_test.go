@@ -0,0 +1,73 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestIsSelected(t *testing.T) {
+	akvs := secret()
+	c := &Controller{options: &Options{}}
+	if !c.isSelected(akvs) {
+		t.Error("expected all azurekeyvaultsecrets to be selected without a label selector")
+	}
+
+	c.options.AkvsLabelSelector = labels.SelectorFromSet(labels.Set{"tier": "platform"})
+	if c.isSelected(akvs) {
+		t.Error("expected azurekeyvaultsecret without label not to be selected")
+	}
+	akvs.Labels = map[string]string{"tier": "platform"}
+	if !c.isSelected(akvs) {
+		t.Error("expected azurekeyvaultsecret with label to be selected")
+	}
+}
+
+func TestSyncSkipsAzureKeyVaultSecretNotSelected(t *testing.T) {
+	akvs := secret()
+	akvs.Labels = map[string]string{"tier": "apps"}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(akvs); err != nil {
+		t.Fatal(err)
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	c := &Controller{
+		akvsClient:                akvfake.NewSimpleClientset(akvs),
+		recorder:                  record.NewFakeRecorder(10),
+		azureKeyVaultSecretLister: listers.NewAzureKeyVaultSecretLister(indexer),
+		vaultService:              service,
+		clock:                     &fakeClock{},
+		options:                   &Options{AkvsLabelSelector: labels.SelectorFromSet(labels.Set{"tier": "platform"})},
+	}
+
+	key := akvs.Namespace + "/" + akvs.Name
+	if err := c.syncAzureKeyVaultSecret(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.syncAzureKeyVault(key); err != nil {
+		t.Fatal(err)
+	}
+	if service.secretReads != 0 {
+		t.Errorf("expected azurekeyvaultsecret not matching label selector to be skipped, but azure was read %d times", service.secretReads)
+	}
+}
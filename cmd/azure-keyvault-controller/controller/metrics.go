@@ -0,0 +1,133 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+
+	// queueDepthInterval is how often the depth of the queues is reported
+	queueDepthInterval = 5 * time.Second
+)
+
+var (
+	syncRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "akv2k8s_sync_runs_total",
+		Help: "The total number of syncs of AzureKeyVaultSecrets, by queue, namespace and result",
+	}, []string{"queue", "namespace", "result"})
+
+	azureCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "akv2k8s_azure_keyvault_request_duration_seconds",
+		Help:    "How long requests to Azure Key Vault take, by operation and result",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"operation", "result"})
+
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "akv2k8s_queue_depth",
+		Help: "The number of keys waiting to be processed, by queue",
+	}, []string{"queue"})
+)
+
+func resultOf(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// countSyncs wraps reconcile so each sync is counted by queue, namespace and result
+func countSyncs(queue string, reconcile func(key string) error) func(key string) error {
+	return func(key string) error {
+		err := reconcile(key)
+		namespace, _, splitErr := cache.SplitMetaNamespaceKey(key)
+		if splitErr != nil {
+			namespace = ""
+		}
+		syncRuns.WithLabelValues(queue, namespace, resultOf(err)).Inc()
+		return err
+	}
+}
+
+// reportQueueDepth sets the depth of the AzureKeyVaultSecret and Azure Key Vault queues
+// until stopCh is closed
+func (c *Controller) reportQueueDepth(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		queueDepth.WithLabelValues("AzureKeyVaultSecrets").Set(float64(c.akvsCrdQueue.GetQueue().Len()))
+		queueDepth.WithLabelValues("AzureKeyVault").Set(float64(c.azureKeyVaultQueue.GetQueue().Len()))
+	}, queueDepthInterval, stopCh)
+}
+
+// instrumentedVaultService records how long each request to Azure Key Vault takes
+type instrumentedVaultService struct {
+	service vault.Service
+}
+
+func newInstrumentedVaultService(service vault.Service) *instrumentedVaultService {
+	return &instrumentedVaultService{service: service}
+}
+
+// observeAzureCall records the duration of a request to Azure Key Vault started at start,
+// to be deferred with a pointer to the named error of the request
+func observeAzureCall(operation string, start time.Time, err *error) {
+	azureCallDuration.WithLabelValues(operation, resultOf(*err)).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedVaultService) GetSecret(secret *akv.AzureKeyVault) (value string, err error) {
+	defer observeAzureCall("GetSecret", time.Now(), &err)
+	return s.service.GetSecret(secret)
+}
+
+func (s *instrumentedVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (value string, metadata *vault.ObjectMetadata, err error) {
+	defer observeAzureCall("GetSecret", time.Now(), &err)
+	return s.service.GetSecretWithMetadata(secret)
+}
+
+func (s *instrumentedVaultService) GetKey(secret *akv.AzureKeyVault) (value string, err error) {
+	defer observeAzureCall("GetKey", time.Now(), &err)
+	return s.service.GetKey(secret)
+}
+
+func (s *instrumentedVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (key *vault.Key, err error) {
+	defer observeAzureCall("GetKeyMaterial", time.Now(), &err)
+	return s.service.GetKeyMaterial(secret)
+}
+
+func (s *instrumentedVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (cert *vault.Certificate, err error) {
+	defer observeAzureCall("GetCertificate", time.Now(), &err)
+	return s.service.GetCertificate(secret, options)
+}
+
+func (s *instrumentedVaultService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (renewal *time.Time, err error) {
+	defer observeAzureCall("GetCertificateRenewalTime", time.Now(), &err)
+	return s.service.GetCertificateRenewalTime(secret)
+}
+
+func (s *instrumentedVaultService) GetObjectVersions(secret *akv.AzureKeyVault) (versions []vault.ObjectVersion, err error) {
+	defer observeAzureCall("GetObjectVersions", time.Now(), &err)
+	return s.service.GetObjectVersions(secret)
+}
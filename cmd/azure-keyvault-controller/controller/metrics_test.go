@@ -0,0 +1,76 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountSyncsByNamespaceAndResult(t *testing.T) {
+	fail := false
+	sync := countSyncs("AzureKeyVault", func(key string) error {
+		if fail {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+
+	succeeded := syncRuns.WithLabelValues("AzureKeyVault", "metrics", resultSuccess)
+	failed := syncRuns.WithLabelValues("AzureKeyVault", "metrics", resultFailure)
+	beforeSucceeded, beforeFailed := testutil.ToFloat64(succeeded), testutil.ToFloat64(failed)
+
+	if err := sync("metrics/akvs"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	fail = true
+	if err := sync("metrics/akvs"); err == nil {
+		t.Fatal("expected error from failed sync to be returned")
+	}
+
+	if got := testutil.ToFloat64(succeeded); got != beforeSucceeded+1 {
+		t.Errorf("expected %v successful syncs, got %v", beforeSucceeded+1, got)
+	}
+	if got := testutil.ToFloat64(failed); got != beforeFailed+1 {
+		t.Errorf("expected %v failed syncs, got %v", beforeFailed+1, got)
+	}
+}
+
+func TestInstrumentedVaultServiceRecordsFailedCalls(t *testing.T) {
+	service := newInstrumentedVaultService(&regionalVaultService{
+		errors: map[string]error{"failing-secret": responseError(500)},
+	})
+
+	value, err := service.GetSecret(&akv.AzureKeyVault{Name: "my-vault", Object: akv.AzureKeyVaultObject{Name: "my-secret"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if value != "value from my-vault" {
+		t.Errorf("expected value to be passed through, got %q", value)
+	}
+
+	before := testutil.CollectAndCount(azureCallDuration)
+	if _, err := service.GetSecret(&akv.AzureKeyVault{Name: "failing-secret"}); err == nil {
+		t.Fatal("expected error to be passed through")
+	}
+	if after := testutil.CollectAndCount(azureCallDuration); after != before+1 {
+		t.Errorf("expected failed call to be recorded in a new series, got %d series, had %d", after, before)
+	}
+}
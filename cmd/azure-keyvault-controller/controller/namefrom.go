@@ -0,0 +1,251 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+const (
+	// nameFromConfigMapIndex indexes azurekeyvaultsecrets by the namespace/name of
+	// the configmap referenced in spec.vault.object.nameFrom
+	nameFromConfigMapIndex = "nameFromConfigMap"
+
+	// nameFromSecretIndex indexes azurekeyvaultsecrets by the namespace/name of
+	// the secret referenced in spec.vault.object.nameFrom
+	nameFromSecretIndex = "nameFromSecret"
+
+	// ReasonNameResolved is used when the object name was resolved
+	ReasonNameResolved = "Resolved"
+
+	// ReasonInvalidNameFrom is used when spec.vault.object.nameFrom is not valid
+	ReasonInvalidNameFrom = "InvalidNameFrom"
+
+	// ReasonSecretNotFound is used when the secret holding the object name does not exist
+	ReasonSecretNotFound = "SecretNotFound"
+
+	// ReasonSecretKeyNotFound is used when the secret holding the object name does not have the key
+	ReasonSecretKeyNotFound = "SecretKeyNotFound"
+
+	// ReasonEmptyName is used when the object name read from spec.vault.object.nameFrom is empty
+	ReasonEmptyName = "EmptyName"
+)
+
+func (c *Controller) initNameFrom() {
+	err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddIndexers(cache.Indexers{
+		nameFromConfigMapIndex: nameFromConfigMapIndexFunc,
+		nameFromSecretIndex:    nameFromSecretIndexFunc,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add indexers", "indexes", []string{nameFromConfigMapIndex, nameFromSecretIndex})
+	}
+
+	for index, informer := range map[string]cache.SharedIndexInformer{
+		nameFromConfigMapIndex: c.kubeInformerFactory.Core().V1().ConfigMaps().Informer(),
+		nameFromSecretIndex:    c.kubeInformerFactory.Core().V1().Secrets().Informer(),
+	} {
+		index := index
+		_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.enqueueAzureKeyVaultSecretsForNameFrom(index, obj)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				oldObj, ok := old.(metav1.Object)
+				if !ok {
+					return
+				}
+				newObj, ok := new.(metav1.Object)
+				if !ok || newObj.GetResourceVersion() == oldObj.GetResourceVersion() {
+					return
+				}
+				c.enqueueAzureKeyVaultSecretsForNameFrom(index, new)
+			},
+			DeleteFunc: func(obj interface{}) {
+				c.enqueueAzureKeyVaultSecretsForNameFrom(index, obj)
+			},
+		})
+		if err != nil {
+			klog.ErrorS(err, "unable to add event handler")
+		}
+	}
+}
+
+func nameFromConfigMapIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	nameFrom := akvs.Spec.Vault.Object.NameFrom
+	if nameFrom == nil || nameFrom.ConfigMapKeyRef == nil || nameFrom.ConfigMapKeyRef.Name == "" {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("%s/%s", akvs.Namespace, nameFrom.ConfigMapKeyRef.Name)}, nil
+}
+
+func nameFromSecretIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	nameFrom := akvs.Spec.Vault.Object.NameFrom
+	if nameFrom == nil || nameFrom.SecretKeyRef == nil || nameFrom.SecretKeyRef.Name == "" {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("%s/%s", akvs.Namespace, nameFrom.SecretKeyRef.Name)}, nil
+}
+
+// enqueueAzureKeyVaultSecretsForNameFrom adds all azurekeyvaultsecrets reading their
+// object name from the configmap or secret in obj to the queue
+func (c *Controller) enqueueAzureKeyVaultSecretsForNameFrom(index string, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	indexer := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().GetIndexer()
+	referencing, err := indexer.ByIndex(index, key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, akvs := range referencing {
+		klog.V(4).InfoS("source of object name changed - adding to queue", "index", index, "key", key, "azurekeyvaultsecret", klog.KObj(akvs.(*akv.AzureKeyVaultSecret)))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// validateNameFrom checks that the object name is given either by spec.vault.object.name
+// or by exactly one source in spec.vault.object.nameFrom
+func validateNameFrom(object akv.AzureKeyVaultObject) error {
+	if object.NameFrom == nil {
+		return nil
+	}
+	if object.Name != "" {
+		return fmt.Errorf("spec.vault.object.name and spec.vault.object.nameFrom cannot both be set")
+	}
+
+	configMapRef, secretRef := object.NameFrom.ConfigMapKeyRef, object.NameFrom.SecretKeyRef
+	switch {
+	case configMapRef != nil && secretRef != nil:
+		return fmt.Errorf("spec.vault.object.nameFrom cannot have both configMapKeyRef and secretKeyRef")
+	case configMapRef != nil && (configMapRef.Name == "" || configMapRef.Key == ""):
+		return fmt.Errorf("spec.vault.object.nameFrom.configMapKeyRef must have both name and key")
+	case secretRef != nil && (secretRef.Name == "" || secretRef.Key == ""):
+		return fmt.Errorf("spec.vault.object.nameFrom.secretKeyRef must have both name and key")
+	case configMapRef == nil && secretRef == nil:
+		return fmt.Errorf("spec.vault.object.nameFrom must have either configMapKeyRef or secretKeyRef")
+	}
+	return nil
+}
+
+// resolveObjectName returns akvs with spec.vault.object.name set to the name read from
+// spec.vault.object.nameFrom, if specified. The NameResolved condition is updated to
+// reflect the outcome, so a missing pointer is reported as such instead of a missing
+// object in Azure Key Vault.
+func (c *Controller) resolveObjectName(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	if akvs.Spec.Vault.Object.NameFrom == nil {
+		return akvs, nil
+	}
+
+	name, reason, err := c.lookupObjectName(akvs)
+	if err != nil {
+		if _, statusErr := c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeNameResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: err.Error(),
+		}); statusErr != nil {
+			klog.ErrorS(statusErr, "failed to update status", "azurekeyvaultsecret", klog.KObj(akvs))
+		}
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrNameFrom, err.Error())
+		return nil, err
+	}
+
+	updated, err := c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeNameResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: fmt.Sprintf("Using object name '%s'", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := updated.DeepCopy()
+	resolved.Spec.Vault.Object.Name = name
+	klog.V(4).InfoS("resolved object name", "azurekeyvaultsecret", klog.KObj(akvs), "name", name)
+	return resolved, nil
+}
+
+// lookupObjectName reads the object name from the configmap or secret referenced by
+// spec.vault.object.nameFrom, returning the condition reason together with the name
+func (c *Controller) lookupObjectName(akvs *akv.AzureKeyVaultSecret) (string, string, error) {
+	if err := validateNameFrom(akvs.Spec.Vault.Object); err != nil {
+		return "", ReasonInvalidNameFrom, err
+	}
+
+	var value, source string
+	if ref := akvs.Spec.Vault.Object.NameFrom.ConfigMapKeyRef; ref != nil {
+		source = fmt.Sprintf("configmap '%s'", ref.Name)
+		cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(ref.Name)
+		if errors.IsNotFound(err) {
+			return "", ReasonConfigMapNotFound, fmt.Errorf("%s holding object name not found", source)
+		}
+		if err != nil {
+			return "", ReasonConfigMapNotFound, fmt.Errorf("failed to get %s holding object name, error: %+v", source, err)
+		}
+		var ok bool
+		if value, ok = cm.Data[ref.Key]; !ok {
+			return "", ReasonConfigMapKeyNotFound, fmt.Errorf("key '%s' holding object name not found in %s", ref.Key, source)
+		}
+	} else {
+		ref := akvs.Spec.Vault.Object.NameFrom.SecretKeyRef
+		source = fmt.Sprintf("secret '%s'", ref.Name)
+		secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(ref.Name)
+		if errors.IsNotFound(err) {
+			return "", ReasonSecretNotFound, fmt.Errorf("%s holding object name not found", source)
+		}
+		if err != nil {
+			return "", ReasonSecretNotFound, fmt.Errorf("failed to get %s holding object name, error: %+v", source, err)
+		}
+		data, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", ReasonSecretKeyNotFound, fmt.Errorf("key '%s' holding object name not found in %s", ref.Key, source)
+		}
+		value = string(data)
+	}
+
+	name := strings.TrimSpace(value)
+	if name == "" {
+		return "", ReasonEmptyName, fmt.Errorf("key holding object name in %s is empty", source)
+	}
+	return name, ReasonNameResolved, nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func controllerWithNameSources(t *testing.T, objs ...interface{}) *Controller {
+	cmIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	secretIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, obj := range objs {
+		indexer := cmIndexer
+		if _, ok := obj.(*corev1.Secret); ok {
+			indexer = secretIndexer
+		}
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Controller{
+		configMapsLister: corelisters.NewConfigMapLister(cmIndexer),
+		secretsLister:    corelisters.NewSecretLister(secretIndexer),
+	}
+}
+
+func secretWithNameFromConfigMap(name, key string) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Name = ""
+	akvs.Spec.Vault.Object.NameFrom = &akv.AzureKeyVaultObjectNameFrom{
+		ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+	return akvs
+}
+
+func secretWithNameFromSecret(name, key string) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Name = ""
+	akvs.Spec.Vault.Object.NameFrom = &akv.AzureKeyVaultObjectNameFrom{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+	return akvs
+}
+
+// namePointers returns a configmap and a secret both named active, pointing to
+// the active object in the key db
+func namePointers() []interface{} {
+	objectMeta := metav1.ObjectMeta{Name: "active", Namespace: metav1.NamespaceDefault}
+	return []interface{}{
+		&corev1.ConfigMap{ObjectMeta: objectMeta, Data: map[string]string{"db": "db-blue\n", "empty": " "}},
+		&corev1.Secret{ObjectMeta: objectMeta, Data: map[string][]byte{"db": []byte("db-green")}},
+	}
+}
+
+func TestLookupObjectName(t *testing.T) {
+	c := controllerWithNameSources(t, namePointers()...)
+
+	tests := []struct {
+		akvs     *akv.AzureKeyVaultSecret
+		expected string
+	}{
+		{secretWithNameFromConfigMap("active", "db"), "db-blue"},
+		{secretWithNameFromSecret("active", "db"), "db-green"},
+	}
+
+	for _, test := range tests {
+		name, reason, err := c.lookupObjectName(test.akvs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.expected {
+			t.Errorf("expected name '%s', but got '%s'", test.expected, name)
+		}
+		if reason != ReasonNameResolved {
+			t.Errorf("expected reason '%s', but got '%s'", ReasonNameResolved, reason)
+		}
+	}
+}
+
+func TestLookupObjectNameFailures(t *testing.T) {
+	c := controllerWithNameSources(t, namePointers()...)
+
+	bothSet := secretWithNameFromConfigMap("active", "db")
+	bothSet.Spec.Vault.Object.Name = "some-secret"
+
+	bothRefs := secretWithNameFromConfigMap("active", "db")
+	bothRefs.Spec.Vault.Object.NameFrom.SecretKeyRef = secretWithNameFromSecret("active", "db").Spec.Vault.Object.NameFrom.SecretKeyRef
+
+	tests := []struct {
+		akvs   *akv.AzureKeyVaultSecret
+		reason string
+	}{
+		{bothSet, ReasonInvalidNameFrom},
+		{bothRefs, ReasonInvalidNameFrom},
+		{secretWithNameFromConfigMap("active", ""), ReasonInvalidNameFrom},
+		{secretWithNameFromConfigMap("missing", "db"), ReasonConfigMapNotFound},
+		{secretWithNameFromConfigMap("active", "missing"), ReasonConfigMapKeyNotFound},
+		{secretWithNameFromConfigMap("active", "empty"), ReasonEmptyName},
+		{secretWithNameFromSecret("missing", "db"), ReasonSecretNotFound},
+		{secretWithNameFromSecret("active", "missing"), ReasonSecretKeyNotFound},
+	}
+
+	for _, test := range tests {
+		_, reason, err := c.lookupObjectName(test.akvs)
+		if err == nil {
+			t.Errorf("expected error with reason '%s'", test.reason)
+			continue
+		}
+		if reason != test.reason {
+			t.Errorf("expected reason '%s', but got '%s'", test.reason, reason)
+		}
+	}
+}
+
+func TestResolveObjectName(t *testing.T) {
+	akvs := secretWithNameFromConfigMap("missing", "db")
+	c := controllerWithNameSources(t, namePointers()...)
+	c.akvsClient = akvfake.NewSimpleClientset(akvs)
+	c.recorder = record.NewFakeRecorder(10)
+
+	if _, err := c.resolveObjectName(akvs); err == nil {
+		t.Fatal("expected error for missing configmap")
+	}
+	updated, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Get(context.TODO(), akvs.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeNameResolved)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != ReasonConfigMapNotFound {
+		t.Errorf("expected NameResolved condition to be false with reason %s, but got %v", ReasonConfigMapNotFound, condition)
+	}
+
+	updated.Spec.Vault.Object.NameFrom.ConfigMapKeyRef.Name = "active"
+	resolved, err := c.resolveObjectName(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Spec.Vault.Object.Name != "db-blue" {
+		t.Errorf("expected resolved name 'db-blue', but got '%s'", resolved.Spec.Vault.Object.Name)
+	}
+	if !meta.IsStatusConditionTrue(resolved.Status.Conditions, ConditionTypeNameResolved) {
+		t.Errorf("expected NameResolved condition to be true, but got %v", resolved.Status.Conditions)
+	}
+}
+
+func TestNameFromIndexes(t *testing.T) {
+	keys, err := nameFromConfigMapIndexFunc(secretWithNameFromConfigMap("active", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "default/active" {
+		t.Errorf("unexpected index keys %v", keys)
+	}
+
+	keys, err = nameFromSecretIndexFunc(secretWithNameFromSecret("active", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "default/active" {
+		t.Errorf("unexpected index keys %v", keys)
+	}
+
+	keys, err = nameFromSecretIndexFunc(secretWithNameFromConfigMap("active", "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no index keys, but got %v", keys)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+var namespaceTerminatingDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "akv2k8s_namespace_terminating_drops_total",
+	Help: "The total number of failed syncs not retried because the namespace is being deleted",
+}, []string{"queue"})
+
+// dropInTerminatingNamespace wraps reconcile so that failed syncs of resources in a namespace
+// being deleted are not retried. The API server rejects new content in such namespaces until
+// they are gone, and deleting the namespace deletes the AzureKeyVaultSecrets, which removes
+// them from the queues.
+func (c *Controller) dropInTerminatingNamespace(queue string, reconcile func(key string) error) func(key string) error {
+	return func(key string) error {
+		err := reconcile(key)
+		if err == nil {
+			return nil
+		}
+
+		namespace, _, splitErr := cache.SplitMetaNamespaceKey(key)
+		if splitErr != nil || !c.isNamespaceTerminating(namespace, err) {
+			return err
+		}
+
+		klog.V(2).InfoS("namespace is being deleted - not retrying", "queue", queue, "key", key, "error", err.Error())
+		namespaceTerminatingDrops.WithLabelValues(queue).Inc()
+		return nil
+	}
+}
+
+// isNamespaceTerminating checks if err was caused by namespace being deleted. Most sync errors
+// are wrapped without keeping the API error, so the namespace itself is checked as well.
+func (c *Controller) isNamespaceTerminating(namespace string, err error) bool {
+	if errors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+		return true
+	}
+	if namespace == "" {
+		return false
+	}
+
+	ns, getErr := c.kubeclientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+	if getErr != nil {
+		return errors.IsNotFound(getErr)
+	}
+	return ns.Status.Phase == corev1.NamespaceTerminating || ns.DeletionTimestamp != nil
+}
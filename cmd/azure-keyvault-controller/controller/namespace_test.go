@@ -0,0 +1,128 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// namespaceTerminatingError is the error returned by the API server when creating
+// objects in a namespace being deleted
+func namespaceTerminatingError(namespace string) error {
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    403,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: fmt.Sprintf("secrets \"my-secret\" is forbidden: unable to create new content in namespace %s because it is being terminated", namespace),
+		Details: &metav1.StatusDetails{
+			Causes: []metav1.StatusCause{{
+				Type:    corev1.NamespaceTerminatingCause,
+				Message: fmt.Sprintf("namespace %s is being terminated", namespace),
+				Field:   "metadata.namespace",
+			}},
+		},
+	}}
+}
+
+func createNamespace(t *testing.T, kubeclient *k8sfake.Clientset, phase corev1.NamespacePhase) {
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: metav1.NamespaceDefault},
+		Status:     corev1.NamespaceStatus{Phase: phase},
+	}
+	if _, err := kubeclient.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func terminatingSecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	return akvs
+}
+
+func TestNoRetriesInTerminatingNamespace(t *testing.T) {
+	akvs := terminatingSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "value"}})
+	createNamespace(t, kubeclient, corev1.NamespaceTerminating)
+	kubeclient.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, namespaceTerminatingError(akvs.Namespace)
+	})
+
+	calls := 0
+	sync := func(key string) error {
+		calls++
+		_, _, err := c.getOrCreateKubernetesSecret(akvs, false)
+		return err
+	}
+	high := newPriorityQueue("high", priorityHigh, 5, 1, nil, false, c.dropInTerminatingNamespace("high", sync))
+	low := newPriorityQueue("low", priorityLow, 5, 1, nil, false, c.dropInTerminatingNamespace("low", sync))
+	worker := newPriorityWorker(high, low, 1, 1)
+
+	key := akvs.Namespace + "/" + akvs.Name
+	worker.process(queuedItem{key: key, queue: high})
+	if calls != 1 {
+		t.Errorf("expected one sync, but got %d", calls)
+	}
+	if requeues := high.GetQueue().NumRequeues(key); requeues != 0 {
+		t.Errorf("expected no retries in terminating namespace, but key was requeued %d times", requeues)
+	}
+	if length := high.GetQueue().Len(); length != 0 {
+		t.Errorf("expected queue to be empty, but got %d items", length)
+	}
+}
+
+func TestIsNamespaceTerminating(t *testing.T) {
+	akvs := terminatingSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{})
+	createNamespace(t, kubeclient, corev1.NamespaceActive)
+
+	if !c.isNamespaceTerminating(akvs.Namespace, namespaceTerminatingError(akvs.Namespace)) {
+		t.Error("expected the namespace terminating error to be detected")
+	}
+	if c.isNamespaceTerminating(akvs.Namespace, fmt.Errorf("api unavailable")) {
+		t.Error("expected other errors in an active namespace to be retried")
+	}
+	if !c.isNamespaceTerminating("deleted", fmt.Errorf("api unavailable")) {
+		t.Error("expected errors in a deleted namespace not to be retried")
+	}
+}
+
+func TestRetriesInActiveNamespace(t *testing.T) {
+	akvs := terminatingSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{})
+	createNamespace(t, kubeclient, corev1.NamespaceActive)
+
+	sync := c.dropInTerminatingNamespace("test", func(key string) error {
+		return fmt.Errorf("api unavailable")
+	})
+	if err := sync(akvs.Namespace + "/" + akvs.Name); err == nil {
+		t.Error("expected error to be returned for retry")
+	}
+}
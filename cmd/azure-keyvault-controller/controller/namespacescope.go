@@ -0,0 +1,64 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"slices"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// isNamespaceWatched tells if AzureKeyVaultSecrets in namespace are synced, according to
+// WatchNamespaces and ExcludeNamespaces. Excluded namespaces are never watched.
+func (o *Options) isNamespaceWatched(namespace string) bool {
+	if slices.Contains(o.ExcludeNamespaces, namespace) {
+		return false
+	}
+	return len(o.WatchNamespaces) == 0 || slices.Contains(o.WatchNamespaces, namespace)
+}
+
+// isObjectWatched tells if obj, which may be a tombstone, is in a watched namespace
+func (c *Controller) isObjectWatched(obj interface{}) bool {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return false
+	}
+	return c.isKeyWatched(key)
+}
+
+// isKeyWatched tells if the resource with key is in a watched namespace
+func (c *Controller) isKeyWatched(key string) bool {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return false
+	}
+	return c.options.isNamespaceWatched(namespace)
+}
+
+// skipUnwatchedNamespace wraps reconcile so keys in namespaces that are not watched are
+// dropped without being synced, like keys queued by other resources before the namespace
+// was excluded
+func (c *Controller) skipUnwatchedNamespace(queue string, reconcile func(key string) error) func(key string) error {
+	return func(key string) error {
+		if !c.isKeyWatched(key) {
+			klog.V(4).InfoS("namespace is not watched - skipping", "queue", queue, "key", key)
+			return nil
+		}
+		return reconcile(key)
+	}
+}
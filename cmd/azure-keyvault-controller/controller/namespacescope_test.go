@@ -0,0 +1,70 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestIsNamespaceWatched(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   Options
+		namespace string
+		expected  bool
+	}{
+		{name: "all namespaces", namespace: "team-a", expected: true},
+		{name: "allowed", options: Options{WatchNamespaces: []string{"team-a", "team-b"}}, namespace: "team-b", expected: true},
+		{name: "not allowed", options: Options{WatchNamespaces: []string{"team-a"}}, namespace: "team-b", expected: false},
+		{name: "excluded", options: Options{ExcludeNamespaces: []string{"kube-system"}}, namespace: "kube-system", expected: false},
+		{name: "allowed and excluded", options: Options{WatchNamespaces: []string{"team-a"}, ExcludeNamespaces: []string{"team-a"}}, namespace: "team-a", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if watched := tt.options.isNamespaceWatched(tt.namespace); watched != tt.expected {
+				t.Errorf("expected namespace '%s' to be watched: %t, but got %t", tt.namespace, tt.expected, watched)
+			}
+		})
+	}
+}
+
+func TestSkipUnwatchedNamespace(t *testing.T) {
+	c := &Controller{options: &Options{WatchNamespaces: []string{"team-a"}}}
+	var synced []string
+	reconcile := c.skipUnwatchedNamespace("test", func(key string) error {
+		synced = append(synced, key)
+		return nil
+	})
+
+	for _, key := range []string{"team-a/some-secret", "team-b/some-secret"} {
+		if err := reconcile(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(synced) != 1 || synced[0] != "team-a/some-secret" {
+		t.Errorf("expected only the key in the watched namespace to be synced, but got %v", synced)
+	}
+
+	akvs := secret()
+	akvs.Namespace = "team-b"
+	if c.isObjectWatched(cache.DeletedFinalStateUnknown{Key: "team-b/" + akvs.Name, Obj: akvs}) {
+		t.Error("expected tombstone in namespace that is not watched to be ignored")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ReasonObjectExpired is used when the synced version of the object has expired in Azure Key Vault
+	ReasonObjectExpired = "ObjectExpired"
+
+	// ReasonObjectValid is used when the synced version of the object has not expired
+	ReasonObjectValid = "ObjectValid"
+)
+
+// enabledVersionVaultService reads the newest enabled version of objects read without a
+// version, when the latest version is disabled. Azure Key Vault refuses to read disabled
+// versions, so the object would otherwise fail to sync until a new version is added.
+type enabledVersionVaultService struct {
+	vault.Service
+}
+
+func newEnabledVersionVaultService(service vault.Service) *enabledVersionVaultService {
+	return &enabledVersionVaultService{Service: service}
+}
+
+// isForbidden tells if err means Azure Key Vault refused the operation, which is the case
+// when reading a disabled version
+func isForbidden(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
+
+func (s *enabledVersionVaultService) read(secret *akv.AzureKeyVault, fn func(*akv.AzureKeyVault) error) error {
+	err := fn(secret)
+	if err == nil || secret.Object.Version != "" || !isForbidden(err) {
+		return err
+	}
+
+	versions, listErr := s.Service.GetObjectVersions(secret)
+	if listErr != nil || !vault.IsNewestVersionDisabled(versions) {
+		return err
+	}
+	current, currentErr := vault.CurrentVersion(versions)
+	if currentErr != nil {
+		return fmt.Errorf("%w, and the latest version of object '%s' is disabled with no enabled version to read instead", err, secret.Object.Name)
+	}
+
+	klog.InfoS("latest version of object is disabled - reading newest enabled version", "vault", secret.Identifier(), "object", secret.Object.Name, "version", current.Version)
+	enabled := secret.DeepCopy()
+	enabled.Object.Version = current.Version
+	return fn(enabled)
+}
+
+func (s *enabledVersionVaultService) GetSecret(secret *akv.AzureKeyVault) (value string, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, err = s.Service.GetSecret(v)
+		return err
+	})
+	return value, err
+}
+
+func (s *enabledVersionVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (value string, metadata *vault.ObjectMetadata, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, metadata, err = s.Service.GetSecretWithMetadata(v)
+		return err
+	})
+	return value, metadata, err
+}
+
+func (s *enabledVersionVaultService) GetKey(secret *akv.AzureKeyVault) (value string, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		value, err = s.Service.GetKey(v)
+		return err
+	})
+	return value, err
+}
+
+func (s *enabledVersionVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (key *vault.Key, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		key, err = s.Service.GetKeyMaterial(v)
+		return err
+	})
+	return key, err
+}
+
+func (s *enabledVersionVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (cert *vault.Certificate, err error) {
+	err = s.read(secret, func(v *akv.AzureKeyVault) (err error) {
+		cert, err = s.Service.GetCertificate(v, options)
+		return err
+	})
+	return cert, err
+}
+
+// notYetValidError is returned when the version read from Azure Key Vault is not valid yet
+type notYetValidError struct {
+	object    string
+	version   string
+	notBefore time.Time
+}
+
+func (e *notYetValidError) Error() string {
+	return fmt.Sprintf("version '%s' of object '%s' in azure key vault is not valid before %s", e.version, e.object, e.notBefore.UTC().Format(time.RFC3339))
+}
+
+func isNotYetValid(err error) bool {
+	var notYetValid *notYetValidError
+	return errors.As(err, &notYetValid)
+}
+
+// checkNotBefore refuses to sync the version handler read for akvs before its not before
+// attribute has passed, keeping the outputs as they are. Akvs is added to the azure key
+// vault queue for when the version becomes valid, as retries may give up before then.
+func (c *Controller) checkNotBefore(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler) error {
+	metadata := handledObjectMetadata(handler)
+	if metadata == nil || metadata.NotBefore.IsZero() {
+		return nil
+	}
+	wait := metadata.NotBefore.Sub(c.clock.Now().Time)
+	if wait <= 0 {
+		return nil
+	}
+
+	err := &notYetValidError{object: akvs.Spec.Vault.Object.Name, version: metadata.Version, notBefore: metadata.NotBefore}
+	key, keyErr := cache.MetaNamespaceKeyFunc(akvs)
+	if keyErr != nil {
+		return err
+	}
+	klog.InfoS("object version not valid yet - syncing when valid", "azurekeyvaultsecret", klog.KObj(akvs), "version", metadata.Version, "notBefore", metadata.NotBefore)
+	c.azureKeyVaultQueue.GetQueue().AddAfter(key, wait)
+	return err
+}
+
+// expiredCondition returns the Expired condition of akvs from the version last read from Azure
+// Key Vault, or nil if the version is unknown, or has not expired and the condition was never set
+func (c *Controller) expiredCondition(akvs *akv.AzureKeyVaultSecret) *metav1.Condition {
+	value, ok := c.vaultObjectMetadata.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return nil
+	}
+	metadata := value.(*vault.ObjectMetadata)
+	if metadata == nil {
+		return nil
+	}
+
+	if !metadata.Expires.IsZero() && !c.clock.Now().Time.Before(metadata.Expires) {
+		return &metav1.Condition{
+			Type:    ConditionTypeExpired,
+			Status:  metav1.ConditionTrue,
+			Reason:  ReasonObjectExpired,
+			Message: fmt.Sprintf("Version '%s' of object '%s' in Azure Key Vault expired at %s", metadata.Version, akvs.Spec.Vault.Object.Name, metadata.Expires.UTC().Format(time.RFC3339)),
+		}
+	}
+	if meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeExpired) == nil {
+		return nil
+	}
+	return &metav1.Condition{
+		Type:    ConditionTypeExpired,
+		Status:  metav1.ConditionFalse,
+		Reason:  ReasonObjectValid,
+		Message: fmt.Sprintf("Version '%s' of object '%s' in Azure Key Vault has not expired", metadata.Version, akvs.Spec.Vault.Object.Name),
+	}
+}
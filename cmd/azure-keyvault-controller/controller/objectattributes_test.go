@@ -0,0 +1,170 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	fakeVault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client/fake"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// multiVersionVault returns an in-memory vault with a version of my-secret for each of
+// enabled, oldest first, along with the versions
+func multiVersionVault(t *testing.T, enabled ...bool) (*fakeVault.InMemoryService, []string) {
+	service := fakeVault.NewInMemoryService()
+	var versions []string
+	for i, e := range enabled {
+		version := service.SetSecret("my-vault", "my-secret", fmt.Sprintf("value %d", i+1))
+		if !e {
+			if err := service.DisableVersion("my-vault", "my-secret", version); err != nil {
+				t.Fatal(err)
+			}
+		}
+		versions = append(versions, version)
+	}
+	return service, versions
+}
+
+func TestEnabledVersionVaultService(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled []bool
+		// index of the version pinned in the spec and the version expected read, -1 for none
+		pinned   int
+		expected int
+	}{
+		{name: "latest enabled", enabled: []bool{true, true, true}, pinned: -1, expected: 2},
+		{name: "latest disabled", enabled: []bool{true, true, false}, pinned: -1, expected: 1},
+		{name: "latest disabled skips disabled", enabled: []bool{true, false, false}, pinned: -1, expected: 0},
+		{name: "all disabled", enabled: []bool{false, false}, pinned: -1, expected: -1},
+		{name: "pinned version disabled", enabled: []bool{true, false}, pinned: 1, expected: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, versions := multiVersionVault(t, tt.enabled...)
+			vaultSpec := &akv.AzureKeyVault{Name: "my-vault", Object: akv.AzureKeyVaultObject{Name: "my-secret", Type: akv.AzureKeyVaultObjectTypeSecret}}
+			if tt.pinned >= 0 {
+				vaultSpec.Object.Version = versions[tt.pinned]
+			}
+			pinned := vaultSpec.Object.Version
+
+			value, metadata, err := newEnabledVersionVaultService(fake).GetSecretWithMetadata(vaultSpec)
+			if tt.expected < 0 {
+				if err == nil {
+					t.Errorf("expected error, but got '%s'", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprintf("value %d", tt.expected+1); value != expected || metadata.Version != versions[tt.expected] {
+				t.Errorf("expected '%s' of version '%s', but got '%s' of version '%s'", expected, versions[tt.expected], value, metadata.Version)
+			}
+			if vaultSpec.Object.Version != pinned {
+				t.Error("expected the vault spec to be left unchanged")
+			}
+		})
+	}
+}
+
+func TestSyncRefusesVersionNotYetValid(t *testing.T) {
+	now := time.Now()
+	akvs := secret()
+	akvs.Spec.Vault.Name = "my-vault"
+	akvs.Spec.Vault.Object.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "value"
+	service, versions := multiVersionVault(t, true, true, false)
+	if err := service.SetVersionAttributes("my-vault", "my-secret", versions[1], now.Add(10*time.Millisecond), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+	c.vaultService = service
+	c.clock = &fakeClock{now: now}
+	c.azureKeyVaultQueue = newPriorityQueue("AzureKeyVault", priorityLow, 1, 1, nil, false, nil)
+	defer c.azureKeyVaultQueue.GetQueue().ShutDown()
+
+	_, err := c.getSecretFromKeyVault(akvs)
+	if !isNotYetValid(err) {
+		t.Fatalf("expected the newest enabled version to be refused before it is valid, but got %v", err)
+	}
+	if _, ok := c.vaultObjectMetadata.Load(akvs.Namespace + "/" + akvs.Name); ok {
+		t.Error("expected the version not to be recorded as synced")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.azureKeyVaultQueue.GetQueue().Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a sync to be queued for when the version becomes valid")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.clock = &fakeClock{now: now.Add(time.Second)}
+	values, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["value"]) != "value 2" {
+		t.Errorf("expected the version to be synced once valid, but got %v", values)
+	}
+}
+
+func TestSyncConditionsWhenExpired(t *testing.T) {
+	akvs := secret()
+	c := syncConditionsController(t, akvs)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	key := akvs.Namespace + "/" + akvs.Name
+	sync := c.withSyncConditions(func(string) error { return nil })
+
+	if err := sync(key); err != nil {
+		t.Fatal(err)
+	}
+	if meta.FindStatusCondition(getStatus(t, c, akvs).Status.Conditions, ConditionTypeExpired) != nil {
+		t.Error("expected no Expired condition before the object is read")
+	}
+
+	c.vaultObjectMetadata.Store(key, &vault.ObjectMetadata{Version: "v1", Expires: syncConditionsNow.Add(-time.Minute)})
+	for i := 0; i < 2; i++ {
+		if err := sync(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCondition(t, getStatus(t, c, akvs), ConditionTypeExpired, metav1.ConditionTrue, ReasonObjectExpired)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected a single warning when the version expires, but got %d events", len(recorder.Events))
+	}
+	if event := <-recorder.Events; event != "Warning Expired Version 'v1' of object 'some-secret' in Azure Key Vault expired at 2023-01-01T11:59:00Z" {
+		t.Errorf("unexpected event '%s'", event)
+	}
+
+	c.vaultObjectMetadata.Store(key, &vault.ObjectMetadata{Version: "v2", Expires: syncConditionsNow.Add(time.Hour)})
+	if err := sync(key); err != nil {
+		t.Fatal(err)
+	}
+	assertCondition(t, getStatus(t, c, akvs), ConditionTypeExpired, metav1.ConditionFalse, ReasonObjectValid)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// getObjectsFromKeyVault reads each object in spec.vault.objects of akvs written to the
+// Secret, merging their values into one map. Each object is read from its own vault with its
+// own credentials, see readObject. Failing to read any object fails the whole read, so the
+// Secret is never written with only some of the objects. The template of the Secret is
+// rendered once, from the merged values.
+func (c *Controller) getObjectsFromKeyVault(akvs *akv.AzureKeyVaultSecret) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	readBy := make(map[string]string)
+	var errs []error
+
+	objects := objectsWrittenTo(akvs, akv.AzureKeyVaultObjectOutputSecret)
+	for _, object := range objects {
+		single := singleObjectSecret(akvs, object.AzureKeyVaultObjectReference)
+		err := c.readObject(akvs, object, single, func(service vault.Service) error {
+			objectValues, err := c.getSecretFromVaultService(single, service)
+			if err != nil {
+				return err
+			}
+			for key, value := range objectValues {
+				if err := claimKey(readBy, key, object.Name); err != nil {
+					return err
+				}
+				values[key] = value
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, objectsError(errs)
+	}
+
+	klog.V(4).InfoS("read objects from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs), "output", akv.AzureKeyVaultObjectOutputSecret, "objects", len(objects), "keys", len(values))
+
+	c.clearVaultObjectMetadata(akvs)
+	values, err := selectByteValueKeys(values, akvs.Spec.Output.Secret.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.renderTemplate(akvs, values)
+}
+
+// getConfigMapObjectsFromKeyVault reads each object in spec.vault.objects of akvs written to
+// the ConfigMap, like getObjectsFromKeyVault for the Secret
+func (c *Controller) getConfigMapObjectsFromKeyVault(akvs *akv.AzureKeyVaultSecret) (map[string]string, error) {
+	values := make(map[string]string)
+	readBy := make(map[string]string)
+	var errs []error
+
+	objects := objectsWrittenTo(akvs, akv.AzureKeyVaultObjectOutputConfigMap)
+	for _, object := range objects {
+		single := singleObjectConfigMap(akvs, object.AzureKeyVaultObjectReference)
+		err := c.readObject(akvs, object, single, func(service vault.Service) error {
+			objectValues, err := c.getConfigMapFromVaultService(single, service)
+			if err != nil {
+				return err
+			}
+			for key, value := range objectValues {
+				if err := claimKey(readBy, key, object.Name); err != nil {
+					return err
+				}
+				values[key] = value
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, objectsError(errs)
+	}
+
+	klog.V(4).InfoS("read objects from azure key vault", "azurekeyvaultsecret", klog.KObj(akvs), "output", akv.AzureKeyVaultObjectOutputConfigMap, "objects", len(objects), "keys", len(values))
+
+	c.clearVaultObjectMetadata(akvs)
+	values, err := selectStringValueKeys(values, akvs.Spec.Output.ConfigMap.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.renderConfigMapTemplate(akvs, values)
+}
+
+// readObject reads object, an entry in spec.vault.objects of akvs, with read, given the vault
+// service for the vault and credentials of single, being akvs reading object alone. The
+// result is recorded for status.objects, attributing failures to the object and its vault.
+func (c *Controller) readObject(akvs *akv.AzureKeyVaultSecret, object indexedObject, single *akv.AzureKeyVaultSecret, read func(vault.Service) error) error {
+	service, err := c.vaultServiceFor(single)
+	if err == nil {
+		err = read(service)
+	}
+
+	status := akv.AzureKeyVaultObjectStatus{Name: object.Name, Vault: single.Spec.Vault.Identifier()}
+	if err != nil {
+		err = fmt.Errorf("failed to read spec.vault.objects[%d] '%s' from azure key vault '%s', error: %w", object.index, object.Name, status.Vault, err)
+		status.Error = err.Error()
+	}
+	c.storeObjectStatus(akvs, object.index, status)
+	return err
+}
+
+// objectsError returns the error of reading spec.vault.objects, where errs are the errors of
+// the objects that failed. A single error is returned as is, so it can still be told apart.
+func objectsError(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// indexedObject is an entry in spec.vault.objects along with its index, to refer to it in errors
+type indexedObject struct {
+	akv.AzureKeyVaultObjectReference
+	index int
+}
+
+// objectsWrittenTo returns the entries in spec.vault.objects of akvs written to output
+func objectsWrittenTo(akvs *akv.AzureKeyVaultSecret, output akv.AzureKeyVaultObjectOutput) []indexedObject {
+	var objects []indexedObject
+	for i, object := range akvs.Spec.Vault.Objects {
+		if akv.ObjectOutput(akvs, object) == output {
+			objects = append(objects, indexedObject{AzureKeyVaultObjectReference: object, index: i})
+		}
+	}
+	return objects
+}
+
+// claimKey records key as written by object in readBy, failing if another object wrote it
+func claimKey(readBy map[string]string, key, object string) error {
+	if other, ok := readBy[key]; ok {
+		return fmt.Errorf("key '%s' is written by both object '%s' and '%s' in spec.vault.objects", key, other, object)
+	}
+	readBy[key] = object
+	return nil
+}
+
+// clearVaultObjectMetadata forgets the version last read for akvs, as versions are per object
+// when reading spec.vault.objects, so no single version can be recorded in status
+func (c *Controller) clearVaultObjectMetadata(akvs *akv.AzureKeyVaultSecret) {
+	c.vaultObjectMetadata.Store(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name), (*vault.ObjectMetadata)(nil))
+}
+
+// singleObjectSecret returns a copy of akvs reading object alone, written to the data key of
+// object and without keys or the template, which are applied once all objects are read
+func singleObjectSecret(akvs *akv.AzureKeyVaultSecret, object akv.AzureKeyVaultObjectReference) *akv.AzureKeyVaultSecret {
+	single := singleObject(akvs, object)
+	single.Spec.Output.Secret.DataKey = object.DataKey
+	single.Spec.Output.Secret.Keys = nil
+	single.Spec.Output.Secret.Template = ""
+	single.Spec.Output.Secret.TemplateFrom = nil
+	return single
+}
+
+// singleObjectConfigMap returns a copy of akvs reading object alone for the ConfigMap, like
+// singleObjectSecret for the Secret
+func singleObjectConfigMap(akvs *akv.AzureKeyVaultSecret, object akv.AzureKeyVaultObjectReference) *akv.AzureKeyVaultSecret {
+	single := singleObject(akvs, object)
+	single.Spec.Output.ConfigMap.DataKey = object.DataKey
+	single.Spec.Output.ConfigMap.Keys = nil
+	single.Spec.Output.ConfigMap.Template = ""
+	single.Spec.Output.ConfigMap.TemplateFrom = nil
+	return single
+}
+
+// singleObject returns a copy of akvs reading object alone, from the vault of object
+func singleObject(akvs *akv.AzureKeyVaultSecret, object akv.AzureKeyVaultObjectReference) *akv.AzureKeyVaultSecret {
+	single := akvs.DeepCopy()
+	single.Spec.Vault = akvs.Spec.Vault.ObjectVault(object)
+	single.Spec.Vault.Object = akv.AzureKeyVaultObject{
+		Name:    object.Name,
+		Type:    object.Type,
+		Version: object.Version,
+	}
+	return single
+}
+
+// storeObjectStatus remembers the result of the last read of the object at index in
+// spec.vault.objects of akvs, to be recorded in status.objects
+func (c *Controller) storeObjectStatus(akvs *akv.AzureKeyVaultSecret, index int, status akv.AzureKeyVaultObjectStatus) {
+	key := fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name)
+	statuses := make(map[int]akv.AzureKeyVaultObjectStatus)
+	if value, ok := c.objectStatus.Load(key); ok {
+		for i, s := range value.(map[int]akv.AzureKeyVaultObjectStatus) {
+			statuses[i] = s
+		}
+	}
+	statuses[index] = status
+	c.objectStatus.Store(key, statuses)
+}
+
+// objectStatuses returns status.objects of akvs, being the result of the last read of each
+// object in spec.vault.objects in the order of the spec. The status is kept as is while the
+// objects have not been read since the controller started.
+func (c *Controller) objectStatuses(akvs *akv.AzureKeyVaultSecret) []akv.AzureKeyVaultObjectStatus {
+	if len(akvs.Spec.Vault.Objects) == 0 {
+		return nil
+	}
+	value, ok := c.objectStatus.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return akvs.Status.Objects
+	}
+
+	stored := value.(map[int]akv.AzureKeyVaultObjectStatus)
+	var statuses []akv.AzureKeyVaultObjectStatus
+	for i, object := range akvs.Spec.Vault.Objects {
+		if status, ok := stored[i]; ok && status.Name == object.Name {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
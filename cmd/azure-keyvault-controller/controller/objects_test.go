@@ -0,0 +1,236 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// objectsVaultService returns the value of each secret by name, or by vault/name for secrets
+// only in that vault
+type objectsVaultService struct {
+	fakeVaultService
+	values map[string]string
+}
+
+func (f *objectsVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
+	value, ok := f.values[secret.Identifier()+"/"+secret.Object.Name]
+	if !ok {
+		value, ok = f.values[secret.Object.Name]
+	}
+	if !ok {
+		return "", fmt.Errorf("secret '%s' not found", secret.Object.Name)
+	}
+	return value, nil
+}
+
+func (f *objectsVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	value, err := f.GetSecret(secret)
+	return value, nil, err
+}
+
+func objectsSecret(objects ...akv.AzureKeyVaultObjectReference) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+	akvs.Spec.Vault.Objects = objects
+	akvs.Spec.Output.Secret.DataKey = ""
+	return akvs
+}
+
+func TestGetObjectsFromKeyVault(t *testing.T) {
+	service := &objectsVaultService{values: map[string]string{"db-user": "admin", "db-password": "s3cret"}}
+
+	tests := []struct {
+		name     string
+		objects  []akv.AzureKeyVaultObjectReference
+		expected map[string]string
+		err      string
+	}{
+		{
+			name: "merges objects",
+			objects: []akv.AzureKeyVaultObjectReference{
+				{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "username"},
+				{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password"},
+			},
+			expected: map[string]string{"username": "admin", "password": "s3cret"},
+		},
+		{
+			name: "fails on any missing object",
+			objects: []akv.AzureKeyVaultObjectReference{
+				{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "username"},
+				{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host"},
+			},
+			err: "failed to read spec.vault.objects[1] 'db-host'",
+		},
+		{
+			name: "fails on key written twice",
+			objects: []akv.AzureKeyVaultObjectReference{
+				{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "value"},
+				{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "value"},
+			},
+			err: "key 'value' is written by both object 'db-user' and 'db-password'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := objectsSecret(tt.objects...)
+			c, _ := outputsController(t, akvs, &countingVaultService{})
+			c.vaultService = service
+
+			values, err := c.getObjectsFromKeyVault(akvs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing '%s', but got %v", tt.err, err)
+				}
+				if values != nil {
+					t.Errorf("expected no values on error, but got %v", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != len(tt.expected) {
+				t.Fatalf("expected %d keys, but got %v", len(tt.expected), values)
+			}
+			for key, value := range tt.expected {
+				if string(values[key]) != value {
+					t.Errorf("expected '%s' for key '%s', but got '%s'", value, key, values[key])
+				}
+			}
+		})
+	}
+}
+
+func TestGetObjectsRoutedToOutputs(t *testing.T) {
+	service := &objectsVaultService{values: map[string]string{"db-host": "db.local", "db-user": "admin", "db-password": "s3cret"}}
+	akvs := objectsSecret(
+		akv.AzureKeyVaultObjectReference{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host", Output: akv.AzureKeyVaultObjectOutputConfigMap},
+		akv.AzureKeyVaultObjectReference{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "user", Output: akv.AzureKeyVaultObjectOutputConfigMap},
+		akv.AzureKeyVaultObjectReference{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password"},
+	)
+	akvs.Spec.Output.Secret.Name = "db"
+	akvs.Spec.Output.ConfigMap.Name = "db-settings"
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+	c.vaultService = service
+
+	secretValues, err := c.getObjectsFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secretValues) != 1 || string(secretValues["password"]) != "s3cret" {
+		t.Errorf("expected only the password in the secret, but got %v", secretValues)
+	}
+
+	cmValues, err := c.getConfigMapObjectsFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmValues) != 2 || cmValues["host"] != "db.local" || cmValues["user"] != "admin" {
+		t.Errorf("expected the host and user in the configmap, but got %v", cmValues)
+	}
+}
+
+func TestGetObjectsFromOtherVaults(t *testing.T) {
+	service := &objectsVaultService{values: map[string]string{"team-vault/db-password": "s3cret", "db-host": "db.local"}}
+	akvs := objectsSecret(
+		akv.AzureKeyVaultObjectReference{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host"},
+		akv.AzureKeyVaultObjectReference{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password", VaultName: "team-vault"},
+		akv.AzureKeyVaultObjectReference{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "user", VaultURI: "https://other-vault.vault.azure.net"},
+	)
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+	c.vaultService = service
+
+	_, err := c.getObjectsFromKeyVault(akvs)
+	if err == nil || !strings.Contains(err.Error(), "spec.vault.objects[2] 'db-user' from azure key vault 'https://other-vault.vault.azure.net'") {
+		t.Fatalf("expected the read of db-user to fail, but got %v", err)
+	}
+
+	statuses := c.objectStatuses(akvs)
+	if len(statuses) != 3 {
+		t.Fatalf("expected the status of each object, but got %v", statuses)
+	}
+	for i, expected := range []akv.AzureKeyVaultObjectStatus{
+		{Name: "db-host", Vault: akvs.Spec.Vault.Name},
+		{Name: "db-password", Vault: "team-vault"},
+		{Name: "db-user", Vault: "https://other-vault.vault.azure.net"},
+	} {
+		if statuses[i].Name != expected.Name || statuses[i].Vault != expected.Vault || (statuses[i].Error != "") != (i == 2) {
+			t.Errorf("expected status %+v for spec.vault.objects[%d], but got %+v", expected, i, statuses[i])
+		}
+	}
+
+	service.values["https://other-vault.vault.azure.net/db-user"] = "admin"
+	values, err := c.getObjectsFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["password"]) != "s3cret" || string(values["user"]) != "admin" || string(values["host"]) != "db.local" {
+		t.Errorf("expected each object read from its own vault, but got %v", values)
+	}
+	if statuses := c.objectStatuses(akvs); statuses[2].Error != "" {
+		t.Errorf("expected the failure to be cleared once the object is read, but got %+v", statuses[2])
+	}
+}
+
+func TestCredentialsFromSecretIndexFuncObjects(t *testing.T) {
+	akvs := objectsSecret(
+		akv.AzureKeyVaultObjectReference{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, CredentialsFrom: &akv.AzureKeyVaultCredentialsFrom{SecretRef: corev1.LocalObjectReference{Name: "platform"}}},
+		akv.AzureKeyVaultObjectReference{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, CredentialsFrom: &akv.AzureKeyVaultCredentialsFrom{SecretRef: corev1.LocalObjectReference{Name: "team"}}},
+	)
+	akvs.Spec.Vault.CredentialsFrom = &akv.AzureKeyVaultCredentialsFrom{SecretRef: corev1.LocalObjectReference{Name: "team"}}
+
+	keys, err := credentialsFromSecretIndexFunc(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{akvs.Namespace + "/team", akvs.Namespace + "/platform"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, but got %v", expected, keys)
+	}
+}
+
+func TestSyncConditionsRecordsObjectStatus(t *testing.T) {
+	akvs := objectsSecret(
+		akv.AzureKeyVaultObjectReference{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host"},
+		akv.AzureKeyVaultObjectReference{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password", VaultName: "team-vault"},
+	)
+	c := syncConditionsController(t, akvs)
+	c.storeObjectStatus(akvs, 1, akv.AzureKeyVaultObjectStatus{Name: "db-password", Vault: "team-vault", Error: "forbidden"})
+	c.storeObjectStatus(akvs, 0, akv.AzureKeyVaultObjectStatus{Name: "db-host", Vault: akvs.Spec.Vault.Name})
+
+	sync := c.withSyncConditions(func(string) error { return fmt.Errorf("forbidden") })
+	if err := sync(akvs.Namespace + "/" + akvs.Name); err == nil {
+		t.Fatal("expected the sync error to be returned")
+	}
+
+	expected := []akv.AzureKeyVaultObjectStatus{
+		{Name: "db-host", Vault: akvs.Spec.Vault.Name},
+		{Name: "db-password", Vault: "team-vault", Error: "forbidden"},
+	}
+	if objects := getStatus(t, c, akvs).Status.Objects; !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expected status.objects %+v, but got %+v", expected, objects)
+	}
+}
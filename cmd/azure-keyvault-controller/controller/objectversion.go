@@ -0,0 +1,75 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// handledObjectMetadata returns the version of the object last handled by handler, or nil
+// if unknown, like for keys read without key material
+func handledObjectMetadata(handler KubernetesHandler) *vault.ObjectMetadata {
+	switch h := handler.(type) {
+	case *azureSecretHandler:
+		return h.metadata
+	case *azureCertificateHandler:
+		return h.metadata
+	case *azureKeyHandler:
+		return h.metadata
+	case *azureMultiValueSecretHandler:
+		return h.metadata
+	}
+	return nil
+}
+
+// storeVaultObjectMetadata remembers the version of the object handler read for akvs, to be
+// recorded in the status of akvs
+func (c *Controller) storeVaultObjectMetadata(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler) {
+	c.vaultObjectMetadata.Store(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name), handledObjectMetadata(handler))
+}
+
+// setVaultObjectVersion records the object version akvs was last read from, when it was
+// last updated in Azure Key Vault and the URI of the vault it was read from, in its status.
+// When the version is unknown, the version in spec.vault.object after resolving versionFrom
+// and "previous" is recorded, which is empty when the latest version is read. The status is kept as is if akvs has not been read since the
+// controller started. Akvs must be a copy about to be written.
+func (c *Controller) setVaultObjectVersion(akvs *akv.AzureKeyVaultSecret) {
+	value, ok := c.vaultObjectMetadata.Load(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name))
+	if !ok {
+		return
+	}
+
+	metadata := value.(*vault.ObjectMetadata)
+	if metadata == nil || metadata.Version == "" {
+		akvs.Status.VaultObjectVersion = akvs.Spec.Vault.Object.Version
+		akvs.Status.VaultObjectUpdated = nil
+		akvs.Status.VaultURI = ""
+		return
+	}
+
+	akvs.Status.VaultURI = metadata.VaultURL
+	akvs.Status.VaultObjectVersion = metadata.Version
+	akvs.Status.VaultObjectUpdated = nil
+	if !metadata.Updated.IsZero() {
+		updated := metav1.NewTime(metadata.Updated)
+		akvs.Status.VaultObjectUpdated = &updated
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+)
+
+func TestSyncOutputsRecordsVaultObjectVersion(t *testing.T) {
+	akvs := outputsSecret()
+	updatedAt := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	service := &countingVaultService{fakeVaultService: fakeVaultService{
+		fakeSecretValue: "value",
+		fakeMetadata:    &vault.ObjectMetadata{Version: "v1", Updated: updatedAt, VaultURL: "https://my-vault.privatelink.vaultcore.azure.net"},
+	}}
+	c, _ := outputsController(t, akvs, service)
+
+	if err := c.syncOutputs(akvs, true); err != nil {
+		t.Fatal(err)
+	}
+	status := getStatus(t, c, akvs).Status
+	if status.VaultObjectVersion != "v1" {
+		t.Errorf("expected version 'v1' in status, but got '%s'", status.VaultObjectVersion)
+	}
+	if status.VaultObjectUpdated == nil || !status.VaultObjectUpdated.Time.Equal(updatedAt) {
+		t.Errorf("expected updated %v in status, but got %v", updatedAt, status.VaultObjectUpdated)
+	}
+	if status.VaultURI != "https://my-vault.privatelink.vaultcore.azure.net" {
+		t.Errorf("expected vault uri in status, but got '%s'", status.VaultURI)
+	}
+
+	// a new version in azure key vault is recorded on the next poll
+	service.fakeMetadata = &vault.ObjectMetadata{Version: "v2"}
+	service.fakeSecretValue = "new value"
+	if err := c.syncOutputs(getStatus(t, c, akvs), true); err != nil {
+		t.Fatal(err)
+	}
+	status = getStatus(t, c, akvs).Status
+	if status.VaultObjectVersion != "v2" {
+		t.Errorf("expected version 'v2' in status, but got '%s'", status.VaultObjectVersion)
+	}
+	if status.VaultObjectUpdated != nil {
+		t.Errorf("expected no updated time in status when unknown, but got %v", status.VaultObjectUpdated)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "first", "password"); value != "new value" {
+		t.Errorf("expected the new version to be written, but got '%s'", value)
+	}
+}
+
+func TestSetVaultObjectVersionNotRead(t *testing.T) {
+	c := &Controller{}
+	akvs := secret()
+	akvs.Status.VaultObjectVersion = "v1"
+
+	c.setVaultObjectVersion(akvs)
+	if akvs.Status.VaultObjectVersion != "v1" {
+		t.Errorf("expected status to be kept until read, but got version '%s'", akvs.Status.VaultObjectVersion)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+// ReasonOutputRecreated is the reason of the event when an output deleted outside of the
+// controller is queued to be recreated
+const ReasonOutputRecreated = "OutputRecreated"
+
+// initOutputDeletion queues the owners of deleted Secrets and ConfigMaps, so outputs deleted
+// by someone else are recreated at once instead of on the next resync
+func (c *Controller) initOutputDeletion() {
+	for kind, informer := range map[string]cache.SharedIndexInformer{
+		outputKindSecret:    c.kubeInformerFactory.Core().V1().Secrets().Informer(),
+		outputKindConfigMap: c.kubeInformerFactory.Core().V1().ConfigMaps().Informer(),
+	} {
+		kind := kind
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj interface{}) { c.handleDeletedOutput(kind, obj) },
+		})
+		if err != nil {
+			klog.ErrorS(err, "unable to add event handler", "kind", kind)
+		}
+	}
+}
+
+// isOwnedByAzureKeyVaultSecret tells if obj has an AzureKeyVaultSecret as owner
+func isOwnedByAzureKeyVaultSecret(obj metav1.Object) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == "AzureKeyVaultSecret" {
+			return true
+		}
+	}
+	return false
+}
+
+// getAzureKeyVaultSecretsFromOwners returns the AzureKeyVaultSecrets owning obj, a Secret or
+// ConfigMap, ignoring owners no longer found
+func (c *Controller) getAzureKeyVaultSecretsFromOwners(obj metav1.Object) []*akv.AzureKeyVaultSecret {
+	var owners []*akv.AzureKeyVaultSecret
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind != "AzureKeyVaultSecret" {
+			continue
+		}
+		akvs, err := c.azureKeyVaultSecretLister.AzureKeyVaultSecrets(obj.GetNamespace()).Get(ref.Name)
+		if err != nil || akvs.UID != ref.UID {
+			continue
+		}
+		owners = append(owners, akvs)
+	}
+	return owners
+}
+
+// isCurrentOutput tells if akvs currently outputs to the Secret or ConfigMap name, as opposed
+// to outputs removed from the spec or earlier revisions of an immutable ConfigMap, which the
+// controller deletes itself
+func isCurrentOutput(akvs *akv.AzureKeyVaultSecret, kind, name string) bool {
+	switch kind {
+	case outputKindSecret:
+		if akvs.Spec.Output.Secret.Name == name {
+			return true
+		}
+	case outputKindConfigMap:
+		if isImmutableConfigMap(akvs) {
+			if akvs.Status.ConfigMapName == name {
+				return true
+			}
+		} else if akvs.Spec.Output.ConfigMap.Name == name {
+			return true
+		}
+	}
+	for _, output := range akvs.Spec.Outputs {
+		if (kind == outputKindSecret && output.Secret.Name == name) || (kind == outputKindConfigMap && output.ConfigMap.Name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDeletedOutput queues the AzureKeyVaultSecrets owning the deleted Secret or ConfigMap
+// obj, which may be a tombstone, on the high priority queue. Syncing recreates the output,
+// unless kept deleted according to spec.output.secret.recreatePolicy.
+func (c *Controller) handleDeletedOutput(kind string, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	output, err := meta.Accessor(obj)
+	if err != nil || !isOwnedByAzureKeyVaultSecret(output) {
+		return
+	}
+
+	for _, akvs := range c.getAzureKeyVaultSecretsFromOwners(output) {
+		if akvs.DeletionTimestamp != nil || !c.isObjectWatched(akvs) || !c.isSelected(akvs) || !isCurrentOutput(akvs, kind, output.GetName()) {
+			continue
+		}
+
+		if kind == outputKindSecret && hasSecretRecreatePolicy(akvs) {
+			klog.V(4).InfoS("output deleted - checking recreate policy", "azurekeyvaultsecret", klog.KObj(akvs), "kind", kind, "name", output.GetName())
+		} else {
+			klog.InfoS("output deleted - recreating", "azurekeyvaultsecret", klog.KObj(akvs), "kind", kind, "name", output.GetName())
+			c.recorder.Eventf(akvs, corev1.EventTypeNormal, ReasonOutputRecreated, "%s '%s' was deleted and is recreated", kind, output.GetName())
+		}
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func deletedOutputController(t *testing.T, akvs *akv.AzureKeyVaultSecret) (*Controller, *record.FakeRecorder) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(akvs); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		recorder:                  recorder,
+		azureKeyVaultSecretLister: listers.NewAzureKeyVaultSecretLister(indexer),
+		akvsCrdQueue:              newPriorityQueue("AzureKeyVaultSecrets", priorityHigh, 1, 1, nil, false, nil),
+		options:                   &Options{},
+	}
+	t.Cleanup(c.akvsCrdQueue.queue.ShutDown)
+	return c, recorder
+}
+
+func ownedSecret(akvs *akv.AzureKeyVaultSecret, name string) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       akvs.Namespace,
+		OwnerReferences: []metav1.OwnerReference{*newOwnerRef(akvs, akv.SchemeGroupVersion.WithKind("AzureKeyVaultSecret"))},
+	}}
+}
+
+func TestDeletedOutputIsQueued(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	c, recorder := deletedOutputController(t, akvs)
+
+	c.handleDeletedOutput(outputKindSecret, cache.DeletedFinalStateUnknown{Key: akvs.Namespace + "/my-secret", Obj: ownedSecret(akvs, "my-secret")})
+	if length := c.akvsCrdQueue.GetQueue().Len(); length != 1 {
+		t.Errorf("expected owner to be queued, but queue has %d items", length)
+	}
+	expectEvent(t, recorder, ReasonOutputRecreated)
+}
+
+func TestDeletedOutputIgnored(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	c, recorder := deletedOutputController(t, akvs)
+
+	other := ownedSecret(akvs, "my-secret")
+	other.OwnerReferences[0].UID = types.UID("other-uid")
+	for name, obj := range map[string]*corev1.Secret{
+		"not owned":          {ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: akvs.Namespace}},
+		"owned by other":     other,
+		"not current output": ownedSecret(akvs, "removed-secret"),
+	} {
+		c.handleDeletedOutput(outputKindSecret, obj)
+		if length := c.akvsCrdQueue.GetQueue().Len(); length != 0 {
+			t.Errorf("%s: expected nothing to be queued, but queue has %d items", name, length)
+		}
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events, but got %d", len(recorder.Events))
+	}
+}
@@ -0,0 +1,548 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	outputKindSecret    = "Secret"
+	outputKindConfigMap = "ConfigMap"
+)
+
+// fetchOnceVaultService reads each object from Azure Key Vault once, so all outputs of an
+// AzureKeyVaultSecret are synced from the same read. Certificates read with different
+// options, or the object read from a fallback vault, are read once for each.
+type fetchOnceVaultService struct {
+	vault.Service
+
+	mu      sync.Mutex
+	results map[string]fetchResult
+}
+
+type fetchResult struct {
+	value interface{}
+	err   error
+}
+
+func newFetchOnceVaultService(service vault.Service) *fetchOnceVaultService {
+	return &fetchOnceVaultService{
+		Service: service,
+		results: make(map[string]fetchResult),
+	}
+}
+
+func (s *fetchOnceVaultService) fetch(secret *akv.AzureKeyVault, key string, fn func() (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = secret.Name + "/" + key
+	if result, ok := s.results[key]; ok {
+		return result.value, result.err
+	}
+
+	value, err := fn()
+	s.results[key] = fetchResult{value: value, err: err}
+	return value, err
+}
+
+func (s *fetchOnceVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
+	value, _, err := s.GetSecretWithMetadata(secret)
+	return value, err
+}
+
+// secretWithMetadata is a secret value read by fetchOnceVaultService
+type secretWithMetadata struct {
+	value    string
+	metadata *vault.ObjectMetadata
+}
+
+func (s *fetchOnceVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	value, err := s.fetch(secret, "secret", func() (interface{}, error) {
+		value, metadata, err := s.Service.GetSecretWithMetadata(secret)
+		return secretWithMetadata{value: value, metadata: metadata}, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	result := value.(secretWithMetadata)
+	return result.value, result.metadata, nil
+}
+
+func (s *fetchOnceVaultService) GetKey(secret *akv.AzureKeyVault) (string, error) {
+	value, err := s.fetch(secret, "key", func() (interface{}, error) { return s.Service.GetKey(secret) })
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (s *fetchOnceVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	value, err := s.fetch(secret, "keymaterial", func() (interface{}, error) { return s.Service.GetKeyMaterial(secret) })
+	if err != nil {
+		return nil, err
+	}
+	return value.(*vault.Key), nil
+}
+
+func (s *fetchOnceVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (*vault.Certificate, error) {
+	key := "certificate"
+	if options != nil {
+		key = fmt.Sprintf("certificate/%t/%t", options.ExportPrivateKey, options.EnsureServerFirst)
+	}
+	value, err := s.fetch(secret, key, func() (interface{}, error) { return s.Service.GetCertificate(secret, options) })
+	if err != nil {
+		return nil, err
+	}
+	return value.(*vault.Certificate), nil
+}
+
+// akvsHasOutputs tells if akvs uses spec.outputs instead of spec.output
+func akvsHasOutputs(akvs *akv.AzureKeyVaultSecret) bool {
+	return len(akvs.Spec.Outputs) > 0
+}
+
+// findOutputStatus returns the status of the output of kind with name in spec.outputs, if any
+func findOutputStatus(statuses []akv.AzureKeyVaultOutputStatus, kind, name string) *akv.AzureKeyVaultOutputStatus {
+	for i := range statuses {
+		if statuses[i].Kind == kind && statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
+
+// outputView returns a copy of akvs with output as its only output, and the last status
+// of the output, so the code syncing spec.output can be used for each of spec.outputs
+func outputView(akvs *akv.AzureKeyVaultSecret, output akv.AzureKeyVaultOutput) *akv.AzureKeyVaultSecret {
+	view := akvs.DeepCopy()
+	view.Spec.Output = output
+	view.Spec.Outputs = nil
+	view.Status.SecretName, view.Status.SecretHash, view.Status.SecretKeys = "", "", nil
+	view.Status.ConfigMapName, view.Status.ConfigMapHash, view.Status.ConfigMapKeys = "", "", nil
+
+	if status := findOutputStatus(akvs.Status.Outputs, outputKindSecret, output.Secret.Name); status != nil {
+		view.Status.SecretName = status.Name
+		view.Status.SecretHash = status.Hash
+		view.Status.SecretKeys = status.Keys
+	}
+	if status := findOutputStatus(akvs.Status.Outputs, outputKindConfigMap, output.ConfigMap.Name); status != nil {
+		view.Status.ConfigMapName = status.Name
+		view.Status.ConfigMapHash = status.Hash
+		view.Status.ConfigMapKeys = status.Keys
+	}
+	return view
+}
+
+// newOutputStatus returns the status of an output to update, starting from its last status
+func newOutputStatus(akvs *akv.AzureKeyVaultSecret, kind, name string) akv.AzureKeyVaultOutputStatus {
+	if status := findOutputStatus(akvs.Status.Outputs, kind, name); status != nil {
+		return *status.DeepCopy()
+	}
+	return akv.AzureKeyVaultOutputStatus{Kind: kind, Name: name}
+}
+
+func setOutputSynced(status *akv.AzureKeyVaultOutputStatus, generation int64, err error) {
+	condition := metav1.Condition{
+		Type:               ConditionTypeOutputSynced,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Synced",
+		Message:            fmt.Sprintf("%s '%s' is synced", status.Kind, status.Name),
+		ObservedGeneration: generation,
+	}
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "SyncFailed"
+		condition.Message = err.Error()
+		if isKeyCollision(err) {
+			condition.Reason = ConditionTypeKeyCollision
+		}
+		if isKeyMismatch(err) {
+			condition.Reason = ConditionTypeKeyMismatch
+		}
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+}
+
+// validateOutputs checks that no Secret or ConfigMap is used by more than one output
+func validateOutputs(outputs []akv.AzureKeyVaultOutput) error {
+	seen := make(map[string]bool)
+	for _, output := range outputs {
+		for kind, name := range map[string]string{outputKindSecret: output.Secret.Name, outputKindConfigMap: output.ConfigMap.Name} {
+			if name == "" {
+				continue
+			}
+			if seen[kind+"/"+name] {
+				return fmt.Errorf("%s '%s' is used by more than one output", kind, name)
+			}
+			seen[kind+"/"+name] = true
+		}
+	}
+	return nil
+}
+
+// syncOutputs syncs each Secret and ConfigMap in spec.outputs, reading the object from
+// Azure Key Vault once for all of them. A failing output does not stop the others from
+// being synced. Outputs no longer in spec.outputs are pruned. When poll is set the time of
+// the poll and the predicted certificate renewal is updated in the status.
+func (c *Controller) syncOutputs(akvs *akv.AzureKeyVaultSecret, poll bool) error {
+	if c.akvsHasOutputSecret(akvs) || c.akvsHasOutputConfigMap(akvs) {
+		msg := "spec.output and spec.outputs cannot be combined, only spec.outputs is synced"
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrOutputs, msg)
+		klog.InfoS(msg, "azurekeyvaultsecret", klog.KObj(akvs))
+	}
+
+	if err := validateOutputs(akvs.Spec.Outputs); err != nil {
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrOutputs, err.Error())
+		return err
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(akvs)
+	if err != nil {
+		return err
+	}
+	forceSync := c.takeForceSync(key)
+
+	vaultService, err := c.vaultServiceFor(akvs)
+	if err != nil {
+		c.recordAzureFailure(akvs, err)
+		return err
+	}
+	service := newFetchOnceVaultService(vaultService)
+	var statuses []akv.AzureKeyVaultOutputStatus
+	var errs []error
+
+	add := func(status akv.AzureKeyVaultOutputStatus, err error) {
+		if err != nil {
+			klog.ErrorS(err, "failed to sync output", "azurekeyvaultsecret", klog.KObj(akvs), "kind", status.Kind, "name", status.Name)
+			errs = append(errs, err)
+		}
+		setOutputSynced(&status, akvs.Generation, err)
+		statuses = append(statuses, status)
+	}
+
+	for _, output := range akvs.Spec.Outputs {
+		view := outputView(akvs, output)
+		if output.Secret.Name != "" {
+			add(c.syncOutputSecret(view, service, forceSync, poll))
+		}
+		if output.ConfigMap.Name != "" {
+			add(c.syncOutputConfigMap(view, service, forceSync, poll))
+		}
+	}
+
+	for _, status := range akvs.Status.Outputs {
+		if findOutputStatus(statuses, status.Kind, status.Name) != nil {
+			continue
+		}
+		if _, err := c.pruneOutput(akvs, status); err != nil {
+			klog.ErrorS(err, "failed to prune output", "azurekeyvaultsecret", klog.KObj(akvs), "kind", status.Kind, "name", status.Name)
+			errs = append(errs, err)
+			// keep the status to retry
+			statuses = append(statuses, status)
+		}
+	}
+
+	if _, err := c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.Outputs = statuses
+		akvsCopy.Status.SanitizedKeys = c.loadSanitizedKeys(akvsCopy)
+		c.setServedBy(akvsCopy)
+		c.setVaultObjectVersion(akvsCopy)
+		if poll {
+			akvsCopy.Status.LastAzureUpdate = c.clock.Now()
+			akvsCopy.Status.PredictedRenewalTime = c.predictCertificateRenewal(akvsCopy)
+			akvsCopy.Status.NextAzurePollTime = c.nextAzurePollTime(akvsCopy)
+		}
+	}); err != nil {
+		errs = append(errs, err)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncOutputSecret syncs the Secret of the output in view, returning its new status. When poll
+// is set a change in the values is counted in the rotation generation of the Secret.
+func (c *Controller) syncOutputSecret(view *akv.AzureKeyVaultSecret, service vault.Service, forceSync, poll bool) (akv.AzureKeyVaultOutputStatus, error) {
+	name := view.Spec.Output.Secret.Name
+	status := newOutputStatus(view, outputKindSecret, name)
+
+	existing, err := c.secretsLister.Secrets(view.Namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return status, err
+	}
+
+	// only a secret synced before can have been deleted, see applySecretRecreatePolicy
+	deleted := meta.FindStatusCondition(status.Conditions, ConditionTypeOutputDeleted)
+	if errors.IsNotFound(err) && view.Status.SecretName == name {
+		condition, recreate := deletedSecretCondition(view.Spec.Output.Secret, deleted, view.Generation, forceSync)
+		if condition != nil {
+			condition.ObservedGeneration = view.Generation
+			meta.SetStatusCondition(&status.Conditions, *condition)
+		}
+		if !recreate {
+			return status, nil
+		}
+	} else if deleted != nil && deleted.Status == metav1.ConditionTrue {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               ConditionTypeOutputDeleted,
+			Status:             metav1.ConditionFalse,
+			Reason:             "OutputExists",
+			Message:            fmt.Sprintf("Secret '%s' is synced", name),
+			ObservedGeneration: view.Generation,
+		})
+	}
+
+	values, err := c.getSecretFromVaultService(view, service)
+	if isKeyCollision(err) || isKeyMismatch(err) {
+		return status, err
+	}
+	if err != nil {
+		return status, newAzureKeyVaultError(view, err)
+	}
+	hash := getHashOfByteValues(values)
+	if migrated, ok := migrateSecretHash(view, values); ok {
+		view = migrated
+		status.Hash = hash
+	}
+	valuesChanged := existing != nil && hasAzureKeyVaultSecretChangedForSecret(view, values, existing)
+	if valuesChanged && isOwnedBy(existing, view) && isReportOnly(view, forceSync) {
+		c.setOutputRotationPending(view, &status, &pendingRotation{kind: outputKindSecret, name: name, hash: hash})
+		return status, nil
+	}
+	c.setOutputRotationPending(view, &status, nil)
+
+	switch {
+	case existing == nil:
+		failedWrite := c.hasFailedWrite(outputKindSecret, view.Namespace, name)
+		created := c.createNewSecret(view, values)
+		setRotationGeneration(created, status.RotationGeneration)
+		secret, err := c.writer().CreateSecret(context.TODO(), created)
+		if err != nil {
+			return status, err
+		}
+		klog.InfoS("secret created", "azurekeyvaultsecret", klog.KObj(view), "secret", klog.KObj(secret))
+		status.RotationGeneration = rotationGeneration(secret)
+		if view.Status.SecretName == name {
+			c.reportDriftRepaired(view, outputKindSecret, name, driftedKeys(diffSecretKeys(nil, nil, secret.Data)), failedWrite)
+		}
+	case valuesChanged || c.hasProvenanceAnnotationsChanged(view, existing) || c.hasCertificateAnnotationsChanged(view, existing):
+		updated, err := c.createNewSecretFromExisting(view, values, existing)
+		if err != nil {
+			return status, err
+		}
+		if poll && valuesChanged && status.Hash != "" && status.Hash != hash {
+			bumpRotationGeneration(updated, existing)
+		}
+		failedWrite := c.hasFailedWrite(outputKindSecret, view.Namespace, name)
+		secret, err := c.writer().PatchSecret(context.TODO(), existing, updated)
+		if err != nil {
+			return status, err
+		}
+		klog.InfoS("secret updated", "azurekeyvaultsecret", klog.KObj(view), "secret", klog.KObj(secret))
+		status.RotationGeneration = rotationGeneration(secret)
+		if valuesChanged && status.Hash == hash {
+			c.reportDriftRepaired(view, outputKindSecret, name, driftedKeys(diffSecretKeys(view.Status.SecretKeys, existing.Data, updated.Data)), failedWrite)
+		} else if status.Hash != "" && status.Hash != hash {
+			diff := diffSecretKeys(view.Status.SecretKeys, existing.Data, updated.Data)
+			status.LastRotationChanges = diff.String()
+			c.reportSecretRotated(view, secret, diff)
+		}
+	case !isOwnedBy(existing, view):
+		msg := fmt.Sprintf(MessageResourceExists, name)
+		c.recorder.Event(view, corev1.EventTypeWarning, ErrResourceExists, msg)
+		return status, fmt.Errorf(msg)
+	default:
+		return status, nil
+	}
+
+	status.Hash = hash
+	status.Keys = sortByteValueKeys(values)
+	return status, nil
+}
+
+// syncOutputConfigMap syncs the ConfigMap of the output in view, returning its new status. When
+// poll is set a change in the values is counted in the rotation generation of the ConfigMap.
+func (c *Controller) syncOutputConfigMap(view *akv.AzureKeyVaultSecret, service vault.Service, forceSync, poll bool) (akv.AzureKeyVaultOutputStatus, error) {
+	name := view.Spec.Output.ConfigMap.Name
+	status := newOutputStatus(view, outputKindConfigMap, name)
+
+	existing, err := c.configMapsLister.ConfigMaps(view.Namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return status, err
+	}
+
+	values, err := c.getConfigMapFromVaultService(view, service)
+	if isKeyCollision(err) {
+		return status, err
+	}
+	if err != nil {
+		return status, newAzureKeyVaultError(view, err)
+	}
+	hash := getHashOfStringValues(values)
+	if migrated, ok := migrateConfigMapHash(view, values); ok {
+		view = migrated
+		status.Hash = hash
+	}
+	valuesChanged := existing != nil && hasAzureKeyVaultSecretChangedForConfigMap(view, values, existing)
+	if valuesChanged && isOwnedBy(existing, view) && isReportOnly(view, forceSync) {
+		c.setOutputRotationPending(view, &status, &pendingRotation{kind: outputKindConfigMap, name: name, hash: hash})
+		return status, nil
+	}
+	c.setOutputRotationPending(view, &status, nil)
+
+	switch {
+	case existing == nil:
+		failedWrite := c.hasFailedWrite(outputKindConfigMap, view.Namespace, name)
+		created := c.createNewConfigMap(view, values)
+		setRotationGeneration(created, status.RotationGeneration)
+		cm, err := c.writer().CreateConfigMap(context.TODO(), created)
+		if err != nil {
+			return status, err
+		}
+		klog.InfoS("configmap created", "azurekeyvaultsecret", klog.KObj(view), "configmap", klog.KObj(cm))
+		status.RotationGeneration = rotationGeneration(cm)
+		if view.Status.ConfigMapName == name {
+			c.reportDriftRepaired(view, outputKindConfigMap, name, sortStringValueKeys(configMapValues(cm)), failedWrite)
+		}
+	case valuesChanged || c.hasProvenanceAnnotationsChanged(view, existing):
+		updated, err := c.createNewConfigMapFromExisting(view, values, existing)
+		if err != nil {
+			return status, err
+		}
+		if poll && valuesChanged && status.Hash != "" && status.Hash != hash {
+			bumpRotationGeneration(updated, existing)
+		}
+		failedWrite := c.hasFailedWrite(outputKindConfigMap, view.Namespace, name)
+		cm, err := c.writer().PatchConfigMap(context.TODO(), existing, updated)
+		if err != nil {
+			return status, err
+		}
+		klog.InfoS("configmap updated", "azurekeyvaultsecret", klog.KObj(view), "configmap", klog.KObj(cm))
+		status.RotationGeneration = rotationGeneration(cm)
+		if valuesChanged && status.Hash == hash {
+			c.reportDriftRepaired(view, outputKindConfigMap, name, changedConfigMapKeys(configMapValues(existing), configMapValues(updated)), failedWrite)
+		}
+	case !isOwnedBy(existing, view):
+		msg := fmt.Sprintf(MessageResourceExists, name)
+		c.recorder.Event(view, corev1.EventTypeWarning, ErrResourceExists, msg)
+		return status, fmt.Errorf(msg)
+	default:
+		return status, nil
+	}
+
+	status.Hash = hash
+	status.Keys = sortStringValueKeys(values)
+	return status, nil
+}
+
+// pruneOutput removes an output no longer written by akvs, like outputs removed from spec.outputs
+// or renamed in spec.output. The output is deleted if akvs is
+// its only owner, otherwise the keys written by akvs and its owner reference are removed.
+// Returns false if the output is gone or not owned by akvs.
+func (c *Controller) pruneOutput(akvs *akv.AzureKeyVaultSecret, status akv.AzureKeyVaultOutputStatus) (bool, error) {
+	klog.InfoS("pruning output", "azurekeyvaultsecret", klog.KObj(akvs), "kind", status.Kind, "name", status.Name)
+
+	switch status.Kind {
+	case outputKindSecret:
+		secret, err := c.secretsLister.Secrets(akvs.Namespace).Get(status.Name)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !isOwnedBy(secret, akvs) {
+			return false, nil
+		}
+		if !hasMultipleOwners(secret.GetOwnerReferences()) {
+			return true, c.writer().DeleteSecret(context.TODO(), akvs.Namespace, status.Name)
+		}
+
+		released := secret.DeepCopy()
+		released.OwnerReferences = removeOwnerRef(released.OwnerReferences, akvs)
+		for _, key := range status.Keys {
+			delete(released.Data, key)
+		}
+		_, err = c.writer().PatchSecret(context.TODO(), secret, released)
+		return true, err
+	case outputKindConfigMap:
+		cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(status.Name)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !isOwnedBy(cm, akvs) {
+			return false, nil
+		}
+		if !hasMultipleOwners(cm.GetOwnerReferences()) {
+			return true, c.writer().DeleteConfigMap(context.TODO(), akvs.Namespace, status.Name)
+		}
+
+		released := cm.DeepCopy()
+		released.OwnerReferences = removeOwnerRef(released.OwnerReferences, akvs)
+		for _, key := range status.Keys {
+			delete(released.Data, key)
+			delete(released.BinaryData, key)
+		}
+		_, err = c.writer().PatchConfigMap(context.TODO(), cm, released)
+		return true, err
+	default:
+		return false, fmt.Errorf("unknown output kind '%s'", status.Kind)
+	}
+}
+
+func removeOwnerRef(refs []metav1.OwnerReference, owner metav1.Object) []metav1.OwnerReference {
+	var kept []metav1.OwnerReference
+	for _, ref := range refs {
+		if ref.Kind == "AzureKeyVaultSecret" && ref.Name == owner.GetName() && ref.UID == owner.GetUID() {
+			continue
+		}
+		kept = append(kept, ref)
+	}
+	return kept
+}
+
+// deleteOutputsValues removes the values written to each output in spec.outputs, when akvs
+// is deleted, except outputs with reclaimPolicy Retain
+func (c *Controller) deleteOutputsValues(akvs *akv.AzureKeyVaultSecret) error {
+	var errs []error
+	for _, output := range akvs.Spec.Outputs {
+		view := outputView(akvs, output)
+		if output.Secret.Name != "" && !isSecretRetained(output) {
+			errs = append(errs, c.deleteKubernetesSecretValues(view))
+		}
+		if output.ConfigMap.Name != "" && !isConfigMapRetained(output) {
+			errs = append(errs, c.deleteKubernetesConfigMapValues(view))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,287 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+type countingVaultService struct {
+	fakeVaultService
+	secretReads int
+}
+
+func (f *countingVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	f.secretReads++
+	return f.fakeVaultService.GetSecretWithMetadata(secret)
+}
+
+// outputsController returns a controller for akvs, with objects in the Secret lister. Secrets
+// written through the client are reflected in the lister, like an informer would.
+func outputsController(t *testing.T, akvs *akv.AzureKeyVaultSecret, service *countingVaultService, objects ...*corev1.Secret) (*Controller, *k8sfake.Clientset) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	kubeclient := k8sfake.NewSimpleClientset()
+	kubeclient.PrependReactor("*", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled, obj, err := k8stesting.ObjectReaction(kubeclient.Tracker())(action)
+		if err != nil || action.GetVerb() == "get" || action.GetVerb() == "list" || action.GetVerb() == "watch" {
+			return handled, obj, err
+		}
+		list, listErr := kubeclient.Tracker().List(corev1.SchemeGroupVersion.WithResource("secrets"), corev1.SchemeGroupVersion.WithKind("Secret"), "")
+		if listErr != nil {
+			return handled, obj, listErr
+		}
+		var secrets []interface{}
+		for i := range list.(*corev1.SecretList).Items {
+			secrets = append(secrets, &list.(*corev1.SecretList).Items[i])
+		}
+		return handled, obj, indexer.Replace(secrets, "")
+	})
+	for _, obj := range objects {
+		if _, err := kubeclient.CoreV1().Secrets(obj.Namespace).Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Controller{
+		kubeclientset:    kubeclient,
+		akvsClient:       akvfake.NewSimpleClientset(akvs),
+		recorder:         record.NewFakeRecorder(10),
+		secretsLister:    corelisters.NewSecretLister(indexer),
+		configMapsLister: corelisters.NewConfigMapLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		vaultService:     service,
+		clock:            &fakeClock{},
+		options:          &Options{},
+	}
+	return c, kubeclient
+}
+
+func outputsSecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Generation = 1
+	akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "first", DataKey: "password"}},
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "second", DataKey: "PASSWORD"}},
+	}
+	return akvs
+}
+
+func getStatus(t *testing.T, c *Controller, akvs *akv.AzureKeyVaultSecret) *akv.AzureKeyVaultSecret {
+	updated, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Get(context.TODO(), akvs.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updated
+}
+
+func TestSyncOutputsReadsAzureOnce(t *testing.T) {
+	akvs := outputsSecret()
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	c, kubeclient := outputsController(t, akvs, service)
+
+	if err := c.syncOutputs(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+	if service.secretReads != 1 {
+		t.Errorf("expected secret to be read once from azure, but was read %d times", service.secretReads)
+	}
+
+	for name, key := range map[string]string{"first": "password", "second": "PASSWORD"} {
+		secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(secret.Data[key]) != "some-value" {
+			t.Errorf("expected secret '%s' to have key '%s', but got %v", name, key, secret.Data)
+		}
+		if !isOwnedBy(secret, akvs) {
+			t.Errorf("expected secret '%s' to be owned by akvs", name)
+		}
+	}
+
+	updated := getStatus(t, c, akvs)
+	if len(updated.Status.Outputs) != 2 {
+		t.Fatalf("expected status of 2 outputs, but got %v", updated.Status.Outputs)
+	}
+	for _, status := range updated.Status.Outputs {
+		if status.Kind != outputKindSecret || status.Hash == "" {
+			t.Errorf("expected hash in status of secret output, but got %v", status)
+		}
+		if !meta.IsStatusConditionTrue(status.Conditions, ConditionTypeOutputSynced) {
+			t.Errorf("expected output '%s' to be synced", status.Name)
+		}
+	}
+}
+
+func TestSyncOutputsReportsFailurePerOutput(t *testing.T) {
+	akvs := outputsSecret()
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	notOwned := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: akvs.Namespace}, Type: corev1.SecretTypeTLS}
+	c, _ := outputsController(t, akvs, service, notOwned)
+
+	if err := c.syncOutputs(akvs, false); err == nil {
+		t.Fatal("expected error syncing secret not owned by akvs")
+	}
+
+	updated := getStatus(t, c, akvs)
+	first := findOutputStatus(updated.Status.Outputs, outputKindSecret, "first")
+	second := findOutputStatus(updated.Status.Outputs, outputKindSecret, "second")
+	if first == nil || meta.IsStatusConditionTrue(first.Conditions, ConditionTypeOutputSynced) {
+		t.Errorf("expected output 'first' to fail, but got %v", first)
+	}
+	if second == nil || !meta.IsStatusConditionTrue(second.Conditions, ConditionTypeOutputSynced) {
+		t.Errorf("expected output 'second' to be synced, but got %v", second)
+	}
+}
+
+func TestSyncOutputsPrunesRemovedOutputs(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Status.Outputs = []akv.AzureKeyVaultOutputStatus{
+		{Kind: outputKindSecret, Name: "removed", Keys: []string{"password"}},
+		{Kind: outputKindSecret, Name: "shared", Keys: []string{"password"}},
+	}
+	ownerRef := *newOwnerRef(akvs, akv.SchemeGroupVersion.WithKind("AzureKeyVaultSecret"))
+	otherRef := metav1.OwnerReference{Kind: "AzureKeyVaultSecret", Name: "other", UID: types.UID("other-uid")}
+	removed := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "removed", Namespace: akvs.Namespace, OwnerReferences: []metav1.OwnerReference{ownerRef}},
+		Data:       map[string][]byte{"password": []byte("some-value")},
+	}
+	shared := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: akvs.Namespace, OwnerReferences: []metav1.OwnerReference{ownerRef, otherRef}},
+		Data:       map[string][]byte{"password": []byte("some-value"), "other": []byte("other-value")},
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	c, kubeclient := outputsController(t, akvs, service, removed, shared)
+
+	if err := c.syncOutputs(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "removed", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected secret only owned by akvs to be deleted, but got %v", err)
+	}
+
+	secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "shared", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["password"]; ok || isOwnedBy(secret, akvs) {
+		t.Errorf("expected keys and owner reference of akvs to be removed, but got %v", secret)
+	}
+	if len(secret.Data) != 1 || len(secret.OwnerReferences) != 1 {
+		t.Errorf("expected other owner to be kept, but got %v", secret)
+	}
+
+	updated := getStatus(t, c, akvs)
+	if findOutputStatus(updated.Status.Outputs, outputKindSecret, "removed") != nil || findOutputStatus(updated.Status.Outputs, outputKindSecret, "shared") != nil {
+		t.Errorf("expected pruned outputs to be removed from status, but got %v", updated.Status.Outputs)
+	}
+}
+
+func TestSyncOutputsRejectsDuplicates(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.Outputs[1].Secret.Name = "first"
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "some-value"}}
+	c, _ := outputsController(t, akvs, service)
+
+	err := c.syncOutputs(akvs, false)
+	if err == nil || !strings.Contains(err.Error(), "more than one output") {
+		t.Errorf("expected error for duplicate output, but got %v", err)
+	}
+}
+
+func TestSyncOutputsSplitsKeys(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+	akvs.Spec.Vault.Object.ContentType = akv.AzureKeyVaultObjectContentTypeJSON
+	akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "app", Keys: []string{"username", "password"}}},
+		{ConfigMap: akv.AzureKeyVaultOutputConfigMap{Name: "settings", Keys: []string{"host"}}},
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: `{"username":"admin","password":"s3cret","host":"db.local"}`}}
+	c, kubeclient := outputsController(t, akvs, service)
+
+	if err := c.syncOutputs(akvs, false); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) != 2 || string(secret.Data["username"]) != "admin" || string(secret.Data["password"]) != "s3cret" {
+		t.Errorf("expected secret with username and password only, but got %v", secret.Data)
+	}
+	cm, err := kubeclient.CoreV1().ConfigMaps(akvs.Namespace).Get(context.TODO(), "settings", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 1 || cm.Data["host"] != "db.local" {
+		t.Errorf("expected configmap with host only, but got %v", cm.Data)
+	}
+
+	updated := getStatus(t, c, akvs)
+	for kind, keys := range map[string]string{outputKindSecret: "password,username", outputKindConfigMap: "host"} {
+		var name string
+		for _, status := range updated.Status.Outputs {
+			if status.Kind == kind {
+				name = status.Name
+				if strings.Join(status.Keys, ",") != keys || status.Hash == "" {
+					t.Errorf("expected status of %s '%s' with keys %s and a hash, but got %v", kind, status.Name, keys, status)
+				}
+			}
+		}
+		if name == "" {
+			t.Errorf("expected status of %s output", kind)
+		}
+	}
+}
+
+func TestSyncOutputsFailsOnMissingKey(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+	akvs.Spec.Vault.Object.ContentType = akv.AzureKeyVaultObjectContentTypeJSON
+	akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+		{Secret: akv.AzureKeyVaultOutputSecret{Name: "app", Keys: []string{"token"}}},
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: `{"username":"admin"}`}}
+	c, kubeclient := outputsController(t, akvs, service)
+
+	if err := c.syncOutputs(akvs, false); err == nil || !strings.Contains(err.Error(), "key 'token' in keys") {
+		t.Fatalf("expected error for missing key, but got %v", err)
+	}
+	if _, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "app", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected no secret to be written, but got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// fieldManager is the field manager of the writes by the controller, telling them apart from
+// changes by other controllers in the managed fields of outputs
+const fieldManager = "akv2k8s-controller"
+
+// managedAnnotationPrefix is the prefix of the annotations set by the controller, which are
+// removed from output Secrets when no longer set
+const managedAnnotationPrefix = "akv2k8s.io/"
+
+// outputWriter writes the Secrets and ConfigMaps synced from Azure Key Vault
+type outputWriter interface {
+	CreateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error)
+	PatchSecret(ctx context.Context, existing, secret *corev1.Secret) (*corev1.Secret, error)
+	DeleteSecret(ctx context.Context, namespace, name string) error
+	CreateConfigMap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+	PatchConfigMap(ctx context.Context, existing, cm *corev1.ConfigMap) (*corev1.ConfigMap, error)
+	DeleteConfigMap(ctx context.Context, namespace, name string) error
+}
+
+// apiOutputWriter applies outputs using the Kubernetes API
+type apiOutputWriter struct {
+	client kubernetes.Interface
+}
+
+func (w *apiOutputWriter) CreateSecret(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	return w.client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{FieldManager: fieldManager})
+}
+
+// PatchSecret changes existing, as last read by the controller, into secret with a strategic
+// merge patch of the fields managed by the controller. Fields set by other controllers since,
+// like annotations, are kept, and the patch is retried on conflicts.
+func (w *apiOutputWriter) PatchSecret(ctx context.Context, existing, secret *corev1.Secret) (*corev1.Secret, error) {
+	patch, err := secretPatch(existing, secret)
+	if err != nil {
+		return nil, err
+	}
+	if string(patch) == "{}" {
+		return existing, nil
+	}
+
+	var patched *corev1.Secret
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		patched, err = w.client.CoreV1().Secrets(secret.Namespace).Patch(ctx, secret.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+	return patched, err
+}
+
+func (w *apiOutputWriter) DeleteSecret(ctx context.Context, namespace, name string) error {
+	return w.client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (w *apiOutputWriter) CreateConfigMap(ctx context.Context, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return w.client.CoreV1().ConfigMaps(cm.Namespace).Create(ctx, cm, metav1.CreateOptions{FieldManager: fieldManager})
+}
+
+// PatchConfigMap changes existing, as last read by the controller, into cm like PatchSecret
+func (w *apiOutputWriter) PatchConfigMap(ctx context.Context, existing, cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	patch, err := configMapPatch(existing, cm)
+	if err != nil {
+		return nil, err
+	}
+	if string(patch) == "{}" {
+		return existing, nil
+	}
+
+	var patched *corev1.ConfigMap
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		patched, err = w.client.CoreV1().ConfigMaps(cm.Namespace).Patch(ctx, cm.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+	return patched, err
+}
+
+func (w *apiOutputWriter) DeleteConfigMap(ctx context.Context, namespace, name string) error {
+	return w.client.CoreV1().ConfigMaps(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+// secretPatch returns the strategic merge patch changing the fields of existing managed by the
+// controller into those of secret
+func secretPatch(existing, secret *corev1.Secret) ([]byte, error) {
+	original, err := json.Marshal(managedSecretFields(existing, secret))
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(managedSecretFields(secret, secret))
+	if err != nil {
+		return nil, err
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(original, modified, corev1.Secret{})
+	if err != nil {
+		return nil, err
+	}
+	return deleteRemovedKeys(patch, managedSecretFields(existing, secret).ObjectMeta)
+}
+
+// configMapPatch returns the strategic merge patch changing the fields of existing managed by
+// the controller into those of cm
+func configMapPatch(existing, cm *corev1.ConfigMap) ([]byte, error) {
+	original, err := json.Marshal(managedConfigMapFields(existing, cm))
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(managedConfigMapFields(cm, cm))
+	if err != nil {
+		return nil, err
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(original, modified, corev1.ConfigMap{})
+	if err != nil {
+		return nil, err
+	}
+	return deleteRemovedKeys(patch, managedConfigMapFields(existing, cm).ObjectMeta)
+}
+
+// deleteRemovedKeys replaces the removal of all labels or annotations in patch, made when none
+// of the managed ones are left, with the removal of each managed key in original, as the
+// other keys of the map are set by other controllers and must be kept
+func deleteRemovedKeys(patch []byte, original metav1.ObjectMeta) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, err
+	}
+	metadata, ok := fields["metadata"].(map[string]interface{})
+	if !ok {
+		return patch, nil
+	}
+
+	for field, values := range map[string]map[string]string{"labels": original.Labels, "annotations": original.Annotations} {
+		if value, ok := metadata[field]; !ok || value != nil {
+			continue
+		}
+		removed := make(map[string]interface{}, len(values))
+		for k := range values {
+			removed[k] = nil
+		}
+		metadata[field] = removed
+	}
+	return json.Marshal(fields)
+}
+
+// managedSecretFields returns the fields of secret written by the controller: the data, type
+// and owner references, and the labels and annotations set in desired or by akv2k8s
+func managedSecretFields(secret, desired *corev1.Secret) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:          managedKeys(secret.Labels, desired.Labels, ""),
+			Annotations:     managedKeys(secret.Annotations, desired.Annotations, managedAnnotationPrefix),
+			OwnerReferences: secret.OwnerReferences,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+}
+
+// managedConfigMapFields returns the fields of cm written by the controller, like
+// managedSecretFields for Secrets
+func managedConfigMapFields(cm, desired *corev1.ConfigMap) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:          managedKeys(cm.Labels, desired.Labels, ""),
+			Annotations:     managedKeys(cm.Annotations, desired.Annotations, managedAnnotationPrefix),
+			OwnerReferences: cm.OwnerReferences,
+		},
+		Data:       cm.Data,
+		BinaryData: cm.BinaryData,
+	}
+}
+
+// managedKeys returns the entries of values with a key in desired or, unless empty, prefix
+func managedKeys(values, desired map[string]string, prefix string) map[string]string {
+	managed := make(map[string]string)
+	for k, v := range values {
+		if _, ok := desired[k]; ok || (prefix != "" && strings.HasPrefix(k, prefix)) {
+			managed[k] = v
+		}
+	}
+	return managed
+}
+
+// writer returns the outputWriter of the controller, applying outputs using the
+// Kubernetes API unless another writer is configured
+func (c *Controller) writer() outputWriter {
+	var writer outputWriter = &apiOutputWriter{client: c.kubeclientset}
+	if c.outputWriter != nil {
+		writer = c.outputWriter
+	}
+	return &failureTrackingWriter{outputWriter: writer, failed: &c.failedWrites}
+}
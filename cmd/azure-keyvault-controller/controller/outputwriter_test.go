@@ -0,0 +1,161 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// externallyAnnotatedSecret returns the output Secret as last read by the controller, and a
+// client where another controller has since annotated and labeled the Secret
+func externallyAnnotatedSecret() (*corev1.Secret, *k8sfake.Clientset) {
+	existing := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-secret",
+			Namespace:   "team-a",
+			Labels:      map[string]string{"app": "my-app"},
+			Annotations: map[string]string{AnnotationSourceObjectVersion: "v1"},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"password": []byte("old"), "stale": []byte("value")},
+	}
+	live := existing.DeepCopy()
+	live.Annotations["cert-manager.io/issuer-name"] = "my-issuer"
+	live.Labels["controller.cert-manager.io/fao"] = "true"
+	return existing, k8sfake.NewSimpleClientset(live)
+}
+
+func TestPatchSecretKeepsExternalFields(t *testing.T) {
+	existing, client := externallyAnnotatedSecret()
+	desired := existing.DeepCopy()
+	desired.Annotations = map[string]string{AnnotationSourceObjectVersion: "v2"}
+	desired.Data = map[string][]byte{"password": []byte("new")}
+
+	w := &apiOutputWriter{client: client}
+	patched, err := w.PatchSecret(context.TODO(), existing, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if patched.Annotations["cert-manager.io/issuer-name"] != "my-issuer" || patched.Labels["controller.cert-manager.io/fao"] != "true" {
+		t.Errorf("expected fields of the other controller to be kept, but got annotations %v and labels %v", patched.Annotations, patched.Labels)
+	}
+	if patched.Annotations[AnnotationSourceObjectVersion] != "v2" {
+		t.Errorf("expected managed annotation to be updated, but got %v", patched.Annotations)
+	}
+	if string(patched.Data["password"]) != "new" {
+		t.Errorf("expected managed key to be updated, but got '%s'", patched.Data["password"])
+	}
+	if _, ok := patched.Data["stale"]; ok {
+		t.Error("expected key removed by the controller to be removed")
+	}
+}
+
+func TestPatchSecretRemovesManagedAnnotations(t *testing.T) {
+	existing, client := externallyAnnotatedSecret()
+	desired := existing.DeepCopy()
+	desired.Annotations = nil
+
+	w := &apiOutputWriter{client: client}
+	patched, err := w.PatchSecret(context.TODO(), existing, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := patched.Annotations[AnnotationSourceObjectVersion]; ok {
+		t.Error("expected annotation no longer set by akv2k8s to be removed")
+	}
+	if patched.Annotations["cert-manager.io/issuer-name"] != "my-issuer" {
+		t.Errorf("expected annotation of the other controller to be kept, but got %v", patched.Annotations)
+	}
+}
+
+func TestPatchSecretRetriesOnConflict(t *testing.T) {
+	existing, client := externallyAnnotatedSecret()
+	conflicts := 0
+	client.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts < 2 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "secrets"}, existing.Name, nil)
+		}
+		return false, nil, nil
+	})
+	desired := existing.DeepCopy()
+	desired.Data = map[string][]byte{"password": []byte("new")}
+
+	w := &apiOutputWriter{client: client}
+	patched, err := w.PatchSecret(context.TODO(), existing, desired)
+	if err != nil {
+		t.Fatalf("expected conflicts to be retried, but got %v", err)
+	}
+	if conflicts != 2 || string(patched.Data["password"]) != "new" {
+		t.Errorf("expected secret to be patched after 2 conflicts, but got %d conflicts and data %v", conflicts, patched.Data)
+	}
+}
+
+func TestPatchSecretSkipsUnchanged(t *testing.T) {
+	existing, client := externallyAnnotatedSecret()
+
+	w := &apiOutputWriter{client: client}
+	if _, err := w.PatchSecret(context.TODO(), existing, existing.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("expected no request for an unchanged secret, but got %v", client.Actions())
+	}
+}
+
+func TestPatchConfigMapKeepsExternalFields(t *testing.T) {
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-configmap",
+			Namespace:   "team-a",
+			Annotations: map[string]string{AnnotationSourceObjectVersion: "v1"},
+		},
+		Data: map[string]string{"password": "old", "stale": "value"},
+	}
+	live := existing.DeepCopy()
+	live.Labels = map[string]string{"app.kubernetes.io/managed-by": "other"}
+	client := k8sfake.NewSimpleClientset(live)
+	desired := existing.DeepCopy()
+	desired.Annotations = map[string]string{AnnotationSourceObjectVersion: "v2"}
+	desired.Data = map[string]string{"password": "new"}
+
+	w := &apiOutputWriter{client: client}
+	patched, err := w.PatchConfigMap(context.TODO(), existing, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if patched.Labels["app.kubernetes.io/managed-by"] != "other" {
+		t.Errorf("expected label of the other controller to be kept, but got %v", patched.Labels)
+	}
+	if patched.Annotations[AnnotationSourceObjectVersion] != "v2" || patched.Data["password"] != "new" {
+		t.Errorf("expected managed fields to be updated, but got annotations %v and data %v", patched.Annotations, patched.Data)
+	}
+	if _, ok := patched.Data["stale"]; ok {
+		t.Error("expected key removed by the controller to be removed")
+	}
+}
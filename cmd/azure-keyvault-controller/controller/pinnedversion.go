@@ -0,0 +1,30 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+// isPinnedVersionSynced tells if akvs reads a fixed object version already synced to its
+// outputs. The value of an object version never changes in Azure Key Vault, so polling it is
+// pointless. Changes to the spec, or to where the version is read from, are synced through the
+// AzureKeyVaultSecret queue, which does not check this.
+func isPinnedVersionSynced(akvs *akv.AzureKeyVaultSecret) bool {
+	version := akvs.Spec.Vault.Object.Version
+	return version != "" && version != akv.AzureKeyVaultObjectVersionPrevious && version == akvs.Status.VaultObjectVersion
+}
@@ -0,0 +1,80 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+func TestIsPinnedVersionSynced(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		synced  string
+		pinned  bool
+	}{
+		{"latest", "", "", false},
+		{"not synced yet", "abc", "", false},
+		{"synced", "abc", "abc", true},
+		{"version changed", "def", "abc", false},
+		{"previous", akv.AzureKeyVaultObjectVersionPrevious, akv.AzureKeyVaultObjectVersionPrevious, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := secret()
+			akvs.Spec.Vault.Object.Version = tt.version
+			akvs.Status.VaultObjectVersion = tt.synced
+			if pinned := isPinnedVersionSynced(akvs); pinned != tt.pinned {
+				t.Errorf("expected %t, but got %t", tt.pinned, pinned)
+			}
+		})
+	}
+}
+
+func TestSyncOutputsRecordsPinnedVersion(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.Vault.Object.Version = "abc"
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "value"}}
+	c, _ := outputsController(t, akvs, service)
+
+	if err := c.syncOutputs(akvs, true); err != nil {
+		t.Fatal(err)
+	}
+	updated := getStatus(t, c, akvs)
+	if updated.Status.VaultObjectVersion != "abc" {
+		t.Errorf("expected version 'abc' in status, but got '%s'", updated.Status.VaultObjectVersion)
+	}
+	if !isPinnedVersionSynced(updated) {
+		t.Error("expected pinned version to be synced")
+	}
+
+	// unpinning reads the latest version again
+	reads := service.secretReads
+	updated.Spec.Vault.Object.Version = ""
+	if err := c.syncOutputs(updated, true); err != nil {
+		t.Fatal(err)
+	}
+	if service.secretReads == reads {
+		t.Error("expected the latest version to be read after unpinning")
+	}
+	if version := getStatus(t, c, akvs).Status.VaultObjectVersion; version != "" {
+		t.Errorf("expected no version in status, but got '%s'", version)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// reportSecretRotated records an event and logs that secret was updated with a change
+// from Azure Key Vault, naming the changed keys and the pods using the secret. Looking up
+// pods is best effort.
+func (c *Controller) reportSecretRotated(akvs *akv.AzureKeyVaultSecret, secret *corev1.Secret, diff keyDiff) {
+	pods, err := c.podsUsingSecret(secret.Namespace, secret.Name)
+	if err != nil {
+		klog.ErrorS(err, "failed to find pods using secret", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+	}
+
+	message := MessageAzureKeyVaultSecretSyncedWithAzureKeyVault
+	if !diff.isEmpty() {
+		message = fmt.Sprintf("%s (%s)", message, diff)
+	}
+
+	if len(pods) == 0 {
+		c.recorder.Event(akvs, corev1.EventTypeNormal, SecretRotated, message)
+		klog.InfoS("secret changed - any resources (like pods) using this secret must be restarted to pick up the new value - details: https://github.com/kubernetes/kubernetes/issues/22368", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret), "added", diff.added, "modified", diff.modified, "removed", diff.removed)
+		return
+	}
+
+	reported := pods
+	if len(reported) > c.options.MaxReportedPods {
+		reported = reported[:c.options.MaxReportedPods]
+	}
+
+	c.recorder.Eventf(akvs, corev1.EventTypeNormal, SecretRotated, "%s - %d pod(s) using the secret must be restarted to pick up the new value: %s", message, len(pods), formatPodNames(reported, len(pods)))
+	klog.InfoS("secret changed - pods using this secret must be restarted to pick up the new value - details: https://github.com/kubernetes/kubernetes/issues/22368", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret), "added", diff.added, "modified", diff.modified, "removed", diff.removed, "pods", reported, "podCount", len(pods))
+}
+
+// reportConfigMapRotated records an event and logs that cm was updated with a change in diff
+func (c *Controller) reportConfigMapRotated(akvs *akv.AzureKeyVaultSecret, cm *corev1.ConfigMap, diff keyDiff) {
+	c.recorder.Event(akvs, corev1.EventTypeNormal, SecretRotated, fmt.Sprintf("%s (%s)", MessageAzureKeyVaultSecretSyncedWithAzureKeyVault, diff))
+	klog.InfoS("configmap changed - any resources (like pods) using this configmap must be restarted to pick up the new value - details: https://github.com/kubernetes/kubernetes/issues/22368", "azurekeyvaultsecret", klog.KObj(akvs), "configmap", klog.KObj(cm), "added", diff.added, "modified", diff.modified, "removed", diff.removed)
+}
+
+// podsUsingSecret returns the sorted names of pods in namespace referencing the secret
+// in volumes, env or envFrom. The pod informer cache is used, so no pods are
+// returned unless pod lookup is enabled.
+func (c *Controller) podsUsingSecret(namespace, name string) ([]string, error) {
+	pods, err := c.listPods(namespace, func(pod *corev1.Pod) bool {
+		return podUsesSecret(pod, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// listPods returns pods in namespace matching filter from the pod informer cache,
+// if pod lookup is enabled
+func (c *Controller) listPods(namespace string, filter func(*corev1.Pod) bool) ([]*corev1.Pod, error) {
+	if c.podsLister == nil {
+		return nil, nil
+	}
+
+	pods, err := c.podsLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []*corev1.Pod
+	for _, pod := range pods {
+		if filter(pod) {
+			matching = append(matching, pod)
+		}
+	}
+	return matching, nil
+}
+
+func podUsesSecret(pod *corev1.Pod, secretName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == secretName {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, container := range pod.Spec.InitContainers {
+		if containerUsesSecret(container.Env, container.EnvFrom, secretName) {
+			return true
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		if containerUsesSecret(container.Env, container.EnvFrom, secretName) {
+			return true
+		}
+	}
+	return false
+}
+
+func containerUsesSecret(env []corev1.EnvVar, envFrom []corev1.EnvFromSource, secretName string) bool {
+	for _, from := range envFrom {
+		if from.SecretRef != nil && from.SecretRef.Name == secretName {
+			return true
+		}
+	}
+	for _, e := range env {
+		if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name == secretName {
+			return true
+		}
+	}
+	return false
+}
+
+func podUsesConfigMap(pod *corev1.Pod, cmName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && volume.ConfigMap.Name == cmName {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil && source.ConfigMap.Name == cmName {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, container := range pod.Spec.InitContainers {
+		if containerUsesConfigMap(container.Env, container.EnvFrom, cmName) {
+			return true
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		if containerUsesConfigMap(container.Env, container.EnvFrom, cmName) {
+			return true
+		}
+	}
+	return false
+}
+
+func containerUsesConfigMap(env []corev1.EnvVar, envFrom []corev1.EnvFromSource, cmName string) bool {
+	for _, from := range envFrom {
+		if from.ConfigMapRef != nil && from.ConfigMapRef.Name == cmName {
+			return true
+		}
+	}
+	for _, e := range env {
+		if e.ValueFrom != nil && e.ValueFrom.ConfigMapKeyRef != nil && e.ValueFrom.ConfigMapKeyRef.Name == cmName {
+			return true
+		}
+	}
+	return false
+}
+
+func formatPodNames(names []string, total int) string {
+	formatted := strings.Join(names, ", ")
+	if total > len(names) {
+		formatted = fmt.Sprintf("%s (and %d more)", formatted, total-len(names))
+	}
+	return formatted
+}
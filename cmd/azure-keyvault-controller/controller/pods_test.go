@@ -0,0 +1,100 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func pod(name, namespace string, spec corev1.PodSpec) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       spec,
+	}
+}
+
+func TestPodsUsingSecret(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pods := []*corev1.Pod{
+		pod("volume", "default", corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "v", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "my-secret"}}}},
+		}),
+		pod("projected", "default", corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "v", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "my-secret"}}}},
+			}}}},
+		}),
+		pod("env-from", "default", corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "c", EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "my-secret"}}}}}},
+		}),
+		pod("env-init", "default", corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "c", Env: []corev1.EnvVar{{Name: "E", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "my-secret"}, Key: "k"}}}}}},
+		}),
+		pod("other-secret", "default", corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "v", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "other-secret"}}}},
+		}),
+		pod("other-namespace", "other", corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "v", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "my-secret"}}}},
+		}),
+	}
+	for _, p := range pods {
+		if err := indexer.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Controller{podsLister: corelisters.NewPodLister(indexer)}
+	names, err := c.podsUsingSecret("default", "my-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"env-from", "env-init", "projected", "volume"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected pods %v, but got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("expected pods %v, but got %v", expected, names)
+		}
+	}
+}
+
+func TestPodsUsingSecretWithoutPodLookup(t *testing.T) {
+	c := &Controller{}
+	names, err := c.podsUsingSecret("default", "my-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("expected no pods, but got %v", names)
+	}
+}
+
+func TestFormatPodNames(t *testing.T) {
+	if formatted := formatPodNames([]string{"a", "b"}, 2); formatted != "a, b" {
+		t.Errorf("unexpected format '%s'", formatted)
+	}
+	if formatted := formatPodNames([]string{"a", "b"}, 5); formatted != "a, b (and 3 more)" {
+		t.Errorf("unexpected format '%s'", formatted)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"math/rand"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// azurePollInterval returns how often akvs is polled for changes in Azure Key Vault, which is
+// spec.vault.object.pollInterval if set and the controller-wide AzurePollInterval otherwise
+func (c *Controller) azurePollInterval(akvs *akv.AzureKeyVaultSecret) time.Duration {
+	if hasPollInterval(akvs) {
+		return akvs.Spec.Vault.Object.PollInterval.Duration
+	}
+	if c.options == nil {
+		return 0
+	}
+	return c.options.AzurePollInterval
+}
+
+// hasPollInterval tells if akvs is polled on its own interval instead of the controller-wide one
+func hasPollInterval(akvs *akv.AzureKeyVaultSecret) bool {
+	return akvs.Spec.Vault.Object.PollInterval != nil && akvs.Spec.Vault.Object.PollInterval.Duration > 0
+}
+
+// nextAzurePollTime returns when akvs should next be polled for changes in Azure Key Vault,
+// or nil if the poll interval is unknown. Certificates polled relaxed are not due until
+// CertificateRelaxedPollInterval has passed or the renewal window starts, unless akvs has
+// its own poll interval.
+func (c *Controller) nextAzurePollTime(akvs *akv.AzureKeyVaultSecret) *metav1.Time {
+	interval := c.azurePollInterval(akvs)
+	if interval <= 0 {
+		return nil
+	}
+
+	now := c.clock.Now().Time
+	next := now.Add(interval)
+	if !hasPollInterval(akvs) && c.options.CertificateRelaxedPollInterval > 0 && akvs.Status.PredictedRenewalTime != nil {
+		windowStart := akvs.Status.PredictedRenewalTime.Add(-c.options.CertificateRenewalWindow)
+		relaxed := now.Add(c.options.CertificateRelaxedPollInterval)
+		if relaxed.After(windowStart) {
+			relaxed = windowStart
+		}
+		if relaxed.After(next) {
+			next = relaxed
+		}
+	}
+	return &metav1.Time{Time: next}
+}
+
+// isNextAzurePollDue checks the poll time recorded in the status of akvs. Resyncs do not
+// happen exactly at the recorded time, so a poll within half an interval of it is due. The
+// interval is the shorter of the poll interval of akvs and the controller-wide one.
+// Returns false for known if no poll time is recorded.
+func (c *Controller) isNextAzurePollDue(akvs *akv.AzureKeyVaultSecret) (due bool, known bool) {
+	interval := c.azurePollInterval(akvs)
+	if akvs.Status.NextAzurePollTime == nil || interval <= 0 {
+		return false, false
+	}
+	now := c.clock.Now().Time
+	if hasPollInterval(akvs) && akvs.Status.NextAzurePollTime.After(now.Add(interval)) {
+		// recorded before the poll interval was shortened
+		return true, true
+	}
+	if c.options != nil && c.options.AzurePollInterval > 0 && c.options.AzurePollInterval < interval {
+		interval = c.options.AzurePollInterval
+	}
+	return !now.Add(interval / 2).Before(akvs.Status.NextAzurePollTime.Time), true
+}
+
+// scheduleAzurePoll adds akvs to the azure key vault queue when its next poll is due, if
+// akvs has its own poll interval. Other AzureKeyVaultSecrets are polled on resync.
+func (c *Controller) scheduleAzurePoll(key string, akvs *akv.AzureKeyVaultSecret) {
+	if !hasPollInterval(akvs) || c.options == nil || c.options.DisableAzurePolling || akvs.DeletionTimestamp != nil {
+		return
+	}
+	interval := akvs.Spec.Vault.Object.PollInterval.Duration
+	klog.V(4).InfoS("scheduling poll of azure key vault", "azurekeyvaultsecret", klog.KObj(akvs), "interval", interval)
+	c.azureKeyVaultQueue.GetQueue().AddAfter(key, interval)
+}
+
+// scheduleStoredAzurePoll adds akvs to the azure key vault queue at the poll time recorded
+// in its status, instead of syncing it right away when the controller starts. Poll times
+// already passed are spread out over the next poll interval, to not poll everything at once.
+// Returns false if akvs has no recorded poll time and must be synced now.
+func (c *Controller) scheduleStoredAzurePoll(akvs *akv.AzureKeyVaultSecret) bool {
+	interval := c.azurePollInterval(akvs)
+	if c.options == nil || c.options.DisableAzurePolling || interval <= 0 {
+		return false
+	}
+	if akvs.Status.NextAzurePollTime == nil || akvs.DeletionTimestamp != nil {
+		return false
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(akvs)
+	if err != nil {
+		return false
+	}
+
+	delay := akvs.Status.NextAzurePollTime.Sub(c.clock.Now().Time)
+	if delay <= 0 {
+		delay = time.Duration(rand.Int63n(int64(interval)))
+	}
+
+	klog.V(4).InfoS("scheduling poll of azure key vault from status", "azurekeyvaultsecret", klog.KObj(akvs), "nextPoll", akvs.Status.NextAzurePollTime, "delay", delay)
+	c.azureKeyVaultQueue.GetQueue().AddAfter(key, delay)
+	return true
+}
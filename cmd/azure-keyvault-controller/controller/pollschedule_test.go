@@ -0,0 +1,189 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNextAzurePollTime(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock: &fakeClock{now: now},
+		options: &Options{
+			AzurePollInterval:              time.Minute,
+			CertificateRelaxedPollInterval: time.Hour,
+			CertificateRenewalWindow:       time.Hour,
+		},
+	}
+
+	akvs := secret()
+	if next := c.nextAzurePollTime(akvs); next == nil || !next.Time.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected next poll after one interval, got %v", next)
+	}
+
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(30 * 24 * time.Hour)}
+	if next := c.nextAzurePollTime(akvs); next == nil || !next.Time.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected next poll after relaxed interval far from renewal, got %v", next)
+	}
+
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(90 * time.Minute)}
+	if next := c.nextAzurePollTime(akvs); next == nil || !next.Time.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("expected next poll at start of renewal window, got %v", next)
+	}
+
+	c.options.AzurePollInterval = 0
+	if next := c.nextAzurePollTime(akvs); next != nil {
+		t.Errorf("expected no next poll without poll interval, got %v", next)
+	}
+}
+
+func TestAzureKeyVaultPollDueFromStatus(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock:   &fakeClock{now: now},
+		options: &Options{AzurePollInterval: time.Minute},
+	}
+
+	akvs := secret()
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(10 * time.Minute)}
+	if c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should not be due before recorded poll time")
+	}
+
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(10 * time.Second)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due within half an interval of recorded poll time")
+	}
+
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(-time.Hour)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due after recorded poll time")
+	}
+}
+
+func TestScheduleStoredAzurePoll(t *testing.T) {
+	now := time.Now()
+	c := &Controller{
+		clock:              &fakeClock{now: now},
+		options:            &Options{AzurePollInterval: 10 * time.Millisecond},
+		azureKeyVaultQueue: newPriorityQueue("AzureKeyVault", priorityLow, 1, 1, nil, false, nil),
+	}
+	defer c.azureKeyVaultQueue.GetQueue().ShutDown()
+
+	akvs := secret()
+	if c.scheduleStoredAzurePoll(akvs) {
+		t.Fatal("expected no schedule without recorded poll time")
+	}
+
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(time.Hour)}
+	if !c.scheduleStoredAzurePoll(akvs) {
+		t.Fatal("expected poll to be scheduled from recorded poll time")
+	}
+	if l := c.azureKeyVaultQueue.GetQueue().Len(); l != 0 {
+		t.Fatalf("expected poll in the future not to be queued yet, got %d items", l)
+	}
+
+	past := akvs.DeepCopy()
+	past.Name = "past"
+	past.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(-time.Hour)}
+	if !c.scheduleStoredAzurePoll(past) {
+		t.Fatal("expected passed poll time to be scheduled")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.azureKeyVaultQueue.GetQueue().Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected passed poll time to be queued within one interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.options.DisableAzurePolling = true
+	if c.scheduleStoredAzurePoll(past) {
+		t.Error("expected no schedule when polling is disabled")
+	}
+}
+
+func TestAzurePollIntervalOfObject(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock: &fakeClock{now: now},
+		options: &Options{
+			AzurePollInterval:              10 * time.Minute,
+			CertificateRelaxedPollInterval: time.Hour,
+			CertificateRenewalWindow:       time.Hour,
+		},
+	}
+
+	akvs := secret()
+	akvs.Spec.Vault.Object.PollInterval = &metav1.Duration{}
+	if next := c.nextAzurePollTime(akvs); next == nil || !next.Time.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("expected zero poll interval to fall back to controller-wide interval, got %v", next)
+	}
+
+	akvs.Spec.Vault.Object.PollInterval = &metav1.Duration{Duration: time.Minute}
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(30 * 24 * time.Hour)}
+	if next := c.nextAzurePollTime(akvs); next == nil || !next.Time.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected next poll after poll interval of object, got %v", next)
+	}
+
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(45 * time.Second)}
+	if c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should not be due more than half the poll interval of object before recorded poll time")
+	}
+
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(time.Hour)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due when recorded poll time is beyond the poll interval of object")
+	}
+
+	akvs.Spec.Vault.Object.PollInterval = &metav1.Duration{Duration: 24 * time.Hour}
+	akvs.Status.NextAzurePollTime = &metav1.Time{Time: now.Add(6 * time.Minute)}
+	if c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should not be due more than half the controller-wide interval before recorded poll time")
+	}
+}
+
+func TestScheduleAzurePoll(t *testing.T) {
+	c := &Controller{
+		clock:              &fakeClock{now: time.Now()},
+		options:            &Options{AzurePollInterval: time.Hour},
+		azureKeyVaultQueue: newPriorityQueue("AzureKeyVault", priorityLow, 1, 1, nil, false, nil),
+	}
+	defer c.azureKeyVaultQueue.GetQueue().ShutDown()
+
+	akvs := secret()
+	c.scheduleAzurePoll("default/akvs", akvs)
+	time.Sleep(20 * time.Millisecond)
+	if l := c.azureKeyVaultQueue.GetQueue().Len(); l != 0 {
+		t.Fatalf("expected no poll to be scheduled without poll interval of object, got %d items", l)
+	}
+
+	akvs.Spec.Vault.Object.PollInterval = &metav1.Duration{Duration: 10 * time.Millisecond}
+	c.scheduleAzurePoll("default/akvs", akvs)
+	deadline := time.Now().Add(time.Second)
+	for c.azureKeyVaultQueue.GetQueue().Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected poll to be queued after poll interval of object")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
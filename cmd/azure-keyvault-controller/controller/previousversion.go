@@ -0,0 +1,130 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ReasonPreviousVersionResolved is used when the symbolic version "previous" was resolved
+	ReasonPreviousVersionResolved = "PreviousVersionResolved"
+
+	// ReasonListVersionsFailed is used when the versions of the object could not be listed
+	ReasonListVersionsFailed = "ListVersionsFailed"
+
+	// ReasonNoPreviousVersion is used when the object has no enabled version before the current version
+	ReasonNoPreviousVersion = "NoPreviousVersion"
+)
+
+// resolvePreviousVersion returns akvs with the symbolic version "previous" in
+// spec.vault.object.version replaced by the concrete version in status.previousVersion.
+// The concrete version is kept for as long as it is enabled in Azure Key Vault, so
+// new versions added while rolling back do not change which version is synced.
+func (c *Controller) resolvePreviousVersion(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	if akvs.Spec.Vault.Object.Version != akv.AzureKeyVaultObjectVersionPrevious {
+		if akvs.Status.PreviousVersion == nil {
+			return akvs, nil
+		}
+		updated, err := c.setPreviousVersionStatus(akvs, nil)
+		if err != nil {
+			return nil, err
+		}
+		resolved := updated.DeepCopy()
+		akvs.Spec.DeepCopyInto(&resolved.Spec)
+		return resolved, nil
+	}
+
+	service, err := c.vaultServiceFor(akvs)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := service.GetObjectVersions(&akvs.Spec.Vault)
+	if err != nil {
+		return nil, c.previousVersionFailed(akvs, ReasonListVersionsFailed, fmt.Errorf("failed to list versions of object '%s' in azure key vault '%s', error: %+v", akvs.Spec.Vault.Object.Name, akvs.Spec.Vault.Identifier(), err))
+	}
+
+	previous := akvs.Status.PreviousVersion
+	if previous == nil || !isVersionEnabled(versions, previous.Version) {
+		resolved, current, err := vault.PreviousVersion(versions)
+		if err != nil {
+			return nil, c.previousVersionFailed(akvs, ReasonNoPreviousVersion, fmt.Errorf("failed to resolve previous version of object '%s', error: %+v", akvs.Spec.Vault.Object.Name, err))
+		}
+
+		previous = &akv.AzureKeyVaultPreviousVersion{
+			Version:        resolved.Version,
+			CurrentVersion: current.Version,
+			ResolvedTime:   c.clock.Now(),
+		}
+		klog.InfoS("resolved previous object version", "azurekeyvaultsecret", klog.KObj(akvs), "version", previous.Version, "currentVersion", previous.CurrentVersion)
+
+		if akvs, err = c.setPreviousVersionStatus(akvs, previous); err != nil {
+			return nil, err
+		}
+	}
+
+	updated, err := c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeVersionResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  ReasonPreviousVersionResolved,
+		Message: fmt.Sprintf("Using previous object version '%s', current version was '%s' when resolved", previous.Version, previous.CurrentVersion),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := updated.DeepCopy()
+	akvs.Spec.DeepCopyInto(&resolved.Spec)
+	resolved.Spec.Vault.Object.Version = previous.Version
+	return resolved, nil
+}
+
+// previousVersionFailed sets the VersionResolved condition and records an event
+// for err, and returns err
+func (c *Controller) previousVersionFailed(akvs *akv.AzureKeyVaultSecret, reason string, err error) error {
+	if _, statusErr := c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeVersionResolved,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: err.Error(),
+	}); statusErr != nil {
+		klog.ErrorS(statusErr, "failed to update status", "azurekeyvaultsecret", klog.KObj(akvs))
+	}
+	c.recorder.Event(akvs, corev1.EventTypeWarning, ErrVersionFrom, err.Error())
+	return err
+}
+
+func (c *Controller) setPreviousVersionStatus(akvs *akv.AzureKeyVaultSecret, previous *akv.AzureKeyVaultPreviousVersion) (*akv.AzureKeyVaultSecret, error) {
+	return c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.PreviousVersion = previous
+	})
+}
+
+func isVersionEnabled(versions []vault.ObjectVersion, version string) bool {
+	for _, v := range versions {
+		if v.Version == version {
+			return v.Enabled
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+func objectVersions(names ...string) []vault.ObjectVersion {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var versions []vault.ObjectVersion
+	for i, name := range names {
+		versions = append(versions, vault.ObjectVersion{Version: name, Enabled: true, Created: created.Add(time.Duration(i) * time.Hour)})
+	}
+	return versions
+}
+
+func TestResolvePreviousVersion(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Version = akv.AzureKeyVaultObjectVersionPrevious
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeVersions: objectVersions("v1", "v2", "v3")}}
+	c, _ := outputsController(t, akvs, service)
+
+	resolved, err := c.resolveObjectVersion(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Spec.Vault.Object.Version != "v2" {
+		t.Errorf("expected version 'v2', but got '%s'", resolved.Spec.Vault.Object.Version)
+	}
+
+	status := getStatus(t, c, akvs)
+	if status.Status.PreviousVersion == nil || status.Status.PreviousVersion.Version != "v2" || status.Status.PreviousVersion.CurrentVersion != "v3" {
+		t.Errorf("expected previous version 'v2' and current version 'v3' in status, but got %+v", status.Status.PreviousVersion)
+	}
+	condition := meta.FindStatusCondition(status.Status.Conditions, ConditionTypeVersionResolved)
+	if condition == nil || condition.Reason != ReasonPreviousVersionResolved {
+		t.Errorf("expected condition with reason '%s', but got %+v", ReasonPreviousVersionResolved, condition)
+	}
+
+	// a new version must not move the resolved version
+	service.fakeVersions = objectVersions("v1", "v2", "v3", "v4")
+	resolved, err = c.resolveObjectVersion(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Spec.Vault.Object.Version != "v2" {
+		t.Errorf("expected version to stay 'v2', but got '%s'", resolved.Spec.Vault.Object.Version)
+	}
+
+	// a disabled version is resolved again
+	service.fakeVersions[1].Enabled = false
+	resolved, err = c.resolveObjectVersion(getStatus(t, c, akvs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Spec.Vault.Object.Version != "v3" {
+		t.Errorf("expected version 'v3' after 'v2' was disabled, but got '%s'", resolved.Spec.Vault.Object.Version)
+	}
+}
+
+func TestResolvePreviousVersionMissing(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Version = akv.AzureKeyVaultObjectVersionPrevious
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeVersions: objectVersions("v1")}}
+	c, _ := outputsController(t, akvs, service)
+
+	if _, err := c.resolveObjectVersion(akvs); err == nil {
+		t.Fatal("expected error when there is no previous version")
+	}
+
+	condition := meta.FindStatusCondition(getStatus(t, c, akvs).Status.Conditions, ConditionTypeVersionResolved)
+	if condition == nil || condition.Reason != ReasonNoPreviousVersion {
+		t.Errorf("expected condition with reason '%s', but got %+v", ReasonNoPreviousVersion, condition)
+	}
+}
+
+func TestResolvePreviousVersionCleared(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Version = "v3"
+	akvs.Status.PreviousVersion = &akv.AzureKeyVaultPreviousVersion{Version: "v2"}
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+
+	resolved, err := c.resolveObjectVersion(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Spec.Vault.Object.Version != "v3" {
+		t.Errorf("expected version 'v3', but got '%s'", resolved.Spec.Vault.Object.Version)
+	}
+	if getStatus(t, c, akvs).Status.PreviousVersion != nil {
+		t.Error("expected previous version to be cleared from status")
+	}
+}
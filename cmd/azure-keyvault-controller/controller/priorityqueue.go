@@ -0,0 +1,367 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// priorityHigh is used for changes to AzureKeyVaultSecrets, like new resources
+	priorityHigh = "high"
+
+	// priorityLow is used for periodic polls of Azure Key Vault
+	priorityLow = "low"
+)
+
+var queueWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "akv2k8s_queue_wait_duration_seconds",
+	Help:    "How long items wait in queue before being processed, by priority",
+	Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+}, []string{"priority"})
+
+// timedQueue is a rate limiting queue keeping track of when keys were added,
+// to report how long they wait before being processed
+type timedQueue struct {
+	workqueue.RateLimitingInterface
+
+	mu    sync.Mutex
+	added map[interface{}]time.Time
+}
+
+func (q *timedQueue) Add(item interface{}) {
+	q.markAdded(item, time.Now())
+	q.RateLimitingInterface.Add(item)
+}
+
+func (q *timedQueue) AddAfter(item interface{}, duration time.Duration) {
+	q.markAdded(item, time.Now().Add(duration))
+	q.RateLimitingInterface.AddAfter(item, duration)
+}
+
+// markAdded keeps the first time an item was added, as adding an item already
+// in the queue does not move it
+func (q *timedQueue) markAdded(item interface{}, added time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.added[item]; !ok {
+		q.added[item] = added
+	}
+}
+
+// takeAdded returns and forgets when item was added, if known. Retries added
+// rate limited are not tracked.
+func (q *timedQueue) takeAdded(item interface{}) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := q.added[item]
+	delete(q.added, item)
+	return added
+}
+
+// priorityQueue is a queue of keys reconciled by a priorityWorker
+type priorityQueue struct {
+	name       string
+	priority   string
+	queue      *timedQueue
+	maxRetries int
+	reconcile  func(key string) error
+	throttle   *throttleBackoff
+
+	// items taken from queue, waiting for a worker
+	items chan queuedItem
+	// slots has a buffer of the max number of keys taken from queue at once, so no more
+	// than that many keys are processed at once even when the workers are shared
+	slots chan struct{}
+}
+
+type queuedItem struct {
+	key   interface{}
+	added time.Time
+	queue *priorityQueue
+	// slot is set when the item holds one of the slots of queue
+	slot bool
+}
+
+// done marks item as processed, releasing its slot
+func (item queuedItem) done() {
+	item.queue.queue.Done(item.key)
+	if item.slot {
+		<-item.queue.slots
+	}
+}
+
+// requeueRateLimiter returns a rate limiter backing off exponentially from RequeueBaseDelay up
+// to RequeueMaxDelay for each failed key, with an overall limit like
+// workqueue.DefaultControllerRateLimiter. Returns nil if the delays are not set.
+func (o *Options) requeueRateLimiter() workqueue.RateLimiter {
+	if o.RequeueBaseDelay <= 0 || o.RequeueMaxDelay <= 0 {
+		return nil
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(o.RequeueBaseDelay, o.RequeueMaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// newPriorityQueue returns a queue of keys reconciled using fn, by at most workers at once.
+// Failed keys are requeued using rateLimiter, or workqueue.DefaultControllerRateLimiter if
+// nil. If fair is set, keys are taken round-robin across namespaces instead of in the order
+// they were added.
+func newPriorityQueue(name, priority string, maxRetries, workers int, rateLimiter workqueue.RateLimiter, fair bool, fn func(key string) error) *priorityQueue {
+	var inner workqueue.Interface
+	if fair {
+		inner = newFairQueue(name)
+	}
+	return newPriorityQueueWithOrder(name, priority, maxRetries, workers, rateLimiter, inner, fn)
+}
+
+// newPriorityQueueWithOrder returns a priority queue handing out keys in the order
+// of inner, or in the order they were queued if inner is nil
+func newPriorityQueueWithOrder(name, priority string, maxRetries, workers int, rateLimiter workqueue.RateLimiter, inner workqueue.Interface, fn func(key string) error) *priorityQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if rateLimiter == nil {
+		rateLimiter = workqueue.DefaultControllerRateLimiter()
+	}
+	config := workqueue.RateLimitingQueueConfig{Name: name}
+	if inner != nil {
+		config.DelayingQueue = workqueue.NewDelayingQueueWithConfig(workqueue.DelayingQueueConfig{
+			Name:  name,
+			Queue: inner,
+		})
+	}
+
+	return &priorityQueue{
+		name:     name,
+		priority: priority,
+		queue: &timedQueue{
+			RateLimitingInterface: workqueue.NewRateLimitingQueueWithConfig(rateLimiter, config),
+			added:                 make(map[interface{}]time.Time),
+		},
+		maxRetries: maxRetries,
+		reconcile:  fn,
+		throttle:   newThrottleBackoff(name),
+		items:      make(chan queuedItem, workers),
+		slots:      make(chan struct{}, workers),
+	}
+}
+
+// GetQueue returns the underlying queue to add keys to
+func (q *priorityQueue) GetQueue() workqueue.RateLimitingInterface {
+	return q.queue
+}
+
+// feed moves keys from the queue to the items channel, until the queue is
+// shut down. A key is only taken from the queue once a slot is free.
+func (q *priorityQueue) feed(shutdown <-chan struct{}) {
+	for {
+		select {
+		case q.slots <- struct{}{}:
+		case <-shutdown:
+			return
+		}
+
+		key, quit := q.queue.Get()
+		if quit {
+			<-q.slots
+			return
+		}
+
+		select {
+		case q.items <- queuedItem{key: key, added: q.queue.takeAdded(key), queue: q, slot: true}:
+		case <-shutdown:
+			q.queue.Done(key)
+			<-q.slots
+			return
+		}
+	}
+}
+
+// priorityWorker runs a shared pool of workers reconciling keys from a high and
+// a low priority queue. Keys in the high priority queue are processed first, but
+// after fairness keys in a row from the high priority queue, a waiting key from the
+// low priority queue is processed, so it is never starved.
+type priorityWorker struct {
+	high        *priorityQueue
+	low         *priorityQueue
+	threadiness int
+	fairness    int
+
+	mu              sync.Mutex
+	consecutiveHigh int
+
+	// running tracks the goroutines started by Run
+	running sync.WaitGroup
+}
+
+func newPriorityWorker(high, low *priorityQueue, threadiness, fairness int) *priorityWorker {
+	if fairness < 1 {
+		fairness = 1
+	}
+	return &priorityWorker{
+		high:        high,
+		low:         low,
+		threadiness: threadiness,
+		fairness:    fairness,
+	}
+}
+
+// Run starts threadiness workers, processing keys until shutdown is closed. Use Wait
+// to wait for them to stop.
+func (w *priorityWorker) Run(shutdown <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	w.start(func() { w.high.feed(shutdown) })
+	w.start(func() { w.low.feed(shutdown) })
+
+	for i := 0; i < w.threadiness; i++ {
+		w.start(func() { wait.Until(func() { w.processQueues(shutdown) }, time.Second, shutdown) })
+	}
+
+	go func() {
+		<-shutdown
+
+		klog.V(1).InfoS("shutting down queues", "queues", []string{w.high.name, w.low.name})
+		w.high.queue.ShutDown()
+		w.low.queue.ShutDown()
+	}()
+}
+
+func (w *priorityWorker) start(fn func()) {
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		fn()
+	}()
+}
+
+// Wait waits for the workers started by Run to stop, after finishing the keys
+// they are processing
+func (w *priorityWorker) Wait() {
+	w.running.Wait()
+}
+
+func (w *priorityWorker) processQueues(shutdown <-chan struct{}) {
+	for {
+		item, ok := w.next(shutdown)
+		if !ok {
+			return
+		}
+		w.process(item)
+	}
+}
+
+// next returns the next item to process, waiting until one is ready
+func (w *priorityWorker) next(shutdown <-chan struct{}) (queuedItem, bool) {
+	first, second := w.high.items, w.low.items
+
+	w.mu.Lock()
+	if w.consecutiveHigh >= w.fairness {
+		first, second = second, first
+	}
+	w.mu.Unlock()
+
+	var item queuedItem
+	select {
+	case item = <-first:
+	default:
+		select {
+		case item = <-first:
+		case item = <-second:
+		case <-shutdown:
+			return queuedItem{}, false
+		}
+	}
+
+	w.mu.Lock()
+	if item.queue == w.high {
+		w.consecutiveHigh++
+	} else {
+		w.consecutiveHigh = 0
+	}
+	w.mu.Unlock()
+
+	if !item.added.IsZero() {
+		queueWaitDuration.WithLabelValues(item.queue.priority).Observe(time.Since(item.added).Seconds())
+	}
+	return item, true
+}
+
+// process reconciles item and requeues it on error, until maxRetries is reached.
+// Keys throttled by Azure Key Vault are requeued after backing off, without
+// counting against maxRetries.
+func (w *priorityWorker) process(item queuedItem) {
+	q := item.queue
+	defer item.done()
+
+	paniced, err := q.panicSafeReconcile(item.key.(string))
+	if err == nil {
+		q.queue.Forget(item.key)
+		q.throttle.forget(item.key)
+		return
+	}
+	klog.ErrorS(err, "failed to process key", "queue", q.name, "key", item.key)
+
+	if retryAfter, ok := throttledRetryAfter(err); ok && !paniced {
+		delay, failures := q.throttle.next(item.key, retryAfter)
+		throttledSyncs.WithLabelValues(q.name).Inc()
+		klog.V(4).InfoS("throttled by azure key vault, backing off", "queue", q.name, "key", item.key, "delay", delay, "retryAfter", retryAfter, "failures", failures)
+		q.queue.AddAfter(item.key, delay)
+		return
+	}
+
+	if !paniced && q.queue.NumRequeues(item.key) < q.maxRetries {
+		q.queue.AddRateLimited(item.key)
+		return
+	}
+
+	q.queue.Forget(item.key)
+	q.throttle.forget(item.key)
+	if !paniced {
+		utilruntime.HandleError(err)
+	}
+	klog.InfoS("dropping key out of the queue", "queue", q.name, "key", item.key, "error", err)
+}
+
+func (q *priorityQueue) panicSafeReconcile(key string) (paniced bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			for _, fn := range utilruntime.PanicHandlers {
+				fn(r)
+			}
+			paniced = true
+			err = fmt.Errorf("panic: %v [recovered]", r)
+		}
+	}()
+	err = q.reconcile(key)
+
+	return
+}
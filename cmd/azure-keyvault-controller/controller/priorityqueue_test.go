@@ -0,0 +1,147 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitForItems(t *testing.T, q *priorityQueue, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(q.items) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d items in %s", count, q.name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPriorityWorkerPrefersHighPriorityWithFairness(t *testing.T) {
+	noop := func(key string) error { return nil }
+	high := newPriorityQueue("high", priorityHigh, 5, 10, nil, false, noop)
+	low := newPriorityQueue("low", priorityLow, 5, 10, nil, false, noop)
+	worker := newPriorityWorker(high, low, 1, 2)
+
+	for _, key := range []string{"h1", "h2", "h3", "h4"} {
+		high.GetQueue().Add(key)
+	}
+	for _, key := range []string{"l1", "l2"} {
+		low.GetQueue().Add(key)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	defer high.queue.ShutDown()
+	defer low.queue.ShutDown()
+	go high.feed(stopCh)
+	go low.feed(stopCh)
+	waitForItems(t, high, 4)
+	waitForItems(t, low, 2)
+
+	expected := []string{"h1", "h2", "l1", "h3", "h4", "l2"}
+	for i, key := range expected {
+		item, ok := worker.next(stopCh)
+		if !ok {
+			t.Fatal("expected next item")
+		}
+		if item.key != key {
+			t.Errorf("expected item %d to be '%s', but got '%s'", i, key, item.key)
+		}
+		if item.added.IsZero() {
+			t.Errorf("expected time added to be known for '%s'", key)
+		}
+		item.done()
+	}
+}
+
+func TestPriorityWorkerRequeuesOnError(t *testing.T) {
+	calls := 0
+	failing := func(key string) error {
+		calls++
+		return errors.New("failed")
+	}
+	high := newPriorityQueue("high", priorityHigh, 1, 1, nil, false, failing)
+	low := newPriorityQueue("low", priorityLow, 1, 1, nil, false, failing)
+	worker := newPriorityWorker(high, low, 1, 1)
+
+	worker.process(queuedItem{key: "key", queue: high})
+	if calls != 1 {
+		t.Errorf("expected one call, but got %d", calls)
+	}
+	if high.GetQueue().NumRequeues("key") != 1 {
+		t.Errorf("expected key to be requeued once, but was requeued %d times", high.GetQueue().NumRequeues("key"))
+	}
+
+	worker.process(queuedItem{key: "key", queue: high})
+	if high.GetQueue().NumRequeues("key") != 0 {
+		t.Error("expected key to be dropped after max retries")
+	}
+}
+
+func TestPriorityWorkerLimitsWorkersPerQueue(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	processed := make(chan string, 10)
+	reconcile := func(queue string) func(key string) error {
+		return func(key string) error {
+			mu.Lock()
+			running[queue]++
+			if running[queue] > maxRunning[queue] {
+				maxRunning[queue] = running[queue]
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running[queue]--
+			mu.Unlock()
+			processed <- key
+			return nil
+		}
+	}
+	high := newPriorityQueue("high", priorityHigh, 1, 3, nil, false, reconcile("high"))
+	low := newPriorityQueue("low", priorityLow, 1, 1, nil, false, reconcile("low"))
+	worker := newPriorityWorker(high, low, 4, 1)
+
+	for _, key := range []string{"h1", "h2", "h3", "h4", "h5"} {
+		high.GetQueue().Add(key)
+	}
+	for _, key := range []string{"l1", "l2", "l3"} {
+		low.GetQueue().Add(key)
+	}
+
+	stopCh := make(chan struct{})
+	worker.Run(stopCh)
+	for i := 0; i < 8; i++ {
+		select {
+		case <-processed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for keys to be processed")
+		}
+	}
+	close(stopCh)
+	worker.Wait()
+
+	if maxRunning["high"] > 3 || maxRunning["low"] > 1 {
+		t.Errorf("expected at most 3 high and 1 low priority keys processed at once, but got %v", maxRunning)
+	}
+}
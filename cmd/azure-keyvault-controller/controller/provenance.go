@@ -0,0 +1,101 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationSourceVault holds the name of the Azure Key Vault an output was synced from
+	AnnotationSourceVault = "akv2k8s.io/source-vault"
+
+	// AnnotationSourceObject holds the name of the Azure Key Vault object an output was synced from
+	AnnotationSourceObject = "akv2k8s.io/source-object"
+
+	// AnnotationSourceObjectType holds the type of the Azure Key Vault object an output was synced from
+	AnnotationSourceObjectType = "akv2k8s.io/source-object-type"
+
+	// AnnotationSourceObjectVersion holds the version of the Azure Key Vault object written to the output
+	AnnotationSourceObjectVersion = "akv2k8s.io/source-object-version"
+
+	// AnnotationManagedBy holds the namespace/name of the AzureKeyVaultSecret managing the output
+	AnnotationManagedBy = "akv2k8s.io/managed-by"
+
+	// AnnotationForceSync can be set or changed on an AzureKeyVaultSecret to sync values from
+	// Azure Key Vault right away, also when periodic polling is disabled, to recreate
+	// a deleted Secret with recreatePolicy Manual and to apply changes held back by
+	// syncPolicy ReportOnly
+	AnnotationForceSync = "akv2k8s.io/force-sync"
+
+	latestObjectVersion = "latest"
+)
+
+// provenanceAnnotations returns the annotations describing where the values of an output come from
+func provenanceAnnotations(akvs *akv.AzureKeyVaultSecret) map[string]string {
+	version := akvs.Spec.Vault.Object.Version
+	if version == "" {
+		version = latestObjectVersion
+	}
+
+	return map[string]string{
+		AnnotationSourceVault:         akvs.Spec.Vault.Identifier(),
+		AnnotationSourceObject:        akvs.Spec.Vault.Object.Name,
+		AnnotationSourceObjectType:    string(akvs.Spec.Vault.Object.Type),
+		AnnotationSourceObjectVersion: version,
+		AnnotationManagedBy:           fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name),
+	}
+}
+
+func (c *Controller) provenanceAnnotationsEnabled() bool {
+	return c.options == nil || !c.options.DisableProvenanceAnnotations
+}
+
+// outputAnnotations returns the annotations to set on a Secret or ConfigMap written for akvs
+func (c *Controller) outputAnnotations(akvs *akv.AzureKeyVaultSecret) map[string]string {
+	if !c.provenanceAnnotationsEnabled() {
+		return akvs.Annotations
+	}
+
+	annotations := make(map[string]string)
+	for k, v := range akvs.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range provenanceAnnotations(akvs) {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// hasProvenanceAnnotationsChanged checks if any provenance annotation on obj
+// has been removed or modified, so it can be restored
+func (c *Controller) hasProvenanceAnnotationsChanged(akvs *akv.AzureKeyVaultSecret, obj metav1.Object) bool {
+	if !c.provenanceAnnotationsEnabled() {
+		return false
+	}
+
+	current := obj.GetAnnotations()
+	for k, v := range provenanceAnnotations(akvs) {
+		if current[k] != v {
+			return true
+		}
+	}
+	return false
+}
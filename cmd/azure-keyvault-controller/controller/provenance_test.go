@@ -0,0 +1,89 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestProvenanceAnnotationsOnNewSecret(t *testing.T) {
+	c := &Controller{options: &Options{}}
+
+	akvs := secret()
+	akvs.Annotations = map[string]string{"some": "annotation"}
+	akvs.Spec.Output.Secret.Name = "my-secret"
+
+	newSecret := c.createNewSecret(akvs, map[string][]byte{"key": []byte("value")})
+
+	expected := map[string]string{
+		"some":                        "annotation",
+		AnnotationSourceVault:         "test-name-vault-name",
+		AnnotationSourceObject:        "some-secret",
+		AnnotationSourceObjectType:    "secret",
+		AnnotationSourceObjectVersion: "latest",
+		AnnotationManagedBy:           "default/test-name",
+	}
+	for k, v := range expected {
+		if newSecret.Annotations[k] != v {
+			t.Errorf("expected annotation %s to be '%s', but was '%s'", k, v, newSecret.Annotations[k])
+		}
+	}
+
+	if _, ok := akvs.Annotations[AnnotationSourceVault]; ok {
+		t.Error("provenance annotations should not be added to the azurekeyvaultsecret itself")
+	}
+}
+
+func TestProvenanceAnnotationsDisabled(t *testing.T) {
+	c := &Controller{options: &Options{DisableProvenanceAnnotations: true}}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+
+	newSecret := c.createNewSecret(akvs, map[string][]byte{"key": []byte("value")})
+	if len(newSecret.Annotations) != 0 {
+		t.Errorf("expected no annotations, but got %v", newSecret.Annotations)
+	}
+	if c.hasProvenanceAnnotationsChanged(akvs, newSecret) {
+		t.Error("missing provenance annotations should be ignored when disabled")
+	}
+}
+
+func TestProvenanceAnnotationsRemovedIsDetected(t *testing.T) {
+	c := &Controller{options: &Options{}}
+
+	akvs := secret()
+	existing := &corev1.Secret{}
+	existing.Annotations = c.outputAnnotations(akvs)
+
+	if c.hasProvenanceAnnotationsChanged(akvs, existing) {
+		t.Error("provenance annotations should be unchanged")
+	}
+
+	delete(existing.Annotations, AnnotationSourceObjectVersion)
+	if !c.hasProvenanceAnnotationsChanged(akvs, existing) {
+		t.Error("removed provenance annotation should be detected")
+	}
+
+	existing.Annotations = c.outputAnnotations(akvs)
+	akvs.Spec.Vault.Object.Version = "abc123"
+	if !c.hasProvenanceAnnotationsChanged(akvs, existing) {
+		t.Error("changed object version should be detected")
+	}
+}
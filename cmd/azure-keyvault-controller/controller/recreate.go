@@ -0,0 +1,129 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// requestForceSync remembers that the force sync annotation was set or changed on the
+// AzureKeyVaultSecret with key, used to recreate outputs with recreatePolicy Manual
+func (c *Controller) requestForceSync(key string) {
+	c.forceSyncs.Store(key, struct{}{})
+}
+
+// takeForceSync returns if a force sync was requested for key since last taken
+func (c *Controller) takeForceSync(key string) bool {
+	_, ok := c.forceSyncs.LoadAndDelete(key)
+	return ok
+}
+
+// hasSecretRecreatePolicy tells if a deleted output Secret of akvs may be kept deleted
+func hasSecretRecreatePolicy(akvs *akv.AzureKeyVaultSecret) bool {
+	policy := akvs.Spec.Output.Secret.RecreatePolicy
+	return policy != "" && policy != akv.AzureKeyVaultRecreatePolicyAlways && akvs.Status.SecretName == akvs.Spec.Output.Secret.Name
+}
+
+// applySecretRecreatePolicy checks if the output Secret of akvs has been deleted after being
+// synced, and returns false if it should stay deleted according to spec.output.secret.recreatePolicy.
+// The OutputDeleted condition tells if the Secret is kept deleted. It records the generation
+// the Secret was found deleted in, so any later change to the spec recreates it.
+// A force sync only recreates a Secret already deleted when the force sync was requested.
+func (c *Controller) applySecretRecreatePolicy(akvs *akv.AzureKeyVaultSecret, forceSync bool) (*akv.AzureKeyVaultSecret, bool, error) {
+	name := akvs.Spec.Output.Secret.Name
+	_, err := c.secretsLister.Secrets(akvs.Namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return akvs, false, err
+	}
+
+	condition := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeOutputDeleted)
+	keptDeleted := condition != nil && condition.Status == metav1.ConditionTrue
+
+	// only a secret synced before can have been deleted, a new or renamed one is created as usual
+	if err == nil || akvs.Status.SecretName != name {
+		if !keptDeleted {
+			return akvs, true, nil
+		}
+		akvs, err = c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeOutputDeleted,
+			Status:  metav1.ConditionFalse,
+			Reason:  "OutputExists",
+			Message: fmt.Sprintf("Secret '%s' is synced", name),
+		})
+		return akvs, true, err
+	}
+
+	deleted, recreate := deletedSecretCondition(akvs.Spec.Output.Secret, condition, akvs.Generation, forceSync)
+	if deleted == nil {
+		return akvs, true, nil
+	}
+	if recreate {
+		klog.InfoS("recreating deleted secret", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, name), "reason", deleted.Reason)
+	} else if !keptDeleted {
+		klog.InfoS("secret deleted - not recreating", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KRef(akvs.Namespace, name), "recreatePolicy", akvs.Spec.Output.Secret.RecreatePolicy)
+	}
+
+	akvs, err = c.setCondition(akvs, *deleted)
+	return akvs, recreate, err
+}
+
+// deletedSecretCondition decides if a Secret synced before and now deleted is recreated, given
+// the current OutputDeleted condition, and returns the new condition. The condition is nil if
+// the Secret is recreated and there is no condition to clear.
+func deletedSecretCondition(output akv.AzureKeyVaultOutputSecret, existing *metav1.Condition, generation int64, forceSync bool) (*metav1.Condition, bool) {
+	keptDeleted := existing != nil && existing.Status == metav1.ConditionTrue
+	policy := output.RecreatePolicy
+
+	var reason string
+	switch {
+	case policy == "" || policy == akv.AzureKeyVaultRecreatePolicyAlways:
+		reason = "RecreatePolicyAlways"
+	case keptDeleted && existing.ObservedGeneration != generation:
+		reason = "SpecChanged"
+	case policy == akv.AzureKeyVaultRecreatePolicyManual && forceSync:
+		reason = "ForceSync"
+	}
+
+	if reason != "" {
+		if existing == nil {
+			return nil, true
+		}
+		return &metav1.Condition{
+			Type:    ConditionTypeOutputDeleted,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: fmt.Sprintf("Secret '%s' was deleted and has been recreated", output.Name),
+		}, true
+	}
+
+	message := fmt.Sprintf("Secret '%s' was deleted and is not recreated until the AzureKeyVaultSecret spec changes", output.Name)
+	if policy == akv.AzureKeyVaultRecreatePolicyManual {
+		message = fmt.Sprintf("Secret '%s' was deleted and is not recreated until annotation %s is set or changed, or the AzureKeyVaultSecret spec changes", output.Name, AnnotationForceSync)
+	}
+	return &metav1.Condition{
+		Type:    ConditionTypeOutputDeleted,
+		Status:  metav1.ConditionTrue,
+		Reason:  fmt.Sprintf("RecreatePolicy%s", policy),
+		Message: message,
+	}, false
+}
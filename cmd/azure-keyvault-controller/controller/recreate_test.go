@@ -0,0 +1,159 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// deletedSecretController returns a controller for akvs, where the output secret
+// has been synced before and then deleted
+func deletedSecretController(t *testing.T, policy akv.AzureKeyVaultRecreatePolicy) (*Controller, *akv.AzureKeyVaultSecret, cache.Indexer) {
+	akvs := secret()
+	akvs.Generation = 1
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.RecreatePolicy = policy
+	akvs.Status.SecretName = "my-secret"
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c := &Controller{
+		akvsClient:    akvfake.NewSimpleClientset(akvs),
+		secretsLister: corelisters.NewSecretLister(indexer),
+		options:       &Options{},
+	}
+	return c, akvs, indexer
+}
+
+func TestRecreatePolicyAlways(t *testing.T) {
+	for _, policy := range []akv.AzureKeyVaultRecreatePolicy{"", akv.AzureKeyVaultRecreatePolicyAlways} {
+		c, akvs, _ := deletedSecretController(t, policy)
+
+		updated, recreate, err := c.applySecretRecreatePolicy(akvs, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !recreate {
+			t.Errorf("deleted secret should be recreated with recreatePolicy '%s'", policy)
+		}
+		if meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeOutputDeleted) != nil {
+			t.Error("condition should not be added when the secret is recreated")
+		}
+	}
+}
+
+func TestRecreatePolicyNever(t *testing.T) {
+	c, akvs, _ := deletedSecretController(t, akv.AzureKeyVaultRecreatePolicyNever)
+
+	updated, recreate, err := c.applySecretRecreatePolicy(akvs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recreate {
+		t.Error("deleted secret should not be recreated")
+	}
+	if !meta.IsStatusConditionTrue(updated.Status.Conditions, ConditionTypeOutputDeleted) {
+		t.Error("expected OutputDeleted condition to be true")
+	}
+
+	// a force sync does not recreate the secret, and the condition is not updated again
+	client := c.akvsClient.(*akvfake.Clientset)
+	client.ClearActions()
+	updated, recreate, err = c.applySecretRecreatePolicy(updated, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recreate {
+		t.Error("deleted secret should not be recreated by a force sync")
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("expected no status update, but got %v", client.Actions())
+	}
+
+	// changing the spec always recreates the secret
+	updated.Generation = 2
+	updated, recreate, err = c.applySecretRecreatePolicy(updated, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recreate {
+		t.Error("deleted secret should be recreated when the spec changes")
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeOutputDeleted)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "SpecChanged" {
+		t.Errorf("expected condition to be false with reason SpecChanged, but got %v", condition)
+	}
+}
+
+func TestRecreatePolicyManual(t *testing.T) {
+	c, akvs, _ := deletedSecretController(t, akv.AzureKeyVaultRecreatePolicyManual)
+
+	updated, recreate, err := c.applySecretRecreatePolicy(akvs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recreate {
+		t.Error("deleted secret should not be recreated before a force sync")
+	}
+
+	updated, recreate, err = c.applySecretRecreatePolicy(updated, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recreate {
+		t.Error("deleted secret should be recreated by a force sync")
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeOutputDeleted)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "ForceSync" {
+		t.Errorf("expected condition to be false with reason ForceSync, but got %v", condition)
+	}
+}
+
+func TestRecreatePolicyIgnoresForceSyncBeforeDeletion(t *testing.T) {
+	c, akvs, indexer := deletedSecretController(t, akv.AzureKeyVaultRecreatePolicyManual)
+	existing := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: akvs.Namespace}}
+	if err := indexer.Add(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, recreate, err := c.applySecretRecreatePolicy(akvs, true); err != nil || !recreate {
+		t.Fatalf("existing secret should be synced, got %t, %v", recreate, err)
+	}
+
+	if err := indexer.Delete(existing); err != nil {
+		t.Fatal(err)
+	}
+	if _, recreate, _ := c.applySecretRecreatePolicy(akvs, false); recreate {
+		t.Error("force sync requested before the secret was deleted should not recreate it")
+	}
+}
+
+func TestRecreatePolicyNewSecret(t *testing.T) {
+	c, akvs, _ := deletedSecretController(t, akv.AzureKeyVaultRecreatePolicyNever)
+	akvs.Spec.Output.Secret.Name = "renamed-secret"
+
+	if _, recreate, err := c.applySecretRecreatePolicy(akvs, false); err != nil || !recreate {
+		t.Errorf("secret never synced should be created, got %t, %v", recreate, err)
+	}
+}
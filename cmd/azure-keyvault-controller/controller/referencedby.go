@@ -0,0 +1,125 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sort"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+func (c *Controller) referencedByEnabled() bool {
+	return c.options != nil && c.options.ReferencedByRefreshInterval > 0
+}
+
+// isReferencedByRefreshDue checks if status.referencedBy should be refreshed, either
+// because the output was just rotated or the refresh interval has passed
+func (c *Controller) isReferencedByRefreshDue(akvs *akv.AzureKeyVaultSecret, rotated bool) bool {
+	if !c.referencedByEnabled() {
+		return false
+	}
+	if rotated || akvs.Status.ReferencedBy == nil {
+		return true
+	}
+	return !c.clock.Now().Time.Before(akvs.Status.ReferencedBy.LastRefreshed.Add(c.options.ReferencedByRefreshInterval))
+}
+
+// refreshReferencedBy looks up workloads consuming the outputs of akvs and sets
+// status.referencedBy. akvs must be a copy, as it is changed in place. Looking up
+// workloads is best effort, so any error leaves the current status as is.
+func (c *Controller) refreshReferencedBy(akvs *akv.AzureKeyVaultSecret) {
+	workloads, err := c.findReferencingWorkloads(akvs)
+	if err != nil {
+		klog.ErrorS(err, "failed to find workloads consuming output", "azurekeyvaultsecret", klog.KObj(akvs))
+		return
+	}
+
+	referencedBy := &akv.AzureKeyVaultSecretReferencedBy{
+		Count:         len(workloads),
+		LastRefreshed: c.clock.Now(),
+	}
+	if len(workloads) > c.options.MaxReferencedBy {
+		workloads = workloads[:c.options.MaxReferencedBy]
+	}
+	if len(workloads) > 0 {
+		referencedBy.Workloads = workloads
+	}
+	akvs.Status.ReferencedBy = referencedBy
+}
+
+// findReferencingWorkloads returns the sorted Deployments, StatefulSets and DaemonSets
+// with pods consuming the output Secret or ConfigMap of akvs
+func (c *Controller) findReferencingWorkloads(akvs *akv.AzureKeyVaultSecret) ([]akv.AzureKeyVaultWorkloadReference, error) {
+	secretName := akvs.Spec.Output.Secret.Name
+	cmName := akvs.Spec.Output.ConfigMap.Name
+
+	pods, err := c.listPods(akvs.Namespace, func(pod *corev1.Pod) bool {
+		return (secretName != "" && podUsesSecret(pod, secretName)) || (cmName != "" && podUsesConfigMap(pod, cmName))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[akv.AzureKeyVaultWorkloadReference]bool)
+	for _, pod := range pods {
+		if workload := c.workloadForPod(pod); workload != nil {
+			found[*workload] = true
+		}
+	}
+
+	workloads := make([]akv.AzureKeyVaultWorkloadReference, 0, len(found))
+	for workload := range found {
+		workloads = append(workloads, workload)
+	}
+	sort.Slice(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+	return workloads, nil
+}
+
+// workloadForPod follows the owner chain of pod to a Deployment, StatefulSet or DaemonSet,
+// returning nil if pod is not owned by any of them
+func (c *Controller) workloadForPod(pod *corev1.Pod) *akv.AzureKeyVaultWorkloadReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+
+	switch owner.Kind {
+	case "StatefulSet", "DaemonSet":
+		return &akv.AzureKeyVaultWorkloadReference{Kind: owner.Kind, Name: owner.Name}
+	case "ReplicaSet":
+		if c.replicaSetsLister == nil {
+			return nil
+		}
+		rs, err := c.replicaSetsLister.ReplicaSets(pod.Namespace).Get(owner.Name)
+		if err != nil {
+			klog.V(4).InfoS("failed to get replicaset owning pod", "pod", klog.KObj(pod), "replicaset", owner.Name, "error", err)
+			return nil
+		}
+		if rsOwner := metav1.GetControllerOf(rs); rsOwner != nil && rsOwner.Kind == "Deployment" {
+			return &akv.AzureKeyVaultWorkloadReference{Kind: rsOwner.Kind, Name: rsOwner.Name}
+		}
+	}
+	return nil
+}
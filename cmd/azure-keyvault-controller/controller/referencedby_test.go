@@ -0,0 +1,143 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func ownedBy(obj metav1.Object, kind, name string) {
+	isController := true
+	obj.SetOwnerReferences([]metav1.OwnerReference{{Kind: kind, Name: name, Controller: &isController}})
+}
+
+func secretVolumePod(name, secretName string) *corev1.Pod {
+	return pod(name, "default", corev1.PodSpec{
+		Volumes: []corev1.Volume{{Name: "v", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}}}},
+	})
+}
+
+func TestFindReferencingWorkloads(t *testing.T) {
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	rsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-abc", Namespace: "default"}}
+	ownedBy(rs, "Deployment", "web")
+	if err := rsIndexer.Add(rs); err != nil {
+		t.Fatal(err)
+	}
+
+	web1 := secretVolumePod("web-abc-1", "my-secret")
+	ownedBy(web1, "ReplicaSet", "web-abc")
+	web2 := secretVolumePod("web-abc-2", "my-secret")
+	ownedBy(web2, "ReplicaSet", "web-abc")
+	db := secretVolumePod("db-0", "my-secret")
+	ownedBy(db, "StatefulSet", "db")
+	agent := pod("agent-x", "default", corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "c", EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "my-cm"}}}}}},
+	})
+	ownedBy(agent, "DaemonSet", "agent")
+	job := secretVolumePod("job-x", "my-secret")
+	ownedBy(job, "Job", "job")
+	other := secretVolumePod("other-0", "other-secret")
+	ownedBy(other, "StatefulSet", "other")
+
+	for _, p := range []*corev1.Pod{web1, web2, db, agent, job, other} {
+		if err := podIndexer.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock:             &fakeClock{now: now},
+		podsLister:        corelisters.NewPodLister(podIndexer),
+		replicaSetsLister: appslisters.NewReplicaSetLister(rsIndexer),
+		options:           &Options{ReferencedByRefreshInterval: time.Hour, MaxReferencedBy: 2},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.ConfigMap.Name = "my-cm"
+
+	workloads, err := c.findReferencingWorkloads(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []akv.AzureKeyVaultWorkloadReference{
+		{Kind: "DaemonSet", Name: "agent"},
+		{Kind: "Deployment", Name: "web"},
+		{Kind: "StatefulSet", Name: "db"},
+	}
+	if len(workloads) != len(expected) {
+		t.Fatalf("expected %v, but got %v", expected, workloads)
+	}
+	for i := range expected {
+		if workloads[i] != expected[i] {
+			t.Errorf("expected %v, but got %v", expected[i], workloads[i])
+		}
+	}
+
+	c.refreshReferencedBy(akvs)
+	referencedBy := akvs.Status.ReferencedBy
+	if referencedBy == nil {
+		t.Fatal("expected status.referencedBy to be set")
+	}
+	if referencedBy.Count != 3 || len(referencedBy.Workloads) != 2 {
+		t.Errorf("expected 2 of 3 workloads listed, but got %d of %d", len(referencedBy.Workloads), referencedBy.Count)
+	}
+	if !referencedBy.LastRefreshed.Time.Equal(now) {
+		t.Errorf("expected last refreshed to be %v, but was %v", now, referencedBy.LastRefreshed)
+	}
+}
+
+func TestReferencedByRefreshDue(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{clock: &fakeClock{now: now}, options: &Options{}}
+
+	akvs := secret()
+	if c.isReferencedByRefreshDue(akvs, true) {
+		t.Error("refresh should never be due when disabled")
+	}
+
+	c.options.ReferencedByRefreshInterval = time.Hour
+	if !c.isReferencedByRefreshDue(akvs, false) {
+		t.Error("refresh should be due when never refreshed")
+	}
+
+	akvs.Status.ReferencedBy = &akv.AzureKeyVaultSecretReferencedBy{LastRefreshed: metav1.NewTime(now.Add(-30 * time.Minute))}
+	if c.isReferencedByRefreshDue(akvs, false) {
+		t.Error("refresh should not be due within the refresh interval")
+	}
+	if !c.isReferencedByRefreshDue(akvs, true) {
+		t.Error("refresh should be due when output was rotated")
+	}
+
+	akvs.Status.ReferencedBy.LastRefreshed = metav1.NewTime(now.Add(-time.Hour))
+	if !c.isReferencedByRefreshDue(akvs, false) {
+		t.Error("refresh should be due after the refresh interval")
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ReasonOutputRenamed is the reason of the event when the output written under the previous name
+// is removed, after spec.output was renamed
+const ReasonOutputRenamed = "OutputRenamed"
+
+// pruneRenamedSecret removes the Secret written as status.secretName in previous, when the Secret
+// of akvs has been renamed since. Like outputs no longer in spec.outputs, the old Secret is only
+// deleted when akvs is its only owner, and left alone when not owned by akvs. Called after the
+// Secret under the new name was written.
+func (c *Controller) pruneRenamedSecret(akvs *akv.AzureKeyVaultSecret, previous akv.AzureKeyVaultSecretStatus) error {
+	name := determineSecretName(akvs)
+	if previous.SecretName == "" || previous.SecretName == name {
+		return nil
+	}
+
+	klog.InfoS("secret renamed - removing previous secret", "azurekeyvaultsecret", klog.KObj(akvs), "previous", previous.SecretName, "secret", name)
+	status := akv.AzureKeyVaultOutputStatus{Kind: outputKindSecret, Name: previous.SecretName, Keys: previous.SecretKeys}
+	if pruned, err := c.pruneOutput(akvs, status); err != nil || !pruned {
+		return err
+	}
+	c.recorder.Eventf(akvs, corev1.EventTypeNormal, ReasonOutputRenamed, "Pruned Secret %s after the output was renamed to %s", previous.SecretName, name)
+	return nil
+}
+
+// pruneRenamedConfigMap removes the ConfigMap written as status.configMapName in previous, when the
+// ConfigMap of akvs has been renamed since. Immutable ConfigMaps are left to their revision cleanup.
+func (c *Controller) pruneRenamedConfigMap(akvs *akv.AzureKeyVaultSecret, previous akv.AzureKeyVaultSecretStatus) error {
+	name := akvs.Spec.Output.ConfigMap.Name
+	if isImmutableConfigMap(akvs) || previous.ConfigMapName == "" || previous.ConfigMapName == name {
+		return nil
+	}
+
+	klog.InfoS("configmap renamed - removing previous configmap", "azurekeyvaultsecret", klog.KObj(akvs), "previous", previous.ConfigMapName, "configmap", name)
+	status := akv.AzureKeyVaultOutputStatus{Kind: outputKindConfigMap, Name: previous.ConfigMapName, Keys: previous.ConfigMapKeys}
+	if pruned, err := c.pruneOutput(akvs, status); err != nil || !pruned {
+		return err
+	}
+	c.recorder.Eventf(akvs, corev1.EventTypeNormal, ReasonOutputRenamed, "Pruned ConfigMap %s after the output was renamed to %s", previous.ConfigMapName, name)
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// renamedSecret returns akvs with its Secret renamed from 'db-creds' to 'database-credentials',
+// and the Secret 'db-creds' written before the rename
+func renamedSecret() (*akv.AzureKeyVaultSecret, *corev1.Secret) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "db-creds"
+	old := (&Controller{options: &Options{}}).createNewSecret(akvs, map[string][]byte{"password": []byte("value")})
+
+	akvs.Spec.Output.Secret.Name = "database-credentials"
+	akvs.Status.SecretName = "db-creds"
+	akvs.Status.SecretKeys = []string{"password"}
+	return akvs, old
+}
+
+func TestPruneRenamedSecretDeletesOldSecret(t *testing.T) {
+	akvs, old := renamedSecret()
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, old)
+
+	if err := c.pruneRenamedSecret(akvs, akvs.Status); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "db-creds", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected old secret to be deleted, but got %v", err)
+	}
+	if len(c.recorder.(*record.FakeRecorder).Events) != 1 {
+		t.Error("expected an event for the pruned secret")
+	}
+}
+
+func TestPruneRenamedSecretKeepsSecretNotOwned(t *testing.T) {
+	akvs, old := renamedSecret()
+	old.OwnerReferences = nil
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, old)
+
+	if err := c.pruneRenamedSecret(akvs, akvs.Status); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "db-creds", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected secret not owned by akvs to be kept, but got %v", err)
+	}
+	if len(c.recorder.(*record.FakeRecorder).Events) != 0 {
+		t.Error("expected no event when nothing was pruned")
+	}
+}
+
+func TestPruneRenamedSecretReleasesSharedSecret(t *testing.T) {
+	akvs, old := renamedSecret()
+	old.OwnerReferences = append(old.OwnerReferences, metav1.OwnerReference{Kind: "AzureKeyVaultSecret", Name: "other", UID: types.UID("other-uid")})
+	old.Data["foreign"] = []byte("foreign-value")
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, old)
+
+	if err := c.pruneRenamedSecret(akvs, akvs.Status); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "db-creds", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected shared secret to be kept, but got %v", err)
+	}
+	if isOwnedBy(shared, akvs) {
+		t.Error("expected owner reference to be removed from shared secret")
+	}
+	if _, ok := shared.Data["password"]; ok || string(shared.Data["foreign"]) != "foreign-value" {
+		t.Errorf("expected only the keys of akvs to be removed, but got %v", shared.Data)
+	}
+}
+
+func TestPruneRenamedSecretWithoutRename(t *testing.T) {
+	akvs, old := renamedSecret()
+	akvs.Spec.Output.Secret.Name = "db-creds"
+	c, kubeclient := outputsController(t, akvs, &countingVaultService{}, old)
+
+	if err := c.pruneRenamedSecret(akvs, akvs.Status); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeclient.CoreV1().Secrets(akvs.Namespace).Get(context.TODO(), "db-creds", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected secret to be kept when not renamed, but got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// isAzureKeyVaultPollDue checks if akvs should be polled for changes in Azure Key Vault.
+// Certificates with a predicted renewal time are polled on every resync close to and after
+// the renewal, but only every CertificateRelaxedPollInterval before that. Everything else
+// is polled on every resync. A poll time recorded in the status takes precedence, so the
+// schedule is kept across controller restarts.
+func (c *Controller) isAzureKeyVaultPollDue(akvs *akv.AzureKeyVaultSecret) bool {
+	if due, known := c.isNextAzurePollDue(akvs); known {
+		return due
+	}
+	if c.options == nil || c.options.CertificateRelaxedPollInterval <= 0 {
+		return true
+	}
+	if akvs.Status.PredictedRenewalTime == nil || akvs.Status.LastAzureUpdate.IsZero() {
+		return true
+	}
+
+	now := c.clock.Now().Time
+	windowStart := akvs.Status.PredictedRenewalTime.Add(-c.options.CertificateRenewalWindow)
+	if !now.Before(windowStart) {
+		return true
+	}
+
+	return !now.Before(akvs.Status.LastAzureUpdate.Add(c.options.CertificateRelaxedPollInterval))
+}
+
+// predictCertificateRenewal returns when the certificate in akvs is expected to be renewed
+// in Azure Key Vault, or nil if unknown or not relevant
+func (c *Controller) predictCertificateRenewal(akvs *akv.AzureKeyVaultSecret) *metav1.Time {
+	// pinned versions never change, even if the certificate is renewed
+	if akvs.Spec.Vault.Object.Type != akv.AzureKeyVaultObjectTypeCertificate || akvs.Spec.Vault.Object.Version != "" {
+		return nil
+	}
+
+	service, err := c.vaultServiceFor(akvs)
+	if err != nil {
+		return nil
+	}
+	renewal, err := service.GetCertificateRenewalTime(&akvs.Spec.Vault)
+	if err != nil {
+		klog.ErrorS(err, "failed to predict certificate renewal, using normal poll interval", "azurekeyvaultsecret", klog.KObj(akvs))
+		return nil
+	}
+	if renewal == nil {
+		return nil
+	}
+	return &metav1.Time{Time: *renewal}
+}
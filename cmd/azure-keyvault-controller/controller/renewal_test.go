@@ -0,0 +1,86 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() metav1.Time {
+	return metav1.Time{Time: c.now}
+}
+
+func TestAzureKeyVaultPollDueAroundCertificateRenewal(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock: &fakeClock{now: now},
+		options: &Options{
+			CertificateRelaxedPollInterval: time.Hour,
+			CertificateRenewalWindow:       time.Hour,
+		},
+	}
+
+	akvs := secret()
+	akvs.Status.LastAzureUpdate = metav1.Time{Time: now.Add(-10 * time.Minute)}
+
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due when renewal time is unknown")
+	}
+
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(30 * 24 * time.Hour)}
+	if c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should not be due far from renewal when last poll was within relaxed interval")
+	}
+
+	akvs.Status.LastAzureUpdate = metav1.Time{Time: now.Add(-2 * time.Hour)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due far from renewal when relaxed interval has passed")
+	}
+
+	akvs.Status.LastAzureUpdate = metav1.Time{Time: now.Add(-time.Minute)}
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(30 * time.Minute)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due within renewal window")
+	}
+
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(-24 * time.Hour)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should be due after predicted renewal")
+	}
+}
+
+func TestAzureKeyVaultPollDueWhenRelaxedPollingDisabled(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := &Controller{
+		clock:   &fakeClock{now: now},
+		options: &Options{},
+	}
+
+	akvs := secret()
+	akvs.Status.LastAzureUpdate = metav1.Time{Time: now.Add(-time.Minute)}
+	akvs.Status.PredictedRenewalTime = &metav1.Time{Time: now.Add(30 * 24 * time.Hour)}
+	if !c.isAzureKeyVaultPollDue(akvs) {
+		t.Error("poll should always be due when relaxed polling is disabled")
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ReasonRotationPending is the reason of the RotationPending condition and event when a
+	// change in Azure Key Vault is held back by spec.syncPolicy ReportOnly
+	ReasonRotationPending = "ReportOnly"
+
+	// ReasonInSync is the reason of the RotationPending condition when no change is held back
+	ReasonInSync = "InSync"
+)
+
+var rotationsPending = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "akv2k8s_rotations_pending_total",
+	Help: "The total number of changes in Azure Key Vault held back from an output by sync policy ReportOnly",
+}, []string{"kind"})
+
+// pendingRotation is a change read from Azure Key Vault not applied to an existing output
+type pendingRotation struct {
+	kind string
+	name string
+	hash string
+}
+
+func (p pendingRotation) String() string {
+	return fmt.Sprintf("%s '%s' (new hash %s)", p.kind, p.name, p.hash)
+}
+
+// isReportOnly tells if changes in Azure Key Vault are only reported for akvs, and applied
+// to existing outputs by a force sync. Missing outputs are always created.
+func isReportOnly(akvs *akv.AzureKeyVaultSecret, forceSync bool) bool {
+	return akvs.Spec.SyncPolicy == akv.AzureKeyVaultSyncPolicyReportOnly && !forceSync
+}
+
+// rotationPendingCondition returns the RotationPending condition for the changes in pending
+func rotationPendingCondition(akvs *akv.AzureKeyVaultSecret, pending []pendingRotation) metav1.Condition {
+	if len(pending) == 0 {
+		return metav1.Condition{
+			Type:    ConditionTypeRotationPending,
+			Status:  metav1.ConditionFalse,
+			Reason:  ReasonInSync,
+			Message: "Outputs are in sync with Azure Key Vault",
+		}
+	}
+
+	version := akvs.Spec.Vault.Object.Version
+	if version == "" {
+		version = latestObjectVersion
+	}
+	outputs := make([]string, 0, len(pending))
+	for _, p := range pending {
+		outputs = append(outputs, p.String())
+	}
+	return metav1.Condition{
+		Type:   ConditionTypeRotationPending,
+		Status: metav1.ConditionTrue,
+		Reason: ReasonRotationPending,
+		Message: fmt.Sprintf("version %s of %s '%s' in Azure Key Vault has changed and is not applied to %s, set or change annotation %s or set spec.syncPolicy to Auto to apply",
+			version, akvs.Spec.Vault.Object.Type, akvs.Spec.Vault.Object.Name, strings.Join(outputs, ", "), AnnotationForceSync),
+	}
+}
+
+// isRotationPendingChanged tells if condition differs from the RotationPending condition in conditions
+func isRotationPendingChanged(conditions []metav1.Condition, condition metav1.Condition) bool {
+	existing := meta.FindStatusCondition(conditions, ConditionTypeRotationPending)
+	if existing == nil {
+		return condition.Status == metav1.ConditionTrue
+	}
+	return existing.Status != condition.Status || existing.Message != condition.Message
+}
+
+// reportRotationPending emits an event and counts the changes in pending when first seen
+func (c *Controller) reportRotationPending(akvs *akv.AzureKeyVaultSecret, condition metav1.Condition, pending []pendingRotation) {
+	klog.InfoS("change in azure key vault not applied, sync policy is ReportOnly", "azurekeyvaultsecret", klog.KObj(akvs), "pending", len(pending))
+	c.recorder.Event(akvs, corev1.EventTypeWarning, ReasonRotationPending, condition.Message)
+	for _, p := range pending {
+		rotationsPending.WithLabelValues(p.kind).Inc()
+	}
+}
+
+// setRotationPending sets the RotationPending condition of akvs for the changes held back
+// from spec.output, and returns the updated akvs. The condition is only added when a change
+// is held back. As the status may have been updated when syncing the outputs, the latest
+// akvs is read before the condition is changed.
+func (c *Controller) setRotationPending(akvs *akv.AzureKeyVaultSecret, pending []pendingRotation) (*akv.AzureKeyVaultSecret, error) {
+	condition := rotationPendingCondition(akvs, pending)
+	if !isRotationPendingChanged(akvs.Status.Conditions, condition) {
+		return akvs, nil
+	}
+	if len(pending) > 0 {
+		c.reportRotationPending(akvs, condition, pending)
+	}
+
+	latest, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Get(context.TODO(), akvs.Name, metav1.GetOptions{})
+	if err != nil {
+		return akvs, err
+	}
+	return c.setCondition(latest, condition)
+}
+
+// setOutputRotationPending sets the RotationPending condition in the status of an output in
+// spec.outputs, where pending is nil if no change is held back
+func (c *Controller) setOutputRotationPending(view *akv.AzureKeyVaultSecret, status *akv.AzureKeyVaultOutputStatus, pending *pendingRotation) {
+	var list []pendingRotation
+	if pending != nil {
+		list = append(list, *pending)
+	}
+	condition := rotationPendingCondition(view, list)
+	if !isRotationPendingChanged(status.Conditions, condition) {
+		return
+	}
+	if pending != nil {
+		c.reportRotationPending(view, condition, list)
+	}
+	condition.ObservedGeneration = view.Generation
+	meta.SetStatusCondition(&status.Conditions, condition)
+}
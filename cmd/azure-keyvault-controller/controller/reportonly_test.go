@@ -0,0 +1,169 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func reportOnlySecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.SyncPolicy = akv.AzureKeyVaultSyncPolicyReportOnly
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+	return akvs
+}
+
+func getSecretValue(t *testing.T, c *Controller, namespace, name, key string) string {
+	secret, err := c.kubeclientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data[key])
+}
+
+func TestReportOnlyCreatesMissingSecret(t *testing.T) {
+	akvs := reportOnlySecret()
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "new-value"}}
+	c, _ := outputsController(t, akvs, service)
+
+	_, pending, err := c.getOrCreateKubernetesSecret(akvs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil {
+		t.Errorf("expected missing secret to be created, but got pending %v", pending)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "my-secret", "password"); value != "new-value" {
+		t.Errorf("expected secret to be created with 'new-value', but got '%s'", value)
+	}
+}
+
+func TestReportOnlyHoldsBackChange(t *testing.T) {
+	akvs := reportOnlySecret()
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "new-value"}}
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, map[string][]byte{"password": []byte("old-value")})
+	c, _ := outputsController(t, akvs, service, existing)
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	_, pending, err := c.getOrCreateKubernetesSecret(akvs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending == nil || pending.kind != outputKindSecret || pending.name != "my-secret" || pending.hash == "" {
+		t.Fatalf("expected change to be pending, but got %v", pending)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "my-secret", "password"); value != "old-value" {
+		t.Errorf("expected secret to keep 'old-value', but got '%s'", value)
+	}
+
+	updated, err := c.setRotationPending(akvs, []pendingRotation{*pending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeRotationPending)
+	if condition == nil || condition.Status != metav1.ConditionTrue || !strings.Contains(condition.Message, AnnotationForceSync) {
+		t.Errorf("expected RotationPending condition mentioning %s, but got %v", AnnotationForceSync, condition)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ReasonRotationPending) {
+			t.Errorf("expected %s event, but got '%s'", ReasonRotationPending, event)
+		}
+	default:
+		t.Error("expected an event for the pending rotation")
+	}
+
+	// reporting the same change again is a no-op
+	if _, err := c.setRotationPending(updated, []pendingRotation{*pending}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event for a change already reported, but got %d", len(recorder.Events))
+	}
+
+	_, pending, err = c.getOrCreateKubernetesSecret(updated, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil {
+		t.Errorf("expected force sync to apply the change, but got pending %v", pending)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "my-secret", "password"); value != "new-value" {
+		t.Errorf("expected force sync to update secret to 'new-value', but got '%s'", value)
+	}
+
+	updated, err = c.setRotationPending(updated, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition = meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeRotationPending)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != ReasonInSync {
+		t.Errorf("expected RotationPending condition to be cleared, but got %v", condition)
+	}
+}
+
+func TestRotationPendingConditionNotAddedWhenInSync(t *testing.T) {
+	akvs := reportOnlySecret()
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+
+	updated, err := c.setRotationPending(akvs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeRotationPending); condition != nil {
+		t.Errorf("expected no RotationPending condition, but got %v", condition)
+	}
+}
+
+func TestSyncOutputsReportOnly(t *testing.T) {
+	akvs := outputsSecret()
+	akvs.Spec.SyncPolicy = akv.AzureKeyVaultSyncPolicyReportOnly
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "new-value"}}
+	existing := (&Controller{options: &Options{}}).createNewSecret(outputView(akvs, akvs.Spec.Outputs[0]), map[string][]byte{"password": []byte("old-value")})
+	c, _ := outputsController(t, akvs, service, existing)
+
+	if err := c.syncOutputs(akvs, true); err != nil {
+		t.Fatal(err)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "first", "password"); value != "old-value" {
+		t.Errorf("expected existing output to keep 'old-value', but got '%s'", value)
+	}
+	if value := getSecretValue(t, c, akvs.Namespace, "second", "PASSWORD"); value != "new-value" {
+		t.Errorf("expected missing output to be created with 'new-value', but got '%s'", value)
+	}
+
+	updated := getStatus(t, c, akvs)
+	first := findOutputStatus(updated.Status.Outputs, outputKindSecret, "first")
+	if first == nil || !meta.IsStatusConditionTrue(first.Conditions, ConditionTypeRotationPending) || first.Hash != "" {
+		t.Errorf("expected rotation of 'first' to be pending without a hash, but got %v", first)
+	}
+	second := findOutputStatus(updated.Status.Outputs, outputKindSecret, "second")
+	if second == nil || meta.FindStatusCondition(second.Conditions, ConditionTypeRotationPending) != nil {
+		t.Errorf("expected no RotationPending condition on 'second', but got %v", second)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AnnotationRotationGeneration is set on outputs to the number of times a change in
+// Azure Key Vault has been applied to them, as a cheap signal that the values changed
+const AnnotationRotationGeneration = "akv2k8s.io/rotation-generation"
+
+// rotationGeneration returns the rotation generation annotated on obj, zero if missing or invalid
+func rotationGeneration(obj metav1.Object) int64 {
+	generation, err := strconv.ParseInt(obj.GetAnnotations()[AnnotationRotationGeneration], 10, 64)
+	if err != nil || generation < 0 {
+		return 0
+	}
+	return generation
+}
+
+// setRotationGeneration annotates obj with generation, if any. The annotations are copied,
+// as they may be shared with the AzureKeyVaultSecret.
+func setRotationGeneration(obj metav1.Object, generation int64) {
+	if generation <= 0 {
+		return
+	}
+
+	annotations := make(map[string]string, len(obj.GetAnnotations())+1)
+	for k, v := range obj.GetAnnotations() {
+		annotations[k] = v
+	}
+	annotations[AnnotationRotationGeneration] = strconv.FormatInt(generation, 10)
+	obj.SetAnnotations(annotations)
+}
+
+// keepRotationGeneration carries the rotation generation of existing over to updated, as
+// the annotations of outputs are rebuilt from the AzureKeyVaultSecret on every update
+func keepRotationGeneration(updated, existing metav1.Object) {
+	setRotationGeneration(updated, rotationGeneration(existing))
+}
+
+// bumpRotationGeneration increments the rotation generation of existing on updated,
+// returning the new generation. Only used when the values of the output change.
+func bumpRotationGeneration(updated, existing metav1.Object) int64 {
+	generation := rotationGeneration(existing) + 1
+	setRotationGeneration(updated, generation)
+	return generation
+}
@@ -0,0 +1,150 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pollController returns a controller polling akvs, where existing is the output Secret
+// written before. poll runs syncAzureKeyVault with the latest status of akvs.
+func pollController(t *testing.T, akvs *akv.AzureKeyVaultSecret, value string, existing *corev1.Secret) (*Controller, func()) {
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: value}}
+	c, _ := outputsController(t, akvs, service, existing)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	c.azureKeyVaultSecretLister = listers.NewAzureKeyVaultSecretLister(indexer)
+
+	poll := func() {
+		t.Helper()
+		if err := indexer.Add(getStatus(t, c, akvs)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.syncAzureKeyVault(akvs.Namespace + "/" + akvs.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, poll
+}
+
+func getRotationGeneration(t *testing.T, c *Controller, namespace, name string) string {
+	secret, err := c.kubeclientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret.Annotations[AnnotationRotationGeneration]
+}
+
+func TestRotationGenerationIncrementsOnlyOnValueChange(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.DataKey = "password"
+
+	oldValues := map[string][]byte{"password": []byte("old-value")}
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, oldValues)
+	// the counter continues from the annotation, like after a controller restart
+	setRotationGeneration(existing, 4)
+	akvs.Status.SecretName = "my-secret"
+	akvs.Status.SecretHash = getHashOfByteValues(oldValues)
+
+	c, poll := pollController(t, akvs, "new-value", existing)
+
+	poll()
+	if generation := getRotationGeneration(t, c, akvs.Namespace, "my-secret"); generation != "5" {
+		t.Errorf("expected rotation generation 5 after value change, but got '%s'", generation)
+	}
+	if status := getStatus(t, c, akvs); status.Status.RotationGeneration != 5 {
+		t.Errorf("expected status.rotationGeneration 5, but got %d", status.Status.RotationGeneration)
+	}
+
+	// unchanged value
+	poll()
+	if generation := getRotationGeneration(t, c, akvs.Namespace, "my-secret"); generation != "5" {
+		t.Errorf("expected rotation generation to stay 5 on no-op poll, but got '%s'", generation)
+	}
+
+	// an update writing the same values, as when the hash in the status is outdated
+	updated := getStatus(t, c, akvs)
+	updated.Status.SecretHash = ""
+	if _, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	poll()
+	if generation := getRotationGeneration(t, c, akvs.Namespace, "my-secret"); generation != "5" {
+		t.Errorf("expected rotation generation to stay 5 when values are unchanged, but got '%s'", generation)
+	}
+	if status := getStatus(t, c, akvs); status.Status.RotationGeneration != 5 {
+		t.Errorf("expected status.rotationGeneration to stay 5, but got %d", status.Status.RotationGeneration)
+	}
+}
+
+func TestRotationGenerationKeptOnMetadataUpdate(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Annotations = map[string]string{"team": "a"}
+	akvs.Spec.Output.Secret.Name = "my-secret"
+
+	values := map[string][]byte{"password": []byte("value")}
+	c := &Controller{options: &Options{}}
+	existing := c.createNewSecret(akvs, values)
+	setRotationGeneration(existing, 3)
+
+	akvs.Annotations = map[string]string{"team": "b"}
+	updated, err := c.createNewSecretFromExisting(akvs, values, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generation := updated.Annotations[AnnotationRotationGeneration]; generation != "3" {
+		t.Errorf("expected rotation generation 3 to be kept, but got '%s'", generation)
+	}
+	if _, ok := akvs.Annotations[AnnotationRotationGeneration]; ok {
+		t.Error("expected annotations of azurekeyvaultsecret to be left unchanged")
+	}
+}
+
+func TestRotationGenerationInOutputs(t *testing.T) {
+	akvs := outputsSecret()
+	oldValues := map[string][]byte{"password": []byte("old-value")}
+	existing := (&Controller{options: &Options{}}).createNewSecret(outputView(akvs, akvs.Spec.Outputs[0]), oldValues)
+	akvs.Status.Outputs = []akv.AzureKeyVaultOutputStatus{
+		{Kind: outputKindSecret, Name: "first", Hash: getHashOfByteValues(oldValues)},
+	}
+	service := &countingVaultService{fakeVaultService: fakeVaultService{fakeSecretValue: "new-value"}}
+	c, _ := outputsController(t, akvs, service, existing)
+
+	if err := c.syncOutputs(akvs, true); err != nil {
+		t.Fatal(err)
+	}
+	if generation := getRotationGeneration(t, c, akvs.Namespace, "first"); generation != "1" {
+		t.Errorf("expected rotation generation 1 after value change, but got '%s'", generation)
+	}
+	if generation := getRotationGeneration(t, c, akvs.Namespace, "second"); generation != "" {
+		t.Errorf("expected no rotation generation on created output, but got '%s'", generation)
+	}
+	status := findOutputStatus(getStatus(t, c, akvs).Status.Outputs, outputKindSecret, "first")
+	if status == nil || status.RotationGeneration != 1 {
+		t.Errorf("expected output status with rotationGeneration 1, but got %v", status)
+	}
+}
@@ -22,9 +22,10 @@ package controller
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"sort"
 
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
@@ -34,6 +35,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 func (c *Controller) getSecret(ns, name string) (*corev1.Secret, error) {
@@ -52,7 +54,10 @@ func (c *Controller) deleteKubernetesSecretValues(akvs *akv.AzureKeyVaultSecret)
 		return nil
 	}
 
-	secretData := secret.Data
+	secretData := make(map[string][]byte, len(secret.Data))
+	for key, value := range secret.Data {
+		secretData[key] = value
+	}
 
 	data, err := c.getSecretFromKeyVault(akvs)
 	if err != nil {
@@ -68,48 +73,59 @@ func (c *Controller) deleteKubernetesSecretValues(akvs *akv.AzureKeyVaultSecret)
 		return err
 	}
 
-	_, err = c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Update(context.TODO(), newSecret, metav1.UpdateOptions{})
+	_, err = c.writer().PatchSecret(context.TODO(), secret, newSecret)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Controller) getOrCreateKubernetesSecret(akvs *akv.AzureKeyVaultSecret) (*corev1.Secret, error) {
+// getOrCreateKubernetesSecret creates or updates the output Secret of akvs. With syncPolicy
+// ReportOnly an existing Secret is only updated when forceSync is set, otherwise the change is
+// returned as pending.
+func (c *Controller) getOrCreateKubernetesSecret(akvs *akv.AzureKeyVaultSecret, forceSync bool) (*corev1.Secret, *pendingRotation, error) {
 	var secret *corev1.Secret
 	var secretValues map[string][]byte
 	var err error
 
 	secretName := akvs.Spec.Output.Secret.Name
 	if secretName == "" {
-		return nil, fmt.Errorf("output secret name must be specified using spec.output.secret.name")
+		return nil, nil, fmt.Errorf("output secret name must be specified using spec.output.secret.name")
 	}
 
 	klog.V(4).InfoS("get or create secret", "secret", klog.KRef(akvs.Namespace, secretName))
 	if secret, err = c.secretsLister.Secrets(akvs.Namespace).Get(secretName); err != nil {
 		if errors.IsNotFound(err) {
 			secretValues, err = c.getSecretFromKeyVault(akvs)
+			akvs, err = c.checkKeyCollision(akvs, err)
+			akvs, err = c.checkKeyMismatch(akvs, err)
 			if err != nil {
-				return nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
+				return nil, nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
 			}
 
-			if secret, err = c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Create(context.TODO(), createNewSecret(akvs, secretValues), metav1.CreateOptions{}); err != nil {
-				return nil, err
+			failedWrite := c.hasFailedWrite(outputKindSecret, akvs.Namespace, secretName)
+			if secret, err = c.writer().CreateSecret(context.TODO(), c.createNewSecret(akvs, secretValues)); err != nil {
+				return nil, nil, err
+			}
+			if akvs.Status.SecretName == secretName {
+				c.reportDriftRepaired(akvs, outputKindSecret, secretName, driftedKeys(diffSecretKeys(nil, nil, secret.Data)), failedWrite)
 			}
 
 			klog.InfoS("updating status for azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs))
-			if err = c.updateAzureKeyVaultSecretStatusForSecret(akvs, getMD5HashOfByteValues(secretValues)); err != nil {
-				return nil, err
+			if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenSecret(akvs, secretValues)); err != nil {
+				return nil, nil, err
 			}
 			c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
-			return secret, nil
+			return secret, nil, nil
 		}
 	}
 
 	// get updated secret values from azure key vault
 	secretValues, err = c.getSecretFromKeyVault(akvs)
+	akvs, err = c.checkKeyCollision(akvs, err)
+	akvs, err = c.checkKeyMismatch(akvs, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
+		return nil, nil, fmt.Errorf("failed to get secret from Azure Key Vault for secret '%s'/'%s', error: %+v", akvs.Namespace, akvs.Name, err)
 	}
 
 	if secretName != secret.Name {
@@ -119,34 +135,63 @@ func (c *Controller) getOrCreateKubernetesSecret(akvs *akv.AzureKeyVaultSecret)
 		// Only delete if this akvs is the only owner
 		if !hasMultipleOwners(secret.GetOwnerReferences()) {
 			// Delete secret
-			if err = c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Delete(context.TODO(), secret.Name, metav1.DeleteOptions{}); err != nil {
-				return nil, err
+			if err = c.writer().DeleteSecret(context.TODO(), akvs.Namespace, secret.Name); err != nil {
+				return nil, nil, err
 			}
 		}
 
 		// Recreate secret under new Name
-		if secret, err = c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Create(context.TODO(), createNewSecret(akvs, secretValues), metav1.CreateOptions{}); err != nil {
-			return nil, err
+		if secret, err = c.writer().CreateSecret(context.TODO(), c.createNewSecret(akvs, secretValues)); err != nil {
+			return nil, nil, err
 		}
 		c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
-		return secret, nil
+		return secret, nil, nil
+	}
+
+	hash := getHashOfByteValues(secretValues)
+	akvs, migrated := migrateSecretHash(akvs, secretValues)
+	valuesChanged := hasAzureKeyVaultSecretChangedForSecret(akvs, secretValues, secret)
+	if valuesChanged && isReportOnly(akvs, forceSync) {
+		klog.V(4).InfoS("values have changed, not updating secret with sync policy ReportOnly", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+		return secret, &pendingRotation{kind: outputKindSecret, name: secret.Name, hash: hash}, nil
+	}
+	if valuesChanged && akvs.Status.SecretHash != hash && c.isRotationDebounced(akvs, forceSync) {
+		klog.V(4).InfoS("values have changed, not updating secret until rotation debounce ends", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret), "applyTime", akvs.Status.DebouncedRotation.ApplyTime)
+		return secret, nil, nil
 	}
 
-	if hasAzureKeyVaultSecretChangedForSecret(akvs, secretValues, secret) {
+	if valuesChanged || c.hasProvenanceAnnotationsChanged(akvs, secret) || c.hasCertificateAnnotationsChanged(akvs, secret) {
 		klog.InfoS("values have changed requiring update to secret", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
 
-		updatedSecret, err := createNewSecretFromExisting(akvs, secretValues, secret)
+		updatedSecret, err := c.createNewSecretFromExisting(akvs, secretValues, secret)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		secret, err = c.kubeclientset.CoreV1().Secrets(akvs.Namespace).Update(context.TODO(), updatedSecret, metav1.UpdateOptions{})
-		if err == nil {
-			klog.InfoS("secret updated", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
-			c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
+		// the values in Azure Key Vault are unchanged since last written, so the secret has drifted
+		drift := valuesChanged && akvs.Status.SecretHash == hash
+		diff := diffSecretKeys(akvs.Status.SecretKeys, secret.Data, updatedSecret.Data)
+		failedWrite := c.hasFailedWrite(outputKindSecret, secret.Namespace, secret.Name)
+		secret, err = c.writer().PatchSecret(context.TODO(), secret, updatedSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		klog.InfoS("secret updated", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+		if drift {
+			c.reportDriftRepaired(akvs, outputKindSecret, secret.Name, driftedKeys(diff), failedWrite)
+		}
+		c.recorder.Event(secret, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretSynced)
+
+		if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenSecret(akvs, secretValues)); err != nil {
+			return nil, nil, err
+		}
+	} else if migrated {
+		klog.V(4).InfoS("values unchanged, recording sha-256 hash in status", "azurekeyvaultsecret", klog.KObj(akvs), "secret", klog.KObj(secret))
+		if err = c.updateAzureKeyVaultSecretStatus(akvs, writtenSecret(akvs, secretValues)); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return secret, err
+	return secret, nil, err
 }
 
 func hasMultipleOwners(refs []metav1.OwnerReference) bool {
@@ -165,7 +210,7 @@ func hasMultipleOwners(refs []metav1.OwnerReference) bool {
 // newSecret creates a new Secret for a AzureKeyVaultSecret resource. It also sets
 // the appropriate OwnerReferences on the resource so handleObject can discover
 // the AzureKeyVaultSecret resource that 'owns' it.
-func createNewSecret(akvs *akv.AzureKeyVaultSecret, azureSecretValues map[string][]byte) *corev1.Secret {
+func (c *Controller) createNewSecret(akvs *akv.AzureKeyVaultSecret, azureSecretValues map[string][]byte) *corev1.Secret {
 	secretName := determineSecretName(akvs)
 	secretType := determineSecretType(akvs)
 
@@ -174,7 +219,7 @@ func createNewSecret(akvs *akv.AzureKeyVaultSecret, azureSecretValues map[string
 			Name:        secretName,
 			Namespace:   akvs.Namespace,
 			Labels:      akvs.Labels,
-			Annotations: akvs.Annotations,
+			Annotations: c.secretAnnotations(akvs),
 			OwnerReferences: []metav1.OwnerReference{
 				*newOwnerRef(akvs, schema.GroupVersionKind{
 					Group:   akv.SchemeGroupVersion.Group,
@@ -191,7 +236,7 @@ func createNewSecret(akvs *akv.AzureKeyVaultSecret, azureSecretValues map[string
 // createNewSecretFromExisting creates a new Secret for a AzureKeyVaultSecret resource. It also sets
 // the appropriate OwnerReferences on the resource so handleObject can discover
 // the AzureKeyVaultSecret resource that 'owns' it.
-func createNewSecretFromExisting(akvs *akv.AzureKeyVaultSecret, values map[string][]byte, existingSecret *corev1.Secret) (*corev1.Secret, error) {
+func (c *Controller) createNewSecretFromExisting(akvs *akv.AzureKeyVaultSecret, values map[string][]byte, existingSecret *corev1.Secret) (*corev1.Secret, error) {
 	secretName := determineSecretName(akvs)
 	secretType := determineSecretType(akvs)
 
@@ -219,19 +264,24 @@ func createNewSecretFromExisting(akvs *akv.AzureKeyVaultSecret, values map[strin
 		}))
 	}
 
-	mergedValues := mergeValuesWithExistingSecret(values, existingSecret)
+	mergedValues := values
+	if !replacesAllSecretKeys(akvs) {
+		mergedValues = mergeValuesWithExistingSecret(values, existingSecret, getStaleSecretKeys(akvs, values, existingSecret))
+	}
 
-	return &corev1.Secret{
+	updated := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            secretName,
 			Namespace:       akvs.Namespace,
 			Labels:          akvs.Labels,
-			Annotations:     akvs.Annotations,
+			Annotations:     c.secretAnnotations(akvs),
 			OwnerReferences: ownerRefs,
 		},
 		Type: secretType,
 		Data: mergedValues,
-	}, nil
+	}
+	keepRotationGeneration(updated, existingSecret)
+	return updated, nil
 }
 
 // updateExistingSecret creates a new Secret for a AzureKeyVaultSecret resource. It also sets
@@ -244,7 +294,7 @@ func createNewSecretFromExistingWithUpdatedValues(akvs *akv.AzureKeyVaultSecret,
 	secretClone := existingSecret.DeepCopy()
 	ownerRefs := secretClone.GetOwnerReferences()
 
-	return &corev1.Secret{
+	updated := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            secretName,
 			Namespace:       akvs.Namespace,
@@ -254,7 +304,9 @@ func createNewSecretFromExistingWithUpdatedValues(akvs *akv.AzureKeyVaultSecret,
 		},
 		Type: secretType,
 		Data: values,
-	}, nil
+	}
+	keepRotationGeneration(updated, existingSecret)
+	return updated, nil
 }
 
 func isOwnedBy(obj metav1.Object, owner metav1.Object) bool {
@@ -268,7 +320,22 @@ func isOwnedBy(obj metav1.Object, owner metav1.Object) bool {
 	return false
 }
 
-func mergeValuesWithExistingSecret(values map[string][]byte, secret *corev1.Secret) map[string][]byte {
+// checkOutputOwnership checks that each of the outputs synced for akvs is owned by it, raising
+// an event for every output that is not and returning an error listing all of them
+func (c *Controller) checkOutputOwnership(akvs *akv.AzureKeyVaultSecret, outputs ...metav1.Object) error {
+	var errs []error
+	for _, output := range outputs {
+		if output == nil || isOwnedBy(output, akvs) {
+			continue
+		}
+		msg := fmt.Sprintf(MessageResourceExists, output.GetName())
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrResourceExists, msg)
+		errs = append(errs, fmt.Errorf("%s", msg))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func mergeValuesWithExistingSecret(values map[string][]byte, secret *corev1.Secret, staleKeys []string) map[string][]byte {
 	newValues := make(map[string][]byte)
 
 	// copy existing values into new map
@@ -282,9 +349,47 @@ func mergeValuesWithExistingSecret(values map[string][]byte, secret *corev1.Secr
 			newValues[key] = val
 		}
 	}
+
+	// remove keys previously written by this akvs, but no longer produced
+	for _, key := range staleKeys {
+		delete(newValues, key)
+	}
 	return newValues
 }
 
+// getStaleSecretKeys returns keys in secret that was written by akvs during the last
+// sync, but is no longer part of the akvs values
+func getStaleSecretKeys(akvs *akv.AzureKeyVaultSecret, akvsValues map[string][]byte, secret *corev1.Secret) []string {
+	var stale []string
+	for _, key := range akvs.Status.SecretKeys {
+		if _, ok := akvsValues[key]; ok {
+			continue
+		}
+		if _, ok := secret.Data[key]; ok {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
+
+// replacesAllSecretKeys tells if the output Secret of akvs should have exactly the keys of
+// akvs, instead of only updating the keys written by akvs
+func replacesAllSecretKeys(akvs *akv.AzureKeyVaultSecret) bool {
+	return akvs.Spec.Output.Secret.MergeStrategy == akv.AzureKeyVaultMergeStrategyReplaceAll
+}
+
+// getUnmanagedSecretKeys returns keys in secret not written by akvs
+func getUnmanagedSecretKeys(akvsValues map[string][]byte, secret *corev1.Secret) []string {
+	var unmanaged []string
+	for key := range secret.Data {
+		if _, ok := akvsValues[key]; !ok {
+			unmanaged = append(unmanaged, key)
+		}
+	}
+	sort.Strings(unmanaged)
+	return unmanaged
+}
+
 func determineSecretName(azureKeyVaultSecret *akv.AzureKeyVaultSecret) string {
 	name := azureKeyVaultSecret.Spec.Output.Secret.Name
 	if name == "" {
@@ -301,7 +406,11 @@ func determineSecretType(azureKeyVaultSecret *akv.AzureKeyVaultSecret) corev1.Se
 	return azureKeyVaultSecret.Spec.Output.Secret.Type
 }
 
-func getMD5HashOfByteValues(values map[string][]byte) string {
+func getHashOfByteValues(values map[string][]byte) string {
+	return hashByteValues(sha256.New(), values)
+}
+
+func hashByteValues(hasher hash.Hash, values map[string][]byte) string {
 	var mergedValues bytes.Buffer
 
 	// sort keys to make sure hash is consistent
@@ -311,16 +420,15 @@ func getMD5HashOfByteValues(values map[string][]byte) string {
 		mergedValues.WriteString(k + string(values[k]))
 	}
 
-	hasher := md5.New()
 	hasher.Write(mergedValues.Bytes())
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-func getMD5HashOfSecret(akvsValues map[string][]byte, secret *corev1.Secret) string {
+func getHashOfSecret(akvsValues map[string][]byte, secret *corev1.Secret) string {
 	// filter out only values related to this akvs,
 	// as multiple akvs can write to a single secret
 	values := filterByteValueKeys(akvsValues, secret.Data)
-	return getMD5HashOfByteValues(values)
+	return getHashOfByteValues(values)
 }
 
 func filterByteValueKeys(akvsValues, secretValues map[string][]byte) map[string][]byte {
@@ -17,19 +17,32 @@ limitations under the License.
 package controller
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/charset"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/multikeyvalue"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
-	yaml "gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 )
 
+// tlsCAKey is the conventional key of the ca chain in kubernetes.io/tls Secrets, as read by
+// ingress controllers and cert-manager
+const tlsCAKey = "ca.crt"
+
+// tlsChainKey is the key of the intermediate certificates in kubernetes.io/tls Secrets using
+// chainOrder split, leaving the leaf alone in tls.crt and the root in ca.crt
+const tlsChainKey = "chain.pem"
+
+// chainOrderSplit writes the leaf, intermediates and root of a certificate to separate keys
+const chainOrderSplit = "split"
+
 // KubernetesSecretHandler handles getting and formatting secrets from Azure Key Vault to Kubernetes
 type KubernetesHandler interface {
 	HandleSecret() (map[string][]byte, error)
@@ -41,24 +54,51 @@ type azureSecretHandler struct {
 	secretSpec    *akv.AzureKeyVaultSecret
 	vaultService  vault.Service
 	transformator transformers.Transformator
+
+	// value written to a kubernetes.io/ssh-auth secret when last handled was not a private key
+	invalidSSHPrivateKey bool
+
+	// version of the secret when last handled
+	metadata *vault.ObjectMetadata
 }
 
 // azureCertificateHandler handles getting and formatting Azure Key Vault Certificate from Azure Key Vault to Kubernetes
 type azureCertificateHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+
+	// password of spec.output.secret.keystore, read from its passwordSecretRef
+	keystorePassword string
+
+	// leaf certificate when last handled
+	certificate *x509.Certificate
+
+	// version of the certificate when last handled
+	metadata *vault.ObjectMetadata
 }
 
 // azureKeyHandler handles getting and formatting Azure Key Vault Key from Azure Key Vault to Kubernetes
 type azureKeyHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+
+	// version of the key when last handled, nil if read without key material
+	metadata *vault.ObjectMetadata
 }
 
 // azureMultiValueSecretHandler handles getting and formatting Azure Key Vault Secret containing multiple values from Azure Key Vault to Kubernetes
 type azureMultiValueSecretHandler struct {
 	secretSpec   *akv.AzureKeyVaultSecret
 	vaultService vault.Service
+
+	// keys renamed to valid data keys when last handled, from original to sanitized key
+	sanitizedKeys map[string]string
+
+	// patterns in includeKeys and excludeKeys matching no key when last handled
+	unmatchedKeyFilters []string
+
+	// version of the secret when last handled
+	metadata *vault.ObjectMetadata
 }
 
 // NewAzureSecretHandler return a new AzureSecretHandler
@@ -94,6 +134,21 @@ func NewAzureMultiKeySecretHandler(secretSpec *akv.AzureKeyVaultSecret, vaultSer
 	}
 }
 
+// transformedSecret reads the secret from Azure Key Vault, decodes it from its charset and
+// runs the transforms, being the same for Secret and ConfigMap outputs
+func (h *azureSecretHandler) transformedSecret() (string, error) {
+	secret, metadata, err := h.vaultService.GetSecretWithMetadata(&h.secretSpec.Spec.Vault)
+	if err != nil {
+		return "", err
+	}
+	h.metadata = metadata
+
+	if secret, err = charset.Decode(secret, h.secretSpec.Spec.Vault.Object.Charset); err != nil {
+		return "", fmt.Errorf("failed to decode secret value as %s, error: %+v", h.secretSpec.Spec.Vault.Object.Charset, err)
+	}
+	return h.transformator.Transform(secret)
+}
+
 // Handle getting and formating Azure Key Vault Secret from Azure Key Vault to Kubernetes
 func (h *azureSecretHandler) HandleSecret() (map[string][]byte, error) {
 	if h.secretSpec.Spec.Vault.Object.Type == akv.AzureKeyVaultObjectTypeMultiKeyValueSecret && h.secretSpec.Spec.Output.Secret.DataKey != "" {
@@ -102,12 +157,7 @@ func (h *azureSecretHandler) HandleSecret() (map[string][]byte, error) {
 
 	values := make(map[string][]byte)
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
-	if err != nil {
-		return nil, err
-	}
-
-	secret, err = h.transformator.Transform(secret)
+	secret, err := h.transformedSecret()
 	if err != nil {
 		return nil, err
 	}
@@ -122,28 +172,29 @@ func (h *azureSecretHandler) HandleSecret() (map[string][]byte, error) {
 		values[corev1.BasicAuthPasswordKey] = []byte(creds[1])
 
 	case corev1.SecretTypeDockerConfigJson:
+		if err = validateDockerConfigJSON(secret); err != nil {
+			return nil, err
+		}
 		values[corev1.DockerConfigJsonKey] = []byte(secret)
 
 	case corev1.SecretTypeDockercfg:
 		values[corev1.DockerConfigKey] = []byte(secret)
 
 	case corev1.SecretTypeSSHAuth:
+		if dataKey := h.secretSpec.Spec.Output.Secret.DataKey; dataKey != "" && dataKey != corev1.SSHAuthPrivateKey {
+			klog.InfoS("output data key ignored - secret type ssh-auth always uses its own key", "azurekeyvaultsecret", klog.KObj(h.secretSpec), "dataKey", dataKey)
+		}
+		secret = normalizeSSHPrivateKey(secret)
+		h.invalidSSHPrivateKey = !isSSHPrivateKey(secret)
 		values[corev1.SSHAuthPrivateKey] = []byte(secret)
 
 	case corev1.SecretTypeTLS:
-		pfxRaw, err := base64.StdEncoding.DecodeString(secret)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64 encoded secret, error: %+v", err)
-		}
-		cert, err := vault.NewCertificateFromPfx(pfxRaw, h.secretSpec.Spec.Output.Secret.ChainOrder == "ensureserverfirst")
+		cert, err := h.certificate(secret)
 		if err != nil {
-			return nil, fmt.Errorf("error while processing secret content as pfx, error: %+v", err)
-		}
-		if values[corev1.TLSCertKey], err = cert.ExportPublicKeyAsPem(); err != nil {
-			return nil, fmt.Errorf("error exporting public key, error: %+v", err)
+			return nil, err
 		}
-		if values[corev1.TLSPrivateKeyKey], err = cert.ExportPrivateKeyAsPem(); err != nil {
-			return nil, fmt.Errorf("error exporting private key, error: %+v", err)
+		if err = writeTLSCertificate(cert, h.secretSpec.Spec.Output.Secret, values); err != nil {
+			return nil, err
 		}
 
 	default:
@@ -165,12 +216,7 @@ func (h *azureSecretHandler) HandleConfigMap() (map[string]string, error) {
 
 	values := make(map[string]string)
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
-	if err != nil {
-		return nil, err
-	}
-
-	secret, err = h.transformator.Transform(secret)
+	secret, err := h.transformedSecret()
 	if err != nil {
 		return nil, err
 	}
@@ -188,32 +234,74 @@ func (h *azureSecretHandler) HandleConfigMap() (map[string]string, error) {
 func (h *azureCertificateHandler) HandleSecret() (map[string][]byte, error) {
 	values := make(map[string][]byte)
 	var err error
+	outputSpec := h.secretSpec.Spec.Output.Secret
+	encoding := outputSpec.Certificate.Encoding
 	options := vault.CertificateOptions{
-		ExportPrivateKey:  h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeTLS || h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeOpaque,
-		EnsureServerFirst: h.secretSpec.Spec.Output.Secret.ChainOrder == "ensureserverfirst",
+		ExportPrivateKey:  outputSpec.Type == corev1.SecretTypeTLS || outputSpec.Type == corev1.SecretTypeOpaque,
+		EnsureServerFirst: outputSpec.ChainOrder == "ensureserverfirst",
 	}
 
-	if !options.ExportPrivateKey && h.secretSpec.Spec.Output.Secret.DataKey == "" {
+	if (!options.ExportPrivateKey || (outputSpec.Type == corev1.SecretTypeOpaque && encoding != "")) && outputSpec.DataKey == "" {
 		return nil, fmt.Errorf("no datakey specified for output secret")
 	}
 
+	// tls secrets are consumed as pem by convention
+	if outputSpec.Type == corev1.SecretTypeTLS && encoding != "" && encoding != akv.AzureKeyVaultCertificateEncodingPem {
+		return nil, fmt.Errorf("certificate encoding '%s' is not supported for secret type %s", encoding, corev1.SecretTypeTLS)
+	}
+	if outputSpec.Certificate.IncludeCAChain && outputSpec.Type != corev1.SecretTypeTLS {
+		return nil, fmt.Errorf("includeCAChain is only supported for secret type %s", corev1.SecretTypeTLS)
+	}
+	if outputSpec.ChainOrder == chainOrderSplit && outputSpec.Type != corev1.SecretTypeTLS {
+		return nil, fmt.Errorf("chainOrder %s is only supported for secret type %s", chainOrderSplit, corev1.SecretTypeTLS)
+	}
+	if outputSpec.ChainOrder == chainOrderSplit && outputSpec.Certificate.IncludeCAChain {
+		return nil, fmt.Errorf("includeCAChain cannot be combined with chainOrder %s, which writes the root to %s", chainOrderSplit, tlsCAKey)
+	}
+	if outputSpec.Keystore != nil && !options.ExportPrivateKey {
+		return nil, fmt.Errorf("keystore is only supported for secret types %s and %s", corev1.SecretTypeOpaque, corev1.SecretTypeTLS)
+	}
+
 	cert, err := h.vaultService.GetCertificate(&h.secretSpec.Spec.Vault, &options)
 	if err != nil {
 		return nil, err
 	}
+	h.metadata = cert.Metadata
+	// ingress controllers expect the leaf first in tls.crt, whatever order the pfx was uploaded in
+	if outputSpec.Type == corev1.SecretTypeTLS {
+		cert.LeafFirst()
+	}
+	if len(cert.Certificates) > 0 {
+		h.certificate = cert.Certificates[0]
+	}
 
-	if h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeOpaque {
-		values[h.secretSpec.Spec.Output.Secret.DataKey] = cert.ExportRaw()
-	} else if options.ExportPrivateKey {
-		if values[corev1.TLSCertKey], err = cert.ExportPublicKeyAsPem(); err != nil {
+	if outputSpec.Type == corev1.SecretTypeOpaque && encoding == "" {
+		values[outputSpec.DataKey] = cert.ExportRaw()
+	} else if outputSpec.Type == corev1.SecretTypeOpaque {
+		if values, err = encodeCertificate(cert, encoding, outputSpec.DataKey); err != nil {
 			return nil, err
 		}
-		if values[corev1.TLSPrivateKeyKey], err = cert.ExportPrivateKeyAsPem(); err != nil {
+		if cert.HasPrivateKey {
+			privateDataKey := determinePrivateKeyDataKey(outputSpec.DataKey, outputSpec.Key)
+			if _, ok := values[privateDataKey]; ok {
+				return nil, &keyCollisionError{key: privateDataKey, source: "the certificate", source2: "the private key"}
+			}
+			if values[privateDataKey], err = exportCertificatePrivateKey(cert, outputSpec.KeyEncoding); err != nil {
+				return nil, err
+			}
+		}
+	} else if options.ExportPrivateKey {
+		if err = writeTLSCertificate(cert, outputSpec, values); err != nil {
 			return nil, err
 		}
 	} else {
-		values[h.secretSpec.Spec.Output.Secret.DataKey], err = cert.ExportPublicKeyAsPem()
-		if err != nil {
+		if values, err = encodeCertificate(cert, encoding, outputSpec.DataKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if outputSpec.Keystore != nil {
+		if err = writeKeystore(cert, outputSpec.Keystore, h.secretSpec.Spec.Vault.Object.Name, h.keystorePassword, values); err != nil {
 			return nil, err
 		}
 	}
@@ -224,110 +312,415 @@ func (h *azureCertificateHandler) HandleSecret() (map[string][]byte, error) {
 // Handle getting and formating Azure Key Vault Certificate from Azure Key Vault to Kubernetes
 func (h *azureCertificateHandler) HandleConfigMap() (map[string]string, error) {
 	values := make(map[string]string)
-	var err error
+	outputSpec := h.secretSpec.Spec.Output.ConfigMap
+
+	if outputSpec.Certificate.IncludeCAChain {
+		return nil, fmt.Errorf("includeCAChain is only supported for secret outputs of type %s", corev1.SecretTypeTLS)
+	}
 
 	cert, err := h.vaultService.GetCertificate(&h.secretSpec.Spec.Vault, nil)
 	if err != nil {
 		return nil, err
 	}
+	h.metadata = cert.Metadata
 
-	value, err := cert.ExportPublicKeyAsPem()
+	encoded, err := encodeCertificate(cert, outputSpec.Certificate.Encoding, outputSpec.DataKey)
 	if err != nil {
 		return nil, err
 	}
+	for key, value := range encoded {
+		values[key] = string(value)
+	}
+
+	return values, nil
+}
+
+// certificate reads the certificate in a secret of content type application/x-pem-file as pem,
+// as when a certificate is imported to Azure Key Vault as a secret. Secrets of any other content
+// type are read as base64 encoded pfx, being application/x-pkcs12.
+func (h *azureSecretHandler) certificate(secret string) (*vault.Certificate, error) {
+	contentType := vault.CertificateContentTypePfx
+	if h.metadata != nil && h.metadata.ContentType == vault.CertificateContentTypePem {
+		contentType = vault.CertificateContentTypePem
+	}
+
+	cert, err := vault.NewCertificateFromSecret(secret, contentType, h.secretSpec.Spec.Output.Secret.ChainOrder == "ensureserverfirst")
+	if err != nil {
+		return nil, fmt.Errorf("error while processing secret content as %s for secret type %s, error: %+v", contentType, corev1.SecretTypeTLS, err)
+	}
+	// ingress controllers expect the leaf first in tls.crt, as for certificate objects
+	cert.LeafFirst()
+	return cert, nil
+}
+
+// writeTLSCertificate writes cert to the keys of a kubernetes.io/tls secret, being the private
+// key in tls.key and the certificate in tls.crt, along with its chain split into chain.pem and
+// ca.crt or in ca.crt as set in outputSpec
+func writeTLSCertificate(cert *vault.Certificate, outputSpec akv.AzureKeyVaultOutputSecret, values map[string][]byte) error {
+	var err error
+	if !outputSpec.SkipKeyMatchCheck {
+		if err = verifyKeyMatchesCertificate(cert); err != nil {
+			return err
+		}
+	}
+	if values[corev1.TLSPrivateKeyKey], err = exportCertificatePrivateKey(cert, outputSpec.KeyEncoding); err != nil {
+		return fmt.Errorf("error exporting private key, error: %+v", err)
+	}
+	if outputSpec.ChainOrder == chainOrderSplit {
+		return splitCertificateChain(cert, values)
+	}
+	if values[corev1.TLSCertKey], err = cert.ExportPublicKeyAsPem(); err != nil {
+		return fmt.Errorf("error exporting public key, error: %+v", err)
+	}
+	if chain := cert.ExportCAChainAsPem(); outputSpec.Certificate.IncludeCAChain && len(chain) > 0 {
+		values[tlsCAKey] = chain
+	}
+	return nil
+}
 
-	values[h.secretSpec.Spec.Output.ConfigMap.DataKey] = string(value)
+// exportCertificatePrivateKey returns the private key of cert pem encoded in format. The key is
+// marshaled from its parsed form, so the value and the hash telling if the output changed only
+// depend on the key and format, not on how the key was stored in Azure Key Vault.
+func exportCertificatePrivateKey(cert *vault.Certificate, format akv.AzureKeyVaultPrivateKeyFormat) ([]byte, error) {
+	switch format {
+	case "", akv.AzureKeyVaultPrivateKeyFormatPkcs1:
+		return cert.ExportPrivateKeyAsPem()
+	case akv.AzureKeyVaultPrivateKeyFormatPkcs8:
+		return cert.ExportPrivateKeyAsPkcs8Pem()
+	default:
+		return nil, fmt.Errorf("private key format '%s' not supported", format)
+	}
+}
+
+// splitCertificateChain writes the leaf of cert to tls.crt, the intermediates in order from the
+// one issuing the leaf to chain.pem and the root to ca.crt. Keys are left out when the chain has
+// no intermediates or no root, as an empty value would be read as an empty chain.
+func splitCertificateChain(cert *vault.Certificate, values map[string][]byte) error {
+	leaf, intermediates, root, err := cert.SplitChain()
+	if err != nil {
+		return fmt.Errorf("failed to split certificate chain, error: %+v", err)
+	}
 
+	values[corev1.TLSCertKey] = vault.CertificatesAsPem(leaf)
+	if len(intermediates) > 0 {
+		values[tlsChainKey] = vault.CertificatesAsPem(intermediates...)
+	}
+	if root != nil {
+		values[tlsCAKey] = vault.CertificatesAsPem(root)
+	}
+	return nil
+}
+
+// encodeCertificate returns the certificate and its chain, keyed by data key. Pem writes
+// the whole chain to dataKey, while der and base64der write the certificate to dataKey and
+// each certificate in the chain to <dataKey>-chain-<n>, as der holds a single certificate.
+func encodeCertificate(cert *vault.Certificate, encoding akv.AzureKeyVaultCertificateEncoding, dataKey string) (map[string][]byte, error) {
+	switch encoding {
+	case "", akv.AzureKeyVaultCertificateEncodingPem:
+		value, err := cert.ExportPublicKeyAsPem()
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{dataKey: value}, nil
+	case akv.AzureKeyVaultCertificateEncodingDer, akv.AzureKeyVaultCertificateEncodingBase64Der:
+	default:
+		return nil, fmt.Errorf("certificate encoding '%s' not supported", encoding)
+	}
+
+	ders, err := cert.ExportPublicKeysAsDer()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(ders))
+	for i, der := range ders {
+		key := dataKey
+		if i > 0 {
+			key = fmt.Sprintf("%s-chain-%d", dataKey, i)
+		}
+		if encoding == akv.AzureKeyVaultCertificateEncodingBase64Der {
+			der = []byte(base64.StdEncoding.EncodeToString(der))
+		}
+		values[key] = der
+	}
 	return values, nil
 }
 
 // Handle getting and formating Azure Key Vault Key from Azure Key Vault to Kubernetes
 func (h *azureKeyHandler) HandleSecret() (map[string][]byte, error) {
-	key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
+	values := make(map[string][]byte)
+	outputSpec := h.secretSpec.Spec.Output.Secret
+
+	if outputSpec.Key.Encoding == "" {
+		key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
+		if err != nil {
+			return nil, err
+		}
+
+		values[outputSpec.DataKey] = []byte(key)
+		return values, nil
+	}
+
+	if outputSpec.DataKey == "" {
+		return nil, fmt.Errorf("no datakey specified for output secret")
+	}
+
+	if outputSpec.Key.Encoding == akv.AzureKeyVaultKeyEncodingJWKS {
+		jwks, err := h.jwks(outputSpec.Key.IncludePreviousVersions)
+		if err != nil {
+			return nil, err
+		}
+		values[outputSpec.DataKey] = jwks
+		return values, nil
+	}
+
+	key, err := h.vaultService.GetKeyMaterial(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return nil, err
 	}
+	h.metadata = key.Metadata
+
+	if values[outputSpec.DataKey], err = encodeKey(key, outputSpec.Key.Encoding, false, ""); err != nil {
+		return nil, err
+	}
+
+	if key.HasPrivateKey {
+		privateDataKey := determinePrivateKeyDataKey(outputSpec.DataKey, outputSpec.Key)
+		if _, ok := values[privateDataKey]; ok {
+			return nil, &keyCollisionError{key: privateDataKey, source: "the public key", source2: "the private key"}
+		}
+		if values[privateDataKey], err = encodeKey(key, outputSpec.Key.Encoding, true, outputSpec.KeyEncoding); err != nil {
+			return nil, err
+		}
+	}
 
-	values := make(map[string][]byte)
-	values[h.secretSpec.Spec.Output.Secret.DataKey] = []byte(key)
 	return values, nil
 }
 
 // Handle getting and formating Azure Key Vault Key from Azure Key Vault to Kubernetes
 func (h *azureKeyHandler) HandleConfigMap() (map[string]string, error) {
-	key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
+	values := make(map[string]string)
+	outputSpec := h.secretSpec.Spec.Output.ConfigMap
+
+	if outputSpec.Key.Encoding == "" {
+		key, err := h.vaultService.GetKey(&h.secretSpec.Spec.Vault)
+		if err != nil {
+			return nil, err
+		}
+
+		values[outputSpec.DataKey] = key
+		return values, nil
+	}
+
+	if outputSpec.DataKey == "" {
+		return nil, fmt.Errorf("no datakey specified for output configmap")
+	}
+
+	if outputSpec.Key.Encoding == akv.AzureKeyVaultKeyEncodingJWKS {
+		jwks, err := h.jwks(outputSpec.Key.IncludePreviousVersions)
+		if err != nil {
+			return nil, err
+		}
+		values[outputSpec.DataKey] = string(jwks)
+		return values, nil
+	}
+
+	key, err := h.vaultService.GetKeyMaterial(&h.secretSpec.Spec.Vault)
 	if err != nil {
 		return nil, err
 	}
+	h.metadata = key.Metadata
 
-	values := make(map[string]string)
-	values[h.secretSpec.Spec.Output.ConfigMap.DataKey] = key
+	// configmaps are not meant for secret data, so only the public key is written
+	pubKey, err := encodeKey(key, outputSpec.Key.Encoding, false, "")
+	if err != nil {
+		return nil, err
+	}
+	values[outputSpec.DataKey] = string(pubKey)
 	return values, nil
 }
 
-// Handle getting and formating Azure Key Vault Secret containing multiple values from Azure Key Vault to Kubernetes
-func (h *azureMultiValueSecretHandler) HandleSecret() (map[string][]byte, error) {
-	values := make(map[string][]byte)
-
-	if h.secretSpec.Spec.Vault.Object.ContentType == "" {
-		return nil, fmt.Errorf("cannot use '%s' without also specifying content type", akv.AzureKeyVaultObjectTypeMultiKeyValueSecret)
+// jwks returns the public part of the key as a json web key set, along with up to
+// previousVersions enabled versions before it so tokens signed by a rotated key can still be
+// verified. Each key has its version in Azure Key Vault as kid.
+func (h *azureKeyHandler) jwks(previousVersions int) ([]byte, error) {
+	key, err := h.vaultService.GetKeyMaterial(&h.secretSpec.Spec.Vault)
+	if err != nil {
+		return nil, err
 	}
+	h.metadata = key.Metadata
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
+	current := h.secretSpec.Spec.Vault.Object.Version
+	if key.Metadata != nil {
+		current = key.Metadata.Version
+	}
+	jwk, err := key.ExportPublicKeyAsJWK(current)
 	if err != nil {
 		return nil, err
 	}
+	set := vault.JSONWebKeySet{Keys: []vault.JSONWebKey{jwk}}
+
+	if previousVersions > 0 {
+		versions, err := h.vaultService.GetObjectVersions(&h.secretSpec.Spec.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of key '%s', error: %+v", h.secretSpec.Spec.Vault.Object.Name, err)
+		}
+		for _, version := range vault.PreviousVersions(versions, current, previousVersions) {
+			vaultSpec := h.secretSpec.Spec.Vault.DeepCopy()
+			vaultSpec.Object.Version = version.Version
+			previous, err := h.vaultService.GetKeyMaterial(vaultSpec)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get version '%s' of key '%s', error: %+v", version.Version, vaultSpec.Object.Name, err)
+			}
+			jwk, err := previous.ExportPublicKeyAsJWK(version.Version)
+			if err != nil {
+				return nil, err
+			}
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
 
-	var dat map[string]string
+	return json.Marshal(set)
+}
 
-	switch h.secretSpec.Spec.Vault.Object.ContentType {
-	case akv.AzureKeyVaultObjectContentTypeJSON:
-		if err := json.Unmarshal([]byte(secret), &dat); err != nil {
-			return nil, err
+// encodeKey returns the public or private key material of key in encoding. Private keys are
+// pkcs#1 for rsa and sec1 for ec keys, unless format is pkcs8
+func encodeKey(key *vault.Key, encoding akv.AzureKeyVaultKeyEncoding, private bool, format akv.AzureKeyVaultPrivateKeyFormat) ([]byte, error) {
+	var der []byte
+	var err error
+
+	pkcs8 := false
+	switch format {
+	case "", akv.AzureKeyVaultPrivateKeyFormatPkcs1:
+	case akv.AzureKeyVaultPrivateKeyFormatPkcs8:
+		pkcs8 = true
+	default:
+		return nil, fmt.Errorf("private key format '%s' not supported", format)
+	}
+
+	switch encoding {
+	case akv.AzureKeyVaultKeyEncodingPem:
+		if private && pkcs8 {
+			return key.ExportPrivateKeyAsPkcs8Pem()
+		}
+		if private {
+			return key.ExportPrivateKeyAsPem()
+		}
+		return key.ExportPublicKeyAsPem()
+	case akv.AzureKeyVaultKeyEncodingDer, akv.AzureKeyVaultKeyEncodingBase64:
+		if private && pkcs8 {
+			der, err = key.ExportPrivateKeyAsPkcs8Der()
+		} else if private {
+			der, err = key.ExportPrivateKeyAsDer()
+		} else {
+			der, err = key.ExportPublicKeyAsDer()
 		}
-	case akv.AzureKeyVaultObjectContentTypeYaml:
-		if err := yaml.Unmarshal([]byte(secret), &dat); err != nil {
+		if err != nil {
 			return nil, err
 		}
 	default:
-		return nil, fmt.Errorf("content type '%s' not supported", h.secretSpec.Spec.Vault.Object.ContentType)
+		return nil, fmt.Errorf("key encoding '%s' not supported", encoding)
 	}
 
-	for k, v := range dat {
-		values[k] = []byte(v)
+	if encoding == akv.AzureKeyVaultKeyEncodingBase64 {
+		return []byte(base64.StdEncoding.EncodeToString(der)), nil
 	}
+	return der, nil
+}
 
-	return values, nil
+func determinePrivateKeyDataKey(dataKey string, keySpec akv.AzureKeyVaultOutputKey) string {
+	if keySpec.PrivateDataKey != "" {
+		return keySpec.PrivateDataKey
+	}
+	return dataKey + "-private"
 }
 
 // Handle getting and formating Azure Key Vault Secret containing multiple values from Azure Key Vault to Kubernetes
-func (h *azureMultiValueSecretHandler) HandleConfigMap() (map[string]string, error) {
-	values := make(map[string]string)
+// decode reads the multi-key-value secret from Azure Key Vault and decodes its keys and values,
+// in spec.vault.object.contentType or else the content type attribute of the secret
+func (h *azureMultiValueSecretHandler) decode() (map[string]string, error) {
+	secret, metadata, err := h.vaultService.GetSecretWithMetadata(&h.secretSpec.Spec.Vault)
+	if err != nil {
+		return nil, err
+	}
+	h.metadata = metadata
 
-	if h.secretSpec.Spec.Vault.Object.ContentType == "" {
-		return nil, fmt.Errorf("cannot use '%s' without also specifying content type", akv.AzureKeyVaultObjectTypeMultiKeyValueSecret)
+	object := h.secretSpec.Spec.Vault.Object
+	if object.ContentType == "" {
+		var attribute string
+		if metadata != nil {
+			attribute = metadata.ContentType
+		}
+		contentType, ok := multikeyvalue.ContentTypeFromAttribute(attribute)
+		if !ok {
+			return nil, fmt.Errorf("cannot use '%s' without a content type, set spec.vault.object.contentType or a content type of %s, %s or %s on secret '%s' in Azure Key Vault, which has content type '%s'",
+				akv.AzureKeyVaultObjectTypeMultiKeyValueSecret, akv.AzureKeyVaultObjectContentTypeJSON, akv.AzureKeyVaultObjectContentTypeYaml, akv.AzureKeyVaultObjectContentTypeProperties, object.Name, attribute)
+		}
+		klog.V(4).InfoS("using content type of secret in azure key vault", "azurekeyvaultsecret", klog.KObj(h.secretSpec), "contentType", contentType)
+		object.ContentType = contentType
 	}
 
-	secret, err := h.vaultService.GetSecret(&h.secretSpec.Spec.Vault)
+	if secret, err = charset.Decode(secret, object.Charset); err != nil {
+		return nil, fmt.Errorf("failed to decode secret value as %s, error: %+v", object.Charset, err)
+	}
+
+	dat, err := multikeyvalue.Decode(secret, &object)
 	if err != nil {
 		return nil, err
 	}
 
-	var dat map[string]string
+	if dat, h.sanitizedKeys, err = sanitizeDataKeys(dat); err != nil {
+		return nil, err
+	}
+	return dat, nil
+}
 
-	switch h.secretSpec.Spec.Vault.Object.ContentType {
-	case akv.AzureKeyVaultObjectContentTypeJSON:
-		if err := json.Unmarshal([]byte(secret), &dat); err != nil {
+func (h *azureMultiValueSecretHandler) HandleSecret() (map[string][]byte, error) {
+	values := make(map[string][]byte)
+
+	dat, err := h.decode()
+	if err != nil {
+		return nil, err
+	}
+	dat, h.unmatchedKeyFilters = filterKeys(dat, h.secretSpec.Spec.Output.Secret.IncludeKeys, h.secretSpec.Spec.Output.Secret.ExcludeKeys)
+	for k, v := range dat {
+		values[k] = []byte(v)
+	}
+
+	if h.secretSpec.Spec.Output.Secret.Type == corev1.SecretTypeBasicAuth {
+		if err = verifyBasicAuthKeys(values); err != nil {
 			return nil, err
 		}
-	case akv.AzureKeyVaultObjectContentTypeYaml:
-		if err := yaml.Unmarshal([]byte(secret), &dat); err != nil {
-			return nil, err
+	}
+
+	return values, nil
+}
+
+// verifyBasicAuthKeys checks that the keys of a multi key value secret hold both the username
+// and password of a kubernetes.io/basic-auth Secret. Other keys are kept as is.
+func verifyBasicAuthKeys(values map[string][]byte) error {
+	var missing []string
+	for _, key := range []string{corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey} {
+		if _, ok := values[key]; !ok {
+			missing = append(missing, key)
 		}
-	default:
-		return nil, fmt.Errorf("content type '%s' not supported", h.secretSpec.Spec.Vault.Object.ContentType)
 	}
+	if len(missing) > 0 {
+		return fmt.Errorf("unable to handle azure key vault secret as %s - missing key(s) '%s', found keys '%s'",
+			corev1.SecretTypeBasicAuth, strings.Join(missing, "', '"), strings.Join(sortByteValueKeys(values), "', '"))
+	}
+	return nil
+}
+
+// Handle getting and formating Azure Key Vault Secret containing multiple values from Azure Key Vault to Kubernetes
+func (h *azureMultiValueSecretHandler) HandleConfigMap() (map[string]string, error) {
+	values := make(map[string]string)
 
+	dat, err := h.decode()
+	if err != nil {
+		return nil, err
+	}
+	dat, h.unmatchedKeyFilters = filterKeys(dat, h.secretSpec.Spec.Output.ConfigMap.IncludeKeys, h.secretSpec.Spec.Output.ConfigMap.ExcludeKeys)
 	for k, v := range dat {
 		values[k] = v
 	}
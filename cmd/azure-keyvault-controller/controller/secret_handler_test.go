@@ -17,8 +17,21 @@ limitations under the License.
 package controller
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
@@ -36,6 +49,9 @@ var (
 type fakeVaultService struct {
 	fakeSecretValue string
 	fakeCertValue   string
+	fakeKey         *vault.Key
+	fakeVersions    []vault.ObjectVersion
+	fakeMetadata    *vault.ObjectMetadata
 }
 
 func (f *fakeVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
@@ -44,9 +60,16 @@ func (f *fakeVaultService) GetSecret(secret *akv.AzureKeyVault) (string, error)
 	}
 	return "", nil
 }
+func (f *fakeVaultService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	value, err := f.GetSecret(secret)
+	return value, f.fakeMetadata, err
+}
 func (f *fakeVaultService) GetKey(secret *akv.AzureKeyVault) (string, error) {
 	return "", nil
 }
+func (f *fakeVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	return f.fakeKey, nil
+}
 func (f *fakeVaultService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (*vault.Certificate, error) {
 	if f.fakeCertValue != "" {
 		return vault.NewCertificateFromPem(f.fakeCertValue)
@@ -54,6 +77,14 @@ func (f *fakeVaultService) GetCertificate(secret *akv.AzureKeyVault, options *va
 	return nil, nil
 }
 
+func (f *fakeVaultService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (*time.Time, error) {
+	return nil, nil
+}
+
+func (f *fakeVaultService) GetObjectVersions(secret *akv.AzureKeyVault) ([]vault.ObjectVersion, error) {
+	return f.fakeVersions, nil
+}
+
 func secret() *akv.AzureKeyVaultSecret {
 	return &akv.AzureKeyVaultSecret{
 		TypeMeta: metav1.TypeMeta{APIVersion: akv.SchemeGroupVersion.String()},
@@ -101,6 +132,98 @@ secondValue: some second value data`,
 	}
 }
 
+// dotEnvSecret is an AzureKeyVaultSecret syncing a dotenv file in Azure Key Vault to one key per variable
+func dotEnvSecret() *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object.Name = "app-env"
+	akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+	akvs.Spec.Vault.Object.ContentType = akv.AzureKeyVaultObjectContentTypeEnv
+	akvs.Spec.Output.Secret.Name = "app-env"
+	return akvs
+}
+
+func TestHandleMultiValueSecretAsDotEnv(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeSecretValue: "# app settings\nexport DB_HOST=db.local\n\nDB_PASSWORD=\"s3cret # not a comment\"\nAPI_KEY='k3y' # comment\n",
+	}
+
+	handler := NewAzureMultiKeySecretHandler(dotEnvSecret(), fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"DB_HOST": "db.local", "DB_PASSWORD": "s3cret # not a comment", "API_KEY": "k3y"}
+	if len(values) != len(expected) {
+		t.Fatalf("expected keys %v, but got %v", expected, values)
+	}
+	for key, value := range expected {
+		if string(values[key]) != value {
+			t.Errorf("expected '%s' for key '%s', but got '%s'", value, key, values[key])
+		}
+	}
+
+	fakeVault.fakeSecretValue = "DB_HOST=db.local\nDB_HOST=db.other\n"
+	if _, err = handler.HandleSecret(); err == nil || !strings.Contains(err.Error(), "key 'DB_HOST' is set more than once") {
+		t.Errorf("expected error on duplicate key, but got %v", err)
+	}
+}
+
+func TestHandleMultiValueSecretContentTypeFromAttribute(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeSecretValue: "db:\n  host: db.local\n",
+		fakeMetadata:    &vault.ObjectMetadata{ContentType: "application/yaml; charset=utf-8"},
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+
+	handler := NewAzureMultiKeySecretHandler(secret, fakeVault)
+	values, err := handler.HandleConfigMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["db.host"] != "db.local" {
+		t.Errorf("expected yaml read by content type attribute, but got %v", values)
+	}
+
+	fakeVault.fakeMetadata.ContentType = "text/plain"
+	if _, err = handler.HandleSecret(); err == nil || !strings.Contains(err.Error(), "which has content type 'text/plain'") {
+		t.Errorf("expected error naming the unsupported content type attribute, but got %v", err)
+	}
+}
+
+func TestHandleMultiValueSecretAsBasicAuth(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeSecretValue: `{"username":"u","password":"p"}`,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+	secret.Spec.Vault.Object.ContentType = akv.AzureKeyVaultObjectContentTypeJSON
+	secret.Spec.Output.Secret.Name = "my-basic-auth"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeBasicAuth
+
+	handler := NewAzureMultiKeySecretHandler(secret, fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[corev1.BasicAuthUsernameKey]) != "u" || string(values[corev1.BasicAuthPasswordKey]) != "p" {
+		t.Errorf("expected username 'u' and password 'p', but got %v", values)
+	}
+
+	newSecret := (&Controller{options: &Options{}}).createNewSecret(secret, values)
+	if newSecret.Type != corev1.SecretTypeBasicAuth {
+		t.Errorf("expected secret type %s, but got %s", corev1.SecretTypeBasicAuth, newSecret.Type)
+	}
+
+	fakeVault.fakeSecretValue = `{"user":"u","password":"p"}`
+	_, err = handler.HandleSecret()
+	if err == nil || !strings.Contains(err.Error(), "'username'") {
+		t.Errorf("expected missing username to be reported, but got %v", err)
+	}
+}
+
 func TestHandleSecretWithNoDataKey(t *testing.T) {
 	fakeVault := &fakeVaultService{
 		fakeSecretValue: "Some very secret data",
@@ -141,6 +264,48 @@ func TestHandleConfigMapWithNoDataKey(t *testing.T) {
 	}
 }
 
+func TestHandleSecretDecodesCharsetBeforeTransforms(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		// " Blåbær\n" in UTF-16LE with byte order mark
+		fakeSecretValue: "\xff\xfe \x00B\x00l\x00\xe5\x00b\x00\xe6\x00r\x00\n\x00",
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Charset = akv.AzureKeyVaultCharsetUTF16LE
+	secret.Spec.Output.Secret.DataKey = "value"
+	secret.Spec.Output.Transform = []string{"trim"}
+	transformator, err := transformers.CreateTransformator(&secret.Spec.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAzureSecretHandler(secret, fakeVault, *transformator)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["value"]) != "Blåbær" {
+		t.Errorf("expected 'Blåbær', but got '%s'", values["value"])
+	}
+}
+
+func TestHandleSecretFailsOnInvalidCharset(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeSecretValue: "\xff\xfeB\x00l",
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Charset = akv.AzureKeyVaultCharsetUTF16LE
+	secret.Spec.Output.ConfigMap.DataKey = "value"
+	transformator, err := transformers.CreateTransformator(&secret.Spec.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAzureSecretHandler(secret, fakeVault, *transformator)
+	if _, err := handler.HandleConfigMap(); err == nil {
+		t.Error("expected invalid utf-16le value to fail")
+	}
+}
+
 func TestHandleCertificateWithTlsOutput(t *testing.T) {
 	fakeVault := &fakeVaultService{
 		fakeCertValue: pemCert,
@@ -314,7 +479,7 @@ func TestHandleSecretWithBasicAuthOutput(t *testing.T) {
 
 func TestHandleSecretWithDockerConfigJsonAsOutput(t *testing.T) {
 	fakeVault := &fakeVaultService{
-		fakeSecretValue: "lkajslfjalsdj",
+		fakeSecretValue: `{"auths":{"myregistry.azurecr.io":{"auth":"dXNlcjpwYXNzd29yZA=="}}}`,
 	}
 
 	secret := secret()
@@ -430,3 +595,621 @@ func TestHandleSecretWithTypeTLSAsOutput(t *testing.T) {
 		t.Errorf("there should be a value stored for key '%s'", corev1.TLSPrivateKeyKey)
 	}
 }
+
+func TestHandleSecretWithCertificateContentType(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeSecretValue: pemTLSChainScrambled,
+		fakeMetadata:    &vault.ObjectMetadata{ContentType: vault.CertificateContentTypePem},
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "secret"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+	secret.Spec.Output.Secret.ChainOrder = chainOrderSplit
+	transformator, err := transformers.CreateTransformator(&secret.Spec.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := NewAzureSecretHandler(secret, fakeVault, *transformator).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[corev1.TLSCertKey]) != pemTLSLeaf || string(values[tlsChainKey]) != pemTLSIntermediate || string(values[tlsCAKey]) != pemTLSRoot {
+		t.Errorf("expected the pem chain split as for certificate objects, but got %v", values)
+	}
+	if values[corev1.TLSPrivateKeyKey] == nil {
+		t.Errorf("there should be a value stored for key '%s'", corev1.TLSPrivateKeyKey)
+	}
+
+	// pfx is only decoded for tls secrets, other types get the value as stored in Azure Key Vault
+	fakeVault = &fakeVaultService{
+		fakeSecretValue: pfxCert,
+		fakeMetadata:    &vault.ObjectMetadata{ContentType: vault.CertificateContentTypePfx},
+	}
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeOpaque
+	secret.Spec.Output.Secret.ChainOrder = ""
+	secret.Spec.Output.Secret.DataKey = "cert.pfx"
+	values, err = NewAzureSecretHandler(secret, fakeVault, *transformator).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["cert.pfx"]) != pfxCert {
+		t.Error("expected the pfx written as is to an Opaque secret")
+	}
+}
+
+func fakeRsaKey(t *testing.T) (*vault.Key, *rsa.PrivateKey) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &vault.Key{
+		KeyType:       vault.CertificateKeyTypeRsa,
+		PublicKeyRsa:  &privKey.PublicKey,
+		PrivateKeyRsa: privKey,
+		HasPrivateKey: true,
+	}, privKey
+}
+
+func TestHandleKeyWithPemEncoding(t *testing.T) {
+	key, privKey := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.Secret.DataKey = "key.pem"
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingPem
+
+	handler := NewAzureKeyHandler(secret, fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected public and private key, but got %d values", len(values))
+	}
+
+	block, _ := pem.Decode(values["key.pem"])
+	if block == nil {
+		t.Fatal("public key is not pem encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.PublicKey.Equal(pub) {
+		t.Error("public key does not match")
+	}
+
+	block, _ = pem.Decode(values["key.pem-private"])
+	if block == nil {
+		t.Fatal("private key is not pem encoded")
+	}
+	parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("private key does not match")
+	}
+}
+
+func TestHandleKeyWithDerEncoding(t *testing.T) {
+	key, privKey := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.Secret.DataKey = "key.der"
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingDer
+	secret.Spec.Output.Secret.Key.PrivateDataKey = "private.der"
+
+	handler := NewAzureKeyHandler(secret, fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(values["key.der"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.PublicKey.Equal(pub) {
+		t.Error("public key does not match")
+	}
+
+	parsed, err := x509.ParsePKCS1PrivateKey(values["private.der"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("private key does not match")
+	}
+}
+
+func TestHandleKeyWithPkcs8KeyEncoding(t *testing.T) {
+	key, privKey := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.Secret.DataKey = "key.pem"
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingPem
+	secret.Spec.Output.Secret.KeyEncoding = akv.AzureKeyVaultPrivateKeyFormatPkcs8
+
+	values, err := NewAzureKeyHandler(secret, fakeVault).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(values["key.pem-private"])
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("expected pem PRIVATE KEY, but got '%s'", string(values["key.pem-private"]))
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("private key does not match")
+	}
+
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingDer
+	if values, err = NewAzureKeyHandler(secret, fakeVault).HandleSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err = x509.ParsePKCS8PrivateKey(values["key.pem-private"]); err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("private key does not match")
+	}
+}
+
+func TestKeyEncodingChangeUpdatesSecret(t *testing.T) {
+	key, _ := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	akvs := secret()
+	akvs.Spec.Vault.Object.Type = "key"
+	akvs.Spec.Output.Secret.DataKey = "key.pem"
+	akvs.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingPem
+
+	pkcs1, err := NewAzureKeyHandler(akvs, fakeVault).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	akvs.Status.SecretHash = getHashOfByteValues(pkcs1)
+	existing := &corev1.Secret{Type: corev1.SecretTypeOpaque, Data: pkcs1}
+	if hasAzureKeyVaultSecretChangedForSecret(akvs, pkcs1, existing) {
+		t.Error("secret should not need update when the key encoding is unchanged")
+	}
+
+	// the key in Azure Key Vault is the same, only how it is rendered changed
+	akvs.Spec.Output.Secret.KeyEncoding = akv.AzureKeyVaultPrivateKeyFormatPkcs8
+	pkcs8, err := NewAzureKeyHandler(akvs, fakeVault).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, pkcs8, existing) {
+		t.Error("secret should need update when the key encoding has changed")
+	}
+}
+
+func TestHandleKeyWithBase64Encoding(t *testing.T) {
+	key, privKey := fakeRsaKey(t)
+	key.HasPrivateKey = false
+	key.PrivateKeyRsa = nil
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.ConfigMap.DataKey = "key"
+	secret.Spec.Output.ConfigMap.Key.Encoding = akv.AzureKeyVaultKeyEncodingBase64
+
+	handler := NewAzureKeyHandler(secret, fakeVault)
+	values, err := handler.HandleConfigMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 {
+		t.Fatalf("expected only public key, but got %d values", len(values))
+	}
+
+	der, err := base64.StdEncoding.DecodeString(values["key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.PublicKey.Equal(pub) {
+		t.Error("public key does not match")
+	}
+}
+
+func TestHandleKeyWithDerEncodingForConfigMap(t *testing.T) {
+	key, _ := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.ConfigMap.DataKey = "key"
+	secret.Spec.Output.ConfigMap.Key.Encoding = akv.AzureKeyVaultKeyEncodingDer
+
+	secret.Spec.Output.Secret.DataKey = "key"
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingDer
+
+	handler := NewAzureKeyHandler(secret, fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmValues, err := handler.HandleConfigMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmValues) != 1 {
+		t.Fatalf("expected only the public key in the configmap, but got %v", cmValues)
+	}
+	if cmValues["key"] != string(values["key"]) {
+		t.Error("expected der bytes of the public key to be the same as for secret output")
+	}
+}
+
+// fakeCertificateChain returns a pem chain of a server certificate issued by a ca,
+// along with the certificates in the chain
+func fakeCertificateChain(t *testing.T) (string, []*x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca.example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	serverDer, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := x509.ParseCertificate(serverDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverDer})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}))
+	return chain, []*x509.Certificate{serverCert, caCert}
+}
+
+// decodeCertificates parses the certificates written to values for dataKey using encoding
+func decodeCertificates(t *testing.T, values map[string][]byte, dataKey string, encoding akv.AzureKeyVaultCertificateEncoding) []*x509.Certificate {
+	var ders [][]byte
+	switch encoding {
+	case akv.AzureKeyVaultCertificateEncodingPem:
+		rest := values[dataKey]
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			ders = append(ders, block.Bytes)
+		}
+	default:
+		for i := 0; ; i++ {
+			key := dataKey
+			if i > 0 {
+				key = fmt.Sprintf("%s-chain-%d", dataKey, i)
+			}
+			value, ok := values[key]
+			if !ok {
+				break
+			}
+			if encoding == akv.AzureKeyVaultCertificateEncodingBase64Der {
+				var err error
+				if value, err = base64.StdEncoding.DecodeString(string(value)); err != nil {
+					t.Fatalf("value for key '%s' is not base64: %v", key, err)
+				}
+			}
+			ders = append(ders, value)
+		}
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func assertSameCertificates(t *testing.T, expected, actual []*x509.Certificate) {
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d certificates, but got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if !expected[i].Equal(actual[i]) {
+			t.Errorf("certificate %d does not match the original certificate", i)
+		}
+	}
+}
+
+func TestHandleCertificateEncodingRoundTrip(t *testing.T) {
+	chain, certs := fakeCertificateChain(t)
+	fakeVault := &fakeVaultService{
+		fakeCertValue: chain,
+	}
+
+	encodings := []akv.AzureKeyVaultCertificateEncoding{
+		akv.AzureKeyVaultCertificateEncodingPem,
+		akv.AzureKeyVaultCertificateEncodingDer,
+		akv.AzureKeyVaultCertificateEncodingBase64Der,
+	}
+	for _, encoding := range encodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			secret := secret()
+			secret.Spec.Vault.Object.Type = "certificate"
+			secret.Spec.Output.Secret.DataKey = "ca.crt"
+			secret.Spec.Output.Secret.Certificate.Encoding = encoding
+
+			handler := NewAzureCertificateHandler(secret, fakeVault)
+			values, err := handler.HandleSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameCertificates(t, certs, decodeCertificates(t, values, "ca.crt", encoding))
+
+			secret.Spec.Output.ConfigMap.DataKey = "ca.crt"
+			secret.Spec.Output.ConfigMap.Certificate.Encoding = encoding
+			cmValues, err := handler.HandleConfigMap()
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = make(map[string][]byte)
+			for key, value := range cmValues {
+				values[key] = []byte(value)
+			}
+			assertSameCertificates(t, certs, decodeCertificates(t, values, "ca.crt", encoding))
+		})
+	}
+}
+
+func TestHandleCertificateDerEncodingWithOpaqueOutput(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: pemCert,
+	}
+	expected, err := vault.NewCertificateFromPem(pemCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.DataKey = "cert.der"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeOpaque
+	secret.Spec.Output.Secret.Certificate.Encoding = akv.AzureKeyVaultCertificateEncodingDer
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	values, err := handler.HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Errorf("expected certificate and private key, but got %d values", len(values))
+	}
+	assertSameCertificates(t, expected.Certificates, decodeCertificates(t, values, "cert.der", akv.AzureKeyVaultCertificateEncodingDer))
+
+	block, _ := pem.Decode(values["cert.der-private"])
+	if block == nil {
+		t.Fatal("private key should be written as pem")
+	}
+}
+
+func TestHandleCertificateDerEncodingForConfigMap(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: pemCertPubOnly,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.ConfigMap.Name = "cert"
+	secret.Spec.Output.ConfigMap.DataKey = "cert"
+	secret.Spec.Output.ConfigMap.Certificate.Encoding = akv.AzureKeyVaultCertificateEncodingDer
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	values, err := handler.HandleConfigMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm := (&Controller{options: &Options{}}).createNewConfigMap(secret, values)
+	if len(cm.Data) != 0 {
+		t.Errorf("expected no der in data, but got %v", cm.Data)
+	}
+	block, _ := pem.Decode([]byte(pemCertPubOnly))
+	if !bytes.Equal(cm.BinaryData["cert"], block.Bytes) {
+		t.Error("expected the der encoded certificate in binaryData")
+	}
+}
+
+func TestHandleCertificateDerEncodingNotAllowedForTlsOutput(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: pemCert,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+	secret.Spec.Output.Secret.Certificate.Encoding = akv.AzureKeyVaultCertificateEncodingDer
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	if _, err := handler.HandleSecret(); err == nil {
+		t.Error("der encoding should not be allowed for tls output")
+	}
+}
+
+func TestHandleKeyPrivateDataKeyCollision(t *testing.T) {
+	key, _ := fakeRsaKey(t)
+	fakeVault := &fakeVaultService{
+		fakeKey: key,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.Secret.DataKey = "key.pem"
+	secret.Spec.Output.Secret.Key.Encoding = akv.AzureKeyVaultKeyEncodingPem
+	secret.Spec.Output.Secret.Key.PrivateDataKey = "key.pem"
+
+	handler := NewAzureKeyHandler(secret, fakeVault)
+	if _, err := handler.HandleSecret(); !isKeyCollision(err) {
+		t.Errorf("expected key collision when private key is written to dataKey, but got %v", err)
+	}
+}
+
+func TestHandleCertificatePrivateDataKeyCollision(t *testing.T) {
+	fakeVault := &fakeVaultService{
+		fakeCertValue: pemCert,
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "certificate"
+	secret.Spec.Output.Secret.DataKey = "cert.der"
+	secret.Spec.Output.Secret.Type = corev1.SecretTypeOpaque
+	secret.Spec.Output.Secret.Certificate.Encoding = akv.AzureKeyVaultCertificateEncodingDer
+	secret.Spec.Output.Secret.Key.PrivateDataKey = "cert.der"
+
+	handler := NewAzureCertificateHandler(secret, fakeVault)
+	if _, err := handler.HandleSecret(); !isKeyCollision(err) {
+		t.Errorf("expected key collision when private key is written to dataKey, but got %v", err)
+	}
+}
+
+// versionedKeyVaultService returns the key of the requested version, or of the newest
+// version when no version is given
+type versionedKeyVaultService struct {
+	fakeVaultService
+	keys map[string]*vault.Key
+}
+
+func (f *versionedKeyVaultService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	version := secret.Object.Version
+	if version == "" {
+		current, err := vault.CurrentVersion(f.fakeVersions)
+		if err != nil {
+			return nil, err
+		}
+		version = current.Version
+	}
+	key, ok := f.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("version '%s' not found", version)
+	}
+	return key, nil
+}
+
+func TestHandleKeyWithJWKSEncoding(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeVault := &versionedKeyVaultService{
+		fakeVaultService: fakeVaultService{fakeVersions: []vault.ObjectVersion{
+			{Version: "v1", Enabled: true, Created: created},
+			{Version: "v2", Enabled: false, Created: created.Add(time.Hour)},
+			{Version: "v3", Enabled: true, Created: created.Add(2 * time.Hour)},
+			{Version: "v4", Enabled: true, Created: created.Add(3 * time.Hour)},
+		}},
+		keys: map[string]*vault.Key{},
+	}
+	for _, version := range []string{"v1", "v3", "v4"} {
+		key, _ := fakeRsaKey(t)
+		key.Metadata = &vault.ObjectMetadata{Version: version}
+		fakeVault.keys[version] = key
+	}
+
+	secret := secret()
+	secret.Spec.Vault.Object.Type = "key"
+	secret.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "jwks", DataKey: "jwks.json"}
+	secret.Spec.Output.ConfigMap.Key = akv.AzureKeyVaultOutputKey{Encoding: akv.AzureKeyVaultKeyEncodingJWKS, IncludePreviousVersions: 3}
+
+	values, err := NewAzureKeyHandler(secret, fakeVault).HandleConfigMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 {
+		t.Fatalf("expected only the key set without private keys, but got %v", values)
+	}
+
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(values["jwks.json"]), &set); err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	for _, jwk := range set.Keys {
+		kids = append(kids, jwk["kid"])
+		if _, ok := jwk["d"]; ok {
+			t.Errorf("expected no private key material in key '%s'", jwk["kid"])
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(jwk["n"])
+		if new(big.Int).SetBytes(n).Cmp(fakeVault.keys[jwk["kid"]].PublicKeyRsa.N) != 0 {
+			t.Errorf("expected key '%s' to match its version", jwk["kid"])
+		}
+	}
+	if strings.Join(kids, ",") != "v4,v3,v1" {
+		t.Errorf("expected the current key and enabled previous versions newest first, but got %v", kids)
+	}
+
+	secret.Spec.Output.Secret.DataKey = "jwks.json"
+	secret.Spec.Output.Secret.Key = akv.AzureKeyVaultOutputKey{Encoding: akv.AzureKeyVaultKeyEncodingJWKS}
+	secretValues, err := NewAzureKeyHandler(secret, fakeVault).HandleSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(secretValues["jwks.json"], &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0]["kid"] != "v4" {
+		t.Errorf("expected only the current key without includePreviousVersions, but got %v", set.Keys)
+	}
+}
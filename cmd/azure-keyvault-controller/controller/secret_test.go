@@ -0,0 +1,167 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// managedSecret returns akvs and its output secret, with the key 'password' written by akvs
+// and the key 'foreign' added by hand
+func managedSecret(strategy akv.AzureKeyVaultMergeStrategy) (*akv.AzureKeyVaultSecret, *corev1.Secret) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.Secret.MergeStrategy = strategy
+
+	managed := map[string][]byte{"password": []byte("old-value")}
+	akvs.Status.SecretHash = getHashOfByteValues(managed)
+	akvs.Status.SecretKeys = sortByteValueKeys(managed)
+
+	existing := &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"password": []byte("old-value"),
+			"foreign":  []byte("foreign-value"),
+		},
+	}
+	return akvs, existing
+}
+
+func assertSecretData(t *testing.T, secret *corev1.Secret, expected map[string]string) {
+	t.Helper()
+	if len(secret.Data) != len(expected) {
+		t.Errorf("expected keys %v, but got %v", expected, secret.Data)
+	}
+	for key, value := range expected {
+		if string(secret.Data[key]) != value {
+			t.Errorf("expected '%s' for key '%s', but got '%s'", value, key, secret.Data[key])
+		}
+	}
+}
+
+func TestManagedKeysOnlyKeepsForeignKeyOnRotation(t *testing.T) {
+	for _, strategy := range []akv.AzureKeyVaultMergeStrategy{"", akv.AzureKeyVaultMergeStrategyManagedKeysOnly} {
+		c := &Controller{options: &Options{}}
+		akvs, existing := managedSecret(strategy)
+		values := map[string][]byte{"password": []byte("new-value")}
+
+		if !hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+			t.Error("secret should need update when rotated")
+		}
+		updated, err := c.createNewSecretFromExisting(akvs, values, existing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSecretData(t, updated, map[string]string{"password": "new-value", "foreign": "foreign-value"})
+	}
+}
+
+func TestManagedKeysOnlyKeepsForeignKeyOnPruning(t *testing.T) {
+	c := &Controller{options: &Options{}}
+	akvs, existing := managedSecret(akv.AzureKeyVaultMergeStrategyManagedKeysOnly)
+	// dataKey renamed, so 'password' is no longer written
+	values := map[string][]byte{"PASSWORD": []byte("old-value")}
+
+	updated, err := c.createNewSecretFromExisting(akvs, values, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSecretData(t, updated, map[string]string{"PASSWORD": "old-value", "foreign": "foreign-value"})
+}
+
+func TestManagedKeysOnlyKeepsForeignKeyOnDriftRepair(t *testing.T) {
+	c := &Controller{options: &Options{}}
+	akvs, existing := managedSecret(akv.AzureKeyVaultMergeStrategyManagedKeysOnly)
+	values := map[string][]byte{"password": []byte("old-value")}
+
+	if hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+		t.Error("foreign key should not require an update")
+	}
+
+	existing.Data["password"] = []byte("modified-by-hand")
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+		t.Error("modified managed key should be repaired")
+	}
+	updated, err := c.createNewSecretFromExisting(akvs, values, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSecretData(t, updated, map[string]string{"password": "old-value", "foreign": "foreign-value"})
+}
+
+func TestReplaceAllRemovesForeignKey(t *testing.T) {
+	c := &Controller{options: &Options{}}
+	akvs, existing := managedSecret(akv.AzureKeyVaultMergeStrategyReplaceAll)
+	values := map[string][]byte{"password": []byte("old-value")}
+
+	if !hasAzureKeyVaultSecretChangedForSecret(akvs, values, existing) {
+		t.Error("foreign key should require an update")
+	}
+	updated, err := c.createNewSecretFromExisting(akvs, values, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSecretData(t, updated, map[string]string{"password": "old-value"})
+}
+
+func TestOutputOwnershipCheckedForBothOutputs(t *testing.T) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	akvs.Spec.Output.ConfigMap.Name = "my-configmap"
+
+	unowned := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: akvs.Namespace}}
+	owned := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name:            "my-configmap",
+		Namespace:       akvs.Namespace,
+		OwnerReferences: []metav1.OwnerReference{{Kind: "AzureKeyVaultSecret", Name: akvs.Name, UID: akvs.UID}},
+	}}
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder}
+
+	err := c.checkOutputOwnership(akvs, unowned, owned)
+	if err == nil || !strings.Contains(err.Error(), "my-secret") || strings.Contains(err.Error(), "my-configmap") {
+		t.Fatalf("expected error naming only the unowned secret, but got %v", err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event for the unowned secret, but got %d", len(recorder.Events))
+	}
+
+	unownedCM := owned.DeepCopy()
+	unownedCM.OwnerReferences = nil
+	err = c.checkOutputOwnership(akvs, unowned, unownedCM)
+	if err == nil || !strings.Contains(err.Error(), "my-secret") || !strings.Contains(err.Error(), "my-configmap") {
+		t.Errorf("expected error naming both unowned outputs, but got %v", err)
+	}
+}
+
+func TestOutputOwnershipWithoutOutputs(t *testing.T) {
+	c := &Controller{recorder: record.NewFakeRecorder(10)}
+	if err := c.checkOutputOwnership(secret()); err != nil {
+		t.Errorf("expected no error without outputs, but got %v", err)
+	}
+	if err := c.checkOutputOwnership(secret(), nil); err != nil {
+		t.Errorf("expected nil output to be skipped, but got %v", err)
+	}
+}
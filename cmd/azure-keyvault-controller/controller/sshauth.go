@@ -0,0 +1,56 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/pem"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReasonInvalidSSHPrivateKey is the reason of events telling that the value written to a
+// kubernetes.io/ssh-auth Secret does not look like a private key
+const ReasonInvalidSSHPrivateKey = "InvalidSSHPrivateKey"
+
+// normalizeSSHPrivateKey converts line endings to LF and ends the key with a newline, as
+// OpenSSH refuses keys pasted with CRLF line endings, which is common from the Azure portal
+func normalizeSSHPrivateKey(key string) string {
+	key = strings.ReplaceAll(key, "\r\n", "\n")
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	return key
+}
+
+// isSSHPrivateKey tells if key looks like a pem or OpenSSH formatted private key
+func isSSHPrivateKey(key string) bool {
+	block, _ := pem.Decode([]byte(key))
+	return block != nil && strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
+
+// reportInvalidSSHPrivateKey emits a warning if handler wrote a value not looking like a
+// private key to the kubernetes.io/ssh-auth Secret of akvs. The value is still written, as
+// the consumer may understand formats not known here.
+func (c *Controller) reportInvalidSSHPrivateKey(akvs *akv.AzureKeyVaultSecret, handler KubernetesHandler) {
+	if h, ok := handler.(*azureSecretHandler); ok && h.invalidSSHPrivateKey {
+		c.recorder.Eventf(akvs, corev1.EventTypeWarning, ReasonInvalidSSHPrivateKey,
+			"Secret '%s' in Azure Key Vault '%s' does not look like a pem or OpenSSH private key, but is written to %s of %s secret '%s'",
+			akvs.Spec.Vault.Object.Name, akvs.Spec.Vault.Identifier(), corev1.SSHAuthPrivateKey, corev1.SecretTypeSSHAuth, determineSecretName(akvs))
+	}
+}
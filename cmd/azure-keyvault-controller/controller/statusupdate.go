@@ -0,0 +1,88 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// updateStatus sets the status of a copy of akvs with mutate and writes it, returning the
+// updated AzureKeyVaultSecret. The write is skipped if mutate leaves the status unchanged. If
+// akvs was modified since it was read, mutate is applied to the latest AzureKeyVaultSecret read
+// from the API and the status written to it instead, so the caller does not have to read Azure
+// Key Vault again. A conflict with a change to the spec is returned, as the status was made for
+// the spec that was read.
+func (c *Controller) updateStatus(akvs *akv.AzureKeyVaultSecret, mutate func(akvsCopy *akv.AzureKeyVaultSecret)) (*akv.AzureKeyVaultSecret, error) {
+	current := akvs
+	var updated *akv.AzureKeyVaultSecret
+	specChanged := false
+	retriable := func(err error) bool {
+		return errors.IsConflict(err) && !specChanged
+	}
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		akvsCopy := current.DeepCopy()
+		mutate(akvsCopy)
+		if equality.Semantic.DeepEqual(current.Status, akvsCopy.Status) {
+			klog.V(4).InfoS("status unchanged - skipping update", "azurekeyvaultsecret", klog.KObj(akvs))
+			updated = current
+			return nil
+		}
+
+		var err error
+		updated, err = c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), akvsCopy, metav1.UpdateOptions{})
+		if !errors.IsConflict(err) {
+			return err
+		}
+
+		latest, getErr := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Get(context.TODO(), akvs.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if latest.Generation != akvs.Generation {
+			klog.V(4).InfoS("spec of azurekeyvaultsecret changed since read - not retrying status update", "azurekeyvaultsecret", klog.KObj(akvs))
+			specChanged = true
+			return err
+		}
+		klog.V(4).InfoS("azurekeyvaultsecret modified since read - retrying status update", "azurekeyvaultsecret", klog.KObj(akvs))
+		current = latest
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// isStatusUnchanged tells if status equals existing. The time of the last poll
+// of Azure Key Vault is only compared while it schedules the next poll of a certificate, and
+// the renewal of the claim of this instance is ignored, as claim renews it when due.
+func (c *Controller) isStatusUnchanged(existing, status akv.AzureKeyVaultSecretStatus) bool {
+	if c.options == nil || c.options.CertificateRelaxedPollInterval <= 0 || status.PredictedRenewalTime == nil {
+		status.LastAzureUpdate = existing.LastAzureUpdate
+	}
+	if status.Claim != nil && existing.Claim != nil && status.Claim.Instance == existing.Claim.Instance {
+		status.Claim = existing.Claim
+	}
+	return equality.Semantic.DeepEqual(existing, status)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// statusController returns a controller where akvs is listed by the informer, synced
+// with the value 'value'
+func statusController(t *testing.T) (*Controller, *akv.AzureKeyVaultSecret, *akvfake.Clientset) {
+	akvs := secret()
+	akvs.UID = types.UID("akvs-uid")
+	akvs.ResourceVersion = "1"
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	synced := map[string][]byte{"password": []byte("value")}
+	akvs.Status.SecretName = akvs.Spec.Output.Secret.Name
+	akvs.Status.SecretHash = getHashOfByteValues(synced)
+	akvs.Status.SecretKeys = sortByteValueKeys(synced)
+	akvs.Status.LastAzureUpdate = metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(akvs); err != nil {
+		t.Fatal(err)
+	}
+	client := akvfake.NewSimpleClientset(akvs)
+	c := &Controller{
+		akvsClient:                client,
+		azureKeyVaultSecretLister: listers.NewAzureKeyVaultSecretLister(indexer),
+		clock:                     &fakeClock{now: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		options:                   &Options{},
+	}
+	return c, akvs, client
+}
+
+func countStatusUpdates(client *akvfake.Clientset) int {
+	updates := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+			updates++
+		}
+	}
+	return updates
+}
+
+func TestUnchangedStatusIsNotWritten(t *testing.T) {
+	c, akvs, client := statusController(t)
+
+	if err := c.updateAzureKeyVaultSecretStatus(akvs, writtenOutputs{secretName: "my-secret", secretHash: akvs.Status.SecretHash, secretKeys: akvs.Status.SecretKeys}); err != nil {
+		t.Fatal(err)
+	}
+	if updates := countStatusUpdates(client); updates != 0 {
+		t.Errorf("expected unchanged status not to be written, but got %d updates", updates)
+	}
+
+	if err := c.updateAzureKeyVaultSecretStatus(akvs, writtenOutputs{secretName: "my-secret", secretHash: "changed", secretKeys: akvs.Status.SecretKeys}); err != nil {
+		t.Fatal(err)
+	}
+	if updates := countStatusUpdates(client); updates != 1 {
+		t.Errorf("expected changed status to be written once, but got %d updates", updates)
+	}
+}
+
+func TestStatusUpdateRetriesOnConflict(t *testing.T) {
+	c, akvs, client := statusController(t)
+
+	// the AzureKeyVaultSecret is labeled after the controller read it
+	modified := akvs.DeepCopy()
+	modified.Labels = map[string]string{"team": "a"}
+	if _, err := client.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Update(context.TODO(), modified, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	conflicts := 0
+	client.PrependReactor("update", "azurekeyvaultsecrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" && conflicts == 0 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "azurekeyvaultsecrets"}, akvs.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	if err := c.updateAzureKeyVaultSecretStatus(akvs, writtenOutputs{secretName: "my-secret", secretHash: "changed", secretKeys: akvs.Status.SecretKeys}); err != nil {
+		t.Fatalf("expected conflict to be retried, but got %v", err)
+	}
+	updated := getStatus(t, c, akvs)
+	if conflicts != 1 || updated.Status.SecretHash != "changed" {
+		t.Errorf("expected status to be written after 1 conflict, but got %d conflicts and hash '%s'", conflicts, updated.Status.SecretHash)
+	}
+	if updated.Labels["team"] != "a" {
+		t.Errorf("expected change made since read to be kept, but got labels %v", updated.Labels)
+	}
+}
+
+func TestSetConditionRetriesOnConflict(t *testing.T) {
+	c, akvs, client := statusController(t)
+
+	// another condition is set after the controller read the AzureKeyVaultSecret
+	modified := akvs.DeepCopy()
+	modified.Status.Conditions = []metav1.Condition{{Type: ConditionTypeAzureReachable, Status: metav1.ConditionTrue, Reason: "Reachable"}}
+	if _, err := client.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).UpdateStatus(context.TODO(), modified, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	conflicts := 0
+	client.PrependReactor("update", "azurekeyvaultsecrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" && conflicts == 0 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "azurekeyvaultsecrets"}, akvs.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	if _, err := c.setCondition(akvs, metav1.Condition{Type: ConditionTypeSynced, Status: metav1.ConditionTrue, Reason: "Synced"}); err != nil {
+		t.Fatalf("expected conflict to be retried, but got %v", err)
+	}
+	updated := getStatus(t, c, akvs)
+	if len(updated.Status.Conditions) != 2 {
+		t.Errorf("expected condition to be added to the latest status, but got %v", updated.Status.Conditions)
+	}
+}
+
+func TestStatusUpdateFailsOnSpecChange(t *testing.T) {
+	c, akvs, client := statusController(t)
+
+	modified := akvs.DeepCopy()
+	modified.Generation = akvs.Generation + 1
+	if _, err := client.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(akvs.Namespace).Update(context.TODO(), modified, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	client.PrependReactor("update", "azurekeyvaultsecrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" {
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "azurekeyvaultsecrets"}, akvs.Name, nil)
+		}
+		return false, nil, nil
+	})
+
+	err := c.updateAzureKeyVaultSecretStatus(akvs, writtenOutputs{secretName: "my-secret", secretHash: "changed", secretKeys: akvs.Status.SecretKeys})
+	if !errors.IsConflict(err) {
+		t.Errorf("expected conflict with a changed spec to be returned, but got %v", err)
+	}
+	if updates := countStatusUpdates(client); updates != 1 {
+		t.Errorf("expected status update not to be retried, but got %d updates", updates)
+	}
+}
+
+func TestStatusUnchangedIgnoresPollTime(t *testing.T) {
+	c, akvs, _ := statusController(t)
+	status := akvs.Status.DeepCopy()
+	status.LastAzureUpdate = c.clock.Now()
+
+	if !c.isStatusUnchanged(akvs.Status, *status) {
+		t.Error("expected a new poll time alone not to change the status")
+	}
+
+	c.options.CertificateRelaxedPollInterval = time.Hour
+	renewal := metav1.NewTime(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	akvs.Status.PredictedRenewalTime = &renewal
+	status.PredictedRenewalTime = &renewal
+	if c.isStatusUnchanged(akvs.Status, *status) {
+		t.Error("expected poll time to be written while it schedules certificate polls")
+	}
+}
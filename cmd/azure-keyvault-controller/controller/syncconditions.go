@@ -0,0 +1,288 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// storeAzureReachable remembers if service could reach Azure Key Vault when reading akvs, to
+// be recorded in the AzureReachable condition after the sync
+func (c *Controller) storeAzureReachable(akvs *akv.AzureKeyVaultSecret, service *fallbackVaultService) {
+	attempted, unreachable := service.lastReachability()
+	if !attempted {
+		return
+	}
+	msg := ""
+	if unreachable != nil {
+		msg = unreachable.Error()
+	}
+	c.azureReachable.Store(fmt.Sprintf("%s/%s", akvs.Namespace, akvs.Name), msg)
+}
+
+// withSyncConditions wraps reconcile so the Synced, AzureReachable, OutputExists and Expired
+// conditions of the AzureKeyVaultSecret are set from the outcome of each sync. Failing to set them is
+// only logged, so the sync is not retried for it.
+func (c *Controller) withSyncConditions(reconcile func(key string) error) func(key string) error {
+	return func(key string) error {
+		err := reconcile(key)
+		if condErr := c.setSyncConditions(key, err); condErr != nil {
+			klog.ErrorS(condErr, "failed to update sync conditions", "key", key)
+		}
+		return err
+	}
+}
+
+// setSyncConditions sets the Synced, AzureReachable, OutputExists and Expired conditions of
+// the AzureKeyVaultSecret with key, where syncErr is the error of its last sync. A warning is
+// recorded when the synced version becomes expired. AzureKeyVaultSecrets being deleted or
+// managed by another controller instance are left alone.
+func (c *Controller) setSyncConditions(key string, syncErr error) error {
+	reachable, read := c.azureReachable.LoadAndDelete(key)
+	if syncErr == nil {
+		c.azureFailureEvents.Delete(key)
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	akvs, err := c.azureKeyVaultSecretLister.AzureKeyVaultSecrets(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	conditions := func(akvs *akv.AzureKeyVaultSecret) []metav1.Condition {
+		if akvs.DeletionTimestamp != nil || c.isClaimedByOther(akvs) {
+			return nil
+		}
+		conditions := []metav1.Condition{syncedCondition(akvs, syncErr)}
+		if read {
+			conditions = append(conditions, azureReachableCondition(akvs, reachable.(string)))
+		}
+		if condition := c.outputExistsCondition(akvs); condition != nil {
+			conditions = append(conditions, *condition)
+		}
+		if condition := c.expiredCondition(akvs); condition != nil {
+			conditions = append(conditions, *condition)
+		}
+		return conditions
+	}
+
+	// most syncs change nothing, so the cache is checked before getting the latest status
+	cached := conditions(akvs)
+	if len(cached) == 0 || (!isAnyConditionChanged(akvs, cached) && !isSyncResultChanged(akvs, syncErr) && equality.Semantic.DeepEqual(akvs.Status.Objects, c.objectStatuses(akvs))) {
+		return nil
+	}
+	latest, err := c.akvsClient.AzureKeyVaultV2beta1().AzureKeyVaultSecrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	latestConditions := conditions(latest)
+	if len(latestConditions) == 0 {
+		return nil
+	}
+	recovered := syncErr == nil && hasSyncFailed(latest)
+	wasExpired := meta.IsStatusConditionTrue(latest.Status.Conditions, ConditionTypeExpired)
+	if err = c.setSyncResult(latest, syncErr, latestConditions); err != nil {
+		return err
+	}
+	if expired := meta.FindStatusCondition(latestConditions, ConditionTypeExpired); expired != nil && expired.Status == metav1.ConditionTrue && !wasExpired {
+		c.recorder.Event(latest, corev1.EventTypeWarning, ConditionTypeExpired, expired.Message)
+	}
+	// steady state syncs record no events, only the first success after a failure does
+	if recovered {
+		c.recorder.Event(latest, corev1.EventTypeNormal, SuccessSynced, MessageAzureKeyVaultSecretRecovered)
+	}
+	return nil
+}
+
+// isSyncResultChanged tells if a sync of akvs failing with err changes the sync result in its
+// status, being the generation synced, the last error and the number of failed syncs
+func isSyncResultChanged(akvs *akv.AzureKeyVaultSecret, err error) bool {
+	return err != nil || akvs.Status.ObservedGeneration != akvs.Generation || akvs.Status.LastSyncError != "" || akvs.Status.FailedSyncCount != 0
+}
+
+// setSyncResult records a sync of akvs failing with syncErr in its status, along with
+// conditions and the result of reading each object in spec.vault.objects. A failure is
+// counted in status.failedSyncCount until a sync succeeds.
+func (c *Controller) setSyncResult(akvs *akv.AzureKeyVaultSecret, syncErr error, conditions []metav1.Condition) error {
+	_, err := c.updateStatus(akvs, func(akvsCopy *akv.AzureKeyVaultSecret) {
+		akvsCopy.Status.ObservedGeneration = akvsCopy.Generation
+		if syncErr != nil {
+			akvsCopy.Status.LastSyncError = syncErr.Error()
+			akvsCopy.Status.FailedSyncCount++
+		} else {
+			akvsCopy.Status.LastSyncError = ""
+			akvsCopy.Status.FailedSyncCount = 0
+		}
+		akvsCopy.Status.Objects = c.objectStatuses(akvsCopy)
+		c.applyConditions(akvsCopy, conditions)
+	})
+	return err
+}
+
+// hasSyncFailed tells if the last sync of akvs failed, according to its Synced condition
+func hasSyncFailed(akvs *akv.AzureKeyVaultSecret) bool {
+	synced := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeSynced)
+	return synced != nil && synced.Status == metav1.ConditionFalse && synced.Reason == "SyncFailed"
+}
+
+// syncedCondition returns the Synced condition of akvs after a sync failing with err
+func syncedCondition(akvs *akv.AzureKeyVaultSecret, err error) metav1.Condition {
+	condition := metav1.Condition{
+		Type:    ConditionTypeSynced,
+		Status:  metav1.ConditionFalse,
+		Reason:  "SyncFailed",
+		Message: fmt.Sprint(err),
+	}
+	if invalid := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeInvalidSpec); invalid != nil && invalid.Status == metav1.ConditionTrue {
+		condition.Reason = ConditionTypeInvalidSpec
+		condition.Message = invalid.Message
+		return condition
+	}
+	if err != nil {
+		return condition
+	}
+	if pending := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeRotationPending); pending != nil && pending.Status == metav1.ConditionTrue {
+		condition.Reason = ConditionTypeRotationPending
+		condition.Message = pending.Message
+		return condition
+	}
+	if akvs.Status.DebouncedRotation != nil {
+		condition.Reason = RotationDebounced
+		condition.Message = fmt.Sprintf("A change from Azure Key Vault is held back until %s", akvs.Status.DebouncedRotation.ApplyTime.UTC().Format(time.RFC3339))
+		return condition
+	}
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "Synced"
+	condition.Message = "Outputs are synced with Azure Key Vault"
+	return condition
+}
+
+// azureReachableCondition returns the AzureReachable condition of akvs, where msg is the error
+// of the last read from Azure Key Vault if it could not be reached
+func azureReachableCondition(akvs *akv.AzureKeyVaultSecret, msg string) metav1.Condition {
+	if msg != "" {
+		return metav1.Condition{
+			Type:    ConditionTypeAzureReachable,
+			Status:  metav1.ConditionFalse,
+			Reason:  "VaultUnreachable",
+			Message: msg,
+		}
+	}
+	return metav1.Condition{
+		Type:    ConditionTypeAzureReachable,
+		Status:  metav1.ConditionTrue,
+		Reason:  "VaultReachable",
+		Message: fmt.Sprintf("Azure Key Vault '%s' was reached", akvs.Spec.Vault.Identifier()),
+	}
+}
+
+// outputExistsCondition returns the OutputExists condition of akvs, or nil if akvs has no
+// outputs in the cluster
+func (c *Controller) outputExistsCondition(akvs *akv.AzureKeyVaultSecret) *metav1.Condition {
+	if c.options != nil && c.options.ExportDir != "" {
+		return nil
+	}
+
+	var secrets, configMaps []string
+	outputs := akvs.Spec.Outputs
+	if !akvsHasOutputs(akvs) {
+		outputs = []akv.AzureKeyVaultOutput{akvs.Spec.Output}
+	}
+	for _, output := range outputs {
+		if output.Secret.Name != "" {
+			secrets = append(secrets, output.Secret.Name)
+		}
+		if output.ConfigMap.Name != "" && output.ConfigMap.Immutable {
+			// named after the hash of the values, and missing until first written
+			configMaps = append(configMaps, akvs.Status.ConfigMapName)
+		} else if output.ConfigMap.Name != "" {
+			configMaps = append(configMaps, output.ConfigMap.Name)
+		}
+	}
+	if len(secrets) == 0 && len(configMaps) == 0 {
+		return nil
+	}
+
+	var missing []string
+	for _, name := range secrets {
+		if !c.outputSecretExists(akvs.Namespace, name) {
+			missing = append(missing, fmt.Sprintf("Secret '%s'", name))
+		}
+	}
+	for _, name := range configMaps {
+		if !c.outputConfigMapExists(akvs.Namespace, name) {
+			missing = append(missing, fmt.Sprintf("ConfigMap '%s'", name))
+		}
+	}
+
+	if len(missing) > 0 {
+		return &metav1.Condition{
+			Type:    ConditionTypeOutputExists,
+			Status:  metav1.ConditionFalse,
+			Reason:  "OutputMissing",
+			Message: fmt.Sprintf("%s not found", strings.Join(missing, ", ")),
+		}
+	}
+	return &metav1.Condition{
+		Type:    ConditionTypeOutputExists,
+		Status:  metav1.ConditionTrue,
+		Reason:  "OutputsExist",
+		Message: "All outputs exist",
+	}
+}
+
+// outputSecretExists checks the cache first, and the API server for Secrets just created
+func (c *Controller) outputSecretExists(namespace, name string) bool {
+	if _, err := c.secretsLister.Secrets(namespace).Get(name); err == nil {
+		return true
+	}
+	_, err := c.kubeclientset.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	return err == nil
+}
+
+// outputConfigMapExists checks the cache first, and the API server for ConfigMaps just created
+func (c *Controller) outputConfigMapExists(namespace, name string) bool {
+	if name == "" {
+		return false
+	}
+	if _, err := c.configMapsLister.ConfigMaps(namespace).Get(name); err == nil {
+		return true
+	}
+	_, err := c.kubeclientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	return err == nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	listers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/listers/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var syncConditionsNow = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// syncConditionsController returns a controller with akvs in the AzureKeyVaultSecret lister
+func syncConditionsController(t *testing.T, akvs *akv.AzureKeyVaultSecret, objects ...*corev1.Secret) *Controller {
+	c, _ := outputsController(t, akvs, &countingVaultService{}, objects...)
+	c.clock = &fakeClock{now: syncConditionsNow}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(akvs); err != nil {
+		t.Fatal(err)
+	}
+	c.azureKeyVaultSecretLister = listers.NewAzureKeyVaultSecretLister(indexer)
+	return c
+}
+
+func assertCondition(t *testing.T, akvs *akv.AzureKeyVaultSecret, conditionType string, status metav1.ConditionStatus, reason string) *metav1.Condition {
+	t.Helper()
+	condition := meta.FindStatusCondition(akvs.Status.Conditions, conditionType)
+	if condition == nil || condition.Status != status || condition.Reason != reason {
+		t.Errorf("expected condition %s to be %s with reason %s, but got %+v", conditionType, status, reason, condition)
+	}
+	return condition
+}
+
+func TestSyncConditionsAfterSync(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Vault.Name = "my-vault"
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	existing := (&Controller{options: &Options{}}).createNewSecret(akvs, map[string][]byte{"password": []byte("value")})
+	c := syncConditionsController(t, akvs, existing)
+	key := akvs.Namespace + "/" + akvs.Name
+
+	sync := c.withSyncConditions(func(key string) error {
+		c.azureReachable.Store(key, "")
+		return nil
+	})
+	if err := sync(key); err != nil {
+		t.Fatal(err)
+	}
+
+	status := getStatus(t, c, akvs).Status
+	synced := assertCondition(t, &akv.AzureKeyVaultSecret{Status: status}, ConditionTypeSynced, metav1.ConditionTrue, "Synced")
+	if synced != nil && !synced.LastTransitionTime.Time.Equal(syncConditionsNow) {
+		t.Errorf("expected last transition time %s from controller clock, but got %s", syncConditionsNow, synced.LastTransitionTime)
+	}
+	assertCondition(t, &akv.AzureKeyVaultSecret{Status: status}, ConditionTypeAzureReachable, metav1.ConditionTrue, "VaultReachable")
+	assertCondition(t, &akv.AzureKeyVaultSecret{Status: status}, ConditionTypeOutputExists, metav1.ConditionTrue, "OutputsExist")
+}
+
+func TestSyncConditionsAfterFailedSync(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "my-secret"
+	c := syncConditionsController(t, akvs)
+	key := akvs.Namespace + "/" + akvs.Name
+
+	syncErr := errors.New("failed to get secret from azure key vault")
+	sync := c.withSyncConditions(func(key string) error {
+		c.azureReachable.Store(key, "connection refused")
+		return syncErr
+	})
+	if err := sync(key); err != syncErr {
+		t.Fatalf("expected sync error to be returned, but got %v", err)
+	}
+
+	updated := getStatus(t, c, akvs)
+	if synced := assertCondition(t, updated, ConditionTypeSynced, metav1.ConditionFalse, "SyncFailed"); synced != nil && synced.Message != syncErr.Error() {
+		t.Errorf("expected message '%s', but got '%s'", syncErr, synced.Message)
+	}
+	if reachable := assertCondition(t, updated, ConditionTypeAzureReachable, metav1.ConditionFalse, "VaultUnreachable"); reachable != nil && reachable.Message != "connection refused" {
+		t.Errorf("expected message 'connection refused', but got '%s'", reachable.Message)
+	}
+	assertCondition(t, updated, ConditionTypeOutputExists, metav1.ConditionFalse, "OutputMissing")
+}
+
+func TestSyncConditionsWithInvalidSpec(t *testing.T) {
+	akvs := secret()
+	akvs.Status.Conditions = []metav1.Condition{{Type: ConditionTypeInvalidSpec, Status: metav1.ConditionTrue, Reason: "InvalidSpec", Message: "spec is invalid"}}
+	c := syncConditionsController(t, akvs)
+
+	if err := c.withSyncConditions(func(string) error { return nil })(akvs.Namespace + "/" + akvs.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := getStatus(t, c, akvs)
+	if synced := assertCondition(t, updated, ConditionTypeSynced, metav1.ConditionFalse, ConditionTypeInvalidSpec); synced != nil && synced.Message != "spec is invalid" {
+		t.Errorf("expected message of InvalidSpec condition, but got '%s'", synced.Message)
+	}
+	if meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeAzureReachable) != nil {
+		t.Error("expected no AzureReachable condition when Azure Key Vault was not read")
+	}
+}
+
+func TestFallbackVaultServiceReachability(t *testing.T) {
+	vaultSpec := &akv.AzureKeyVault{
+		Name:   "primary",
+		Object: akv.AzureKeyVaultObject{Name: "some-secret", Type: akv.AzureKeyVaultObjectTypeSecret},
+	}
+
+	service := newFallbackVaultService(&regionalVaultService{})
+	if attempted, _ := service.lastReachability(); attempted {
+		t.Error("expected no read before getting a secret")
+	}
+
+	tests := map[int]bool{http.StatusOK: true, http.StatusNotFound: true, http.StatusServiceUnavailable: false}
+	for statusCode, reachable := range tests {
+		errs := map[string]error{}
+		if statusCode != http.StatusOK {
+			errs["primary"] = responseError(statusCode)
+		}
+		service := newFallbackVaultService(&regionalVaultService{errors: errs})
+		_, _ = service.GetSecret(vaultSpec)
+		attempted, unreachable := service.lastReachability()
+		if !attempted || (unreachable == nil) != reachable {
+			t.Errorf("expected vault reachable=%t for status %d, but got attempted=%t, unreachable=%v", reachable, statusCode, attempted, unreachable)
+		}
+	}
+}
+
+func TestSyncResult(t *testing.T) {
+	akvs := secret()
+	akvs.Generation = 3
+	c := syncConditionsController(t, akvs)
+	key := akvs.Namespace + "/" + akvs.Name
+
+	syncErr := errors.New("failed to get secret from azure key vault")
+	for i := 0; i < 2; i++ {
+		if err := c.withSyncConditions(func(string) error { return syncErr })(key); err != syncErr {
+			t.Fatalf("expected sync error to be returned, but got %v", err)
+		}
+	}
+	status := getStatus(t, c, akvs).Status
+	if status.ObservedGeneration != 3 || status.LastSyncError != syncErr.Error() || status.FailedSyncCount != 2 {
+		t.Errorf("expected generation 3 observed with 2 failed syncs and last error '%s', but got %d, %d and '%s'", syncErr, status.ObservedGeneration, status.FailedSyncCount, status.LastSyncError)
+	}
+
+	if err := c.withSyncConditions(func(string) error { return nil })(key); err != nil {
+		t.Fatal(err)
+	}
+	status = getStatus(t, c, akvs).Status
+	if status.ObservedGeneration != 3 || status.LastSyncError != "" || status.FailedSyncCount != 0 {
+		t.Errorf("expected generation 3 observed with sync error cleared, but got %d, %d and '%s'", status.ObservedGeneration, status.FailedSyncCount, status.LastSyncError)
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+const (
+	// templateFromConfigMapIndex indexes azurekeyvaultsecrets by the namespace/name of the
+	// configmaps referenced in spec.output.secret.templateFrom and spec.output.configMap.templateFrom
+	templateFromConfigMapIndex = "templateFromConfigMap"
+
+	// ReasonTemplateResolved is used when the template was resolved and parsed
+	ReasonTemplateResolved = "Resolved"
+
+	// ReasonTemplateParseError is used when the template is not a valid Go template
+	ReasonTemplateParseError = "TemplateParseError"
+)
+
+func (c *Controller) initTemplateFrom() {
+	err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddIndexers(cache.Indexers{
+		templateFromConfigMapIndex: templateFromConfigMapIndexFunc,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add indexer", "index", templateFromConfigMapIndex)
+	}
+
+	_, err = c.kubeInformerFactory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForTemplate(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldCm, ok := old.(*corev1.ConfigMap)
+			if !ok {
+				return
+			}
+			newCm, ok := new.(*corev1.ConfigMap)
+			if !ok || newCm.ResourceVersion == oldCm.ResourceVersion {
+				return
+			}
+			c.enqueueAzureKeyVaultSecretsForTemplate(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForTemplate(obj)
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add event handler")
+	}
+}
+
+func templateFromConfigMapIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, tmpl := range outputTemplates(akvs) {
+		templateFrom := tmpl.templateFrom
+		if templateFrom == nil || templateFrom.ConfigMapKeyRef == nil || templateFrom.ConfigMapKeyRef.Name == "" {
+			continue
+		}
+		key := fmt.Sprintf("%s/%s", akvs.Namespace, templateFrom.ConfigMapKeyRef.Name)
+		if len(keys) == 0 || keys[0] != key {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// outputTemplate is the template of the output Secret or ConfigMap of an AzureKeyVaultSecret
+type outputTemplate struct {
+	field        string
+	dataKey      string
+	template     string
+	templateFrom *akv.AzureKeyVaultOutputTemplateFrom
+}
+
+func (t outputTemplate) isSet() bool {
+	return t.template != "" || t.templateFrom != nil
+}
+
+func secretTemplate(akvs *akv.AzureKeyVaultSecret) outputTemplate {
+	secret := akvs.Spec.Output.Secret
+	return outputTemplate{field: "spec.output.secret", dataKey: secret.DataKey, template: secret.Template, templateFrom: secret.TemplateFrom}
+}
+
+func configMapTemplate(akvs *akv.AzureKeyVaultSecret) outputTemplate {
+	cm := akvs.Spec.Output.ConfigMap
+	return outputTemplate{field: "spec.output.configMap", dataKey: cm.DataKey, template: cm.Template, templateFrom: cm.TemplateFrom}
+}
+
+// outputTemplates returns the templates in use by the outputs of akvs
+func outputTemplates(akvs *akv.AzureKeyVaultSecret) []outputTemplate {
+	var templates []outputTemplate
+	for _, tmpl := range []outputTemplate{secretTemplate(akvs), configMapTemplate(akvs)} {
+		if tmpl.isSet() {
+			templates = append(templates, tmpl)
+		}
+	}
+	return templates
+}
+
+// enqueueAzureKeyVaultSecretsForTemplate adds all azurekeyvaultsecrets reading
+// their template from the configmap to the queue
+func (c *Controller) enqueueAzureKeyVaultSecretsForTemplate(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	indexer := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().GetIndexer()
+	referencing, err := indexer.ByIndex(templateFromConfigMapIndex, key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, akvs := range referencing {
+		klog.V(4).InfoS("configmap with template changed - adding to queue", "configmap", key, "azurekeyvaultsecret", klog.KObj(akvs.(*akv.AzureKeyVaultSecret)))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// validateTemplate returns the problems with the template options of the output secret
+func validateTemplate(field string, secret akv.AzureKeyVaultOutputSecret) []string {
+	tmpl := outputTemplate{field: field, dataKey: secret.DataKey, template: secret.Template, templateFrom: secret.TemplateFrom}
+	problems := validateOutputTemplate(tmpl)
+	if tmpl.isSet() && secret.Type != "" && secret.Type != corev1.SecretTypeOpaque {
+		problems = append(problems, fmt.Sprintf("%s.type must be %s when using a template", field, corev1.SecretTypeOpaque))
+	}
+	return problems
+}
+
+// validateConfigMapTemplate returns the problems with the template options of the output configmap
+func validateConfigMapTemplate(field string, cm akv.AzureKeyVaultOutputConfigMap) []string {
+	return validateOutputTemplate(outputTemplate{field: field, dataKey: cm.DataKey, template: cm.Template, templateFrom: cm.TemplateFrom})
+}
+
+func validateOutputTemplate(tmpl outputTemplate) []string {
+	if !tmpl.isSet() {
+		return nil
+	}
+
+	var problems []string
+	field := tmpl.field
+	if tmpl.template != "" && tmpl.templateFrom != nil {
+		problems = append(problems, fmt.Sprintf("%s.template and %s.templateFrom cannot both be set", field, field))
+	}
+	if tmpl.template != "" {
+		if _, err := parseTemplate(field+".template", tmpl.template); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.template is invalid: %s", field, err.Error()))
+		}
+	}
+	if tmpl.templateFrom != nil {
+		ref := tmpl.templateFrom.ConfigMapKeyRef
+		if ref == nil || ref.Name == "" || ref.Key == "" {
+			problems = append(problems, fmt.Sprintf("%s.templateFrom.configMapKeyRef must have both name and key", field))
+		} else if ref.Optional != nil && *ref.Optional {
+			problems = append(problems, fmt.Sprintf("%s.templateFrom.configMapKeyRef.optional is not supported", field))
+		}
+	}
+	if tmpl.dataKey == "" {
+		problems = append(problems, fmt.Sprintf("%s.dataKey is required when using a template", field))
+	}
+	return problems
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// resolveTemplate checks that the templates of the output secret and configmap can be read
+// and parsed, and updates the TemplateResolved condition to reflect the outcome
+func (c *Controller) resolveTemplate(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	templates := outputTemplates(akvs)
+	if len(templates) == 0 {
+		return akvs, nil
+	}
+
+	var messages []string
+	for _, tmpl := range templates {
+		if _, reason, err := c.lookupTemplate(akvs, tmpl); err != nil {
+			if _, statusErr := c.setCondition(akvs, metav1.Condition{
+				Type:    ConditionTypeTemplateResolved,
+				Status:  metav1.ConditionFalse,
+				Reason:  reason,
+				Message: err.Error(),
+			}); statusErr != nil {
+				klog.ErrorS(statusErr, "failed to update status", "azurekeyvaultsecret", klog.KObj(akvs))
+			}
+			c.recorder.Event(akvs, corev1.EventTypeWarning, ErrTemplate, err.Error())
+			return nil, err
+		}
+
+		message := fmt.Sprintf("Using template in %s.template", tmpl.field)
+		if ref := tmpl.templateFrom; ref != nil {
+			message = fmt.Sprintf("Using template in key '%s' of configmap '%s'", ref.ConfigMapKeyRef.Key, ref.ConfigMapKeyRef.Name)
+		}
+		messages = append(messages, message)
+	}
+
+	updated, err := c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeTemplateResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  ReasonTemplateResolved,
+		Message: strings.Join(messages, ", "),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// keep object name and version resolved earlier in the sync
+	resolved := updated.DeepCopy()
+	akvs.Spec.DeepCopyInto(&resolved.Spec)
+	return resolved, nil
+}
+
+// lookupTemplate parses the template in the template field of the output, or in the
+// configmap referenced by its templateFrom, returning the condition reason together
+// with the template
+func (c *Controller) lookupTemplate(akvs *akv.AzureKeyVaultSecret, output outputTemplate) (*template.Template, string, error) {
+	if output.templateFrom == nil {
+		tmpl, err := parseTemplate(output.field+".template", output.template)
+		if err != nil {
+			return nil, ReasonTemplateParseError, fmt.Errorf("failed to parse template in %s.template, error: %+v", output.field, err)
+		}
+		return tmpl, ReasonTemplateResolved, nil
+	}
+
+	ref := output.templateFrom.ConfigMapKeyRef
+	cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(ref.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, ReasonConfigMapNotFound, fmt.Errorf("configmap '%s' holding template not found", ref.Name)
+		}
+		return nil, ReasonConfigMapNotFound, fmt.Errorf("failed to get configmap '%s' holding template, error: %+v", ref.Name, err)
+	}
+
+	text, ok := cm.Data[ref.Key]
+	if !ok {
+		return nil, ReasonConfigMapKeyNotFound, fmt.Errorf("key '%s' holding template not found in configmap '%s'", ref.Key, ref.Name)
+	}
+
+	tmpl, err := parseTemplate(fmt.Sprintf("configmap %s key %s", ref.Name, ref.Key), text)
+	if err != nil {
+		return nil, ReasonTemplateParseError, fmt.Errorf("failed to parse template in key '%s' of configmap '%s', error: %+v", ref.Key, ref.Name, err)
+	}
+	return tmpl, ReasonTemplateResolved, nil
+}
+
+// renderTemplate renders the template of the output secret with values, returning the
+// rendered template as the only value with spec.output.secret.dataKey as key. Values
+// are returned as is if no template is used.
+func (c *Controller) renderTemplate(akvs *akv.AzureKeyVaultSecret, values map[string][]byte) (map[string][]byte, error) {
+	output := secretTemplate(akvs)
+	if !output.isSet() {
+		return values, nil
+	}
+
+	data := make(map[string]string, len(values))
+	for key, value := range values {
+		data[key] = string(value)
+	}
+
+	rendered, err := c.executeTemplate(akvs, output, data)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{output.dataKey: []byte(rendered)}, nil
+}
+
+// renderConfigMapTemplate renders the template of the output configmap with values, like
+// renderTemplate for the output secret
+func (c *Controller) renderConfigMapTemplate(akvs *akv.AzureKeyVaultSecret, values map[string]string) (map[string]string, error) {
+	output := configMapTemplate(akvs)
+	if !output.isSet() {
+		return values, nil
+	}
+
+	rendered, err := c.executeTemplate(akvs, output, values)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{output.dataKey: rendered}, nil
+}
+
+// executeTemplate renders the template of output with data. Referencing a key not in data
+// fails rather than rendering an empty value.
+func (c *Controller) executeTemplate(akvs *akv.AzureKeyVaultSecret, output outputTemplate, data map[string]string) (string, error) {
+	tmpl, _, err := c.lookupTemplate(akvs, output)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render template in %s, error: %+v", output.field, err)
+	}
+	return rendered.String(), nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func secretWithTemplateFrom(name, key string) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Output.Secret.DataKey = "config.yaml"
+	akvs.Spec.Output.Secret.TemplateFrom = &akv.AzureKeyVaultOutputTemplateFrom{
+		ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+	return akvs
+}
+
+func templateConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "templates",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Data: data,
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	both := secretWithTemplateFrom("templates", "config")
+	both.Spec.Output.Secret.Template = "password: {{ .password }}"
+
+	noDataKey := secretWithTemplateFrom("templates", "config")
+	noDataKey.Spec.Output.Secret.DataKey = ""
+
+	tls := secretWithTemplateFrom("templates", "config")
+	tls.Spec.Output.Secret.Type = corev1.SecretTypeTLS
+
+	invalid := secret()
+	invalid.Spec.Output.Secret.DataKey = "config.yaml"
+	invalid.Spec.Output.Secret.Template = "password: {{ .password"
+
+	tests := []struct {
+		akvs    *akv.AzureKeyVaultSecret
+		wantErr string
+	}{
+		{secretWithTemplateFrom("templates", "config"), ""},
+		{both, "spec.output.secret.template and spec.output.secret.templateFrom cannot both be set"},
+		{secretWithTemplateFrom("templates", ""), "spec.output.secret.templateFrom.configMapKeyRef must have both name and key"},
+		{noDataKey, "spec.output.secret.dataKey is required when using a template"},
+		{tls, "spec.output.secret.type must be Opaque when using a template"},
+		{invalid, "spec.output.secret.template is invalid"},
+	}
+
+	for _, test := range tests {
+		problems := strings.Join(validateTemplate("spec.output.secret", test.akvs.Spec.Output.Secret), "; ")
+		if test.wantErr == "" && problems != "" {
+			t.Errorf("expected no problems, but got '%s'", problems)
+		}
+		if !strings.Contains(problems, test.wantErr) {
+			t.Errorf("expected problem '%s', but got '%s'", test.wantErr, problems)
+		}
+	}
+}
+
+func TestRenderTemplateFromConfigMap(t *testing.T) {
+	c := controllerWithConfigMaps(t, templateConfigMap(map[string]string{"config": "user: {{ .user }}\npassword: {{ .password }}\n"}))
+
+	rendered, err := c.renderTemplate(secretWithTemplateFrom("templates", "config"), map[string][]byte{
+		"user":     []byte("admin"),
+		"password": []byte("secret"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 || string(rendered["config.yaml"]) != "user: admin\npassword: secret\n" {
+		t.Errorf("expected only rendered config.yaml, but got %v", rendered)
+	}
+
+	if _, err := c.renderTemplate(secretWithTemplateFrom("templates", "config"), map[string][]byte{"user": []byte("admin")}); err == nil {
+		t.Error("expected error when the template references a missing value")
+	}
+}
+
+func TestRenderTemplateWithoutTemplate(t *testing.T) {
+	c := controllerWithConfigMaps(t)
+
+	values := map[string][]byte{"password": []byte("secret")}
+	rendered, err := c.renderTemplate(secret(), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 || string(rendered["password"]) != "secret" {
+		t.Errorf("expected values to be returned as is, but got %v", rendered)
+	}
+}
+
+func TestRenderConfigMapTemplate(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{
+		Name:     "settings",
+		DataKey:  "app.properties",
+		Template: "db.host={{ .host }}\ndb.port={{ .port }}\n",
+	}
+	c := controllerWithConfigMaps(t)
+
+	rendered, err := c.renderConfigMapTemplate(akvs, map[string]string{"host": "db.local", "port": "5432"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 || rendered["app.properties"] != "db.host=db.local\ndb.port=5432\n" {
+		t.Errorf("expected only rendered app.properties, but got %v", rendered)
+	}
+
+	_, err = c.renderConfigMapTemplate(akvs, map[string]string{"host": "db.local"})
+	if err == nil || !strings.Contains(err.Error(), "spec.output.configMap") {
+		t.Errorf("expected error naming spec.output.configMap when the template references a missing value, but got %v", err)
+	}
+}
+
+func TestValidateConfigMapTemplate(t *testing.T) {
+	cm := akv.AzureKeyVaultOutputConfigMap{Name: "settings", Template: "host: {{ .host }}"}
+	problems := strings.Join(validateConfigMapTemplate("spec.output.configMap", cm), "; ")
+	if !strings.Contains(problems, "spec.output.configMap.dataKey is required when using a template") {
+		t.Errorf("expected missing dataKey to be reported, but got '%s'", problems)
+	}
+}
+
+func TestResolveTemplateConditions(t *testing.T) {
+	tests := []struct {
+		data       map[string]string
+		key        string
+		wantStatus metav1.ConditionStatus
+		wantReason string
+	}{
+		{map[string]string{"config": "password: {{ .password }}"}, "config", metav1.ConditionTrue, ReasonTemplateResolved},
+		{map[string]string{"config": "password: {{ .password }}"}, "missing", metav1.ConditionFalse, ReasonConfigMapKeyNotFound},
+		{map[string]string{"config": "password: {{ .password"}, "config", metav1.ConditionFalse, ReasonTemplateParseError},
+	}
+
+	for _, test := range tests {
+		akvs := secretWithTemplateFrom("templates", test.key)
+		c, _ := outputsController(t, akvs, &countingVaultService{})
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		if err := indexer.Add(templateConfigMap(test.data)); err != nil {
+			t.Fatal(err)
+		}
+		c.configMapsLister = corelisters.NewConfigMapLister(indexer)
+
+		_, err := c.resolveTemplate(akvs)
+		if (err != nil) != (test.wantStatus == metav1.ConditionFalse) {
+			t.Errorf("unexpected error for reason '%s': %v", test.wantReason, err)
+		}
+
+		condition := meta.FindStatusCondition(getStatus(t, c, akvs).Status.Conditions, ConditionTypeTemplateResolved)
+		if condition == nil || condition.Status != test.wantStatus || condition.Reason != test.wantReason {
+			t.Errorf("expected condition %s with reason '%s', but got %+v", test.wantStatus, test.wantReason, condition)
+			continue
+		}
+		if !strings.Contains(condition.Message, "templates") {
+			t.Errorf("expected condition message to name the configmap, but got '%s'", condition.Message)
+		}
+	}
+}
+
+func TestResolveTemplateMissingConfigMap(t *testing.T) {
+	akvs := secretWithTemplateFrom("templates", "config")
+	c, _ := outputsController(t, akvs, &countingVaultService{})
+
+	if _, err := c.resolveTemplate(akvs); err == nil {
+		t.Fatal("expected error when the configmap does not exist")
+	}
+
+	condition := meta.FindStatusCondition(getStatus(t, c, akvs).Status.Conditions, ConditionTypeTemplateResolved)
+	if condition == nil || condition.Reason != ReasonConfigMapNotFound {
+		t.Errorf("expected condition with reason '%s', but got %+v", ReasonConfigMapNotFound, condition)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// throttleBaseDelay is how long to wait before retrying a key the first time
+	// Azure Key Vault throttles it, doubled for each following time
+	throttleBaseDelay = 5 * time.Second
+
+	// throttleMaxDelay is the longest time to wait before retrying a throttled key
+	throttleMaxDelay = 5 * time.Minute
+
+	// throttleJitter is the max fraction of the delay added as jitter, so throttled
+	// keys are not retried all at once
+	throttleJitter = 0.2
+)
+
+var (
+	throttledSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "akv2k8s_azure_throttled_syncs_total",
+		Help: "The total number of syncs throttled by Azure Key Vault, by queue",
+	}, []string{"queue"})
+
+	throttledKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "akv2k8s_azure_throttled_keys",
+		Help: "The number of keys currently backing off after being throttled by Azure Key Vault, by queue",
+	}, []string{"queue"})
+)
+
+// azureKeyVaultError is an error getting a secret from Azure Key Vault, keeping the
+// underlying error so callers can tell why it failed, like being throttled
+type azureKeyVaultError struct {
+	msg string
+	err error
+}
+
+func newAzureKeyVaultError(akvs *akv.AzureKeyVaultSecret, err error) error {
+	return &azureKeyVaultError{
+		msg: fmt.Sprintf(FailedAzureKeyVault, akvs.Name, akvs.Spec.Vault.Identifier(), err.Error()),
+		err: err,
+	}
+}
+
+func (e *azureKeyVaultError) Error() string {
+	return e.msg
+}
+
+func (e *azureKeyVaultError) Unwrap() error {
+	return e.err
+}
+
+// throttledRetryAfter tells if err, or any error aggregated in it, is Azure Key Vault
+// throttling requests, and how long it asked to wait
+func throttledRetryAfter(err error) (time.Duration, bool) {
+	if retryAfter, ok := vault.IsThrottled(err); ok {
+		return retryAfter, true
+	}
+
+	var agg utilerrors.Aggregate
+	if !errors.As(err, &agg) {
+		return 0, false
+	}
+	var retryAfter time.Duration
+	throttled := false
+	for _, e := range agg.Errors() {
+		if after, ok := throttledRetryAfter(e); ok {
+			throttled = true
+			if after > retryAfter {
+				retryAfter = after
+			}
+		}
+	}
+	return retryAfter, throttled
+}
+
+// throttleBackoff keeps track of how many times in a row each key in a queue has been
+// throttled by Azure Key Vault, backing off exponentially with jitter
+type throttleBackoff struct {
+	queue  string
+	jitter func(d time.Duration) time.Duration
+
+	mu       sync.Mutex
+	failures map[interface{}]int
+}
+
+func newThrottleBackoff(queue string) *throttleBackoff {
+	return &throttleBackoff{
+		queue:    queue,
+		jitter:   func(d time.Duration) time.Duration { return wait.Jitter(d, throttleJitter) },
+		failures: make(map[interface{}]int),
+	}
+}
+
+// next records key as throttled again, returning how long to wait before retrying it
+// and how many times in a row it has been throttled. The delay is never shorter than
+// retryAfter, as asked for by Azure Key Vault.
+func (b *throttleBackoff) next(key interface{}, retryAfter time.Duration) (time.Duration, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failures := b.failures[key] + 1
+	b.failures[key] = failures
+	throttledKeys.WithLabelValues(b.queue).Set(float64(len(b.failures)))
+
+	exp := math.Min(float64(throttleBaseDelay)*math.Pow(2, float64(failures-1)), float64(throttleMaxDelay))
+	delay := b.jitter(time.Duration(exp))
+	if delay < retryAfter {
+		delay = retryAfter
+	}
+	return delay, failures
+}
+
+// forget stops tracking key, after being synced or dropped
+func (b *throttleBackoff) forget(key interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.failures[key]; !ok {
+		return
+	}
+	delete(b.failures, key)
+	throttledKeys.WithLabelValues(b.queue).Set(float64(len(b.failures)))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+func throttledError(retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://primary.vault.azure.net/secrets/some-secret", nil)
+	return runtime.NewResponseError(&http.Response{
+		Status:     http.StatusText(http.StatusTooManyRequests),
+		StatusCode: http.StatusTooManyRequests,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	})
+}
+
+func TestThrottledRetryAfter(t *testing.T) {
+	akvs := secret()
+	tests := []struct {
+		name               string
+		err                error
+		expectedThrottled  bool
+		expectedRetryAfter time.Duration
+	}{
+		{name: "throttled", err: throttledError("10"), expectedThrottled: true, expectedRetryAfter: 10 * time.Second},
+		{name: "wrapped", err: newAzureKeyVaultError(akvs, throttledError("3")), expectedThrottled: true, expectedRetryAfter: 3 * time.Second},
+		{name: "aggregated", err: utilerrors.NewAggregate([]error{errors.New("failed"), newAzureKeyVaultError(akvs, throttledError("7"))}), expectedThrottled: true, expectedRetryAfter: 7 * time.Second},
+		{name: "not throttled", err: newAzureKeyVaultError(akvs, responseError(http.StatusServiceUnavailable))},
+		{name: "other error", err: errors.New("failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, throttled := throttledRetryAfter(tt.err)
+			if throttled != tt.expectedThrottled || retryAfter != tt.expectedRetryAfter {
+				t.Errorf("expected throttled %t after %v, but got %t after %v", tt.expectedThrottled, tt.expectedRetryAfter, throttled, retryAfter)
+			}
+		})
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	backoff := newThrottleBackoff("test")
+	backoff.jitter = func(d time.Duration) time.Duration { return d }
+
+	for i, expected := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		delay, failures := backoff.next("key", 0)
+		if delay != expected || failures != i+1 {
+			t.Errorf("expected delay %v after %d failures, but got %v after %d", expected, i+1, delay, failures)
+		}
+	}
+
+	if delay, _ := backoff.next("key", time.Minute); delay != time.Minute {
+		t.Errorf("expected delay to honor retry after, but got %v", delay)
+	}
+
+	for i := 0; i < 10; i++ {
+		backoff.next("key", 0)
+	}
+	if delay, _ := backoff.next("key", 0); delay != throttleMaxDelay {
+		t.Errorf("expected delay to be capped at %v, but got %v", throttleMaxDelay, delay)
+	}
+
+	backoff.forget("key")
+	if delay, failures := backoff.next("key", 0); delay != throttleBaseDelay || failures != 1 {
+		t.Errorf("expected backoff to start over once forgotten, but got %v after %d failures", delay, failures)
+	}
+}
+
+func TestPriorityWorkerBacksOffWhenThrottled(t *testing.T) {
+	throttled := true
+	reconcile := func(key string) error {
+		if throttled {
+			return newAzureKeyVaultError(secret(), throttledError("1"))
+		}
+		return nil
+	}
+	high := newPriorityQueue("high", priorityHigh, 1, 1, nil, false, reconcile)
+	low := newPriorityQueue("low", priorityLow, 1, 1, nil, false, reconcile)
+	defer high.queue.ShutDown()
+	defer low.queue.ShutDown()
+	worker := newPriorityWorker(high, low, 1, 1)
+
+	for i := 1; i <= 3; i++ {
+		worker.process(queuedItem{key: "key", queue: high})
+		if high.GetQueue().NumRequeues("key") != 0 {
+			t.Error("expected throttled key not to count against max retries")
+		}
+		if high.throttle.failures["key"] != i {
+			t.Errorf("expected key to be throttled %d times, but got %d", i, high.throttle.failures["key"])
+		}
+	}
+
+	throttled = false
+	worker.process(queuedItem{key: "key", queue: high})
+	if _, ok := high.throttle.failures["key"]; ok {
+		t.Error("expected backoff to be forgotten once synced")
+	}
+}
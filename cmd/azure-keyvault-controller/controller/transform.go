@@ -0,0 +1,39 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ReasonTransformFailed is the reason of events telling that a transform in spec.output.transform,
+// or a default transform, failed for the value read from Azure Key Vault
+const ReasonTransformFailed = "TransformFailed"
+
+// reportTransformFailed emits a warning if err is caused by a failing transform, like
+// base64decode of a value that is not base64, as retrying will not succeed until the value
+// in Azure Key Vault or the transforms are changed
+func (c *Controller) reportTransformFailed(akvs *akv.AzureKeyVaultSecret, err error) {
+	if !transformers.IsTransformError(err) {
+		return
+	}
+	c.recorder.Eventf(akvs, corev1.EventTypeWarning, ReasonTransformFailed,
+		"Secret '%s' in Azure Key Vault '%s' could not be transformed: %v",
+		akvs.Spec.Vault.Object.Name, akvs.Spec.Vault.Identifier(), err)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestBase64DecodeWritesBinarySecret(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		// binary bytes, wrapped over two lines as when pasted from a file
+		vaultService: &fakeVaultService{fakeSecretValue: "MIIC\nAP8A/w==\n"},
+		recorder:     recorder,
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "license"
+	akvs.Spec.Output.Secret.DataKey = "license.p12"
+	akvs.Spec.Output.Transform = []string{"base64decode"}
+
+	values, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x30, 0x82, 0x02, 0x00, 0xff, 0x00, 0xff}
+	if !bytes.Equal(values["license.p12"], expected) {
+		t.Errorf("expected decoded bytes %v, but got %v", expected, values["license.p12"])
+	}
+}
+
+func TestBase64DecodeOfInvalidValueFailsSync(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{
+		vaultService: &fakeVaultService{fakeSecretValue: "not base64!"},
+		recorder:     recorder,
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "license"
+	akvs.Spec.Output.Secret.DataKey = "license.p12"
+	akvs.Spec.Output.Transform = []string{"trim", "base64decode"}
+
+	_, err := c.getSecretFromKeyVault(akvs)
+	if !transformers.IsTransformError(err) {
+		t.Fatalf("expected transform error, but got %v", err)
+	}
+	event := expectEvent(t, recorder, ReasonTransformFailed)
+	if !strings.Contains(event, "transform 'base64decode' failed") || !strings.Contains(event, "not valid base64") {
+		t.Errorf("expected event describing the invalid base64, but got '%s'", event)
+	}
+}
+
+func TestBase64DecodeToConfigMapWritesBinaryData(t *testing.T) {
+	c := &Controller{
+		vaultService: &fakeVaultService{fakeSecretValue: "c29tZS12YWx1ZQ=="},
+		recorder:     record.NewFakeRecorder(10),
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+	akvs.Spec.Output.ConfigMap.DataKey = "value"
+	akvs.Spec.Output.Transform = []string{"base64decode"}
+
+	values, err := c.getConfigMapFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["value"] != "some-value" {
+		t.Errorf("expected decoded value, but got %v", values)
+	}
+	if cm := c.createNewConfigMap(akvs, values); cm.Data["value"] != "some-value" || len(cm.BinaryData) != 0 {
+		t.Errorf("expected decoded text to be written to data, but got data %v and binaryData %v", cm.Data, cm.BinaryData)
+	}
+}
+
+func TestJSONPathWritesExtractedValue(t *testing.T) {
+	c := &Controller{
+		vaultService: &fakeVaultService{fakeSecretValue: `{"connectionStrings": {"primary": "Server=db"}}`},
+		recorder:     record.NewFakeRecorder(10),
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "db"
+	akvs.Spec.Output.Secret.DataKey = "connectionString"
+	akvs.Spec.Output.Transform = []string{"jsonpath:$.connectionStrings.primary"}
+
+	values, err := c.getSecretFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values["connectionString"]) != "Server=db" {
+		t.Errorf("expected extracted value, but got %v", values)
+	}
+
+	akvs.Spec.Output.Transform = []string{"jsonpath:$.connectionStrings.secondary"}
+	if _, err := c.getSecretFromKeyVault(akvs); err == nil || !strings.Contains(err.Error(), "$.connectionStrings.secondary") {
+		t.Errorf("expected error naming the json path, but got %v", err)
+	}
+}
+
+func TestTransformsGiveSameValueForSecretAndConfigMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		transforms []string
+		expected   string
+	}{
+		{"no transforms", "value", nil, "value"},
+		{"trim", "  value\n", []string{"trim"}, "value"},
+		{"chomp", "value\n", []string{"chomp"}, "value"},
+		{"base64encode", "value", []string{"base64encode"}, "dmFsdWU="},
+		{"base64decode encoded again", "dmFsdWU=\n", []string{"base64decode", "base64encode"}, "dmFsdWU="},
+		{"jsonpath", `{"db": {"port": 5432}}`, []string{"jsonpath:$.db.port"}, "5432"},
+		{"replace", "postgres://db:5432", []string{"replace:|^postgres://||"}, "db:5432"},
+		{"chained", ` {"url": "postgres://db"} `, []string{"trim", "jsonpath:$.url", "replace:|^postgres://||", "base64encode"}, "ZGI="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{
+				vaultService: &fakeVaultService{fakeSecretValue: tt.value},
+				recorder:     record.NewFakeRecorder(10),
+				options:      &Options{},
+			}
+
+			akvs := secret()
+			akvs.Spec.Output.Secret.DataKey = "value"
+			akvs.Spec.Output.ConfigMap.Name = "settings"
+			akvs.Spec.Output.ConfigMap.DataKey = "value"
+			akvs.Spec.Output.Transform = tt.transforms
+
+			secretValues, err := c.getSecretFromKeyVault(akvs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			configMapValues, err := c.getConfigMapFromKeyVault(akvs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(secretValues["value"]) != tt.expected || configMapValues["value"] != tt.expected {
+				t.Errorf("expected '%s' in both outputs, but got '%s' in Secret and '%s' in ConfigMap", tt.expected, secretValues["value"], configMapValues["value"])
+			}
+		})
+	}
+}
+
+func TestInvalidUTF8ToConfigMapWritesBinaryData(t *testing.T) {
+	c := &Controller{
+		vaultService: &fakeVaultService{fakeSecretValue: "\xff\xfe\x00value"},
+		recorder:     record.NewFakeRecorder(10),
+		options:      &Options{},
+	}
+
+	akvs := secret()
+	akvs.Spec.Output.Secret.DataKey = "value"
+	akvs.Spec.Output.ConfigMap.Name = "settings"
+	akvs.Spec.Output.ConfigMap.DataKey = "value"
+	akvs.Spec.Output.Transform = []string{"trim"}
+
+	if _, err := c.getSecretFromKeyVault(akvs); err != nil {
+		t.Errorf("expected binary value to be written to the Secret, but got %v", err)
+	}
+	values, err := c.getConfigMapFromKeyVault(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := c.createNewConfigMap(akvs, values)
+	if len(cm.Data) != 0 || string(cm.BinaryData["value"]) != "\xff\xfe\x00value" {
+		t.Errorf("expected invalid UTF-8 to be written to binaryData, but got data %v and binaryData %v", cm.Data, cm.BinaryData)
+	}
+}
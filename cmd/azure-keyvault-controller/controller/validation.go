@@ -0,0 +1,108 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1/validation"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// validateSpec returns an error describing every problem in the spec of akvs that retrying
+// the sync cannot fix, like output names Kubernetes will never accept. It runs the checks of
+// the admission webhook too, as AzureKeyVaultSecrets may be created while it is not running.
+func validateSpec(akvs *akv.AzureKeyVaultSecret) error {
+	var problems []string
+	for _, err := range validation.ValidateAzureKeyVaultSecret(akvs) {
+		problems = append(problems, err.Error())
+	}
+	problems = append(problems, validateChecksumAnnotationTargets("spec.output.secret.checksumAnnotationTargets", akvs.Spec.Output.Secret.ChecksumAnnotationTargets)...)
+	problems = append(problems, validateTemplate("spec.output.secret", akvs.Spec.Output.Secret)...)
+	problems = append(problems, validateConfigMapTemplate("spec.output.configMap", akvs.Spec.Output.ConfigMap)...)
+	problems = append(problems, validateRotationDebounce(akvs.Spec.Output)...)
+	if interval := akvs.Spec.Vault.Object.PollInterval; interval != nil && interval.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("spec.vault.object.pollInterval '%s' must not be negative", interval.Duration))
+	}
+	for i, output := range akvs.Spec.Outputs {
+		if output.ConfigMap.Immutable {
+			problems = append(problems, fmt.Sprintf("spec.outputs[%d].configMap.immutable is not supported, only spec.output.configMap.immutable", i))
+		}
+		if len(output.Secret.ChecksumAnnotationTargets) > 0 {
+			problems = append(problems, fmt.Sprintf("spec.outputs[%d].secret.checksumAnnotationTargets is not supported, only spec.output.secret.checksumAnnotationTargets", i))
+		}
+		if output.Secret.Template != "" || output.Secret.TemplateFrom != nil {
+			problems = append(problems, fmt.Sprintf("spec.outputs[%d].secret.template and templateFrom are not supported, only spec.output.secret.template and templateFrom", i))
+		}
+		if output.ConfigMap.Template != "" || output.ConfigMap.TemplateFrom != nil {
+			problems = append(problems, fmt.Sprintf("spec.outputs[%d].configMap.template and templateFrom are not supported, only spec.output.configMap.template and templateFrom", i))
+		}
+		if output.RotationDebounce != nil {
+			problems = append(problems, fmt.Sprintf("spec.outputs[%d].rotationDebounce is not supported, only spec.output.rotationDebounce", i))
+		}
+	}
+	if err := validateNameFrom(akvs.Spec.Vault.Object); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := validateOutputs(akvs.Spec.Outputs); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// checkSpec sets the InvalidSpec condition if the spec of akvs is invalid, and returns false
+// so akvs is not synced or retried until the spec is changed. The condition is cleared once
+// the spec is valid.
+func (c *Controller) checkSpec(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, bool, error) {
+	specErr := validateSpec(akvs)
+	if specErr == nil {
+		if !meta.IsStatusConditionTrue(akvs.Status.Conditions, ConditionTypeInvalidSpec) {
+			return akvs, true, nil
+		}
+		akvs, err := c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeInvalidSpec,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ValidSpec",
+			Message: "The AzureKeyVaultSecret spec is valid",
+		})
+		return akvs, true, err
+	}
+
+	existing := meta.FindStatusCondition(akvs.Status.Conditions, ConditionTypeInvalidSpec)
+	if existing == nil || existing.Status != metav1.ConditionTrue || existing.Message != specErr.Error() {
+		klog.InfoS("invalid spec - not syncing until the spec is changed", "azurekeyvaultsecret", klog.KObj(akvs), "error", specErr.Error())
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ConditionTypeInvalidSpec, specErr.Error())
+	}
+
+	akvs, err := c.setCondition(akvs, metav1.Condition{
+		Type:    ConditionTypeInvalidSpec,
+		Status:  metav1.ConditionTrue,
+		Reason:  "ValidationFailed",
+		Message: specErr.Error(),
+	})
+	return akvs, false, err
+}
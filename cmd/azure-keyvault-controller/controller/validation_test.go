@@ -0,0 +1,149 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	akvfake "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned/fake"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestValidateSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(akvs *akv.AzureKeyVaultSecret)
+		wantErr string
+	}{
+		{
+			name: "valid secret name",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.Name = "my-secret.v1"
+				akvs.Spec.Output.Secret.DataKey = "password"
+			},
+		},
+		{
+			name:    "invalid secret name",
+			mutate:  func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Output.Secret.Name = "My_Secret" },
+			wantErr: `spec.output.secret.name: Invalid value: "My_Secret"`,
+		},
+		{
+			name:    "invalid configmap name",
+			mutate:  func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Output.ConfigMap.Name = "-config" },
+			wantErr: `spec.output.configMap.name: Invalid value: "-config"`,
+		},
+		{
+			name: "invalid name in outputs",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+					{Secret: akv.AzureKeyVaultOutputSecret{Name: "ok", DataKey: "password"}},
+					{Secret: akv.AzureKeyVaultOutputSecret{Name: "not ok", DataKey: "password"}},
+				}
+			},
+			wantErr: `spec.outputs[1].secret.name: Invalid value: "not ok"`,
+		},
+		{
+			name: "name and nameFrom",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.NameFrom = secretWithNameFromSecret("active", "db").Spec.Vault.Object.NameFrom
+			},
+			wantErr: "spec.vault.object.name and spec.vault.object.nameFrom cannot both be set",
+		},
+		{
+			name:    "missing data key",
+			mutate:  func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Output.Secret.Name = "my-secret" },
+			wantErr: "spec.output.secret.dataKey: Required value",
+		},
+		{
+			name: "duplicate outputs",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+					{Secret: akv.AzureKeyVaultOutputSecret{Name: "same"}},
+					{Secret: akv.AzureKeyVaultOutputSecret{Name: "same"}},
+				}
+			},
+			wantErr: "same",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := secret()
+			tt.mutate(akvs)
+			err := validateSpec(akvs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected no error, but got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestInvalidSpecCondition(t *testing.T) {
+	akvs := secret()
+	akvs.Spec.Output.Secret.Name = "My_Secret"
+	client := akvfake.NewSimpleClientset(akvs)
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{akvsClient: client, recorder: recorder, options: &Options{}}
+
+	updated, valid, err := c.checkSpec(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Error("expected spec to be invalid")
+	}
+	condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeInvalidSpec)
+	if condition == nil || condition.Status != metav1.ConditionTrue || !strings.Contains(condition.Message, `"My_Secret"`) {
+		t.Fatalf("expected InvalidSpec condition naming the offending value, but got %v", condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event, but got %d", len(recorder.Events))
+	}
+
+	// checking again does not emit another event
+	updated, _, err = c.checkSpec(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected no new event for unchanged spec, but got %d", len(recorder.Events))
+	}
+
+	updated.Spec.Output.Secret.Name = "my-secret"
+	updated.Spec.Output.Secret.DataKey = "password"
+	updated, valid, err = c.checkSpec(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Error("expected spec to be valid")
+	}
+	condition = meta.FindStatusCondition(updated.Status.Conditions, ConditionTypeInvalidSpec)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Errorf("expected InvalidSpec condition to be cleared, but got %v", condition)
+	}
+}
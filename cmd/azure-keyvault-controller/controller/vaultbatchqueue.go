@@ -0,0 +1,250 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+var (
+	pollBatchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "akv2k8s_poll_batch_size",
+		Help:    "Number of AzureKeyVaultSecrets polled in one batch, by vault. Only reported when poll batching is enabled.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"vault"})
+
+	pollBatchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "akv2k8s_poll_batch_duration_seconds",
+		Help:    "How long it took to hand out one batch of polls, by vault. Only reported when poll batching is enabled.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"vault"})
+)
+
+// vaultBatchQueue is a workqueue.Interface handing out items in batches per Azure Key Vault,
+// so polls of the same vault run close together and reuse connections and tokens. A batch
+// takes all pending items of one vault, including items added while it runs, until the
+// vault has no more pending items or the window has passed. Vaults get their batches in
+// the order they got pending items. Like workqueue.Type, an item is never pending more
+// than once, and an item added while processing is pending again when done.
+type vaultBatchQueue struct {
+	name    string
+	window  time.Duration
+	vaultOf func(item interface{}) string
+	now     func() time.Time
+	cond    *sync.Cond
+
+	// vaults with pending items, except the vault of the current batch, in the order
+	// they get their next batch
+	vaults  []string
+	pending map[string][]interface{}
+
+	// current batch
+	batching   bool
+	batchVault string
+	batchStart time.Time
+	batchLast  time.Time
+	batchSize  int
+
+	dirty      map[interface{}]bool
+	processing map[interface{}]bool
+
+	shuttingDown bool
+	drain        bool
+}
+
+var _ workqueue.Interface = &vaultBatchQueue{}
+
+// newVaultBatchQueue returns a queue batching items by the vault returned by vaultOf
+func newVaultBatchQueue(name string, window time.Duration, vaultOf func(item interface{}) string) *vaultBatchQueue {
+	return &vaultBatchQueue{
+		name:       name,
+		window:     window,
+		vaultOf:    vaultOf,
+		now:        time.Now,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		pending:    make(map[string][]interface{}),
+		dirty:      make(map[interface{}]bool),
+		processing: make(map[interface{}]bool),
+	}
+}
+
+// Add marks item as needing processing
+func (q *vaultBatchQueue) Add(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.shuttingDown || q.dirty[item] {
+		return
+	}
+
+	q.dirty[item] = true
+	if q.processing[item] {
+		return
+	}
+
+	q.push(item)
+	q.cond.Signal()
+}
+
+func (q *vaultBatchQueue) push(item interface{}) {
+	vault := q.vaultOf(item)
+	if len(q.pending[vault]) == 0 && !(q.batching && vault == q.batchVault) {
+		q.vaults = append(q.vaults, vault)
+	}
+	q.pending[vault] = append(q.pending[vault], item)
+}
+
+// Len returns the number of pending items
+func (q *vaultBatchQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	count := 0
+	for _, items := range q.pending {
+		count += len(items)
+	}
+	return count
+}
+
+func (q *vaultBatchQueue) hasPending() bool {
+	return len(q.vaults) > 0 || (q.batching && len(q.pending[q.batchVault]) > 0)
+}
+
+// Get blocks until an item is pending, and returns the next item of the current batch,
+// starting the batch of the next vault when the current batch is done
+func (q *vaultBatchQueue) Get() (item interface{}, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for !q.hasPending() && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if !q.hasPending() {
+		return nil, true
+	}
+
+	now := q.now()
+	if !q.batching || len(q.pending[q.batchVault]) == 0 || now.Sub(q.batchStart) >= q.window {
+		q.endBatch()
+		q.batching = true
+		q.batchVault = q.vaults[0]
+		q.vaults = q.vaults[1:]
+		q.batchStart = now
+		q.batchSize = 0
+	}
+
+	items := q.pending[q.batchVault]
+	item = items[0]
+	if len(items) > 1 {
+		q.pending[q.batchVault] = items[1:]
+	} else {
+		delete(q.pending, q.batchVault)
+	}
+	q.batchLast = now
+	q.batchSize++
+
+	q.processing[item] = true
+	delete(q.dirty, item)
+	return item, false
+}
+
+// endBatch reports the current batch, and gives its vault a new turn if items are left
+func (q *vaultBatchQueue) endBatch() {
+	if !q.batching {
+		return
+	}
+	q.batching = false
+
+	if q.batchSize > 0 {
+		pollBatchSize.WithLabelValues(q.batchVault).Observe(float64(q.batchSize))
+		pollBatchDuration.WithLabelValues(q.batchVault).Observe(q.batchLast.Sub(q.batchStart).Seconds())
+	}
+	if len(q.pending[q.batchVault]) > 0 {
+		q.vaults = append(q.vaults, q.batchVault)
+	}
+}
+
+// Done marks item as done processing, making it pending again if it was added
+// while being processed
+func (q *vaultBatchQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	delete(q.processing, item)
+	if q.dirty[item] {
+		q.push(item)
+		q.cond.Signal()
+	} else if len(q.processing) == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// ShutDown ignores new items and instructs workers to exit
+func (q *vaultBatchQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.drain = false
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain ignores new items, and waits until all items being processed
+// are done before instructing workers to exit
+func (q *vaultBatchQueue) ShutDownWithDrain() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.drain = true
+	q.shuttingDown = true
+	q.cond.Broadcast()
+
+	for len(q.processing) > 0 && q.drain {
+		q.cond.Wait()
+	}
+}
+
+func (q *vaultBatchQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	return q.shuttingDown
+}
+
+// vaultOfKey returns the vault polled for the AzureKeyVaultSecret with key, or an empty
+// string if it is not found, so polls of removed AzureKeyVaultSecrets are batched together
+func (c *Controller) vaultOfKey(item interface{}) string {
+	key, ok := item.(string)
+	if !ok {
+		return ""
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return ""
+	}
+	akvs, err := c.azureKeyVaultSecretLister.AzureKeyVaultSecrets(namespace).Get(name)
+	if err != nil {
+		return ""
+	}
+	return akvs.Spec.Vault.Identifier()
+}
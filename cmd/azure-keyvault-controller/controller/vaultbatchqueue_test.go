@@ -0,0 +1,111 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// vaultOfTestKey returns the part of the name before the dash as the vault, so
+// "ns/one-a" is polled from vault "one"
+func vaultOfTestKey(item interface{}) string {
+	name := strings.SplitN(item.(string), "/", 2)[1]
+	return strings.SplitN(name, "-", 2)[0]
+}
+
+func getAll(t *testing.T, q *vaultBatchQueue, expected []string) {
+	t.Helper()
+	for i, key := range expected {
+		item, shutdown := q.Get()
+		if shutdown {
+			t.Fatal("queue should not be shut down")
+		}
+		if item != key {
+			t.Errorf("expected item %d to be '%s', but got '%s'", i, key, item)
+		}
+		q.Done(item)
+	}
+}
+
+func TestVaultBatchQueueGroupsByVault(t *testing.T) {
+	q := newVaultBatchQueue("test", time.Minute, vaultOfTestKey)
+	for _, key := range []string{"a/one-a", "a/two-a", "b/one-b", "a/three-a", "b/two-b", "c/one-c"} {
+		q.Add(key)
+	}
+	q.Add("a/one-a")
+
+	if q.Len() != 6 {
+		t.Errorf("expected 6 pending items, but got %d", q.Len())
+	}
+
+	getAll(t, q, []string{"a/one-a", "b/one-b", "c/one-c", "a/two-a", "b/two-b", "a/three-a"})
+
+	if q.Len() != 0 {
+		t.Errorf("expected no pending items, but got %d", q.Len())
+	}
+}
+
+func TestVaultBatchQueueAddsToRunningBatch(t *testing.T) {
+	q := newVaultBatchQueue("test", time.Minute, vaultOfTestKey)
+	q.Add("a/one-a")
+	q.Add("a/two-a")
+
+	item, _ := q.Get()
+	q.Add("b/one-b")
+	q.Done(item)
+
+	getAll(t, q, []string{"b/one-b", "a/two-a"})
+}
+
+func TestVaultBatchQueueMovesOnAfterWindow(t *testing.T) {
+	now := time.Now()
+	q := newVaultBatchQueue("test", time.Minute, vaultOfTestKey)
+	q.now = func() time.Time { return now }
+	for _, key := range []string{"a/one-a", "b/one-b", "c/one-c", "a/two-a"} {
+		q.Add(key)
+	}
+
+	getAll(t, q, []string{"a/one-a", "b/one-b"})
+	now = now.Add(time.Minute)
+	getAll(t, q, []string{"a/two-a", "c/one-c"})
+}
+
+func TestVaultBatchQueueAddWhileProcessing(t *testing.T) {
+	q := newVaultBatchQueue("test", time.Minute, vaultOfTestKey)
+	q.Add("ns/one-a")
+
+	item, _ := q.Get()
+	q.Add("ns/one-a")
+	if q.Len() != 0 {
+		t.Error("item being processed should not be pending until done")
+	}
+
+	q.Done(item)
+	if q.Len() != 1 {
+		t.Error("item added while processing should be pending when done")
+	}
+
+	q.ShutDown()
+	if _, shutdown := q.Get(); shutdown {
+		t.Error("pending items should still be returned after shut down")
+	}
+	if _, shutdown := q.Get(); !shutdown {
+		t.Error("expected queue to be shut down")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"kmodules.xyz/client-go/tools/queue"
+)
+
+const (
+	// versionFromConfigMapIndex indexes azurekeyvaultsecrets by the namespace/name of
+	// the configmap referenced in spec.vault.object.versionFrom
+	versionFromConfigMapIndex = "versionFromConfigMap"
+
+	// ReasonVersionResolved is used when the object version was resolved
+	ReasonVersionResolved = "Resolved"
+
+	// ReasonInvalidVersionFrom is used when spec.vault.object.versionFrom is not valid
+	ReasonInvalidVersionFrom = "InvalidVersionFrom"
+
+	// ReasonConfigMapNotFound is used when the configmap holding the object version does not exist
+	ReasonConfigMapNotFound = "ConfigMapNotFound"
+
+	// ReasonConfigMapKeyNotFound is used when the configmap holding the object version does not have the key
+	ReasonConfigMapKeyNotFound = "ConfigMapKeyNotFound"
+
+	// ReasonEmptyVersion is used when the object version read from the configmap is empty
+	ReasonEmptyVersion = "EmptyVersion"
+)
+
+func (c *Controller) initVersionFromConfigMaps() {
+	err := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().AddIndexers(cache.Indexers{
+		versionFromConfigMapIndex: versionFromConfigMapIndexFunc,
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add indexer", "index", versionFromConfigMapIndex)
+	}
+
+	_, err = c.kubeInformerFactory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForConfigMap(obj)
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldCm, ok := old.(*corev1.ConfigMap)
+			if !ok {
+				return
+			}
+			newCm, ok := new.(*corev1.ConfigMap)
+			if !ok || newCm.ResourceVersion == oldCm.ResourceVersion {
+				return
+			}
+			c.enqueueAzureKeyVaultSecretsForConfigMap(new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueAzureKeyVaultSecretsForConfigMap(obj)
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to add event handler")
+	}
+}
+
+func versionFromConfigMapIndexFunc(obj interface{}) ([]string, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return nil, nil
+	}
+
+	versionFrom := akvs.Spec.Vault.Object.VersionFrom
+	if versionFrom == nil || versionFrom.ConfigMapKeyRef == nil || versionFrom.ConfigMapKeyRef.Name == "" {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("%s/%s", akvs.Namespace, versionFrom.ConfigMapKeyRef.Name)}, nil
+}
+
+// enqueueAzureKeyVaultSecretsForConfigMap adds all azurekeyvaultsecrets reading
+// their object version from the configmap to the queue
+func (c *Controller) enqueueAzureKeyVaultSecretsForConfigMap(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	indexer := c.akvsInformerFactory.AzureKeyVault().V2beta1().AzureKeyVaultSecrets().Informer().GetIndexer()
+	referencing, err := indexer.ByIndex(versionFromConfigMapIndex, key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, akvs := range referencing {
+		klog.V(4).InfoS("configmap with object version changed - adding to queue", "configmap", key, "azurekeyvaultsecret", klog.KObj(akvs.(*akv.AzureKeyVaultSecret)))
+		queue.Enqueue(c.akvsCrdQueue.GetQueue(), akvs)
+	}
+}
+
+// resolveObjectVersion returns akvs with spec.vault.object.version set to the version
+// read from spec.vault.object.versionFrom, if specified, and the symbolic version
+// "previous" replaced by a concrete version. The VersionResolved condition is updated
+// to reflect the outcome.
+func (c *Controller) resolveObjectVersion(akvs *akv.AzureKeyVaultSecret) (*akv.AzureKeyVaultSecret, error) {
+	if akvs.Spec.Vault.Object.VersionFrom == nil {
+		return c.resolvePreviousVersion(akvs)
+	}
+
+	version, reason, err := c.lookupObjectVersion(akvs)
+	if err != nil {
+		if _, statusErr := c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeVersionResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: err.Error(),
+		}); statusErr != nil {
+			klog.ErrorS(statusErr, "failed to update status", "azurekeyvaultsecret", klog.KObj(akvs))
+		}
+		c.recorder.Event(akvs, corev1.EventTypeWarning, ErrVersionFrom, err.Error())
+		return nil, err
+	}
+
+	updated := akvs
+	if version != akv.AzureKeyVaultObjectVersionPrevious {
+		message := fmt.Sprintf("Using object version '%s'", version)
+		if version == "" {
+			message = "Optional object version not found, using latest version"
+		}
+
+		updated, err = c.setCondition(akvs, metav1.Condition{
+			Type:    ConditionTypeVersionResolved,
+			Status:  metav1.ConditionTrue,
+			Reason:  reason,
+			Message: message,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resolved := updated.DeepCopy()
+	resolved.Spec.Vault.Object.Version = version
+	klog.V(4).InfoS("resolved object version", "azurekeyvaultsecret", klog.KObj(akvs), "version", version)
+	return c.resolvePreviousVersion(resolved)
+}
+
+// lookupObjectVersion reads the object version from the configmap referenced by
+// spec.vault.object.versionFrom, returning the condition reason together with the version
+func (c *Controller) lookupObjectVersion(akvs *akv.AzureKeyVaultSecret) (string, string, error) {
+	object := akvs.Spec.Vault.Object
+	if object.Version != "" {
+		return "", ReasonInvalidVersionFrom, fmt.Errorf("spec.vault.object.version and spec.vault.object.versionFrom cannot both be set")
+	}
+
+	ref := object.VersionFrom.ConfigMapKeyRef
+	if ref == nil || ref.Name == "" || ref.Key == "" {
+		return "", ReasonInvalidVersionFrom, fmt.Errorf("spec.vault.object.versionFrom.configMapKeyRef must have both name and key")
+	}
+	optional := ref.Optional != nil && *ref.Optional
+
+	cm, err := c.configMapsLister.ConfigMaps(akvs.Namespace).Get(ref.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			if optional {
+				return "", ReasonVersionResolved, nil
+			}
+			return "", ReasonConfigMapNotFound, fmt.Errorf("configmap '%s' holding object version not found", ref.Name)
+		}
+		return "", ReasonConfigMapNotFound, fmt.Errorf("failed to get configmap '%s' holding object version, error: %+v", ref.Name, err)
+	}
+
+	value, ok := cm.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", ReasonVersionResolved, nil
+		}
+		return "", ReasonConfigMapKeyNotFound, fmt.Errorf("key '%s' holding object version not found in configmap '%s'", ref.Key, ref.Name)
+	}
+
+	version := strings.TrimSpace(value)
+	if version == "" {
+		return "", ReasonEmptyVersion, fmt.Errorf("key '%s' holding object version in configmap '%s' is empty", ref.Key, ref.Name)
+	}
+	return version, ReasonVersionResolved, nil
+}
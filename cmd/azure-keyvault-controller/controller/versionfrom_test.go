@@ -0,0 +1,136 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func controllerWithConfigMaps(t *testing.T, cms ...*corev1.ConfigMap) *Controller {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, cm := range cms {
+		if err := indexer.Add(cm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Controller{configMapsLister: corelisters.NewConfigMapLister(indexer)}
+}
+
+func secretWithVersionFrom(name, key string) *akv.AzureKeyVaultSecret {
+	akvs := secret()
+	akvs.Spec.Vault.Object.VersionFrom = &akv.AzureKeyVaultObjectVersionFrom{
+		ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Key:                  key,
+		},
+	}
+	return akvs
+}
+
+func versionConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "versions",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Data: data,
+	}
+}
+
+func TestLookupObjectVersion(t *testing.T) {
+	c := controllerWithConfigMaps(t, versionConfigMap(map[string]string{"some-secret": " abc123\n"}))
+
+	version, reason, err := c.lookupObjectVersion(secretWithVersionFrom("versions", "some-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "abc123" {
+		t.Errorf("expected version 'abc123', but got '%s'", version)
+	}
+	if reason != ReasonVersionResolved {
+		t.Errorf("expected reason '%s', but got '%s'", ReasonVersionResolved, reason)
+	}
+}
+
+func TestLookupObjectVersionFailures(t *testing.T) {
+	c := controllerWithConfigMaps(t, versionConfigMap(map[string]string{"empty": "  "}))
+
+	bothSet := secretWithVersionFrom("versions", "some-secret")
+	bothSet.Spec.Vault.Object.Version = "abc123"
+
+	tests := []struct {
+		akvs   *akv.AzureKeyVaultSecret
+		reason string
+	}{
+		{bothSet, ReasonInvalidVersionFrom},
+		{secretWithVersionFrom("versions", ""), ReasonInvalidVersionFrom},
+		{secretWithVersionFrom("missing", "some-secret"), ReasonConfigMapNotFound},
+		{secretWithVersionFrom("versions", "some-secret"), ReasonConfigMapKeyNotFound},
+		{secretWithVersionFrom("versions", "empty"), ReasonEmptyVersion},
+	}
+
+	for _, test := range tests {
+		_, reason, err := c.lookupObjectVersion(test.akvs)
+		if err == nil {
+			t.Errorf("expected error with reason '%s'", test.reason)
+			continue
+		}
+		if reason != test.reason {
+			t.Errorf("expected reason '%s', but got '%s'", test.reason, reason)
+		}
+	}
+}
+
+func TestLookupObjectVersionOptional(t *testing.T) {
+	c := controllerWithConfigMaps(t)
+
+	optional := true
+	akvs := secretWithVersionFrom("missing", "some-secret")
+	akvs.Spec.Vault.Object.VersionFrom.ConfigMapKeyRef.Optional = &optional
+
+	version, _, err := c.lookupObjectVersion(akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		t.Errorf("expected latest version, but got '%s'", version)
+	}
+}
+
+func TestVersionFromConfigMapIndex(t *testing.T) {
+	keys, err := versionFromConfigMapIndexFunc(secretWithVersionFrom("versions", "some-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "default/versions" {
+		t.Errorf("unexpected index keys %v", keys)
+	}
+
+	keys, err = versionFromConfigMapIndexFunc(secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no index keys, but got %v", keys)
+	}
+}
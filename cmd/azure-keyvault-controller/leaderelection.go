@@ -0,0 +1,135 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leaderTerm runs the controller while this replica is the leader. As leaderelection
+// starts OnStartedLeading in a goroutine, the term keeps track of whether it was
+// started, so the next term only begins once the controller has stopped.
+type leaderTerm struct {
+	mu        sync.Mutex
+	started   bool
+	abandoned bool
+	stopped   chan struct{}
+}
+
+func newLeaderTerm() *leaderTerm {
+	return &leaderTerm{stopped: make(chan struct{})}
+}
+
+// run runs fn until ctx is done, unless the term has already ended
+func (t *leaderTerm) run(ctx context.Context, fn func(stopCh <-chan struct{})) {
+	t.mu.Lock()
+	if t.abandoned {
+		t.mu.Unlock()
+		return
+	}
+	t.started = true
+	t.mu.Unlock()
+
+	defer close(t.stopped)
+	fn(ctx.Done())
+}
+
+// end waits for fn to stop if it was started, and prevents it from starting otherwise
+func (t *leaderTerm) end() {
+	t.mu.Lock()
+	started := t.started
+	t.abandoned = !started
+	t.mu.Unlock()
+
+	if started {
+		<-t.stopped
+	}
+}
+
+// runWithLeaderElection runs fn while this replica holds the lease name in namespace, until
+// stopCh is closed. When leadership is lost the stop channel given to fn is closed, and once
+// fn has returned this replica stands by to become leader again, calling fn anew.
+func runWithLeaderElection(stopCh <-chan struct{}, client kubernetes.Interface, recorder record.EventRecorder, namespace, name string, fn func(stopCh <-chan struct{})) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname for leader election identity: %w", err)
+	}
+	identity := hostname + "_" + string(uuid.NewUUID())
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Client:    client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      identity,
+			EventRecorder: recorder,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		term := newLeaderTerm()
+		klog.InfoS("waiting to become leader", "lease", klog.KRef(namespace, name), "identity", identity)
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			Name:            name,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					klog.InfoS("became leader, starting controller", "lease", klog.KRef(namespace, name), "identity", identity)
+					term.run(ctx, fn)
+				},
+				OnStoppedLeading: func() {
+					klog.InfoS("stopped leading", "lease", klog.KRef(namespace, name), "identity", identity)
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						klog.InfoS("standing by for leader", "lease", klog.KRef(namespace, name), "leader", leader)
+					}
+				},
+			},
+		})
+		term.end()
+	}
+	return nil
+}
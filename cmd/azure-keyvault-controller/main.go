@@ -20,14 +20,17 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/spf13/viper"
 
 	"github.com/gorilla/mux"
@@ -51,9 +54,11 @@ import (
 	azlog "github.com/Azure/azure-sdk-for-go/sdk/azcore/log"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/cmd/azure-keyvault-controller/controller"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/credentialprovider"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 	clientset "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/clientset/versioned"
 	informers "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/client/informers/externalversions"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/signals"
@@ -70,6 +75,43 @@ var (
 	watchAllNamespaces        bool
 	kubeResyncPeriod          int
 	azureKeyVaultResyncPeriod int
+	provenanceAnnotations     bool
+	defaultTransforms         string
+	certRelaxedPollInterval   int
+	certRenewalWindow         int
+	maxReportedPods           int
+	referencedByRefresh       int
+	maxReferencedBy           int
+	pollFairness              int
+	fairQueuing               bool
+	pollBatchWindow           int
+	immutableGracePeriod      int
+	disableAzurePolling       bool
+	credentialsReloadInterval int
+	vaultCredentialsFile      string
+	allowTakeover             bool
+	outputMode                string
+	exportDir                 string
+	exportDigestsOnly         bool
+	instanceID                string
+	claimTTL                  int
+	changeDetection           string
+	maxConcurrentAzure        int
+	azureRequestQPS           float64
+	crdWorkers                int
+	azureWorkers              int
+	requeueBaseDelay          time.Duration
+	requeueMaxDelay           time.Duration
+	enableLeaderElection      bool
+	leaderElectionNamespace   string
+	leaderElectionLeaseName   string
+	watchNamespaces           string
+	excludeNamespaces         string
+	akvsLabelSelector         string
+	azureFailureEventInterval time.Duration
+	metricsListenAddress      string
+	authMode                  string
+	azureEnvironment          string
 )
 
 func initConfig() {
@@ -91,6 +133,43 @@ func init() {
 	flag.BoolVar(&watchAllNamespaces, "watch-all-namespaces", true, "Watch for custom resources in all namespaces, if set to false it will only watch the runtime namespace.")
 	flag.IntVar(&kubeResyncPeriod, "kube-resync-period", 30, "Resync period for kubernetes changes, in seconds. Defaults to 30.")
 	flag.IntVar(&azureKeyVaultResyncPeriod, "azure-resync-period", 30, "Resync period for Azure Key Vault changes, in seconds. Defaults to 30.")
+	flag.BoolVar(&provenanceAnnotations, "provenance-annotations", true, "Annotate Secrets and ConfigMaps with the Azure Key Vault object and AzureKeyVaultSecret they were synced from. Set to false if vault names are considered sensitive.")
+	flag.StringVar(&defaultTransforms, "default-transforms", "", "Transforms to run for every AzureKeyVaultSecret of an object type, before its own transforms. Format is <object type>:<transform>[,<transform>...] separated by ';', like 'secret:chomp,trim'.")
+	flag.IntVar(&certRelaxedPollInterval, "certificate-relaxed-poll-interval", 3600, "How often to poll certificates far from their predicted renewal in Azure Key Vault, in seconds. Set to 0 to poll on every Azure resync. Defaults to 3600.")
+	flag.IntVar(&certRenewalWindow, "certificate-renewal-window", 3600, "How long before a predicted certificate renewal to poll on every Azure resync, in seconds. Defaults to 3600.")
+	flag.IntVar(&maxReportedPods, "max-reported-pods", 5, "Max number of pods to name in events and logs when a secret used by the pods is rotated. Set to 0 to not watch pods. Defaults to 5.")
+	flag.IntVar(&referencedByRefresh, "referenced-by-refresh-interval", 0, "How often to refresh status.referencedBy with Deployments, StatefulSets and DaemonSets consuming the output, in seconds. Requires watching pods and replicasets. Defaults to 0 (disabled).")
+	flag.IntVar(&maxReferencedBy, "max-referenced-by", 20, "Max number of workloads to list in status.referencedBy. Defaults to 20.")
+	flag.IntVar(&pollFairness, "poll-fairness", 10, "Max number of changed AzureKeyVaultSecrets to process in a row while a periodic poll of Azure Key Vault is waiting. Defaults to 10.")
+	flag.BoolVar(&fairQueuing, "fair-queuing", false, "Process AzureKeyVaultSecrets round-robin across namespaces, so namespaces with many AzureKeyVaultSecrets do not delay syncs in other namespaces.")
+	flag.IntVar(&pollBatchWindow, "poll-batch-window", 0, "Poll Azure Key Vault one vault at a time, polling all AzureKeyVaultSecrets of a vault together for up to this many seconds before moving on to the next vault. Polls are not round-robin across namespaces when set. Defaults to 0, polling in the order queued.")
+	flag.IntVar(&immutableGracePeriod, "immutable-revision-grace-period", 3600, "How long an immutable ConfigMap replaced by a newer revision is kept before it is deleted, in seconds. Defaults to 3600.")
+	flag.BoolVar(&disableAzurePolling, "disable-azure-polling", false, "Never poll Azure Key Vault for changes, only sync when an AzureKeyVaultSecret is created or changed. Set or change the annotation akv2k8s.io/force-sync to sync an AzureKeyVaultSecret.")
+	flag.IntVar(&credentialsReloadInterval, "credentials-reload-interval", 30, "How often to check the cloud config or certificate file used for Azure credentials for changes, in seconds, reloading credentials when changed. Set to 0 to disable. Defaults to 30.")
+	flag.BoolVar(&allowTakeover, "allow-takeover", false, "Allow AzureKeyVaultSecrets with conflictPolicy TakeOver to take over Secrets owned by other AzureKeyVaultSecrets, without the owner setting the annotation akv2k8s.io/allow-takeover.")
+	flag.StringVar(&vaultCredentialsFile, "vault-credentials-file", "", "Path to a YAML file mapping vault name patterns to service principals, for vaults not accessible using the default credentials. Reloaded when changed, see --credentials-reload-interval.")
+	flag.StringVar(&outputMode, "output-mode", "apply", "How outputs are written - apply, to create and update Secrets and ConfigMaps using the Kubernetes API, or git-export, to write their manifests into --export-dir for another process to commit to Git.")
+	flag.StringVar(&exportDir, "export-dir", "", "Directory to write manifests into with --output-mode=git-export, with one directory per namespace.")
+	flag.BoolVar(&exportDigestsOnly, "export-digests-only", false, "Write the SHA-256 digest of each value instead of the value itself in manifests written with --output-mode=git-export.")
+	flag.StringVar(&instanceID, "instance-id", "", "Identity of this controller installation when several run in one cluster. Each AzureKeyVaultSecret is claimed by one instance in status.claim, and other instances leave it alone until the claim expires. Defaults to empty, not claiming AzureKeyVaultSecrets.")
+	flag.StringVar(&changeDetection, "change-detection", "hash", "How polls detect changes in Azure Key Vault for AzureKeyVaultSecrets not setting spec.vault.object.changeDetection - hash, to download the object and compare the hash of its values, or version, to only download the object when its current version or updated time has changed. Defaults to hash.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "", "Comma-separated list of namespaces to sync AzureKeyVaultSecrets in. AzureKeyVaultSecrets in other namespaces are ignored. Defaults to empty, syncing all namespaces.")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "", "Comma-separated list of namespaces to never sync AzureKeyVaultSecrets in, even if listed in --watch-namespaces.")
+	flag.StringVar(&akvsLabelSelector, "akvs-label-selector", "", "Label selector for the AzureKeyVaultSecrets handled by this controller, like 'tier=platform', so several controllers with different identities can share a cluster. Defaults to empty, handling all AzureKeyVaultSecrets.")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Elect a leader among replicas of the controller using a Lease, so only the leader syncs AzureKeyVaultSecrets while the other replicas stand by.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "Namespace of the Lease used for leader election. Defaults to the runtime namespace of the controller.")
+	flag.StringVar(&leaderElectionLeaseName, "leader-election-lease-name", "akv2k8s-controller", "Name of the Lease used for leader election. Defaults to akv2k8s-controller.")
+	flag.IntVar(&crdWorkers, "crd-workers", 1, "Max number of changed or deleted AzureKeyVaultSecrets to sync at once. Increase on clusters with many AzureKeyVaultSecrets. Defaults to 1.")
+	flag.IntVar(&azureWorkers, "azure-workers", 1, "Max number of periodic polls of Azure Key Vault to run at once. Keep low to limit the load on Azure Key Vault. Defaults to 1.")
+	flag.DurationVar(&requeueBaseDelay, "requeue-base-delay", 5*time.Millisecond, "How long to wait before retrying a failed sync the first time, doubled for each following failure. Defaults to 5ms.")
+	flag.DurationVar(&requeueMaxDelay, "requeue-max-delay", 1000*time.Second, "Max time to wait before retrying a failed sync. Defaults to 1000s.")
+	flag.IntVar(&maxConcurrentAzure, "max-concurrent-azure-requests", 10, "Max number of requests to Azure Key Vault sent at once, shared by all workers. Set to 0 for no limit. Defaults to 10.")
+	flag.Float64Var(&azureRequestQPS, "azure-request-qps", 0, "Max number of requests per second to Azure Key Vault, shared by all workers, to smooth out bursts of polls. Set to 0 for no limit. Defaults to 0.")
+	flag.DurationVar(&azureFailureEventInterval, "azure-failure-event-interval", 10*time.Minute, "Min time between warning events for repeated failures to read an AzureKeyVaultSecret from Azure Key Vault. Set to 0 to record an event on every failure. Defaults to 10m.")
+	flag.IntVar(&claimTTL, "claim-ttl", 300, "How long a claim on an AzureKeyVaultSecret is valid without being renewed, in seconds, before another instance can take it over. Claims are renewed after half this time. Defaults to 300.")
+	flag.StringVar(&authMode, "auth-mode", "", "How to authenticate with Azure Key Vault - azureCloudConfig, environment, environment-azidentity or workload-identity, to exchange the projected service account token of Azure Workload Identity for an AAD token. Overrides the AUTH_TYPE environment variable. Defaults to AUTH_TYPE, or workload-identity if AUTH_TYPE is not set and AZURE_FEDERATED_TOKEN_FILE is.")
+	flag.StringVar(&azureEnvironment, "azure-environment", "", "Azure cloud of Azure Key Vault - AzurePublicCloud, AzureChinaCloud, AzureUSGovernmentCloud or AzureGermanCloud, setting the key vault DNS suffix and the AAD authority of azidentity based auth modes. AzureKeyVaultSecrets can override it using spec.vault.azureEnvironment. Defaults to the cloud of the credentials.")
+	flag.StringVar(&metricsListenAddress, "metrics-listen-address", ":8080", "Address of the server for Prometheus metrics at /metrics. Set to an address on the health port (HTTP_PORT, 9000 by default) to serve metrics there instead of starting a separate server, or to empty to not start it. Metrics are also served on the health port when METRICS_ENABLED is set. Defaults to :8080.")
 }
 
 func main() {
@@ -114,9 +193,91 @@ func main() {
 	akv2k8s.LogVersion()
 
 	authType := viper.GetString("auth_type")
+	switch {
+	case authMode != "":
+		authType = authMode
+	case os.Getenv("AUTH_TYPE") == "" && credentialprovider.IsWorkloadIdentityEnvironment():
+		klog.InfoS("detected azure workload identity environment", "tokenFile", os.Getenv(credentialprovider.FederatedTokenFileEnv))
+		authType = "workload-identity"
+	}
 	objectLabels := viper.GetString("object_labels")
 
-	createHttpServer()
+	parsedDefaultTransforms, err := transformers.ParseDefaultTransforms(defaultTransforms)
+	if err != nil {
+		klog.ErrorS(err, "invalid default transforms", "transforms", defaultTransforms)
+		os.Exit(1)
+	}
+	klog.InfoS("default transforms", "transforms", parsedDefaultTransforms)
+
+	switch outputMode {
+	case "apply":
+		exportDir = ""
+	case "git-export":
+		if exportDir == "" {
+			klog.ErrorS(nil, "--export-dir is required with --output-mode=git-export")
+			os.Exit(1)
+		}
+	default:
+		klog.ErrorS(nil, "invalid output mode, must be apply or git-export", "mode", outputMode)
+		os.Exit(1)
+	}
+
+	switch akv.AzureKeyVaultChangeDetection(changeDetection) {
+	case akv.AzureKeyVaultChangeDetectionHash, akv.AzureKeyVaultChangeDetectionVersion:
+	default:
+		klog.ErrorS(nil, "invalid change detection, must be hash or version", "changeDetection", changeDetection)
+		os.Exit(1)
+	}
+
+	var parsedAkvsLabelSelector labels.Selector
+	if akvsLabelSelector != "" {
+		if parsedAkvsLabelSelector, err = labels.Parse(akvsLabelSelector); err != nil {
+			klog.ErrorS(err, "invalid label selector", "selector", akvsLabelSelector)
+			os.Exit(1)
+		}
+		klog.InfoS("handling azurekeyvaultsecrets matching label selector", "selector", parsedAkvsLabelSelector.String())
+	}
+
+	if enableLeaderElection {
+		if leaderElectionNamespace == "" {
+			leaderElectionNamespace = os.Getenv("RUNTIME_NAMESPACE")
+		}
+		if leaderElectionNamespace == "" || leaderElectionLeaseName == "" {
+			klog.ErrorS(nil, "--leader-election-namespace, or the RUNTIME_NAMESPACE environment variable, and --leader-election-lease-name are required with --enable-leader-election")
+			os.Exit(1)
+		}
+	}
+
+	if crdWorkers < 1 || azureWorkers < 1 {
+		klog.ErrorS(nil, "--crd-workers and --azure-workers must be at least 1", "crdWorkers", crdWorkers, "azureWorkers", azureWorkers)
+		os.Exit(1)
+	}
+	if requeueBaseDelay <= 0 || requeueMaxDelay < requeueBaseDelay {
+		klog.ErrorS(nil, "--requeue-base-delay must be positive and not greater than --requeue-max-delay", "requeueBaseDelay", requeueBaseDelay, "requeueMaxDelay", requeueMaxDelay)
+		os.Exit(1)
+	}
+
+	if azureFailureEventInterval < 0 {
+		klog.ErrorS(nil, "--azure-failure-event-interval cannot be negative", "azureFailureEventInterval", azureFailureEventInterval)
+		os.Exit(1)
+	}
+
+	if maxConcurrentAzure < 0 || azureRequestQPS < 0 {
+		klog.ErrorS(nil, "--max-concurrent-azure-requests and --azure-request-qps cannot be negative", "maxConcurrentAzureRequests", maxConcurrentAzure, "azureRequestQPS", azureRequestQPS)
+		os.Exit(1)
+	}
+
+	var vaultCredentials *azure.MappedVaultCredentials
+	if vaultCredentialsFile != "" {
+		vaultCredentials, err = azure.LoadVaultCredentials(vaultCredentialsFile)
+		if err != nil {
+			klog.ErrorS(err, "invalid vault credentials config", "file", vaultCredentialsFile)
+			os.Exit(1)
+		}
+		klog.InfoS("vault credentials config loaded", "file", vaultCredentialsFile, "vaults", len(vaultCredentials.Config().Vaults))
+	}
+
+	createHttpServer(vaultCredentials)
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -146,6 +307,15 @@ func main() {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
 	}
 	kubeInformerOptions = append(kubeInformerOptions, kubeinformers.WithNamespace(watchNamespace))
+	watchNamespaceList := splitNamespaces(watchNamespaces)
+	excludeNamespaceList := splitNamespaces(excludeNamespaces)
+	var namespaceScope interface{} = "all"
+	if watchNamespace != "" {
+		namespaceScope = []string{watchNamespace}
+	} else if len(watchNamespaceList) > 0 {
+		namespaceScope = watchNamespaceList
+	}
+	klog.InfoS("effective namespace scope", "namespaces", namespaceScope, "excluded", excludeNamespaceList)
 	akvInformerOptions = append(akvInformerOptions, informers.WithNamespace(watchNamespace))
 	if objectLabels != "" {
 		objectLabelSet, err := labels.ConvertSelectorToLabelsMap(objectLabels)
@@ -163,72 +333,195 @@ func main() {
 			options.LabelSelector = labelSelectorAppender(options.LabelSelector, objectLabelSet)
 		}))
 	}
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*time.Duration(kubeResyncPeriod), kubeInformerOptions...)
-	azureKeyVaultSecretInformerFactory := informers.NewSharedInformerFactoryWithOptions(azureKeyVaultSecretClient, time.Second*time.Duration(azureKeyVaultResyncPeriod), akvInformerOptions...)
-
 	klog.InfoS("Creating event broadcaster")
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(klog.V(6).Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 
-	var token azcore.TokenCredential
-	var keyVaultDNSSuffix string
 	klog.Infof("use `%s` as authType", authType)
-	switch authType {
-	case "azureCloudConfig":
-		token, keyVaultDNSSuffix, err = getCredentialsFromCloudConfig(cloudconfig)
-		if err != nil {
-			klog.ErrorS(err, "failed to create cloud config provider for azure key vault", "file", cloudconfig)
-			os.Exit(1)
-		}
-	case "environment":
-		token, keyVaultDNSSuffix, err = getCredentialsFromEnvironment()
-		if err != nil {
-			klog.ErrorS(err, "failed to create credentials provider from environment for azure key vault")
-			os.Exit(1)
-		}
-	case "environment-azidentity":
+	if authType == "environment-azidentity" || authType == "workload-identity" {
 		logLevel, _ := strconv.Atoi(flag.Lookup("v").Value.String())
 		if logLevel >= 4 {
 			azlog.SetListener(func(cls azlog.Event, msg string) {
 				klog.Infof(msg)
 			})
 		}
-		token, keyVaultDNSSuffix, err = getCredentialsFromAzidentity()
+	}
+
+	var environment azure.Environment
+	if azureEnvironment != "" {
+		environment, err = azure.EnvironmentFromName(azureEnvironment)
 		if err != nil {
-			klog.ErrorS(err, "failed to create credentials provider from azidentity for azure key vault")
+			klog.ErrorS(err, "invalid azure environment", "environment", azureEnvironment)
 			os.Exit(1)
 		}
+		// azidentity reads the authority from the environment
+		if os.Getenv(credentialprovider.AuthorityHostEnv) == "" {
+			os.Setenv(credentialprovider.AuthorityHostEnv, environment.ActiveDirectoryAuthorityHost)
+		}
+		klog.InfoS("using azure environment", "environment", environment.Name, "keyVaultDNSSuffix", environment.KeyVaultDNSSuffix)
+	}
 
-	default:
-		klog.ErrorS(nil, "auth type not supported", "type", authType)
+	token, keyVaultDNSSuffix, err := getCredentials(authType)
+	if err != nil {
+		klog.ErrorS(err, "failed to create credentials for azure key vault", "authType", authType)
 		os.Exit(1)
 	}
+	if environment.KeyVaultDNSSuffix != "" {
+		keyVaultDNSSuffix = environment.KeyVaultDNSSuffix
+	}
 
-	vaultService := vault.NewService(token, keyVaultDNSSuffix)
+	credential := azure.NewReloadableTokenCredential(token)
+	if files := getCredentialFiles(authType); credentialsReloadInterval > 0 && len(files) > 0 {
+		watcher := &azure.CredentialFileWatcher{
+			Credential: credential,
+			Files:      files,
+			Interval:   time.Second * time.Duration(credentialsReloadInterval),
+			Load: func() (azure.LegacyTokenCredential, error) {
+				token, _, err := getCredentials(authType)
+				return token, err
+			},
+		}
+		go watcher.Run(stopCh)
+		klog.InfoS("watching credential files for changes", "files", files)
+	}
+
+	var vaultService vault.Service
+	if vaultCredentials != nil {
+		if credentialsReloadInterval > 0 {
+			go vaultCredentials.Watch(time.Second*time.Duration(credentialsReloadInterval), stopCh)
+		}
+		vaultService = vault.NewServiceWithVaultCredentials(credential, keyVaultDNSSuffix, vaultCredentials)
+	} else {
+		vaultService = vault.NewService(credential, keyVaultDNSSuffix)
+	}
 
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
 	options := &controller.Options{
-		MaxNumRequeues: 5,
-		NumThreads:     1,
+		MaxNumRequeues:                 5,
+		CRDWorkers:                     crdWorkers,
+		AzureWorkers:                   azureWorkers,
+		RequeueBaseDelay:               requeueBaseDelay,
+		RequeueMaxDelay:                requeueMaxDelay,
+		DisableProvenanceAnnotations:   !provenanceAnnotations,
+		DefaultTransforms:              parsedDefaultTransforms,
+		CertificateRelaxedPollInterval: time.Second * time.Duration(certRelaxedPollInterval),
+		CertificateRenewalWindow:       time.Second * time.Duration(certRenewalWindow),
+		MaxReportedPods:                maxReportedPods,
+		ReferencedByRefreshInterval:    time.Second * time.Duration(referencedByRefresh),
+		MaxReferencedBy:                maxReferencedBy,
+		PollFairness:                   pollFairness,
+		FairQueuing:                    fairQueuing,
+		PollBatchWindow:                time.Second * time.Duration(pollBatchWindow),
+		ImmutableRevisionGracePeriod:   time.Second * time.Duration(immutableGracePeriod),
+		DisableAzurePolling:            disableAzurePolling,
+		AzurePollInterval:              time.Second * time.Duration(azureKeyVaultResyncPeriod),
+		AllowTakeover:                  allowTakeover,
+		ExportDir:                      exportDir,
+		ExportDigestsOnly:              exportDigestsOnly,
+		InstanceID:                     instanceID,
+		ClaimTTL:                       time.Second * time.Duration(claimTTL),
+		ChangeDetection:                akv.AzureKeyVaultChangeDetection(changeDetection),
+		MaxConcurrentAzureRequests:     maxConcurrentAzure,
+		AzureRequestQPS:                azureRequestQPS,
+		WatchNamespaces:                watchNamespaceList,
+		ExcludeNamespaces:              excludeNamespaceList,
+		AkvsLabelSelector:              parsedAkvsLabelSelector,
+		AzureFailureEventInterval:      azureFailureEventInterval,
+		NewVaultService: func(credential azure.LegacyTokenCredential) vault.Service {
+			return vault.NewService(credential, keyVaultDNSSuffix)
+		},
+		AzureEnvironment: environment.Name,
+	}
+
+	// runController runs the controller with new informers until stopCh is closed, so
+	// each run starts with a full resync
+	runController := func(stopCh <-chan struct{}) {
+		kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*time.Duration(kubeResyncPeriod), kubeInformerOptions...)
+		azureKeyVaultSecretInformerFactory := informers.NewSharedInformerFactoryWithOptions(azureKeyVaultSecretClient, time.Second*time.Duration(azureKeyVaultResyncPeriod), akvInformerOptions...)
+
+		controller := controller.NewController(
+			kubeClient,
+			azureKeyVaultSecretClient,
+			azureKeyVaultSecretInformerFactory,
+			kubeInformerFactory,
+			recorder,
+			vaultService,
+			options)
+
+		controller.Run(stopCh)
+	}
+
+	metricsServer := createMetricsServer(metricsListenAddress)
+
+	if enableLeaderElection {
+		if err := runWithLeaderElection(stopCh, kubeClient, recorder, leaderElectionNamespace, leaderElectionLeaseName, runController); err != nil {
+			klog.ErrorS(err, "failed to run leader election", "lease", klog.KRef(leaderElectionNamespace, leaderElectionLeaseName))
+			os.Exit(1)
+		}
+	} else {
+		runController(stopCh)
 	}
 
-	controller := controller.NewController(
-		kubeClient,
-		azureKeyVaultSecretClient,
-		azureKeyVaultSecretInformerFactory,
-		kubeInformerFactory,
-		recorder,
-		vaultService,
-		options)
+	shutdownMetricsServer(metricsServer)
+}
+
+// splitNamespaces returns the namespaces in a comma-separated list
+func splitNamespaces(value string) []string {
+	var namespaces []string
+	for _, namespace := range strings.Split(value, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
 
-	controller.Run(stopCh)
+// isHealthPort tells if address is on httpPort, where the health server already listens
+func isHealthPort(address, httpPort string) bool {
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && port == httpPort
 }
 
-func createHttpServer() {
+// createMetricsServer serves Prometheus metrics at /metrics on address, returning nil if
+// address is empty or on the health port, which serves the metrics itself
+func createMetricsServer(address string) *http.Server {
+	if address == "" || isHealthPort(address, viper.GetString("http_port")) {
+		return nil
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: address, Handler: router}
+	klog.InfoS("serving metrics endpoint", "path", fmt.Sprintf("%s/metrics", address))
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "error serving metrics server", "address", address)
+			os.Exit(1)
+		}
+	}()
+	return server
+}
+
+// shutdownMetricsServer stops server, waiting a few seconds for scrapes in progress
+func shutdownMetricsServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		klog.ErrorS(err, "failed to shut down metrics server", "address", server.Addr)
+	}
+}
+
+func createHttpServer(vaultCredentials *azure.MappedVaultCredentials) {
 	httpPort := viper.GetString("http_port")
-	serveMetrics := viper.GetBool("metrics_enabled")
+	serveMetrics := viper.GetBool("metrics_enabled") || isHealthPort(metricsListenAddress, httpPort)
 
 	router := mux.NewRouter()
 	httpURL := fmt.Sprintf(":%s", httpPort)
@@ -241,6 +534,11 @@ func createHttpServer() {
 	router.HandleFunc("/healthz", healthHandler)
 	klog.InfoS("serving health endpoint", "path", fmt.Sprintf("%s/healthz", httpURL))
 
+	if vaultCredentials != nil {
+		router.HandleFunc("/debug/vault-credentials", vaultCredentialsHandler(vaultCredentials))
+		klog.InfoS("serving vault credentials debug endpoint", "path", fmt.Sprintf("%s/debug/vault-credentials", httpURL))
+	}
+
 	go func() {
 		err := http.ListenAndServe(httpURL, router)
 		if err != nil {
@@ -258,6 +556,55 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// vaultCredentialsHandler dumps the active vault credentials config, which only
+// references client secret files
+func vaultCredentialsHandler(vaultCredentials *azure.MappedVaultCredentials) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(vaultCredentials.Config()); err != nil {
+			klog.ErrorS(err, "failed to write vault credentials config")
+		}
+	}
+}
+
+func getCredentials(authType string) (azure.LegacyTokenCredential, string, error) {
+	switch authType {
+	case "azureCloudConfig":
+		return getCredentialsFromCloudConfig(cloudconfig)
+	case "environment":
+		return getCredentialsFromEnvironment()
+	case "environment-azidentity":
+		return getCredentialsFromAzidentity()
+	case "workload-identity":
+		return getCredentialsFromWorkloadIdentity()
+	default:
+		return nil, "", fmt.Errorf("auth type %s not supported", authType)
+	}
+}
+
+// getCredentialFiles returns the files credentials are read from, which are watched
+// for changes. Environment variables cannot change while running, so only files
+// referenced by them are watched.
+func getCredentialFiles(authType string) []string {
+	switch authType {
+	case "azureCloudConfig":
+		return []string{cloudconfig}
+	case "environment":
+		if certPath := os.Getenv("AZURE_CERTIFICATE_PATH"); certPath != "" {
+			return []string{certPath}
+		}
+	case "environment-azidentity":
+		if certPath := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"); certPath != "" {
+			return []string{certPath}
+		}
+	}
+	return nil
+}
+
 func getCredentialsFromCloudConfig(cloudconfig string) (azure.LegacyTokenCredential, string, error) {
 	f, err := os.Open(cloudconfig)
 	if err != nil {
@@ -304,3 +651,16 @@ func getCredentialsFromAzidentity() (azure.LegacyTokenCredential, string, error)
 
 	return token, provider.GetAzureKeyVaultDNSSuffix(), err
 }
+
+func getCredentialsFromWorkloadIdentity() (azure.LegacyTokenCredential, string, error) {
+	provider, err := credentialprovider.NewFromWorkloadIdentity()
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := provider.GetAzureKeyVaultCredentials()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return token, provider.GetAzureKeyVaultDNSSuffix(), nil
+}
@@ -100,9 +100,39 @@ func retry(attempts int, sleep time.Duration, fn func() error) error {
 	return nil
 }
 
+// resolvePreviousVersion returns azureKeyVaultSecret with the symbolic version "previous" replaced
+// by the version the controller recorded in status, or else by the newest enabled version before
+// the current version
+func resolvePreviousVersion(azureKeyVaultSecret *akv.AzureKeyVaultSecret, vaultService vault.Service) (*akv.AzureKeyVaultSecret, error) {
+	resolved := azureKeyVaultSecret.DeepCopy()
+	if previous := azureKeyVaultSecret.Status.PreviousVersion; previous != nil && previous.Version != "" {
+		resolved.Spec.Vault.Object.Version = previous.Version
+		return resolved, nil
+	}
+
+	versions, err := vaultService.GetObjectVersions(&azureKeyVaultSecret.Spec.Vault)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of object '%s', error: %+v", azureKeyVaultSecret.Spec.Vault.Object.Name, err)
+	}
+	previous, _, err := vault.PreviousVersion(versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve previous version of object '%s', error: %+v", azureKeyVaultSecret.Spec.Vault.Object.Name, err)
+	}
+	resolved.Spec.Vault.Object.Version = previous.Version
+	return resolved, nil
+}
+
 func getSecretFromKeyVault(azureKeyVaultSecret *akv.AzureKeyVaultSecret, query string, vaultService vault.Service) (string, error) {
 	var secretHandler EnvSecretHandler
 
+	if azureKeyVaultSecret.Spec.Vault.Object.Version == akv.AzureKeyVaultObjectVersionPrevious {
+		resolved, err := resolvePreviousVersion(azureKeyVaultSecret, vaultService)
+		if err != nil {
+			return "", err
+		}
+		azureKeyVaultSecret = resolved
+	}
+
 	switch azureKeyVaultSecret.Spec.Vault.Object.Type {
 	case akv.AzureKeyVaultObjectTypeSecret:
 		transformator, err := transformers.CreateTransformator(&azureKeyVaultSecret.Spec.Output)
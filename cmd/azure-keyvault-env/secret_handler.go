@@ -17,15 +17,15 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/charset"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/multikeyvalue"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 
-	yaml "gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -107,6 +107,10 @@ func (h *AzureKeyVaultSecretHandler) Handle() (string, error) {
 		return "", err
 	}
 
+	if secret, err = charset.Decode(secret, h.secretSpec.Spec.Vault.Object.Charset); err != nil {
+		return "", fmt.Errorf("failed to decode secret value as %s, error: %+v", h.secretSpec.Spec.Vault.Object.Charset, err)
+	}
+
 	secret, err = h.transformator.Transform(secret)
 	if err != nil {
 		return "", err
@@ -188,19 +192,13 @@ func (h *AzureKeyVaultMultiValueSecretHandler) Handle() (string, error) {
 		return "", err
 	}
 
-	var dat map[string]string
+	if secret, err = charset.Decode(secret, h.secretSpec.Spec.Vault.Object.Charset); err != nil {
+		return "", fmt.Errorf("failed to decode secret value as %s, error: %+v", h.secretSpec.Spec.Vault.Object.Charset, err)
+	}
 
-	switch h.secretSpec.Spec.Vault.Object.ContentType {
-	case akv.AzureKeyVaultObjectContentTypeJSON:
-		if err := json.Unmarshal([]byte(secret), &dat); err != nil {
-			return "", err
-		}
-	case akv.AzureKeyVaultObjectContentTypeYaml:
-		if err := yaml.Unmarshal([]byte(secret), &dat); err != nil {
-			return "", err
-		}
-	default:
-		return "", fmt.Errorf("content type '%s' not supported", h.secretSpec.Spec.Vault.Object.ContentType)
+	dat, err := multikeyvalue.Decode(secret, &h.secretSpec.Spec.Vault.Object)
+	if err != nil {
+		return "", err
 	}
 
 	if val, ok := dat[h.query]; ok {
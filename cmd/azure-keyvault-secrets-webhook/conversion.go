@@ -0,0 +1,274 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// sourceAnnotation holds the apiVersion, spec and status of an AzureKeyVaultSecret converted
+// to v1alpha1 from a version newer than v2alpha1, like the stored v2beta1, so fields v2alpha1
+// does not have survive a round trip through v1alpha1
+const sourceAnnotation = "akv2k8s.io/conversion-source"
+
+// conversionSource is stored as JSON in sourceAnnotation
+type conversionSource struct {
+	APIVersion string          `json:"apiVersion"`
+	Spec       json.RawMessage `json:"spec,omitempty"`
+	Status     json.RawMessage `json:"status,omitempty"`
+}
+
+// v1alpha1Fields are the paths of the fields v1alpha1 has, which are taken from the v1alpha1
+// object when restoring the source of a conversion, as they may have been changed through
+// v1alpha1. Their paths are the same in all newer versions.
+var v1alpha1Fields = [][]string{
+	{"spec", "vault", "name"},
+	{"spec", "vault", "object", "name"},
+	{"spec", "vault", "object", "type"},
+	{"spec", "vault", "object", "version"},
+	{"spec", "vault", "object", "contentType"},
+	{"spec", "output", "secret", "name"},
+	{"spec", "output", "secret", "type"},
+	{"spec", "output", "secret", "dataKey"},
+	{"spec", "output", "transform"},
+	{"status", "secretHash"},
+	{"status", "secretName"},
+	{"status", "lastAzureUpdate"},
+}
+
+// conversionReview is the apiextensions.k8s.io/v1 ConversionReview sent by the API server to
+// convert AzureKeyVaultSecrets between the versions of the CRD
+type conversionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *conversionRequest  `json:"request,omitempty"`
+	Response        *conversionResponse `json:"response,omitempty"`
+}
+
+type conversionRequest struct {
+	UID               types.UID              `json:"uid"`
+	DesiredAPIVersion string                 `json:"desiredAPIVersion"`
+	Objects           []runtime.RawExtension `json:"objects"`
+}
+
+type conversionResponse struct {
+	UID              types.UID              `json:"uid"`
+	ConvertedObjects []runtime.RawExtension `json:"convertedObjects"`
+	Result           metav1.Status          `json:"result"`
+}
+
+// conversionHandler converts AzureKeyVaultSecrets in a ConversionReview to the desired version
+func conversionHandler(w http.ResponseWriter, r *http.Request) {
+	var review conversionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "invalid conversion review", http.StatusBadRequest)
+		return
+	}
+
+	response := &conversionResponse{UID: review.Request.UID, Result: metav1.Status{Status: metav1.StatusSuccess}}
+	for _, obj := range review.Request.Objects {
+		converted, err := convertAzureKeyVaultSecret(obj.Raw, review.Request.DesiredAPIVersion)
+		if err != nil {
+			klog.ErrorS(err, "failed to convert azurekeyvaultsecret", "desiredAPIVersion", review.Request.DesiredAPIVersion)
+			response = &conversionResponse{UID: review.Request.UID, Result: metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}}
+			break
+		}
+		response.ConvertedObjects = append(response.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+
+	review.Request, review.Response = nil, response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.ErrorS(err, "failed to write conversion review")
+	}
+}
+
+// convertAzureKeyVaultSecret converts the AzureKeyVaultSecret raw to desiredAPIVersion.
+// Conversions to and from v1alpha1 go through v2alpha1, using the conversion functions of
+// v1alpha1. The other versions only add fields, so converting between them changes the
+// apiVersion alone.
+func convertAzureKeyVaultSecret(raw []byte, desiredAPIVersion string) ([]byte, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return nil, err
+	}
+	for _, apiVersion := range []string{typeMeta.APIVersion, desiredAPIVersion} {
+		if gv, err := schema.ParseGroupVersion(apiVersion); err != nil || gv.Group != azurekeyvault.GroupName {
+			return nil, fmt.Errorf("unsupported apiVersion '%s'", apiVersion)
+		}
+	}
+
+	switch {
+	case typeMeta.APIVersion == desiredAPIVersion:
+		return raw, nil
+
+	case typeMeta.APIVersion == v1alpha1.SchemeGroupVersion.String():
+		var src v1alpha1.AzureKeyVaultSecret
+		if err := json.Unmarshal(raw, &src); err != nil {
+			return nil, err
+		}
+		source, hasSource := src.Annotations[sourceAnnotation]
+		delete(src.Annotations, sourceAnnotation)
+
+		var hub v2alpha1.AzureKeyVaultSecret
+		if err := v1alpha1.ConvertToV2alpha1(&src, &hub); err != nil {
+			return nil, err
+		}
+		converted, err := json.Marshal(&hub)
+		if err != nil {
+			return nil, err
+		}
+		if hasSource {
+			return restoreSource(converted, source, desiredAPIVersion)
+		}
+		return setAPIVersion(converted, desiredAPIVersion)
+
+	case desiredAPIVersion == v1alpha1.SchemeGroupVersion.String():
+		hubRaw, err := setAPIVersion(raw, v2alpha1.SchemeGroupVersion.String())
+		if err != nil {
+			return nil, err
+		}
+		var hub v2alpha1.AzureKeyVaultSecret
+		if err := json.Unmarshal(hubRaw, &hub); err != nil {
+			return nil, err
+		}
+		var dst v1alpha1.AzureKeyVaultSecret
+		if err := v1alpha1.ConvertFromV2alpha1(&hub, &dst); err != nil {
+			return nil, err
+		}
+		if typeMeta.APIVersion != v2alpha1.SchemeGroupVersion.String() {
+			if err := storeSource(raw, typeMeta.APIVersion, &dst); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(&dst)
+
+	default:
+		return setAPIVersion(raw, desiredAPIVersion)
+	}
+}
+
+// setAPIVersion returns the object raw with apiVersion, leaving all other fields as they are
+func setAPIVersion(raw []byte, apiVersion string) ([]byte, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	obj["apiVersion"] = apiVersion
+	return json.Marshal(obj)
+}
+
+// storeSource stores the spec and status of raw, being an AzureKeyVaultSecret of apiVersion, in
+// sourceAnnotation of dst. It replaces v1alpha1.ConversionDataAnnotation, which only holds the
+// fields of v2alpha1.
+func storeSource(raw []byte, apiVersion string, dst *v1alpha1.AzureKeyVaultSecret) error {
+	var obj struct {
+		Spec   json.RawMessage `json:"spec,omitempty"`
+		Status json.RawMessage `json:"status,omitempty"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return err
+	}
+	value, err := json.Marshal(conversionSource{APIVersion: apiVersion, Spec: obj.Spec, Status: obj.Status})
+	if err != nil {
+		return fmt.Errorf("failed to store %s fields in annotation %s, error: %+v", apiVersion, sourceAnnotation, err)
+	}
+
+	delete(dst.Annotations, v1alpha1.ConversionDataAnnotation)
+	if dst.Annotations == nil {
+		dst.Annotations = make(map[string]string)
+	}
+	dst.Annotations[sourceAnnotation] = string(value)
+	return nil
+}
+
+// restoreSource returns the AzureKeyVaultSecret of apiVersion with the spec and status stored
+// in source, and the metadata and the v1alpha1Fields of hub, being the v2alpha1 conversion of
+// the v1alpha1 object
+func restoreSource(hub []byte, source, apiVersion string) ([]byte, error) {
+	var data conversionSource
+	if err := json.Unmarshal([]byte(source), &data); err != nil {
+		return nil, fmt.Errorf("failed to restore fields from annotation %s, error: %+v", sourceAnnotation, err)
+	}
+	var converted map[string]interface{}
+	if err := json.Unmarshal(hub, &converted); err != nil {
+		return nil, err
+	}
+
+	obj := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       converted["kind"],
+		"metadata":   converted["metadata"],
+	}
+	for field, value := range map[string]json.RawMessage{"spec": data.Spec, "status": data.Status} {
+		if len(value) == 0 {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil, fmt.Errorf("failed to restore %s from annotation %s, error: %+v", field, sourceAnnotation, err)
+		}
+		obj[field] = fields
+	}
+
+	for _, path := range v1alpha1Fields {
+		copyField(converted, obj, path)
+	}
+	return json.Marshal(obj)
+}
+
+// copyField sets the field at path in dst to its value in src, or removes it from dst when
+// src has no value at path
+func copyField(src, dst map[string]interface{}, path []string) {
+	var value interface{} = src
+	for _, key := range path {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			value = nil
+			break
+		}
+		value = fields[key]
+	}
+
+	parent := dst
+	for _, key := range path[:len(path)-1] {
+		fields, ok := parent[key].(map[string]interface{})
+		if !ok {
+			if value == nil {
+				return
+			}
+			fields = make(map[string]interface{})
+			parent[key] = fields
+		}
+		parent = fields
+	}
+	if value == nil {
+		delete(parent, path[len(path)-1])
+		return
+	}
+	parent[path[len(path)-1]] = value
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v1alpha1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2alpha1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestConversionHandler(t *testing.T) {
+	obj, err := json.Marshal(&v1alpha1.AzureKeyVaultSecret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "AzureKeyVaultSecret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Spec: v1alpha1.AzureKeyVaultSecretSpec{
+			Vault:  v1alpha1.AzureKeyVault{Name: "my-vault", Object: v1alpha1.AzureKeyVaultObject{Name: "db-password", Type: v1alpha1.AzureKeyVaultObjectTypeSecret}},
+			Output: v1alpha1.AzureKeyVaultOutput{Secret: v1alpha1.AzureKeyVaultOutputSecret{Name: "db", DataKey: "password"}, Transforms: []string{"trim"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&conversionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apiextensions.k8s.io/v1", Kind: "ConversionReview"},
+		Request:  &conversionRequest{UID: "uid", DesiredAPIVersion: v2beta1.SchemeGroupVersion.String(), Objects: []runtime.RawExtension{{Raw: obj}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	conversionHandler(recorder, httptest.NewRequest(http.MethodPost, "/convert", bytes.NewReader(body)))
+
+	var review conversionReview
+	if err := json.NewDecoder(recorder.Body).Decode(&review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || review.Response.UID != "uid" || review.Response.Result.Status != metav1.StatusSuccess || len(review.Response.ConvertedObjects) != 1 {
+		t.Fatalf("expected one converted object, but got %+v", review.Response)
+	}
+	var converted v2beta1.AzureKeyVaultSecret
+	if err := json.Unmarshal(review.Response.ConvertedObjects[0].Raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted.APIVersion != v2beta1.SchemeGroupVersion.String() || converted.Spec.Output.Secret.DataKey != "password" || len(converted.Spec.Output.Transform) != 1 {
+		t.Errorf("expected v1alpha1 fields to be converted through v2alpha1, but got %+v", converted)
+	}
+}
+
+func TestConvertToV1alpha1(t *testing.T) {
+	obj, err := json.Marshal(&v2alpha1.AzureKeyVaultSecret{
+		TypeMeta: metav1.TypeMeta{APIVersion: v2alpha1.SchemeGroupVersion.String(), Kind: "AzureKeyVaultSecret"},
+		Spec: v2alpha1.AzureKeyVaultSecretSpec{
+			Vault:  v2alpha1.AzureKeyVault{Name: "my-vault", Object: v2alpha1.AzureKeyVaultObject{Name: "db-password", Type: v2alpha1.AzureKeyVaultObjectTypeSecret}},
+			Output: v2alpha1.AzureKeyVaultOutput{ConfigMap: v2alpha1.AzureKeyVaultOutputConfigMap{Name: "db", DataKey: "password"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := convertAzureKeyVaultSecret(obj, v1alpha1.SchemeGroupVersion.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var converted v1alpha1.AzureKeyVaultSecret
+	if err := json.Unmarshal(raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := converted.Annotations[v1alpha1.ConversionDataAnnotation]; !ok || converted.APIVersion != v1alpha1.SchemeGroupVersion.String() {
+		t.Errorf("expected v1alpha1 object preserving the configmap output, but got %+v", converted)
+	}
+
+	if _, err := convertAzureKeyVaultSecret(obj, "apps/v1"); err == nil {
+		t.Error("expected conversion to another group to fail")
+	}
+}
+
+func TestConvertV2beta1RoundTripThroughV1alpha1(t *testing.T) {
+	obj, err := json.Marshal(&v2beta1.AzureKeyVaultSecret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v2beta1.SchemeGroupVersion.String(), Kind: "AzureKeyVaultSecret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Spec: v2beta1.AzureKeyVaultSecretSpec{
+			Vault: v2beta1.AzureKeyVault{
+				Name:    "my-vault",
+				Object:  v2beta1.AzureKeyVaultObject{Name: "db-password", Type: v2beta1.AzureKeyVaultObjectTypeSecret},
+				Objects: []v2beta1.AzureKeyVaultObjectReference{{Name: "db-user", Type: v2beta1.AzureKeyVaultObjectTypeSecret, DataKey: "user"}},
+			},
+			Output: v2beta1.AzureKeyVaultOutput{Secret: v2beta1.AzureKeyVaultOutputSecret{Name: "db", DataKey: "password", DataKeyCase: v2beta1.AzureKeyVaultDataKeyCaseUpper}},
+		},
+		Status: v2beta1.AzureKeyVaultSecretStatus{SecretName: "db", SecretKeys: []string{"password", "user"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := convertAzureKeyVaultSecret(obj, v1alpha1.SchemeGroupVersion.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old v1alpha1.AzureKeyVaultSecret
+	if err := json.Unmarshal(raw, &old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := old.Annotations[sourceAnnotation]; !ok {
+		t.Fatalf("expected the v2beta1 spec to be stored in annotation %s, but got %v", sourceAnnotation, old.Annotations)
+	}
+	old.Spec.Output.Secret.DataKey = "pass"
+	old.Spec.Vault.Object.Version = "v2"
+	if raw, err = json.Marshal(&old); err != nil {
+		t.Fatal(err)
+	}
+
+	if raw, err = convertAzureKeyVaultSecret(raw, v2beta1.SchemeGroupVersion.String()); err != nil {
+		t.Fatal(err)
+	}
+	var converted v2beta1.AzureKeyVaultSecret
+	if err := json.Unmarshal(raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := converted.Annotations[sourceAnnotation]; ok {
+		t.Error("expected the annotation to be removed")
+	}
+	if len(converted.Spec.Vault.Objects) != 1 || converted.Spec.Vault.Objects[0].DataKey != "user" || converted.Spec.Output.Secret.DataKeyCase != v2beta1.AzureKeyVaultDataKeyCaseUpper || len(converted.Status.SecretKeys) != 2 {
+		t.Errorf("expected v2beta1 fields to survive the round trip, but got %+v", converted)
+	}
+	if converted.Spec.Output.Secret.DataKey != "pass" || converted.Spec.Vault.Object.Version != "v2" {
+		t.Errorf("expected fields changed through v1alpha1 to be kept, but got %+v", converted.Spec)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/credentialprovider"
 	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/docker/registry"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -42,6 +43,7 @@ import (
 	"github.com/slok/kubewebhook/pkg/observability/metrics"
 	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	"github.com/slok/kubewebhook/pkg/webhook/mutating"
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
 	"github.com/spf13/viper"
 	logConfig "k8s.io/component-base/logs/api/v1"
 	jsonlogs "k8s.io/component-base/logs/json"
@@ -414,6 +416,8 @@ func createTLSEndpoint(wg *sync.WaitGroup, port, tlsCertFile, tlsKeyFile string)
 	metricsRecorder := metrics.NewPrometheus(prometheus.DefaultRegisterer)
 	internalLogger := &internalLog.Std{Debug: config.klogLevel >= 4}
 	podHandler := handlerFor(mutating.WebhookConfig{Name: "azurekeyvault-secrets-pods", Obj: &corev1.Pod{}}, mutator, metricsRecorder, internalLogger)
+	akvsDefaultsHandler := handlerFor(mutating.WebhookConfig{Name: "azurekeyvault-secrets-azurekeyvaultsecrets-defaults", Obj: &akv.AzureKeyVaultSecret{}}, mutating.MutatorFunc(azureKeyVaultSecretDefaulter), metricsRecorder, internalLogger)
+	akvsHandler := validatingHandlerFor(validating.WebhookConfig{Name: "azurekeyvault-secrets-azurekeyvaultsecrets", Obj: &akv.AzureKeyVaultSecret{}}, validating.ValidatorFunc(azureKeyVaultSecretValidator), metricsRecorder, internalLogger)
 
 	router := mux.NewRouter()
 	tlsURL := fmt.Sprintf(":%s", port)
@@ -421,6 +425,15 @@ func createTLSEndpoint(wg *sync.WaitGroup, port, tlsCertFile, tlsKeyFile string)
 	router.Handle("/pods", podHandler)
 	klog.InfoS("serving encrypted webhook endpoint", "path", fmt.Sprintf("%s/pods", tlsURL))
 
+	router.Handle("/azurekeyvaultsecrets", akvsHandler)
+	klog.InfoS("serving encrypted webhook endpoint", "path", fmt.Sprintf("%s/azurekeyvaultsecrets", tlsURL))
+
+	router.Handle("/azurekeyvaultsecrets/defaults", akvsDefaultsHandler)
+	klog.InfoS("serving encrypted webhook endpoint", "path", fmt.Sprintf("%s/azurekeyvaultsecrets/defaults", tlsURL))
+
+	router.HandleFunc("/convert", conversionHandler)
+	klog.InfoS("serving encrypted conversion endpoint", "path", fmt.Sprintf("%s/convert", tlsURL))
+
 	router.HandleFunc("/healthz", healthHandler)
 	klog.InfoS("serving encrypted healthz endpoint", "path", fmt.Sprintf("%s/healthz", tlsURL))
 
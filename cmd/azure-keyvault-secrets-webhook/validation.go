@@ -0,0 +1,80 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1/validation"
+	whhttp "github.com/slok/kubewebhook/pkg/http"
+	internalLog "github.com/slok/kubewebhook/pkg/log"
+	"github.com/slok/kubewebhook/pkg/observability/metrics"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	"github.com/slok/kubewebhook/pkg/webhook/validating"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// azureKeyVaultSecretValidator rejects AzureKeyVaultSecrets with a spec the controller can
+// never sync, with a message naming each offending field
+func azureKeyVaultSecretValidator(ctx context.Context, obj metav1.Object) (bool, validating.ValidatorResult, error) {
+	if req := whcontext.GetAdmissionRequest(ctx); req != nil && req.Operation == admissionv1beta1.Delete {
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return false, validating.ValidatorResult{Valid: true}, nil
+	}
+
+	if errs := validation.ValidateAzureKeyVaultSecret(akvs); len(errs) > 0 {
+		klog.InfoS("rejecting invalid azurekeyvaultsecret", "azurekeyvaultsecret", klog.KObj(akvs), "errors", errs.ToAggregate().Error())
+		return true, validating.ValidatorResult{Valid: false, Message: errs.ToAggregate().Error()}, nil
+	}
+	return false, validating.ValidatorResult{Valid: true}, nil
+}
+
+// azureKeyVaultSecretDefaulter sets defaults for the output fields of AzureKeyVaultSecrets,
+// before they are validated
+func azureKeyVaultSecretDefaulter(_ context.Context, obj metav1.Object) (bool, error) {
+	akvs, ok := obj.(*akv.AzureKeyVaultSecret)
+	if !ok {
+		return false, nil
+	}
+	akv.SetAzureKeyVaultSecretDefaults(akvs)
+	return false, nil
+}
+
+func validatingHandlerFor(config validating.WebhookConfig, validator validating.ValidatorFunc, recorder metrics.Recorder, logger internalLog.Logger) http.Handler {
+	webhook, err := validating.NewWebhook(config, validator, nil, recorder, logger)
+	if err != nil {
+		klog.ErrorS(err, "error creating webhook")
+		os.Exit(1)
+	}
+
+	handler, err := whhttp.HandlerFor(webhook)
+	if err != nil {
+		klog.ErrorS(err, "error creating webhook")
+		os.Exit(1)
+	}
+
+	return handler
+}
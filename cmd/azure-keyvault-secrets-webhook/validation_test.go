@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAzureKeyVaultSecretValidator(t *testing.T) {
+	akvs := &akv.AzureKeyVaultSecret{
+		Spec: akv.AzureKeyVaultSecretSpec{
+			Vault: akv.AzureKeyVault{
+				Name:   "my-vault",
+				Object: akv.AzureKeyVaultObject{Name: "my-secret", Type: akv.AzureKeyVaultObjectTypeSecret},
+			},
+			Output: akv.AzureKeyVaultOutput{
+				Secret: akv.AzureKeyVaultOutputSecret{Name: "My_Secret"},
+			},
+		},
+	}
+
+	ctx := whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Operation: admissionv1beta1.Create})
+	_, result, err := azureKeyVaultSecretValidator(ctx, akvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || !strings.Contains(result.Message, "spec.output.secret.name") || !strings.Contains(result.Message, "spec.output.secret.dataKey") {
+		t.Errorf("expected invalid name and missing data key to be rejected, but got %+v", result)
+	}
+
+	ctx = whcontext.SetAdmissionRequest(context.Background(), &admissionv1beta1.AdmissionRequest{Operation: admissionv1beta1.Delete})
+	if _, result, _ = azureKeyVaultSecretValidator(ctx, akvs); !result.Valid {
+		t.Errorf("expected delete to be allowed, but got %+v", result)
+	}
+
+	akvs.Spec.Output.Secret = akv.AzureKeyVaultOutputSecret{Name: "my-secret", DataKey: "password"}
+	if _, result, _ = azureKeyVaultSecretValidator(context.Background(), akvs); !result.Valid {
+		t.Errorf("expected valid spec to be allowed, but got %+v", result)
+	}
+}
+
+func TestAzureKeyVaultSecretDefaulter(t *testing.T) {
+	akvs := &akv.AzureKeyVaultSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db"},
+		Spec: akv.AzureKeyVaultSecretSpec{
+			Vault: akv.AzureKeyVault{
+				Name:   "my-vault",
+				Object: akv.AzureKeyVaultObject{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret},
+			},
+			Output: akv.AzureKeyVaultOutput{Transform: []string{"trim"}, Secret: akv.AzureKeyVaultOutputSecret{DisableDefaultTransforms: true}},
+		},
+	}
+
+	if _, err := azureKeyVaultSecretDefaulter(context.Background(), akvs); err != nil {
+		t.Fatal(err)
+	}
+	if secret := akvs.Spec.Output.Secret; secret.Name != "db" || secret.DataKey != "db-password" {
+		t.Errorf("expected secret output db with data key db-password, but got %+v", secret)
+	}
+	if _, result, _ := azureKeyVaultSecretValidator(context.Background(), akvs); !result.Valid {
+		t.Errorf("expected defaulted spec to be valid, but got %+v", result)
+	}
+}
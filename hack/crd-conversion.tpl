@@ -0,0 +1,48 @@
+{{/*
+Conversion of AzureKeyVaultSecrets between the versions of the CRD by the /convert endpoint of
+the env-injector webhook. The shipped CRD in crds/AzureKeyVaultSecret.yaml has no conversion,
+which is strategy None. The azure-key-vault-env-injector chart includes these templates in the
+AzureKeyVaultSecret CRD it renders, and only while it deploys the webhook, because the API
+server cannot serve AzureKeyVaultSecrets if the conversion webhook is not there.
+
+Include with the root context and the PEM encoded CA of the webhook certificate:
+
+  metadata:
+    annotations:
+      {{- include "akv2k8s.crdConversionAnnotations" (dict "root" . ) | nindent 4 }}
+  spec:
+    {{- include "akv2k8s.crdConversion" (dict "root" . "caBundle" $ca.Cert) | nindent 2 }}
+
+If the certificate is issued by cert-manager, the caBundle is injected by cert-manager from the
+certificate of the webhook instead.
+*/}}
+
+{{- define "akv2k8s.crdConversionAnnotations" -}}
+{{- $root := .root -}}
+{{- if and $root.Values.crdConversion.enabled $root.Values.webhook.certificate.useCertManager }}
+cert-manager.io/inject-ca-from: {{ $root.Release.Namespace }}/{{ include "azure-key-vault-env-injector.fullname" $root }}
+{{- end }}
+{{- end -}}
+
+{{- define "akv2k8s.crdConversion" -}}
+{{- $root := .root -}}
+{{- if $root.Values.crdConversion.enabled }}
+conversion:
+  strategy: Webhook
+  webhook:
+    clientConfig:
+      service:
+        name: {{ include "azure-key-vault-env-injector.fullname" $root }}
+        namespace: {{ $root.Release.Namespace }}
+        path: /convert
+        port: {{ $root.Values.service.externalTlsPort }}
+      {{- if not $root.Values.webhook.certificate.useCertManager }}
+      caBundle: {{ required "the CA of the webhook certificate is required for crd conversion" .caBundle | b64enc }}
+      {{- end }}
+    conversionReviewVersions:
+    - v1
+{{- else }}
+conversion:
+  strategy: None
+{{- end }}
+{{- end -}}
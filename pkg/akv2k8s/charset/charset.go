@@ -0,0 +1,107 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package charset transcodes Azure Key Vault secret values to UTF-8
+package charset
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+const (
+	utf8BOM    = "\xef\xbb\xbf"
+	utf16LEBOM = "\xff\xfe"
+	utf16BEBOM = "\xfe\xff"
+)
+
+// Decode returns the bytes of secret, encoded using charset, as UTF-8 without byte order mark.
+// An empty charset returns secret as it is. Invalid sequences fail instead of being replaced
+// by the Unicode replacement character.
+func Decode(secret string, charset akv.AzureKeyVaultCharset) (string, error) {
+	switch charset {
+	case "":
+		return secret, nil
+	case akv.AzureKeyVaultCharsetUTF8:
+		return decodeUTF8(secret)
+	case akv.AzureKeyVaultCharsetUTF16LE:
+		return decodeUTF16(secret, charset, utf16LEBOM, utf16BEBOM, func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 })
+	case akv.AzureKeyVaultCharsetUTF16BE:
+		return decodeUTF16(secret, charset, utf16BEBOM, utf16LEBOM, func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) })
+	case akv.AzureKeyVaultCharsetLatin1:
+		return decodeLatin1(secret), nil
+	}
+	return "", fmt.Errorf("unsupported charset '%s'", charset)
+}
+
+func decodeUTF8(secret string) (string, error) {
+	secret = strings.TrimPrefix(secret, utf8BOM)
+	for i := 0; i < len(secret); {
+		r, size := utf8.DecodeRuneInString(secret[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return "", fmt.Errorf("invalid utf-8 sequence at byte %d", i)
+		}
+		i += size
+	}
+	return secret, nil
+}
+
+// decodeUTF16 decodes secret as UTF-16 code units read by unit, removing a byte order mark
+// matching bom and failing on one for the other byte order
+func decodeUTF16(secret string, charset akv.AzureKeyVaultCharset, bom, otherBOM string, unit func([]byte) uint16) (string, error) {
+	data := []byte(secret)
+	offset := 0
+	if strings.HasPrefix(secret, bom) {
+		offset = len(bom)
+	} else if strings.HasPrefix(secret, otherBOM) {
+		return "", fmt.Errorf("byte order mark does not match %s", charset)
+	}
+	if (len(data)-offset)%2 != 0 {
+		return "", fmt.Errorf("invalid %s value, length of %d bytes is not a multiple of 2", charset, len(data)-offset)
+	}
+
+	var decoded strings.Builder
+	for i := offset; i < len(data); i += 2 {
+		u := unit(data[i:])
+		if !utf16.IsSurrogate(rune(u)) {
+			decoded.WriteRune(rune(u))
+			continue
+		}
+		if u >= 0xdc00 || i+4 > len(data) {
+			return "", fmt.Errorf("invalid %s sequence at byte %d, unpaired surrogate", charset, i)
+		}
+		r := utf16.DecodeRune(rune(u), rune(unit(data[i+2:])))
+		if r == utf8.RuneError {
+			return "", fmt.Errorf("invalid %s sequence at byte %d, unpaired surrogate", charset, i)
+		}
+		decoded.WriteRune(r)
+		i += 2
+	}
+	return decoded.String(), nil
+}
+
+// decodeLatin1 maps each byte of secret to the Unicode code point with the same value
+func decodeLatin1(secret string) string {
+	var decoded strings.Builder
+	for i := 0; i < len(secret); i++ {
+		decoded.WriteRune(rune(secret[i]))
+	}
+	return decoded.String()
+}
@@ -0,0 +1,83 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package charset
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		charset  akv.AzureKeyVaultCharset
+		secret   string
+		expected string
+	}{
+		{"not set passes through", "", "\xff\xfeBl\xe5", "\xff\xfeBl\xe5"},
+		{"utf-8", akv.AzureKeyVaultCharsetUTF8, "Bl\xc3\xa5b\xc3\xa6r \xe2\x82\xac", "Blåbær €"},
+		{"utf-8 with bom", akv.AzureKeyVaultCharsetUTF8, "\xef\xbb\xbfBl\xc3\xa5b\xc3\xa6r", "Blåbær"},
+		{"utf-16le with bom", akv.AzureKeyVaultCharsetUTF16LE, "\xff\xfeB\x00l\x00\xe5\x00b\x00\xe6\x00r\x00 \x00\xac\x20", "Blåbær €"},
+		{"utf-16le without bom", akv.AzureKeyVaultCharsetUTF16LE, "B\x00l\x00\xe5\x00", "Blå"},
+		{"utf-16le surrogate pair", akv.AzureKeyVaultCharsetUTF16LE, "k\x00\x3d\xd8\x11\xdd", "k🔑"},
+		{"utf-16be with bom", akv.AzureKeyVaultCharsetUTF16BE, "\xfe\xff\x00B\x00l\x00\xe5\x00b\x00\xe6\x00r\x00 \x20\xac", "Blåbær €"},
+		{"utf-16be surrogate pair", akv.AzureKeyVaultCharsetUTF16BE, "\x00k\xd8\x3d\xdd\x11", "k🔑"},
+		{"utf-16 empty", akv.AzureKeyVaultCharsetUTF16LE, "\xff\xfe", ""},
+		{"latin1", akv.AzureKeyVaultCharsetLatin1, "Bl\xe5b\xe6r \xa3", "Blåbær £"},
+		{"latin1 ascii", akv.AzureKeyVaultCharsetLatin1, "user:password", "user:password"},
+	}
+
+	for _, test := range tests {
+		decoded, err := Decode(test.secret, test.charset)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if decoded != test.expected {
+			t.Errorf("%s: expected '%s', but got '%s'", test.name, test.expected, decoded)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		charset  akv.AzureKeyVaultCharset
+		secret   string
+		expected string
+	}{
+		{"invalid utf-8", akv.AzureKeyVaultCharsetUTF8, "Bl\xe5", "invalid utf-8 sequence at byte 2"},
+		{"odd length utf-16", akv.AzureKeyVaultCharsetUTF16LE, "\xff\xfeB\x00l", "invalid utf-16le value, length of 3 bytes is not a multiple of 2"},
+		{"unpaired high surrogate", akv.AzureKeyVaultCharsetUTF16LE, "\x3d\xd8k\x00", "invalid utf-16le sequence at byte 0, unpaired surrogate"},
+		{"truncated surrogate pair", akv.AzureKeyVaultCharsetUTF16BE, "\x00k\xd8\x3d", "invalid utf-16be sequence at byte 2, unpaired surrogate"},
+		{"unpaired low surrogate", akv.AzureKeyVaultCharsetUTF16BE, "\xdd\x11", "invalid utf-16be sequence at byte 0, unpaired surrogate"},
+		{"wrong byte order mark", akv.AzureKeyVaultCharsetUTF16BE, "\xff\xfeB\x00", "byte order mark does not match utf-16be"},
+		{"unsupported charset", akv.AzureKeyVaultCharset("ebcdic"), "value", "unsupported charset 'ebcdic'"},
+	}
+
+	for _, test := range tests {
+		_, err := Decode(test.secret, test.charset)
+		if err == nil {
+			t.Errorf("%s: expected error '%s'", test.name, test.expected)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("%s: expected error '%s', but got '%s'", test.name, test.expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	jksMagic           = 0xfeedfeed
+	jksVersion         = 2
+	jksPrivateKeyEntry = 1
+
+	// jksIntegritySalt is mixed into the digest of the keystore by Java
+	jksIntegritySalt = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector is the proprietary algorithm Java protects JKS private keys with
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// EncodeJKS returns entry as a Java KeyStore protected by password, used both for the private
+// key and the integrity of the keystore. The entry is created at the start of the validity of
+// the leaf certificate.
+func EncodeJKS(entry Entry, password string) ([]byte, error) {
+	keyDer, err := entry.privateKeyInfo(password)
+	if err != nil {
+		return nil, err
+	}
+	alias := entry.alias()
+	if len(alias) > 0xffff {
+		return nil, fmt.Errorf("keystore alias is longer than %d bytes", 0xffff)
+	}
+
+	protectedKey, err := protectJKSKey(keyDer, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		// writes to a bytes.Buffer do not fail
+		_ = binary.Write(&buf, binary.BigEndian, v)
+	}
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(1))
+
+	write(uint32(jksPrivateKeyEntry))
+	writeUTF(alias)
+	write(entry.Certificates[0].NotBefore.UnixMilli())
+	write(uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+	write(uint32(len(entry.Certificates)))
+	for _, cert := range entry.Certificates {
+		writeUTF("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	digest := sha1.New()
+	digest.Write(utf16BE(password))
+	digest.Write([]byte(jksIntegritySalt))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// protectJKSKey encrypts keyDer the way Java protects JKS private keys, by xor with a key stream
+// of chained SHA-1 digests of the password and a salt, followed by a SHA-1 checksum
+func protectJKSKey(keyDer []byte, password string) ([]byte, error) {
+	pass := utf16BE(password)
+	salt := deriveSalt(password, "jks key", sha1.Size, keyDer)
+
+	protected := append([]byte{}, salt...)
+	digest := salt
+	for offset := 0; offset < len(keyDer); offset += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, pass...), digest...))
+		digest = sum[:]
+		for i := 0; i < sha1.Size && offset+i < len(keyDer); i++ {
+			protected = append(protected, keyDer[offset+i]^digest[i])
+		}
+	}
+	checksum := sha1.Sum(append(append([]byte{}, pass...), keyDer...))
+	protected = append(protected, checksum[:]...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+}
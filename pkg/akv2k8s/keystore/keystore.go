@@ -0,0 +1,91 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package keystore writes a private key and its certificate chain as a password protected
+// PKCS#12 or JKS keystore, as read by Java applications.
+//
+// Salts are derived from the password and the entry instead of being random, and the JKS
+// creation date is the start of the leaf certificate validity, so encoding the same entry with
+// the same password always gives the same bytes. This lets the controller tell whether the
+// keystore changed by its hash, like any other value.
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Entry is a private key with its certificate chain, written to a keystore under alias
+type Entry struct {
+	Alias        string
+	PrivateKey   crypto.PrivateKey
+	Certificates []*x509.Certificate
+}
+
+// privateKeyInfo validates entry and password, returning the private key as pkcs#8 der
+func (entry Entry) privateKeyInfo(password string) ([]byte, error) {
+	if password == "" {
+		return nil, fmt.Errorf("keystore password cannot be empty")
+	}
+	if entry.Alias == "" {
+		return nil, fmt.Errorf("keystore alias cannot be empty")
+	}
+	if len(entry.Certificates) == 0 {
+		return nil, fmt.Errorf("keystore entry '%s' has no certificate", entry.Alias)
+	}
+
+	switch entry.PrivateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, fmt.Errorf("private key of type %T currently not supported in keystores", entry.PrivateKey)
+	}
+	return x509.MarshalPKCS8PrivateKey(entry.PrivateKey)
+}
+
+// alias returns the alias in lower case, as JKS keystores match aliases case-insensitively
+// and Java lower cases them when loading
+func (entry Entry) alias() string {
+	return strings.ToLower(entry.Alias)
+}
+
+// deriveSalt returns a salt of size bytes for purpose, taking the place of a random salt so the
+// keystore only changes with the password and entry
+func deriveSalt(password, purpose string, size int, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(purpose))
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)[:size]
+}
+
+// utf16BE returns password as big-endian UTF-16, being how both PKCS#12 and JKS turn
+// passwords into bytes
+func utf16BE(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
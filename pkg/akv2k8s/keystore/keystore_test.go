@@ -0,0 +1,329 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// testEntry returns an entry with a leaf issued by a self-signed root
+func testEntry(t *testing.T, key crypto.Signer) Entry {
+	t.Helper()
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDer, err := x509.CreateCertificate(rand.Reader, root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err = x509.ParseCertificate(rootDer); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "app.example.com"},
+		NotBefore:    notBefore.Add(time.Hour),
+		NotAfter:     notBefore.AddDate(1, 0, 0),
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leaf, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err = x509.ParseCertificate(leafDer); err != nil {
+		t.Fatal(err)
+	}
+	return Entry{Alias: "My-Cert", PrivateKey: key, Certificates: []*x509.Certificate{leaf, root}}
+}
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey}
+}
+
+func TestEncodePkcs12(t *testing.T) {
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			entry := testEntry(t, key)
+			pfx, err := EncodePkcs12(entry, "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blocks, err := pkcs12.ToPEM(pfx, "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 3 {
+				t.Fatalf("expected the leaf, root and private key, but got %d blocks", len(blocks))
+			}
+			for i, cert := range entry.Certificates {
+				if !bytes.Equal(blocks[i].Bytes, cert.Raw) {
+					t.Errorf("expected certificate %d to be '%s'", i, cert.Subject.CommonName)
+				}
+			}
+			if blocks[0].Headers["friendlyName"] != "my-cert" {
+				t.Errorf("expected leaf with friendlyName my-cert, but got %v", blocks[0].Headers)
+			}
+			if blocks[0].Headers["localKeyId"] == "" || blocks[0].Headers["localKeyId"] != blocks[2].Headers["localKeyId"] {
+				t.Errorf("expected leaf and private key to share localKeyId, but got %v and %v", blocks[0].Headers, blocks[2].Headers)
+			}
+			// ToPEM writes rsa keys as pkcs#1 and ec keys as sec1
+			var expectedKey []byte
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				expectedKey = x509.MarshalPKCS1PrivateKey(key)
+			case *ecdsa.PrivateKey:
+				expectedKey, _ = x509.MarshalECPrivateKey(key)
+			}
+			if !bytes.Equal(blocks[2].Bytes, expectedKey) {
+				t.Error("expected the private key to be decrypted")
+			}
+
+			if _, err = pkcs12.ToPEM(pfx, "wrong"); err == nil {
+				t.Error("expected reading the keystore with the wrong password to fail")
+			}
+		})
+	}
+}
+
+func TestEncodePkcs12WithoutChain(t *testing.T) {
+	key := testKeys(t)["rsa"]
+	entry := testEntry(t, key)
+	entry.Certificates = entry.Certificates[:1]
+
+	pfx, err := EncodePkcs12(entry, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, cert, err := pkcs12.Decode(pfx, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(entry.Certificates[0]) {
+		t.Error("expected the leaf certificate")
+	}
+	if !key.(*rsa.PrivateKey).Equal(privateKey) {
+		t.Error("expected the private key")
+	}
+}
+
+func TestEncodeIsDeterministic(t *testing.T) {
+	entry := testEntry(t, testKeys(t)["ecdsa"])
+
+	for name, encode := range map[string]func(Entry, string) ([]byte, error){"pkcs12": EncodePkcs12, "jks": EncodeJKS} {
+		t.Run(name, func(t *testing.T) {
+			first, err := encode(entry, "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := encode(entry, "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(first, second) {
+				t.Error("expected the same keystore when encoding the same entry twice")
+			}
+
+			changed, err := encode(entry, "n3w-s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(first, changed) {
+				t.Error("expected a different keystore when the password changes")
+			}
+		})
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	for name, key := range testKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			entry := testEntry(t, key)
+			jks, err := EncodeJKS(entry, "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			alias, created, keyDer, certs := readJKS(t, jks, "s3cret")
+			if alias != "my-cert" {
+				t.Errorf("expected alias my-cert, but got '%s'", alias)
+			}
+			if !created.Equal(entry.Certificates[0].NotBefore) {
+				t.Errorf("expected entry created at %v, but got %v", entry.Certificates[0].NotBefore, created)
+			}
+			expectedKey, _ := x509.MarshalPKCS8PrivateKey(key)
+			if !bytes.Equal(keyDer, expectedKey) {
+				t.Error("expected the private key to be recovered with the password")
+			}
+			if len(certs) != 2 || !bytes.Equal(certs[0], entry.Certificates[0].Raw) || !bytes.Equal(certs[1], entry.Certificates[1].Raw) {
+				t.Error("expected the leaf and root certificate in order")
+			}
+		})
+	}
+}
+
+func TestEncodeInvalidEntry(t *testing.T) {
+	valid := testEntry(t, testKeys(t)["ecdsa"])
+
+	tests := []struct {
+		name     string
+		entry    Entry
+		password string
+		err      string
+	}{
+		{name: "empty password", entry: valid, err: "password cannot be empty"},
+		{name: "no alias", entry: Entry{PrivateKey: valid.PrivateKey, Certificates: valid.Certificates}, password: "s3cret", err: "alias cannot be empty"},
+		{name: "no certificate", entry: Entry{Alias: "app", PrivateKey: valid.PrivateKey}, password: "s3cret", err: "has no certificate"},
+		{name: "unsupported key", entry: Entry{Alias: "app", PrivateKey: "key", Certificates: valid.Certificates}, password: "s3cret", err: "not supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, encode := range []func(Entry, string) ([]byte, error){EncodePkcs12, EncodeJKS} {
+				if _, err := encode(tt.entry, tt.password); err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error containing '%s', but got %v", tt.err, err)
+				}
+			}
+		})
+	}
+}
+
+// readJKS reads the single private key entry of a JKS keystore, checking its integrity and
+// recovering the private key the way Java does
+func readJKS(t *testing.T, jks []byte, password string) (string, time.Time, []byte, [][]byte) {
+	t.Helper()
+
+	data, stored := jks[:len(jks)-sha1.Size], jks[len(jks)-sha1.Size:]
+	digest := sha1.New()
+	digest.Write(utf16BE(password))
+	digest.Write([]byte(jksIntegritySalt))
+	digest.Write(data)
+	if !bytes.Equal(digest.Sum(nil), stored) {
+		t.Fatal("keystore integrity check failed")
+	}
+
+	r := bytes.NewReader(data)
+	read := func(v interface{}) {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := r.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	readUTF := func() string {
+		var n uint16
+		read(&n)
+		return string(readBytes(int(n)))
+	}
+
+	var magic, version, count, tag, keyLen, certCount uint32
+	var created int64
+	read(&magic)
+	read(&version)
+	read(&count)
+	if magic != jksMagic || version != jksVersion || count != 1 {
+		t.Fatalf("expected a version 2 JKS keystore with one entry, but got magic %x, version %d and %d entries", magic, version, count)
+	}
+	read(&tag)
+	if tag != jksPrivateKeyEntry {
+		t.Fatalf("expected a private key entry, but got tag %d", tag)
+	}
+	alias := readUTF()
+	read(&created)
+	read(&keyLen)
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(readBytes(int(keyLen)), &info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidJKSKeyProtector) {
+		t.Fatalf("expected the key protected by %v, but got %v", oidJKSKeyProtector, info.Algorithm.Algorithm)
+	}
+	protected := info.EncryptedData
+	salt, encrypted, checksum := protected[:sha1.Size], protected[sha1.Size:len(protected)-sha1.Size], protected[len(protected)-sha1.Size:]
+	pass := utf16BE(password)
+	keyDer := make([]byte, len(encrypted))
+	stream := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, pass...), stream...))
+		stream = sum[:]
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			keyDer[offset+i] = encrypted[offset+i] ^ stream[i]
+		}
+	}
+	if sum := sha1.Sum(append(append([]byte{}, pass...), keyDer...)); !reflect.DeepEqual(sum[:], checksum) {
+		t.Fatal("private key checksum does not match")
+	}
+
+	read(&certCount)
+	var certs [][]byte
+	for i := uint32(0); i < certCount; i++ {
+		if certType := readUTF(); certType != "X.509" {
+			t.Fatalf("expected certificate type X.509, but got '%s'", certType)
+		}
+		var certLen uint32
+		read(&certLen)
+		certs = append(certs, readBytes(int(certLen)))
+	}
+	if r.Len() != 0 {
+		t.Errorf("expected no data after the entry, but got %d bytes", r.Len())
+	}
+	return alias, time.UnixMilli(created).UTC(), keyDer, certs
+}
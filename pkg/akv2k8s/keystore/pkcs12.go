@@ -0,0 +1,286 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+)
+
+// pkcs12Iterations is the iteration count of the key derivation, being the OpenSSL default
+const pkcs12Iterations = 2048
+
+var (
+	oidDataContentType            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPbeWithSHAAnd3KeyTripleDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPkcs8ShroudedKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidFriendlyName               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidCertTypeX509Certificate    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidSHA1                       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data asn1.RawValue
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// EncodePkcs12 returns entry as a PKCS#12 keystore protected by password. The private key is
+// encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the keystore has a SHA-1 MAC, being the
+// algorithms read by all Java versions and OpenSSL. The certificates are not encrypted.
+func EncodePkcs12(entry Entry, password string) ([]byte, error) {
+	keyDer, err := entry.privateKeyInfo(password)
+	if err != nil {
+		return nil, err
+	}
+
+	// pairs the private key with its certificate, by the sha-1 thumbprint of the leaf
+	localKeyID := sha1.Sum(entry.Certificates[0].Raw)
+	attributes, err := pkcs12Attributes(entry.alias(), localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := make([]safeBag, 0, len(entry.Certificates))
+	for i, cert := range entry.Certificates {
+		octets, err := asn1.Marshal(cert.Raw)
+		if err != nil {
+			return nil, err
+		}
+		bag, err := asn1.Marshal(certBag{ID: oidCertTypeX509Certificate, Data: explicit(octets)})
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, safeBag{ID: oidCertBag, Value: explicit(bag)})
+		if i == 0 {
+			certBags[0].Attributes = attributes
+		}
+	}
+
+	encryptedKey, err := encryptPkcs8ShroudedKey(keyDer, password)
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{ID: oidPkcs8ShroudedKeyBag, Value: explicit(encryptedKey), Attributes: attributes}}
+
+	var safes []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		safe, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, safe)
+	}
+	authenticatedSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := deriveSalt(password, "pkcs12 mac", 8, authenticatedSafe)
+	macKey := pbkdf(3, 20, macSalt, pkcs12Iterations, password)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+
+	authSafe, err := asn1.Marshal(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPdu{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidDataContentType,
+			Content:     explicit(authSafe),
+		},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// pkcs12Attributes returns the friendlyName and localKeyId bag attributes
+func pkcs12Attributes(alias string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	friendlyName := asn1.RawValue{Tag: asn1.TagBMPString, Bytes: utf16BE(alias)}
+	friendlyNameDer, err := asn1.Marshal(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+	localKeyIDDer, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: set(friendlyNameDer)},
+		{ID: oidLocalKeyID, Value: set(localKeyIDDer)},
+	}, nil
+}
+
+// encryptPkcs8ShroudedKey returns keyDer as an EncryptedPrivateKeyInfo using
+// pbeWithSHAAnd3-KeyTripleDES-CBC
+func encryptPkcs8ShroudedKey(keyDer []byte, password string) ([]byte, error) {
+	salt := deriveSalt(password, "pkcs12 key", 8, keyDer)
+	key := pbkdf(1, 24, salt, pkcs12Iterations, password)
+	iv := pbkdf(2, 8, salt, pkcs12Iterations, password)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(keyDer)%block.BlockSize()
+	encrypted := append(append([]byte{}, keyDer...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPbeWithSHAAnd3KeyTripleDES,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+}
+
+// dataContentInfo returns bags as SafeContents in a data ContentInfo
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicit(octets)}, nil
+}
+
+// explicit returns der wrapped in an explicit [0] tag, as encoding/asn1 ignores the tag options
+// of RawValue fields when marshaling
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// set returns der as the only value of a SET
+func set(der []byte) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+}
+
+// pbkdf derives size bytes of key material for id from password and salt, as described in
+// RFC 7292 appendix B.2 using SHA-1. Id 1 gives encryption keys, 2 initialization vectors and
+// 3 MAC keys.
+func pbkdf(id byte, size int, salt []byte, iterations int, password string) []byte {
+	const u, v = sha1.Size, 64
+
+	// the password is a null terminated BMPString
+	pass := append(utf16BE(password), 0, 0)
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt, v), fill(pass, v)...)
+
+	one := big.NewInt(1)
+	modulus := new(big.Int).Lsh(one, v*8)
+
+	var out []byte
+	for len(out) < size {
+		a := sha1.Sum(append(append([]byte{}, d...), i...))
+		for n := 1; n < iterations; n++ {
+			a = sha1.Sum(a[:])
+		}
+		out = append(out, a[:]...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v-byte block of I, B being A repeated to v bytes
+		b := new(big.Int).SetBytes(fill(a[:u], v))
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			block.Add(block, b).Mod(block, modulus)
+			sum := block.Bytes()
+			copy(i[j:j+v], make([]byte, v-len(sum)))
+			copy(i[j+v-len(sum):j+v], sum)
+		}
+	}
+	return out[:size]
+}
+
+// fill repeats data to the smallest multiple of v bytes holding it
+func fill(data []byte, v int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	size := v * ((len(data) + v - 1) / v)
+	out := make([]byte, 0, size)
+	for len(out) < size {
+		out = append(out, data...)
+	}
+	return out[:size]
+}
@@ -0,0 +1,121 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multikeyvalue
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envKeyRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// decodeEnv decodes a dotenv document of KEY=value lines, optionally prefixed by export,
+// with blank lines and # comments. Single quoted values are written as is and double quoted
+// values expand \n, \r, \t, \" and \\, both may span several lines. Unquoted values end at
+// a # preceded by whitespace. Variables like ${OTHER} are not expanded. Errors never include
+// values, as they are secret.
+func decodeEnv(secret string) (map[string]string, error) {
+	values := make(map[string]string)
+	firstLines := make(map[string]int)
+	lines := strings.Split(strings.ReplaceAll(secret, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			line = strings.TrimSpace(rest)
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=value", number)
+		}
+		key = strings.TrimSpace(key)
+		if !envKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key '%s', must start with a letter or _ followed by letters, digits, _, . or -", number, key)
+		}
+
+		var value string
+		raw = strings.TrimLeft(raw, " \t")
+		if raw != "" && (raw[0] == '"' || raw[0] == '\'') {
+			quote := raw[0]
+			content := raw[1:]
+			for {
+				end := closingQuote(content, quote)
+				if end >= 0 {
+					if after := strings.TrimSpace(content[end+1:]); after != "" && after[0] != '#' {
+						return nil, fmt.Errorf("line %d: unexpected characters after the quoted value of key '%s'", i+1, key)
+					}
+					content = content[:end]
+					break
+				}
+				if i+1 == len(lines) {
+					return nil, fmt.Errorf("line %d: value of key '%s' has no closing quote", number, key)
+				}
+				i++
+				content += "\n" + lines[i]
+			}
+			value = content
+			if quote == '"' {
+				value = unescapeEnv(content)
+			}
+		} else {
+			value = stripEnvComment(raw)
+		}
+
+		if first, exists := firstLines[key]; exists {
+			return nil, fmt.Errorf("line %d: key '%s' is set more than once, first on line %d", number, key, first)
+		}
+		firstLines[key] = number
+		values[key] = value
+	}
+	return values, nil
+}
+
+// closingQuote returns the index of the quote ending s, skipping quotes escaped by a backslash
+// in double quoted values, or -1 if not found
+func closingQuote(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeEnv(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+// stripEnvComment removes a comment starting with # after whitespace from an unquoted value
+func stripEnvComment(value string) string {
+	for i := 1; i < len(value); i++ {
+		if value[i] == '#' && (value[i-1] == ' ' || value[i-1] == '\t') {
+			value = value[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package multikeyvalue decodes Azure Key Vault secrets of type multi-key-value-secret
+package multikeyvalue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+// maxExponent is the largest exponent of a JSON number that is expanded into an integer,
+// to not write huge numbers from a short value like 1e1000000
+const maxExponent = 1000
+
+// defaultKeyDelimiter separates a key and the index of an array element when arrays
+// are written as indexed keys
+const defaultKeyDelimiter = "_"
+
+// Decode returns the key/values in secret, read from object in Azure Key Vault.
+//
+// JSON values that are not strings are written as strings using these rules. Changing
+// them rewrites every Secret and ConfigMap derived from such values, so they must stay
+// the same:
+//
+//   - true and false are written as true and false
+//   - integers are written as in the JSON, never through float64, so large integers keep
+//     their precision
+//   - other numbers with an integer value are written as integers, without fraction or
+//     exponent: 1.0 as 1, 1e3 as 1000 and 2.5E+1 as 25
+//   - all other numbers are written as in the JSON: 0.1 as 0.1 and 1.5e-3 as 1.5e-3
+//   - null is written as an empty string, or the key is left out when nullValues is Skip
+//   - arrays fail unless arrayValues is set. Indexed writes element i of key to
+//     key<keyDelimiter>i, recursing into nested arrays. JSON writes the array to key as
+//     compact JSON, with object keys sorted, no HTML escaping and numbers written as above.
+//   - objects are not supported, except inside arrays written as JSON
+//
+// YAML values are written as they appear in the YAML.
+const defaultNestedKeySeparator = "."
+
+// Decode decodes the keys and values of a multi-key-value secret in the content type of
+// object. Errors name the content type the secret was parsed as.
+func Decode(secret string, object *akv.AzureKeyVaultObject) (map[string]string, error) {
+	var values map[string]string
+	var err error
+	switch object.ContentType {
+	case akv.AzureKeyVaultObjectContentTypeJSON:
+		values, err = decodeJSON(secret, object)
+	case akv.AzureKeyVaultObjectContentTypeYaml:
+		values, err = decodeYAML(secret, object)
+	case akv.AzureKeyVaultObjectContentTypeProperties:
+		values, err = decodeProperties(secret)
+	case akv.AzureKeyVaultObjectContentTypeEnv:
+		values, err = decodeEnv(secret)
+	default:
+		return nil, fmt.Errorf("content type '%s' not supported", object.ContentType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse multi-key-value secret as %s, error: %+v", object.ContentType, err)
+	}
+	return values, nil
+}
+
+// ContentTypeFromAttribute returns the content type matching the content type attribute of a
+// secret in Azure Key Vault, like application/json or text/yaml, and false if not supported
+func ContentTypeFromAttribute(attribute string) (akv.AzureKeyVaultObjectContentType, bool) {
+	mediaType, _, _ := strings.Cut(attribute, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/json", "application/x-json", "text/json":
+		return akv.AzureKeyVaultObjectContentTypeJSON, true
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return akv.AzureKeyVaultObjectContentTypeYaml, true
+	case "text/x-java-properties", "text/x-properties":
+		return akv.AzureKeyVaultObjectContentTypeProperties, true
+	case "text/x-env", "text/x-dotenv", "application/x-env":
+		return akv.AzureKeyVaultObjectContentTypeEnv, true
+	default:
+		return "", false
+	}
+}
+
+// jsonValues collects the key/values of a JSON multi-key-value secret
+type jsonValues struct {
+	object *akv.AzureKeyVaultObject
+	values map[string]string
+}
+
+func decodeJSON(secret string, object *akv.AzureKeyVaultObject) (map[string]string, error) {
+	decoder := json.NewDecoder(strings.NewReader(secret))
+	decoder.UseNumber()
+
+	var dat map[string]interface{}
+	if err := decoder.Decode(&dat); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid json, unexpected data after top-level object")
+	}
+
+	j := &jsonValues{object: object, values: make(map[string]string, len(dat))}
+	for key, value := range dat {
+		if err := j.add(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return j.values, nil
+}
+
+func (j *jsonValues) add(key string, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return j.set(key, v)
+	case bool:
+		return j.set(key, strconv.FormatBool(v))
+	case json.Number:
+		return j.set(key, formatNumber(v))
+	case nil:
+		if j.object.NullValues == akv.AzureKeyVaultNullValuesSkip {
+			return nil
+		}
+		return j.set(key, "")
+	case []interface{}:
+		return j.addArray(key, v)
+	case map[string]interface{}:
+		return fmt.Errorf("value of key '%s' is a json object, only strings, numbers, booleans, null and arrays are supported", key)
+	default:
+		return fmt.Errorf("value of key '%s' has unsupported type %T", key, value)
+	}
+}
+
+func (j *jsonValues) addArray(key string, array []interface{}) error {
+	switch j.object.ArrayValues {
+	case akv.AzureKeyVaultArrayValuesIndexed:
+		delimiter := j.object.KeyDelimiter
+		if delimiter == "" {
+			delimiter = defaultKeyDelimiter
+		}
+		for i, element := range array {
+			if err := j.add(key+delimiter+strconv.Itoa(i), element); err != nil {
+				return err
+			}
+		}
+		return nil
+	case akv.AzureKeyVaultArrayValuesJSON:
+		value, err := canonicalJSON(array)
+		if err != nil {
+			return fmt.Errorf("failed to write array of key '%s' as json, error: %+v", key, err)
+		}
+		return j.set(key, value)
+	default:
+		return fmt.Errorf("value of key '%s' is a json array, set arrayValues to Indexed or JSON to write arrays", key)
+	}
+}
+
+// set writes value to key, failing if an indexed key and a key in the JSON are the same
+func (j *jsonValues) set(key, value string) error {
+	if _, ok := j.values[key]; ok {
+		return fmt.Errorf("key '%s' is written more than once, as an array element and a key in the json", key)
+	}
+	j.values[key] = value
+	return nil
+}
+
+// canonicalJSON writes value as compact JSON, see Decode
+func canonicalJSON(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(normalizeNumbers(value)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// normalizeNumbers formats all numbers in value like top-level numbers
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		return json.Number(formatNumber(v))
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, element := range v {
+			normalized[i] = normalizeNumbers(element)
+		}
+		return normalized
+	case map[string]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for k, element := range v {
+			normalized[k] = normalizeNumbers(element)
+		}
+		return normalized
+	default:
+		return value
+	}
+}
+
+// formatNumber writes number without going through float64, see Decode
+func formatNumber(number json.Number) string {
+	s := number.String()
+	if !strings.ContainsAny(s, ".eE") {
+		return s
+	}
+
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exponent, err := strconv.Atoi(s[i+1:])
+		if err != nil || exponent > maxExponent || exponent < -maxExponent {
+			return s
+		}
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || !r.IsInt() {
+		return s
+	}
+	return r.Num().String()
+}
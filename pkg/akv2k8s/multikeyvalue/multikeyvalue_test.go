@@ -0,0 +1,380 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multikeyvalue
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+var jsonObject = &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON}
+
+// These rules are written to every derived Secret and ConfigMap, a failing case here
+// means existing outputs would be rewritten
+func TestDecodeJSONCoercion(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{`"text"`, "text"},
+		{`""`, ""},
+		{`"123"`, "123"},
+		{`"1e3"`, "1e3"},
+		{`true`, "true"},
+		{`false`, "false"},
+		{`0`, "0"},
+		{`-0`, "-0"},
+		{`42`, "42"},
+		{`-42`, "-42"},
+		{`9007199254740993`, "9007199254740993"},
+		{`12345678901234567890123456789`, "12345678901234567890123456789"},
+		{`-12345678901234567890123456789`, "-12345678901234567890123456789"},
+		{`1.0`, "1"},
+		{`-2.000`, "-2"},
+		{`0.0`, "0"},
+		{`-0.0`, "0"},
+		{`1e3`, "1000"},
+		{`1E3`, "1000"},
+		{`1e+3`, "1000"},
+		{`2.5E+1`, "25"},
+		{`1234.5e-1`, "1234.5e-1"},
+		{`1500e-3`, "1500e-3"},
+		{`1000e-3`, "1"},
+		{`1e30`, "1000000000000000000000000000000"},
+		{`9007199254740993.0`, "9007199254740993"},
+		{`0.1`, "0.1"},
+		{`3.14159265358979323846264338327950288`, "3.14159265358979323846264338327950288"},
+		{`1.5e-3`, "1.5e-3"},
+		{`1e-3`, "1e-3"},
+		{`1e1001`, "1e1001"},
+		{`1e-1001`, "1e-1001"},
+	}
+
+	for _, test := range tests {
+		values, err := Decode(`{"key": `+test.value+`}`, jsonObject)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if values["key"] != test.expected {
+			t.Errorf("%s: expected '%s', but got '%s'", test.value, test.expected, values["key"])
+		}
+	}
+}
+
+func TestDecodeJSONNullValues(t *testing.T) {
+	secret := `{"a": "value", "b": null}`
+
+	for _, nullValues := range []akv.AzureKeyVaultNullValues{"", akv.AzureKeyVaultNullValuesEmpty} {
+		values, err := Decode(secret, &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON, NullValues: nullValues})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"a": "value", "b": ""}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("nullValues '%s': expected %v, but got %v", nullValues, expected, values)
+		}
+	}
+
+	values, err := Decode(secret, &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON, NullValues: akv.AzureKeyVaultNullValuesSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "value"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("nullValues Skip: expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeJSONIsDeterministic(t *testing.T) {
+	secret := `{"int": 12345678901234567890, "float": 0.30000000000000004, "exp": 1e21, "bool": true, "null": null}`
+
+	first, err := Decode(secret, jsonObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		values, err := Decode(secret, jsonObject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(first, values) {
+			t.Fatalf("expected %v, but got %v", first, values)
+		}
+	}
+	if first["exp"] != "1000000000000000000000" {
+		t.Errorf("expected 1e21 without exponent, but got '%s'", first["exp"])
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"key": {"nested": "value"}}`: "json object",
+		`{"key": ["a", "b"]}`:          "set arrayValues",
+		`{"key": "value"} {}`:          "unexpected data",
+		`["a", "b"]`:                   "cannot unmarshal",
+		`{"key": `:                     "EOF",
+	}
+
+	for secret, expected := range tests {
+		_, err := Decode(secret, jsonObject)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing '%s', but got %v", secret, expected, err)
+		}
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	values, err := Decode("a: value\nb: 1.0\nc: true\n", &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeYaml})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "value", "b": "1.0", "c": "true"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeUnsupportedContentType(t *testing.T) {
+	if _, err := Decode("{}", &akv.AzureKeyVaultObject{ContentType: "text/plain"}); err == nil {
+		t.Error("expected error for unsupported content type")
+	}
+}
+
+func TestDecodeJSONArraysIndexed(t *testing.T) {
+	secret := `{"keys": ["a", 1.0, true, null, ["b", "c"]], "empty": [], "name": "value"}`
+	object := &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON, ArrayValues: akv.AzureKeyVaultArrayValuesIndexed}
+
+	values, err := Decode(secret, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"keys_0": "a", "keys_1": "1", "keys_2": "true", "keys_3": "", "keys_4_0": "b", "keys_4_1": "c", "name": "value"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+
+	object.KeyDelimiter = "."
+	object.NullValues = akv.AzureKeyVaultNullValuesSkip
+	values, err = Decode(secret, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"keys.0": "a", "keys.1": "1", "keys.2": "true", "keys.4.0": "b", "keys.4.1": "c", "name": "value"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeJSONArraysIndexedErrors(t *testing.T) {
+	object := &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON, ArrayValues: akv.AzureKeyVaultArrayValuesIndexed}
+	tests := map[string]string{
+		`{"keys": [{"a": "b"}]}`:             "json object",
+		`{"keys": ["a"], "keys_0": "other"}`: "more than once",
+	}
+
+	for secret, expected := range tests {
+		_, err := Decode(secret, object)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing '%s', but got %v", secret, expected, err)
+		}
+	}
+}
+
+func TestDecodeJSONArraysAsJSON(t *testing.T) {
+	secret := `{"keys": [ "a<b>&c", 1.0, 1e3, 0.1, 12345678901234567890, true, null, {"z": 1, "a": [2.50]} ]}`
+	object := &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeJSON, ArrayValues: akv.AzureKeyVaultArrayValuesJSON}
+
+	values, err := Decode(secret, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `["a<b>&c",1,1000,0.1,12345678901234567890,true,null,{"a":[2.50],"z":1}]`
+	if values["keys"] != expected {
+		t.Errorf("expected '%s', but got '%s'", expected, values["keys"])
+	}
+}
+
+func TestDecodeFormatsGiveSameValues(t *testing.T) {
+	documents := map[akv.AzureKeyVaultObjectContentType]string{
+		akv.AzureKeyVaultObjectContentTypeJSON: `{"db.host": "db.local", "db.port": 5432, "db.tls": true, "log.level": "debug", "greeting": "hello world"}`,
+		akv.AzureKeyVaultObjectContentTypeYaml: `
+db:
+  host: db.local
+  port: 5432
+  tls: true
+log:
+  level: debug
+greeting: hello world
+`,
+		akv.AzureKeyVaultObjectContentTypeProperties: `
+# database
+db.host=db.local
+db.port: 5432
+db.tls   true
+! logging
+log.level = debug
+greeting = hello \
+    world
+`,
+		akv.AzureKeyVaultObjectContentTypeEnv: `
+# database
+export db.host=db.local
+db.port=5432
+db.tls="true"
+log.level='debug' # logging
+greeting="hello world"
+`,
+	}
+	expected := map[string]string{
+		"db.host":   "db.local",
+		"db.port":   "5432",
+		"db.tls":    "true",
+		"log.level": "debug",
+		"greeting":  "hello world",
+	}
+
+	for contentType, document := range documents {
+		values, err := Decode(document, &akv.AzureKeyVaultObject{ContentType: contentType})
+		if err != nil {
+			t.Errorf("%s: %v", contentType, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("%s: expected %v, but got %v", contentType, expected, values)
+		}
+	}
+}
+
+func TestDecodeYAMLNested(t *testing.T) {
+	secret := `
+db:
+  primary: &primary
+    host: db-1
+  replica: *primary
+  hosts: [db-1, db-2]
+  password: ~
+`
+	object := &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeYaml, ArrayValues: akv.AzureKeyVaultArrayValuesIndexed, NestedKeySeparator: "__"}
+
+	values, err := Decode(secret, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"db__primary__host": "db-1", "db__replica__host": "db-1", "db__hosts_0": "db-1", "db__hosts_1": "db-2", "db__password": ""}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeProperties(t *testing.T) {
+	secret := "key\\ with\\=separators = value \\u00e6\\uD83D\\uDE00\\n\r\nempty\nurl=https://example.com\n"
+
+	values, err := Decode(secret, &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeProperties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"key with=separators": "value \u00e6\U0001F600\n", "empty": "", "url": "https://example.com"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeErrorsNameFormat(t *testing.T) {
+	tests := []struct {
+		contentType akv.AzureKeyVaultObjectContentType
+		secret      string
+		expected    string
+	}{
+		{akv.AzureKeyVaultObjectContentTypeJSON, `{"key": `, "as application/x-json"},
+		{akv.AzureKeyVaultObjectContentTypeYaml, "key: [", "as application/x-yaml"},
+		{akv.AzureKeyVaultObjectContentTypeYaml, "- a\n- b\n", "top-level value must be a map"},
+		{akv.AzureKeyVaultObjectContentTypeYaml, "key: [a]\n", "set arrayValues"},
+		{akv.AzureKeyVaultObjectContentTypeYaml, "a:\n  b: 1\na.b: 2\n", "line 3: key 'a.b' is written more than once"},
+		{akv.AzureKeyVaultObjectContentTypeProperties, "a=1\na=2\n", "as text/x-java-properties, error: line 2: key 'a' is set more than once"},
+		{akv.AzureKeyVaultObjectContentTypeProperties, "a=\\u12\n", "malformed \\uxxxx escape"},
+	}
+
+	for _, test := range tests {
+		_, err := Decode(test.secret, &akv.AzureKeyVaultObject{ContentType: test.contentType})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s %q: expected error containing '%s', but got %v", test.contentType, test.secret, test.expected, err)
+		}
+	}
+}
+
+func TestContentTypeFromAttribute(t *testing.T) {
+	for attribute, expected := range map[string]akv.AzureKeyVaultObjectContentType{
+		"application/json":                akv.AzureKeyVaultObjectContentTypeJSON,
+		"Application/JSON; charset=utf-8": akv.AzureKeyVaultObjectContentTypeJSON,
+		"text/yaml":                       akv.AzureKeyVaultObjectContentTypeYaml,
+		"application/x-yaml":              akv.AzureKeyVaultObjectContentTypeYaml,
+		"text/x-java-properties":          akv.AzureKeyVaultObjectContentTypeProperties,
+		"text/plain":                      "",
+		"":                                "",
+	} {
+		contentType, ok := ContentTypeFromAttribute(attribute)
+		if contentType != expected || ok != (expected != "") {
+			t.Errorf("expected '%s' for attribute '%s', but got '%s'", expected, attribute, contentType)
+		}
+	}
+}
+
+func TestDecodeEnv(t *testing.T) {
+	secret := "# settings\r\n\nexport DB_HOST=db.local\nDB_PASSWORD=\"p@ss \\\"word\\\" #1\\n\" # comment\nRAW='no \\n ${EXPANSION}'\n" +
+		"URL=https://example.com/#anchor # comment\nEMPTY=\nCERT=\"line 1\nline 2\"\n  SPACED = value  \n"
+
+	values, err := Decode(secret, &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeEnv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"DB_HOST":     "db.local",
+		"DB_PASSWORD": "p@ss \"word\" #1\n",
+		"RAW":         `no \n ${EXPANSION}`,
+		"URL":         "https://example.com/#anchor",
+		"EMPTY":       "",
+		"CERT":        "line 1\nline 2",
+		"SPACED":      "value",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, but got %v", expected, values)
+	}
+}
+
+func TestDecodeEnvErrors(t *testing.T) {
+	tests := map[string]string{
+		"A=1\nexport A=s3cret\n": "line 2: key 'A' is set more than once, first on line 1",
+		"A=1\ns3cret\n":          "line 2: expected KEY=value",
+		"1A=s3cret\n":            "invalid key '1A'",
+		"A=\"s3cret\nB=2\n":      "line 1: value of key 'A' has no closing quote",
+		"A='s3cret'suffix\n":     "unexpected characters after the quoted value of key 'A'",
+		"A=1\nB=2\nA=3\n":        "as text/x-env",
+	}
+
+	for secret, expected := range tests {
+		_, err := Decode(secret, &akv.AzureKeyVaultObject{ContentType: akv.AzureKeyVaultObjectContentTypeEnv})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing '%s', but got %v", secret, expected, err)
+		} else if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("%q: expected error without the secret value, but got %v", secret, err)
+		}
+	}
+}
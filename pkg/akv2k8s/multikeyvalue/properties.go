@@ -0,0 +1,153 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multikeyvalue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// propertiesWhitespace is the whitespace skipped around keys and separators
+const propertiesWhitespace = " \t\f"
+
+// decodeProperties decodes a java .properties document, with # and ! comments, keys separated
+// from values by =, : or whitespace, lines continued by a trailing backslash and escapes like
+// \n and \u00e6. Unlike java, keys set more than once are rejected instead of the last one winning.
+func decodeProperties(secret string) (map[string]string, error) {
+	values := make(map[string]string)
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(secret, "\r\n", "\n"), "\r", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimLeft(lines[i], propertiesWhitespace)
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		for continuesOnNextLine(line) {
+			line = line[:len(line)-1]
+			if i+1 == len(lines) {
+				break
+			}
+			i++
+			line += strings.TrimLeft(lines[i], propertiesWhitespace)
+		}
+
+		rawKey, rawValue := splitProperty(line)
+		key, err := unescapeProperty(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %+v", number, err)
+		}
+		value, err := unescapeProperty(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %+v", number, err)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: key '%s' is set more than once", number, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// continuesOnNextLine tells if line ends with an odd number of backslashes, the last one
+// not being escaped
+func continuesOnNextLine(line string) bool {
+	backslashes := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 1
+}
+
+// splitProperty splits line at the first unescaped =, : or whitespace, skipping whitespace
+// and one = or : around the separator
+func splitProperty(line string) (string, string) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || strings.IndexByte(propertiesWhitespace, line[i]) >= 0 {
+			end = i
+			break
+		}
+	}
+
+	rest := strings.TrimLeft(line[end:], propertiesWhitespace)
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], propertiesWhitespace)
+	}
+	return line[:end], rest
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			r, ok := parseUnicodeEscape(s[i+1:])
+			if !ok {
+				return "", fmt.Errorf("malformed \\uxxxx escape in '%s'", s)
+			}
+			i += 4
+			// characters outside the basic multilingual plane are escaped as utf-16 surrogate pairs
+			if utf16.IsSurrogate(r) && strings.HasPrefix(s[i+1:], `\u`) {
+				if low, ok := parseUnicodeEscape(s[i+3:]); ok && utf16.DecodeRune(r, low) != unicode.ReplacementChar {
+					r = utf16.DecodeRune(r, low)
+					i += 6
+				}
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// parseUnicodeEscape parses the four hex digits starting s
+func parseUnicodeEscape(s string) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(s[:4], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(r), true
+}
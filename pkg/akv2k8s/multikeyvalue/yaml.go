@@ -0,0 +1,142 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multikeyvalue
+
+import (
+	"fmt"
+	"strconv"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"gopkg.in/yaml.v3"
+)
+
+type yamlValues struct {
+	object *akv.AzureKeyVaultObject
+	values map[string]string
+}
+
+// decodeYAML decodes a yaml map, flattening nested maps by joining their keys with
+// nestedKeySeparator. Scalars are written as they are in the yaml, so 1.0 stays 1.0.
+func decodeYAML(secret string, object *akv.AzureKeyVaultObject) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(secret), &doc); err != nil {
+		return nil, err
+	}
+
+	y := &yamlValues{object: object, values: make(map[string]string)}
+	if len(doc.Content) == 0 {
+		return y.values, nil
+	}
+
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: top-level value must be a map, but is %s", root.Line, root.ShortTag())
+	}
+	if err := y.addMap("", root); err != nil {
+		return nil, err
+	}
+	return y.values, nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func (y *yamlValues) addMap(prefix string, node *yaml.Node) error {
+	separator := y.object.NestedKeySeparator
+	if separator == "" {
+		separator = defaultNestedKeySeparator
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode := resolveAlias(node.Content[i])
+		if keyNode.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: keys must be scalars, but found %s", keyNode.Line, keyNode.ShortTag())
+		}
+		if keyNode.ShortTag() == "!!merge" {
+			return fmt.Errorf("line %d: merge keys are not supported", keyNode.Line)
+		}
+
+		key := keyNode.Value
+		if prefix != "" {
+			key = prefix + separator + key
+		}
+		if err := y.add(key, node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (y *yamlValues) add(key string, node *yaml.Node) error {
+	node = resolveAlias(node)
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			if y.object.NullValues == akv.AzureKeyVaultNullValuesSkip {
+				return nil
+			}
+			return y.set(key, "", node)
+		}
+		return y.set(key, node.Value, node)
+	case yaml.MappingNode:
+		return y.addMap(key, node)
+	case yaml.SequenceNode:
+		return y.addSequence(key, node)
+	default:
+		return fmt.Errorf("line %d: value of key '%s' has unsupported type %s", node.Line, key, node.ShortTag())
+	}
+}
+
+func (y *yamlValues) addSequence(key string, node *yaml.Node) error {
+	switch y.object.ArrayValues {
+	case akv.AzureKeyVaultArrayValuesIndexed:
+		delimiter := y.object.KeyDelimiter
+		if delimiter == "" {
+			delimiter = defaultKeyDelimiter
+		}
+		for i, element := range node.Content {
+			if err := y.add(key+delimiter+strconv.Itoa(i), element); err != nil {
+				return err
+			}
+		}
+		return nil
+	case akv.AzureKeyVaultArrayValuesJSON:
+		var array interface{}
+		if err := node.Decode(&array); err != nil {
+			return fmt.Errorf("line %d: failed to read sequence of key '%s', error: %+v", node.Line, key, err)
+		}
+		value, err := canonicalJSON(array)
+		if err != nil {
+			return fmt.Errorf("line %d: failed to write sequence of key '%s' as json, error: %+v", node.Line, key, err)
+		}
+		return y.set(key, value, node)
+	default:
+		return fmt.Errorf("line %d: value of key '%s' is a yaml sequence, set arrayValues to Indexed or JSON to write sequences", node.Line, key)
+	}
+}
+
+func (y *yamlValues) set(key, value string, node *yaml.Node) error {
+	if _, ok := y.values[key]; ok {
+		return fmt.Errorf("line %d: key '%s' is written more than once, by a nested map, sequence or key in the yaml", node.Line, key)
+	}
+	y.values[key] = value
+	return nil
+}
@@ -18,6 +18,8 @@ package transformers
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -35,17 +37,25 @@ type Base64DecodeHandler struct{}
 // TrimHandler handles standar trimming of string data
 type TrimHandler struct{}
 
+// ChompHandler handles removing a single trailing newline from string data
+type ChompHandler struct{}
+
 // Handle encode secrets as a base64 encoded string
 func (h *Base64EncodeHandler) Handle(secret string) (string, error) {
 	return base64.StdEncoding.EncodeToString([]byte(secret)), nil
 }
 
-// Handle handles decoding of base64 encoded data
+// Handle handles decoding of base64 encoded data, like binary files stored as text in Azure
+// Key Vault. Whitespace is ignored, as encoded files are often wrapped over several lines.
 func (h *Base64DecodeHandler) Handle(secret string) (string, error) {
-	decoded, err := base64.StdEncoding.DecodeString(secret)
-
+	encoded := strings.Join(strings.Fields(secret), "")
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", err
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			return "", fmt.Errorf("value of %d characters is not valid base64, invalid data at character %d", len(encoded), int64(corrupt)+1)
+		}
+		return "", fmt.Errorf("value is not valid base64: %+v", err)
 	}
 
 	return string(decoded), nil
@@ -55,3 +65,11 @@ func (h *Base64DecodeHandler) Handle(secret string) (string, error) {
 func (h *TrimHandler) Handle(secret string) (string, error) {
 	return strings.TrimSpace(secret), nil
 }
+
+// Handle handles removing a single trailing newline (\n or \r\n) from secret
+func (h *ChompHandler) Handle(secret string) (string, error) {
+	if strings.HasSuffix(secret, "\r\n") {
+		return strings.TrimSuffix(secret, "\r\n"), nil
+	}
+	return strings.TrimSuffix(secret, "\n"), nil
+}
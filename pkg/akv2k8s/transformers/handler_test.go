@@ -17,6 +17,7 @@ limitations under the License.
 package transformers
 
 import (
+	"strings"
 	"testing"
 
 	akvsv1 "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
@@ -137,3 +138,171 @@ func TestTransformWithNilOutputSpec(t *testing.T) {
 	}
 
 }
+
+func TestTransformWithChomp(t *testing.T) {
+	secretSpec := akvsv1.AzureKeyVaultOutput{
+		Transform: []string{"chomp"},
+	}
+
+	transformator, err := CreateTransformator(&secretSpec)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for secret, expected := range map[string]string{
+		"some secret\n":   "some secret",
+		"some secret\r\n": "some secret",
+		"some secret\n\n": "some secret\n",
+		"some secret ":    "some secret ",
+	} {
+		newSecret, err := transformator.Transform(secret)
+		if err != nil {
+			t.Error(err)
+		}
+		if newSecret != expected {
+			t.Errorf("Actual   :%q", newSecret)
+			t.Errorf("Expected :%q", expected)
+		}
+	}
+}
+
+func TestTransformWithDefaultsRunsDefaultsFirst(t *testing.T) {
+	secretSpec := akvsv1.AzureKeyVaultOutput{
+		Transform: []string{"base64encode"},
+	}
+
+	transformator, err := CreateTransformatorWithDefaults([]string{"trim"}, &secretSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transforms := transformator.Transforms()
+	if len(transforms) != 2 || transforms[0] != "trim" || transforms[1] != "base64encode" {
+		t.Errorf("unexpected transforms %v", transforms)
+	}
+
+	newSecret, err := transformator.Transform(testString)
+	if err != nil {
+		t.Error(err)
+	}
+	if newSecret != "YWxzZGpmbCBsamFzZms=" {
+		t.Errorf("Actual   :%s", newSecret)
+	}
+}
+
+func TestParseDefaultTransforms(t *testing.T) {
+	defaults, err := ParseDefaultTransforms("secret:chomp, trim")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transforms := defaults[akvsv1.AzureKeyVaultObjectTypeSecret]
+	if len(transforms) != 2 || transforms[0] != "chomp" || transforms[1] != "trim" {
+		t.Errorf("unexpected default transforms %v", transforms)
+	}
+
+	defaults, err = ParseDefaultTransforms("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defaults) != 0 {
+		t.Errorf("expected no default transforms, but got %v", defaults)
+	}
+}
+
+func TestParseDefaultTransformsInvalid(t *testing.T) {
+	for _, value := range []string{
+		"chomp",
+		"secret:",
+		"secret:nonexistant",
+		"certificate:trim",
+		"secret:trim;secret:chomp",
+	} {
+		if _, err := ParseDefaultTransforms(value); err == nil {
+			t.Errorf("expected '%s' to be invalid", value)
+		}
+	}
+}
+
+func TestTransformWithBase64DecodeInvalid(t *testing.T) {
+	transformator, err := CreateTransformator(&akvsv1.AzureKeyVaultOutput{Transform: []string{"trim", "base64decode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = transformator.Transform("ICBhbHNk*mZs")
+	if !IsTransformError(err) {
+		t.Fatalf("expected transform error, but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "transform 'base64decode' failed") || !strings.Contains(err.Error(), "invalid data at character 9") {
+		t.Errorf("expected error describing the invalid data, but got %v", err)
+	}
+}
+
+func TestTransformWithBase64DecodeIgnoresLineBreaks(t *testing.T) {
+	handler := &Base64DecodeHandler{}
+	decoded, err := handler.Handle("ICBhbHNkamZsIGxq\r\nYXNmayAgIA==\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != testString {
+		t.Errorf("Actual   :%q", decoded)
+		t.Errorf("Expected :%q", testString)
+	}
+}
+
+func TestWritesBinary(t *testing.T) {
+	for transforms, expected := range map[string]bool{
+		"":                          false,
+		"trim":                      false,
+		"trim,base64decode":         true,
+		"base64decode,base64encode": false,
+		"base64encode,base64decode": true,
+	} {
+		var names []string
+		if transforms != "" {
+			names = strings.Split(transforms, ",")
+		}
+		if WritesBinary(names) != expected {
+			t.Errorf("expected WritesBinary of '%s' to be %t", transforms, expected)
+		}
+	}
+}
+
+func TestChainRunsInDeclaredOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms []string
+		expected   string
+	}{
+		{"trim then base64decode", []string{"trim", "base64decode"}, testString},
+		{"base64decode then trim", []string{"base64decode", "trim"}, testStringTrimmed},
+		{"base64decode then base64encode", []string{"base64decode", "base64encode"}, testBase64String},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := NewChain(tt.transforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, err := chain.Transform("  " + testBase64String + "\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.expected {
+				t.Errorf("expected %q, but got %q", tt.expected, value)
+			}
+			if strings.Join(chain.Transforms(), ",") != strings.Join(tt.transforms, ",") {
+				t.Errorf("expected transforms %v, but got %v", tt.transforms, chain.Transforms())
+			}
+		})
+	}
+}
+
+func TestChainUnknownTransformNamesIndex(t *testing.T) {
+	_, err := CreateTransformator(&akvsv1.AzureKeyVaultOutput{Transform: []string{"trim", "base64decode", "rot13"}})
+	if err == nil || !strings.Contains(err.Error(), "transform[2]") {
+		t.Errorf("expected error naming transform[2], but got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transformers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathPrefix starts transforms extracting a value from a json document, like
+// jsonpath:$.connectionStrings.primary
+const jsonPathPrefix = "jsonpath:"
+
+// JSONPathHandler handles extracting a single value from a json document. String values are
+// written as is, other values like numbers, objects and arrays are written as json.
+type JSONPathHandler struct {
+	expr     string
+	segments []jsonPathSegment
+}
+
+// jsonPathSegment is either a member name or an array index
+type jsonPathSegment struct {
+	name  string
+	index int
+	isIdx bool
+}
+
+func (s jsonPathSegment) String() string {
+	if s.isIdx {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	return fmt.Sprintf("['%s']", s.name)
+}
+
+// newJSONPathHandler parses expr, supporting member names as .name or ['name'] and array
+// indexes as [0], starting from the root $
+func newJSONPathHandler(expr string) (*JSONPathHandler, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("json path '%s' must start with $", expr)
+	}
+
+	var segments []jsonPathSegment
+	rest := expr[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("json path '%s' has an empty member name", expr)
+			}
+			segments = append(segments, jsonPathSegment{name: name})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end == -1 {
+				return nil, fmt.Errorf("json path '%s' has an unterminated member name", expr)
+			}
+			segments = append(segments, jsonPathSegment{name: rest[2:end]})
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("json path '%s' has an unterminated index", expr)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("json path '%s' has invalid index '%s', must be a number from 0", expr, rest[1:end])
+			}
+			segments = append(segments, jsonPathSegment{index: index, isIdx: true})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path '%s' is not supported, use members like $.name or $['name'] and indexes like $[0]", expr)
+		}
+	}
+	return &JSONPathHandler{expr: expr, segments: segments}, nil
+}
+
+// Handle handles extracting the value at the json path from secret
+func (h *JSONPathHandler) Handle(secret string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(secret))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("value is not valid json, cannot read json path '%s': %v", h.expr, err)
+	}
+
+	path := "$"
+	for _, segment := range h.segments {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			member, ok := current[segment.name]
+			if segment.isIdx || !ok {
+				return "", fmt.Errorf("json path '%s' not found, %s has no %s", h.expr, path, segment)
+			}
+			value = member
+		case []interface{}:
+			if !segment.isIdx || segment.index >= len(current) {
+				return "", fmt.Errorf("json path '%s' not found, %s has no %s", h.expr, path, segment)
+			}
+			value = current[segment.index]
+		default:
+			return "", fmt.Errorf("json path '%s' not found, %s is not an object or array", h.expr, path)
+		}
+		path += segment.String()
+	}
+
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to write value at json path '%s' as json: %v", h.expr, err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transformers
+
+import (
+	"strings"
+	"testing"
+
+	akvsv1 "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+const testJSONDocument = `{
+  "connectionStrings": {"primary": "Server=db;Password=s3cret", "replicas": ["db-1", "db-2"]},
+  "port": 5432,
+  "tls": {"enabled": true, "ciphers": null},
+  "app.name": "api"
+}`
+
+func TestTransformWithJSONPath(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"$.connectionStrings.primary":     "Server=db;Password=s3cret",
+		"$.connectionStrings.replicas[1]": "db-2",
+		"$['app.name']":                   "api",
+		"$.port":                          "5432",
+		"$.tls.enabled":                   "true",
+		"$.tls.ciphers":                   "null",
+		"$.tls":                           `{"ciphers":null,"enabled":true}`,
+		"$.connectionStrings.replicas":    `["db-1","db-2"]`,
+	} {
+		transformator, err := CreateTransformator(&akvsv1.AzureKeyVaultOutput{Transform: []string{"jsonpath:" + expr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := transformator.Transform(testJSONDocument)
+		if err != nil {
+			t.Errorf("failed to read '%s': %v", expr, err)
+			continue
+		}
+		if value != expected {
+			t.Errorf("expected '%s' at '%s', but got '%s'", expected, expr, value)
+		}
+	}
+}
+
+func TestTransformWithJSONPathFailures(t *testing.T) {
+	tests := []struct {
+		expr     string
+		value    string
+		expected string
+	}{
+		{"$.connectionStrings.secondary", testJSONDocument, "json path '$.connectionStrings.secondary' not found, $['connectionStrings'] has no ['secondary']"},
+		{"$.connectionStrings.replicas[2]", testJSONDocument, "$['connectionStrings']['replicas'] has no [2]"},
+		{"$.port.number", testJSONDocument, "$['port'] is not an object or array"},
+		{"$.password", "password=s3cret", "value is not valid json, cannot read json path '$.password'"},
+	}
+
+	for _, tt := range tests {
+		transformator, err := CreateTransformator(&akvsv1.AzureKeyVaultOutput{Transform: []string{"jsonpath:" + tt.expr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = transformator.Transform(tt.value)
+		if !IsTransformError(err) || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("expected error containing '%s' for '%s', but got %v", tt.expected, tt.expr, err)
+		}
+	}
+}
+
+func TestValidateTransformsWithInvalidJSONPath(t *testing.T) {
+	for _, expr := range []string{"connectionStrings.primary", "$..primary", "$.replicas[-1]", "$['primary'", "$.replicas[first]"} {
+		if err := ValidateTransforms([]string{"jsonpath:" + expr}); err == nil {
+			t.Errorf("expected json path '%s' to be invalid", expr)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transformers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// replacePrefix starts transforms replacing matches of a regular expression, like
+// replace:|^postgres://|| where the first character after the prefix is the delimiter
+const replacePrefix = "replace:"
+
+// ReplaceHandler handles replacing all matches of a regular expression in the secret
+type ReplaceHandler struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// newReplaceHandler parses expr on the form <d><regex><d><replacement><d>, where the
+// delimiter d is any character not used in regex or replacement, like /, | or #
+func newReplaceHandler(expr string) (*ReplaceHandler, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("replace must be on the form replace:/<regex>/<replacement>/")
+	}
+
+	delimiter := expr[:1]
+	parts := strings.Split(expr[1:], delimiter)
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("replace '%s' must be on the form replace:%s<regex>%s<replacement>%s, use another delimiter if %s is part of regex or replacement", expr, delimiter, delimiter, delimiter, delimiter)
+	}
+	if parts[0] == "" {
+		return nil, fmt.Errorf("replace '%s' has an empty regular expression", expr)
+	}
+
+	regex, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("replace '%s' has an invalid regular expression: %v", expr, err)
+	}
+	return &ReplaceHandler{regex: regex, replacement: parts[1]}, nil
+}
+
+// Handle handles replacing all matches in secret, expanding $1 and ${name} in the
+// replacement to the submatches
+func (h *ReplaceHandler) Handle(secret string) (string, error) {
+	return h.regex.ReplaceAllString(secret, h.replacement), nil
+}
@@ -0,0 +1,72 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package transformers
+
+import (
+	"strings"
+	"testing"
+
+	akvsv1 "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+func TestTransformWithReplace(t *testing.T) {
+	tests := []struct {
+		transforms []string
+		secret     string
+		expected   string
+	}{
+		{[]string{"replace:|^postgres://||"}, "postgres://db.example.com:5432/app", "db.example.com:5432/app"},
+		{[]string{`replace:/\.example\.com/.default.svc.cluster.local/`}, "db.example.com:5432", "db.default.svc.cluster.local:5432"},
+		{[]string{`replace:/(\w+)@(\w+)/$2@$1/`}, "user@host", "host@user"},
+		{
+			[]string{"trim", "replace:|^postgres://||", `replace:/:\d+$//`, "base64encode"},
+			"  postgres://db:5432\n",
+			"ZGI=",
+		},
+	}
+
+	for _, test := range tests {
+		transformator, err := CreateTransformator(&akvsv1.AzureKeyVaultOutput{Transform: test.transforms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := transformator.Transform(test.secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != test.expected {
+			t.Errorf("expected '%s' after %v, but got '%s'", test.expected, test.transforms, value)
+		}
+	}
+}
+
+func TestReplaceValidation(t *testing.T) {
+	tests := map[string]string{
+		"replace:":             "must be on the form",
+		"replace:/a/b":         "must be on the form",
+		"replace:/a/b/c/":      "use another delimiter",
+		"replace:///":          "empty regular expression",
+		"replace:/postgres(//": "invalid regular expression",
+	}
+
+	for transform, wantErr := range tests {
+		err := ValidateTransforms([]string{transform})
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("expected error containing '%s' for '%s', but got %v", wantErr, transform, err)
+		}
+	}
+}
@@ -17,50 +17,199 @@ limitations under the License.
 package transformers
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 )
 
+// DefaultTransforms holds transforms applied to each Azure Key Vault object type,
+// before any transforms specified in the AzureKeyVaultSecret
+type DefaultTransforms map[akvs.AzureKeyVaultObjectType][]string
+
 // CreateTransformator creates a new Transformator ready to run transformation handlers
 func CreateTransformator(spec *akvs.AzureKeyVaultOutput) (*Transformator, error) {
-	var transforms []TransformationHandler
+	return CreateTransformatorWithDefaults(nil, spec)
+}
+
+// CreateTransformatorWithDefaults creates a new Transformator running the default
+// transforms before the transforms in spec
+func CreateTransformatorWithDefaults(defaults []string, spec *akvs.AzureKeyVaultOutput) (*Transformator, error) {
+	chain, err := NewChain(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default transforms: %w", err)
+	}
+
+	if spec != nil {
+		specChain, err := NewChain(spec.Transform)
+		if err != nil {
+			return nil, err
+		}
+		chain = chain.Then(specChain)
+	}
+	return &Transformator{Chain: chain}, nil
+}
+
+// ValidateTransforms checks that all transforms are supported, naming the index of the
+// first unsupported transform
+func ValidateTransforms(transforms []string) error {
+	_, err := NewChain(transforms)
+	return err
+}
+
+// ValidateTransform checks that transform is supported
+func ValidateTransform(transform string) error {
+	_, err := newTransformationHandler(transform)
+	return err
+}
+
+// ParseDefaultTransforms parses default transforms on the form
+// <object type>:<transform>[,<transform>...][;<object type>:<transform>...],
+// like secret:chomp,trim
+func ParseDefaultTransforms(value string) (DefaultTransforms, error) {
+	defaults := DefaultTransforms{}
+	if strings.TrimSpace(value) == "" {
+		return defaults, nil
+	}
+
+	for _, entry := range strings.Split(value, ";") {
+		objectType, transformList, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || objectType == "" || transformList == "" {
+			return nil, fmt.Errorf("default transforms '%s' must be on the form <object type>:<transform>[,<transform>...]", entry)
+		}
+
+		// transforms are only run for secret objects
+		if akvs.AzureKeyVaultObjectType(objectType) != akvs.AzureKeyVaultObjectTypeSecret {
+			return nil, fmt.Errorf("default transforms not supported for object type '%s'", objectType)
+		}
+		if _, exists := defaults[akvs.AzureKeyVaultObjectType(objectType)]; exists {
+			return nil, fmt.Errorf("default transforms for object type '%s' specified more than once", objectType)
+		}
+
+		var transforms []string
+		for _, transform := range strings.Split(transformList, ",") {
+			transforms = append(transforms, strings.TrimSpace(transform))
+		}
+		if err := ValidateTransforms(transforms); err != nil {
+			return nil, err
+		}
+		defaults[akvs.AzureKeyVaultObjectType(objectType)] = transforms
+	}
+	return defaults, nil
+}
+
+func newTransformationHandler(transform string) (TransformationHandler, error) {
+	if expr, ok := strings.CutPrefix(transform, jsonPathPrefix); ok {
+		return newJSONPathHandler(expr)
+	}
+	if expr, ok := strings.CutPrefix(transform, replacePrefix); ok {
+		return newReplaceHandler(expr)
+	}
 
-	if spec == nil {
-		return &Transformator{
-			transHandlers: transforms,
-		}, nil
+	switch transform {
+	case "trim":
+		return &TrimHandler{}, nil
+	case "chomp":
+		return &ChompHandler{}, nil
+	case "base64encode":
+		return &Base64EncodeHandler{}, nil
+	case "base64decode":
+		return &Base64DecodeHandler{}, nil
+	default:
+		return nil, fmt.Errorf("transform type '%s' not currently supported", transform)
 	}
+}
+
+// TransformError tells that a transform failed for the value read from Azure Key Vault
+type TransformError struct {
+	Transform string
+	Err       error
+}
 
-	for _, transform := range spec.Transform {
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("transform '%s' failed: %v", e.Transform, e.Err)
+}
+
+func (e *TransformError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransformError tells if err is caused by a failing transform
+func IsTransformError(err error) bool {
+	var transformErr *TransformError
+	return errors.As(err, &transformErr)
+}
+
+// WritesBinary tells if the value after running transforms may be binary, being decoded
+// by base64decode and not encoded again. Binary values cannot be written to ConfigMap data.
+func WritesBinary(transforms []string) bool {
+	binary := false
+	for _, transform := range transforms {
 		switch transform {
-		case "trim":
-			transforms = append(transforms, &TrimHandler{})
-		case "base64encode":
-			transforms = append(transforms, &Base64EncodeHandler{})
 		case "base64decode":
-			transforms = append(transforms, &Base64DecodeHandler{})
-		default:
-			return nil, fmt.Errorf("transform type '%s' not currently supported", transform)
+			binary = true
+		case "base64encode":
+			binary = false
+		}
+	}
+	return binary
+}
+
+// Chain is an ordered list of transforms, run strictly in the order listed with the
+// output of one transform being the input of the next. Transforms are not reordered,
+// so trim then base64decode may give another value than base64decode then trim.
+type Chain struct {
+	handlers []TransformationHandler
+	names    []string
+}
+
+// NewChain creates a Chain running transforms in order, failing with the index of
+// the first unsupported transform
+func NewChain(transforms []string) (*Chain, error) {
+	chain := &Chain{}
+	for i, transform := range transforms {
+		handler, err := newTransformationHandler(transform)
+		if err != nil {
+			return nil, fmt.Errorf("transform[%d] is invalid: %w", i, err)
 		}
+		chain.handlers = append(chain.handlers, handler)
+		chain.names = append(chain.names, transform)
 	}
+	return chain, nil
+}
 
-	return &Transformator{
-		transHandlers: transforms,
-	}, nil
+// Then returns a new Chain running the transforms of c followed by the transforms of next
+func (c *Chain) Then(next *Chain) *Chain {
+	return &Chain{
+		handlers: append(append([]TransformationHandler{}, c.handlers...), next.handlers...),
+		names:    append(append([]string{}, c.names...), next.names...),
+	}
 }
 
-// Transformator
-type Transformator struct {
-	transHandlers []TransformationHandler
+// Transforms returns the names of the transforms run, in order
+func (c *Chain) Transforms() []string {
+	return c.names
+}
+
+// WritesBinary tells if the transformed value may be binary, see WritesBinary
+func (c *Chain) WritesBinary() bool {
+	return WritesBinary(c.names)
 }
 
-func (t *Transformator) Transform(secret string) (string, error) {
+// Transform runs the transforms in order on secret
+func (c *Chain) Transform(secret string) (string, error) {
 	var err error
-	for _, handler := range t.transHandlers {
+	for i, handler := range c.handlers {
 		if secret, err = handler.Handle(secret); err != nil {
-			return "", err
+			return "", &TransformError{Transform: c.names[i], Err: err}
 		}
 	}
 	return secret, nil
 }
+
+// Transformator runs the default transforms of the controller followed by the
+// transforms of an AzureKeyVaultSecret output
+type Transformator struct {
+	*Chain
+}
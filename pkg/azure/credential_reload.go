@@ -0,0 +1,144 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+var credentialReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "akv2k8s_credential_reloads_total",
+	Help: "The total number of Azure credential reloads, by result",
+}, []string{"result"})
+
+// ReloadableTokenCredential is a LegacyTokenCredential where the underlying credential
+// can be replaced, like when a service principal secret is rotated. Replacing the
+// credential also drops any token cached by the old one. Requests already holding a
+// token complete using it, while later requests get a token from the new credential.
+type ReloadableTokenCredential struct {
+	mu         sync.RWMutex
+	credential LegacyTokenCredential
+}
+
+// NewReloadableTokenCredential returns a ReloadableTokenCredential using credential
+func NewReloadableTokenCredential(credential LegacyTokenCredential) *ReloadableTokenCredential {
+	return &ReloadableTokenCredential{credential: credential}
+}
+
+func (r *ReloadableTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	r.mu.RLock()
+	credential := r.credential
+	r.mu.RUnlock()
+
+	return credential.GetToken(ctx, options)
+}
+
+// Reload replaces the underlying credential
+func (r *ReloadableTokenCredential) Reload(credential LegacyTokenCredential) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.credential = credential
+}
+
+// CredentialFileWatcher reloads a ReloadableTokenCredential when any of the files the
+// credential is created from changes. Files are polled instead of watched for events,
+// as mounted Secrets are updated by swapping symlinks.
+type CredentialFileWatcher struct {
+	Credential *ReloadableTokenCredential
+	Files      []string
+	Interval   time.Duration
+
+	// Load creates a new credential from the files
+	Load func() (LegacyTokenCredential, error)
+
+	checksum []byte
+}
+
+// Run checks the files for changes every interval, until stopCh is closed
+func (w *CredentialFileWatcher) Run(stopCh <-chan struct{}) {
+	checksum, err := filesChecksum(w.Files)
+	if err != nil {
+		klog.ErrorS(err, "failed to read credential files, changes are detected when they can be read", "files", w.Files)
+	}
+	w.checksum = checksum
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the credential if the files have changed. The current credential
+// is kept if the files cannot be read or a new credential cannot be created.
+func (w *CredentialFileWatcher) check() {
+	checksum, err := filesChecksum(w.Files)
+	if err != nil {
+		klog.ErrorS(err, "failed to read credential files", "files", w.Files)
+		return
+	}
+	if string(checksum) == string(w.checksum) {
+		return
+	}
+
+	klog.InfoS("credential files changed, reloading azure credentials", "files", w.Files)
+	credential, err := w.Load()
+	if err == nil && credential == nil {
+		err = fmt.Errorf("no credential created")
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to reload azure credentials, keeping current credentials", "files", w.Files)
+		credentialReloads.WithLabelValues("failed").Inc()
+		return
+	}
+
+	w.Credential.Reload(credential)
+	w.checksum = checksum
+	credentialReloads.WithLabelValues("success").Inc()
+	klog.InfoS("azure credentials reloaded", "files", w.Files)
+}
+
+func filesChecksum(files []string) ([]byte, error) {
+	hash := sha256.New()
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write([]byte(file))
+		hash.Write(content)
+	}
+	return hash.Sum(nil), nil
+}
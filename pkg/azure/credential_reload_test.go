@@ -0,0 +1,77 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+func tokenOf(t *testing.T, credential LegacyTokenCredential) string {
+	token, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Token
+}
+
+func TestCredentialFileWatcherReloadsOnChange(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "azure.json")
+	if err := os.WriteFile(file, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credential := NewReloadableTokenCredential(NewLegacyTokenCredentialOauth("first"))
+	var loadErr error
+	watcher := &CredentialFileWatcher{
+		Credential: credential,
+		Files:      []string{file},
+		Load: func() (LegacyTokenCredential, error) {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			return NewLegacyTokenCredentialOauth(string(content)), loadErr
+		},
+	}
+	watcher.checksum, _ = filesChecksum(watcher.Files)
+
+	watcher.check()
+	if token := tokenOf(t, credential); token != "first" {
+		t.Errorf("expected unchanged credential, but got token '%s'", token)
+	}
+
+	if err := os.WriteFile(file, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loadErr = errors.New("invalid credential")
+	watcher.check()
+	if token := tokenOf(t, credential); token != "first" {
+		t.Errorf("expected current credential to be kept when reload fails, but got token '%s'", token)
+	}
+
+	loadErr = nil
+	watcher.check()
+	if token := tokenOf(t, credential); token != "second" {
+		t.Errorf("expected reloaded credential, but got token '%s'", token)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentialprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	azureAuth "github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure"
+)
+
+// Environment variables set by the Azure Workload Identity webhook in pods using a
+// service account annotated with azure.workload.identity/client-id
+const (
+	FederatedTokenFileEnv = "AZURE_FEDERATED_TOKEN_FILE"
+	ClientIDEnv           = "AZURE_CLIENT_ID"
+	TenantIDEnv           = "AZURE_TENANT_ID"
+	AuthorityHostEnv      = "AZURE_AUTHORITY_HOST"
+)
+
+// WorkloadIdentityCredentialProvider provides credentials for Azure by exchanging the
+// projected service account token of Azure Workload Identity for an AAD token
+type WorkloadIdentityCredentialProvider struct {
+	tokenFile     string
+	clientID      string
+	tenantID      string
+	authorityHost string
+	envSettings   *azureAuth.EnvironmentSettings
+}
+
+// IsWorkloadIdentityEnvironment tells if the environment is set up for Azure Workload Identity
+func IsWorkloadIdentityEnvironment() bool {
+	return os.Getenv(FederatedTokenFileEnv) != ""
+}
+
+// NewFromWorkloadIdentity creates a credentials provider from the environment variables
+// set by Azure Workload Identity, failing if the projected token file cannot be read
+func NewFromWorkloadIdentity() (*WorkloadIdentityCredentialProvider, error) {
+	provider := &WorkloadIdentityCredentialProvider{
+		tokenFile:     os.Getenv(FederatedTokenFileEnv),
+		clientID:      os.Getenv(ClientIDEnv),
+		tenantID:      os.Getenv(TenantIDEnv),
+		authorityHost: os.Getenv(AuthorityHostEnv),
+	}
+
+	var missing []string
+	for _, env := range []string{FederatedTokenFileEnv, ClientIDEnv, TenantIDEnv} {
+		if os.Getenv(env) == "" {
+			missing = append(missing, env)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("workload identity requires environment variables %s, which are set by the azure workload identity webhook for pods with the label azure.workload.identity/use=true", strings.Join(missing, ", "))
+	}
+	if _, err := readFederatedToken(provider.tokenFile); err != nil {
+		return nil, fmt.Errorf("workload identity requires the projected service account token in %s, error: %+v", provider.tokenFile, err)
+	}
+
+	envSettings, err := azureAuth.GetSettingsFromEnvironment()
+	if err != nil {
+		return nil, fmt.Errorf("failed getting settings from environment, err: %+v", err)
+	}
+	provider.envSettings = &envSettings
+	return provider, nil
+}
+
+// GetAzureKeyVaultCredentials returns credentials exchanging the projected service account
+// token for an AAD token. Tokens are refreshed before they expire, reading the token file
+// again on each refresh, as the kubelet rotates the projected token.
+func (c WorkloadIdentityCredentialProvider) GetAzureKeyVaultCredentials() (azure.LegacyTokenCredential, error) {
+	options := &azidentity.ClientAssertionCredentialOptions{}
+	if c.authorityHost != "" {
+		options.ClientOptions = azcore.ClientOptions{Cloud: cloud.Configuration{ActiveDirectoryAuthorityHost: c.authorityHost}}
+	}
+
+	tokenFile := c.tokenFile
+	credential, err := azidentity.NewClientAssertionCredential(c.tenantID, c.clientID, func(context.Context) (string, error) {
+		return readFederatedToken(tokenFile)
+	}, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workload identity credentials, error: %+v", err)
+	}
+	return credential, nil
+}
+
+// GetAzureKeyVaultDNSSuffix returns the environment specific Azure Key Vault DNS suffix
+func (c WorkloadIdentityCredentialProvider) GetAzureKeyVaultDNSSuffix() string {
+	return c.envSettings.Environment.KeyVaultDNSSuffix
+}
+
+func readFederatedToken(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentialprovider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setWorkloadIdentityEnv(t *testing.T, tokenFile string) {
+	t.Setenv(FederatedTokenFileEnv, tokenFile)
+	t.Setenv(ClientIDEnv, "client-id")
+	t.Setenv(TenantIDEnv, "tenant-id")
+}
+
+func TestNewFromWorkloadIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	if err := os.WriteFile(tokenFile, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setWorkloadIdentityEnv(t, tokenFile)
+
+	if !IsWorkloadIdentityEnvironment() {
+		t.Error("expected environment to be detected as workload identity")
+	}
+	provider, err := NewFromWorkloadIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.GetAzureKeyVaultCredentials(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewFromWorkloadIdentityWithoutTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "missing")
+	setWorkloadIdentityEnv(t, tokenFile)
+
+	_, err := NewFromWorkloadIdentity()
+	if err == nil || !strings.Contains(err.Error(), tokenFile) {
+		t.Errorf("expected error naming missing token file, but got %v", err)
+	}
+}
+
+func TestNewFromWorkloadIdentityWithoutEnvironment(t *testing.T) {
+	setWorkloadIdentityEnv(t, "")
+	t.Setenv(TenantIDEnv, "")
+
+	_, err := NewFromWorkloadIdentity()
+	if err == nil || !strings.Contains(err.Error(), FederatedTokenFileEnv+", "+TenantIDEnv) {
+		t.Errorf("expected error naming missing environment variables, but got %v", err)
+	}
+}
+
+func TestReadFederatedTokenRereadsRotatedToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	for _, token := range []string{"first-token", "rotated-token"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readFederatedToken(tokenFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != token {
+			t.Errorf("expected token '%s', but got '%s'", token, read)
+		}
+	}
+
+	if err := os.WriteFile(tokenFile, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFederatedToken(tokenFile); err == nil {
+		t.Error("expected error for empty token file")
+	}
+}
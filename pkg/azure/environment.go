@@ -0,0 +1,48 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Environment has the endpoints of an Azure cloud used to read Azure Key Vault
+type Environment struct {
+	Name                         string
+	KeyVaultDNSSuffix            string
+	ActiveDirectoryAuthorityHost string
+}
+
+var environments = []Environment{
+	{Name: "AzurePublicCloud", KeyVaultDNSSuffix: "vault.azure.net", ActiveDirectoryAuthorityHost: "https://login.microsoftonline.com/"},
+	{Name: "AzureChinaCloud", KeyVaultDNSSuffix: "vault.azure.cn", ActiveDirectoryAuthorityHost: "https://login.chinacloudapi.cn/"},
+	{Name: "AzureUSGovernmentCloud", KeyVaultDNSSuffix: "vault.usgovcloudapi.net", ActiveDirectoryAuthorityHost: "https://login.microsoftonline.us/"},
+	{Name: "AzureGermanCloud", KeyVaultDNSSuffix: "vault.microsoftazure.de", ActiveDirectoryAuthorityHost: "https://login.microsoftonline.de/"},
+}
+
+// EnvironmentFromName returns the Azure cloud with name, ignoring case
+func EnvironmentFromName(name string) (Environment, error) {
+	var names []string
+	for _, env := range environments {
+		if strings.EqualFold(env.Name, name) {
+			return env, nil
+		}
+		names = append(names, env.Name)
+	}
+	return Environment{}, fmt.Errorf("unknown azure environment '%s', must be one of %s", name, strings.Join(names, ", "))
+}
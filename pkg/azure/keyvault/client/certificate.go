@@ -21,6 +21,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"strings"
@@ -54,6 +55,9 @@ type Certificate struct {
 
 	// Indicate if Certificate has private key
 	HasPrivateKey bool
+
+	// Version of the certificate read from Azure Key Vault, nil if not read from Azure Key Vault
+	Metadata *ObjectMetadata
 }
 
 // NewCertificateFromPem creates a new Certificate from a base64 encoded pem string
@@ -72,6 +76,24 @@ func NewCertificateFromPem(pem string) (*Certificate, error) {
 	return cert, nil
 }
 
+// NewCertificateFromSecret creates a new Certificate from the value of a secret in Azure Key
+// Vault, being pem for content type application/x-pem-file and base64 encoded pfx for
+// application/x-pkcs12
+func NewCertificateFromSecret(value, contentType string, ensureServerFirst bool) (*Certificate, error) {
+	switch contentType {
+	case CertificateContentTypePem:
+		return NewCertificateFromPem(value)
+	case CertificateContentTypePfx:
+		pfxRaw, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 encoded pfx, error: %+v", err)
+		}
+		return NewCertificateFromPfx(pfxRaw, ensureServerFirst)
+	default:
+		return nil, fmt.Errorf("unknown content type '%s'", contentType)
+	}
+}
+
 // NewCertificateFromPfx creates a new Certificate from a PFX certificate
 func NewCertificateFromPfx(pfx []byte, ensureServerFirst bool) (*Certificate, error) {
 	pemList, err := pkcs12.ToPEM(pfx, "")
@@ -140,6 +162,33 @@ func (cert *Certificate) ExportPrivateKeyAsPem() ([]byte, error) {
 	return pem.EncodeToMemory(privKeyBlock), nil
 }
 
+// ExportPrivateKeyAsPkcs8Pem returns the private key as a pkcs#8 pem formatted PRIVATE KEY,
+// being the same block type for rsa and ecdsa keys
+func (cert *Certificate) ExportPrivateKeyAsPkcs8Pem() ([]byte, error) {
+	if !cert.HasPrivateKey {
+		return nil, fmt.Errorf("certificate has no private key")
+	}
+
+	var key interface{}
+	switch cert.PrivateKeyType {
+	case CertificateKeyTypeRsa:
+		key = cert.PrivateKeyRsa
+	case CertificateKeyTypeEcdsa:
+		key = cert.PrivateKeyEcdsa
+	default:
+		return nil, fmt.Errorf("private key type '%s' currently not supported for pkcs#8 pem export", cert.PrivateKeyType)
+	}
+
+	derKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: derKey,
+	}), nil
+}
+
 // ExportPublicKeyAsPem returns a pem formatted certificate
 func (cert *Certificate) ExportPublicKeyAsPem() ([]byte, error) {
 	if len(cert.Certificates) == 0 {
@@ -159,6 +208,117 @@ func (cert *Certificate) ExportPublicKeyAsPem() ([]byte, error) {
 	return []byte(certs.String()), nil
 }
 
+// LeafFirst moves the leaf certificate, the first certificate in the chain not being a ca, to
+// the front of the chain, keeping the order of the other certificates
+func (cert *Certificate) LeafFirst() {
+	for i, c := range cert.Certificates {
+		if c.IsCA {
+			continue
+		}
+		if i > 0 {
+			ordered := append([]*x509.Certificate{c}, cert.Certificates[:i]...)
+			cert.Certificates = append(ordered, cert.Certificates[i+1:]...)
+		}
+		return
+	}
+}
+
+// ExportCAChainAsPem returns a pem formatted chain of the certificates after the first one,
+// which is empty for certificates without a chain
+func (cert *Certificate) ExportCAChainAsPem() []byte {
+	var certs bytes.Buffer
+	for i := 1; i < len(cert.Certificates); i++ {
+		certs.Write(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Certificates[i].Raw,
+		}))
+	}
+	return certs.Bytes()
+}
+
+// SplitChain orders the certificates from the leaf to the root by following the issuer of
+// each, whatever order they were stored in. It returns the leaf, the intermediates starting
+// with the one issuing the leaf, and the self-signed root, being nil when the chain has no root.
+func (cert *Certificate) SplitChain() (*x509.Certificate, []*x509.Certificate, *x509.Certificate, error) {
+	var leaves []*x509.Certificate
+	for _, c := range cert.Certificates {
+		issuesOther := false
+		for _, other := range cert.Certificates {
+			if other != c && isIssuedBy(other, c) {
+				issuesOther = true
+				break
+			}
+		}
+		if !issuesOther {
+			leaves = append(leaves, c)
+		}
+	}
+	if len(leaves) != 1 {
+		return nil, nil, nil, fmt.Errorf("certificate chain must have exactly one leaf certificate not issuing any other, but has %d", len(leaves))
+	}
+
+	chain := []*x509.Certificate{leaves[0]}
+	used := map[*x509.Certificate]bool{leaves[0]: true}
+	for current := leaves[0]; !isIssuedBy(current, current); {
+		var issuer *x509.Certificate
+		for _, c := range cert.Certificates {
+			if !used[c] && isIssuedBy(current, c) {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		used[issuer] = true
+		current = issuer
+	}
+	for _, c := range cert.Certificates {
+		if !used[c] {
+			return nil, nil, nil, fmt.Errorf("certificate '%s' is not part of the chain of leaf certificate '%s'", c.Subject, leaves[0].Subject)
+		}
+	}
+
+	leaf, intermediates := chain[0], chain[1:]
+	var root *x509.Certificate
+	if last := chain[len(chain)-1]; len(chain) > 1 && isIssuedBy(last, last) {
+		root, intermediates = last, intermediates[:len(intermediates)-1]
+	}
+	return leaf, intermediates, root, nil
+}
+
+// isIssuedBy tells if cert is issued and signed by issuer
+func isIssuedBy(cert, issuer *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, issuer.RawSubject) && cert.CheckSignatureFrom(issuer) == nil
+}
+
+// CertificatesAsPem returns the certificates pem formatted, in the order given
+func CertificatesAsPem(certs ...*x509.Certificate) []byte {
+	var pems bytes.Buffer
+	for _, c := range certs {
+		pems.Write(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Raw,
+		}))
+	}
+	return pems.Bytes()
+}
+
+// ExportPublicKeysAsDer returns the der encoding of each certificate in the chain, in the
+// same order as ExportPublicKeyAsPem
+func (cert *Certificate) ExportPublicKeysAsDer() ([][]byte, error) {
+	if len(cert.Certificates) == 0 {
+		return nil, fmt.Errorf("certificate has no public key")
+	}
+
+	ders := make([][]byte, 0, len(cert.Certificates))
+	for _, pubCert := range cert.Certificates {
+		ders = append(ders, pubCert.Raw)
+	}
+	return ders, nil
+}
+
 // ExportRaw returns the raw format of the original certificate
 func (cert *Certificate) ExportRaw() []byte {
 	return cert.raw
@@ -17,25 +17,46 @@ limitations under the License.
 package fake
 
 import (
+	"time"
+
 	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
 	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
 )
 
 // AkvsService is a fake service used for testing
 type AkvsService struct {
-	FakeSecret string
-	FakeKey    string
-	FakeCert   *vault.Certificate
+	FakeSecret      string
+	FakeKey         string
+	FakeKeyMaterial *vault.Key
+	FakeCert        *vault.Certificate
+	FakeRenewalTime *time.Time
+	FakeVersions    []vault.ObjectVersion
 }
 
 func (s *AkvsService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
 	return s.FakeSecret, nil
 }
 
+func (s *AkvsService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	return s.FakeSecret, nil, nil
+}
+
 func (s *AkvsService) GetKey(secret *akv.AzureKeyVault) (string, error) {
 	return s.FakeKey, nil
 }
 
+func (s *AkvsService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	return s.FakeKeyMaterial, nil
+}
+
 func (s *AkvsService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (*vault.Certificate, error) {
 	return s.FakeCert, nil
 }
+
+func (s *AkvsService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (*time.Time, error) {
+	return s.FakeRenewalTime, nil
+}
+
+func (s *AkvsService) GetObjectVersions(secret *akv.AzureKeyVault) ([]vault.ObjectVersion, error) {
+	return s.FakeVersions, nil
+}
@@ -0,0 +1,272 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+const (
+	kindSecret      = "secrets"
+	kindKey         = "keys"
+	kindCertificate = "certificates"
+)
+
+// InMemoryService is a vault service keeping objects in memory, for testing the controller
+// without Azure Key Vault. Like Azure Key Vault, each object set is a new version of the
+// object, reading without a version returns the newest version, and reading a missing object
+// or a disabled version fails with the response error Azure Key Vault would return.
+type InMemoryService struct {
+	mu      sync.Mutex
+	objects map[string][]*memoryObject
+	last    time.Time
+}
+
+type memoryObject struct {
+	version   string
+	enabled   bool
+	created   time.Time
+	notBefore time.Time
+	expires   time.Time
+	value     interface{}
+}
+
+var _ vault.Service = &InMemoryService{}
+
+// NewInMemoryService returns an InMemoryService without any objects
+func NewInMemoryService() *InMemoryService {
+	return &InMemoryService{objects: make(map[string][]*memoryObject)}
+}
+
+// SetSecret adds value as a new version of the secret name in vaultName, and returns the version
+func (s *InMemoryService) SetSecret(vaultName, name, value string) string {
+	return s.set(vaultName, kindSecret, name, value)
+}
+
+// SetKey adds key as a new version of the key name in vaultName, and returns the version
+func (s *InMemoryService) SetKey(vaultName, name string, key *vault.Key) string {
+	return s.set(vaultName, kindKey, name, key)
+}
+
+// SetCertificate adds cert as a new version of the certificate name in vaultName, and returns
+// the version
+func (s *InMemoryService) SetCertificate(vaultName, name string, cert *vault.Certificate) string {
+	return s.set(vaultName, kindCertificate, name, cert)
+}
+
+// DisableVersion disables version of the object name in vaultName, whatever its type. Fails if
+// there is no such version.
+func (s *InMemoryService) DisableVersion(vaultName, name, version string) error {
+	return s.update(vaultName, name, version, func(object *memoryObject) {
+		object.enabled = false
+	})
+}
+
+// SetVersionAttributes sets when version of the object name in vaultName becomes valid and
+// when it expires, whatever its type. Zero times leave the attribute unset. Fails if there is
+// no such version.
+func (s *InMemoryService) SetVersionAttributes(vaultName, name, version string, notBefore, expires time.Time) error {
+	return s.update(vaultName, name, version, func(object *memoryObject) {
+		object.notBefore = notBefore
+		object.expires = expires
+	})
+}
+
+func (s *InMemoryService) update(vaultName, name, version string, fn func(*memoryObject)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, kind := range []string{kindSecret, kindKey, kindCertificate} {
+		for _, object := range s.objects[objectKey(vaultName, kind, name)] {
+			if object.version == version {
+				fn(object)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("version '%s' of object '%s' not found in vault '%s'", version, name, vaultName)
+}
+
+func (s *InMemoryService) set(vaultName, kind, name string, value interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// versions are ordered by when they were created, so they must never be created at the same time
+	created := time.Now()
+	if !created.After(s.last) {
+		created = s.last.Add(time.Nanosecond)
+	}
+	s.last = created
+
+	object := &memoryObject{version: newVersion(), enabled: true, created: created, value: value}
+	key := objectKey(vaultName, kind, name)
+	s.objects[key] = append(s.objects[key], object)
+	return object.version
+}
+
+func (s *InMemoryService) get(vaultSpec *akv.AzureKeyVault, kind string) (*memoryObject, error) {
+	if vaultSpec.Object.Name == "" {
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.objects[objectKey(vaultSpec.Name, kind, vaultSpec.Object.Name)]
+	var found *memoryObject
+	if vaultSpec.Object.Version == "" && len(versions) > 0 {
+		found = versions[len(versions)-1]
+	}
+	for _, object := range versions {
+		if object.version == vaultSpec.Object.Version {
+			found = object
+		}
+	}
+
+	if found == nil {
+		return nil, responseError(vaultSpec, kind, http.StatusNotFound)
+	}
+	if !found.enabled {
+		return nil, responseError(vaultSpec, kind, http.StatusForbidden)
+	}
+	return found, nil
+}
+
+func (s *InMemoryService) GetSecret(secret *akv.AzureKeyVault) (string, error) {
+	value, _, err := s.GetSecretWithMetadata(secret)
+	return value, err
+}
+
+func (s *InMemoryService) GetSecretWithMetadata(secret *akv.AzureKeyVault) (string, *vault.ObjectMetadata, error) {
+	object, err := s.get(secret, kindSecret)
+	if err != nil {
+		return "", nil, err
+	}
+	return object.value.(string), object.metadata(), nil
+}
+
+// GetKey returns the modulus of an rsa key, like the Azure Key Vault service
+func (s *InMemoryService) GetKey(secret *akv.AzureKeyVault) (string, error) {
+	object, err := s.get(secret, kindKey)
+	if err != nil {
+		return "", err
+	}
+	key := object.value.(*vault.Key)
+	if key.PublicKeyRsa == nil {
+		return "", fmt.Errorf("key '%s' has no modulus, as it is not an rsa key", secret.Object.Name)
+	}
+	return string(key.PublicKeyRsa.N.Bytes()), nil
+}
+
+func (s *InMemoryService) GetKeyMaterial(secret *akv.AzureKeyVault) (*vault.Key, error) {
+	object, err := s.get(secret, kindKey)
+	if err != nil {
+		return nil, err
+	}
+	key := *object.value.(*vault.Key)
+	key.Metadata = object.metadata()
+	return &key, nil
+}
+
+// GetCertificate returns the certificate as it was set, so it only has a private key if set
+// with one, whatever options are given
+func (s *InMemoryService) GetCertificate(secret *akv.AzureKeyVault, options *vault.CertificateOptions) (*vault.Certificate, error) {
+	object, err := s.get(secret, kindCertificate)
+	if err != nil {
+		return nil, err
+	}
+	cert := *object.value.(*vault.Certificate)
+	// the chain is reordered by handlers, which must not change the certificate kept
+	cert.Certificates = append(cert.Certificates[:0:0], cert.Certificates...)
+	cert.Metadata = object.metadata()
+	return &cert, nil
+}
+
+// GetCertificateRenewalTime returns no renewal time, as certificates are not issued
+func (s *InMemoryService) GetCertificateRenewalTime(secret *akv.AzureKeyVault) (*time.Time, error) {
+	if _, err := s.get(secret, kindCertificate); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *InMemoryService) GetObjectVersions(secret *akv.AzureKeyVault) ([]vault.ObjectVersion, error) {
+	var kind string
+	switch secret.Object.Type {
+	case akv.AzureKeyVaultObjectTypeSecret, akv.AzureKeyVaultObjectTypeMultiKeyValueSecret:
+		kind = kindSecret
+	case akv.AzureKeyVaultObjectTypeCertificate:
+		kind = kindCertificate
+	case akv.AzureKeyVaultObjectTypeKey:
+		kind = kindKey
+	default:
+		return nil, fmt.Errorf("listing versions of azure key vault object type '%s' is not supported", secret.Object.Type)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects := s.objects[objectKey(secret.Name, kind, secret.Object.Name)]
+	if len(objects) == 0 {
+		return nil, responseError(secret, kind, http.StatusNotFound)
+	}
+	versions := make([]vault.ObjectVersion, 0, len(objects))
+	for _, object := range objects {
+		versions = append(versions, vault.ObjectVersion{
+			Version: object.version,
+			Enabled: object.enabled,
+			Created: object.created,
+			Updated: object.created,
+		})
+	}
+	return versions, nil
+}
+
+func (o *memoryObject) metadata() *vault.ObjectMetadata {
+	return &vault.ObjectMetadata{Version: o.version, Updated: o.created, NotBefore: o.notBefore, Expires: o.expires}
+}
+
+func objectKey(vaultName, kind, name string) string {
+	return vaultName + "/" + kind + "/" + name
+}
+
+func newVersion() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// responseError returns the error Azure Key Vault responds with for the object in vaultSpec
+func responseError(vaultSpec *akv.AzureKeyVault, kind string, statusCode int) error {
+	url := fmt.Sprintf("https://%s.vault.azure.net/%s/%s/%s", vaultSpec.Name, kind, vaultSpec.Object.Name, vaultSpec.Object.Version)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	return &azcore.ResponseError{
+		StatusCode:  statusCode,
+		RawResponse: &http.Response{StatusCode: statusCode, Request: req},
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	vault "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/azure/keyvault/client"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+func secretSpec(version string) *akv.AzureKeyVault {
+	return &akv.AzureKeyVault{
+		Name:   "my-vault",
+		Object: akv.AzureKeyVaultObject{Name: "my-secret", Type: akv.AzureKeyVaultObjectTypeSecret, Version: version},
+	}
+}
+
+func statusCode(err error) int {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode
+	}
+	return 0
+}
+
+func TestInMemoryServiceSecretVersions(t *testing.T) {
+	service := NewInMemoryService()
+	first := service.SetSecret("my-vault", "my-secret", "first")
+	second := service.SetSecret("my-vault", "my-secret", "second")
+
+	value, metadata, err := service.GetSecretWithMetadata(secretSpec(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "second" || metadata.Version != second {
+		t.Errorf("expected latest version '%s' with value 'second', but got version '%s' with value '%s'", second, metadata.Version, value)
+	}
+
+	if value, err = service.GetSecret(secretSpec(first)); err != nil || value != "first" {
+		t.Errorf("expected value 'first' of version '%s', but got '%s' (error: %v)", first, value, err)
+	}
+
+	versions, err := service.GetObjectVersions(secretSpec(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := vault.CurrentVersion(versions)
+	if err != nil || current.Version != second {
+		t.Errorf("expected current version '%s', but got '%s' (error: %v)", second, current.Version, err)
+	}
+
+	if err = service.DisableVersion("my-vault", "my-secret", first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.GetSecret(secretSpec(first)); statusCode(err) != http.StatusForbidden {
+		t.Errorf("expected forbidden reading disabled version, but got %v", err)
+	}
+}
+
+func TestInMemoryServiceNotFound(t *testing.T) {
+	service := NewInMemoryService()
+	service.SetSecret("other-vault", "my-secret", "value")
+
+	if _, err := service.GetSecret(secretSpec("")); statusCode(err) != http.StatusNotFound {
+		t.Errorf("expected not found, but got %v", err)
+	}
+	if _, err := service.GetCertificate(secretSpec(""), nil); statusCode(err) != http.StatusNotFound {
+		t.Errorf("expected not found for certificate with the name of a secret, but got %v", err)
+	}
+}
+
+func TestInMemoryServiceVersionAttributes(t *testing.T) {
+	service := NewInMemoryService()
+	version := service.SetSecret("my-vault", "my-secret", "value")
+	notBefore := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := notBefore.AddDate(1, 0, 0)
+
+	if err := service.SetVersionAttributes("my-vault", "my-secret", version, notBefore, expires); err != nil {
+		t.Fatal(err)
+	}
+	_, metadata, err := service.GetSecretWithMetadata(secretSpec(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.NotBefore.Equal(notBefore) || !metadata.Expires.Equal(expires) {
+		t.Errorf("expected not before %s and expiry %s, but got %s and %s", notBefore, expires, metadata.NotBefore, metadata.Expires)
+	}
+
+	if err = service.SetVersionAttributes("my-vault", "my-secret", "missing", notBefore, expires); err == nil {
+		t.Error("expected error setting attributes of a missing version")
+	}
+}
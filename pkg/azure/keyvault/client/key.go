@@ -0,0 +1,252 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+)
+
+// Key handles data on Keys from Azure Key Vault
+type Key struct {
+	PublicKeyRsa   *rsa.PublicKey
+	PublicKeyEcdsa *ecdsa.PublicKey
+
+	PrivateKeyRsa   *rsa.PrivateKey
+	PrivateKeyEcdsa *ecdsa.PrivateKey
+
+	KeyType CertificateKeyType
+
+	// Indicate if Key has private key material
+	HasPrivateKey bool
+
+	// Version of the key read from Azure Key Vault, nil if not read from Azure Key Vault
+	Metadata *ObjectMetadata
+}
+
+// NewKeyFromJSONWebKey creates a new Key from a Azure Key Vault json web key
+func NewKeyFromJSONWebKey(jwk *azkeys.JSONWebKey) (*Key, error) {
+	if jwk == nil || jwk.Kty == nil {
+		return nil, fmt.Errorf("json web key has no key type")
+	}
+
+	var key Key
+	switch string(*jwk.Kty) {
+	case "RSA", "RSA-HSM":
+		if len(jwk.N) == 0 || len(jwk.E) == 0 {
+			return nil, fmt.Errorf("rsa json web key is missing modulus or exponent")
+		}
+		key.KeyType = CertificateKeyTypeRsa
+		key.PublicKeyRsa = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(jwk.N),
+			E: int(new(big.Int).SetBytes(jwk.E).Int64()),
+		}
+
+		if len(jwk.D) > 0 && len(jwk.P) > 0 && len(jwk.Q) > 0 {
+			privKey := &rsa.PrivateKey{
+				PublicKey: *key.PublicKeyRsa,
+				D:         new(big.Int).SetBytes(jwk.D),
+				Primes:    []*big.Int{new(big.Int).SetBytes(jwk.P), new(big.Int).SetBytes(jwk.Q)},
+			}
+			if err := privKey.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid rsa private key in json web key, error: %+v", err)
+			}
+			privKey.Precompute()
+			key.PrivateKeyRsa = privKey
+			key.HasPrivateKey = true
+		}
+
+	case "EC", "EC-HSM":
+		if jwk.Crv == nil {
+			return nil, fmt.Errorf("ec json web key has no curve")
+		}
+		var curve elliptic.Curve
+		switch string(*jwk.Crv) {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ec curve '%s' currently not supported", *jwk.Crv)
+		}
+		key.KeyType = CertificateKeyTypeEcdsa
+		key.PublicKeyEcdsa = &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(jwk.X),
+			Y:     new(big.Int).SetBytes(jwk.Y),
+		}
+
+		if len(jwk.D) > 0 {
+			key.PrivateKeyEcdsa = &ecdsa.PrivateKey{
+				PublicKey: *key.PublicKeyEcdsa,
+				D:         new(big.Int).SetBytes(jwk.D),
+			}
+			key.HasPrivateKey = true
+		}
+
+	default:
+		return nil, fmt.Errorf("key type '%s' currently not supported", *jwk.Kty)
+	}
+
+	return &key, nil
+}
+
+// ExportPublicKeyAsDer returns the public key as PKIX der bytes
+func (key *Key) ExportPublicKeyAsDer() ([]byte, error) {
+	switch key.KeyType {
+	case CertificateKeyTypeRsa:
+		return x509.MarshalPKIXPublicKey(key.PublicKeyRsa)
+	case CertificateKeyTypeEcdsa:
+		return x509.MarshalPKIXPublicKey(key.PublicKeyEcdsa)
+	default:
+		return nil, fmt.Errorf("key type '%s' currently not supported for export", key.KeyType)
+	}
+}
+
+// ExportPublicKeyAsPem returns a pem formatted public key
+func (key *Key) ExportPublicKeyAsPem() ([]byte, error) {
+	derKey, err := key.ExportPublicKeyAsDer()
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyBlock := &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: derKey,
+	}
+	return pem.EncodeToMemory(pubKeyBlock), nil
+}
+
+// ExportPrivateKeyAsDer returns the private key as PKCS#1 (rsa) or SEC 1 (ecdsa) der bytes
+func (key *Key) ExportPrivateKeyAsDer() ([]byte, error) {
+	if !key.HasPrivateKey {
+		return nil, fmt.Errorf("key has no private key material")
+	}
+
+	switch key.KeyType {
+	case CertificateKeyTypeRsa:
+		return x509.MarshalPKCS1PrivateKey(key.PrivateKeyRsa), nil
+	case CertificateKeyTypeEcdsa:
+		return x509.MarshalECPrivateKey(key.PrivateKeyEcdsa)
+	default:
+		return nil, fmt.Errorf("private key type '%s' currently not supported for export", key.KeyType)
+	}
+}
+
+// ExportPrivateKeyAsPem returns a pem formatted private key
+func (key *Key) ExportPrivateKeyAsPem() ([]byte, error) {
+	derKey, err := key.ExportPrivateKeyAsDer()
+	if err != nil {
+		return nil, err
+	}
+
+	keyType := "RSA PRIVATE KEY"
+	if key.KeyType == CertificateKeyTypeEcdsa {
+		keyType = "EC PRIVATE KEY"
+	}
+
+	privKeyBlock := &pem.Block{
+		Type:  keyType,
+		Bytes: derKey,
+	}
+	return pem.EncodeToMemory(privKeyBlock), nil
+}
+
+// ExportPrivateKeyAsPkcs8Der returns the private key as PKCS#8 der bytes, for both rsa and ecdsa
+func (key *Key) ExportPrivateKeyAsPkcs8Der() ([]byte, error) {
+	if !key.HasPrivateKey {
+		return nil, fmt.Errorf("key has no private key material")
+	}
+
+	switch key.KeyType {
+	case CertificateKeyTypeRsa:
+		return x509.MarshalPKCS8PrivateKey(key.PrivateKeyRsa)
+	case CertificateKeyTypeEcdsa:
+		return x509.MarshalPKCS8PrivateKey(key.PrivateKeyEcdsa)
+	default:
+		return nil, fmt.Errorf("private key type '%s' currently not supported for export", key.KeyType)
+	}
+}
+
+// ExportPrivateKeyAsPkcs8Pem returns the private key as a pkcs#8 pem formatted PRIVATE KEY
+func (key *Key) ExportPrivateKeyAsPkcs8Pem() ([]byte, error) {
+	derKey, err := key.ExportPrivateKeyAsPkcs8Der()
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyBlock := &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: derKey,
+	}
+	return pem.EncodeToMemory(privKeyBlock), nil
+}
+
+// JSONWebKey is the public part of a key as a json web key, as described in RFC 7517 and RFC 7518
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of json web keys, as served by JWKS endpoints
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// ExportPublicKeyAsJWK returns the public key as a json web key identified by kid. Private key
+// material is never included.
+func (key *Key) ExportPublicKeyAsJWK(kid string) (JSONWebKey, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch key.KeyType {
+	case CertificateKeyTypeRsa:
+		return JSONWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			N:   encode(key.PublicKeyRsa.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.PublicKeyRsa.E)).Bytes()),
+		}, nil
+	case CertificateKeyTypeEcdsa:
+		params := key.PublicKeyEcdsa.Curve.Params()
+		// coordinates are padded to the size of the curve, see RFC 7518 section 6.2.1
+		size := (params.BitSize + 7) / 8
+		return JSONWebKey{
+			Kty: "EC",
+			Kid: kid,
+			Crv: params.Name,
+			X:   encode(key.PublicKeyEcdsa.X.FillBytes(make([]byte, size))),
+			Y:   encode(key.PublicKeyEcdsa.Y.FillBytes(make([]byte, size))),
+		}, nil
+	default:
+		return JSONWebKey{}, fmt.Errorf("key type '%s' currently not supported for export", key.KeyType)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+)
+
+func rsaJSONWebKey(t *testing.T, includePrivate bool) (*azkeys.JSONWebKey, *rsa.PrivateKey) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kty := azkeys.JSONWebKeyType("RSA")
+	jwk := &azkeys.JSONWebKey{
+		Kty: &kty,
+		N:   privKey.N.Bytes(),
+		E:   big.NewInt(int64(privKey.E)).Bytes(),
+	}
+	if includePrivate {
+		jwk.D = privKey.D.Bytes()
+		jwk.P = privKey.Primes[0].Bytes()
+		jwk.Q = privKey.Primes[1].Bytes()
+	}
+	return jwk, privKey
+}
+
+func ecJSONWebKey(t *testing.T) (*azkeys.JSONWebKey, *ecdsa.PrivateKey) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kty := azkeys.JSONWebKeyType("EC")
+	crv := azkeys.JSONWebKeyCurveName("P-256")
+	return &azkeys.JSONWebKey{
+		Kty: &kty,
+		Crv: &crv,
+		X:   privKey.X.Bytes(),
+		Y:   privKey.Y.Bytes(),
+		D:   privKey.D.Bytes(),
+	}, privKey
+}
+
+func TestKeyFromRsaJSONWebKeyPublicOnly(t *testing.T) {
+	jwk, privKey := rsaJSONWebKey(t, false)
+
+	key, err := NewKeyFromJSONWebKey(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.HasPrivateKey {
+		t.Error("key should not have private key material")
+	}
+
+	der, err := key.ExportPublicKeyAsDer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.PublicKey.Equal(pub) {
+		t.Error("exported public key does not match original key")
+	}
+
+	if _, err := key.ExportPrivateKeyAsPem(); err == nil {
+		t.Error("exporting private key should fail when key has no private key material")
+	}
+}
+
+func TestKeyFromRsaJSONWebKeyWithPrivateKey(t *testing.T) {
+	jwk, privKey := rsaJSONWebKey(t, true)
+
+	key, err := NewKeyFromJSONWebKey(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.HasPrivateKey {
+		t.Fatal("key should have private key material")
+	}
+
+	pemKey, err := key.ExportPrivateKeyAsPem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		t.Fatal("expected pem block of type 'RSA PRIVATE KEY'")
+	}
+	parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("exported private key does not match original key")
+	}
+}
+
+func TestKeyFromEcJSONWebKey(t *testing.T) {
+	jwk, privKey := ecJSONWebKey(t)
+
+	key, err := NewKeyFromJSONWebKey(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyType != CertificateKeyTypeEcdsa {
+		t.Errorf("expected key type '%s', but got '%s'", CertificateKeyTypeEcdsa, key.KeyType)
+	}
+
+	pemKey, err := key.ExportPublicKeyAsPem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		t.Fatal("expected pem block of type 'PUBLIC KEY'")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.PublicKey.Equal(pub) {
+		t.Error("exported public key does not match original key")
+	}
+
+	der, err := key.ExportPrivateKeyAsDer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("exported private key does not match original key")
+	}
+}
+
+func TestKeyFromUnsupportedJSONWebKey(t *testing.T) {
+	kty := azkeys.JSONWebKeyType("oct")
+	if _, err := NewKeyFromJSONWebKey(&azkeys.JSONWebKey{Kty: &kty}); err == nil {
+		t.Error("symmetric keys should not be supported")
+	}
+}
+
+func TestExportEcKeyAsPkcs8(t *testing.T) {
+	jwk, privKey := ecJSONWebKey(t)
+
+	key, err := NewKeyFromJSONWebKey(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemKey, err := key.ExportPrivateKeyAsPkcs8Pem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatal("expected pem block of type 'PRIVATE KEY'")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !privKey.Equal(parsed) {
+		t.Error("exported private key does not match original key")
+	}
+}
+
+func TestExportPublicKeyAsJWK(t *testing.T) {
+	rsaJwk, rsaKey := rsaJSONWebKey(t, true)
+	key, err := NewKeyFromJSONWebKey(rsaJwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := key.ExportPublicKeyAsJWK("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+	if jwk.Kty != "RSA" || jwk.Kid != "v1" || new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(rsaKey.E) {
+		t.Errorf("expected rsa json web key with kid v1 matching the original key, but got %+v", jwk)
+	}
+
+	ecJwk, _ := ecJSONWebKey(t)
+	key, err = NewKeyFromJSONWebKey(ecJwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a coordinate with leading zero bytes must still be written as 32 bytes for P-256
+	key.PublicKeyEcdsa.X = new(big.Int).Rsh(key.PublicKeyEcdsa.X, 8)
+	jwk, err = key.ExportPublicKeyAsJWK("v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Kid != "v2" || len(x) != 32 {
+		t.Errorf("expected P-256 json web key with kid v2 and 32 byte coordinates, but got %+v", jwk)
+	}
+
+	out, err := json.Marshal(jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["d"]; ok {
+		t.Error("expected no private key material in json web key")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azcertificates"
+)
+
+// issuerUnknown is the issuer used by Azure Key Vault for imported certificates
+// and certificates not issued through Key Vault, which are never renewed automatically
+const issuerUnknown = "Unknown"
+
+// PredictCertificateRenewal returns when Azure Key Vault is expected to renew a
+// certificate valid from notBefore to expires, according to the auto renew
+// lifetime actions in policy. Nil is returned if the certificate is not renewed
+// automatically.
+func PredictCertificateRenewal(notBefore, expires *time.Time, policy *azcertificates.CertificatePolicy) *time.Time {
+	if notBefore == nil || expires == nil || policy == nil {
+		return nil
+	}
+	if policy.IssuerParameters != nil && policy.IssuerParameters.Name != nil && *policy.IssuerParameters.Name == issuerUnknown {
+		return nil
+	}
+
+	var renewal *time.Time
+	for _, action := range policy.LifetimeActions {
+		if action == nil || action.Action == nil || action.Action.ActionType == nil || action.Trigger == nil {
+			continue
+		}
+		if *action.Action.ActionType != azcertificates.CertificatePolicyActionAutoRenew {
+			continue
+		}
+
+		var at time.Time
+		switch {
+		case action.Trigger.LifetimePercentage != nil:
+			lifetime := expires.Sub(*notBefore)
+			at = notBefore.Add(lifetime * time.Duration(*action.Trigger.LifetimePercentage) / 100)
+		case action.Trigger.DaysBeforeExpiry != nil:
+			at = expires.Add(-time.Duration(*action.Trigger.DaysBeforeExpiry) * 24 * time.Hour)
+		default:
+			continue
+		}
+
+		if renewal == nil || at.Before(*renewal) {
+			renewal = &at
+		}
+	}
+	return renewal
+}
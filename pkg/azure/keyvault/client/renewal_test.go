@@ -0,0 +1,89 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azcertificates"
+)
+
+func lifetimeAction(action azcertificates.CertificatePolicyAction, trigger *azcertificates.Trigger) *azcertificates.LifetimeAction {
+	return &azcertificates.LifetimeAction{
+		Action:  &azcertificates.Action{ActionType: &action},
+		Trigger: trigger,
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestPredictCertificateRenewal(t *testing.T) {
+	notBefore := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := notBefore.Add(100 * 24 * time.Hour)
+
+	policy := &azcertificates.CertificatePolicy{
+		LifetimeActions: []*azcertificates.LifetimeAction{
+			lifetimeAction(azcertificates.CertificatePolicyActionEmailContacts, &azcertificates.Trigger{LifetimePercentage: int32Ptr(50)}),
+			lifetimeAction(azcertificates.CertificatePolicyActionAutoRenew, &azcertificates.Trigger{LifetimePercentage: int32Ptr(80)}),
+		},
+	}
+
+	renewal := PredictCertificateRenewal(&notBefore, &expires, policy)
+	expected := notBefore.Add(80 * 24 * time.Hour)
+	if renewal == nil || !renewal.Equal(expected) {
+		t.Errorf("expected renewal at %s, but got %v", expected, renewal)
+	}
+
+	policy.LifetimeActions = append(policy.LifetimeActions, lifetimeAction(azcertificates.CertificatePolicyActionAutoRenew, &azcertificates.Trigger{DaysBeforeExpiry: int32Ptr(30)}))
+	renewal = PredictCertificateRenewal(&notBefore, &expires, policy)
+	expected = expires.Add(-30 * 24 * time.Hour)
+	if renewal == nil || !renewal.Equal(expected) {
+		t.Errorf("expected earliest renewal at %s, but got %v", expected, renewal)
+	}
+}
+
+func TestPredictCertificateRenewalWithoutAutoRenew(t *testing.T) {
+	notBefore := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := notBefore.Add(100 * 24 * time.Hour)
+
+	if renewal := PredictCertificateRenewal(&notBefore, &expires, nil); renewal != nil {
+		t.Errorf("expected no renewal without policy, but got %s", renewal)
+	}
+
+	issuer := issuerUnknown
+	imported := &azcertificates.CertificatePolicy{
+		IssuerParameters: &azcertificates.IssuerParameters{Name: &issuer},
+		LifetimeActions: []*azcertificates.LifetimeAction{
+			lifetimeAction(azcertificates.CertificatePolicyActionAutoRenew, &azcertificates.Trigger{LifetimePercentage: int32Ptr(80)}),
+		},
+	}
+	if renewal := PredictCertificateRenewal(&notBefore, &expires, imported); renewal != nil {
+		t.Errorf("expected no renewal for imported certificate, but got %s", renewal)
+	}
+
+	emailOnly := &azcertificates.CertificatePolicy{
+		LifetimeActions: []*azcertificates.LifetimeAction{
+			lifetimeAction(azcertificates.CertificatePolicyActionEmailContacts, &azcertificates.Trigger{DaysBeforeExpiry: int32Ptr(30)}),
+		},
+	}
+	if renewal := PredictCertificateRenewal(&notBefore, &expires, emailOnly); renewal != nil {
+		t.Errorf("expected no renewal when policy only emails contacts, but got %s", renewal)
+	}
+}
@@ -18,8 +18,10 @@ package client
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azcertificates"
@@ -30,15 +32,34 @@ import (
 )
 
 const (
-	certificateTypePem string = "application/x-pem-file"
-	certificateTypePfx string = "application/x-pkcs12"
+	// CertificateContentTypePem is the content type of secrets holding a pem certificate
+	CertificateContentTypePem string = "application/x-pem-file"
+	// CertificateContentTypePfx is the content type of secrets holding a base64 encoded pfx
+	CertificateContentTypePfx string = "application/x-pkcs12"
 )
 
-// Service is an interface for implementing vaults
+// ErrCertificateNotExportable is returned when the private key of a certificate is requested,
+// but the key policy of the certificate in Azure Key Vault does not allow exporting it
+var ErrCertificateNotExportable = errors.New("cannot export private key because key is not exportable in azure key vault")
+
+// Service is an interface for implementing vaults. Each method reads the object named in
+// secret.Object from the vault in secret.Name, at secret.Object.Version or else the latest
+// version. See the fake package for an in-memory implementation for testing.
 type Service interface {
+	// GetSecret returns the value of a secret
 	GetSecret(secret *akvs.AzureKeyVault) (string, error)
+	// GetSecretWithMetadata returns the value of a secret and the version read
+	GetSecretWithMetadata(secret *akvs.AzureKeyVault) (string, *ObjectMetadata, error)
+	// GetKey returns the modulus of an rsa key
 	GetKey(secret *akvs.AzureKeyVault) (string, error)
+	// GetKeyMaterial returns the public key, and private key if any, of a key
+	GetKeyMaterial(secret *akvs.AzureKeyVault) (*Key, error)
+	// GetCertificate returns a certificate, with its private key if options.ExportPrivateKey is set
 	GetCertificate(secret *akvs.AzureKeyVault, options *CertificateOptions) (*Certificate, error)
+	// GetCertificateRenewalTime returns when a certificate is renewed according to its policy, if known
+	GetCertificateRenewalTime(secret *akvs.AzureKeyVault) (*time.Time, error)
+	// GetObjectVersions lists all versions of an object
+	GetObjectVersions(secret *akvs.AzureKeyVault) ([]ObjectVersion, error)
 }
 
 // CertificateOptions has options for exporting certificate
@@ -47,9 +68,15 @@ type CertificateOptions struct {
 	EnsureServerFirst bool
 }
 
+// VaultCredentials returns credentials for vaults not accessed using the default credentials
+type VaultCredentials interface {
+	CredentialsFor(vaultName string) (azure.LegacyTokenCredential, bool)
+}
+
 type azureKeyVaultService struct {
 	credentials       azure.LegacyTokenCredential
 	keyVaultDNSSuffix string
+	vaultCredentials  VaultCredentials
 }
 
 // NewService creates a new AzureKeyVaultService
@@ -60,32 +87,85 @@ func NewService(creds azure.LegacyTokenCredential, keyVaultDNSSuffix string) Ser
 	}
 }
 
-func (a *azureKeyVaultService) vaultNameToURL(name string) string {
+// NewServiceWithVaultCredentials creates a new AzureKeyVaultService using vaultCredentials
+// for the vaults it has credentials for, and creds for all other vaults
+func NewServiceWithVaultCredentials(creds azure.LegacyTokenCredential, keyVaultDNSSuffix string, vaultCredentials VaultCredentials) Service {
+	return &azureKeyVaultService{
+		credentials:       creds,
+		keyVaultDNSSuffix: keyVaultDNSSuffix,
+		vaultCredentials:  vaultCredentials,
+	}
+}
+
+// credentialsFor returns the credentials for the vault in vaultSpec. Vaults set by uri are
+// matched against the vault credentials by the first label of their host name.
+func (a *azureKeyVaultService) credentialsFor(vaultSpec *akvs.AzureKeyVault) azure.LegacyTokenCredential {
+	if a.vaultCredentials != nil {
+		vaultName := vaultSpec.Name
+		if vaultSpec.URI != "" {
+			if uri, err := url.Parse(vaultSpec.URI); err == nil {
+				vaultName = strings.SplitN(uri.Hostname(), ".", 2)[0]
+			}
+		}
+		if creds, ok := a.vaultCredentials.CredentialsFor(vaultName); ok {
+			return creds
+		}
+	}
+	return a.credentials
+}
+
+// vaultURL returns the URI of the vault in vaultSpec if set. Otherwise the URL is built
+// from its name, using the DNS suffix of its Azure environment if set, and the DNS suffix
+// of the service otherwise. Unknown environments are rejected by the CRD, so they fall back
+// to the DNS suffix of the service.
+func (a *azureKeyVaultService) vaultURL(vaultSpec *akvs.AzureKeyVault) string {
+	if vaultSpec.URI != "" {
+		return strings.TrimSuffix(vaultSpec.URI, "/")
+	}
 	suffix := a.keyVaultDNSSuffix
+	if vaultSpec.AzureEnvironment != "" {
+		if env, err := azure.EnvironmentFromName(string(vaultSpec.AzureEnvironment)); err == nil {
+			suffix = env.KeyVaultDNSSuffix
+		}
+	}
 	if suffix == "" {
 		suffix = "vault.azure.net"
 	}
-	return fmt.Sprintf("https://%s.%s", name, suffix)
+	return fmt.Sprintf("https://%s.%s", vaultSpec.Name, suffix)
 }
 
 // GetSecret download secrets from Azure Key Vault
 func (a *azureKeyVaultService) GetSecret(vaultSpec *akvs.AzureKeyVault) (string, error) {
+	value, _, err := a.GetSecretWithMetadata(vaultSpec)
+	return value, err
+}
+
+// GetSecretWithMetadata download secrets from Azure Key Vault along with the version read
+func (a *azureKeyVaultService) GetSecretWithMetadata(vaultSpec *akvs.AzureKeyVault) (string, *ObjectMetadata, error) {
 	if vaultSpec.Object.Name == "" {
-		return "", fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+		return "", nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
 	}
 
-	client, err := azsecrets.NewClient(a.vaultNameToURL(vaultSpec.Name), a.credentials, nil)
+	client, err := azsecrets.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	response, err := client.GetSecret(ctx, vaultSpec.Object.Name, vaultSpec.Object.Version, &azsecrets.GetSecretOptions{})
 
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	var metadata *ObjectMetadata
+	if response.ID != nil && response.Attributes != nil {
+		metadata = newObjectMetadata(a.vaultURL(vaultSpec), response.ID, response.Attributes.NotBefore, response.Attributes.Expires, response.Attributes.Updated)
+		if response.ContentType != nil {
+			metadata.ContentType = *response.ContentType
+		}
 	}
-	return *response.Value, nil
+	return *response.Value, metadata, nil
 }
 
 // GetKey download encryption keys from Azure Key Vault
@@ -94,7 +174,7 @@ func (a *azureKeyVaultService) GetKey(vaultSpec *akvs.AzureKeyVault) (string, er
 		return "", fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
 	}
 
-	client, err := azkeys.NewClient(a.vaultNameToURL(vaultSpec.Name), a.credentials, nil)
+	client, err := azkeys.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
 	if err != nil {
 		return "", err
 	}
@@ -111,13 +191,41 @@ func (a *azureKeyVaultService) GetKey(vaultSpec *akvs.AzureKeyVault) (string, er
 	return string(*data), nil
 }
 
+// GetKeyMaterial download encryption keys from Azure Key Vault as parsed key material
+func (a *azureKeyVaultService) GetKeyMaterial(vaultSpec *akvs.AzureKeyVault) (*Key, error) {
+	if vaultSpec.Object.Name == "" {
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+	}
+
+	client, err := azkeys.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	response, err := client.GetKey(ctx, vaultSpec.Object.Name, vaultSpec.Object.Version, &azkeys.GetKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewKeyFromJSONWebKey(response.Key)
+	if err != nil {
+		return nil, err
+	}
+	if response.Key.KID != nil && response.Attributes != nil {
+		key.Metadata = newObjectMetadata(a.vaultURL(vaultSpec), response.Key.KID, response.Attributes.NotBefore, response.Attributes.Expires, response.Attributes.Updated)
+	}
+	return key, nil
+}
+
 // GetCertificate download public/private certificates from Azure Key Vault
 func (a *azureKeyVaultService) GetCertificate(vaultSpec *akvs.AzureKeyVault, options *CertificateOptions) (*Certificate, error) {
-	client, err := azcertificates.NewClient(a.vaultNameToURL(vaultSpec.Name), a.credentials, &azcertificates.ClientOptions{})
+	client, err := azcertificates.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), &azcertificates.ClientOptions{})
 	if err != nil {
 		return nil, err
 	}
-	clientSecret, err := azsecrets.NewClient(a.vaultNameToURL(vaultSpec.Name), a.credentials, &azsecrets.ClientOptions{})
+	clientSecret, err := azsecrets.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), &azsecrets.ClientOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -125,34 +233,76 @@ func (a *azureKeyVaultService) GetCertificate(vaultSpec *akvs.AzureKeyVault, opt
 	defer cancel()
 	response, err := client.GetCertificate(ctx, vaultSpec.Object.Name, vaultSpec.Object.Version, &azcertificates.GetCertificateOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get certificate from azure key vault, error: %+v", err)
+		return nil, fmt.Errorf("failed to get certificate from azure key vault, error: %w", err)
 	}
 
-	if options.ExportPrivateKey {
-		if !*response.Policy.KeyProperties.Exportable {
-			return nil, fmt.Errorf("cannot export private key because key is not exportable in azure key vault")
-		}
-		secretBundle, err := clientSecret.GetSecret(ctx, vaultSpec.Object.Name, vaultSpec.Object.Version, &azsecrets.GetSecretOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get private certificate from azure key vault, error: %+v", err)
+	var cert *Certificate
+	if options != nil && options.ExportPrivateKey {
+		if !isExportable(response.Policy) {
+			return nil, ErrCertificateNotExportable
 		}
+		cert, err = exportCertificate(ctx, clientSecret, vaultSpec, options.EnsureServerFirst)
+	} else {
+		cert, err = NewCertificateFromDer(response.CER)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		switch *secretBundle.ContentType {
-		case certificateTypePem:
-			return NewCertificateFromPem(*secretBundle.Value)
-		case certificateTypePfx:
-			pfxRaw, err := base64.StdEncoding.DecodeString(*secretBundle.Value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode base64 encoded pfx, error: %+v", err)
-			}
-			if options.EnsureServerFirst {
-				return NewCertificateFromPfx(pfxRaw, true)
-			}
-			return NewCertificateFromPfx(pfxRaw, false)
-		default:
-			return nil, fmt.Errorf("failed to get certificate from azure key vault - unknown content type '%s'", *secretBundle.ContentType)
-		}
+	if response.ID != nil && response.Attributes != nil {
+		cert.Metadata = newObjectMetadata(a.vaultURL(vaultSpec), response.ID, response.Attributes.NotBefore, response.Attributes.Expires, response.Attributes.Updated)
+	}
+	return cert, nil
+}
+
+// exportCertificate downloads the certificate along with its private key from the secret
+// backing the certificate in Azure Key Vault
+func exportCertificate(ctx context.Context, client *azsecrets.Client, vaultSpec *akvs.AzureKeyVault, ensureServerFirst bool) (*Certificate, error) {
+	secretBundle, err := client.GetSecret(ctx, vaultSpec.Object.Name, vaultSpec.Object.Version, &azsecrets.GetSecretOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private certificate from azure key vault, error: %w", err)
+	}
+
+	var contentType, value string
+	if secretBundle.ContentType != nil {
+		contentType = *secretBundle.ContentType
+	}
+	if secretBundle.Value != nil {
+		value = *secretBundle.Value
+	}
+	cert, err := NewCertificateFromSecret(value, contentType, ensureServerFirst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate from azure key vault - %+v", err)
+	}
+	return cert, nil
+}
+
+// isExportable tells if the private key of a certificate with policy can be exported. Keys
+// without a known key policy are attempted.
+func isExportable(policy *azcertificates.CertificatePolicy) bool {
+	if policy == nil || policy.KeyProperties == nil || policy.KeyProperties.Exportable == nil {
+		return true
+	}
+	return *policy.KeyProperties.Exportable
+}
+
+// GetCertificateRenewalTime predicts when Azure Key Vault will renew the current version of a
+// certificate, based on its issuance policy. Returns nil if the certificate is not renewed automatically.
+func (a *azureKeyVaultService) GetCertificateRenewalTime(vaultSpec *akvs.AzureKeyVault) (*time.Time, error) {
+	client, err := azcertificates.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), &azcertificates.ClientOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	response, err := client.GetCertificate(ctx, vaultSpec.Object.Name, "", &azcertificates.GetCertificateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate from azure key vault, error: %w", err)
+	}
+	if response.Attributes == nil {
+		return nil, nil
 	}
 
-	return NewCertificateFromDer(response.CER)
+	return PredictCertificateRenewal(response.Attributes.NotBefore, response.Attributes.Expires, response.Policy), nil
 }
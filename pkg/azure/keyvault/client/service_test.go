@@ -128,3 +128,38 @@ func TestIntegrationEnvironmentGetSecret(t *testing.T) {
 	}
 
 }
+
+func TestVaultURL(t *testing.T) {
+	tests := []struct {
+		environment akv.AzureEnvironment
+		dnsSuffix   string
+		expected    string
+	}{
+		{expected: "https://my-vault.vault.azure.net"},
+		{dnsSuffix: "vault.azure.cn", expected: "https://my-vault.vault.azure.cn"},
+		{environment: akv.AzurePublicCloud, dnsSuffix: "vault.azure.cn", expected: "https://my-vault.vault.azure.net"},
+		{environment: akv.AzureChinaCloud, expected: "https://my-vault.vault.azure.cn"},
+		{environment: akv.AzureUSGovernmentCloud, expected: "https://my-vault.vault.usgovcloudapi.net"},
+		{environment: akv.AzureGermanCloud, expected: "https://my-vault.vault.microsoftazure.de"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s%s", tt.environment, tt.dnsSuffix), func(t *testing.T) {
+			service := NewService(nil, tt.dnsSuffix).(*azureKeyVaultService)
+			url := service.vaultURL(&akv.AzureKeyVault{Name: "my-vault", AzureEnvironment: tt.environment})
+			if url != tt.expected {
+				t.Errorf("expected vault url '%s', but got '%s'", tt.expected, url)
+			}
+		})
+	}
+}
+
+func TestVaultURLFromURI(t *testing.T) {
+	service := NewService(nil, "vault.azure.cn").(*azureKeyVaultService)
+	for _, uri := range []string{"https://my-hsm.managedhsm.azure.net", "https://my-hsm.managedhsm.azure.net/"} {
+		url := service.vaultURL(&akv.AzureKeyVault{URI: uri, AzureEnvironment: akv.AzureUSGovernmentCloud})
+		if url != "https://my-hsm.managedhsm.azure.net" {
+			t.Errorf("expected uri to be used as is, but got '%s'", url)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// IsThrottled tells if err is Azure Key Vault throttling requests, and how long it asked to
+// wait before the next request in the Retry-After header, zero if not given. The Azure SDK has
+// already retried the request when throttled, so the caller should back off.
+func IsThrottled(err error) (retryAfter time.Duration, throttled bool) {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if respErr.RawResponse != nil {
+		retryAfter = parseRetryAfter(respErr.RawResponse.Header.Get("Retry-After"), time.Now())
+	}
+	return retryAfter, true
+}
+
+// parseRetryAfter parses a Retry-After header given either as seconds or as an http date,
+// returning zero if missing or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
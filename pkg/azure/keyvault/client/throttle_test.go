@@ -0,0 +1,80 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func throttledError(statusCode int, retryAfter string) error {
+	resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return fmt.Errorf("failed to get secret: %w", &azcore.ResponseError{StatusCode: statusCode, RawResponse: resp})
+}
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		throttled  bool
+		retryAfter time.Duration
+	}{
+		{"throttled with retry after", throttledError(http.StatusTooManyRequests, "12"), true, 12 * time.Second},
+		{"throttled without retry after", throttledError(http.StatusTooManyRequests, ""), true, 0},
+		{"not found", throttledError(http.StatusNotFound, "12"), false, 0},
+		{"other error", fmt.Errorf("connection reset"), false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, throttled := IsThrottled(tt.err)
+			if throttled != tt.throttled || retryAfter != tt.retryAfter {
+				t.Errorf("expected throttled %t with retry after %v, but got %t with %v", tt.throttled, tt.retryAfter, throttled, retryAfter)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"0", 0},
+		{"-5", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if actual := parseRetryAfter(tt.value, now); actual != tt.expected {
+			t.Errorf("expected %v for '%s', but got %v", tt.expected, tt.value, actual)
+		}
+	}
+}
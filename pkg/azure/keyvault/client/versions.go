@@ -0,0 +1,225 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azcertificates"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azkeys"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
+	akvs "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+)
+
+// ObjectVersion is a version of an object in Azure Key Vault
+type ObjectVersion struct {
+	Version string
+	Enabled bool
+	Created time.Time
+	Updated time.Time
+}
+
+// ObjectMetadata tells which version of an object was read from Azure Key Vault
+type ObjectMetadata struct {
+	Version string
+	// When the version was last updated in Azure Key Vault, zero if unknown
+	Updated time.Time
+	// URL of the vault the version was read from
+	VaultURL string
+	// Content type attribute of secrets in Azure Key Vault, empty if not set
+	ContentType string
+	// When the version becomes valid and when it expires, zero if not set
+	NotBefore time.Time
+	Expires   time.Time
+}
+
+func newObjectMetadata(vaultURL string, id interface{ Version() string }, notBefore, expires, updated *time.Time) *ObjectMetadata {
+	metadata := &ObjectMetadata{Version: id.Version(), VaultURL: vaultURL}
+	if notBefore != nil {
+		metadata.NotBefore = *notBefore
+	}
+	if expires != nil {
+		metadata.Expires = *expires
+	}
+	if updated != nil {
+		metadata.Updated = *updated
+	}
+	return metadata
+}
+
+// GetObjectVersions lists all versions of the object in Azure Key Vault
+func (a *azureKeyVaultService) GetObjectVersions(vaultSpec *akvs.AzureKeyVault) ([]ObjectVersion, error) {
+	if vaultSpec.Object.Name == "" {
+		return nil, fmt.Errorf("azurekeyvaultsecret.spec.vault.object.name not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var versions []ObjectVersion
+	add := func(id interface{ Version() string }, enabled *bool, created, updated *time.Time) {
+		version := ObjectVersion{Version: id.Version(), Enabled: enabled != nil && *enabled}
+		if created != nil {
+			version.Created = *created
+		}
+		if updated != nil {
+			version.Updated = *updated
+		}
+		versions = append(versions, version)
+	}
+
+	switch vaultSpec.Object.Type {
+	case akvs.AzureKeyVaultObjectTypeSecret, akvs.AzureKeyVaultObjectTypeMultiKeyValueSecret:
+		client, err := azsecrets.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
+		if err != nil {
+			return nil, err
+		}
+		pager := client.NewListSecretVersionsPager(vaultSpec.Object.Name, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range page.Value {
+				if item.ID != nil && item.Attributes != nil {
+					add(item.ID, item.Attributes.Enabled, item.Attributes.Created, item.Attributes.Updated)
+				}
+			}
+		}
+
+	case akvs.AzureKeyVaultObjectTypeCertificate:
+		client, err := azcertificates.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
+		if err != nil {
+			return nil, err
+		}
+		pager := client.NewListCertificateVersionsPager(vaultSpec.Object.Name, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range page.Value {
+				if item.ID != nil && item.Attributes != nil {
+					add(item.ID, item.Attributes.Enabled, item.Attributes.Created, item.Attributes.Updated)
+				}
+			}
+		}
+
+	case akvs.AzureKeyVaultObjectTypeKey:
+		client, err := azkeys.NewClient(a.vaultURL(vaultSpec), a.credentialsFor(vaultSpec), nil)
+		if err != nil {
+			return nil, err
+		}
+		pager := client.NewListKeyVersionsPager(vaultSpec.Object.Name, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range page.Value {
+				if item.KID != nil && item.Attributes != nil {
+					add(item.KID, item.Attributes.Enabled, item.Attributes.Created, item.Attributes.Updated)
+				}
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("listing versions of azure key vault object type '%s' is not supported", vaultSpec.Object.Type)
+	}
+
+	return versions, nil
+}
+
+// CurrentVersion returns the newest enabled version, being the version read from Azure Key
+// Vault when no version is given. Fails if the object has no enabled versions.
+func CurrentVersion(versions []ObjectVersion) (ObjectVersion, error) {
+	if len(versions) == 0 {
+		return ObjectVersion{}, fmt.Errorf("no versions found")
+	}
+	enabled := enabledVersions(versions)
+	if len(enabled) == 0 {
+		return ObjectVersion{}, fmt.Errorf("no enabled versions found")
+	}
+	return enabled[0], nil
+}
+
+// IsNewestVersionDisabled tells if the newest version is disabled, so reading the latest
+// version fails in Azure Key Vault while an older version may still be enabled
+func IsNewestVersionDisabled(versions []ObjectVersion) bool {
+	if len(versions) == 0 {
+		return false
+	}
+	newest := versions[0]
+	for _, version := range versions[1:] {
+		if version.Created.After(newest.Created) {
+			newest = version
+		}
+	}
+	return !newest.Enabled
+}
+
+// PreviousVersion returns the newest enabled version before current, where current is
+// the newest enabled version. Fails if there is no enabled version before it.
+func PreviousVersion(versions []ObjectVersion) (previous, current ObjectVersion, err error) {
+	enabled := enabledVersions(versions)
+	if len(enabled) == 0 {
+		return previous, current, fmt.Errorf("no enabled versions found")
+	}
+	if len(enabled) == 1 {
+		return previous, enabled[0], fmt.Errorf("no enabled version found before the current version '%s'", enabled[0].Version)
+	}
+	return enabled[1], enabled[0], nil
+}
+
+// PreviousVersions returns up to n enabled versions created before the version current, newest
+// first. If current is not an enabled version, the newest enabled version is taken as current.
+func PreviousVersions(versions []ObjectVersion, current string, n int) []ObjectVersion {
+	enabled := enabledVersions(versions)
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	start := 1
+	for i, version := range enabled {
+		if version.Version == current {
+			start = i + 1
+			break
+		}
+	}
+	previous := enabled[start:]
+	if len(previous) > n {
+		previous = previous[:n]
+	}
+	return previous
+}
+
+// enabledVersions returns the enabled versions, newest first
+func enabledVersions(versions []ObjectVersion) []ObjectVersion {
+	var enabled []ObjectVersion
+	for _, version := range versions {
+		if version.Enabled {
+			enabled = append(enabled, version)
+		}
+	}
+	sort.SliceStable(enabled, func(i, j int) bool {
+		return enabled[i].Created.After(enabled[j].Created)
+	})
+	return enabled
+}
@@ -0,0 +1,123 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPreviousVersion(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []ObjectVersion{
+		{Version: "v1", Enabled: true, Created: created},
+		{Version: "v4", Enabled: false, Created: created.Add(3 * time.Hour)},
+		{Version: "v3", Enabled: true, Created: created.Add(2 * time.Hour)},
+		{Version: "v2", Enabled: true, Created: created.Add(time.Hour)},
+	}
+
+	previous, current, err := PreviousVersion(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous.Version != "v2" {
+		t.Errorf("expected previous version 'v2', but got '%s'", previous.Version)
+	}
+	if current.Version != "v3" {
+		t.Errorf("expected current version 'v3', but got '%s'", current.Version)
+	}
+}
+
+func TestPreviousVersionMissing(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []ObjectVersion{
+		{Version: "v1", Enabled: false, Created: created},
+		{Version: "v2", Enabled: true, Created: created.Add(time.Hour)},
+	}
+
+	if _, _, err := PreviousVersion(versions); err == nil {
+		t.Error("expected error when only one version is enabled")
+	}
+	if _, _, err := PreviousVersion(nil); err == nil {
+		t.Error("expected error when there are no versions")
+	}
+}
+
+func TestCurrentVersion(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []ObjectVersion{
+		{Version: "v1", Enabled: true, Created: created},
+		{Version: "v3", Enabled: false, Created: created.Add(2 * time.Hour)},
+		{Version: "v2", Enabled: true, Created: created.Add(time.Hour)},
+	}
+
+	current, err := CurrentVersion(versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != "v2" {
+		t.Errorf("expected current version 'v2', but got '%s'", current.Version)
+	}
+	if _, err := CurrentVersion(nil); err == nil {
+		t.Error("expected error when there are no versions")
+	}
+	if _, err := CurrentVersion(versions[1:2]); err == nil {
+		t.Error("expected error when there are no enabled versions")
+	}
+	if !IsNewestVersionDisabled(versions) {
+		t.Error("expected the newest version 'v3' to be disabled")
+	}
+	if IsNewestVersionDisabled([]ObjectVersion{versions[0], versions[2]}) {
+		t.Error("expected the newest version 'v2' to be enabled")
+	}
+}
+
+func TestPreviousVersions(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []ObjectVersion{
+		{Version: "v1", Enabled: true, Created: created},
+		{Version: "v5", Enabled: true, Created: created.Add(4 * time.Hour)},
+		{Version: "v3", Enabled: false, Created: created.Add(2 * time.Hour)},
+		{Version: "v4", Enabled: true, Created: created.Add(3 * time.Hour)},
+		{Version: "v2", Enabled: true, Created: created.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		current  string
+		n        int
+		expected []string
+	}{
+		{current: "v5", n: 2, expected: []string{"v4", "v2"}},
+		{current: "v4", n: 5, expected: []string{"v2", "v1"}},
+		{current: "", n: 1, expected: []string{"v4"}},
+		{current: "v1", n: 2, expected: nil},
+		{current: "v5", n: 0, expected: nil},
+	}
+	for _, tt := range tests {
+		var actual []string
+		for _, version := range PreviousVersions(versions, tt.current, tt.n) {
+			actual = append(actual, version.Version)
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("expected %d versions before '%s' to be %v, but got %v", tt.n, tt.current, tt.expected, actual)
+		}
+	}
+	if previous := PreviousVersions(nil, "v1", 1); len(previous) != 0 {
+		t.Errorf("expected no versions, but got %v", previous)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// VaultCredentialsConfig maps vault names to credentials, for vaults not accessible
+// using the default credentials. Example:
+//
+//	credentials:
+//	  team-a:
+//	    tenantId: 00000000-0000-0000-0000-000000000000
+//	    clientId: 00000000-0000-0000-0000-000000000000
+//	    clientSecretFile: /etc/akv2k8s/team-a/client-secret
+//	vaults:
+//	- pattern: team-a-*
+//	  credential: team-a
+type VaultCredentialsConfig struct {
+	Credentials map[string]VaultCredentialConfig `json:"credentials"`
+
+	// Vaults are matched in order, using the credential of the first matching pattern
+	Vaults []VaultCredentialRule `json:"vaults"`
+}
+
+// VaultCredentialConfig is a service principal used to access vaults
+type VaultCredentialConfig struct {
+	TenantID         string `json:"tenantId"`
+	ClientID         string `json:"clientId"`
+	ClientSecretFile string `json:"clientSecretFile"`
+}
+
+// VaultCredentialRule maps vault names matching Pattern to Credential. Pattern
+// uses shell file name pattern syntax, like team-a-*.
+type VaultCredentialRule struct {
+	Pattern    string `json:"pattern"`
+	Credential string `json:"credential"`
+}
+
+type vaultCredentialMapping struct {
+	config      VaultCredentialsConfig
+	credentials map[string]LegacyTokenCredential
+}
+
+// MappedVaultCredentials holds the credentials for vaults mapped in a
+// VaultCredentialsConfig, which can be reloaded while in use
+type MappedVaultCredentials struct {
+	file string
+
+	mu      sync.RWMutex
+	mapping *vaultCredentialMapping
+}
+
+// LoadVaultCredentials loads the vault credentials config in file, failing if it is
+// invalid or any credential cannot be created
+func LoadVaultCredentials(file string) (*MappedVaultCredentials, error) {
+	mapping, err := loadVaultCredentialMapping(file)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedVaultCredentials{file: file, mapping: mapping}, nil
+}
+
+func loadVaultCredentialMapping(file string) (*vaultCredentialMapping, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault credentials config %s: %w", file, err)
+	}
+
+	var config VaultCredentialsConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse vault credentials config %s: %w", file, err)
+	}
+
+	return newVaultCredentialMapping(config, os.ReadFile)
+}
+
+func newVaultCredentialMapping(config VaultCredentialsConfig, readFile func(string) ([]byte, error)) (*vaultCredentialMapping, error) {
+	patterns := make(map[string]int)
+	for i, rule := range config.Vaults {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("vaults[%d]: pattern is required", i)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("vaults[%d]: invalid pattern '%s': %w", i, rule.Pattern, err)
+		}
+		if first, ok := patterns[rule.Pattern]; ok {
+			return nil, fmt.Errorf("vaults[%d]: pattern '%s' is already used by vaults[%d]", i, rule.Pattern, first)
+		}
+		patterns[rule.Pattern] = i
+
+		if _, ok := config.Credentials[rule.Credential]; !ok {
+			return nil, fmt.Errorf("vaults[%d]: credential '%s' for pattern '%s' is not defined in credentials", i, rule.Credential, rule.Pattern)
+		}
+	}
+
+	// create in sorted order to get the same error every time
+	names := make([]string, 0, len(config.Credentials))
+	for name := range config.Credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	credentials := make(map[string]LegacyTokenCredential, len(config.Credentials))
+	for _, name := range names {
+		credential := config.Credentials[name]
+		if credential.TenantID == "" || credential.ClientID == "" || credential.ClientSecretFile == "" {
+			return nil, fmt.Errorf("credentials.%s: tenantId, clientId and clientSecretFile are required", name)
+		}
+
+		secret, err := readFile(credential.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("credentials.%s: failed to read client secret: %w", name, err)
+		}
+
+		token, err := azidentity.NewClientSecretCredential(credential.TenantID, credential.ClientID, strings.TrimSpace(string(secret)), nil)
+		if err != nil {
+			return nil, fmt.Errorf("credentials.%s: failed to create credential: %w", name, err)
+		}
+		credentials[name] = token
+	}
+
+	return &vaultCredentialMapping{config: config, credentials: credentials}, nil
+}
+
+// files returns the config file and all files referenced by it
+func (m *MappedVaultCredentials) files() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := []string{m.file}
+	for _, credential := range m.mapping.config.Credentials {
+		files = append(files, credential.ClientSecretFile)
+	}
+	sort.Strings(files[1:])
+	return files
+}
+
+// CredentialsFor returns the credentials for vaultName, or false if the default
+// credentials should be used
+func (m *MappedVaultCredentials) CredentialsFor(vaultName string) (LegacyTokenCredential, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rule := range m.mapping.config.Vaults {
+		if matched, _ := path.Match(rule.Pattern, vaultName); matched {
+			return m.mapping.credentials[rule.Credential], true
+		}
+	}
+	return nil, false
+}
+
+// Config returns the active config, which has no secrets, only references to them
+func (m *MappedVaultCredentials) Config() VaultCredentialsConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.mapping.config
+}
+
+// Watch reloads the config when the config file or any client secret file changes,
+// checking every interval until stopCh is closed. An invalid config is logged and
+// ignored, keeping the current config.
+func (m *MappedVaultCredentials) Watch(interval time.Duration, stopCh <-chan struct{}) {
+	checksum, _ := filesChecksum(m.files())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		files := m.files()
+		current, err := filesChecksum(files)
+		if err != nil {
+			klog.ErrorS(err, "failed to read vault credentials files", "files", files)
+			continue
+		}
+		if string(current) == string(checksum) {
+			continue
+		}
+		checksum = current
+
+		mapping, err := loadVaultCredentialMapping(m.file)
+		if err != nil {
+			klog.ErrorS(err, "failed to reload vault credentials config, keeping current config", "file", m.file)
+			credentialReloads.WithLabelValues("failed").Inc()
+			continue
+		}
+
+		m.mu.Lock()
+		m.mapping = mapping
+		m.mu.Unlock()
+
+		// the reloaded config may reference other files
+		checksum, _ = filesChecksum(m.files())
+		credentialReloads.WithLabelValues("success").Inc()
+		klog.InfoS("vault credentials config reloaded", "file", m.file)
+	}
+}
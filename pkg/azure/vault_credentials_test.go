@@ -0,0 +1,120 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testID = "00000000-0000-0000-0000-000000000000"
+
+func readSecretFile(file string) ([]byte, error) {
+	if file == "/missing" {
+		return nil, fmt.Errorf("open %s: no such file or directory", file)
+	}
+	return []byte("secret\n"), nil
+}
+
+func testVaultCredentialsConfig() VaultCredentialsConfig {
+	return VaultCredentialsConfig{
+		Credentials: map[string]VaultCredentialConfig{
+			"team-a": {TenantID: testID, ClientID: testID, ClientSecretFile: "/team-a"},
+			"team-b": {TenantID: testID, ClientID: testID, ClientSecretFile: "/team-b"},
+		},
+		Vaults: []VaultCredentialRule{
+			{Pattern: "team-a-*", Credential: "team-a"},
+			{Pattern: "team-b-prod", Credential: "team-b"},
+			{Pattern: "team-*", Credential: "team-b"},
+		},
+	}
+}
+
+func TestVaultCredentialsFor(t *testing.T) {
+	mapping, err := newVaultCredentialMapping(testVaultCredentialsConfig(), readSecretFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &MappedVaultCredentials{mapping: mapping}
+
+	tests := map[string]string{
+		"team-a-dev":  "team-a",
+		"team-b-prod": "team-b",
+		"team-c":      "team-b",
+	}
+	for vault, name := range tests {
+		credential, ok := m.CredentialsFor(vault)
+		if !ok {
+			t.Errorf("expected credential for vault '%s'", vault)
+			continue
+		}
+		if credential != mapping.credentials[name] {
+			t.Errorf("expected credential '%s' for vault '%s'", name, vault)
+		}
+	}
+
+	if _, ok := m.CredentialsFor("other"); ok {
+		t.Error("expected default credentials for unmatched vault")
+	}
+}
+
+func TestVaultCredentialsConfigErrors(t *testing.T) {
+	tests := map[string]struct {
+		change   func(*VaultCredentialsConfig)
+		expected string
+	}{
+		"duplicate pattern": {
+			change:   func(c *VaultCredentialsConfig) { c.Vaults[2].Pattern = "team-a-*" },
+			expected: "vaults[2]: pattern 'team-a-*' is already used by vaults[0]",
+		},
+		"invalid pattern": {
+			change:   func(c *VaultCredentialsConfig) { c.Vaults[1].Pattern = "team-[" },
+			expected: "vaults[1]: invalid pattern 'team-['",
+		},
+		"unknown credential": {
+			change:   func(c *VaultCredentialsConfig) { c.Vaults[0].Credential = "team-c" },
+			expected: "vaults[0]: credential 'team-c' for pattern 'team-a-*' is not defined",
+		},
+		"unreadable secret": {
+			change: func(c *VaultCredentialsConfig) {
+				c.Credentials["team-b"] = VaultCredentialConfig{TenantID: testID, ClientID: testID, ClientSecretFile: "/missing"}
+			},
+			expected: "credentials.team-b: failed to read client secret",
+		},
+		"missing client id": {
+			change: func(c *VaultCredentialsConfig) {
+				c.Credentials["team-a"] = VaultCredentialConfig{TenantID: testID, ClientSecretFile: "/team-a"}
+			},
+			expected: "credentials.team-a: tenantId, clientId and clientSecretFile are required",
+		},
+	}
+
+	for name, test := range tests {
+		config := testVaultCredentialsConfig()
+		test.change(&config)
+
+		_, err := newVaultCredentialMapping(config, readSecretFile)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error containing '%s', but got '%s'", name, test.expected, err)
+		}
+	}
+}
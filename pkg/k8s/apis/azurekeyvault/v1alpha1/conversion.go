@@ -0,0 +1,130 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2alpha1"
+)
+
+// ConversionDataAnnotation holds the v2alpha1 spec and status of an AzureKeyVaultSecret
+// converted to v1alpha1, when it has fields v1alpha1 cannot represent, so they survive a
+// round trip through v1alpha1
+const ConversionDataAnnotation = "akv2k8s.io/v2alpha1-conversion-data"
+
+// conversionData is stored as JSON in ConversionDataAnnotation
+// +k8s:deepcopy-gen=false
+type conversionData struct {
+	Spec   v2alpha1.AzureKeyVaultSecretSpec   `json:"spec"`
+	Status v2alpha1.AzureKeyVaultSecretStatus `json:"status,omitempty"`
+}
+
+// ConvertToV2alpha1 converts src to dst. Fields only v2alpha1 has are restored from
+// ConversionDataAnnotation, which is removed, while fields both versions have are always
+// taken from src, as they may have been changed through v1alpha1.
+func ConvertToV2alpha1(src *AzureKeyVaultSecret, dst *v2alpha1.AzureKeyVaultSecret) error {
+	dst.TypeMeta = src.TypeMeta
+	dst.APIVersion = v2alpha1.SchemeGroupVersion.String()
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = v2alpha1.AzureKeyVaultSecretSpec{}
+	dst.Status = v2alpha1.AzureKeyVaultSecretStatus{}
+
+	if value, ok := dst.Annotations[ConversionDataAnnotation]; ok {
+		var data conversionData
+		if err := json.Unmarshal([]byte(value), &data); err != nil {
+			return fmt.Errorf("failed to restore v2alpha1 fields from annotation %s, error: %+v", ConversionDataAnnotation, err)
+		}
+		dst.Spec, dst.Status = data.Spec, data.Status
+		delete(dst.Annotations, ConversionDataAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+
+	dst.Spec.Vault.Name = src.Spec.Vault.Name
+	dst.Spec.Vault.Object.Name = src.Spec.Vault.Object.Name
+	dst.Spec.Vault.Object.Type = v2alpha1.AzureKeyVaultObjectType(src.Spec.Vault.Object.Type)
+	dst.Spec.Vault.Object.Version = src.Spec.Vault.Object.Version
+	dst.Spec.Vault.Object.ContentType = v2alpha1.AzureKeyVaultObjectContentType(src.Spec.Vault.Object.ContentType)
+	dst.Spec.Output.Secret.Name = src.Spec.Output.Secret.Name
+	dst.Spec.Output.Secret.Type = src.Spec.Output.Secret.Type
+	dst.Spec.Output.Secret.DataKey = src.Spec.Output.Secret.DataKey
+	dst.Spec.Output.Transform = src.Spec.Output.Transforms
+
+	dst.Status.SecretHash = src.Status.SecretHash
+	dst.Status.SecretName = src.Status.SecretName
+	dst.Status.LastAzureUpdate = src.Status.LastAzureUpdate
+	return nil
+}
+
+// ConvertFromV2alpha1 converts src to dst. If src has fields v1alpha1 cannot represent, like
+// a ConfigMap output, its spec and status are stored in ConversionDataAnnotation of dst.
+func ConvertFromV2alpha1(src *v2alpha1.AzureKeyVaultSecret, dst *AzureKeyVaultSecret) error {
+	dst.TypeMeta = src.TypeMeta
+	dst.APIVersion = SchemeGroupVersion.String()
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	dst.Spec = AzureKeyVaultSecretSpec{
+		Vault: AzureKeyVault{
+			Name: src.Spec.Vault.Name,
+			Object: AzureKeyVaultObject{
+				Name:        src.Spec.Vault.Object.Name,
+				Type:        AzureKeyVaultObjectType(src.Spec.Vault.Object.Type),
+				Version:     src.Spec.Vault.Object.Version,
+				ContentType: AzureKeyVaultObjectContentType(src.Spec.Vault.Object.ContentType),
+			},
+		},
+		Output: AzureKeyVaultOutput{
+			Secret: AzureKeyVaultOutputSecret{
+				Name:    src.Spec.Output.Secret.Name,
+				Type:    src.Spec.Output.Secret.Type,
+				DataKey: src.Spec.Output.Secret.DataKey,
+			},
+			Transforms: src.Spec.Output.Transform,
+		},
+	}
+	dst.Status = AzureKeyVaultSecretStatus{
+		SecretHash:      src.Status.SecretHash,
+		SecretName:      src.Status.SecretName,
+		LastAzureUpdate: src.Status.LastAzureUpdate,
+	}
+
+	delete(dst.Annotations, ConversionDataAnnotation)
+	if !hasV2alpha1OnlyFields(src) {
+		return nil
+	}
+	value, err := json.Marshal(conversionData{Spec: src.Spec, Status: src.Status})
+	if err != nil {
+		return fmt.Errorf("failed to store v2alpha1 fields in annotation %s, error: %+v", ConversionDataAnnotation, err)
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = make(map[string]string)
+	}
+	dst.Annotations[ConversionDataAnnotation] = string(value)
+	return nil
+}
+
+// hasV2alpha1OnlyFields tells if akvs has fields that are lost when converted to v1alpha1
+func hasV2alpha1OnlyFields(akvs *v2alpha1.AzureKeyVaultSecret) bool {
+	return akvs.Spec.Vault.AzureIdentity != (v2alpha1.AzureIdentity{}) ||
+		akvs.Spec.Output.Secret.ChainOrder != "" ||
+		akvs.Spec.Output.ConfigMap != (v2alpha1.AzureKeyVaultOutputConfigMap{}) ||
+		akvs.Status.ConfigMapHash != "" ||
+		akvs.Status.ConfigMapName != ""
+}
@@ -0,0 +1,155 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestConvertToV2alpha1(t *testing.T) {
+	synced := metav1.NewTime(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	src := &AzureKeyVaultSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-a"},
+		Spec: AzureKeyVaultSecretSpec{
+			Vault: AzureKeyVault{
+				Name:   "my-vault",
+				Object: AzureKeyVaultObject{Name: "db-password", Type: AzureKeyVaultObjectTypeSecret, Version: "abc"},
+			},
+			Output: AzureKeyVaultOutput{
+				Secret:     AzureKeyVaultOutputSecret{Name: "db", Type: corev1.SecretTypeOpaque, DataKey: "password"},
+				Transforms: []string{"trim"},
+			},
+		},
+		Status: AzureKeyVaultSecretStatus{SecretHash: "hash", SecretName: "db", LastAzureUpdate: synced},
+	}
+
+	dst := &v2alpha1.AzureKeyVaultSecret{}
+	if err := ConvertToV2alpha1(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	expected := v2alpha1.AzureKeyVaultSecretSpec{
+		Vault: v2alpha1.AzureKeyVault{
+			Name:   "my-vault",
+			Object: v2alpha1.AzureKeyVaultObject{Name: "db-password", Type: v2alpha1.AzureKeyVaultObjectTypeSecret, Version: "abc"},
+		},
+		Output: v2alpha1.AzureKeyVaultOutput{
+			Secret:    v2alpha1.AzureKeyVaultOutputSecret{Name: "db", Type: corev1.SecretTypeOpaque, DataKey: "password"},
+			Transform: []string{"trim"},
+		},
+	}
+	if !reflect.DeepEqual(dst.Spec, expected) {
+		t.Errorf("expected spec %+v, but got %+v", expected, dst.Spec)
+	}
+	if dst.Status.SecretHash != "hash" || dst.Status.SecretName != "db" || !dst.Status.LastAzureUpdate.Equal(&synced) {
+		t.Errorf("expected status to be converted, but got %+v", dst.Status)
+	}
+	if dst.APIVersion != v2alpha1.SchemeGroupVersion.String() || dst.Name != "db" || dst.Namespace != "team-a" {
+		t.Errorf("expected v2alpha1 object team-a/db, but got %s %s/%s", dst.APIVersion, dst.Namespace, dst.Name)
+	}
+}
+
+func TestConvertObjectTypes(t *testing.T) {
+	for _, objectType := range []AzureKeyVaultObjectType{
+		AzureKeyVaultObjectTypeSecret,
+		AzureKeyVaultObjectTypeMultiKeyValueSecret,
+		AzureKeyVaultObjectTypeCertificate,
+		AzureKeyVaultObjectTypeKey,
+	} {
+		src := &AzureKeyVaultSecret{Spec: AzureKeyVaultSecretSpec{Vault: AzureKeyVault{Object: AzureKeyVaultObject{Type: objectType}}}}
+		hub := &v2alpha1.AzureKeyVaultSecret{}
+		if err := ConvertToV2alpha1(src, hub); err != nil {
+			t.Fatal(err)
+		}
+		if string(hub.Spec.Vault.Object.Type) != string(objectType) {
+			t.Errorf("expected object type %s in v2alpha1, but got %s", objectType, hub.Spec.Vault.Object.Type)
+		}
+
+		dst := &AzureKeyVaultSecret{}
+		if err := ConvertFromV2alpha1(hub, dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst.Spec.Vault.Object.Type != objectType {
+			t.Errorf("expected object type %s in v1alpha1, but got %s", objectType, dst.Spec.Vault.Object.Type)
+		}
+	}
+}
+
+func TestConvertFromV2alpha1RoundTrip(t *testing.T) {
+	src := &v2alpha1.AzureKeyVaultSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "team-a", Annotations: map[string]string{"team": "a"}},
+		Spec: v2alpha1.AzureKeyVaultSecretSpec{
+			Vault: v2alpha1.AzureKeyVault{
+				Name:          "my-vault",
+				Object:        v2alpha1.AzureKeyVaultObject{Name: "tls", Type: v2alpha1.AzureKeyVaultObjectTypeCertificate},
+				AzureIdentity: v2alpha1.AzureIdentity{Name: "my-identity"},
+			},
+			Output: v2alpha1.AzureKeyVaultOutput{
+				Secret:    v2alpha1.AzureKeyVaultOutputSecret{Name: "tls", Type: corev1.SecretTypeTLS, ChainOrder: "ensureserverfirst"},
+				ConfigMap: v2alpha1.AzureKeyVaultOutputConfigMap{Name: "ca", DataKey: "ca.crt"},
+			},
+		},
+		Status: v2alpha1.AzureKeyVaultSecretStatus{SecretName: "tls", ConfigMapName: "ca", ConfigMapHash: "hash"},
+	}
+
+	converted := &AzureKeyVaultSecret{}
+	if err := ConvertFromV2alpha1(src, converted); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := converted.Annotations[ConversionDataAnnotation]; !ok {
+		t.Fatal("expected fields only v2alpha1 has to be preserved in annotation")
+	}
+	if converted.Spec.Output.Secret.Name != "tls" || converted.Spec.Output.Secret.Type != corev1.SecretTypeTLS {
+		t.Errorf("expected secret output to be converted, but got %+v", converted.Spec.Output.Secret)
+	}
+
+	// fields both versions have are changed through v1alpha1
+	converted.Spec.Vault.Name = "other-vault"
+
+	restored := &v2alpha1.AzureKeyVaultSecret{}
+	if err := ConvertToV2alpha1(converted, restored); err != nil {
+		t.Fatal(err)
+	}
+	expected := src.DeepCopy()
+	expected.APIVersion = v2alpha1.SchemeGroupVersion.String()
+	expected.Spec.Vault.Name = "other-vault"
+	if !reflect.DeepEqual(restored, expected) {
+		t.Errorf("expected %+v after round trip, but got %+v", expected, restored)
+	}
+}
+
+func TestConvertFromV2alpha1WithoutV2alpha1OnlyFields(t *testing.T) {
+	src := &v2alpha1.AzureKeyVaultSecret{
+		Spec: v2alpha1.AzureKeyVaultSecretSpec{
+			Vault:  v2alpha1.AzureKeyVault{Name: "my-vault", Object: v2alpha1.AzureKeyVaultObject{Name: "db-password", Type: v2alpha1.AzureKeyVaultObjectTypeSecret}},
+			Output: v2alpha1.AzureKeyVaultOutput{Secret: v2alpha1.AzureKeyVaultOutputSecret{Name: "db", DataKey: "password"}},
+		},
+	}
+
+	dst := &AzureKeyVaultSecret{}
+	if err := ConvertFromV2alpha1(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Annotations != nil {
+		t.Errorf("expected no annotation when nothing is lost, but got %v", dst.Annotations)
+	}
+}
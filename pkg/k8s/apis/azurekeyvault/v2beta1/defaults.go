@@ -0,0 +1,109 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2beta1
+
+import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HasOwnDataKeys tells if a single value secret is written to a Secret of secretType using
+// keys given by the type, like tls.crt and tls.key, so no dataKey is needed
+func HasOwnDataKeys(secretType corev1.SecretType) bool {
+	switch secretType {
+	case corev1.SecretTypeBasicAuth, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeDockercfg, corev1.SecretTypeSSHAuth, corev1.SecretTypeTLS:
+		return true
+	}
+	return false
+}
+
+// ObjectOutput returns the output object, an entry in spec.vault.objects of akvs, is written to:
+// the output set for object, or else the Secret when spec.output.secret is set and the
+// ConfigMap otherwise
+func ObjectOutput(akvs *AzureKeyVaultSecret, object AzureKeyVaultObjectReference) AzureKeyVaultObjectOutput {
+	if object.Output != "" {
+		return object.Output
+	}
+	if akvs.Spec.Output.Secret.Name == "" && akvs.Spec.Output.ConfigMap.Name != "" {
+		return AzureKeyVaultObjectOutputConfigMap
+	}
+	return AzureKeyVaultObjectOutputSecret
+}
+
+// DataKeyCaseOf returns the casing of the keys written to secret: dataKeyCase, or else the
+// case keyTransform is an alias of
+func DataKeyCaseOf(secret AzureKeyVaultOutputSecret) AzureKeyVaultDataKeyCase {
+	if secret.DataKeyCase != "" {
+		return secret.DataKeyCase
+	}
+	switch secret.KeyTransform {
+	case AzureKeyVaultKeyTransformUpper:
+		return AzureKeyVaultDataKeyCaseUpper
+	case AzureKeyVaultKeyTransformLower:
+		return AzureKeyVaultDataKeyCaseLower
+	case AzureKeyVaultKeyTransformSnakeUpper:
+		return AzureKeyVaultDataKeyCaseUpperSnake
+	}
+	return ""
+}
+
+// SetAzureKeyVaultSecretDefaults sets the output fields most manifests would otherwise repeat:
+//
+//   - spec.output.secret.name defaults to the name of the AzureKeyVaultSecret when other
+//     spec.output.secret fields are set, as AzureKeyVaultSecrets without outputs are only
+//     read by the env injector
+//   - the secret type of each output defaults to Opaque for secret and multi-key-value-secret
+//     objects, as certificates and keys are written differently when the type is not set
+//   - the dataKey of each output defaults to the object name for single value secrets, as
+//     does the dataKey of each entry in spec.vault.objects
+//   - the output of each entry in spec.vault.objects defaults to the Secret when
+//     spec.output.secret is set and to the ConfigMap otherwise
+func SetAzureKeyVaultSecretDefaults(akvs *AzureKeyVaultSecret) {
+	if akvs.Spec.Output.Secret.Name == "" && !reflect.DeepEqual(akvs.Spec.Output.Secret, AzureKeyVaultOutputSecret{}) {
+		akvs.Spec.Output.Secret.Name = akvs.Name
+	}
+
+	setOutputDefaults(akvs.Spec.Vault.Object, &akvs.Spec.Output)
+	for i := range akvs.Spec.Outputs {
+		setOutputDefaults(akvs.Spec.Vault.Object, &akvs.Spec.Outputs[i])
+	}
+
+	for i, object := range akvs.Spec.Vault.Objects {
+		if object.Type == AzureKeyVaultObjectTypeSecret && object.DataKey == "" {
+			akvs.Spec.Vault.Objects[i].DataKey = object.Name
+		}
+		akvs.Spec.Vault.Objects[i].Output = ObjectOutput(akvs, object)
+	}
+}
+
+func setOutputDefaults(object AzureKeyVaultObject, output *AzureKeyVaultOutput) {
+	if output.Secret.Name != "" && output.Secret.Type == "" &&
+		(object.Type == AzureKeyVaultObjectTypeSecret || object.Type == AzureKeyVaultObjectTypeMultiKeyValueSecret) {
+		output.Secret.Type = corev1.SecretTypeOpaque
+	}
+
+	if object.Type != AzureKeyVaultObjectTypeSecret || object.Name == "" {
+		return
+	}
+	if output.Secret.Name != "" && output.Secret.DataKey == "" && !HasOwnDataKeys(output.Secret.Type) {
+		output.Secret.DataKey = object.Name
+	}
+	if output.ConfigMap.Name != "" && output.ConfigMap.DataKey == "" {
+		output.ConfigMap.DataKey = object.Name
+	}
+}
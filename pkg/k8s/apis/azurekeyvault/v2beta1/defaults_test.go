@@ -0,0 +1,117 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2beta1
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func defaultsSecret(objectType AzureKeyVaultObjectType, output AzureKeyVaultOutput) *AzureKeyVaultSecret {
+	return &AzureKeyVaultSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-akvs"},
+		Spec: AzureKeyVaultSecretSpec{
+			Vault:  AzureKeyVault{Name: "my-vault", Object: AzureKeyVaultObject{Name: "db-password", Type: objectType}},
+			Output: output,
+		},
+	}
+}
+
+func TestSetAzureKeyVaultSecretDefaults(t *testing.T) {
+	akvs := defaultsSecret(AzureKeyVaultObjectTypeSecret, AzureKeyVaultOutput{
+		Secret:    AzureKeyVaultOutputSecret{DataKeyCase: AzureKeyVaultDataKeyCaseAsIs},
+		ConfigMap: AzureKeyVaultOutputConfigMap{Name: "my-config"},
+	})
+	SetAzureKeyVaultSecretDefaults(akvs)
+
+	secret := akvs.Spec.Output.Secret
+	if secret.Name != "my-akvs" || secret.Type != corev1.SecretTypeOpaque || secret.DataKey != "db-password" {
+		t.Errorf("expected secret output my-akvs of type Opaque with data key db-password, but got %+v", secret)
+	}
+	if dataKey := akvs.Spec.Output.ConfigMap.DataKey; dataKey != "db-password" {
+		t.Errorf("expected configmap data key db-password, but got '%s'", dataKey)
+	}
+}
+
+func TestSetAzureKeyVaultSecretDefaultsLeavesOutputsAlone(t *testing.T) {
+	// read by the env injector only
+	akvs := defaultsSecret(AzureKeyVaultObjectTypeSecret, AzureKeyVaultOutput{})
+	SetAzureKeyVaultSecretDefaults(akvs)
+	if akvs.Spec.Output.Secret.Name != "" {
+		t.Errorf("expected no secret output, but got '%s'", akvs.Spec.Output.Secret.Name)
+	}
+
+	akvs = defaultsSecret(AzureKeyVaultObjectTypeCertificate, AzureKeyVaultOutput{Secret: AzureKeyVaultOutputSecret{Name: "my-cert", DataKey: "cert.pem"}})
+	SetAzureKeyVaultSecretDefaults(akvs)
+	if akvs.Spec.Output.Secret.Type != "" {
+		t.Errorf("expected certificate secret type to be left unset, but got '%s'", akvs.Spec.Output.Secret.Type)
+	}
+
+	akvs = defaultsSecret(AzureKeyVaultObjectTypeSecret, AzureKeyVaultOutput{Secret: AzureKeyVaultOutputSecret{Name: "my-tls", Type: corev1.SecretTypeTLS}})
+	SetAzureKeyVaultSecretDefaults(akvs)
+	if akvs.Spec.Output.Secret.DataKey != "" {
+		t.Errorf("expected no data key for secret type with its own keys, but got '%s'", akvs.Spec.Output.Secret.DataKey)
+	}
+}
+
+func TestSetAzureKeyVaultSecretDefaultsObjects(t *testing.T) {
+	akvs := defaultsSecret("", AzureKeyVaultOutput{Secret: AzureKeyVaultOutputSecret{Name: "db"}})
+	akvs.Spec.Vault.Object = AzureKeyVaultObject{}
+	akvs.Spec.Vault.Objects = []AzureKeyVaultObjectReference{
+		{Name: "db-username", Type: AzureKeyVaultObjectTypeSecret},
+		{Name: "db-password", Type: AzureKeyVaultObjectTypeSecret, DataKey: "password"},
+		{Name: "db-cert", Type: AzureKeyVaultObjectTypeCertificate},
+	}
+	SetAzureKeyVaultSecretDefaults(akvs)
+
+	for i, expected := range []string{"db-username", "password", ""} {
+		if dataKey := akvs.Spec.Vault.Objects[i].DataKey; dataKey != expected {
+			t.Errorf("expected data key '%s' for spec.vault.objects[%d], but got '%s'", expected, i, dataKey)
+		}
+		if output := akvs.Spec.Vault.Objects[i].Output; output != AzureKeyVaultObjectOutputSecret {
+			t.Errorf("expected spec.vault.objects[%d] to default to the secret, but got '%s'", i, output)
+		}
+	}
+
+	akvs = defaultsSecret("", AzureKeyVaultOutput{ConfigMap: AzureKeyVaultOutputConfigMap{Name: "db"}})
+	akvs.Spec.Vault.Object = AzureKeyVaultObject{}
+	akvs.Spec.Vault.Objects = []AzureKeyVaultObjectReference{{Name: "db-ca", Type: AzureKeyVaultObjectTypeCertificate}}
+	SetAzureKeyVaultSecretDefaults(akvs)
+	if output := akvs.Spec.Vault.Objects[0].Output; output != AzureKeyVaultObjectOutputConfigMap {
+		t.Errorf("expected objects to default to the only output declared, but got '%s'", output)
+	}
+}
+
+func TestDataKeyCaseOf(t *testing.T) {
+	tests := []struct {
+		secret   AzureKeyVaultOutputSecret
+		expected AzureKeyVaultDataKeyCase
+	}{
+		{AzureKeyVaultOutputSecret{}, ""},
+		{AzureKeyVaultOutputSecret{DataKeyCase: AzureKeyVaultDataKeyCaseCamel}, AzureKeyVaultDataKeyCaseCamel},
+		{AzureKeyVaultOutputSecret{KeyTransform: AzureKeyVaultKeyTransformUpper}, AzureKeyVaultDataKeyCaseUpper},
+		{AzureKeyVaultOutputSecret{KeyTransform: AzureKeyVaultKeyTransformLower}, AzureKeyVaultDataKeyCaseLower},
+		{AzureKeyVaultOutputSecret{KeyTransform: AzureKeyVaultKeyTransformSnakeUpper}, AzureKeyVaultDataKeyCaseUpperSnake},
+	}
+	for _, test := range tests {
+		if keyCase := DataKeyCaseOf(test.secret); keyCase != test.expected {
+			t.Errorf("expected data key case '%s' for %+v, but got '%s'", test.expected, test.secret, keyCase)
+		}
+	}
+}
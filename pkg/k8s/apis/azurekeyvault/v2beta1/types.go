@@ -56,16 +56,114 @@ type AzureKeyVaultSecretList struct {
 type AzureKeyVaultSecretSpec struct {
 	Vault  AzureKeyVault       `json:"vault"`
 	Output AzureKeyVaultOutput `json:"output,omitempty"`
+	// +optional
+	// Several outputs synced from a single read of the object in Azure Key Vault, each with
+	// its own secret and/or configMap. Cannot be combined with output
+	Outputs []AzureKeyVaultOutput `json:"outputs,omitempty"`
+	// +optional
+	// How changes are applied to outputs that already exist. Defaults to Auto
+	SyncPolicy AzureKeyVaultSyncPolicy `json:"syncPolicy,omitempty"`
 }
 
+// AzureKeyVaultSyncPolicy defines how changes are applied to existing outputs
+// +kubebuilder:validation:Enum=Auto;ReportOnly
+type AzureKeyVaultSyncPolicy string
+
+const (
+	// AzureKeyVaultSyncPolicyAuto - changes are applied to outputs as soon as they are read
+	AzureKeyVaultSyncPolicyAuto AzureKeyVaultSyncPolicy = "Auto"
+
+	// AzureKeyVaultSyncPolicyReportOnly - changes to existing outputs are only reported, and applied
+	// when the force sync annotation is set or changed. Missing outputs are still created.
+	AzureKeyVaultSyncPolicyReportOnly AzureKeyVaultSyncPolicy = "ReportOnly"
+)
+
 // AzureKeyVault contains information needed to get the
 // Azure Key Vault secret from Azure Key Vault
 type AzureKeyVault struct {
-	// Name of the Azure Key Vault
-	Name   string              `json:"name"`
+	// +optional
+	// Name of the Azure Key Vault, required unless uri is set
+	Name string `json:"name,omitempty"`
+	// +optional
+	// URI of the Azure Key Vault or Managed HSM, like https://my-vault.privatelink.vaultcore.azure.net,
+	// used as is instead of building it from name
+	URI string `json:"uri,omitempty"`
+	// +optional
+	// The object to sync, required unless objects is set
 	Object AzureKeyVaultObject `json:"object"`
 	// +optional
+	// Objects to sync into the Secret or ConfigMap output instead of object, each written to
+	// its own keys
+	Objects []AzureKeyVaultObjectReference `json:"objects,omitempty"`
+	// +optional
 	AzureIdentity AzureIdentity `json:"azureIdentity,omitempty"`
+	// +optional
+	// Azure Key Vault to read the same object from when this vault cannot be reached
+	Fallback *AzureKeyVaultFallback `json:"fallback,omitempty"`
+	// +optional
+	// Credentials to authenticate to Azure Key Vault with instead of those of the controller
+	CredentialsFrom *AzureKeyVaultCredentialsFrom `json:"credentialsFrom,omitempty"`
+	// +optional
+	// Azure cloud of the Azure Key Vault, used for its DNS suffix and the AAD authority of
+	// credentialsFrom. Not set uses the cloud of the controller.
+	AzureEnvironment AzureEnvironment `json:"azureEnvironment,omitempty"`
+}
+
+// AzureEnvironment defines the Azure cloud an Azure Key Vault is in
+// +kubebuilder:validation:Enum=AzurePublicCloud;AzureChinaCloud;AzureUSGovernmentCloud;AzureGermanCloud
+type AzureEnvironment string
+
+const (
+	// AzurePublicCloud is the global Azure cloud
+	AzurePublicCloud AzureEnvironment = "AzurePublicCloud"
+
+	// AzureChinaCloud is Azure operated by 21Vianet in China
+	AzureChinaCloud AzureEnvironment = "AzureChinaCloud"
+
+	// AzureUSGovernmentCloud is Azure for US government
+	AzureUSGovernmentCloud AzureEnvironment = "AzureUSGovernmentCloud"
+
+	// AzureGermanCloud is Azure Germany
+	AzureGermanCloud AzureEnvironment = "AzureGermanCloud"
+)
+
+// Identifier returns the URI of the vault if set, and its name otherwise, to identify the
+// vault the way the AzureKeyVaultSecret does in logs and events
+func (v *AzureKeyVault) Identifier() string {
+	if v.URI != "" {
+		return v.URI
+	}
+	return v.Name
+}
+
+// ObjectVault returns the vault object, an entry in objects of v, is read from, being v with
+// the vault and credentials set for object, if any, and without objects
+func (v *AzureKeyVault) ObjectVault(object AzureKeyVaultObjectReference) AzureKeyVault {
+	vault := *v.DeepCopy()
+	vault.Objects = nil
+	if object.VaultName != "" || object.VaultURI != "" {
+		vault.Name, vault.URI = object.VaultName, object.VaultURI
+		// the fallback holds a replica of the objects in v, not in the vault of object
+		vault.Fallback = nil
+	}
+	if object.CredentialsFrom != nil {
+		vault.CredentialsFrom = object.CredentialsFrom.DeepCopy()
+	}
+	return vault
+}
+
+// AzureKeyVaultCredentialsFrom has information about where to read the
+// service principal used to authenticate to Azure Key Vault from
+type AzureKeyVaultCredentialsFrom struct {
+	// Secret in the same namespace with the keys clientId, clientSecret and tenantId
+	SecretRef corev1.LocalObjectReference `json:"secretRef"`
+}
+
+// AzureKeyVaultFallback has information about a secondary Azure Key Vault
+// holding a replica of the object
+type AzureKeyVaultFallback struct {
+	// Name of the fallback Azure Key Vault
+	Name string `json:"name"`
 }
 
 // AzureIdentity has information about the azure
@@ -75,26 +173,191 @@ type AzureIdentity struct {
 	Name string `json:"name"`
 }
 
-// AzureKeyVaultObject has information about the Azure Key Vault
-// object to get from Azure Key Vault
-type AzureKeyVaultObject struct {
+// AzureKeyVaultObjectReference has information about one of several Azure Key Vault
+// objects synced into the Secret or ConfigMap output
+type AzureKeyVaultObjectReference struct {
 	// The object name in Azure Key Vault
 	Name string                  `json:"name"`
 	Type AzureKeyVaultObjectType `json:"type"`
 	// +optional
-	// The object version in Azure Key Vault
+	// The object version in Azure Key Vault, the latest version if not set
+	Version string `json:"version,omitempty"`
+	// +optional
+	// The key in the Secret to write the value of a secret object to, defaults to the object
+	// name. Other object types write their own keys.
+	DataKey string `json:"dataKey,omitempty"`
+	// +optional
+	// The output to write the object to, defaults to the Secret when spec.output.secret is
+	// set and to the ConfigMap otherwise
+	Output AzureKeyVaultObjectOutput `json:"output,omitempty"`
+	// +optional
+	// Name of the Azure Key Vault to read the object from instead of the vault in spec.vault,
+	// cannot be combined with vaultURI
+	VaultName string `json:"vaultName,omitempty"`
+	// +optional
+	// URI of the Azure Key Vault or Managed HSM to read the object from instead of the vault
+	// in spec.vault, cannot be combined with vaultName
+	VaultURI string `json:"vaultURI,omitempty"`
+	// +optional
+	// Credentials to authenticate to the vault of the object with instead of those in
+	// spec.vault.credentialsFrom
+	CredentialsFrom *AzureKeyVaultCredentialsFrom `json:"credentialsFrom,omitempty"`
+}
+
+// AzureKeyVaultObjectOutput defines which output an entry in spec.vault.objects is written to
+// +kubebuilder:validation:Enum=secret;configMap
+type AzureKeyVaultObjectOutput string
+
+const (
+	// AzureKeyVaultObjectOutputSecret - the object is written to spec.output.secret
+	AzureKeyVaultObjectOutputSecret AzureKeyVaultObjectOutput = "secret"
+
+	// AzureKeyVaultObjectOutputConfigMap - the object is written to spec.output.configMap
+	AzureKeyVaultObjectOutputConfigMap AzureKeyVaultObjectOutput = "configMap"
+)
+
+// AzureKeyVaultObject has information about the Azure Key Vault
+// object to get from Azure Key Vault
+type AzureKeyVaultObject struct {
+	// +optional
+	// The object name in Azure Key Vault, required unless nameFrom is set
+	Name string `json:"name"`
+	// +optional
+	// Read the object name from a source in the same namespace, cannot be combined with name
+	NameFrom *AzureKeyVaultObjectNameFrom `json:"nameFrom,omitempty"`
+	Type     AzureKeyVaultObjectType      `json:"type"`
+	// +optional
+	// The object version in Azure Key Vault. The symbolic version "previous" syncs the newest enabled
+	// version before the current one, and is meant as a break-glass tool for rolling back a bad rotation
 	Version string `json:"version"`
 	// +optional
+	// Read the object version from a source in the same namespace, cannot be combined with version
+	VersionFrom *AzureKeyVaultObjectVersionFrom `json:"versionFrom,omitempty"`
+	// +optional
 	ContentType AzureKeyVaultObjectContentType `json:"contentType"`
+	// +optional
+	// How null values are written for multi-key-value-secret with content type application/x-json,
+	// Empty (default) writes an empty string and Skip leaves the key out
+	NullValues AzureKeyVaultNullValues `json:"nullValues,omitempty"`
+	// +optional
+	// How arrays are written for multi-key-value-secret with content type application/x-json,
+	// Error (default) fails the sync, Indexed writes each element to its own key and JSON writes
+	// the array as a JSON string
+	ArrayValues AzureKeyVaultArrayValues `json:"arrayValues,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]*$`
+	// Written between a key and the index of each element when arrayValues is Indexed, defaults to _
+	KeyDelimiter string `json:"keyDelimiter,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]*$`
+	// Written between the keys of nested maps when contentType is application/x-yaml, defaults to .
+	NestedKeySeparator string `json:"nestedKeySeparator,omitempty"`
+	// +optional
+	// Character encoding of the secret value in Azure Key Vault, only used when type is secret or
+	// multi-key-value-secret. The value is transcoded to UTF-8 before transforms, without byte order
+	// mark. Not set (default) writes the value as it is.
+	Charset AzureKeyVaultCharset `json:"charset,omitempty"`
+	// +optional
+	// How often the object is polled for changes in Azure Key Vault, instead of the controller-wide
+	// poll interval. Not set or zero uses the controller-wide poll interval
+	PollInterval *metav1.Duration `json:"pollInterval,omitempty"`
+	// +optional
+	// How polls detect changes in Azure Key Vault. Hash downloads the object and compares the hash
+	// of its values, while version only downloads it when its current version or updated time differs
+	// from status. Not set uses the controller default, which is hash unless changed.
+	ChangeDetection AzureKeyVaultChangeDetection `json:"changeDetection,omitempty"`
 }
 
+// AzureKeyVaultObjectNameFrom has information about where to
+// read the Azure Key Vault object name from. Exactly one source must be set.
+type AzureKeyVaultObjectNameFrom struct {
+	// +optional
+	// Selects a key of a ConfigMap holding the object name
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+	// +optional
+	// Selects a key of a Secret holding the object name
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// AzureKeyVaultObjectVersionFrom has information about where to
+// read the Azure Key Vault object version from
+type AzureKeyVaultObjectVersionFrom struct {
+	// Selects a key of a ConfigMap holding the object version
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef"`
+}
+
+// AzureKeyVaultObjectVersionPrevious is the symbolic object version syncing the newest enabled
+// version before the current version. The concrete version is recorded in status.previousVersion
+// and kept until it is disabled, so new versions added during a rollback do not change it.
+const AzureKeyVaultObjectVersionPrevious = "previous"
+
+// AzureKeyVaultNullValues defines how null values in a multi-key-value-secret are written
+// +kubebuilder:validation:Enum=Empty;Skip
+type AzureKeyVaultNullValues string
+
+const (
+	// AzureKeyVaultNullValuesEmpty writes null values as an empty string
+	AzureKeyVaultNullValuesEmpty AzureKeyVaultNullValues = "Empty"
+
+	// AzureKeyVaultNullValuesSkip leaves out keys with null values
+	AzureKeyVaultNullValuesSkip AzureKeyVaultNullValues = "Skip"
+)
+
+// AzureKeyVaultArrayValues defines how arrays in a multi-key-value-secret are written
+// +kubebuilder:validation:Enum=Error;Indexed;JSON
+type AzureKeyVaultArrayValues string
+
+const (
+	// AzureKeyVaultArrayValuesError fails the sync if the secret contains an array
+	AzureKeyVaultArrayValuesError AzureKeyVaultArrayValues = "Error"
+
+	// AzureKeyVaultArrayValuesIndexed writes each element of an array to its own key,
+	// named by the key of the array and the index of the element
+	AzureKeyVaultArrayValuesIndexed AzureKeyVaultArrayValues = "Indexed"
+
+	// AzureKeyVaultArrayValuesJSON writes an array to a single key as a JSON string
+	AzureKeyVaultArrayValuesJSON AzureKeyVaultArrayValues = "JSON"
+)
+
+// AzureKeyVaultChangeDetection defines how polls detect changes to an object in Azure Key Vault
+// +kubebuilder:validation:Enum=hash;version
+type AzureKeyVaultChangeDetection string
+
+const (
+	// AzureKeyVaultChangeDetectionHash downloads the object and compares the hash of its values
+	AzureKeyVaultChangeDetectionHash AzureKeyVaultChangeDetection = "hash"
+
+	// AzureKeyVaultChangeDetectionVersion compares the current version of the object and when it
+	// was updated, only downloading the object when changed
+	AzureKeyVaultChangeDetectionVersion AzureKeyVaultChangeDetection = "version"
+)
+
+// AzureKeyVaultCharset defines the character encoding of a secret value in Azure Key Vault
+// +kubebuilder:validation:Enum=utf-8;utf-16le;utf-16be;latin1
+type AzureKeyVaultCharset string
+
+const (
+	// AzureKeyVaultCharsetUTF8 checks that the value is valid UTF-8 and removes any byte order mark
+	AzureKeyVaultCharsetUTF8 AzureKeyVaultCharset = "utf-8"
+
+	// AzureKeyVaultCharsetUTF16LE transcodes the value from little endian UTF-16
+	AzureKeyVaultCharsetUTF16LE AzureKeyVaultCharset = "utf-16le"
+
+	// AzureKeyVaultCharsetUTF16BE transcodes the value from big endian UTF-16
+	AzureKeyVaultCharsetUTF16BE AzureKeyVaultCharset = "utf-16be"
+
+	// AzureKeyVaultCharsetLatin1 transcodes the value from ISO-8859-1
+	AzureKeyVaultCharsetLatin1 AzureKeyVaultCharset = "latin1"
+)
+
 // AzureKeyVaultObjectType defines which Object type to get from Azure Key Vault
 // +kubebuilder:validation:Enum=secret;certificate;key;multi-key-value-secret
 type AzureKeyVaultObjectType string
 
 // AzureKeyVaultObjectContentType defines what content type a secret contains,
-// only used when type is multi-key-value-secret
-// +kubebuilder:validation:Enum=application/x-json;application/x-yaml
+// only used when type is multi-key-value-secret.
+// Not set uses the content type attribute of the secret in Azure Key Vault
+// +kubebuilder:validation:Enum=application/x-json;application/x-yaml;text/x-java-properties;text/x-env
 type AzureKeyVaultObjectContentType string
 
 const (
@@ -115,6 +378,12 @@ const (
 
 	// AzureKeyVaultObjectContentTypeYaml - object content is of type application/x-yaml
 	AzureKeyVaultObjectContentTypeYaml = "application/x-yaml"
+
+	// AzureKeyVaultObjectContentTypeProperties - object content is of type text/x-java-properties
+	AzureKeyVaultObjectContentTypeProperties = "text/x-java-properties"
+
+	// AzureKeyVaultObjectContentTypeEnv - object content is a dotenv file of KEY=value lines
+	AzureKeyVaultObjectContentTypeEnv = "text/x-env"
 )
 
 // AzureKeyVaultOutput defines output sources, supports Secret and Configmap
@@ -124,40 +393,533 @@ type AzureKeyVaultOutput struct {
 	// +optional
 	ConfigMap AzureKeyVaultOutputConfigMap `json:"configMap"`
 	// +optional
+	// Transforms run in order on the value of secret objects, one of trim, chomp, base64encode, base64decode
+	// and jsonpath:<expr> to extract one value from a json document, like jsonpath:$.connectionStrings.primary,
+	// and replace:/<regex>/<replacement>/ to replace all matches of a regular expression, like replace:|^postgres://||
 	Transform []string `json:"transform,omitempty"`
+	// +optional
+	// What happens to the Secret and ConfigMap when the AzureKeyVaultSecret is deleted. Defaults to Delete
+	DeletePolicy AzureKeyVaultDeletePolicy `json:"deletePolicy,omitempty"`
+	// +optional
+	// How long to wait after detecting a change in Azure Key Vault before applying it, so several
+	// versions written in quick succession cause one update with the final value. Setting or
+	// changing the akv2k8s.io/force-sync annotation applies changes right away.
+	RotationDebounce *metav1.Duration `json:"rotationDebounce,omitempty"`
 }
 
+// AzureKeyVaultDeletePolicy defines what happens to outputs when the AzureKeyVaultSecret is deleted
+// +kubebuilder:validation:Enum=Delete;Retain
+type AzureKeyVaultDeletePolicy string
+
+const (
+	// AzureKeyVaultDeletePolicyDelete - outputs are deleted with the AzureKeyVaultSecret, and values
+	// written to outputs shared with others are removed
+	AzureKeyVaultDeletePolicyDelete AzureKeyVaultDeletePolicy = "Delete"
+
+	// AzureKeyVaultDeletePolicyRetain - outputs are kept as they are, without the AzureKeyVaultSecret
+	// as owner
+	AzureKeyVaultDeletePolicyRetain AzureKeyVaultDeletePolicy = "Retain"
+)
+
 // AzureKeyVaultOutputSecret has information needed to output
 // a secret from Azure Key Vault to Kubernetes as a Secret resource
 type AzureKeyVaultOutputSecret struct {
-	// Name for Kubernetes secret
+	// +optional
+	// Name for Kubernetes secret, defaults to the AzureKeyVaultSecret name when other fields are set
 	Name string `json:"name"`
 	// +optional
-	// Type of Secret in Kubernetes
+	// Type of Secret in Kubernetes, defaults to Opaque for secret and multi-key-value-secret objects
 	Type corev1.SecretType `json:"type,omitempty"`
 	// +optional
-	// The key to use in Kubernetes secret when setting the value from Azure Key Vault object data
+	// The key to use in Kubernetes secret when setting the value from Azure Key Vault object data,
+	// defaults to the object name for single value secrets
 	DataKey string `json:"dataKey,omitempty"`
 	// +optional
-	// By setting chainOrder to ensureserverfirst the server certificate will be moved first in the chain
-	// +kubebuilder:validation:Enum=ensureserverfirst
+	// Normalize the casing of all keys written to the Kubernetes secret
+	DataKeyCase AzureKeyVaultDataKeyCase `json:"dataKeyCase,omitempty"`
+	// +optional
+	// Alias of dataKeyCase, where snake-upper is upperSnake. Must agree with dataKeyCase when
+	// both are set
+	KeyTransform AzureKeyVaultKeyTransform `json:"keyTransform,omitempty"`
+	// +optional
+	// Prepended to every key written to the Kubernetes secret, after dataKeyCase, like APP_DB_
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+	// +optional
+	// Appended to every key written to the Kubernetes secret, after dataKeyCase
+	KeySuffix string `json:"keySuffix,omitempty"`
+	// +optional
+	// Only write these keys to the Secret, picked from the values after transforms and dataKeyCase,
+	// so each of spec.outputs can take its own part of a multi-key-value secret
+	Keys []string `json:"keys,omitempty"`
+	// +optional
+	// Only write keys of a multi-key-value secret matching one of these glob patterns, like DB_*
+	IncludeKeys []string `json:"includeKeys,omitempty"`
+	// +optional
+	// Leave out keys of a multi-key-value secret matching one of these glob patterns
+	ExcludeKeys []string `json:"excludeKeys,omitempty"`
+	// +optional
+	// By setting chainOrder to ensureserverfirst the server certificate will be moved first in the chain.
+	// Setting chainOrder to split writes the leaf to tls.crt, the intermediates in order to chain.pem
+	// and the root to ca.crt of kubernetes.io/tls Secrets
+	// +kubebuilder:validation:Enum=ensureserverfirst;split
 	ChainOrder string `json:"chainOrder,omitempty"`
+	// +optional
+	// Options for how Azure Key Vault key objects are written to the Secret
+	Key AzureKeyVaultOutputKey `json:"key,omitempty"`
+	// +optional
+	// Format of private keys of certificates and keys written to the Secret, like to tls.key.
+	// Defaults to pkcs1, being RSA PRIVATE KEY for rsa keys and EC PRIVATE KEY for ec keys,
+	// while pkcs8 writes PRIVATE KEY for both
+	KeyEncoding AzureKeyVaultPrivateKeyFormat `json:"keyEncoding,omitempty"`
+	// +optional
+	// Options for how Azure Key Vault certificate objects are written to the Secret
+	Certificate AzureKeyVaultOutputCertificate `json:"certificate,omitempty"`
+	// +optional
+	// Also write certificate objects with their private key and chain as a password protected keystore
+	Keystore *AzureKeyVaultOutputKeystore `json:"keystore,omitempty"`
+	// +optional
+	// Skip the default transforms configured for the controller
+	DisableDefaultTransforms bool `json:"disableDefaultTransforms,omitempty"`
+	// +optional
+	// What to do when the Secret has been deleted after being synced. Defaults to Always
+	RecreatePolicy AzureKeyVaultRecreatePolicy `json:"recreatePolicy,omitempty"`
+	// +optional
+	// What to do when the Secret is owned by a different AzureKeyVaultSecret and cannot be shared. Defaults to Fail
+	ConflictPolicy AzureKeyVaultConflictPolicy `json:"conflictPolicy,omitempty"`
+	// +optional
+	// How values are written to an existing Secret. Defaults to managedKeysOnly
+	MergeStrategy AzureKeyVaultMergeStrategy `json:"mergeStrategy,omitempty"`
+	// +optional
+	// Keep keys in the Secret not written by the AzureKeyVaultSecret, like keys added by hand, when
+	// the Secret is repaired after being changed outside of akv2k8s, as with mergeStrategy managedKeysOnly.
+	// Cannot be combined with mergeStrategy replaceAll
+	PreserveUnmanagedKeys bool `json:"preserveUnmanagedKeys,omitempty"`
+	// +optional
+	// Skip checking that the private key matches the certificate before writing tls secrets
+	SkipKeyMatchCheck bool `json:"skipKeyMatchCheck,omitempty"`
+	// +optional
+	// Deployments, StatefulSets and DaemonSets in the same namespace to annotate with a checksum of the
+	// Secret values in their pod template, so they roll out when the values change
+	ChecksumAnnotationTargets []AzureKeyVaultWorkloadReference `json:"checksumAnnotationTargets,omitempty"`
+	// +optional
+	// Go template rendered with the values from Azure Key Vault, written to the Secret as dataKey
+	Template string `json:"template,omitempty"`
+	// +optional
+	// Read the template from a source in the same namespace, cannot be combined with template
+	TemplateFrom *AzureKeyVaultOutputTemplateFrom `json:"templateFrom,omitempty"`
+	// +optional
+	// Deprecated: use deletePolicy. What happens to the Secret when the AzureKeyVaultSecret is deleted, while
+	// deletePolicy is not set. Must equal deletePolicy when both are set
+	ReclaimPolicy AzureKeyVaultDeletePolicy `json:"reclaimPolicy,omitempty"`
+}
+
+// AzureKeyVaultOutputTemplateFrom has information about where to read the template for an output
+type AzureKeyVaultOutputTemplateFrom struct {
+	// Selects a key of a ConfigMap holding the template
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef"`
+}
+
+// AzureKeyVaultMergeStrategy defines how values are written to an existing output
+// +kubebuilder:validation:Enum=managedKeysOnly;replaceAll
+type AzureKeyVaultMergeStrategy string
+
+const (
+	// AzureKeyVaultMergeStrategyManagedKeysOnly - only keys written by the AzureKeyVaultSecret
+	// (status.secretKeys) are created, updated or deleted, other keys are left untouched
+	AzureKeyVaultMergeStrategyManagedKeysOnly AzureKeyVaultMergeStrategy = "managedKeysOnly"
+
+	// AzureKeyVaultMergeStrategyReplaceAll - the output has exactly the keys of the AzureKeyVaultSecret,
+	// other keys are removed. Not for Secrets shared by several AzureKeyVaultSecrets.
+	AzureKeyVaultMergeStrategyReplaceAll AzureKeyVaultMergeStrategy = "replaceAll"
+)
+
+// AzureKeyVaultConflictPolicy defines what happens when an output is owned by a different
+// AzureKeyVaultSecret. Opaque Secrets can be shared and are never in conflict.
+// +kubebuilder:validation:Enum=Fail;Skip;TakeOver
+type AzureKeyVaultConflictPolicy string
+
+const (
+	// AzureKeyVaultConflictPolicyFail - the sync fails until the conflict is resolved
+	AzureKeyVaultConflictPolicyFail AzureKeyVaultConflictPolicy = "Fail"
+
+	// AzureKeyVaultConflictPolicySkip - the output is left to its owner without failing the sync
+	AzureKeyVaultConflictPolicySkip AzureKeyVaultConflictPolicy = "Skip"
+
+	// AzureKeyVaultConflictPolicyTakeOver - ownership of the output is transferred, when the current
+	// owner acknowledges it with the allow-takeover annotation or the controller allows takeovers
+	AzureKeyVaultConflictPolicyTakeOver AzureKeyVaultConflictPolicy = "TakeOver"
+)
+
+// AzureKeyVaultRecreatePolicy defines if a deleted output is recreated. Changes to the
+// AzureKeyVaultSecret spec always recreate the output, regardless of policy.
+// +kubebuilder:validation:Enum=Always;Never;Manual
+type AzureKeyVaultRecreatePolicy string
+
+const (
+	// AzureKeyVaultRecreatePolicyAlways - a deleted output is recreated on the next sync
+	AzureKeyVaultRecreatePolicyAlways AzureKeyVaultRecreatePolicy = "Always"
+
+	// AzureKeyVaultRecreatePolicyNever - a deleted output stays deleted until the spec changes
+	AzureKeyVaultRecreatePolicyNever AzureKeyVaultRecreatePolicy = "Never"
+
+	// AzureKeyVaultRecreatePolicyManual - a deleted output is recreated when the force sync annotation is set or changed
+	AzureKeyVaultRecreatePolicyManual AzureKeyVaultRecreatePolicy = "Manual"
+)
+
+// AzureKeyVaultDataKeyCase defines how keys in the output are normalized
+// +kubebuilder:validation:Enum=asIs;upper;lower;upperSnake;lowerSnake;camel
+type AzureKeyVaultDataKeyCase string
+
+const (
+	// AzureKeyVaultDataKeyCaseAsIs - keys are written unchanged
+	AzureKeyVaultDataKeyCaseAsIs AzureKeyVaultDataKeyCase = "asIs"
+
+	// AzureKeyVaultDataKeyCaseUpper - keys are written in upper case, keeping separators as is
+	AzureKeyVaultDataKeyCaseUpper AzureKeyVaultDataKeyCase = "upper"
+
+	// AzureKeyVaultDataKeyCaseLower - keys are written in lower case, keeping separators as is
+	AzureKeyVaultDataKeyCaseLower AzureKeyVaultDataKeyCase = "lower"
+
+	// AzureKeyVaultDataKeyCaseUpperSnake - keys are written as UPPER_SNAKE_CASE
+	AzureKeyVaultDataKeyCaseUpperSnake AzureKeyVaultDataKeyCase = "upperSnake"
+
+	// AzureKeyVaultDataKeyCaseLowerSnake - keys are written as lower_snake_case
+	AzureKeyVaultDataKeyCaseLowerSnake AzureKeyVaultDataKeyCase = "lowerSnake"
+
+	// AzureKeyVaultDataKeyCaseCamel - keys are written as camelCase
+	AzureKeyVaultDataKeyCaseCamel AzureKeyVaultDataKeyCase = "camel"
+)
+
+// AzureKeyVaultKeyTransform is an alias of the AzureKeyVaultDataKeyCase values upper, lower
+// and upperSnake
+// +kubebuilder:validation:Enum=upper;lower;snake-upper
+type AzureKeyVaultKeyTransform string
+
+const (
+	// AzureKeyVaultKeyTransformUpper - same as dataKeyCase upper
+	AzureKeyVaultKeyTransformUpper AzureKeyVaultKeyTransform = "upper"
+
+	// AzureKeyVaultKeyTransformLower - same as dataKeyCase lower
+	AzureKeyVaultKeyTransformLower AzureKeyVaultKeyTransform = "lower"
+
+	// AzureKeyVaultKeyTransformSnakeUpper - same as dataKeyCase upperSnake
+	AzureKeyVaultKeyTransformSnakeUpper AzureKeyVaultKeyTransform = "snake-upper"
+)
+
+// AzureKeyVaultOutputKey has options for outputting
+// Azure Key Vault key objects
+type AzureKeyVaultOutputKey struct {
+	// +optional
+	// Encoding of the key material. If not set the raw key modulus is written as before
+	Encoding AzureKeyVaultKeyEncoding `json:"encoding,omitempty"`
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// Number of key versions before the current version to include in the key set, so tokens
+	// signed before a rotation can still be verified. Only used with encoding jwks
+	IncludePreviousVersions int `json:"includePreviousVersions,omitempty"`
+	// +optional
+	// The key to use for private key material, if available. Defaults to <dataKey>-private
+	PrivateDataKey string `json:"privateDataKey,omitempty"`
+}
+
+// AzureKeyVaultKeyEncoding defines how key material is encoded in the output
+// +kubebuilder:validation:Enum=pem;der;base64;jwks
+type AzureKeyVaultKeyEncoding string
+
+const (
+	// AzureKeyVaultKeyEncodingPem - key material encoded as pem text
+	AzureKeyVaultKeyEncodingPem AzureKeyVaultKeyEncoding = "pem"
+
+	// AzureKeyVaultKeyEncodingDer - key material as raw der bytes, written to binaryData of ConfigMap outputs
+	AzureKeyVaultKeyEncodingDer AzureKeyVaultKeyEncoding = "der"
+
+	// AzureKeyVaultKeyEncodingBase64 - key material as base64 encoded der
+	AzureKeyVaultKeyEncodingBase64 AzureKeyVaultKeyEncoding = "base64"
+
+	// AzureKeyVaultKeyEncodingJWKS - public key as a json web key set with the key version as kid,
+	// never including private key material
+	AzureKeyVaultKeyEncodingJWKS AzureKeyVaultKeyEncoding = "jwks"
+)
+
+// AzureKeyVaultOutputCertificate has options for outputting
+// Azure Key Vault certificate objects
+type AzureKeyVaultOutputCertificate struct {
+	// +optional
+	// Encoding of the certificate and its chain, independent of the private key. Defaults to pem.
+	// Using der or base64der, the certificate is written to dataKey and each certificate in the
+	// chain to <dataKey>-chain-<n>, as der cannot hold more than one certificate. Setting an encoding
+	// for Opaque secrets writes the private key as pem to <dataKey>-private instead of the raw certificate
+	Encoding AzureKeyVaultCertificateEncoding `json:"encoding,omitempty"`
+	// +optional
+	// Write the certificates following the leaf in the chain to ca.crt of kubernetes.io/tls Secrets
+	IncludeCAChain bool `json:"includeCAChain,omitempty"`
+	// +optional
+	// Annotate Secret outputs with the subject, SANs, issuer, serial, validity and key algorithm
+	// of the certificate. Off by default, as SANs may be sensitive
+	MetadataAnnotations bool `json:"metadataAnnotations,omitempty"`
+}
+
+// AzureKeyVaultCertificateEncoding defines how certificates are encoded in the output
+// +kubebuilder:validation:Enum=pem;der;base64der
+type AzureKeyVaultCertificateEncoding string
+
+const (
+	// AzureKeyVaultCertificateEncodingPem - certificate and chain concatenated as pem text
+	AzureKeyVaultCertificateEncodingPem AzureKeyVaultCertificateEncoding = "pem"
+
+	// AzureKeyVaultCertificateEncodingDer - one certificate per key as raw der bytes, written to binaryData of ConfigMap outputs
+	AzureKeyVaultCertificateEncodingDer AzureKeyVaultCertificateEncoding = "der"
+
+	// AzureKeyVaultCertificateEncodingBase64Der - one certificate per key as base64 encoded der
+	AzureKeyVaultCertificateEncodingBase64Der AzureKeyVaultCertificateEncoding = "base64der"
+)
+
+// AzureKeyVaultPrivateKeyFormat defines how private keys of certificates and keys are encoded
+// +kubebuilder:validation:Enum=pkcs1;pkcs8
+type AzureKeyVaultPrivateKeyFormat string
+
+const (
+	// AzureKeyVaultPrivateKeyFormatPkcs1 - RSA PRIVATE KEY for rsa keys and EC PRIVATE KEY (sec1) for ec keys
+	AzureKeyVaultPrivateKeyFormatPkcs1 AzureKeyVaultPrivateKeyFormat = "pkcs1"
+
+	// AzureKeyVaultPrivateKeyFormatPkcs8 - PRIVATE KEY for both rsa and ec keys
+	AzureKeyVaultPrivateKeyFormatPkcs8 AzureKeyVaultPrivateKeyFormat = "pkcs8"
+)
+
+// AzureKeyVaultOutputKeystore has information about writing a certificate to a Secret as a
+// keystore, as read by Java applications
+type AzureKeyVaultOutputKeystore struct {
+	// Format of the keystore
+	Format AzureKeyVaultKeystoreFormat `json:"format"`
+	// Selects a key of a Secret in the same namespace holding the keystore password, used
+	// both for the keystore and the private key in it
+	PasswordSecretRef *corev1.SecretKeySelector `json:"passwordSecretRef"`
+	// +optional
+	// The key to write the keystore to in the Secret, defaults to keystore.p12 for pkcs12
+	// and keystore.jks for jks
+	DataKey string `json:"dataKey,omitempty"`
 }
 
+// AzureKeyVaultKeystoreFormat defines the format of keystores
+// +kubebuilder:validation:Enum=pkcs12;jks
+type AzureKeyVaultKeystoreFormat string
+
+const (
+	// AzureKeyVaultKeystoreFormatPkcs12 - PKCS#12 keystore, being the default keystore type of Java 9 and later
+	AzureKeyVaultKeystoreFormatPkcs12 AzureKeyVaultKeystoreFormat = "pkcs12"
+
+	// AzureKeyVaultKeystoreFormatJKS - Java KeyStore, for applications not reading PKCS#12
+	AzureKeyVaultKeystoreFormatJKS AzureKeyVaultKeystoreFormat = "jks"
+)
+
 // AzureKeyVaultOutputConfigMap has information needed to output
 // a secret from Azure Key Vault to Kubernetes as a ConfigMap resource
 type AzureKeyVaultOutputConfigMap struct {
 	// Name for Kubernetes ConfigMap
 	Name string `json:"name"`
-	// The key to use in Kubernetes ConfigMap when setting the value from Azure Key Vault object data
-	DataKey string `json:"dataKey"`
+	// +optional
+	// The key to use in Kubernetes ConfigMap when setting the value from Azure Key Vault object data,
+	// defaults to the object name for single value secrets
+	DataKey string `json:"dataKey,omitempty"`
+	// +optional
+	// Only write these keys to the ConfigMap, picked from the values after transforms, so each of
+	// spec.outputs can take its own part of a multi-key-value secret
+	Keys []string `json:"keys,omitempty"`
+	// +optional
+	// Only write keys of a multi-key-value secret matching one of these glob patterns, like DB_*
+	IncludeKeys []string `json:"includeKeys,omitempty"`
+	// +optional
+	// Leave out keys of a multi-key-value secret matching one of these glob patterns
+	ExcludeKeys []string `json:"excludeKeys,omitempty"`
+	// +optional
+	// Options for how Azure Key Vault key objects are written to the ConfigMap
+	Key AzureKeyVaultOutputKey `json:"key,omitempty"`
+	// +optional
+	// Options for how Azure Key Vault certificate objects are written to the ConfigMap
+	Certificate AzureKeyVaultOutputCertificate `json:"certificate,omitempty"`
+	// +optional
+	// Write the values to an immutable ConfigMap named <name>-<hash of values>, creating a new ConfigMap when
+	// the values change. status.configMapName has the name of the current ConfigMap, and replaced ConfigMaps are
+	// deleted after a grace period.
+	Immutable bool `json:"immutable,omitempty"`
+	// +optional
+	// Write all values to binaryData, instead of only the values that are not valid UTF-8
+	ForceBinary bool `json:"forceBinary,omitempty"`
+	// +optional
+	// Go template rendered with the values from Azure Key Vault, written to the ConfigMap as dataKey
+	Template string `json:"template,omitempty"`
+	// +optional
+	// Read the template from a source in the same namespace, cannot be combined with template
+	TemplateFrom *AzureKeyVaultOutputTemplateFrom `json:"templateFrom,omitempty"`
+	// +optional
+	// Deprecated: use deletePolicy. What happens to the ConfigMap when the AzureKeyVaultSecret is deleted, while
+	// deletePolicy is not set. Must equal deletePolicy when both are set
+	ReclaimPolicy AzureKeyVaultDeletePolicy `json:"reclaimPolicy,omitempty"`
 }
 
 // AzureKeyVaultSecretStatus is the status for a AzureKeyVaultSecret resource
 type AzureKeyVaultSecretStatus struct {
 	SecretHash      string      `json:"secretHash,omitempty"`
+	SecretKeys      []string    `json:"secretKeys,omitempty"`
 	SecretName      string      `json:"secretName,omitempty"`
 	ConfigMapHash   string      `json:"configMapHash,omitempty"`
 	ConfigMapName   string      `json:"configMapName,omitempty"`
 	LastAzureUpdate metav1.Time `json:"lastAzureUpdate,omitempty"`
+	// +optional
+	// Keys last written to the output ConfigMap
+	ConfigMapKeys []string `json:"configMapKeys,omitempty"`
+	// +optional
+	// When Azure Key Vault is expected to renew the certificate, according to its issuance policy
+	PredictedRenewalTime *metav1.Time `json:"predictedRenewalTime,omitempty"`
+	// +optional
+	// Workloads consuming the output Secret or ConfigMap, only set when enabled in the controller
+	ReferencedBy *AzureKeyVaultSecretReferencedBy `json:"referencedBy,omitempty"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// +optional
+	// Status of each Secret and ConfigMap in spec.outputs
+	Outputs []AzureKeyVaultOutputStatus `json:"outputs,omitempty"`
+	// +optional
+	// Result of the last read of each object in spec.vault.objects
+	Objects []AzureKeyVaultObjectStatus `json:"objects,omitempty"`
+	// +optional
+	// Keys from Azure Key Vault that were not valid Kubernetes data keys, mapped to the sanitized key written instead
+	SanitizedKeys map[string]string `json:"sanitizedKeys,omitempty"`
+	// +optional
+	// Name of the Azure Key Vault the current values were read from
+	ServedBy string `json:"servedBy,omitempty"`
+	// +optional
+	// Names of the data keys added, modified and removed by the last rotation of the output Secret
+	LastRotationChanges string `json:"lastRotationChanges,omitempty"`
+	// +optional
+	// When Azure Key Vault is next polled for changes, kept across controller restarts
+	NextAzurePollTime *metav1.Time `json:"nextAzurePollTime,omitempty"`
+	// +optional
+	// Number of times a change in Azure Key Vault has been applied to the outputs, mirroring
+	// the akv2k8s.io/rotation-generation annotation
+	RotationGeneration int64 `json:"rotationGeneration,omitempty"`
+	// +optional
+	// Workloads with the checksum of the output Secret values in their pod template
+	ChecksumAnnotationTargets []AzureKeyVaultWorkloadReference `json:"checksumAnnotationTargets,omitempty"`
+	// +optional
+	// Immutable ConfigMaps replaced by a newer revision, deleted once the grace period has passed
+	RetiredConfigMaps []AzureKeyVaultRetiredOutput `json:"retiredConfigMaps,omitempty"`
+	// +optional
+	// The concrete object version synced when spec.vault.object.version is "previous"
+	PreviousVersion *AzureKeyVaultPreviousVersion `json:"previousVersion,omitempty"`
+	// +optional
+	// The object version in Azure Key Vault the outputs were last synced from
+	VaultObjectVersion string `json:"vaultObjectVersion,omitempty"`
+	// +optional
+	// When the object version the outputs were last synced from was last updated in Azure Key Vault
+	VaultObjectUpdated *metav1.Time `json:"vaultObjectUpdated,omitempty"`
+	// +optional
+	// The URI of the Azure Key Vault the outputs were last synced from
+	VaultURI string `json:"vaultURI,omitempty"`
+	// +optional
+	// The controller instance managing the AzureKeyVaultSecret, only set when instance IDs are used
+	Claim *AzureKeyVaultSecretClaim `json:"claim,omitempty"`
+	// +optional
+	// A change in Azure Key Vault waiting for spec.output.rotationDebounce to pass before it is applied
+	DebouncedRotation *AzureKeyVaultDebouncedRotation `json:"debouncedRotation,omitempty"`
+	// +optional
+	// The metadata.generation of the AzureKeyVaultSecret last synced, successfully or not
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	// The error of the last sync, empty if it succeeded
+	LastSyncError string `json:"lastSyncError,omitempty"`
+	// +optional
+	// Number of syncs failed in a row since the last successful sync
+	FailedSyncCount int64 `json:"failedSyncCount,omitempty"`
+}
+
+// AzureKeyVaultDebouncedRotation is a change in Azure Key Vault held back by spec.output.rotationDebounce
+type AzureKeyVaultDebouncedRotation struct {
+	// When the change was detected
+	DetectedTime metav1.Time `json:"detectedTime"`
+	// When Azure Key Vault is checked again and the latest values applied
+	ApplyTime metav1.Time `json:"applyTime"`
+}
+
+// AzureKeyVaultSecretClaim tells which controller instance manages a AzureKeyVaultSecret
+type AzureKeyVaultSecretClaim struct {
+	// Instance ID of the controller
+	Instance string `json:"instance"`
+	// When the claim was last renewed, other instances take over once it has expired
+	RenewTime metav1.Time `json:"renewTime"`
+}
+
+// AzureKeyVaultPreviousVersion is the object version resolved from the symbolic version "previous"
+type AzureKeyVaultPreviousVersion struct {
+	// The object version synced
+	Version string `json:"version"`
+	// The current object version when the previous version was resolved
+	CurrentVersion string `json:"currentVersion,omitempty"`
+	// When the previous version was resolved
+	ResolvedTime metav1.Time `json:"resolvedTime"`
+}
+
+// AzureKeyVaultRetiredOutput is an immutable output replaced by a newer revision
+type AzureKeyVaultRetiredOutput struct {
+	// Name of the Secret or ConfigMap
+	Name string `json:"name"`
+	// When the output was replaced
+	RetiredTime metav1.Time `json:"retiredTime"`
+}
+
+// AzureKeyVaultOutputStatus is the status of a Secret or ConfigMap in spec.outputs
+type AzureKeyVaultOutputStatus struct {
+	// Kind of output, Secret or ConfigMap
+	Kind string `json:"kind"`
+	// Name of the Secret or ConfigMap
+	Name string `json:"name"`
+	// +optional
+	// Hash of the values last written to the output
+	Hash string `json:"hash,omitempty"`
+	// +optional
+	// Keys last written to the output
+	Keys []string `json:"keys,omitempty"`
+	// +optional
+	// Names of the data keys added, modified and removed by the last rotation of the output
+	LastRotationChanges string `json:"lastRotationChanges,omitempty"`
+	// +optional
+	// Number of times a change in Azure Key Vault has been applied to the output, mirroring
+	// its akv2k8s.io/rotation-generation annotation
+	RotationGeneration int64 `json:"rotationGeneration,omitempty"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// AzureKeyVaultObjectStatus is the result of the last read of an object in spec.vault.objects
+type AzureKeyVaultObjectStatus struct {
+	// Name of the object in Azure Key Vault
+	Name string `json:"name"`
+	// Name or URI of the Azure Key Vault the object was read from
+	Vault string `json:"vault"`
+	// +optional
+	// The error reading the object, empty if it was read
+	Error string `json:"error,omitempty"`
+}
+
+// AzureKeyVaultSecretReferencedBy has information about workloads
+// consuming the output of a AzureKeyVaultSecret
+type AzureKeyVaultSecretReferencedBy struct {
+	// Workloads consuming the output, limited to a max number of workloads
+	Workloads []AzureKeyVaultWorkloadReference `json:"workloads,omitempty"`
+	// Total number of workloads consuming the output
+	Count int `json:"count"`
+	// When the workloads was last looked up
+	LastRefreshed metav1.Time `json:"lastRefreshed,omitempty"`
+}
+
+// AzureKeyVaultWorkloadReference references a workload in the same namespace
+type AzureKeyVaultWorkloadReference struct {
+	// Kind of workload, like Deployment, StatefulSet or DaemonSet
+	Kind string `json:"kind"`
+	// Name of workload
+	Name string `json:"name"`
 }
@@ -0,0 +1,334 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validation validates AzureKeyVaultSecret specs, both at admission by the webhook
+// and by the controller before syncing
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+
+	"github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/akv2k8s/transformers"
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var supportedObjectTypes = []string{
+	string(akv.AzureKeyVaultObjectTypeSecret),
+	akv.AzureKeyVaultObjectTypeMultiKeyValueSecret,
+	akv.AzureKeyVaultObjectTypeCertificate,
+	akv.AzureKeyVaultObjectTypeKey,
+}
+
+// ValidateAzureKeyVaultSecret returns every problem in the spec of akvs that syncing can
+// never get past, each with the path of the offending field
+func ValidateAzureKeyVaultSecret(akvs *akv.AzureKeyVaultSecret) field.ErrorList {
+	specPath := field.NewPath("spec")
+	allErrs := validateVault(akvs.Spec.Vault, specPath.Child("vault"))
+	if len(akvs.Spec.Vault.Objects) > 0 {
+		allErrs = append(allErrs, validateObjects(akvs, specPath)...)
+	} else {
+		allErrs = append(allErrs, validateObjectType(akvs.Spec.Vault.Object.Type, specPath.Child("vault", "object", "type"))...)
+	}
+
+	allErrs = append(allErrs, validateOutput(akvs.Spec.Vault.Object.Type, akvs.Spec.Output, specPath.Child("output"))...)
+	for i, output := range akvs.Spec.Outputs {
+		allErrs = append(allErrs, validateOutput(akvs.Spec.Vault.Object.Type, output, specPath.Child("outputs").Index(i))...)
+	}
+	return allErrs
+}
+
+// validateVault validates that the vault is identified by exactly one of name and uri
+func validateVault(vault akv.AzureKeyVault, fldPath *field.Path) field.ErrorList {
+	if vault.Name == "" && vault.URI == "" {
+		return field.ErrorList{field.Required(fldPath.Child("name"), "name or uri is required")}
+	}
+	return validateVaultAddress(vault.Name, vault.URI, fldPath.Child("name"), fldPath.Child("uri"))
+}
+
+// validateVaultAddress validates that a vault is not identified by both name and uri, and
+// that uri is the URL of a vault
+func validateVaultAddress(name, uri string, namePath, uriPath *field.Path) field.ErrorList {
+	switch {
+	case name != "" && uri != "":
+		return field.ErrorList{field.Forbidden(uriPath, fmt.Sprintf("cannot be combined with %s", namePath.String()))}
+	case uri != "":
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "https" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			return field.ErrorList{field.Invalid(uriPath, uri, "must be an https URL without a path, like https://my-vault.vault.azure.net")}
+		}
+	}
+	return nil
+}
+
+// validateObjects validates spec.vault.objects, which are synced into spec.output.secret and
+// spec.output.configMap. Each declared output must have objects written to it, and each object
+// must be written to a declared output.
+func validateObjects(akvs *akv.AzureKeyVaultSecret, specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	vaultPath, outputPath := specPath.Child("vault"), specPath.Child("output")
+
+	object := akvs.Spec.Vault.Object
+	if object.Name != "" || object.NameFrom != nil || object.Type != "" {
+		allErrs = append(allErrs, field.Forbidden(vaultPath.Child("object"), "cannot be combined with objects"))
+	}
+	if akvs.Spec.Output.Secret.Name == "" && akvs.Spec.Output.ConfigMap.Name == "" {
+		allErrs = append(allErrs, field.Required(outputPath.Child("secret", "name"), "spec.output.secret or spec.output.configMap is required with spec.vault.objects"))
+	}
+	if len(akvs.Spec.Outputs) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("outputs"), "spec.vault.objects are only synced into spec.output"))
+	}
+
+	declared := map[akv.AzureKeyVaultObjectOutput]bool{
+		akv.AzureKeyVaultObjectOutputSecret:    akvs.Spec.Output.Secret.Name != "",
+		akv.AzureKeyVaultObjectOutputConfigMap: akvs.Spec.Output.ConfigMap.Name != "",
+	}
+	written := make(map[akv.AzureKeyVaultObjectOutput]bool)
+	dataKeys := make(map[akv.AzureKeyVaultObjectOutput]map[string]bool)
+	for i, object := range akvs.Spec.Vault.Objects {
+		objectPath := vaultPath.Child("objects").Index(i)
+		if object.Name == "" {
+			allErrs = append(allErrs, field.Required(objectPath.Child("name"), ""))
+		}
+		allErrs = append(allErrs, validateObjectType(object.Type, objectPath.Child("type"))...)
+		allErrs = append(allErrs, validateVaultAddress(object.VaultName, object.VaultURI, objectPath.Child("vaultName"), objectPath.Child("vaultURI"))...)
+		if object.CredentialsFrom != nil && object.CredentialsFrom.SecretRef.Name == "" {
+			allErrs = append(allErrs, field.Required(objectPath.Child("credentialsFrom", "secretRef", "name"), ""))
+		}
+
+		output := akv.ObjectOutput(akvs, object)
+		switch output {
+		case akv.AzureKeyVaultObjectOutputSecret, akv.AzureKeyVaultObjectOutputConfigMap:
+			if !declared[output] {
+				allErrs = append(allErrs, field.Invalid(objectPath.Child("output"), output, fmt.Sprintf("spec.output.%s is not set", output)))
+			}
+			written[output] = true
+		default:
+			allErrs = append(allErrs, field.NotSupported(objectPath.Child("output"), output, []string{string(akv.AzureKeyVaultObjectOutputSecret), string(akv.AzureKeyVaultObjectOutputConfigMap)}))
+		}
+
+		ownDataKeys := output == akv.AzureKeyVaultObjectOutputSecret && akv.HasOwnDataKeys(akvs.Spec.Output.Secret.Type)
+		if object.Type == akv.AzureKeyVaultObjectTypeSecret && object.DataKey == "" && !ownDataKeys {
+			allErrs = append(allErrs, field.Required(objectPath.Child("dataKey"), "required for a single value secret unless the secret type has its own keys"))
+		}
+		if object.DataKey != "" {
+			if dataKeys[output] == nil {
+				dataKeys[output] = make(map[string]bool)
+			}
+			if dataKeys[output][object.DataKey] {
+				allErrs = append(allErrs, field.Duplicate(objectPath.Child("dataKey"), object.DataKey))
+			}
+			dataKeys[output][object.DataKey] = true
+		}
+	}
+
+	if declared[akv.AzureKeyVaultObjectOutputSecret] && !written[akv.AzureKeyVaultObjectOutputSecret] {
+		allErrs = append(allErrs, field.Invalid(outputPath.Child("secret", "name"), akvs.Spec.Output.Secret.Name, "no entry of spec.vault.objects is written to the Secret"))
+	}
+	if declared[akv.AzureKeyVaultObjectOutputConfigMap] && !written[akv.AzureKeyVaultObjectOutputConfigMap] {
+		allErrs = append(allErrs, field.Invalid(outputPath.Child("configMap", "name"), akvs.Spec.Output.ConfigMap.Name, "no entry of spec.vault.objects is written to the ConfigMap"))
+	}
+	return allErrs
+}
+
+func validateObjectType(objectType akv.AzureKeyVaultObjectType, fldPath *field.Path) field.ErrorList {
+	if objectType == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+	for _, supported := range supportedObjectTypes {
+		if string(objectType) == supported {
+			return nil
+		}
+	}
+	return field.ErrorList{field.NotSupported(fldPath, objectType, supportedObjectTypes)}
+}
+
+// validateOutput validates the names, data keys and transforms of output, written from an
+// object of objectType
+func validateOutput(objectType akv.AzureKeyVaultObjectType, output akv.AzureKeyVaultOutput, fldPath *field.Path) field.ErrorList {
+	secretPath, configMapPath := fldPath.Child("secret"), fldPath.Child("configMap")
+	allErrs := validateName(output.Secret.Name, secretPath.Child("name"))
+	allErrs = append(allErrs, validateName(output.ConfigMap.Name, configMapPath.Child("name"))...)
+
+	// a single value secret has no key of its own to write the value to
+	if objectType == akv.AzureKeyVaultObjectTypeSecret {
+		if output.Secret.Name != "" && output.Secret.DataKey == "" && !akv.HasOwnDataKeys(output.Secret.Type) {
+			allErrs = append(allErrs, field.Required(secretPath.Child("dataKey"), "required for a single value secret unless the secret type has its own keys"))
+		}
+		if output.ConfigMap.Name != "" && output.ConfigMap.DataKey == "" {
+			allErrs = append(allErrs, field.Required(configMapPath.Child("dataKey"), "required for a single value secret"))
+		}
+	}
+
+	allErrs = append(allErrs, validateReclaimPolicy(output.Secret.ReclaimPolicy, output.DeletePolicy, secretPath.Child("reclaimPolicy"), fldPath.Child("deletePolicy"))...)
+	allErrs = append(allErrs, validateReclaimPolicy(output.ConfigMap.ReclaimPolicy, output.DeletePolicy, configMapPath.Child("reclaimPolicy"), fldPath.Child("deletePolicy"))...)
+	if output.Secret.PreserveUnmanagedKeys && output.Secret.MergeStrategy == akv.AzureKeyVaultMergeStrategyReplaceAll {
+		allErrs = append(allErrs, field.Forbidden(secretPath.Child("preserveUnmanagedKeys"), "cannot be combined with mergeStrategy replaceAll"))
+	}
+	allErrs = append(allErrs, validateKeyTransform(output.Secret, secretPath)...)
+	allErrs = append(allErrs, validateKeyAffixes(output.Secret, secretPath)...)
+	allErrs = append(allErrs, validateKeystore(objectType, output.Secret.Keystore, secretPath.Child("keystore"))...)
+	allErrs = append(allErrs, validateOutputKey(output.Secret.Key, secretPath.Child("key"))...)
+	allErrs = append(allErrs, validateOutputKey(output.ConfigMap.Key, configMapPath.Child("key"))...)
+	allErrs = append(allErrs, validateKeys(output.Secret.Keys, secretPath.Child("keys"))...)
+	allErrs = append(allErrs, validateKeys(output.ConfigMap.Keys, configMapPath.Child("keys"))...)
+	allErrs = append(allErrs, validateKeyPatterns(output.Secret.IncludeKeys, secretPath.Child("includeKeys"))...)
+	allErrs = append(allErrs, validateKeyPatterns(output.Secret.ExcludeKeys, secretPath.Child("excludeKeys"))...)
+	allErrs = append(allErrs, validateKeyPatterns(output.ConfigMap.IncludeKeys, configMapPath.Child("includeKeys"))...)
+	allErrs = append(allErrs, validateKeyPatterns(output.ConfigMap.ExcludeKeys, configMapPath.Child("excludeKeys"))...)
+
+	for i, transform := range output.Transform {
+		if err := transformers.ValidateTransform(transform); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("transform").Index(i), transform, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateReclaimPolicy validates that policy, the deprecated reclaimPolicy of a Secret or
+// ConfigMap, does not contradict deletePolicy
+func validateReclaimPolicy(policy, deletePolicy akv.AzureKeyVaultDeletePolicy, fldPath, deletePolicyPath *field.Path) field.ErrorList {
+	if policy != "" && deletePolicy != "" && policy != deletePolicy {
+		return field.ErrorList{field.Invalid(fldPath, policy, fmt.Sprintf("deprecated, and must equal %s when both are set", deletePolicyPath))}
+	}
+	return nil
+}
+
+// validateKeyTransform validates that keyTransform, an alias of dataKeyCase, does not
+// contradict dataKeyCase
+func validateKeyTransform(secret akv.AzureKeyVaultOutputSecret, fldPath *field.Path) field.ErrorList {
+	if secret.KeyTransform == "" {
+		return nil
+	}
+	transformed := akv.DataKeyCaseOf(akv.AzureKeyVaultOutputSecret{KeyTransform: secret.KeyTransform})
+	if transformed == "" {
+		return field.ErrorList{field.NotSupported(fldPath.Child("keyTransform"), secret.KeyTransform, []string{
+			string(akv.AzureKeyVaultKeyTransformUpper), string(akv.AzureKeyVaultKeyTransformLower), string(akv.AzureKeyVaultKeyTransformSnakeUpper),
+		})}
+	}
+	if secret.DataKeyCase != "" && secret.DataKeyCase != transformed {
+		return field.ErrorList{field.Invalid(fldPath.Child("keyTransform"), secret.KeyTransform, fmt.Sprintf("alias of dataKeyCase %s, and must agree with %s when both are set", transformed, fldPath.Child("dataKeyCase")))}
+	}
+	return nil
+}
+
+// validateKeyAffixes validates that keyPrefix and keySuffix give valid data keys, checking
+// the data key of the Secret when known
+func validateKeyAffixes(secret akv.AzureKeyVaultOutputSecret, fldPath *field.Path) field.ErrorList {
+	if secret.KeyPrefix == "" && secret.KeySuffix == "" {
+		return nil
+	}
+	key := secret.DataKey
+	if key == "" {
+		key = "key"
+	}
+
+	var allErrs field.ErrorList
+	affixed := secret.KeyPrefix + key + secret.KeySuffix
+	for _, msg := range validation.IsConfigMapKey(affixed) {
+		fldName, value := "keyPrefix", secret.KeyPrefix
+		if secret.KeyPrefix == "" {
+			fldName, value = "keySuffix", secret.KeySuffix
+		}
+		allErrs = append(allErrs, field.Invalid(fldPath.Child(fldName), value, fmt.Sprintf("data key '%s' is not valid: %s", affixed, msg)))
+	}
+	return allErrs
+}
+
+// validateKeystore validates that keystores are only written for certificates, reading their
+// password from a key of a Secret
+func validateKeystore(objectType akv.AzureKeyVaultObjectType, keystore *akv.AzureKeyVaultOutputKeystore, fldPath *field.Path) field.ErrorList {
+	if keystore == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if objectType != akv.AzureKeyVaultObjectTypeCertificate {
+		allErrs = append(allErrs, field.Forbidden(fldPath, "only supported for certificate objects"))
+	}
+	switch keystore.Format {
+	case akv.AzureKeyVaultKeystoreFormatPkcs12, akv.AzureKeyVaultKeystoreFormatJKS:
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("format"), keystore.Format, []string{
+			string(akv.AzureKeyVaultKeystoreFormatPkcs12), string(akv.AzureKeyVaultKeystoreFormatJKS),
+		}))
+	}
+	if ref := keystore.PasswordSecretRef; ref == nil || ref.Name == "" || ref.Key == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("passwordSecretRef"), "must have both name and key"))
+	}
+	if keystore.DataKey != "" {
+		for _, msg := range validation.IsConfigMapKey(keystore.DataKey) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("dataKey"), keystore.DataKey, msg))
+		}
+	}
+	return allErrs
+}
+
+// validateOutputKey validates that previous key versions are only included in json web key sets
+func validateOutputKey(key akv.AzureKeyVaultOutputKey, fldPath *field.Path) field.ErrorList {
+	if key.IncludePreviousVersions < 0 {
+		return field.ErrorList{field.Invalid(fldPath.Child("includePreviousVersions"), key.IncludePreviousVersions, "must not be negative")}
+	}
+	if key.IncludePreviousVersions > 0 && key.Encoding != akv.AzureKeyVaultKeyEncodingJWKS {
+		return field.ErrorList{field.Invalid(fldPath.Child("includePreviousVersions"), key.IncludePreviousVersions, "only supported with encoding jwks")}
+	}
+	return nil
+}
+
+// validateKeys validates the keys an output is limited to, which must be unique data keys
+func validateKeys(keys []string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		for _, msg := range validation.IsConfigMapKey(key) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), key, msg))
+		}
+		if seen[key] {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), key))
+		}
+		seen[key] = true
+	}
+	return allErrs
+}
+
+// validateKeyPatterns validates the glob patterns in includeKeys or excludeKeys
+func validateKeyPatterns(patterns []string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, pattern := range patterns {
+		if pattern == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Index(i), ""))
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), pattern, "must be a glob pattern like DB_*"))
+		}
+	}
+	return allErrs
+}
+
+func validateName(name string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if name == "" {
+		return allErrs
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, msg))
+	}
+	return allErrs
+}
@@ -0,0 +1,390 @@
+/*
+Copyright Sparebanken Vest
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"testing"
+
+	akv "github.com/SparebankenVest/azure-key-vault-to-kubernetes/pkg/k8s/apis/azurekeyvault/v2beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func validSecret() *akv.AzureKeyVaultSecret {
+	return &akv.AzureKeyVaultSecret{
+		Spec: akv.AzureKeyVaultSecretSpec{
+			Vault: akv.AzureKeyVault{
+				Name:   "my-vault",
+				Object: akv.AzureKeyVaultObject{Name: "my-secret", Type: akv.AzureKeyVaultObjectTypeSecret},
+			},
+			Output: akv.AzureKeyVaultOutput{
+				Secret: akv.AzureKeyVaultOutputSecret{Name: "my-secret", DataKey: "password"},
+			},
+		},
+	}
+}
+
+func TestValidateAzureKeyVaultSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(akvs *akv.AzureKeyVaultSecret)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {},
+		},
+		{
+			name: "vault uri",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Name = ""
+				akvs.Spec.Vault.URI = "https://my-hsm.managedhsm.azure.net/"
+			},
+		},
+		{
+			name: "vault name and uri",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.URI = "https://my-vault.privatelink.vaultcore.azure.net"
+			},
+			fields: []string{"spec.vault.uri"},
+		},
+		{
+			name:   "missing vault name and uri",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Vault.Name = "" },
+			fields: []string{"spec.vault.name"},
+		},
+		{
+			name: "invalid vault uri",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Name = ""
+				akvs.Spec.Vault.URI = "http://my-vault.vault.azure.net/secrets"
+			},
+			fields: []string{"spec.vault.uri"},
+		},
+		{
+			name: "objects",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "db-username", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "username"},
+					{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password"},
+					{Name: "db-settings", Type: akv.AzureKeyVaultObjectTypeMultiKeyValueSecret},
+				}
+			},
+		},
+		{
+			name: "invalid objects",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "my-config", DataKey: "password"}
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "db-username", Type: akv.AzureKeyVaultObjectTypeSecret},
+					{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password"},
+					{Type: "password", DataKey: "password"},
+				}
+			},
+			fields: []string{
+				"spec.vault.object",
+				"spec.vault.objects[0].dataKey",
+				"spec.vault.objects[2].name",
+				"spec.vault.objects[2].type",
+				"spec.vault.objects[2].dataKey",
+				"spec.output.configMap.name",
+			},
+		},
+		{
+			name: "objects routed to outputs",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "my-config"}
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "ca", Type: akv.AzureKeyVaultObjectTypeCertificate, Output: akv.AzureKeyVaultObjectOutputConfigMap},
+					{Name: "client-key", Type: akv.AzureKeyVaultObjectTypeKey},
+					{Name: "host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host", Output: akv.AzureKeyVaultObjectOutputConfigMap},
+					{Name: "password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host"},
+				}
+			},
+		},
+		{
+			name: "objects routed to undeclared outputs",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "ca", Type: akv.AzureKeyVaultObjectTypeCertificate, Output: akv.AzureKeyVaultObjectOutputConfigMap},
+					{Name: "client-key", Type: akv.AzureKeyVaultObjectTypeKey, Output: "file"},
+				}
+			},
+			fields: []string{
+				"spec.vault.objects[0].output",
+				"spec.vault.objects[1].output",
+				"spec.output.secret.name",
+			},
+		},
+		{
+			name: "objects from other vaults",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password", VaultName: "team-vault"},
+					{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host", VaultURI: "https://platform.vault.azure.net", CredentialsFrom: &akv.AzureKeyVaultCredentialsFrom{SecretRef: corev1.LocalObjectReference{Name: "platform"}}},
+				}
+			},
+		},
+		{
+			name: "invalid object vaults",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object = akv.AzureKeyVaultObject{}
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Vault.Objects = []akv.AzureKeyVaultObjectReference{
+					{Name: "db-password", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "password", VaultName: "team-vault", VaultURI: "https://team-vault.vault.azure.net"},
+					{Name: "db-host", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "host", VaultURI: "http://platform.vault.azure.net/secrets"},
+					{Name: "db-user", Type: akv.AzureKeyVaultObjectTypeSecret, DataKey: "user", CredentialsFrom: &akv.AzureKeyVaultCredentialsFrom{}},
+				}
+			},
+			fields: []string{
+				"spec.vault.objects[0].vaultURI",
+				"spec.vault.objects[1].vaultURI",
+				"spec.vault.objects[2].credentialsFrom.secretRef.name",
+			},
+		},
+		{
+			name:   "unknown object type",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Vault.Object.Type = "password" },
+			fields: []string{"spec.vault.object.type"},
+		},
+		{
+			name:   "missing object type",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Vault.Object.Type = "" },
+			fields: []string{"spec.vault.object.type"},
+		},
+		{
+			name: "missing data keys",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Output.ConfigMap.Name = "my-config"
+			},
+			fields: []string{"spec.output.secret.dataKey", "spec.output.configMap.dataKey"},
+		},
+		{
+			name: "secret type with own keys",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.DataKey = ""
+				akvs.Spec.Output.Secret.Type = corev1.SecretTypeBasicAuth
+			},
+		},
+		{
+			name: "multi key value secret",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+				akvs.Spec.Output.Secret.DataKey = ""
+			},
+		},
+		{
+			name: "invalid output names",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.Name = "My_Secret"
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{{ConfigMap: akv.AzureKeyVaultOutputConfigMap{Name: "-config", DataKey: "password"}}}
+			},
+			fields: []string{"spec.output.secret.name", "spec.outputs[0].configMap.name"},
+		},
+		{
+			name: "output keys",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeMultiKeyValueSecret
+				akvs.Spec.Output = akv.AzureKeyVaultOutput{}
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{
+					{Secret: akv.AzureKeyVaultOutputSecret{Name: "app", Keys: []string{"username", "password"}}},
+					{ConfigMap: akv.AzureKeyVaultOutputConfigMap{Name: "settings", Keys: []string{"host", "port"}}},
+				}
+			},
+		},
+		{
+			name: "invalid output keys",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.Keys = []string{"password", "password"}
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{{ConfigMap: akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "password", Keys: []string{"not valid"}}}}
+			},
+			fields: []string{"spec.output.secret.keys[1]", "spec.outputs[0].configMap.keys[0]"},
+		},
+		{
+			name: "preserve unmanaged keys with replaceAll",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.MergeStrategy = akv.AzureKeyVaultMergeStrategyReplaceAll
+				akvs.Spec.Output.Secret.PreserveUnmanagedKeys = true
+			},
+			fields: []string{"spec.output.secret.preserveUnmanagedKeys"},
+		},
+		{
+			name: "reclaim policy agreeing with delete policy",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.ReclaimPolicy = akv.AzureKeyVaultDeletePolicyRetain
+				akvs.Spec.Outputs = []akv.AzureKeyVaultOutput{{
+					ConfigMap:    akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "password", ReclaimPolicy: akv.AzureKeyVaultDeletePolicyRetain},
+					DeletePolicy: akv.AzureKeyVaultDeletePolicyRetain,
+				}}
+			},
+		},
+		{
+			name: "reclaim policy contradicting delete policy",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.DeletePolicy = akv.AzureKeyVaultDeletePolicyDelete
+				akvs.Spec.Output.Secret.ReclaimPolicy = akv.AzureKeyVaultDeletePolicyRetain
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "password", ReclaimPolicy: akv.AzureKeyVaultDeletePolicyDelete}
+			},
+			fields: []string{"spec.output.secret.reclaimPolicy"},
+		},
+		{
+			name: "key filters",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.IncludeKeys = []string{"DB_*", "API_KEY"}
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "password", ExcludeKeys: []string{"*_PASSWORD"}}
+			},
+		},
+		{
+			name: "invalid key filters",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.IncludeKeys = []string{"DB_[", ""}
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "password", ExcludeKeys: []string{"[]"}}
+			},
+			fields: []string{"spec.output.secret.includeKeys[0]", "spec.output.secret.includeKeys[1]", "spec.output.configMap.excludeKeys[0]"},
+		},
+		{
+			name: "key prefix and suffix",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.KeyPrefix = "APP_DB_"
+				akvs.Spec.Output.Secret.KeySuffix = ".txt"
+			},
+		},
+		{
+			name: "key transform agreeing with data key case",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.KeyTransform = akv.AzureKeyVaultKeyTransformSnakeUpper
+				akvs.Spec.Output.Secret.DataKeyCase = akv.AzureKeyVaultDataKeyCaseUpperSnake
+			},
+		},
+		{
+			name: "key transform contradicting data key case",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.KeyTransform = akv.AzureKeyVaultKeyTransformUpper
+				akvs.Spec.Output.Secret.DataKeyCase = akv.AzureKeyVaultDataKeyCaseLower
+			},
+			fields: []string{"spec.output.secret.keyTransform"},
+		},
+		{
+			name: "unknown key transform",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.KeyTransform = "camel"
+			},
+			fields: []string{"spec.output.secret.keyTransform"},
+		},
+		{
+			name: "invalid key prefix",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.KeyPrefix = "APP DB/"
+			},
+			fields: []string{"spec.output.secret.keyPrefix"},
+		},
+		{
+			name: "keystore",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeCertificate
+				akvs.Spec.Output.Secret.Keystore = &akv.AzureKeyVaultOutputKeystore{
+					Format:            akv.AzureKeyVaultKeystoreFormatJKS,
+					PasswordSecretRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "keystore"}, Key: "password"},
+				}
+			},
+		},
+		{
+			name: "invalid keystore",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Secret.Keystore = &akv.AzureKeyVaultOutputKeystore{
+					Format:            "pem",
+					PasswordSecretRef: &corev1.SecretKeySelector{Key: "password"},
+					DataKey:           "key store",
+				}
+			},
+			fields: []string{
+				"spec.output.secret.keystore",
+				"spec.output.secret.keystore.format",
+				"spec.output.secret.keystore.passwordSecretRef",
+				"spec.output.secret.keystore.dataKey",
+			},
+		},
+		{
+			name: "jwks with previous key versions",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeKey
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "jwks", DataKey: "jwks.json"}
+				akvs.Spec.Output.ConfigMap.Key = akv.AzureKeyVaultOutputKey{Encoding: akv.AzureKeyVaultKeyEncodingJWKS, IncludePreviousVersions: 2}
+			},
+		},
+		{
+			name: "previous key versions without jwks",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Vault.Object.Type = akv.AzureKeyVaultObjectTypeKey
+				akvs.Spec.Output.Secret.Key = akv.AzureKeyVaultOutputKey{Encoding: akv.AzureKeyVaultKeyEncodingPem, IncludePreviousVersions: 2}
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "jwks", DataKey: "jwks.json"}
+				akvs.Spec.Output.ConfigMap.Key = akv.AzureKeyVaultOutputKey{Encoding: akv.AzureKeyVaultKeyEncodingJWKS, IncludePreviousVersions: -1}
+			},
+			fields: []string{"spec.output.secret.key.includePreviousVersions", "spec.output.configMap.key.includePreviousVersions"},
+		},
+		{
+			name: "base64decode to configmap",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "license"}
+				akvs.Spec.Output.Transform = []string{"trim", "base64decode"}
+			},
+		},
+		{
+			name: "base64decode encoded again to configmap",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.ConfigMap = akv.AzureKeyVaultOutputConfigMap{Name: "settings", DataKey: "license"}
+				akvs.Spec.Output.Transform = []string{"base64decode", "base64encode"}
+			},
+		},
+		{
+			name: "invalid replace regex",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) {
+				akvs.Spec.Output.Transform = []string{"replace:|^postgres://||", "replace:/db-(/db/"}
+			},
+			fields: []string{"spec.output.transform[1]"},
+		},
+		{
+			name:   "unknown transform",
+			mutate: func(akvs *akv.AzureKeyVaultSecret) { akvs.Spec.Output.Transform = []string{"trim", "rot13"} },
+			fields: []string{"spec.output.transform[1]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akvs := validSecret()
+			tt.mutate(akvs)
+			errs := ValidateAzureKeyVaultSecret(akvs)
+			if len(errs) != len(tt.fields) {
+				t.Fatalf("expected errors for %v, but got %v", tt.fields, errs)
+			}
+			for i, err := range errs {
+				if err.Field != tt.fields[i] {
+					t.Errorf("expected error for %s, but got %v", tt.fields[i], err)
+				}
+			}
+		})
+	}
+}
@@ -25,6 +25,8 @@ limitations under the License.
 package v2beta1
 
 import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -47,8 +49,25 @@ func (in *AzureIdentity) DeepCopy() *AzureIdentity {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVault) DeepCopyInto(out *AzureKeyVault) {
 	*out = *in
-	out.Object = in.Object
+	in.Object.DeepCopyInto(&out.Object)
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]AzureKeyVaultObjectReference, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	out.AzureIdentity = in.AzureIdentity
+	if in.Fallback != nil {
+		in, out := &in.Fallback, &out.Fallback
+		*out = new(AzureKeyVaultFallback)
+		**out = **in
+	}
+	if in.CredentialsFrom != nil {
+		in, out := &in.CredentialsFrom, &out.CredentialsFrom
+		*out = new(AzureKeyVaultCredentialsFrom)
+		**out = **in
+	}
 	return
 }
 
@@ -62,9 +81,75 @@ func (in *AzureKeyVault) DeepCopy() *AzureKeyVault {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultCredentialsFrom) DeepCopyInto(out *AzureKeyVaultCredentialsFrom) {
+	*out = *in
+	out.SecretRef = in.SecretRef
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultCredentialsFrom.
+func (in *AzureKeyVaultCredentialsFrom) DeepCopy() *AzureKeyVaultCredentialsFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultCredentialsFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultDebouncedRotation) DeepCopyInto(out *AzureKeyVaultDebouncedRotation) {
+	*out = *in
+	in.DetectedTime.DeepCopyInto(&out.DetectedTime)
+	in.ApplyTime.DeepCopyInto(&out.ApplyTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultDebouncedRotation.
+func (in *AzureKeyVaultDebouncedRotation) DeepCopy() *AzureKeyVaultDebouncedRotation {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultDebouncedRotation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultFallback) DeepCopyInto(out *AzureKeyVaultFallback) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultFallback.
+func (in *AzureKeyVaultFallback) DeepCopy() *AzureKeyVaultFallback {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultFallback)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultObject) DeepCopyInto(out *AzureKeyVaultObject) {
 	*out = *in
+	if in.NameFrom != nil {
+		in, out := &in.NameFrom, &out.NameFrom
+		*out = new(AzureKeyVaultObjectNameFrom)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VersionFrom != nil {
+		in, out := &in.VersionFrom, &out.VersionFrom
+		*out = new(AzureKeyVaultObjectVersionFrom)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PollInterval != nil {
+		in, out := &in.PollInterval, &out.PollInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -78,16 +163,105 @@ func (in *AzureKeyVaultObject) DeepCopy() *AzureKeyVaultObject {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectNameFrom) DeepCopyInto(out *AzureKeyVaultObjectNameFrom) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectNameFrom.
+func (in *AzureKeyVaultObjectNameFrom) DeepCopy() *AzureKeyVaultObjectNameFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectNameFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectReference) DeepCopyInto(out *AzureKeyVaultObjectReference) {
+	*out = *in
+	if in.CredentialsFrom != nil {
+		in, out := &in.CredentialsFrom, &out.CredentialsFrom
+		*out = new(AzureKeyVaultCredentialsFrom)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectReference.
+func (in *AzureKeyVaultObjectReference) DeepCopy() *AzureKeyVaultObjectReference {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectStatus) DeepCopyInto(out *AzureKeyVaultObjectStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectStatus.
+func (in *AzureKeyVaultObjectStatus) DeepCopy() *AzureKeyVaultObjectStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultObjectVersionFrom) DeepCopyInto(out *AzureKeyVaultObjectVersionFrom) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultObjectVersionFrom.
+func (in *AzureKeyVaultObjectVersionFrom) DeepCopy() *AzureKeyVaultObjectVersionFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultObjectVersionFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultOutput) DeepCopyInto(out *AzureKeyVaultOutput) {
 	*out = *in
-	out.Secret = in.Secret
-	out.ConfigMap = in.ConfigMap
+	in.Secret.DeepCopyInto(&out.Secret)
+	in.ConfigMap.DeepCopyInto(&out.ConfigMap)
 	if in.Transform != nil {
 		in, out := &in.Transform, &out.Transform
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.RotationDebounce != nil {
+		in, out := &in.RotationDebounce, &out.RotationDebounce
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -101,9 +275,47 @@ func (in *AzureKeyVaultOutput) DeepCopy() *AzureKeyVaultOutput {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultOutputCertificate) DeepCopyInto(out *AzureKeyVaultOutputCertificate) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultOutputCertificate.
+func (in *AzureKeyVaultOutputCertificate) DeepCopy() *AzureKeyVaultOutputCertificate {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultOutputCertificate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultOutputConfigMap) DeepCopyInto(out *AzureKeyVaultOutputConfigMap) {
 	*out = *in
+	if in.Keys != nil {
+		in, out := &in.Keys, &out.Keys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IncludeKeys != nil {
+		in, out := &in.IncludeKeys, &out.IncludeKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeKeys != nil {
+		in, out := &in.ExcludeKeys, &out.ExcludeKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Key = in.Key
+	out.Certificate = in.Certificate
+	if in.TemplateFrom != nil {
+		in, out := &in.TemplateFrom, &out.TemplateFrom
+		*out = new(AzureKeyVaultOutputTemplateFrom)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -117,9 +329,78 @@ func (in *AzureKeyVaultOutputConfigMap) DeepCopy() *AzureKeyVaultOutputConfigMap
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultOutputKey) DeepCopyInto(out *AzureKeyVaultOutputKey) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultOutputKey.
+func (in *AzureKeyVaultOutputKey) DeepCopy() *AzureKeyVaultOutputKey {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultOutputKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultOutputKeystore) DeepCopyInto(out *AzureKeyVaultOutputKeystore) {
+	*out = *in
+	if in.PasswordSecretRef != nil {
+		in, out := &in.PasswordSecretRef, &out.PasswordSecretRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultOutputKeystore.
+func (in *AzureKeyVaultOutputKeystore) DeepCopy() *AzureKeyVaultOutputKeystore {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultOutputKeystore)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultOutputSecret) DeepCopyInto(out *AzureKeyVaultOutputSecret) {
 	*out = *in
+	if in.Keys != nil {
+		in, out := &in.Keys, &out.Keys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IncludeKeys != nil {
+		in, out := &in.IncludeKeys, &out.IncludeKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeKeys != nil {
+		in, out := &in.ExcludeKeys, &out.ExcludeKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Key = in.Key
+	out.Certificate = in.Certificate
+	if in.Keystore != nil {
+		in, out := &in.Keystore, &out.Keystore
+		*out = new(AzureKeyVaultOutputKeystore)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ChecksumAnnotationTargets != nil {
+		in, out := &in.ChecksumAnnotationTargets, &out.ChecksumAnnotationTargets
+		*out = make([]AzureKeyVaultWorkloadReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.TemplateFrom != nil {
+		in, out := &in.TemplateFrom, &out.TemplateFrom
+		*out = new(AzureKeyVaultOutputTemplateFrom)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -133,6 +414,89 @@ func (in *AzureKeyVaultOutputSecret) DeepCopy() *AzureKeyVaultOutputSecret {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultOutputStatus) DeepCopyInto(out *AzureKeyVaultOutputStatus) {
+	*out = *in
+	if in.Keys != nil {
+		in, out := &in.Keys, &out.Keys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultOutputStatus.
+func (in *AzureKeyVaultOutputStatus) DeepCopy() *AzureKeyVaultOutputStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultOutputStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultOutputTemplateFrom) DeepCopyInto(out *AzureKeyVaultOutputTemplateFrom) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultOutputTemplateFrom.
+func (in *AzureKeyVaultOutputTemplateFrom) DeepCopy() *AzureKeyVaultOutputTemplateFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultOutputTemplateFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultPreviousVersion) DeepCopyInto(out *AzureKeyVaultPreviousVersion) {
+	*out = *in
+	in.ResolvedTime.DeepCopyInto(&out.ResolvedTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultPreviousVersion.
+func (in *AzureKeyVaultPreviousVersion) DeepCopy() *AzureKeyVaultPreviousVersion {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultPreviousVersion)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultRetiredOutput) DeepCopyInto(out *AzureKeyVaultRetiredOutput) {
+	*out = *in
+	in.RetiredTime.DeepCopyInto(&out.RetiredTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultRetiredOutput.
+func (in *AzureKeyVaultRetiredOutput) DeepCopy() *AzureKeyVaultRetiredOutput {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultRetiredOutput)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecret) DeepCopyInto(out *AzureKeyVaultSecret) {
 	*out = *in
@@ -161,6 +525,23 @@ func (in *AzureKeyVaultSecret) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultSecretClaim) DeepCopyInto(out *AzureKeyVaultSecretClaim) {
+	*out = *in
+	in.RenewTime.DeepCopyInto(&out.RenewTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultSecretClaim.
+func (in *AzureKeyVaultSecretClaim) DeepCopy() *AzureKeyVaultSecretClaim {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultSecretClaim)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecretList) DeepCopyInto(out *AzureKeyVaultSecretList) {
 	*out = *in
@@ -194,11 +575,40 @@ func (in *AzureKeyVaultSecretList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultSecretReferencedBy) DeepCopyInto(out *AzureKeyVaultSecretReferencedBy) {
+	*out = *in
+	if in.Workloads != nil {
+		in, out := &in.Workloads, &out.Workloads
+		*out = make([]AzureKeyVaultWorkloadReference, len(*in))
+		copy(*out, *in)
+	}
+	in.LastRefreshed.DeepCopyInto(&out.LastRefreshed)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultSecretReferencedBy.
+func (in *AzureKeyVaultSecretReferencedBy) DeepCopy() *AzureKeyVaultSecretReferencedBy {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultSecretReferencedBy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecretSpec) DeepCopyInto(out *AzureKeyVaultSecretSpec) {
 	*out = *in
-	out.Vault = in.Vault
+	in.Vault.DeepCopyInto(&out.Vault)
 	in.Output.DeepCopyInto(&out.Output)
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = make([]AzureKeyVaultOutput, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -215,7 +625,87 @@ func (in *AzureKeyVaultSecretSpec) DeepCopy() *AzureKeyVaultSecretSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureKeyVaultSecretStatus) DeepCopyInto(out *AzureKeyVaultSecretStatus) {
 	*out = *in
+	if in.SecretKeys != nil {
+		in, out := &in.SecretKeys, &out.SecretKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	in.LastAzureUpdate.DeepCopyInto(&out.LastAzureUpdate)
+	if in.ConfigMapKeys != nil {
+		in, out := &in.ConfigMapKeys, &out.ConfigMapKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PredictedRenewalTime != nil {
+		in, out := &in.PredictedRenewalTime, &out.PredictedRenewalTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ReferencedBy != nil {
+		in, out := &in.ReferencedBy, &out.ReferencedBy
+		*out = new(AzureKeyVaultSecretReferencedBy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = make([]AzureKeyVaultOutputStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]AzureKeyVaultObjectStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.SanitizedKeys != nil {
+		in, out := &in.SanitizedKeys, &out.SanitizedKeys
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.NextAzurePollTime != nil {
+		in, out := &in.NextAzurePollTime, &out.NextAzurePollTime
+		*out = (*in).DeepCopy()
+	}
+	if in.ChecksumAnnotationTargets != nil {
+		in, out := &in.ChecksumAnnotationTargets, &out.ChecksumAnnotationTargets
+		*out = make([]AzureKeyVaultWorkloadReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.RetiredConfigMaps != nil {
+		in, out := &in.RetiredConfigMaps, &out.RetiredConfigMaps
+		*out = make([]AzureKeyVaultRetiredOutput, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PreviousVersion != nil {
+		in, out := &in.PreviousVersion, &out.PreviousVersion
+		*out = new(AzureKeyVaultPreviousVersion)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VaultObjectUpdated != nil {
+		in, out := &in.VaultObjectUpdated, &out.VaultObjectUpdated
+		*out = (*in).DeepCopy()
+	}
+	if in.Claim != nil {
+		in, out := &in.Claim, &out.Claim
+		*out = new(AzureKeyVaultSecretClaim)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DebouncedRotation != nil {
+		in, out := &in.DebouncedRotation, &out.DebouncedRotation
+		*out = new(AzureKeyVaultDebouncedRotation)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -228,3 +718,19 @@ func (in *AzureKeyVaultSecretStatus) DeepCopy() *AzureKeyVaultSecretStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureKeyVaultWorkloadReference) DeepCopyInto(out *AzureKeyVaultWorkloadReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureKeyVaultWorkloadReference.
+func (in *AzureKeyVaultWorkloadReference) DeepCopy() *AzureKeyVaultWorkloadReference {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureKeyVaultWorkloadReference)
+	in.DeepCopyInto(out)
+	return out
+}